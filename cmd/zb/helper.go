@@ -0,0 +1,428 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dspec "github.com/opencontainers/distribution-spec"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go"
+	imeta "github.com/opencontainers/image-spec/specs-go/v1"
+	"gopkg.in/resty.v1"
+)
+
+const (
+	KiB = 1 * 1024
+	MiB = 1 * KiB * 1024
+
+	smallBlob  = 1 * MiB
+	mediumBlob = 10 * MiB
+	largeBlob  = 100 * MiB
+
+	// percentiles reported for each test.
+	p50 = 0.5
+	p75 = 0.75
+	p90 = 0.9
+	p99 = 0.99
+)
+
+type testFunc func(baseURL, repo string, blob *testBlob, id int) (int, error)
+
+type testConfig struct {
+	name  string
+	tfunc testFunc
+	size  int
+}
+
+// testBlob is a synthetic single-layer image used by the push/pull tests.
+type testBlob struct {
+	layer          []byte
+	layerDigest    godigest.Digest
+	config         []byte
+	configDigest   godigest.Digest
+	manifest       []byte
+	manifestDigest godigest.Digest
+}
+
+type durationList []time.Duration
+
+func (a durationList) Len() int           { return len(a) }
+func (a durationList) Less(i, j int) bool { return a[i] < a[j] }
+func (a durationList) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+type statsSummary struct {
+	Name        string        `json:"name"`
+	Total       time.Duration `json:"total"`
+	Min         time.Duration `json:"min"`
+	Max         time.Duration `json:"max"`
+	Mean        time.Duration `json:"mean"`
+	P50         time.Duration `json:"p50"`
+	P75         time.Duration `json:"p75"`
+	P90         time.Duration `json:"p90"`
+	P99         time.Duration `json:"p99"`
+	Requests    int           `json:"requests"`
+	Errors      int           `json:"errors"`
+	RPS         float64       `json:"requestsPerSec"`
+	Throughput  float64       `json:"bytesPerSec"`
+	StatusCodes map[int]int   `json:"statusCodes"`
+}
+
+type statsRecord struct {
+	latency    time.Duration
+	statusCode int
+	isError    bool
+}
+
+func printVersion() {
+	fmt.Printf("distribution-spec: %s, commit: %s\n", dspec.Version, Commit)
+}
+
+// newTestBlob generates (or reuses from workdir) a random layer of the given size
+// and builds a valid OCI config and manifest around it.
+func newTestBlob(workdir string, size int) *testBlob {
+	dir := path.Join(workdir, "zb-data")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		panic(err)
+	}
+
+	fname := path.Join(dir, fmt.Sprintf("layer-%d", size))
+
+	layer, err := ioutil.ReadFile(fname)
+	if err != nil || len(layer) != size {
+		layer = make([]byte, size)
+		if _, err := rand.Read(layer); err != nil {
+			panic(err)
+		}
+
+		if err := ioutil.WriteFile(fname, layer, 0600); err != nil {
+			panic(err)
+		}
+	}
+
+	tb := &testBlob{layer: layer, layerDigest: godigest.FromBytes(layer)}
+
+	cfg := imeta.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS: imeta.RootFS{
+			Type:    "layers",
+			DiffIDs: []godigest.Digest{tb.layerDigest},
+		},
+	}
+
+	tb.config, err = json.Marshal(cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	tb.configDigest = godigest.FromBytes(tb.config)
+
+	m := imeta.Manifest{
+		Versioned: ispec.Versioned{SchemaVersion: 2},
+		Config: imeta.Descriptor{
+			MediaType: imeta.MediaTypeImageConfig,
+			Digest:    tb.configDigest,
+			Size:      int64(len(tb.config)),
+		},
+		Layers: []imeta.Descriptor{
+			{
+				MediaType: imeta.MediaTypeImageLayer,
+				Digest:    tb.layerDigest,
+				Size:      int64(len(tb.layer)),
+			},
+		},
+	}
+
+	tb.manifest, err = json.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+
+	tb.manifestDigest = godigest.FromBytes(tb.manifest)
+
+	return tb
+}
+
+func location(baseURL string, resp *resty.Response) string {
+	loc := resp.Header().Get("Location")
+	if strings.HasPrefix(loc, "/") {
+		return baseURL + loc
+	}
+
+	return loc
+}
+
+func pushBlob(baseURL, repo string, content []byte, digest godigest.Digest) (int, error) {
+	resp, err := resty.R().Post(fmt.Sprintf("%s/v2/%s/blobs/uploads/", baseURL, repo))
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.StatusCode() != http.StatusAccepted {
+		return resp.StatusCode(), fmt.Errorf("unexpected status code %d", resp.StatusCode()) // nolint: goerr113
+	}
+
+	resp, err = resty.R().
+		SetQueryParam("digest", digest.String()).
+		SetHeader("Content-Type", "application/octet-stream").
+		SetBody(content).
+		Put(location(baseURL, resp))
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.StatusCode() != http.StatusCreated {
+		return resp.StatusCode(), fmt.Errorf("unexpected status code %d", resp.StatusCode()) // nolint: goerr113
+	}
+
+	return resp.StatusCode(), nil
+}
+
+func pushMonolithImage(baseURL, repo string, blob *testBlob, id int) (int, error) {
+	if sc, err := pushBlob(baseURL, repo, blob.layer, blob.layerDigest); err != nil {
+		return sc, err
+	}
+
+	if sc, err := pushBlob(baseURL, repo, blob.config, blob.configDigest); err != nil {
+		return sc, err
+	}
+
+	resp, err := resty.R().
+		SetHeader("Content-Type", imeta.MediaTypeImageManifest).
+		SetBody(blob.manifest).
+		Put(fmt.Sprintf("%s/v2/%s/manifests/%d-%d", baseURL, repo, len(blob.layer), id))
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.StatusCode() != http.StatusCreated {
+		return resp.StatusCode(), fmt.Errorf("unexpected status code %d", resp.StatusCode()) // nolint: goerr113
+	}
+
+	return resp.StatusCode(), nil
+}
+
+func pullImage(baseURL, repo string, blob *testBlob, id int) (int, error) {
+	resp, err := resty.R().
+		SetHeader("Accept", imeta.MediaTypeImageManifest).
+		Get(fmt.Sprintf("%s/v2/%s/manifests/%s", baseURL, repo, blob.manifestDigest))
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.StatusCode() != http.StatusOK {
+		return resp.StatusCode(), fmt.Errorf("unexpected status code %d", resp.StatusCode()) // nolint: goerr113
+	}
+
+	for _, d := range []godigest.Digest{blob.configDigest, blob.layerDigest} {
+		resp, err = resty.R().Get(fmt.Sprintf("%s/v2/%s/blobs/%s", baseURL, repo, d))
+		if err != nil {
+			return 0, err
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			return resp.StatusCode(), fmt.Errorf("unexpected status code %d", resp.StatusCode()) // nolint: goerr113
+		}
+	}
+
+	return resp.StatusCode(), nil
+}
+
+func getCatalog(baseURL, repo string, blob *testBlob, id int) (int, error) {
+	resp, err := resty.R().Get(baseURL + "/v2/_catalog")
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.StatusCode() != http.StatusOK {
+		return resp.StatusCode(), fmt.Errorf("unexpected status code %d", resp.StatusCode()) // nolint: goerr113
+	}
+
+	return resp.StatusCode(), nil
+}
+
+// nolint: gochecknoglobals
+var testSuite = []testConfig{
+	{name: "Get Catalog", tfunc: getCatalog},
+	{name: "Push Monolith 1MB", tfunc: pushMonolithImage, size: smallBlob},
+	{name: "Push Monolith 10MB", tfunc: pushMonolithImage, size: mediumBlob},
+	{name: "Push Monolith 100MB", tfunc: pushMonolithImage, size: largeBlob},
+	{name: "Pull 1MB", tfunc: pullImage, size: smallBlob},
+	{name: "Pull 10MB", tfunc: pullImage, size: mediumBlob},
+	{name: "Pull 100MB", tfunc: pullImage, size: largeBlob},
+}
+
+func runTest(baseURL, repo string, tc testConfig, blob *testBlob, concurrency, requests int) statsSummary {
+	var wg sync.WaitGroup
+
+	ids := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		ids <- i
+	}
+
+	close(ids)
+
+	records := make(chan statsRecord, requests)
+
+	start := time.Now()
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for id := range ids {
+				t := time.Now()
+				sc, err := tc.tfunc(baseURL, repo, blob, id)
+				records <- statsRecord{latency: time.Since(t), statusCode: sc, isError: err != nil}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(records)
+
+	total := time.Since(start)
+
+	return summarize(tc, total, records)
+}
+
+func summarize(tc testConfig, total time.Duration, records <-chan statsRecord) statsSummary {
+	s := statsSummary{Name: tc.name, Total: total, StatusCodes: map[int]int{}}
+
+	var latencies durationList
+
+	var sum time.Duration
+
+	for r := range records {
+		s.Requests++
+		s.StatusCodes[r.statusCode]++
+
+		if r.isError {
+			s.Errors++
+		}
+
+		latencies = append(latencies, r.latency)
+		sum += r.latency
+	}
+
+	if len(latencies) == 0 {
+		return s
+	}
+
+	sort.Sort(latencies)
+
+	s.Min = latencies[0]
+	s.Max = latencies[len(latencies)-1]
+	s.Mean = sum / time.Duration(len(latencies))
+	s.P50 = percentile(latencies, p50)
+	s.P75 = percentile(latencies, p75)
+	s.P90 = percentile(latencies, p90)
+	s.P99 = percentile(latencies, p99)
+
+	if total > 0 {
+		s.RPS = float64(s.Requests) / total.Seconds()
+		s.Throughput = float64((s.Requests-s.Errors)*tc.size) / total.Seconds()
+	}
+
+	return s
+}
+
+// percentile expects a sorted list of latencies.
+func percentile(latencies durationList, p float64) time.Duration {
+	i := int(float64(len(latencies))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	if i >= len(latencies) {
+		i = len(latencies) - 1
+	}
+
+	return latencies[i]
+}
+
+func printStats(s statsSummary) {
+	fmt.Printf("============\n")
+	fmt.Printf("Test name:\t%s\n", s.Name)
+	fmt.Printf("Time taken for tests:\t%v\n", s.Total)
+	fmt.Printf("Complete requests:\t%d\n", s.Requests-s.Errors)
+	fmt.Printf("Failed requests:\t%d\n", s.Errors)
+	fmt.Printf("Requests per second:\t%f\n", s.RPS)
+
+	if s.Throughput > 0 {
+		fmt.Printf("Throughput (MiB/s):\t%f\n", s.Throughput/MiB)
+	}
+
+	fmt.Printf("\n")
+
+	codes := make([]int, 0, len(s.StatusCodes))
+	for code := range s.StatusCodes {
+		codes = append(codes, code)
+	}
+
+	sort.Ints(codes)
+
+	for _, code := range codes {
+		fmt.Printf("%d responses:\t%d\n", code, s.StatusCodes[code])
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf("min:\t%v\n", s.Min)
+	fmt.Printf("max:\t%v\n", s.Max)
+	fmt.Printf("mean:\t%v\n", s.Mean)
+	fmt.Printf("p50:\t%v\n", s.P50)
+	fmt.Printf("p75:\t%v\n", s.P75)
+	fmt.Printf("p90:\t%v\n", s.P90)
+	fmt.Printf("p99:\t%v\n", s.P99)
+	fmt.Printf("\n")
+}
+
+// Perf runs the benchmark test suite against a zot endpoint.
+func Perf(workdir, url, repo, outFmt string, concurrency, requests int) {
+	url = strings.TrimSuffix(url, "/")
+
+	fmt.Printf("Registry URL:\t%s\n", url)
+	fmt.Printf("\n")
+	fmt.Printf("Concurrency Level:\t%v\n", concurrency)
+	fmt.Printf("Total requests:\t%v\n", requests)
+	fmt.Printf("Working dir:\t%v\n", workdir)
+	fmt.Printf("\n")
+
+	summaries := []statsSummary{}
+	blobs := map[int]*testBlob{}
+
+	for _, tc := range testSuite {
+		blob, ok := blobs[tc.size]
+		if !ok && tc.size > 0 {
+			blob = newTestBlob(workdir, tc.size)
+			blobs[tc.size] = blob
+		}
+
+		s := runTest(url, repo, tc, blob, concurrency, requests)
+		summaries = append(summaries, s)
+
+		if outFmt != "json" {
+			printStats(s)
+		}
+	}
+
+	if outFmt == "json" {
+		buf, err := json.MarshalIndent(summaries, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Println(string(buf))
+	}
+}
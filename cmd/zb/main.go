@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/spf13/cobra"
+)
+
+// Commit is set at build time via ldflags.
+var Commit string //nolint: gochecknoglobals
+
+// "zb" - performance benchmark and stress.
+func NewPerfRootCmd() *cobra.Command {
+	showVersion := false
+
+	var workdir, repo, outFmt string
+
+	var concurrency, requests int
+
+	rootCmd := &cobra.Command{
+		Use:   "zb <url>",
+		Short: "`zb`",
+		Long:  "`zb`",
+		Run: func(cmd *cobra.Command, args []string) {
+			if showVersion {
+				printVersion()
+				return
+			}
+
+			if len(args) == 0 {
+				_ = cmd.Usage()
+				cmd.SilenceErrors = false
+
+				return
+			}
+
+			if requests < concurrency {
+				panic(errors.ErrInvalidArgs)
+			}
+
+			if workdir == "" {
+				cwd, err := os.Getwd()
+				if err != nil {
+					panic(err)
+				}
+
+				workdir = cwd
+			}
+
+			Perf(workdir, args[0], repo, outFmt, concurrency, requests)
+		},
+	}
+
+	rootCmd.Flags().StringVarP(&workdir, "working-dir", "d", "",
+		"Use specified directory to store test data")
+	rootCmd.Flags().StringVarP(&repo, "repo", "r", "zb",
+		"Use specified repository name to push/pull test images")
+	rootCmd.Flags().StringVarP(&outFmt, "output-format", "o", "",
+		"Output format of test results: text (default), json")
+	rootCmd.Flags().IntVarP(&concurrency, "concurrency", "c", 1,
+		"Number of multiple requests to make at a time")
+	rootCmd.Flags().IntVarP(&requests, "requests", "n", 1,
+		"Number of requests to perform")
+	rootCmd.Flags().BoolVarP(&showVersion, "version", "v", false, "show the version and exit")
+
+	return rootCmd
+}
+
+func main() {
+	if err := NewPerfRootCmd().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
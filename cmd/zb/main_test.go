@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIntegration(t *testing.T) {
+	oldArgs := os.Args
+
+	defer func() { os.Args = oldArgs }()
+
+	Convey("Test usage", t, func(c C) {
+		os.Args = []string{"zb", "-h"}
+		So(NewPerfRootCmd().Execute(), ShouldBeNil)
+	})
+
+	Convey("Test version", t, func(c C) {
+		os.Args = []string{"zb", "--version"}
+		So(NewPerfRootCmd().Execute(), ShouldBeNil)
+	})
+
+	Convey("Test invalid args", t, func(c C) {
+		os.Args = []string{"zb", "-c", "2", "-n", "1", "http://127.0.0.1:8080"}
+		So(func() { _ = NewPerfRootCmd().Execute() }, ShouldPanic)
+	})
+}
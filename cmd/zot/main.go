@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"os"
 
 	"github.com/anuvu/zot/pkg/cli"
@@ -8,6 +9,11 @@ import (
 
 func main() {
 	if err := cli.NewRootCmd().Execute(); err != nil {
+		var exitErr *cli.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
+
 		os.Exit(1)
 	}
 }
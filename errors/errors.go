@@ -7,13 +7,18 @@ var (
 	ErrRepoNotFound            = errors.New("repository: not found")
 	ErrRepoIsNotDir            = errors.New("repository: not a directory")
 	ErrRepoBadVersion          = errors.New("repository: unsupported layout version")
+	ErrRepoCorrupted           = errors.New("repository: failed integrity check")
 	ErrManifestNotFound        = errors.New("manifest: not found")
 	ErrBadManifest             = errors.New("manifest: invalid contents")
+	ErrTagImmutable            = errors.New("manifest: tag is immutable")
+	ErrMediaTypeNotAllowed     = errors.New("manifest: media type not allowed")
 	ErrUploadNotFound          = errors.New("uploads: not found")
 	ErrBadUploadRange          = errors.New("uploads: bad range")
 	ErrBlobNotFound            = errors.New("blob: not found")
 	ErrBadBlob                 = errors.New("blob: bad blob")
 	ErrBadBlobDigest           = errors.New("blob: bad blob digest")
+	ErrBlobTooLarge            = errors.New("blob: larger than the maximum size")
+	ErrBadRange                = errors.New("blob: range not satisfiable")
 	ErrUnknownCode             = errors.New("error: unknown error code")
 	ErrBadCACert               = errors.New("tls: invalid ca cert")
 	ErrBadUser                 = errors.New("ldap: non-existent user")
@@ -24,6 +29,8 @@ var (
 	ErrCacheRootBucket         = errors.New("cache: unable to create/update root bucket")
 	ErrCacheNoBucket           = errors.New("cache: unable to find bucket")
 	ErrCacheMiss               = errors.New("cache: miss")
+	ErrCacheNotFound           = errors.New("cache: db not found")
+	ErrCacheInUse              = errors.New("cache: db is in use by another process")
 	ErrRequireCred             = errors.New("ldap: bind credentials required")
 	ErrInvalidCred             = errors.New("ldap: invalid credentials")
 	ErrInvalidArgs             = errors.New("cli: Invalid Arguments")
@@ -36,5 +43,31 @@ var (
 	ErrIllegalConfigKey        = errors.New("cli: given config key is not allowed")
 	ErrScanNotSupported        = errors.New("search: scanning of image media type not supported")
 	ErrCLITimeout              = errors.New("cli: Query timed out while waiting for results")
+	ErrVulnerabilitiesFound    = errors.New("cli: vulnerabilities found")
 	ErrDuplicateConfigName     = errors.New("cli: cli config name already added")
+	ErrImgStoreNotFound        = errors.New("controller: image store not found")
+	ErrUnexpectedStatus        = errors.New("test: unexpected HTTP status code")
+	ErrConfigIncludeCycle      = errors.New("config: include cycle")
+	ErrPidfileInUse            = errors.New("cli: pidfile is in use by a running process")
+	ErrUpstreamBadResponse     = errors.New("upstream: unexpected response from registry")
+	ErrUpstreamUnauthorized    = errors.New("upstream: unauthorized by registry. check credentials")
+	ErrUpstreamDigestMismatch  = errors.New("upstream: content does not match the expected digest")
+	ErrEventsNotDelivered      = errors.New("events: endpoint failed to accept events")
+	ErrSnapshotNotFound        = errors.New("backup: snapshot not found")
+	ErrAdmissionFailed         = errors.New("admission: service failed to review push")
+	ErrBadPagination           = errors.New("pagination: invalid n or last query parameters")
+	ErrSoakInvariant           = errors.New("soak: invariant violated")
+	ErrS3Request               = errors.New("s3: request failed")
+	ErrPathNotFound            = errors.New("storage: path not found")
+	ErrDriverNotFound          = errors.New("storage: driver not registered")
+	ErrCacheDriverNotFound     = errors.New("cache: driver not registered")
+	ErrRedisReply              = errors.New("cache: unexpected redis reply")
+	ErrBadLayout               = errors.New("layout: invalid OCI image layout tar")
+	ErrStorageNotReady         = errors.New("storage: not a readable directory")
+	ErrOIDCProvider            = errors.New("oidc: unexpected response from provider")
+	ErrBadIDToken              = errors.New("oidc: invalid ID token")
+	ErrBadOIDCState            = errors.New("oidc: login state mismatch, expired or forged")
+	ErrBadAPIKey               = errors.New("apikey: invalid, revoked or expired API key")
+	ErrBadAPIKeyExpiry         = errors.New("apikey: expiry negative or beyond the maximum")
+	ErrAPIKeyNotFound          = errors.New("apikey: API key not found")
 )
@@ -0,0 +1,454 @@
+// Package actions runs configured actions on images once pushed, or once scanned, such as
+// tagging them stable when found free of vulnerabilities, so that such workflows can be
+// built inside zot.
+package actions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/bus"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/upstream"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	AfterPush = "push"
+	AfterScan = "scan"
+
+	// events waiting to be acted on, beyond which they are skipped.
+	queueSize = 1024
+
+	// how long a notified URL has to respond.
+	notifyTimeout = 10 * time.Second
+)
+
+type Config struct {
+	Rules        []RuleConfig
+	Destinations []DestinationConfig
+	// ReconcileInterval is how often images replicated to destinations are checked, and
+	// pushed again if incomplete there
+	ReconcileInterval time.Duration
+}
+
+// RuleConfig selects images by repository and tag, and lists the actions to run on them,
+// in this order: annotate, retag, notify and replicate.
+type RuleConfig struct {
+	Repositories []string // glob patterns, all if empty
+	Tags         string   // regex, all tags if empty
+	// After is when to act: AfterPush, by default, or AfterScan, once scanned on push
+	After string
+	// MaxVulnerabilities is how many vulnerabilities scanned images may have to be acted on
+	MaxVulnerabilities int
+
+	Annotations map[string]string // added to the manifest, pushed again under the same tag
+	Retag       []string          // tags to add
+	Notify      string            // URL the event is posted to
+	Replicate   []string          // names of the destinations to push to
+}
+
+// DestinationConfig names a registry images are replicated to.
+type DestinationConfig struct {
+	Name            string
+	upstream.Config `mapstructure:",squash" yaml:",inline"`
+}
+
+// Validate checks rules have actions, patterns and URLs are well-formed and destinations
+// replicated to are configured.
+func (c *Config) Validate(log log.Logger) error {
+	if c.ReconcileInterval < 0 {
+		log.Error().Str("reconcileInterval", c.ReconcileInterval.String()).Msg("invalid reconcile interval")
+		return errors.ErrBadConfig
+	}
+
+	destinations := map[string]bool{}
+
+	for _, d := range c.Destinations {
+		if d.Name == "" || d.URL == "" || destinations[d.Name] {
+			log.Error().Str("name", d.Name).Str("url", d.URL).Msg("unique name and URL of destination required")
+			return errors.ErrBadConfig
+		}
+
+		destinations[d.Name] = true
+	}
+
+	for _, r := range c.Rules {
+		if len(r.Annotations) == 0 && len(r.Retag) == 0 && r.Notify == "" && len(r.Replicate) == 0 {
+			log.Error().Msg("no action in rule")
+			return errors.ErrBadConfig
+		}
+
+		for _, p := range r.Repositories {
+			if _, err := path.Match(p, ""); err != nil {
+				log.Error().Err(err).Str("repositories", p).Msg("invalid rule repositories pattern")
+				return errors.ErrBadConfig
+			}
+		}
+
+		if _, err := regexp.Compile(r.Tags); err != nil {
+			log.Error().Err(err).Str("tags", r.Tags).Msg("invalid rule tags regex")
+			return errors.ErrBadConfig
+		}
+
+		if r.After != "" && r.After != AfterPush && r.After != AfterScan {
+			log.Error().Str("after", r.After).Msg("rule must run after push or scan")
+			return errors.ErrBadConfig
+		}
+
+		if r.MaxVulnerabilities < 0 {
+			log.Error().Int("maxVulnerabilities", r.MaxVulnerabilities).Msg("invalid rule vulnerabilities")
+			return errors.ErrBadConfig
+		}
+
+		if r.Notify != "" {
+			if u, err := url.Parse(r.Notify); err != nil || u.Host == "" {
+				log.Error().Err(err).Str("notify", r.Notify).Msg("invalid rule notify URL")
+				return errors.ErrBadConfig
+			}
+		}
+
+		for _, name := range r.Replicate {
+			if !destinations[name] {
+				log.Error().Str("replicate", name).Msg("unknown destination")
+				return errors.ErrBadConfig
+			}
+		}
+	}
+
+	return nil
+}
+
+type rule struct {
+	config *RuleConfig
+	tags   *regexp.Regexp
+}
+
+// Runner runs the actions of the rules matching the images pushed, or scanned, one event
+// at a time in the background, keeping track of the images replicated to destinations.
+type Runner struct {
+	is     storage.ImageStore
+	http   *http.Client
+	log    log.Logger
+	events chan bus.Event
+
+	configLock   sync.RWMutex // guards config, rules and destinations, replaced on reload
+	config       *Config
+	rules        []rule
+	destinations map[string]*upstream.Client
+
+	lock         sync.Mutex
+	replications map[string]*Replication // by destination, repository and tag
+}
+
+// NewRunner returns a runner of the rules of a valid config on the images of is.
+func NewRunner(config *Config, is storage.ImageStore, log log.Logger) (*Runner, error) {
+	rules, destinations, err := newRules(config, log)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Runner{config: config, rules: rules, destinations: destinations, is: is,
+		http: &http.Client{Timeout: notifyTimeout}, log: log, events: make(chan bus.Event, queueSize),
+		replications: map[string]*Replication{}}, nil
+}
+
+func newRules(config *Config, log log.Logger) ([]rule, map[string]*upstream.Client, error) {
+	rules := make([]rule, 0, len(config.Rules))
+
+	for i := range config.Rules {
+		rules = append(rules, rule{config: &config.Rules[i], tags: regexp.MustCompile(config.Rules[i].Tags)})
+	}
+
+	destinations := map[string]*upstream.Client{}
+
+	for _, d := range config.Destinations {
+		client, err := upstream.NewClient(d.Config, log)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		destinations[d.Name] = client
+	}
+
+	return rules, destinations, nil
+}
+
+// Reload replaces the rules and destinations with those of a valid config, the images
+// replicated to destinations removed being forgotten. The reconcile interval is as it was
+// when run.
+func (r *Runner) Reload(config *Config) error {
+	apply, err := r.PrepareReload(config)
+	if err != nil {
+		return err
+	}
+
+	apply()
+
+	return nil
+}
+
+// PrepareReload returns the function replacing the rules and destinations as Reload does, which
+// can't fail, so that they are replaced along with other settings or not at all.
+func (r *Runner) PrepareReload(config *Config) (func(), error) {
+	rules, destinations, err := newRules(config, r.log)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { r.replace(config, rules, destinations) }, nil
+}
+
+// replace replaces the rules and destinations, forgetting the images replicated to destinations
+// removed.
+func (r *Runner) replace(config *Config, rules []rule, destinations map[string]*upstream.Client) {
+	r.configLock.Lock()
+	r.config, r.rules, r.destinations = config, rules, destinations
+	r.configLock.Unlock()
+
+	r.lock.Lock()
+	for key, rep := range r.replications {
+		if _, ok := destinations[rep.Destination]; !ok {
+			delete(r.replications, key)
+		}
+	}
+	r.lock.Unlock()
+
+	r.log.Info().Int("rules", len(rules)).Int("destinations", len(destinations)).Msg("reloaded actions")
+}
+
+// destination returns the client of a destination, nil if not configured (anymore).
+func (r *Runner) destination(name string) *upstream.Client {
+	r.configLock.RLock()
+	defer r.configLock.RUnlock()
+
+	return r.destinations[name]
+}
+
+// Subscribe queues the images pushed, or scanned, to be acted on.
+func (r *Runner) Subscribe(b *bus.Bus) {
+	b.Subscribe(func(event bus.Event) {
+		select {
+		case r.events <- event:
+		default:
+			r.log.Warn().Str("repo", event.Repository).Str("reference", event.Reference).
+				Msg("too many events waiting for actions, skipping")
+		}
+	}, bus.ManifestPushed, bus.ImageScanned)
+}
+
+// Run acts on the events queued, and reconciles replications periodically, in the
+// background, until ctx is done.
+func (r *Runner) Run(ctx context.Context, wg *sync.WaitGroup) {
+	interval := r.config.ReconcileInterval
+	if interval == 0 {
+		interval = defaultReconcileInterval
+	}
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				r.log.Info().Msg("stopping actions")
+				return
+			case event := <-r.events:
+				r.Act(event)
+			case <-ticker.C:
+				r.Reconcile()
+			}
+		}
+	}()
+}
+
+// Act runs the actions of the rules matching an event, in the order configured. If a rule
+// annotates the image, the rules are left to run on the annotated image once pushed instead.
+func (r *Runner) Act(event bus.Event) {
+	// only images by tag are acted on
+	if event.MediaType != ispec.MediaTypeImageManifest {
+		return
+	}
+
+	if _, err := godigest.Parse(event.Reference); err == nil {
+		return
+	}
+
+	r.configLock.RLock()
+	rules := r.rules
+	r.configLock.RUnlock()
+
+	for _, rule := range rules {
+		if !rule.matches(event) {
+			continue
+		}
+
+		annotated, err := r.annotate(rule.config, event)
+		if err != nil {
+			r.log.Error().Err(err).Str("repo", event.Repository).Str("tag", event.Reference).
+				Msg("unable to annotate image")
+
+			continue
+		}
+
+		if annotated {
+			return
+		}
+
+		r.retag(rule.config, event)
+		r.notify(rule.config, event)
+		r.replicate(rule.config, event)
+	}
+}
+
+func (rl rule) matches(event bus.Event) bool {
+	switch rl.config.After {
+	case AfterScan:
+		if event.Type != bus.ImageScanned || event.Vulnerabilities > rl.config.MaxVulnerabilities {
+			return false
+		}
+	default:
+		if event.Type != bus.ManifestPushed {
+			return false
+		}
+	}
+
+	if !rl.tags.MatchString(event.Reference) {
+		return false
+	}
+
+	if len(rl.config.Repositories) == 0 {
+		return true
+	}
+
+	for _, p := range rl.config.Repositories {
+		if ok, _ := path.Match(p, event.Repository); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// annotate pushes the image again with the annotations of config added, returning false if
+// it has them already.
+func (r *Runner) annotate(config *RuleConfig, event bus.Event) (bool, error) {
+	if len(config.Annotations) == 0 {
+		return false, nil
+	}
+
+	body, _, _, err := r.is.GetImageManifest(event.Repository, event.Reference)
+	if err != nil {
+		return false, err
+	}
+
+	var manifest ispec.Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return false, err
+	}
+
+	if manifest.Annotations == nil {
+		manifest.Annotations = map[string]string{}
+	}
+
+	changed := false
+
+	for k, v := range config.Annotations {
+		if manifest.Annotations[k] != v {
+			manifest.Annotations[k] = v
+			changed = true
+		}
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	if body, err = json.Marshal(manifest); err != nil {
+		return false, err
+	}
+
+	if _, err := r.is.PutImageManifest(event.Repository, event.Reference, ispec.MediaTypeImageManifest,
+		body); err != nil {
+		return false, err
+	}
+
+	r.log.Info().Str("repo", event.Repository).Str("tag", event.Reference).Msg("annotated image")
+
+	return true, nil
+}
+
+func (r *Runner) retag(config *RuleConfig, event bus.Event) {
+	for _, tag := range config.Retag {
+		if tag == event.Reference {
+			continue
+		}
+
+		if _, digest, _, err := r.is.GetImageManifest(event.Repository, tag); err == nil && digest == event.Digest {
+			continue
+		}
+
+		body, _, _, err := r.is.GetImageManifest(event.Repository, event.Digest)
+		if err == nil {
+			_, err = r.is.PutImageManifest(event.Repository, tag, event.MediaType, body)
+		}
+
+		if err != nil {
+			r.log.Error().Err(err).Str("repo", event.Repository).Str("tag", tag).Msg("unable to retag image")
+			continue
+		}
+
+		r.log.Info().Str("repo", event.Repository).Str("tag", event.Reference).Str("retag", tag).Msg("retagged image")
+	}
+}
+
+func (r *Runner) notify(config *RuleConfig, event bus.Event) {
+	if config.Notify == "" {
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	resp, err := r.http.Post(config.Notify, "application/json", bytes.NewReader(body))
+	if err != nil {
+		r.log.Error().Err(err).Str("url", config.Notify).Msg("unable to notify of image")
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		r.log.Warn().Str("url", config.Notify).Int("status", resp.StatusCode).Msg("notified URL failed")
+	}
+}
+
+func (r *Runner) replicate(config *RuleConfig, event bus.Event) {
+	for _, name := range config.Replicate {
+		if err := r.push(name, event.Repository, event.Reference); err != nil {
+			r.log.Error().Err(err).Str("destination", name).Str("repo", event.Repository).
+				Str("tag", event.Reference).Msg("unable to replicate image")
+
+			continue
+		}
+
+		r.log.Info().Str("destination", name).Str("repo", event.Repository).Str("tag", event.Reference).
+			Msg("replicated image")
+	}
+}
@@ -0,0 +1,204 @@
+package actions_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/actions"
+	"github.com/anuvu/zot/pkg/bus"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	"github.com/anuvu/zot/pkg/upstream"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestActions(t *testing.T) {
+	Convey("Run actions on pushed images", t, func() {
+		log := log.NewLogger("debug", "")
+		b := bus.New(log)
+		is := bus.NewImageStore(storage.NewImageStoreMem(log), b)
+
+		registry := test.NewRegistry()
+		defer registry.Close()
+
+		var lock sync.Mutex
+
+		notified := []bus.Event{}
+
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var event bus.Event
+			if err := json.NewDecoder(r.Body).Decode(&event); err == nil {
+				lock.Lock()
+				notified = append(notified, event)
+				lock.Unlock()
+			}
+		}))
+		defer receiver.Close()
+
+		config := &actions.Config{
+			Rules: []actions.RuleConfig{
+				{
+					Repositories: []string{"apps/*"},
+					Tags:         `^v\d+$`,
+					Annotations:  map[string]string{"org.example.team": "apps"},
+					Notify:       receiver.URL,
+					Replicate:    []string{"dr"},
+				},
+				{
+					Repositories:       []string{"apps/*"},
+					Tags:               `^v\d+$`,
+					After:              actions.AfterScan,
+					MaxVulnerabilities: 0,
+					Retag:              []string{"stable"},
+				},
+			},
+			Destinations: []actions.DestinationConfig{{Name: "dr", Config: upstream.Config{URL: registry.URL}}},
+		}
+		So(config.Validate(log), ShouldBeNil)
+
+		r, err := actions.NewRunner(config, is, log)
+		So(err, ShouldBeNil)
+
+		// act synchronously, for the test
+		b.Subscribe(r.Act, bus.ManifestPushed, bus.ImageScanned)
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "apps/web", "v1"), ShouldBeNil)
+
+		body, digest, _, err := is.GetImageManifest("apps/web", "v1")
+		So(err, ShouldBeNil)
+
+		var manifest ispec.Manifest
+		So(json.Unmarshal(body, &manifest), ShouldBeNil)
+		So(manifest.Annotations["org.example.team"], ShouldEqual, "apps")
+
+		// the annotated image is notified of and replicated, not the one pushed
+		So(notified, ShouldHaveLength, 1)
+		So(notified[0].Digest, ShouldEqual, digest)
+
+		replicated, ok := registry.Manifest("apps/web", "v1")
+		So(ok, ShouldBeTrue)
+		So(replicated, ShouldResemble, body)
+
+		Convey("Retag images once scanned without vulnerabilities", func() {
+			b.Publish(bus.Event{Type: bus.ImageScanned, Repository: "apps/web", Reference: "v1", Digest: digest,
+				MediaType: ispec.MediaTypeImageManifest, Vulnerabilities: 2})
+
+			_, _, _, err := is.GetImageManifest("apps/web", "stable")
+			So(err, ShouldEqual, errors.ErrManifestNotFound)
+
+			b.Publish(bus.Event{Type: bus.ImageScanned, Repository: "apps/web", Reference: "v1", Digest: digest,
+				MediaType: ispec.MediaTypeImageManifest})
+
+			_, stable, _, err := is.GetImageManifest("apps/web", "stable")
+			So(err, ShouldBeNil)
+			So(stable, ShouldEqual, digest)
+		})
+
+		Convey("Repair incomplete replications", func() {
+			replications := r.Replications()
+			So(replications, ShouldHaveLength, 1)
+			So(replications[0].Destination, ShouldEqual, "dr")
+			So(replications[0].Digest, ShouldEqual, digest)
+			So(replications[0].State, ShouldEqual, actions.ReplicationReplicated)
+
+			// complete
+			So(r.Reconcile()[0].Repairs, ShouldEqual, 0)
+
+			layer := godigest.FromBytes(img.Layers[0]).String()
+			registry.DeleteBlob("apps/web", layer)
+
+			replications = r.Reconcile()
+			So(replications[0].Repairs, ShouldEqual, 1)
+			So(replications[0].State, ShouldEqual, actions.ReplicationReplicated)
+
+			_, ok := registry.Blob("apps/web", layer)
+			So(ok, ShouldBeTrue)
+
+			// removed here since
+			So(is.DeleteImageTag("apps/web", "v1"), ShouldBeNil)
+			So(r.Reconcile(), ShouldBeEmpty)
+		})
+
+		Convey("Record failed replications", func() {
+			registry.Close()
+
+			So(test.WriteImageToStore(img, is, "apps/web", "v2"), ShouldBeNil)
+
+			replications := r.Replications()
+			So(replications, ShouldHaveLength, 2)
+			So(replications[1].Tag, ShouldEqual, "v2")
+			So(replications[1].State, ShouldEqual, actions.ReplicationFailed)
+			So(replications[1].Error, ShouldNotBeEmpty)
+
+			status := r.Status()
+			So(status, ShouldHaveLength, 1)
+			So(status[0].Kind, ShouldEqual, "destination")
+			So(status[0].Name, ShouldEqual, "dr")
+			So(status[0].URL, ShouldEqual, registry.URL)
+			So(*status[0].LastSync, ShouldEqual, replications[0].Updated)
+			So(status[0].Lag, ShouldEqual, 1)
+			So(status[0].LastError, ShouldEqual, replications[1].Error)
+			So(status[0].BytesTransferred, ShouldBeGreaterThan, len(body))
+		})
+
+		Convey("Reload rules and destinations", func() {
+			So(r.Reload(&actions.Config{Rules: []actions.RuleConfig{
+				{Repositories: []string{"other"}, Retag: []string{"stable"}},
+			}}), ShouldBeNil)
+
+			// replicated to destinations removed
+			So(r.Replications(), ShouldBeEmpty)
+			So(r.Status(), ShouldBeEmpty)
+
+			So(test.WriteImageToStore(img, is, "apps/web", "v2"), ShouldBeNil)
+			So(test.WriteImageToStore(img, is, "other", "v1"), ShouldBeNil)
+
+			So(notified, ShouldHaveLength, 1)
+
+			_, ok := registry.Manifest("apps/web", "v2")
+			So(ok, ShouldBeFalse)
+
+			_, _, _, err := is.GetImageManifest("other", "stable")
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Leave other images alone", func() {
+			So(test.WriteImageToStore(img, is, "apps/web", "latest"), ShouldBeNil)
+			So(test.WriteImageToStore(img, is, "other", "v1"), ShouldBeNil)
+
+			So(notified, ShouldHaveLength, 1)
+
+			_, ok := registry.Manifest("other", "v1")
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("Validate actions configuration", t, func() {
+		log := log.NewLogger("debug", "")
+
+		dr := []actions.DestinationConfig{{Name: "dr", Config: upstream.Config{URL: "http://127.0.0.1"}}}
+
+		for _, config := range []*actions.Config{
+			{Rules: []actions.RuleConfig{{}}},
+			{Rules: []actions.RuleConfig{{Retag: []string{"stable"}, Tags: "("}}},
+			{Rules: []actions.RuleConfig{{Retag: []string{"stable"}, Repositories: []string{"["}}}},
+			{Rules: []actions.RuleConfig{{Retag: []string{"stable"}, After: "pull"}}},
+			{Rules: []actions.RuleConfig{{Notify: "not a URL"}}},
+			{Rules: []actions.RuleConfig{{Replicate: []string{"missing"}}}, Destinations: dr},
+			{Destinations: append(dr, dr...)},
+			{ReconcileInterval: -time.Minute},
+		} {
+			So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+		}
+	})
+}
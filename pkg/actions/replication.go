@@ -0,0 +1,201 @@
+package actions
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/upstream"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	ReplicationReplicated = "replicated"
+	ReplicationFailed     = "failed"
+
+	// how often replications are reconciled, if not configured.
+	defaultReconcileInterval = time.Hour
+)
+
+// Replication is the state of an image replicated to a destination, as last pushed or
+// reconciled.
+type Replication struct {
+	Destination string    `json:"destination"`
+	Repository  string    `json:"repository"`
+	Tag         string    `json:"tag"`
+	Digest      string    `json:"digest"`
+	State       string    `json:"state"`
+	Error       string    `json:"error,omitempty"`
+	Updated     time.Time `json:"updated"`
+	Repairs     int       `json:"repairs"` // times found incomplete at the destination, and pushed again
+}
+
+func replicationKey(destination string, repo string, tag string) string {
+	return destination + "/" + repo + ":" + tag
+}
+
+// Replications returns the state of the images replicated so far, by destination,
+// repository and tag.
+func (r *Runner) Replications() []Replication {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	replications := make([]Replication, 0, len(r.replications))
+	for _, rep := range r.replications {
+		replications = append(replications, *rep)
+	}
+
+	sort.Slice(replications, func(i, j int) bool {
+		a, b := replications[i], replications[j]
+		return replicationKey(a.Destination, a.Repository, a.Tag) < replicationKey(b.Destination, b.Repository, b.Tag)
+	})
+
+	return replications
+}
+
+// Status returns the health of replicating to each destination: it was last synced with when
+// an image was last replicated to it, and lags by the images which failed to be.
+func (r *Runner) Status() []upstream.Status {
+	replications := r.Replications()
+
+	r.configLock.RLock()
+	config, destinations := r.config, r.destinations
+	r.configLock.RUnlock()
+
+	statuses := make([]upstream.Status, 0, len(config.Destinations))
+
+	for _, d := range config.Destinations {
+		status := upstream.Status{Kind: "destination", Name: d.Name, URL: d.URL,
+			BytesTransferred: destinations[d.Name].Transferred()}
+
+		var lastFailure time.Time
+
+		for _, rep := range replications {
+			if rep.Destination != d.Name {
+				continue
+			}
+
+			updated := rep.Updated
+
+			switch {
+			case rep.State == ReplicationFailed:
+				status.Lag++
+
+				if updated.After(lastFailure) {
+					lastFailure, status.LastError = updated, rep.Error
+				}
+			case status.LastSync == nil || updated.After(*status.LastSync):
+				status.LastSync = &updated
+			}
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// push pushes an image to a destination, recording how it went.
+func (r *Runner) push(destination string, repo string, tag string) error {
+	client := r.destination(destination)
+	if client == nil {
+		// removed on reload meanwhile
+		return errors.ErrBadConfig
+	}
+
+	digest, err := client.PushImage(r.is, repo, tag)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := replicationKey(destination, repo, tag)
+
+	rep, ok := r.replications[key]
+	if !ok {
+		rep = &Replication{Destination: destination, Repository: repo, Tag: tag}
+		r.replications[key] = rep
+	}
+
+	rep.Updated = time.Now()
+
+	if err != nil {
+		rep.State, rep.Error = ReplicationFailed, err.Error()
+		return err
+	}
+
+	rep.Digest, rep.State, rep.Error = digest.String(), ReplicationReplicated, ""
+
+	return nil
+}
+
+// Reconcile checks every image replicated so far is complete at its destination, as it is
+// here now, i.e. the destination has its manifest under the same tag and all its blobs, and
+// pushes it again if not, or if replicating it failed. Images since removed here are
+// forgotten. It returns the state of the images replicated afterwards.
+func (r *Runner) Reconcile() []Replication {
+	for _, rep := range r.Replications() {
+		_, digest, _, err := r.is.GetImageManifest(rep.Repository, rep.Tag)
+		if err == errors.ErrRepoNotFound || err == errors.ErrManifestNotFound {
+			r.lock.Lock()
+			delete(r.replications, replicationKey(rep.Destination, rep.Repository, rep.Tag))
+			r.lock.Unlock()
+
+			continue
+		}
+
+		// replicated before its destination was removed
+		client := r.destination(rep.Destination)
+		if client == nil {
+			r.lock.Lock()
+			delete(r.replications, replicationKey(rep.Destination, rep.Repository, rep.Tag))
+			r.lock.Unlock()
+
+			continue
+		}
+
+		if rep.State == ReplicationReplicated && err == nil && rep.Digest == digest &&
+			complete(client, rep.Repository, rep.Tag, digest) {
+			continue
+		}
+
+		r.log.Warn().Str("destination", rep.Destination).Str("repo", rep.Repository).Str("tag", rep.Tag).
+			Str("state", rep.State).Msg("replication incomplete, pushing again")
+
+		if err := r.push(rep.Destination, rep.Repository, rep.Tag); err != nil {
+			r.log.Error().Err(err).Str("destination", rep.Destination).Str("repo", rep.Repository).
+				Str("tag", rep.Tag).Msg("unable to repair replication")
+
+			continue
+		}
+
+		r.lock.Lock()
+		r.replications[replicationKey(rep.Destination, rep.Repository, rep.Tag)].Repairs++
+		r.lock.Unlock()
+	}
+
+	return r.Replications()
+}
+
+// complete returns whether a registry has the manifest with the given digest under a tag,
+// and all the blobs it references.
+func complete(client *upstream.Client, repo string, tag string, digest string) bool {
+	body, _, d, err := client.GetManifest(repo, tag, ispec.MediaTypeImageManifest)
+	if err != nil || d != godigest.Digest(digest) {
+		return false
+	}
+
+	var manifest ispec.Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return false
+	}
+
+	for _, desc := range append([]ispec.Descriptor{manifest.Config}, manifest.Layers...) {
+		if ok, err := client.CheckBlob(repo, desc.Digest); err != nil || !ok {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,161 @@
+// Package admission lets an external service, such as a policy engine, accept or reject
+// manifests before they are pushed, e.g. those built on a banned base image or missing
+// required labels.
+package admission
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+)
+
+// how long the service has to decide, if not configured.
+const defaultTimeout = 5 * time.Second
+
+type Config struct {
+	URL          string
+	Headers      map[string]string // e.g. Authorization
+	Timeout      time.Duration
+	Repositories []string // glob patterns matching the repositories reviewed, all if empty
+	FailOpen     bool     // accept pushes when the service fails, instead of rejecting them
+}
+
+// Validate checks the URL is given and repository patterns are well-formed.
+func (c *Config) Validate(log log.Logger) error {
+	if c.URL == "" {
+		log.Error().Msg("admission service URL is required")
+		return errors.ErrBadConfig
+	}
+
+	if c.Timeout < 0 {
+		log.Error().Str("timeout", c.Timeout.String()).Msg("invalid admission timeout")
+		return errors.ErrBadConfig
+	}
+
+	for _, r := range c.Repositories {
+		if _, err := path.Match(r, ""); err != nil {
+			log.Error().Err(err).Str("repositories", r).Msg("invalid admission repositories pattern")
+			return errors.ErrBadConfig
+		}
+	}
+
+	return nil
+}
+
+// Request is what the service is posted about a push.
+type Request struct {
+	Repository string          `json:"repository"`
+	Reference  string          `json:"reference"`
+	Digest     string          `json:"digest"`
+	MediaType  string          `json:"mediaType"`
+	Manifest   json.RawMessage `json:"manifest"`
+	Config     json.RawMessage `json:"config,omitempty"` // of the image, if pushed already
+	Actor      string          `json:"actor,omitempty"`  // user pushing, if authenticated
+	Groups     []string        `json:"groups,omitempty"` // of the user, if authenticated with OpenID Connect
+	Addr       string          `json:"addr"`             // of the client pushing
+	UserAgent  string          `json:"useragent"`
+}
+
+// Response is the decision of the service, with a reason given back to the client if
+// rejected.
+type Response struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Reviewer submits pushes to the service for review.
+type Reviewer struct {
+	config *Config
+	client *http.Client
+	log    log.Logger
+}
+
+// NewReviewer returns a reviewer of pushes with the service of a valid config.
+func NewReviewer(config *Config, log log.Logger) *Reviewer {
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	return &Reviewer{config: config, client: &http.Client{Timeout: timeout}, log: log}
+}
+
+// Reviews returns whether pushes to repo are reviewed.
+func (r *Reviewer) Reviews(repo string) bool {
+	if len(r.config.Repositories) == 0 {
+		return true
+	}
+
+	for _, p := range r.config.Repositories {
+		if ok, _ := path.Match(p, repo); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Review returns whether the service accepts a push, which it does for repositories it
+// doesn't review. If the service fails to decide, the push is accepted only if configured
+// to fail open.
+func (r *Reviewer) Review(req Request) Response {
+	if !r.Reviews(req.Repository) {
+		return Response{Allowed: true}
+	}
+
+	resp, err := r.post(req)
+	if err != nil {
+		r.log.Error().Err(err).Str("url", r.config.URL).Str("repo", req.Repository).
+			Bool("failOpen", r.config.FailOpen).Msg("unable to review push")
+
+		return Response{Allowed: r.config.FailOpen, Reason: "admission service unavailable"}
+	}
+
+	if !resp.Allowed {
+		r.log.Info().Str("repo", req.Repository).Str("reference", req.Reference).Str("reason", resp.Reason).
+			Msg("push rejected by admission service")
+	}
+
+	return resp
+}
+
+func (r *Reviewer) post(req Request) (Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Response{}, err
+	}
+
+	hreq, err := http.NewRequest(http.MethodPost, r.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return Response{}, err
+	}
+
+	hreq.Header.Set("Content-Type", "application/json")
+
+	for k, v := range r.config.Headers {
+		hreq.Header.Set(k, v)
+	}
+
+	hresp, err := r.client.Do(hreq)
+	if err != nil {
+		return Response{}, err
+	}
+	defer hresp.Body.Close()
+
+	if hresp.StatusCode < http.StatusOK || hresp.StatusCode >= http.StatusMultipleChoices {
+		r.log.Warn().Str("url", r.config.URL).Int("status", hresp.StatusCode).Msg("admission service failed")
+		return Response{}, errors.ErrAdmissionFailed
+	}
+
+	var resp Response
+	if err := json.NewDecoder(hresp.Body).Decode(&resp); err != nil {
+		return Response{}, err
+	}
+
+	return resp, nil
+}
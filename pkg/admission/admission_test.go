@@ -0,0 +1,100 @@
+package admission_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/admission"
+	"github.com/anuvu/zot/pkg/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAdmission(t *testing.T) {
+	Convey("Review pushes with the admission service", t, func() {
+		log := log.NewLogger("debug", "")
+
+		reviewed := []admission.Request{}
+
+		// rejects images without a maintainer label
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			var req admission.Request
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			reviewed = append(reviewed, req)
+
+			var config struct {
+				Config struct {
+					Labels map[string]string
+				} `json:"config"`
+			}
+
+			_ = json.Unmarshal(req.Config, &config)
+
+			resp := admission.Response{Allowed: true}
+			if config.Config.Labels["maintainer"] == "" {
+				resp = admission.Response{Reason: "maintainer label required"}
+			}
+
+			_ = json.NewEncoder(w).Encode(resp)
+		}))
+		defer server.Close()
+
+		config := &admission.Config{
+			URL:          server.URL,
+			Headers:      map[string]string{"Authorization": "Bearer secret"},
+			Repositories: []string{"prod/*"},
+		}
+		So(config.Validate(log), ShouldBeNil)
+
+		r := admission.NewReviewer(config, log)
+
+		req := admission.Request{Repository: "prod/app", Reference: "1.0", Manifest: json.RawMessage(`{}`),
+			Config: json.RawMessage(`{"config":{"Labels":{"maintainer":"ops"}}}`), Actor: "alice"}
+
+		So(r.Review(req), ShouldResemble, admission.Response{Allowed: true})
+		So(reviewed, ShouldHaveLength, 1)
+		So(reviewed[0].Actor, ShouldEqual, "alice")
+
+		req.Config = json.RawMessage(`{"config":{}}`)
+		So(r.Review(req), ShouldResemble, admission.Response{Reason: "maintainer label required"})
+
+		// other repositories aren't reviewed
+		req.Repository = "dev/app"
+		So(r.Review(req), ShouldResemble, admission.Response{Allowed: true})
+		So(reviewed, ShouldHaveLength, 2)
+
+		Convey("Reject pushes when the service fails, unless failing open", func() {
+			config.Headers = nil
+			req.Repository = "prod/app"
+
+			So(r.Review(req).Allowed, ShouldBeFalse)
+
+			config.FailOpen = true
+			So(r.Review(req).Allowed, ShouldBeTrue)
+		})
+	})
+
+	Convey("Validate admission configuration", t, func() {
+		log := log.NewLogger("debug", "")
+
+		for _, config := range []*admission.Config{
+			{},
+			{URL: "http://127.0.0.1", Timeout: -time.Second},
+			{URL: "http://127.0.0.1", Repositories: []string{"["}},
+		} {
+			So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"net/http"
+	"path"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/chartmuseum/auth"
+	"github.com/gorilla/mux"
+)
+
+func (a *AccessControlConfig) Validate(log log.Logger) error {
+	for pattern, group := range a.Repositories {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Error().Err(err).Str("pattern", pattern).Msg("invalid repository pattern")
+			return errors.ErrBadConfig
+		}
+
+		actions := group.DefaultPolicy
+		for _, p := range group.Policies {
+			actions = append(actions, p.Actions...)
+		}
+
+		for _, action := range actions {
+			if action != auth.PullAction && action != auth.PushAction {
+				log.Error().Str("pattern", pattern).Str("action", action).Msg("invalid access control action")
+				return errors.ErrBadConfig
+			}
+		}
+	}
+
+	return nil
+}
+
+// admin returns whether an authenticated user administers the registry, any of them doing
+// without access control.
+func (c *Controller) admin(user string) bool {
+	a := c.Config.HTTP.AccessControl
+	if a == nil {
+		return true
+	}
+
+	return contains(a.AdminPolicy.Users, user)
+}
+
+// adminRequest returns whether a request is made by an admin, anonymous users being ones only
+// if users aren't authenticated at all.
+func (c *Controller) adminRequest(r *http.Request) bool {
+	if user := actorOf(r); user != "" {
+		return c.admin(user)
+	}
+
+	return c.Config.HTTP.Auth == nil && (c.Config.HTTP.TLS == nil || c.Config.HTTP.TLS.CACert == "")
+}
+
+// allowed returns whether an authenticated user may take an action, "pull" or "push", on the
+// repository named, as its policies allow, any action on a repository matching none being
+// denied but to admins.
+func (c *Controller) allowed(user, name, action string) bool {
+	if c.admin(user) {
+		return true
+	}
+
+	group, longest := PolicyGroup{}, -1
+
+	for pattern, g := range c.Config.HTTP.AccessControl.Repositories {
+		if ok, _ := path.Match(pattern, name); ok && len(pattern) > longest {
+			group, longest = g, len(pattern)
+		}
+	}
+
+	for _, p := range group.Policies {
+		if contains(p.Users, user) {
+			return contains(p.Actions, action)
+		}
+	}
+
+	return contains(group.DefaultPolicy, action)
+}
+
+// AccessHandler denies authenticated users the pulls and pushes of repositories their access
+// control policies don't allow, anonymous users having been let through by authentication
+// being limited by it instead.
+func AccessHandler(c *Controller) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, named := mux.Vars(r)["name"]
+			user := actorOf(r)
+
+			if c.Config.HTTP.AccessControl == nil || !named || user == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			action := auth.PullAction
+			if m := r.Method; m != http.MethodGet && m != http.MethodHead {
+				action = auth.PushAction
+			}
+
+			if !c.allowed(user, name, action) {
+				c.Log.Warn().Str("user", user).Str("name", name).Str("action", action).Msg("access denied")
+				WriteJSON(w, http.StatusForbidden, NewErrorList(NewError(DENIED)))
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"bufio"
+	"context"
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
@@ -10,10 +11,15 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/apikey"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/oidc"
 	"github.com/chartmuseum/auth"
+	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -22,6 +28,104 @@ const (
 	bearerAuthDefaultAccessEntryType = "repository"
 )
 
+// ReadOnlyHandler rejects the requests which would modify the storage, i.e. all but pulls,
+// in read-only mode, whatever the authentication, e.g. during maintenance windows. Images
+// are still mirrored meanwhile.
+func ReadOnlyHandler(c *Controller) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c.Config.HTTP.ReadOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+				w.Header().Set("Allow", "GET, HEAD")
+				w.WriteHeader(http.StatusMethodNotAllowed)
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type clientUserKey struct{}
+
+// authUserKey is that of the user authenticated by a password or a bearer token.
+type authUserKey struct{}
+
+// ClientIdentityHandler names the users of verified client certificates, as configured, for
+// handlers and the log of requests to know them by.
+func ClientIdentityHandler(c *Controller) mux.MiddlewareFunc {
+	config := &ClientIdentityConfig{}
+	if c.Config.HTTP.TLS != nil && c.Config.HTTP.TLS.ClientIdentity != nil {
+		config = c.Config.HTTP.TLS.ClientIdentity
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cert := r.TLS.VerifiedChains[0][0]
+
+			user := clientIdentityOf(cert, config)
+			if user == "" {
+				c.Log.Warn().Str("subject", cert.Subject.String()).Str("field", config.Field).
+					Msg("no identity of client certificate")
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			log.SetUser(r, user)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientUserKey{}, user)))
+		})
+	}
+}
+
+// clientIdentityOf returns the name of the user of a client certificate, if any.
+func clientIdentityOf(cert *x509.Certificate, config *ClientIdentityConfig) string {
+	var field string
+
+	switch config.Field {
+	case "", ClientIdentityCN:
+		field = cert.Subject.CommonName
+	case ClientIdentityDNS:
+		if len(cert.DNSNames) > 0 {
+			field = cert.DNSNames[0]
+		}
+	case ClientIdentityEmail:
+		if len(cert.EmailAddresses) > 0 {
+			field = cert.EmailAddresses[0]
+		}
+	case ClientIdentityURI:
+		if len(cert.URIs) > 0 {
+			field = cert.URIs[0].String()
+		}
+	}
+
+	if field == "" {
+		return ""
+	}
+
+	if user, ok := config.Users[field]; ok {
+		return user
+	}
+
+	if config.pattern == nil {
+		return field
+	}
+
+	m := config.pattern.FindStringSubmatch(field)
+	if len(m) > 1 {
+		return m[1]
+	} else if len(m) == 1 {
+		return m[0]
+	}
+
+	return ""
+}
+
 func AuthHandler(c *Controller) mux.MiddlewareFunc {
 	if c.Config.HTTP.Auth != nil &&
 		c.Config.HTTP.Auth.Bearer != nil &&
@@ -31,7 +135,85 @@ func AuthHandler(c *Controller) mux.MiddlewareFunc {
 		return bearerAuthHandler(c)
 	}
 
-	return basicAuthHandler(c)
+	authenticate := basicAuthHandler(c)
+	if c.OpenID != nil {
+		authenticate = openIDAuthHandler(c)
+	}
+
+	if c.APIKeys != nil {
+		return apiKeyAuthHandler(c, authenticate)
+	}
+
+	return authenticate
+}
+
+// apiKeyAuthHandler authenticates requests with the API keys of users, given in a header, or as
+// the password of basic authentication, leaving the others to authenticate.
+func apiKeyAuthHandler(c *Controller, authenticate mux.MiddlewareFunc) mux.MiddlewareFunc {
+	realm := basicRealm(c)
+	delay := c.Config.HTTP.Auth.FailDelay
+
+	return func(next http.Handler) http.Handler {
+		others := authenticate(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := apikey.TokenOf(r)
+			if !ok {
+				others.ServeHTTP(w, r)
+				return
+			}
+
+			key, err := c.APIKeys.Authenticate(token)
+			if err != nil {
+				c.Log.Debug().Err(err).Msg("invalid API key")
+				authFail(w, realm, delay)
+
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(apikey.ContextWithKey(r.Context(), key)))
+		})
+	}
+}
+
+// openIDAuthHandler authenticates requests with the ID tokens of users, given as bearer tokens,
+// as passwords of basic authentication, e.g. by docker login, or by the session cookie of those
+// logged in, falling back to htpasswd and LDAP, if configured, for other passwords.
+func openIDAuthHandler(c *Controller) mux.MiddlewareFunc {
+	realm := basicRealm(c)
+	delay := c.Config.HTTP.Auth.FailDelay
+	passwords := c.Config.HTTP.Auth.HTPasswd.Path != "" || c.Config.HTTP.Auth.LDAP != nil
+	basic := basicAuthHandler(c)
+
+	return func(next http.Handler) http.Handler {
+		fallback := basic(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if (r.Method == http.MethodGet || r.Method == http.MethodHead) && c.Config.HTTP.AllowReadAccess {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, password, ok := oidc.TokenOf(r)
+			if ok {
+				identity, err := c.OpenID.Verify(token, "")
+				if err == nil {
+					next.ServeHTTP(w, r.WithContext(oidc.ContextWithIdentity(r.Context(), identity)))
+					return
+				}
+
+				c.Log.Debug().Err(err).Msg("invalid ID token")
+			}
+
+			// which may be that of a user, rather than a token
+			if (!ok || password) && passwords {
+				fallback.ServeHTTP(w, r)
+				return
+			}
+
+			authFail(w, realm, delay)
+		})
+	}
 }
 
 func bearerAuthHandler(c *Controller) mux.MiddlewareFunc {
@@ -66,19 +248,39 @@ func bearerAuthHandler(c *Controller) mux.MiddlewareFunc {
 				authFail(w, permissions.WWWAuthenticateHeader, 0)
 				return
 			}
+			if user := bearerSubject(authorizer, header); user != "" {
+				r = r.WithContext(context.WithValue(r.Context(), authUserKey{}, user))
+			}
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-// nolint:gocyclo  // we use closure making this a complex subroutine
-func basicAuthHandler(c *Controller) mux.MiddlewareFunc {
-	realm := c.Config.HTTP.Realm
-	if realm == "" {
-		realm = "Authorization Required"
+// bearerSubject returns the subject of a bearer token the authorizer accepted, if any.
+func bearerSubject(authorizer *auth.Authorizer, header string) string {
+	s := strings.SplitN(header, " ", 2)
+	if len(s) != 2 {
+		return ""
+	}
+
+	token, err := authorizer.TokenDecoder.DecodeToken(s[1])
+	if err != nil {
+		return ""
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return ""
 	}
 
-	realm = "Basic realm=" + strconv.Quote(realm)
+	user, _ := claims["sub"].(string)
+
+	return user
+}
+
+// nolint:gocyclo  // we use closure making this a complex subroutine
+func basicAuthHandler(c *Controller) mux.MiddlewareFunc {
+	realm := basicRealm(c)
 
 	// no password based authN, if neither LDAP nor HTTP BASIC is enabled
 	if c.Config.HTTP.Auth == nil || (c.Config.HTTP.Auth.HTPasswd.Path == "" && c.Config.HTTP.Auth.LDAP == nil) {
@@ -92,21 +294,66 @@ func basicAuthHandler(c *Controller) mux.MiddlewareFunc {
 					return
 				}
 
-				if (r.Method != http.MethodGet && r.Method != http.MethodHead) && c.Config.HTTP.ReadOnly {
-					// Reject modification requests in read-only mode
-					w.WriteHeader(http.StatusMethodNotAllowed)
-					return
-				}
 				// Process request
 				next.ServeHTTP(w, r)
 			})
 		}
 	}
 
-	credMap := make(map[string]string)
-
 	delay := c.Config.HTTP.Auth.FailDelay
+	authenticate := passwordChecker(c)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if (r.Method == http.MethodGet || r.Method == http.MethodHead) && c.Config.HTTP.AllowReadAccess {
+				// Process request
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			basicAuth := r.Header.Get("Authorization")
+			if basicAuth == "" {
+				authFail(w, realm, delay)
+				return
+			}
+
+			s := strings.SplitN(basicAuth, " ", 2)
+
+			if len(s) != 2 || strings.ToLower(s[0]) != "basic" {
+				authFail(w, realm, delay)
+				return
+			}
+
+			b, err := base64.StdEncoding.DecodeString(s[1])
+			if err != nil {
+				authFail(w, realm, delay)
+				return
+			}
+
+			pair := strings.SplitN(string(b), ":", 2)
+			// nolint:gomnd
+			if len(pair) != 2 {
+				authFail(w, realm, delay)
+				return
+			}
+
+			username := pair[0]
+			passphrase := pair[1]
+
+			if authenticate(username, passphrase) {
+				// Process request
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authUserKey{}, username)))
+				return
+			}
+
+			authFail(w, realm, delay)
+		})
+	}
+}
 
+// passwordChecker returns the function telling whether a password is that of a user in htpasswd,
+// or else accepted by LDAP, of those configured.
+func passwordChecker(c *Controller) func(username string, passphrase string) bool {
 	var ldapClient *LDAPClient
 
 	if c.Config.HTTP.Auth != nil {
@@ -154,91 +401,100 @@ func basicAuthHandler(c *Controller) mux.MiddlewareFunc {
 		}
 
 		if c.Config.HTTP.Auth.HTPasswd.Path != "" {
-			f, err := os.Open(c.Config.HTTP.Auth.HTPasswd.Path)
-
-			if err != nil {
+			if err := c.htpasswd.load(c.Config.HTTP.Auth.HTPasswd.Path); err != nil {
 				panic(err)
 			}
-			defer f.Close()
-
-			scanner := bufio.NewScanner(f)
+		}
+	}
 
-			for scanner.Scan() {
-				line := scanner.Text()
-				if strings.Contains(line, ":") {
-					tokens := strings.Split(scanner.Text(), ":")
-					credMap[tokens[0]] = tokens[1]
-				}
+	return func(username string, passphrase string) bool {
+		// first, HTTPPassword authN (which is local)
+		if passphraseHash, ok := c.htpasswd.hash(username); ok {
+			if err := bcrypt.CompareHashAndPassword([]byte(passphraseHash), []byte(passphrase)); err == nil {
+				return true
 			}
 		}
+
+		// next, LDAP if configured (network-based which can lose connectivity)
+		if ldapClient != nil {
+			ok, _, err := ldapClient.Authenticate(username, passphrase)
+			return ok && err == nil
+		}
+
+		return false
 	}
+}
 
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if (r.Method == http.MethodGet || r.Method == http.MethodHead) && c.Config.HTTP.AllowReadAccess {
-				// Process request
-				next.ServeHTTP(w, r)
-				return
-			}
+// htpasswd keeps the password hashes of the users of an htpasswd file, loaded again on reloading
+// the configuration.
+type htpasswd struct {
+	lock   sync.RWMutex
+	hashes map[string]string
+}
 
-			if (r.Method != http.MethodGet && r.Method != http.MethodHead) && c.Config.HTTP.ReadOnly {
-				// Reject modification requests in read-only mode
-				w.WriteHeader(http.StatusMethodNotAllowed)
-				return
-			}
+// load reads the users of an htpasswd file, replacing those read before, unless it can't be read.
+func (h *htpasswd) load(path string) error {
+	hashes, err := readHtpasswd(path)
+	if err != nil {
+		return err
+	}
 
-			basicAuth := r.Header.Get("Authorization")
-			if basicAuth == "" {
-				authFail(w, realm, delay)
-				return
-			}
+	h.set(hashes)
 
-			s := strings.SplitN(basicAuth, " ", 2)
+	return nil
+}
 
-			if len(s) != 2 || strings.ToLower(s[0]) != "basic" {
-				authFail(w, realm, delay)
-				return
-			}
+// set replaces the password hashes of the users.
+func (h *htpasswd) set(hashes map[string]string) {
+	h.lock.Lock()
+	h.hashes = hashes
+	h.lock.Unlock()
+}
 
-			b, err := base64.StdEncoding.DecodeString(s[1])
-			if err != nil {
-				authFail(w, realm, delay)
-				return
-			}
+// readHtpasswd returns the password hashes of the users of an htpasswd file.
+func readHtpasswd(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-			pair := strings.SplitN(string(b), ":", 2)
-			// nolint:gomnd
-			if len(pair) != 2 {
-				authFail(w, realm, delay)
-				return
-			}
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(f)
 
-			username := pair[0]
-			passphrase := pair[1]
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, ":") {
+			tokens := strings.Split(line, ":")
+			hashes[tokens[0]] = tokens[1]
+		}
+	}
 
-			// first, HTTPPassword authN (which is local)
-			passphraseHash, ok := credMap[username]
-			if ok {
-				if err := bcrypt.CompareHashAndPassword([]byte(passphraseHash), []byte(passphrase)); err == nil {
-					// Process request
-					next.ServeHTTP(w, r)
-					return
-				}
-			}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
 
-			// next, LDAP if configured (network-based which can lose connectivity)
-			if c.Config.HTTP.Auth != nil && c.Config.HTTP.Auth.LDAP != nil {
-				ok, _, err := ldapClient.Authenticate(username, passphrase)
-				if ok && err == nil {
-					// Process request
-					next.ServeHTTP(w, r)
-					return
-				}
-			}
+	return hashes, nil
+}
 
-			authFail(w, realm, delay)
-		})
+// hash returns the password hash of a user, if any.
+func (h *htpasswd) hash(username string) (string, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	hash, ok := h.hashes[username]
+
+	return hash, ok
+}
+
+// basicRealm returns the challenge of basic authentication, of the realm configured.
+func basicRealm(c *Controller) string {
+	realm := c.Config.HTTP.Realm
+	if realm == "" {
+		realm = "Authorization Required"
 	}
+
+	return "Basic realm=" + strconv.Quote(realm)
 }
 
 func authFail(w http.ResponseWriter, realm string, delay int) {
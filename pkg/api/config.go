@@ -1,26 +1,119 @@
 package api
 
 import (
+	"regexp"
+	"strings"
+	"time"
+
 	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/actions"
+	"github.com/anuvu/zot/pkg/admission"
+	"github.com/anuvu/zot/pkg/apikey"
+	"github.com/anuvu/zot/pkg/backup"
+	"github.com/anuvu/zot/pkg/events"
+	"github.com/anuvu/zot/pkg/eviction"
 	ext "github.com/anuvu/zot/pkg/extensions"
 	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/metrics"
+	"github.com/anuvu/zot/pkg/mirror"
+	"github.com/anuvu/zot/pkg/oidc"
+	"github.com/anuvu/zot/pkg/proxy"
+	"github.com/anuvu/zot/pkg/replicas"
+	"github.com/anuvu/zot/pkg/retention"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/tracing"
+	"github.com/dustin/go-humanize"
 	"github.com/getlantern/deepcopy"
 	dspec "github.com/opencontainers/distribution-spec"
+	"github.com/rs/zerolog"
 )
 
 // Commit ...
 var Commit string //nolint: gochecknoglobals
 
+// ReleaseTag is the release this binary was built from, if any.
+var ReleaseTag string //nolint: gochecknoglobals
+
+// BuildDate ...
+var BuildDate string //nolint: gochecknoglobals
+
 type StorageConfig struct {
 	RootDirectory string
 	GC            bool
-	Dedupe        bool
+	// GCInterval is how long after being written to repositories are collected garbage in, in
+	// the background, e.g. "10m" for pushes of several images to be collected at once, as soon
+	// as possible if not set
+	GCInterval time.Duration
+	// GCParallelism is how many repositories are collected garbage in at once, one if not set
+	GCParallelism int
+	// GCDeleteRate is how many blobs garbage collection removes per second at most, across
+	// repositories, e.g. for it not to slow down pulls during business hours, unlimited if not set
+	GCDeleteRate int
+	Dedupe       bool
+	// Check verifies the integrity of all repositories at startup, and refuses to serve if any is corrupted
+	Check bool
+	// Shared allows other zot instances to serve the same root directory, e.g. on a network
+	// filesystem behind a load balancer
+	Shared bool
+	// ImmutableTags can't be moved to other content or deleted, by clients or retention policies
+	ImmutableTags []storage.ImmutableTagsConfig
+	// ArtifactTypes are glob patterns of the media types, e.g. "application/vnd.cncf.helm.*", of
+	// the artifacts, beyond images, whose manifests are accepted, those of any if not set
+	ArtifactTypes []string
+	// CopyBufferSize is the size of the pooled buffers blobs are uploaded and downloaded with,
+	// e.g. "1MB", 32KB if not set
+	CopyBufferSize string
+	// WriteBufferSize is the size of the buffer blob uploads are written to their files through,
+	// e.g. "4MB" to write to network filesystems in fewer, larger writes, unbuffered if not set
+	WriteBufferSize string
+	// DropUploadCache writes uploaded blobs to disk and drops them from the page cache once
+	// finished, where supported (Linux), so that large pushes don't evict blobs being pulled
+	DropUploadCache bool
+	// DedupeCacheShards spreads the records of the dedupe cache over as many dbs, e.g. 8, each
+	// written to on its own, for heavy concurrent pushes not to wait on a single db writer
+	DedupeCacheShards int
+	// UploadDirectory stages blob uploads outside of the root directory, e.g. on NVMe or tmpfs,
+	// from which they're moved, or copied if on another filesystem, once finished
+	UploadDirectory string
+	// S3 keeps images in an S3 bucket rather than under the root directory
+	S3 *storage.S3Config
+	// StorageDriver keeps images with the storage driver registered by its "name", e.g. "s3",
+	// configured with the rest of its parameters, rather than under the root directory
+	StorageDriver map[string]interface{}
+	// DedupeCacheDriver keeps the dedupe cache with the cache driver registered by its "name", e.g.
+	// "redis" for replicas sharing the storage to share it too, configured with the rest of its
+	// parameters, rather than in bolt dbs under the root directory
+	DedupeCacheDriver map[string]interface{}
 }
 
 type TLSConfig struct {
 	Cert   string
 	Key    string
 	CACert string
+	// ClientIdentity names the users of the client certificates verified with CACert, by the common
+	// name of their subject if not set
+	ClientIdentity *ClientIdentityConfig
+}
+
+const (
+	ClientIdentityCN    = "cn"    // the common name of the subject
+	ClientIdentityDNS   = "dns"   // the first DNS subject alternative name
+	ClientIdentityEmail = "email" // the first email subject alternative name
+	ClientIdentityURI   = "uri"   // the first URI subject alternative name, e.g. a SPIFFE ID
+)
+
+// ClientIdentityConfig names the users of client certificates after a field of the certificates,
+// mapped to other names, or matched for them.
+type ClientIdentityConfig struct {
+	// Field is that of the certificates naming users, ClientIdentityCN if not set
+	Field string
+	// Users maps fields to the names of their users, e.g. "ci.example.com" to "ci"
+	Users map[string]string
+	// Pattern, if set, must be matched by the fields not mapped, their users being named by its
+	// first group, if any, or else the whole field, e.g. "^spiffe://example.org/ns/(.+)$"
+	Pattern string
+
+	pattern *regexp.Regexp // Pattern, compiled when validated
 }
 
 type AuthHTPasswd struct {
@@ -32,12 +125,20 @@ type AuthConfig struct {
 	HTPasswd  AuthHTPasswd
 	LDAP      *LDAPConfig
 	Bearer    *BearerConfig
+	// OpenID authenticates users with the ID tokens of an OpenID Connect provider, alongside
+	// htpasswd and LDAP, if set
+	OpenID *oidc.Config
+	// APIKey lets users otherwise authenticated mint API keys to authenticate with instead, if set
+	APIKey *apikey.Config
 }
 
 type BearerConfig struct {
 	Realm   string
 	Service string
 	Cert    string
+	// Key is the private key of Cert, for zot to issue tokens itself at TokenPath, to the users of
+	// htpasswd and LDAP, instead of a token service, if set
+	Key string
 }
 
 type HTTPConfig struct {
@@ -47,7 +148,56 @@ type HTTPConfig struct {
 	Auth            *AuthConfig
 	Realm           string
 	AllowReadAccess bool `mapstructure:",omitempty"`
-	ReadOnly        bool `mapstructure:",omitempty"`
+	// ReadOnly rejects pushes and deletes, with 405 Method Not Allowed, while serving pulls
+	ReadOnly      bool `mapstructure:",omitempty"`
+	DisableDelete bool `mapstructure:",omitempty"`
+	Ratelimit     *RatelimitConfig
+	// AccessControl limits what authenticated users may do to repositories, all of them being
+	// allowed to pull and push any without it
+	AccessControl *AccessControlConfig
+	// MaxManifestSize is that of the largest manifest pushed accepted, in bytes, MaxManifestSize
+	// if not set
+	MaxManifestSize int64 `mapstructure:",omitempty"`
+	// MaxBlobSize is that of the largest blob uploaded accepted, in bytes, unlimited if not set
+	MaxBlobSize int64 `mapstructure:",omitempty"`
+	// DisableHTTP2 serves HTTP/1.1 only over TLS, HTTP/2 being negotiated otherwise
+	DisableHTTP2 bool `mapstructure:",omitempty"`
+	// H2C serves HTTP/2 without TLS too, to clients either knowing it's supported or upgrading
+	H2C bool `mapstructure:",omitempty"`
+	// Strict turns off whatever isn't in the distribution spec, e.g. the /v2/_zot and extension
+	// routes, or untagging manifests by deleting their tags, for conformance certification.
+	Strict bool `mapstructure:",omitempty"`
+}
+
+type RatelimitConfig struct {
+	Rate    *int                    // requests per second
+	Methods []MethodRatelimitConfig `mapstructure:",omitempty"`
+}
+
+type MethodRatelimitConfig struct {
+	Method string
+	Rate   int
+}
+
+type AccessControlConfig struct {
+	// Repositories maps patterns of repository names, as matched by path.Match, e.g. "team/*", to
+	// the policies of the repositories matching them, those of the longest pattern matching
+	Repositories map[string]PolicyGroup
+	// AdminPolicy names the users allowed every action on every repository, and to administer the
+	// registry, e.g. scrub its storage
+	AdminPolicy Policy
+}
+
+type PolicyGroup struct {
+	Policies []Policy
+	// DefaultPolicy is the actions allowed the authenticated users named in no policy
+	DefaultPolicy []string `mapstructure:",omitempty"`
+}
+
+// Policy allows users actions, "pull" or "push", on repositories.
+type Policy struct {
+	Users   []string
+	Actions []string `mapstructure:",omitempty"`
 }
 
 type LDAPConfig struct {
@@ -72,10 +222,33 @@ type LogConfig struct {
 type Config struct {
 	Version    string
 	Commit     string
+	Preset     string
 	Storage    StorageConfig
 	HTTP       HTTPConfig
 	Log        *LogConfig
 	Extensions *ext.ExtensionConfig
+	// Proxy, if set, makes zot a pull-through cache of the given upstream registries.
+	Proxy *proxy.Config
+	// Mirror, if set, periodically copies the given repositories of upstream registries.
+	Mirror *mirror.Config
+	// Events, if set, are sent to the given endpoints on pushes, pulls and deletes.
+	Events *events.Config
+	// Retention, if set, periodically removes tags according to the given policies.
+	Retention *retention.Config
+	// Eviction, if set, keeps proxied or mirrored images within a size budget.
+	Eviction *eviction.Config
+	// Backup, if set, allows taking snapshots of the storage, on demand or periodically.
+	Backup *backup.Config
+	// Replicas, if set, redirects blob pulls to sibling instances in the region of the client.
+	Replicas *replicas.Config
+	// Admission, if set, has pushed manifests reviewed by an external service before accepting them.
+	Admission *admission.Config
+	// Actions, if set, are run on images once pushed or scanned, e.g. retagging or replicating them.
+	Actions *actions.Config
+	// Metrics, if set, are exposed to Prometheus.
+	Metrics *metrics.Config
+	// Tracing, if set, exports spans of requests and the storage operations serving them.
+	Tracing *tracing.Config
 }
 
 func NewConfig() *Config {
@@ -90,12 +263,29 @@ func NewConfig() *Config {
 
 // Sanitize makes a sanitized copy of the config removing any secrets.
 func (c *Config) Sanitize() *Config {
-	if c.HTTP.Auth != nil && c.HTTP.Auth.LDAP != nil && c.HTTP.Auth.LDAP.BindPassword != "" {
-		s := &Config{}
-		if err := deepcopy.Copy(s, c); err != nil {
-			panic(err)
-		}
+	ldap := c.HTTP.Auth != nil && c.HTTP.Auth.LDAP != nil && c.HTTP.Auth.LDAP.BindPassword != ""
+	openID := c.HTTP.Auth != nil && c.HTTP.Auth.OpenID != nil && c.HTTP.Auth.OpenID.ClientSecret != ""
+	proxied := c.Proxy != nil && (c.Proxy.Password != "" || len(c.Proxy.Upstreams) > 0)
+	mirrored := c.Mirror != nil && len(c.Mirror.Registries) > 0
+	notified := c.Events != nil && (len(c.Events.Endpoints) > 0 || len(c.Events.NATS) > 0 || len(c.Events.Kafka) > 0)
+	replicated := c.Replicas != nil && len(c.Replicas.Replicas) > 0
+	admitted := c.Admission != nil && len(c.Admission.Headers) > 0
+	acting := c.Actions != nil && len(c.Actions.Destinations) > 0
+	bucket := c.Storage.S3 != nil && (c.Storage.S3.SecretAccessKey != "" || c.Storage.S3.SessionToken != "")
+	driven := c.Storage.StorageDriver != nil || c.Storage.DedupeCacheDriver != nil
+	traced := c.Tracing != nil && len(c.Tracing.Headers) > 0
 
+	if !ldap && !openID && !proxied && !mirrored && !notified && !replicated && !admitted && !acting && !bucket &&
+		!driven && !traced {
+		return c
+	}
+
+	s := &Config{}
+	if err := deepcopy.Copy(s, c); err != nil {
+		panic(err)
+	}
+
+	if ldap {
 		s.HTTP.Auth.LDAP = &LDAPConfig{}
 
 		if err := deepcopy.Copy(s.HTTP.Auth.LDAP, c.HTTP.Auth.LDAP); err != nil {
@@ -103,14 +293,424 @@ func (c *Config) Sanitize() *Config {
 		}
 
 		s.HTTP.Auth.LDAP.BindPassword = "******"
+	}
+
+	if openID {
+		o := *c.HTTP.Auth.OpenID
+		o.ClientSecret = "******"
+		s.HTTP.Auth.OpenID = &o
+	}
 
-		return s
+	if bucket {
+		b := *c.Storage.S3
+		b.SecretAccessKey = "******"
+		b.SessionToken = "******"
+		s.Storage.S3 = &b
 	}
 
-	return c
+	// driver parameters are opaque, so any looking like a secret is hidden
+	if driven {
+		s.Storage.StorageDriver = sanitizeParameters(c.Storage.StorageDriver)
+		s.Storage.DedupeCacheDriver = sanitizeParameters(c.Storage.DedupeCacheDriver)
+	}
+
+	if proxied {
+		p := *c.Proxy
+		if p.Password != "" {
+			p.Password = "******"
+		}
+
+		p.Upstreams = make([]proxy.UpstreamConfig, len(c.Proxy.Upstreams))
+
+		for i, u := range c.Proxy.Upstreams {
+			if u.Password != "" {
+				u.Password = "******"
+			}
+
+			p.Upstreams[i] = u
+		}
+
+		s.Proxy = &p
+	}
+
+	if mirrored {
+		s.Mirror = &mirror.Config{Registries: make([]mirror.RegistryConfig, len(c.Mirror.Registries))}
+
+		for i, r := range c.Mirror.Registries {
+			if r.Password != "" {
+				r.Password = "******"
+			}
+
+			s.Mirror.Registries[i] = r
+		}
+	}
+
+	if replicated {
+		r := *c.Replicas
+		r.Replicas = make([]replicas.ReplicaConfig, len(c.Replicas.Replicas))
+
+		for i, rc := range c.Replicas.Replicas {
+			if rc.Password != "" {
+				rc.Password = "******"
+			}
+
+			r.Replicas[i] = rc
+		}
+
+		s.Replicas = &r
+	}
+
+	if acting {
+		a := *c.Actions
+		a.Destinations = make([]actions.DestinationConfig, len(c.Actions.Destinations))
+
+		for i, d := range c.Actions.Destinations {
+			if d.Password != "" {
+				d.Password = "******"
+			}
+
+			a.Destinations[i] = d
+		}
+
+		s.Actions = &a
+	}
+
+	// as do those of the admission service
+	if admitted {
+		a := *c.Admission
+		a.Headers = make(map[string]string, len(c.Admission.Headers))
+
+		for k := range c.Admission.Headers {
+			a.Headers[k] = "******"
+		}
+
+		s.Admission = &a
+	}
+
+	// as do those of the tracing endpoint
+	if traced {
+		t := *c.Tracing
+		t.Headers = make(map[string]string, len(c.Tracing.Headers))
+
+		for k := range c.Tracing.Headers {
+			t.Headers[k] = "******"
+		}
+
+		s.Tracing = &t
+	}
+
+	// endpoint headers typically carry credentials
+	if notified {
+		s.Events = &events.Config{
+			Endpoints: make([]events.EndpointConfig, len(c.Events.Endpoints)),
+			NATS:      make([]events.NATSConfig, len(c.Events.NATS)),
+			Kafka:     make([]events.KafkaConfig, len(c.Events.Kafka)),
+		}
+
+		for i, e := range c.Events.Endpoints {
+			headers := make(map[string]string, len(e.Headers))
+			for k := range e.Headers {
+				headers[k] = "******"
+			}
+
+			e.Headers = headers
+			s.Events.Endpoints[i] = e
+		}
+
+		for i, n := range c.Events.NATS {
+			if n.Password != "" {
+				n.Password = "******"
+			}
+
+			if n.Token != "" {
+				n.Token = "******"
+			}
+
+			s.Events.NATS[i] = n
+		}
+
+		for i, k := range c.Events.Kafka {
+			if k.Password != "" {
+				k.Password = "******"
+			}
+
+			s.Events.Kafka[i] = k
+		}
+	}
+
+	return s
+}
+
+// sanitizeParameters returns a copy of driver parameters with those looking like a secret hidden.
+func sanitizeParameters(parameters map[string]interface{}) map[string]interface{} {
+	if parameters == nil {
+		return nil
+	}
+
+	sanitized := make(map[string]interface{}, len(parameters))
+
+	for k, v := range parameters {
+		key := strings.ToLower(k)
+		if strings.Contains(key, "secret") || strings.Contains(key, "password") || strings.Contains(key, "token") {
+			v = "******"
+		}
+
+		sanitized[k] = v
+	}
+
+	return sanitized
 }
 
 func (c *Config) Validate(log log.Logger) error {
+	if c.Preset != "" {
+		if _, ok := presets[c.Preset]; !ok {
+			log.Error().Str("preset", c.Preset).Msg("unknown configuration preset")
+			return errors.ErrBadConfig
+		}
+
+		if c.Preset == PresetSecure && (c.HTTP.TLS == nil || c.HTTP.TLS.Cert == "" || c.HTTP.TLS.Key == "") {
+			log.Error().Str("preset", c.Preset).Msg("TLS must be configured with this preset")
+			return errors.ErrBadConfig
+		}
+	}
+
+	// log level, reloaded without being checked otherwise
+	if c.Log != nil {
+		if _, err := zerolog.ParseLevel(c.Log.Level); err != nil {
+			log.Error().Err(err).Str("level", c.Log.Level).Msg("invalid log level")
+			return errors.ErrBadConfig
+		}
+	}
+
+	// sizes of manifests and blobs pushed
+	if c.HTTP.MaxManifestSize < 0 || c.HTTP.MaxBlobSize < 0 {
+		log.Error().Int64("maxManifestSize", c.HTTP.MaxManifestSize).Int64("maxBlobSize", c.HTTP.MaxBlobSize).
+			Msg("invalid maximum size")
+		return errors.ErrBadConfig
+	}
+
+	if c.HTTP.H2C && c.HTTP.DisableHTTP2 {
+		log.Error().Msg("h2c can't be enabled with HTTP/2 disabled")
+		return errors.ErrBadConfig
+	}
+
+	// rate limits
+	if c.HTTP.Ratelimit != nil {
+		r := c.HTTP.Ratelimit
+		if r.Rate != nil && *r.Rate <= 0 {
+			log.Error().Int("rate", *r.Rate).Msg("invalid rate limit")
+			return errors.ErrBadConfig
+		}
+
+		for _, m := range r.Methods {
+			if m.Method == "" || m.Rate <= 0 {
+				log.Error().Str("method", m.Method).Int("rate", m.Rate).Msg("invalid rate limit")
+				return errors.ErrBadConfig
+			}
+		}
+	}
+
+	// access control policies
+	if c.HTTP.AccessControl != nil {
+		if err := c.HTTP.AccessControl.Validate(log); err != nil {
+			return err
+		}
+	}
+
+	// pull-through proxy
+	if c.Proxy != nil {
+		if err := c.Proxy.Validate(log); err != nil {
+			return err
+		}
+	}
+
+	// mirrored registries
+	if c.Mirror != nil {
+		if err := c.Mirror.Validate(log); err != nil {
+			return err
+		}
+	}
+
+	// events endpoints
+	if c.Events != nil {
+		if err := c.Events.Validate(log); err != nil {
+			return err
+		}
+	}
+
+	// metrics endpoint
+	if c.Metrics != nil {
+		if err := c.Metrics.Validate(log); err != nil {
+			return err
+		}
+
+		if path := c.Metrics.Endpoint(); path == "/livez" || path == "/readyz" || path == TokenPath ||
+			path == oidc.LoginPath || path == oidc.CallbackPath || path == oidc.LogoutPath {
+			log.Error().Str("path", path).Msg("metrics path is taken by probes, tokens or logins")
+			return errors.ErrBadConfig
+		}
+	}
+
+	// tracing exporter
+	if c.Tracing != nil {
+		if err := c.Tracing.Validate(log); err != nil {
+			return err
+		}
+	}
+
+	// cache size budget
+	if c.Eviction != nil {
+		if c.Proxy == nil && c.Mirror == nil {
+			log.Error().Msg("eviction requires a proxy or mirror configuration")
+			return errors.ErrBadConfig
+		}
+
+		if err := c.Eviction.Validate(log); err != nil {
+			return err
+		}
+	}
+
+	// blob copy buffers
+	if c.Storage.CopyBufferSize != "" {
+		size, err := humanize.ParseBytes(c.Storage.CopyBufferSize)
+		if err != nil || size == 0 || size > storage.MaxCopyBufferSize {
+			log.Error().Err(err).Str("copyBufferSize", c.Storage.CopyBufferSize).Msg("invalid copy buffer size")
+			return errors.ErrBadConfig
+		}
+	}
+
+	if c.Storage.WriteBufferSize != "" {
+		size, err := humanize.ParseBytes(c.Storage.WriteBufferSize)
+		if err != nil || size == 0 || size > storage.MaxCopyBufferSize {
+			log.Error().Err(err).Str("writeBufferSize", c.Storage.WriteBufferSize).Msg("invalid write buffer size")
+			return errors.ErrBadConfig
+		}
+	}
+
+	if c.Storage.GCInterval < 0 {
+		log.Error().Dur("gcInterval", c.Storage.GCInterval).Msg("invalid garbage collection interval")
+		return errors.ErrBadConfig
+	}
+
+	if c.Storage.GCParallelism < 0 || c.Storage.GCDeleteRate < 0 {
+		log.Error().Int("gcParallelism", c.Storage.GCParallelism).Int("gcDeleteRate", c.Storage.GCDeleteRate).
+			Msg("invalid garbage collection pacing")
+		return errors.ErrBadConfig
+	}
+
+	if c.Storage.DedupeCacheShards < 0 || c.Storage.DedupeCacheShards > storage.MaxCacheShards {
+		log.Error().Int("dedupeCacheShards", c.Storage.DedupeCacheShards).Msg("invalid dedupe cache shards")
+		return errors.ErrBadConfig
+	}
+
+	// other instances couldn't continue the uploads started on this one
+	if c.Storage.UploadDirectory != "" && c.Storage.Shared {
+		log.Error().Str("uploadDirectory", c.Storage.UploadDirectory).
+			Msg("an upload directory can't be set for shared storage")
+		return errors.ErrBadConfig
+	}
+
+	// S3 bucket
+	if c.Storage.S3 != nil {
+		if err := c.Storage.S3.Validate(log); err != nil {
+			return err
+		}
+
+		// all of which are about the root directory
+		if c.Storage.Shared || c.Storage.UploadDirectory != "" || c.Storage.Check || c.Backup != nil {
+			log.Error().Msg("shared storage, an upload directory, checks and backups are not supported with S3")
+			return errors.ErrBadConfig
+		}
+	}
+
+	// storage driver
+	if c.Storage.StorageDriver != nil {
+		name, _ := c.Storage.StorageDriver["name"].(string)
+		registered := false
+
+		for _, d := range storage.Drivers() {
+			registered = registered || d == name
+		}
+
+		if !registered {
+			log.Error().Str("name", name).Strs("drivers", storage.Drivers()).Msg("unknown storage driver")
+			return errors.ErrBadConfig
+		}
+
+		if c.Storage.S3 != nil || c.Storage.Shared || c.Storage.UploadDirectory != "" || c.Storage.Check ||
+			c.Backup != nil {
+			log.Error().Msg("S3, shared storage, an upload directory, checks and backups are not supported with a storage driver")
+			return errors.ErrBadConfig
+		}
+	}
+
+	// dedupe cache driver
+	if c.Storage.DedupeCacheDriver != nil {
+		name, _ := c.Storage.DedupeCacheDriver["name"].(string)
+		registered := false
+
+		for _, d := range storage.CacheDrivers() {
+			registered = registered || d == name
+		}
+
+		if !registered {
+			log.Error().Str("name", name).Strs("drivers", storage.CacheDrivers()).Msg("unknown dedupe cache driver")
+			return errors.ErrBadConfig
+		}
+
+		if !c.Storage.Dedupe || c.Storage.S3 != nil || c.Storage.StorageDriver != nil {
+			log.Error().Msg("a dedupe cache driver requires dedupe under the root directory")
+			return errors.ErrBadConfig
+		}
+	}
+
+	// immutable tags
+	for _, t := range c.Storage.ImmutableTags {
+		if err := t.Validate(log); err != nil {
+			return err
+		}
+	}
+
+	// artifacts allowed
+	if err := storage.ValidateArtifactTypes(c.Storage.ArtifactTypes, log); err != nil {
+		return err
+	}
+
+	// tag retention policies
+	if c.Retention != nil {
+		if err := c.Retention.Validate(log); err != nil {
+			return err
+		}
+	}
+
+	// storage snapshots
+	if c.Backup != nil {
+		if err := c.Backup.Validate(log); err != nil {
+			return err
+		}
+	}
+
+	// regional replicas
+	if c.Replicas != nil {
+		if err := c.Replicas.Validate(log); err != nil {
+			return err
+		}
+	}
+
+	// push admission service
+	if c.Admission != nil {
+		if err := c.Admission.Validate(log); err != nil {
+			return err
+		}
+	}
+
+	// post-push actions
+	if c.Actions != nil {
+		if err := c.Actions.Validate(log); err != nil {
+			return err
+		}
+	}
+
 	// LDAP configuration
 	if c.HTTP.Auth != nil && c.HTTP.Auth.LDAP != nil {
 		l := c.HTTP.Auth.LDAP
@@ -120,5 +720,75 @@ func (c *Config) Validate(log log.Logger) error {
 		}
 	}
 
+	// identities of client certificates
+	if c.HTTP.TLS != nil && c.HTTP.TLS.ClientIdentity != nil {
+		ci := c.HTTP.TLS.ClientIdentity
+
+		if c.HTTP.TLS.CACert == "" {
+			log.Error().Msg("client identities require client certificates to be verified with a CA certificate")
+			return errors.ErrBadConfig
+		}
+
+		switch ci.Field {
+		case "", ClientIdentityCN, ClientIdentityDNS, ClientIdentityEmail, ClientIdentityURI:
+		default:
+			log.Error().Str("field", ci.Field).Msg("invalid client identity field, must be cn, dns, email or uri")
+			return errors.ErrBadConfig
+		}
+
+		if ci.Pattern != "" {
+			pattern, err := regexp.Compile(ci.Pattern)
+			if err != nil {
+				log.Error().Err(err).Str("pattern", ci.Pattern).Msg("invalid client identity pattern")
+				return errors.ErrBadConfig
+			}
+
+			ci.pattern = pattern
+		}
+	}
+
+	// bearer tokens issued by zot
+	if c.HTTP.Auth != nil && c.HTTP.Auth.Bearer != nil && c.HTTP.Auth.Bearer.Key != "" {
+		b := c.HTTP.Auth.Bearer
+		if b.Cert == "" || b.Realm == "" || b.Service == "" {
+			log.Error().Msg("bearer realm, service and certificate are required to issue tokens")
+			return errors.ErrBadConfig
+		}
+
+		if c.HTTP.Auth.HTPasswd.Path == "" && c.HTTP.Auth.LDAP == nil {
+			log.Error().Msg("issuing bearer tokens requires users to be authenticated with htpasswd or LDAP")
+			return errors.ErrBadConfig
+		}
+	}
+
+	// OpenID Connect provider
+	if c.HTTP.Auth != nil && c.HTTP.Auth.OpenID != nil {
+		if err := c.HTTP.Auth.OpenID.Validate(log); err != nil {
+			return err
+		}
+
+		if c.HTTP.Auth.Bearer != nil {
+			log.Error().Msg("OpenID Connect and bearer authentication are mutually exclusive")
+			return errors.ErrBadConfig
+		}
+	}
+
+	// API keys
+	if c.HTTP.Auth != nil && c.HTTP.Auth.APIKey != nil {
+		if err := c.HTTP.Auth.APIKey.Validate(log); err != nil {
+			return err
+		}
+
+		if c.HTTP.Auth.Bearer != nil {
+			log.Error().Msg("API keys and bearer authentication are mutually exclusive")
+			return errors.ErrBadConfig
+		}
+
+		if c.HTTP.Auth.HTPasswd.Path == "" && c.HTTP.Auth.LDAP == nil && c.HTTP.Auth.OpenID == nil {
+			log.Error().Msg("API keys require users to be authenticated with htpasswd, LDAP or OpenID Connect")
+			return errors.ErrBadConfig
+		}
+	}
+
 	return nil
 }
@@ -1,35 +1,108 @@
 package api
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"os"
+	"sync"
+	"time"
 
 	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/actions"
+	"github.com/anuvu/zot/pkg/admission"
+	"github.com/anuvu/zot/pkg/apikey"
+	"github.com/anuvu/zot/pkg/backup"
+	"github.com/anuvu/zot/pkg/bus"
+	"github.com/anuvu/zot/pkg/events"
+	"github.com/anuvu/zot/pkg/eviction"
 	ext "github.com/anuvu/zot/pkg/extensions"
 	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/metrics"
+	"github.com/anuvu/zot/pkg/mirror"
+	"github.com/anuvu/zot/pkg/oidc"
+	"github.com/anuvu/zot/pkg/proxy"
+	"github.com/anuvu/zot/pkg/replicas"
+	"github.com/anuvu/zot/pkg/retention"
 	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/tracing"
+	"github.com/dustin/go-humanize"
+	guuid "github.com/gofrs/uuid"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type Controller struct {
-	Config     *Config
-	Router     *mux.Router
-	ImageStore *storage.ImageStore
+	Config *Config
+	Router *mux.Router
+	// ImageStore, if set before Start, is used instead of a store backed by the root directory.
+	ImageStore storage.ImageStore
 	Log        log.Logger
 	Server     *http.Server
+	// Listener, if set, is served on instead of listening on the configured address.
+	Listener net.Listener
+	// Bus publishes the changes made to the storage, by clients or background workers.
+	Bus *bus.Bus
+	// Events, if events are configured, notifies their endpoints of registry activity.
+	Events *events.Notifier
+	// Backup, if backups are configured, takes snapshots of the storage.
+	Backup *backup.Manager
+	// Replicas, if replicas are configured, redirects blob pulls to those closer to clients.
+	Replicas *replicas.Redirector
+	// Admission, if an admission service is configured, reviews pushed manifests with it.
+	Admission *admission.Reviewer
+	// Actions, if actions are configured, runs them on images and tracks their replication.
+	Actions *actions.Runner
+	// Mirrorer, if mirroring is configured, mirrors upstream registries and tracks their status.
+	Mirrorer *mirror.Mirrorer
+	// Metrics, if metrics are configured, records those of requests and serves them to Prometheus.
+	Metrics *metrics.Metrics
+	// OpenID, if OpenID Connect is configured, verifies the ID tokens of users and logs them in.
+	OpenID *oidc.Provider
+	// APIKeys, if API keys are configured, keeps those minted by users.
+	APIKeys *apikey.Store
+	// Tracer, if tracing is configured, traces requests and the storage operations serving them.
+	Tracer *tracing.Tracer
+	// LoadConfig, if set before Start, loads the configuration again, e.g. from the file it was
+	// loaded from, to Reload it on request.
+	LoadConfig func() (*Config, error)
+
+	store    storage.ImageStore   // as stored, under the stores wrapping it
+	copies   *storage.CopyBuffers // blobs are sent to clients with
+	issuer   *tokenIssuer         // of bearer tokens, if zot issues them itself
+	cancel   context.CancelFunc   // stops background workers
+	wg       sync.WaitGroup       // tracks background workers
+	serveErr chan error
+
+	htpasswd   htpasswd   // users of the htpasswd file, loaded again on reload
+	reloadLock sync.Mutex // serializes reloads
+
+	scrubLock sync.Mutex           // guards the scrub state below
+	scrubbing bool                 // whether the storage is being scrubbed
+	lastScrub *storage.ScrubReport // the report of the last scrub done, if any
 }
 
 func NewController(config *Config) *Controller {
 	return &Controller{Config: config, Log: log.NewLogger(config.Log.Level, config.Log.Output)}
 }
 
+// Run starts the controller and blocks until the server stops.
 func (c *Controller) Run() error {
+	if err := c.Start(context.Background()); err != nil {
+		return err
+	}
+
+	return <-c.serveErr
+}
+
+// Start initializes the controller and returns once it is listening, serving requests
+// in the background. Background workers run until ctx is done or Stop is called.
+func (c *Controller) Start(ctx context.Context) error {
 	// validate configuration
 	if err := c.Config.Validate(c.Log); err != nil {
 		c.Log.Error().Err(err).Msg("configuration validation failed")
@@ -43,33 +116,343 @@ func (c *Controller) Run() error {
 	engine.Use(log.SessionLogger(c.Log), handlers.RecoveryHandler(handlers.RecoveryLogger(c.Log),
 		handlers.PrintRecoveryStack(false)))
 
-	c.ImageStore = storage.NewImageStore(c.Config.Storage.RootDirectory, c.Config.Storage.GC,
-		c.Config.Storage.Dedupe, c.Log)
+	if c.Config.HTTP.Auth != nil && c.Config.HTTP.Auth.OpenID != nil {
+		c.OpenID = oidc.NewProvider(c.Config.HTTP.Auth.OpenID, c.Log)
+	}
+
+	// requests rate limited are traced too
+	if c.Config.Tracing != nil {
+		c.Tracer = tracing.NewTracer(c.Config.Tracing, c.Log)
+		engine.Use(c.Tracer.Instrument)
+	}
+
+	if c.Config.HTTP.Ratelimit != nil {
+		engine.Use(RateLimiter(c, c.Config.HTTP.Ratelimit))
+	}
+
+	// requests rejected by authentication are counted too
+	if c.Config.Metrics != nil {
+		c.Metrics = newMetrics(c.Config)
+		engine.Use(c.Metrics.Instrument)
+	}
+
+	opts := storageOptions(c.Config.Storage)
+	c.copies = storage.NewCopyBuffers(opts.CopyBufferSize)
+
+	// use the image store handed to us, if any, otherwise one backed by the storage driver or
+	// S3 bucket, if set, or the root directory
+	if c.ImageStore == nil && c.Config.Storage.StorageDriver != nil {
+		name, _ := c.Config.Storage.StorageDriver["name"].(string)
+
+		driver, err := storage.NewDriver(name, c.Config.Storage.StorageDriver)
+		if err != nil {
+			c.Log.Error().Err(err).Str("name", name).Msg("unable to create storage driver")
+			return err
+		}
+
+		is := storage.NewImageStoreDriver(driver, c.Config.Storage.GC, storage.Options{}, c.Log)
+		is.SetGCInterval(c.Config.Storage.GCInterval)
+		is.SetGCParallelism(c.Config.Storage.GCParallelism)
+		is.SetGCDeleteRate(c.Config.Storage.GCDeleteRate)
+
+		c.ImageStore = is
+	}
+
+	if c.ImageStore == nil && c.Config.Storage.S3 != nil {
+		is := storage.NewImageStoreS3(*c.Config.Storage.S3, c.Config.Storage.GC, opts, c.Log)
+		if is == nil {
+			return errors.ErrImgStoreNotFound
+		}
+
+		is.SetGCInterval(c.Config.Storage.GCInterval)
+		is.SetGCParallelism(c.Config.Storage.GCParallelism)
+		is.SetGCDeleteRate(c.Config.Storage.GCDeleteRate)
+
+		c.ImageStore = is
+	}
+
 	if c.ImageStore == nil {
-		// we can't proceed without at least a image store
-		os.Exit(1)
+		newImageStore := storage.NewImageStore
+		if c.Config.Storage.Shared {
+			newImageStore = storage.NewSharedImageStore
+		}
+
+		// deduped with the cache driver, if set, rather than the cache under the root directory
+		cacheDriver := c.Config.Storage.DedupeCacheDriver
+
+		is := newImageStore(c.Config.Storage.RootDirectory, c.Config.Storage.GC,
+			c.Config.Storage.Dedupe && cacheDriver == nil, opts, c.Log)
+		if is == nil {
+			// we can't proceed without at least a image store
+			return errors.ErrImgStoreNotFound
+		}
+
+		if cacheDriver != nil {
+			name, _ := cacheDriver["name"].(string)
+
+			cache, err := storage.NewCacheDriver(name, c.Config.Storage.RootDirectory, cacheDriver, c.Log)
+			if err != nil {
+				c.Log.Error().Err(err).Str("name", name).Msg("unable to create dedupe cache driver")
+				return err
+			}
+
+			if err := is.SetCacheDriver(cache); err != nil {
+				return err
+			}
+		}
+
+		if c.Config.Storage.UploadDirectory != "" {
+			if err := is.SetUploadDir(c.Config.Storage.UploadDirectory); err != nil {
+				return err
+			}
+		}
+
+		is.SetGCInterval(c.Config.Storage.GCInterval)
+		is.SetGCParallelism(c.Config.Storage.GCParallelism)
+		is.SetGCDeleteRate(c.Config.Storage.GCDeleteRate)
+
+		c.ImageStore = is
+	}
+
+	// back up what's actually stored, with its dedupe cache
+	store := c.ImageStore
+	c.store = store
+
+	// dedupe and garbage collection happen within the store, out of reach of those wrapping it
+	if ts, ok := store.(interface{ SetTracer(storage.Tracer) }); ok && c.Tracer != nil {
+		ts.SetTracer(c.Tracer)
+	}
+
+	if c.Config.Storage.Check {
+		problems, err := storage.CheckImageStore(c.ImageStore, c.Log)
+		if err != nil {
+			c.Log.Error().Err(err).Msg("unable to check repositories")
+			return err
+		}
+
+		if len(problems) > 0 {
+			return errors.ErrRepoCorrupted
+		}
+	}
+
+	// let the modules reacting to changes of the storage know of them, whoever makes them
+	c.Bus = bus.New(c.Log)
+	c.ImageStore = bus.NewImageStore(c.ImageStore, c.Bus)
+
+	if len(c.Config.Storage.ArtifactTypes) > 0 {
+		c.ImageStore = storage.NewArtifactImageStore(c.ImageStore, c.Config.Storage.ArtifactTypes, c.Log)
+	}
+
+	if len(c.Config.Storage.ImmutableTags) > 0 {
+		c.ImageStore = storage.NewImmutableImageStore(c.ImageStore, c.Config.Storage.ImmutableTags, c.Log)
+	}
+
+	// mirror into, and pull through to, the local store
+	local := c.ImageStore
+
+	// serve what's missing locally from the upstream registries, if any
+	if c.Config.Proxy != nil {
+		p, err := proxy.NewProxy(c.Config.Proxy, c.ImageStore, c.Log)
+		if err != nil {
+			return err
+		}
+
+		c.ImageStore = p
+
+		if c.Config.Proxy.URL != "" {
+			c.Log.Info().Str("upstream", c.Config.Proxy.URL).Msg("proxying upstream registry")
+		}
+
+		for _, u := range c.Config.Proxy.Upstreams {
+			c.Log.Info().Str("upstream", u.URL).Str("prefix", u.Prefix).Msg("proxying upstream registry")
+		}
+	}
+
+	ctx, c.cancel = context.WithCancel(ctx)
+
+	if c.Config.Mirror != nil {
+		m, err := mirror.NewMirrorer(c.Config.Mirror, local, c.Log)
+		if err != nil {
+			c.cancel()
+			return err
+		}
+
+		c.Mirrorer = m
+
+		// copy what's pulled before it's mirrored, if any registry is mirrored on demand
+		for _, r := range c.Config.Mirror.Registries {
+			if r.OnDemand {
+				c.ImageStore = mirror.NewImageStore(c.ImageStore, m)
+				break
+			}
+		}
+
+		c.Mirrorer.Run(ctx, &c.wg)
+	}
+
+	if c.Config.Retention != nil {
+		e := retention.NewEnforcer(c.Config.Retention, local, c.Log)
+		e.Subscribe(c.Bus)
+		e.Run(ctx, &c.wg)
+	}
+
+	// evict what's least recently pulled, but mirrored images pinned to a digest
+	if c.Config.Eviction != nil {
+		config := *c.Config.Eviction
+		config.Pinned = append([]string{}, config.Pinned...)
+
+		if c.Config.Mirror != nil {
+			for _, r := range c.Config.Mirror.Registries {
+				for _, pin := range r.Pins {
+					config.Pinned = append(config.Pinned, pin.Repo)
+				}
+			}
+		}
+
+		evictor := eviction.NewEvictor(&config, local, c.Log)
+		c.ImageStore = eviction.NewImageStore(c.ImageStore, evictor)
+		evictor.Subscribe(c.Bus)
+
+		evictor.Run(ctx, &c.wg)
+	}
+
+	// over all the others, for the time spent in each to be traced
+	if c.Tracer != nil {
+		c.ImageStore = tracing.NewImageStore(c.ImageStore, c.Tracer)
+		c.Tracer.Run(ctx, &c.wg)
+	}
+
+	// act on images pushed, by clients or mirroring, or scanned
+	if c.Config.Actions != nil {
+		r, err := actions.NewRunner(c.Config.Actions, local, c.Log)
+		if err != nil {
+			c.cancel()
+			return err
+		}
+
+		c.Actions = r
+		c.Actions.Subscribe(c.Bus)
+		c.Actions.Run(ctx, &c.wg)
+	}
+
+	if c.Config.Backup != nil {
+		c.Backup = backup.NewManager(c.Config.Backup, store, c.Config.Storage.RootDirectory, c.Log)
+		c.Backup.Run(ctx, &c.wg)
+	}
+
+	if c.Config.Replicas != nil {
+		r, err := replicas.NewRedirector(c.Config.Replicas, c.Log)
+		if err != nil {
+			c.cancel()
+			return err
+		}
+
+		c.Replicas = r
+	}
+
+	if c.Config.Admission != nil {
+		c.Admission = admission.NewReviewer(c.Config.Admission, c.Log)
+	}
+
+	if c.Config.HTTP.Auth != nil && c.Config.HTTP.Auth.APIKey != nil {
+		keys, err := apikey.NewStore(c.Config.HTTP.Auth.APIKey, c.Config.Storage.RootDirectory, c.Log)
+		if err != nil {
+			c.cancel()
+			return err
+		}
+
+		c.APIKeys = keys
 	}
 
 	// Enable extensions if extension config is provided
 	if c.Config != nil && c.Config.Extensions != nil {
-		ext.EnableExtensions(c.Config.Extensions, c.Log, c.Config.Storage.RootDirectory)
+		ext.EnableExtensions(ctx, &c.wg, c.Config.Extensions, c.Log, c.Config.Storage.RootDirectory, c.Bus)
+	}
+
+	if c.Config.HTTP.Auth != nil && c.Config.HTTP.Auth.Bearer != nil && c.Config.HTTP.Auth.Bearer.Key != "" {
+		issuer, err := newTokenIssuer(c.Config.HTTP.Auth.Bearer, c.Log)
+		if err != nil {
+			c.cancel()
+			return err
+		}
+
+		c.issuer = issuer
 	}
 
 	c.Router = engine
 	c.Router.UseEncodedPath()
-	_ = NewRouteHandler(c)
+	rh := NewRouteHandler(c)
+
+	// served ahead of the router, and so of authentication, e.g. for probes, which can't
+	// authenticate
+	public := map[string]http.HandlerFunc{"/livez": rh.Livez, "/readyz": rh.Readyz}
+	if c.Metrics != nil && !c.Config.Metrics.Protected {
+		public[c.Config.Metrics.Endpoint()] = c.Metrics.ServeHTTP
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h, ok := public[r.URL.Path]; ok && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			h(w, r)
+			return
+		}
+
+		c.Router.ServeHTTP(w, r)
+	})
 
 	addr := fmt.Sprintf("%s:%s", c.Config.HTTP.Address, c.Config.HTTP.Port)
-	server := &http.Server{Addr: addr, Handler: c.Router}
+	server := &http.Server{Addr: addr, Handler: handler}
 	c.Server = server
 
-	// Create the listener
-	l, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
+	// HTTP/2 is negotiated over TLS by net/http itself, unless given the protocols to upgrade to
+	if c.Config.HTTP.DisableHTTP2 {
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	} else if c.Config.HTTP.H2C && !c.tlsEnabled() {
+		server.Handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+
+	// Create the listener, unless one was handed to us or inherited via systemd socket activation
+	l := c.Listener
+	if l == nil {
+		sl, nfds, err := sdListener()
+		if err != nil {
+			c.Log.Error().Err(err).Msg("unable to use socket-activated listener")
+			return err
+		}
+
+		if sl != nil {
+			if nfds > 1 {
+				c.Log.Warn().Int("fds", nfds).Msg("multiple sockets passed in, only the first one is used")
+			}
+
+			c.Log.Info().Str("addr", sl.Addr().String()).Msg("using socket-activated listener")
+
+			l = sl
+		} else if l, err = net.Listen("tcp", addr); err != nil {
+			c.cancel()
+			return err
+		}
+
+		c.Listener = l
 	}
 
-	if c.Config.HTTP.TLS != nil && c.Config.HTTP.TLS.Key != "" && c.Config.HTTP.TLS.Cert != "" {
+	if c.Config.Events != nil {
+		instanceID, err := guuid.NewV4()
+		if err != nil {
+			c.cancel()
+			return err
+		}
+
+		c.Events = events.NewNotifier(c.Config.Events,
+			events.Source{Addr: l.Addr().String(), InstanceID: instanceID.String()}, c.Log)
+		c.Events.Run(ctx, &c.wg)
+	}
+
+	// let the service manager know we are ready to accept connections
+	if _, err := sdNotify(sdNotifyReady); err != nil {
+		c.Log.Warn().Err(err).Msg("unable to notify service manager")
+	}
+
+	if c.tlsEnabled() {
 		if c.Config.HTTP.TLS.CACert != "" {
 			clientAuth := tls.VerifyClientCertIfGiven
 			if (c.Config.HTTP.Auth == nil || c.Config.HTTP.Auth.HTPasswd.Path == "") && !c.Config.HTTP.AllowReadAccess {
@@ -96,8 +479,263 @@ func (c *Controller) Run() error {
 			server.TLSConfig.BuildNameToCertificate() // nolint: staticcheck
 		}
 
-		return server.ServeTLS(l, c.Config.HTTP.TLS.Cert, c.Config.HTTP.TLS.Key)
 	}
 
-	return server.Serve(l)
+	c.serveErr = make(chan error, 1)
+
+	go func() {
+		if c.tlsEnabled() {
+			c.serveErr <- server.ServeTLS(l, c.Config.HTTP.TLS.Cert, c.Config.HTTP.TLS.Key)
+			return
+		}
+
+		c.serveErr <- server.Serve(l)
+	}()
+
+	return nil
+}
+
+// tlsEnabled returns whether connections are served over TLS.
+func (c *Controller) tlsEnabled() bool {
+	return c.Config.HTTP.TLS != nil && c.Config.HTTP.TLS.Key != "" && c.Config.HTTP.TLS.Cert != ""
+}
+
+// Port returns the port the controller is listening on, which is useful when
+// configured with port "0".
+func (c *Controller) Port() int {
+	if c.Listener == nil {
+		return 0
+	}
+
+	if addr, ok := c.Listener.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+
+	return 0
+}
+
+// Stop gracefully shuts down the server, stops and waits for background workers
+// and closes the image store.
+func (c *Controller) Stop(ctx context.Context) error {
+	if _, err := sdNotify(sdNotifyStopping); err != nil {
+		c.Log.Warn().Err(err).Msg("unable to notify service manager")
+	}
+
+	var err error
+
+	if c.Server != nil {
+		err = c.Server.Shutdown(ctx)
+	}
+
+	if c.cancel != nil {
+		c.cancel()
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	// the databases are closed even if the workers didn't stop in time, so that they are unlocked
+	var werr error
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		werr = ctx.Err()
+	}
+
+	if c.ImageStore != nil {
+		if cerr := c.ImageStore.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	if c.APIKeys != nil {
+		if cerr := c.APIKeys.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	if cerr := ext.CloseDB(); cerr != nil && err == nil {
+		err = cerr
+	}
+
+	if werr != nil {
+		return werr
+	}
+
+	return err
+}
+
+// Reload applies the parts of a configuration which can change without restarting, those
+// requests in flight, e.g. uploads, being served as they were: the users of the htpasswd file,
+// the log level, the registries mirrored and the rules and destinations of actions. Mirroring
+// and actions are only reloaded if configured when started, as is the htpasswd file, other
+// settings, e.g. the address, TLS or storage, needing a restart. Either all of them are applied,
+// along with those of c.Config, or, if any can't be, e.g. the htpasswd file can't be read, none.
+func (c *Controller) Reload(config *Config) error {
+	if err := config.Validate(c.Log); err != nil {
+		c.Log.Error().Err(err).Msg("configuration validation failed, not reloaded")
+		return err
+	}
+
+	c.reloadLock.Lock()
+	defer c.reloadLock.Unlock()
+
+	var hashes map[string]string
+
+	reloadHtpasswd := config.HTTP.Auth != nil && config.HTTP.Auth.HTPasswd.Path != "" &&
+		c.Config.HTTP.Auth != nil && c.Config.HTTP.Auth.HTPasswd.Path != ""
+	if reloadHtpasswd {
+		var err error
+
+		if hashes, err = readHtpasswd(config.HTTP.Auth.HTPasswd.Path); err != nil {
+			c.Log.Error().Err(err).Str("path", config.HTTP.Auth.HTPasswd.Path).Msg("unable to reload htpasswd")
+			return err
+		}
+	}
+
+	var applyMirror, applyActions func()
+
+	if c.Mirrorer != nil && config.Mirror != nil {
+		var err error
+
+		if applyMirror, err = c.Mirrorer.PrepareReload(config.Mirror); err != nil {
+			c.Log.Error().Err(err).Msg("unable to reload mirrored registries")
+			return err
+		}
+	}
+
+	if c.Actions != nil && config.Actions != nil {
+		var err error
+
+		if applyActions, err = c.Actions.PrepareReload(config.Actions); err != nil {
+			c.Log.Error().Err(err).Msg("unable to reload actions")
+			return err
+		}
+	}
+
+	// nothing can fail from here on; the settings reloaded aren't read by requests from c.Config,
+	// but from the parts they are applied to
+	if reloadHtpasswd {
+		c.htpasswd.set(hashes)
+		c.Config.HTTP.Auth.HTPasswd.Path = config.HTTP.Auth.HTPasswd.Path
+	}
+
+	if applyMirror != nil {
+		applyMirror()
+		c.Config.Mirror = config.Mirror
+	}
+
+	if applyActions != nil {
+		applyActions()
+		c.Config.Actions = config.Actions
+	}
+
+	c.Log.Info().Interface("params", config.Sanitize()).Msg("configuration reloaded")
+
+	// last, for the above to be logged whatever the level, which is valid
+	if config.Log != nil {
+		_ = c.Log.SetLevel(config.Log.Level)
+
+		if c.Config.Log == nil {
+			c.Config.Log = &LogConfig{}
+		}
+
+		c.Config.Log.Level = config.Log.Level
+	}
+
+	return nil
+}
+
+// storageOptions returns the options of the image stores of a storage config, which is valid.
+// Scrub starts scrubbing a store in the background, unless it's already being scrubbed, one
+// scrub at a time re-hashing every blob, and returns whether it did.
+func (c *Controller) Scrub(is storage.ImageStore) bool {
+	c.scrubLock.Lock()
+	defer c.scrubLock.Unlock()
+
+	if c.scrubbing {
+		return false
+	}
+
+	c.scrubbing = true
+
+	c.wg.Add(1)
+
+	go func() {
+		defer c.wg.Done()
+
+		report, err := storage.ScrubStore(is, c.Log)
+		if err != nil {
+			c.Log.Error().Err(err).Msg("unable to scrub storage")
+		}
+
+		c.scrubLock.Lock()
+		defer c.scrubLock.Unlock()
+
+		c.scrubbing = false
+
+		if report != nil {
+			c.lastScrub = report
+		}
+	}()
+
+	return true
+}
+
+// ScrubStatus returns whether the storage is being scrubbed, and the report of the last scrub
+// done, if any.
+func (c *Controller) ScrubStatus() (bool, *storage.ScrubReport) {
+	c.scrubLock.Lock()
+	defer c.scrubLock.Unlock()
+
+	return c.scrubbing, c.lastScrub
+}
+
+func storageOptions(config StorageConfig) storage.Options {
+	opts := storage.Options{DropUploadCache: config.DropUploadCache, CacheShards: config.DedupeCacheShards}
+
+	if config.CopyBufferSize != "" {
+		size, _ := humanize.ParseBytes(config.CopyBufferSize)
+		opts.CopyBufferSize = int(size)
+	}
+
+	if config.WriteBufferSize != "" {
+		size, _ := humanize.ParseBytes(config.WriteBufferSize)
+		opts.WriteBufferSize = int(size)
+	}
+
+	return opts
+}
+
+// newMetrics returns the metrics of requests, along with those of garbage collection and, on a
+// filesystem, of storage usage.
+func newMetrics(config *Config) *metrics.Metrics {
+	m := metrics.New()
+
+	m.AddCounter("zot_gc_runs_total", "Garbage collections of repositories run.", func() float64 {
+		runs, _ := storage.GCRuns()
+		return float64(runs)
+	})
+	m.AddCounter("zot_gc_failures_total", "Garbage collections of repositories failed.", func() float64 {
+		_, failures := storage.GCRuns()
+		return float64(failures)
+	})
+
+	if config.Storage.StorageDriver == nil && config.Storage.S3 == nil {
+		rootDir := config.Storage.RootDirectory
+
+		// walked at most once a minute, however often scraped
+		m.AddGauge("zot_storage_usage_bytes", "Bytes stored under the root directory.",
+			metrics.Cached(time.Minute, func() float64 {
+				usage, _ := storage.DiskUsage(rootDir)
+				return float64(usage)
+			}))
+	}
+
+	return m
 }
@@ -4,13 +4,21 @@ package api_test
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -19,13 +27,35 @@ import (
 	"path"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/http2"
 
 	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/actions"
+	"github.com/anuvu/zot/pkg/admission"
 	"github.com/anuvu/zot/pkg/api"
+	"github.com/anuvu/zot/pkg/apikey"
+	"github.com/anuvu/zot/pkg/backup"
+	"github.com/anuvu/zot/pkg/bus"
+	"github.com/anuvu/zot/pkg/events"
+	"github.com/anuvu/zot/pkg/eviction"
+	"github.com/anuvu/zot/pkg/extensions"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/metrics"
+	"github.com/anuvu/zot/pkg/mirror"
+	"github.com/anuvu/zot/pkg/oidc"
+	"github.com/anuvu/zot/pkg/proxy"
+	"github.com/anuvu/zot/pkg/replicas"
+	"github.com/anuvu/zot/pkg/retention"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	"github.com/anuvu/zot/pkg/tracing"
+	"github.com/anuvu/zot/pkg/upstream"
 	"github.com/chartmuseum/auth"
 	"github.com/mitchellh/mapstructure"
 	godigest "github.com/opencontainers/go-digest"
@@ -1218,6 +1248,332 @@ func TestBearerAuth(t *testing.T) {
 	})
 }
 
+func TestBearerTokenIssuer(t *testing.T) {
+	Convey("Issue bearer tokens to the users of htpasswd", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		htpasswdPath := makeHtpasswdFile()
+		defer os.Remove(htpasswdPath)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.Auth = &api.AuthConfig{
+			HTPasswd: api.AuthHTPasswd{Path: htpasswdPath},
+			Bearer: &api.BearerConfig{
+				Cert:    ServerCert,
+				Key:     ServerKey,
+				Realm:   "http://zot.example.com" + api.TokenPath,
+				Service: "zot",
+			},
+		}
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		resp, err := resty.R().Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+
+		challenge := parseBearerAuthHeader(resp.Header().Get("Www-Authenticate"))
+		So(challenge.Realm, ShouldEqual, config.HTTP.Auth.Bearer.Realm)
+
+		token := func(user string, password string, scope string) (*resty.Response, accessTokenResponse) {
+			req := resty.R().SetQueryParam("service", "zot").SetQueryParam("scope", scope)
+			if user != "" {
+				req.SetBasicAuth(user, password)
+			}
+
+			resp, err := req.Get(baseURL + api.TokenPath)
+			So(err, ShouldBeNil)
+
+			var token accessTokenResponse
+			if resp.StatusCode() == http.StatusOK {
+				So(json.Unmarshal(resp.Body(), &token), ShouldBeNil)
+			}
+
+			return resp, token
+		}
+
+		// only to users authenticated, read access not being allowed
+		resp, _ = token("", "", "repository:repo:pull")
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+
+		resp, _ = token(username, "wrong", "repository:repo:pull")
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+
+		// and for zot only
+		resp, err = resty.R().SetBasicAuth(username, passphrase).SetQueryParam("service", "other").
+			Get(baseURL + api.TokenPath)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusBadRequest)
+
+		resp, good := token(username, passphrase, "repository:repo:pull,push")
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(good.AccessToken, ShouldNotBeEmpty)
+
+		// naming the user
+		parts := strings.Split(good.AccessToken, ".")
+		So(parts, ShouldHaveLength, 3)
+
+		claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+		So(err, ShouldBeNil)
+
+		var subject struct {
+			Subject string `json:"sub"`
+		}
+
+		So(json.Unmarshal(claims, &subject), ShouldBeNil)
+		So(subject.Subject, ShouldEqual, username)
+
+		resp, err = resty.R().SetAuthToken(good.AccessToken).Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		resp, err = resty.R().SetAuthToken(good.AccessToken).Post(baseURL + "/v2/repo/blobs/uploads/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusAccepted)
+
+		// only to the repositories of its scope
+		resp, err = resty.R().SetAuthToken(good.AccessToken).Post(baseURL + "/v2/other/blobs/uploads/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+
+		// and actions
+		resp, pull := token(username, passphrase, "repository:other:pull")
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		resp, err = resty.R().SetAuthToken(pull.AccessToken).Get(baseURL + "/v2/other/tags/list")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldNotEqual, http.StatusUnauthorized)
+
+		resp, err = resty.R().SetAuthToken(pull.AccessToken).Post(baseURL + "/v2/other/blobs/uploads/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+	})
+
+	Convey("Limit the rate of token requests", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		htpasswdPath := makeHtpasswdFile()
+		defer os.Remove(htpasswdPath)
+
+		rate := 1
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.Ratelimit = &api.RatelimitConfig{Rate: &rate}
+		config.HTTP.Auth = &api.AuthConfig{
+			HTPasswd: api.AuthHTPasswd{Path: htpasswdPath},
+			Bearer: &api.BearerConfig{
+				Cert:    ServerCert,
+				Key:     ServerKey,
+				Realm:   "http://zot.example.com" + api.TokenPath,
+				Service: "zot",
+			},
+		}
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		resp, err := resty.R().SetBasicAuth(username, "wrong").Get(baseURL + api.TokenPath)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+
+		resp, err = resty.R().SetBasicAuth(username, passphrase).Get(baseURL + api.TokenPath)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusTooManyRequests)
+	})
+
+	Convey("Grant only the actions access control policies allow", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		htpasswdPath := makeHtpasswdFileFromString(getCredString(username, passphrase) + "\n" +
+			getCredString("other", "other") + "\n")
+		defer os.Remove(htpasswdPath)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.Auth = &api.AuthConfig{
+			HTPasswd: api.AuthHTPasswd{Path: htpasswdPath},
+			Bearer: &api.BearerConfig{
+				Cert:    ServerCert,
+				Key:     ServerKey,
+				Realm:   "http://zot.example.com" + api.TokenPath,
+				Service: "zot",
+			},
+		}
+		config.HTTP.AccessControl = &api.AccessControlConfig{
+			Repositories: map[string]api.PolicyGroup{
+				"team/*": {
+					Policies:      []api.Policy{{Users: []string{username}, Actions: []string{"pull", "push"}}},
+					DefaultPolicy: []string{"pull"},
+				},
+			},
+		}
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		token := func(user string, scope string) string {
+			resp, err := resty.R().SetBasicAuth(user, user).SetQueryParam("service", "zot").
+				SetQueryParam("scope", scope).Get(baseURL + api.TokenPath)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+			var token accessTokenResponse
+			So(json.Unmarshal(resp.Body(), &token), ShouldBeNil)
+
+			return token.AccessToken
+		}
+
+		push := func(token string, name string) int {
+			resp, err := resty.R().SetAuthToken(token).Post(baseURL + "/v2/" + name + "/blobs/uploads/")
+			So(err, ShouldBeNil)
+
+			return resp.StatusCode()
+		}
+
+		So(push(token(username, "repository:team/repo:pull,push"), "team/repo"), ShouldEqual, http.StatusAccepted)
+
+		// pulls only, by default
+		other := token("other", "repository:team/repo:pull,push")
+		So(push(other, "team/repo"), ShouldEqual, http.StatusUnauthorized)
+
+		resp, err := resty.R().SetAuthToken(other).Get(baseURL + "/v2/team/repo/tags/list")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldNotEqual, http.StatusUnauthorized)
+
+		// and nothing on repositories without policies
+		resp, err = resty.R().SetAuthToken(token(username, "repository:repo:pull,push")).
+			Get(baseURL + "/v2/repo/tags/list")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+	})
+
+	Convey("Issue pull tokens to anonymous users with read access allowed", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		htpasswdPath := makeHtpasswdFile()
+		defer os.Remove(htpasswdPath)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.AllowReadAccess = true
+		config.HTTP.Auth = &api.AuthConfig{
+			HTPasswd: api.AuthHTPasswd{Path: htpasswdPath},
+			Bearer: &api.BearerConfig{
+				Cert:    ServerCert,
+				Key:     ServerKey,
+				Realm:   "http://zot.example.com" + api.TokenPath,
+				Service: "zot",
+			},
+		}
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		resp, err := resty.R().SetQueryParam("scope", "repository:repo:pull,push").Get(baseURL + api.TokenPath)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		var anonymous accessTokenResponse
+		So(json.Unmarshal(resp.Body(), &anonymous), ShouldBeNil)
+
+		resp, err = resty.R().SetAuthToken(anonymous.AccessToken).Get(baseURL + "/v2/repo/tags/list")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldNotEqual, http.StatusUnauthorized)
+
+		resp, err = resty.R().SetAuthToken(anonymous.AccessToken).Post(baseURL + "/v2/repo/blobs/uploads/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+	})
+
+}
+
+func TestAccessControl(t *testing.T) {
+	Convey("Deny the actions access control policies don't allow", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		htpasswdPath := makeHtpasswdFileFromString(getCredString(username, passphrase) + "\n" +
+			getCredString("other", "other") + "\n" + getCredString("admin", "admin") + "\n")
+		defer os.Remove(htpasswdPath)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.Auth = &api.AuthConfig{HTPasswd: api.AuthHTPasswd{Path: htpasswdPath}}
+		config.HTTP.AccessControl = &api.AccessControlConfig{
+			Repositories: map[string]api.PolicyGroup{
+				"team/*": {
+					Policies:      []api.Policy{{Users: []string{username}, Actions: []string{"pull", "push"}}},
+					DefaultPolicy: []string{"pull"},
+				},
+			},
+			AdminPolicy: api.Policy{Users: []string{"admin"}},
+		}
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		request := func(user string, method string, path string) int {
+			resp, err := resty.R().SetBasicAuth(user, user).Execute(method, baseURL+path)
+			So(err, ShouldBeNil)
+
+			return resp.StatusCode()
+		}
+
+		So(request(username, http.MethodPost, "/v2/team/repo/blobs/uploads/"), ShouldEqual, http.StatusAccepted)
+		So(request("other", http.MethodGet, "/v2/team/repo/tags/list"), ShouldNotEqual, http.StatusForbidden)
+		So(request("other", http.MethodPost, "/v2/team/repo/blobs/uploads/"), ShouldEqual, http.StatusForbidden)
+		So(request(username, http.MethodGet, "/v2/repo/tags/list"), ShouldEqual, http.StatusForbidden)
+		So(request("admin", http.MethodPost, "/v2/repo/blobs/uploads/"), ShouldEqual, http.StatusAccepted)
+
+		// only repositories are
+		So(request("other", http.MethodGet, "/v2/"), ShouldEqual, http.StatusOK)
+	})
+
+	Convey("Validate access control policies", t, func() {
+		config := api.NewConfig()
+		config.HTTP.AccessControl = &api.AccessControlConfig{
+			Repositories: map[string]api.PolicyGroup{"team/*": {DefaultPolicy: []string{"delete"}}},
+		}
+		So(config.Validate(log.NewLogger("debug", "")), ShouldNotBeNil)
+
+		config.HTTP.AccessControl = &api.AccessControlConfig{
+			Repositories: map[string]api.PolicyGroup{"team/[": {DefaultPolicy: []string{"pull"}}},
+		}
+		So(config.Validate(log.NewLogger("debug", "")), ShouldNotBeNil)
+	})
+}
+
 func TestBearerAuthWithAllowReadAccess(t *testing.T) {
 	Convey("Make a new controller", t, func() {
 		authTestServer := makeAuthTestServer()
@@ -1523,81 +1879,389 @@ func TestHTTPReadOnly(t *testing.T) {
 			}()
 		}
 	})
+
+	Convey("Without auth", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log.NewLogger("debug", ""))
+		So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.ReadOnly = true
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		// pulls still work
+		resp, err := resty.R().Get(baseURL + "/v2/repo/manifests/1.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		mblob, err := img.ManifestBlob()
+		So(err, ShouldBeNil)
+
+		resp, err = resty.R().SetHeader("Content-Type", ispec.MediaTypeImageManifest).SetBody(mblob).
+			Put(baseURL + "/v2/repo/manifests/2.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusMethodNotAllowed)
+		So(resp.Header().Get("Allow"), ShouldEqual, "GET, HEAD")
+
+		resp, err = resty.R().Delete(baseURL + "/v2/repo/manifests/1.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusMethodNotAllowed)
+
+		resp, err = resty.R().Post(baseURL + "/v2/repo/blobs/uploads/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusMethodNotAllowed)
+	})
 }
 
-func TestParallelRequests(t *testing.T) {
-	testCases := []struct {
-		srcImageName  string
-		srcImageTag   string
-		destImageName string
-		destImageTag  string
-		testCaseName  string
-	}{
-		{
-			srcImageName:  "zot-test",
-			srcImageTag:   "0.0.1",
-			destImageName: "zot-1-test",
-			destImageTag:  "0.0.1",
-			testCaseName:  "Request-1",
-		},
-		{
-			srcImageName:  "zot-test",
-			srcImageTag:   "0.0.1",
-			destImageName: "zot-2-test",
-			testCaseName:  "Request-2",
-		},
-		{
-			srcImageName:  "zot-cve-test",
-			srcImageTag:   "0.0.1",
-			destImageName: "zot-3-test",
-			testCaseName:  "Request-3",
-		},
-		{
-			srcImageName:  "zot-cve-test",
-			srcImageTag:   "0.0.1",
-			destImageName: "zot-4-test",
-			testCaseName:  "Request-4",
-		},
-		{
-			srcImageName:  "zot-cve-test",
-			srcImageTag:   "0.0.1",
-			destImageName: "zot-5-test",
-			testCaseName:  "Request-5",
-		},
-		{
-			srcImageName:  "zot-cve-test",
-			srcImageTag:   "0.0.1",
-			destImageName: "zot-1-test",
-			testCaseName:  "Request-6",
-		},
-		{
-			srcImageName:  "zot-cve-test",
-			srcImageTag:   "0.0.1",
-			destImageName: "zot-2-test",
-			testCaseName:  "Request-7",
-		},
-		{
-			srcImageName:  "zot-cve-test",
-			srcImageTag:   "0.0.1",
-			destImageName: "zot-3-test",
-			testCaseName:  "Request-8",
-		},
-		{
-			srcImageName:  "zot-cve-test",
-			srcImageTag:   "0.0.1",
-			destImageName: "zot-4-test",
-			testCaseName:  "Request-9",
-		},
-		{
-			srcImageName:  "zot-cve-test",
-			srcImageTag:   "0.0.1",
-			destImageName: "zot-5-test",
-			testCaseName:  "Request-10",
-		},
-		{
-			srcImageName:  "zot-test",
-			srcImageTag:   "0.0.1",
-			destImageName: "zot-1-test",
+func TestSystemdNotify(t *testing.T) {
+	Convey("Notify the service manager when ready", t, func() {
+		dir, err := ioutil.TempDir("", "sd-notify-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		addr := &net.UnixAddr{Name: path.Join(dir, "notify.sock"), Net: "unixgram"}
+		conn, err := net.ListenUnixgram(addr.Net, addr)
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		os.Setenv("NOTIFY_SOCKET", addr.Name)
+		defer os.Unsetenv("NOTIFY_SOCKET")
+
+		config := api.NewConfig()
+		config.HTTP.Port = SecurePort3
+		c := api.NewController(config)
+		c.Config.Storage.RootDirectory = dir
+		go func(controller *api.Controller) {
+			// this blocks
+			if err := controller.Run(); err != nil {
+				return
+			}
+		}(c)
+		defer func(controller *api.Controller) {
+			ctx := context.Background()
+			_ = controller.Server.Shutdown(ctx)
+		}(c)
+
+		So(conn.SetReadDeadline(time.Now().Add(10*time.Second)), ShouldBeNil)
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		So(err, ShouldBeNil)
+		So(string(buf[:n]), ShouldEqual, "READY=1")
+
+		resp, err := resty.R().Get(BaseURL3 + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, 200)
+	})
+}
+
+func TestStartStop(t *testing.T) {
+	Convey("Start and stop a controller on a random port", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		c := api.NewController(config)
+		c.Config.Storage.RootDirectory = dir
+		So(c.Port(), ShouldEqual, 0)
+
+		// returns once listening
+		So(c.Start(context.Background()), ShouldBeNil)
+		So(c.Port(), ShouldNotEqual, 0)
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+		resp, err := resty.R().Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, 200)
+
+		So(c.Stop(context.Background()), ShouldBeNil)
+
+		_, err = resty.R().Get(baseURL + "/v2/")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Close the databases even if the workers don't stop in time", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		htpasswdPath := makeHtpasswdFile()
+		defer os.Remove(htpasswdPath)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.Auth = &api.AuthConfig{HTPasswd: api.AuthHTPasswd{Path: htpasswdPath},
+			APIKey: &apikey.Config{MaxExpiry: time.Hour}}
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err = c.Stop(ctx)
+		if err != nil {
+			So(err, ShouldEqual, context.Canceled)
+		}
+
+		// the db is locked until closed
+		s, err := apikey.NewStore(config.HTTP.Auth.APIKey, dir, log.NewLogger("debug", ""))
+		So(err, ShouldBeNil)
+		So(s.Close(), ShouldBeNil)
+	})
+}
+
+func TestRatelimit(t *testing.T) {
+	Convey("Limit the rate of requests", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		rate := 1
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.Ratelimit = &api.RatelimitConfig{
+			Rate:    &rate,
+			Methods: []api.MethodRatelimitConfig{{Method: "post", Rate: 1}},
+		}
+		c := api.NewController(config)
+		c.Config.Storage.RootDirectory = dir
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+		resp, err := resty.R().Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, 200)
+
+		resp, err = resty.R().Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusTooManyRequests)
+
+		resp, err = resty.R().Post(baseURL + "/v2/repo/blobs/uploads/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusTooManyRequests)
+
+		time.Sleep(time.Second)
+
+		resp, err = resty.R().Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, 200)
+	})
+
+	Convey("Reject invalid rates", t, func() {
+		rate := 0
+		config := api.NewConfig()
+		config.HTTP.Ratelimit = &api.RatelimitConfig{Rate: &rate}
+		So(config.Validate(api.NewController(config).Log), ShouldNotBeNil)
+
+		config.HTTP.Ratelimit = &api.RatelimitConfig{Methods: []api.MethodRatelimitConfig{{Method: "GET"}}}
+		So(config.Validate(api.NewController(config).Log), ShouldNotBeNil)
+	})
+}
+
+func TestDisableDelete(t *testing.T) {
+	Convey("Reject deletes when disabled", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.DisableDelete = true
+		c := api.NewController(config)
+		c.Config.Storage.RootDirectory = dir
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+		digest := godigest.FromString("x").String()
+
+		resp, err := resty.R().Delete(baseURL + "/v2/repo/manifests/" + digest)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusMethodNotAllowed)
+
+		resp, err = resty.R().Delete(baseURL + "/v2/repo/blobs/" + digest)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusMethodNotAllowed)
+	})
+}
+
+func TestIntegrityCheck(t *testing.T) {
+	Convey("Check repositories at startup", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log.NewLogger("debug", ""))
+		So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		config.Storage.Check = true
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		So(c.Stop(context.Background()), ShouldBeNil)
+
+		layer := godigest.FromBytes(img.Layers[0])
+		So(os.Remove(path.Join(dir, "repo", "blobs", "sha256", layer.Encoded())), ShouldBeNil)
+
+		c = api.NewController(config)
+		So(c.Start(context.Background()), ShouldEqual, errors.ErrRepoCorrupted)
+	})
+}
+
+func TestVersion(t *testing.T) {
+	Convey("Get build information", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		config.Extensions = &extensions.ExtensionConfig{Search: &extensions.SearchConfig{}}
+		api.Commit = "v1.0.0-0-gdeadbee"
+		api.ReleaseTag = "v1.0.0"
+		defer func() { api.Commit, api.ReleaseTag = "", "" }()
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		resp, err := resty.R().Get(fmt.Sprintf("http://127.0.0.1:%d/v2/_zot/version", c.Port()))
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		var info api.VersionInfo
+		So(json.Unmarshal(resp.Body(), &info), ShouldBeNil)
+		So(info.Version, ShouldEqual, "v1.0.0")
+		So(info.Commit, ShouldEqual, "v1.0.0-0-gdeadbee")
+		So(info.GoVersion, ShouldStartWith, "go")
+		So(info.DistSpecVersion, ShouldNotBeEmpty)
+		So(info.CompiledExtensions, ShouldContain, "search")
+		So(info.EnabledExtensions, ShouldResemble, []string{"search"})
+	})
+}
+
+func TestPresets(t *testing.T) {
+	Convey("Apply configuration presets", t, func() {
+		config := api.NewConfig()
+		So(config.ApplyPreset("unknown"), ShouldNotBeNil)
+
+		So(config.ApplyPreset(api.PresetMinimal), ShouldBeNil)
+		So(config.Preset, ShouldEqual, api.PresetMinimal)
+		So(config.Storage.GC, ShouldBeFalse)
+		So(config.Storage.Dedupe, ShouldBeFalse)
+
+		config = api.NewConfig()
+		So(config.ApplyPreset(api.PresetSecure), ShouldBeNil)
+		So(config.HTTP.DisableDelete, ShouldBeTrue)
+		So(config.HTTP.Ratelimit, ShouldNotBeNil)
+
+		// TLS is required
+		log := api.NewController(config).Log
+		So(config.Validate(log), ShouldNotBeNil)
+		config.HTTP.TLS = &api.TLSConfig{Cert: ServerCert, Key: ServerKey}
+		So(config.Validate(log), ShouldBeNil)
+
+		config.Preset = "unknown"
+		So(config.Validate(log), ShouldNotBeNil)
+	})
+}
+
+func TestParallelRequests(t *testing.T) {
+	testCases := []struct {
+		srcImageName  string
+		srcImageTag   string
+		destImageName string
+		destImageTag  string
+		testCaseName  string
+	}{
+		{
+			srcImageName:  "zot-test",
+			srcImageTag:   "0.0.1",
+			destImageName: "zot-1-test",
+			destImageTag:  "0.0.1",
+			testCaseName:  "Request-1",
+		},
+		{
+			srcImageName:  "zot-test",
+			srcImageTag:   "0.0.1",
+			destImageName: "zot-2-test",
+			testCaseName:  "Request-2",
+		},
+		{
+			srcImageName:  "zot-cve-test",
+			srcImageTag:   "0.0.1",
+			destImageName: "zot-3-test",
+			testCaseName:  "Request-3",
+		},
+		{
+			srcImageName:  "zot-cve-test",
+			srcImageTag:   "0.0.1",
+			destImageName: "zot-4-test",
+			testCaseName:  "Request-4",
+		},
+		{
+			srcImageName:  "zot-cve-test",
+			srcImageTag:   "0.0.1",
+			destImageName: "zot-5-test",
+			testCaseName:  "Request-5",
+		},
+		{
+			srcImageName:  "zot-cve-test",
+			srcImageTag:   "0.0.1",
+			destImageName: "zot-1-test",
+			testCaseName:  "Request-6",
+		},
+		{
+			srcImageName:  "zot-cve-test",
+			srcImageTag:   "0.0.1",
+			destImageName: "zot-2-test",
+			testCaseName:  "Request-7",
+		},
+		{
+			srcImageName:  "zot-cve-test",
+			srcImageTag:   "0.0.1",
+			destImageName: "zot-3-test",
+			testCaseName:  "Request-8",
+		},
+		{
+			srcImageName:  "zot-cve-test",
+			srcImageTag:   "0.0.1",
+			destImageName: "zot-4-test",
+			testCaseName:  "Request-9",
+		},
+		{
+			srcImageName:  "zot-cve-test",
+			srcImageTag:   "0.0.1",
+			destImageName: "zot-5-test",
+			testCaseName:  "Request-10",
+		},
+		{
+			srcImageName:  "zot-test",
+			srcImageTag:   "0.0.1",
+			destImageName: "zot-1-test",
 			destImageTag:  "0.0.1",
 			testCaseName:  "Request-11",
 		},
@@ -1990,3 +2654,3118 @@ func copyFiles(sourceDir string, destDir string) error {
 
 	return nil
 }
+
+func TestProxy(t *testing.T) {
+	Convey("Pull through a proxy of another registry", t, func() {
+		upstreamDir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(upstreamDir)
+
+		img, err := test.GetRandomImage(64, 2)
+		So(err, ShouldBeNil)
+		is := storage.NewImageStore(upstreamDir, false, false, storage.Options{}, log.NewLogger("debug", ""))
+		So(test.WriteImageToStore(img, is, "library/repo", "1.0"), ShouldBeNil)
+
+		upstreamConfig := api.NewConfig()
+		upstreamConfig.HTTP.Port = "0"
+		upstreamConfig.Storage.RootDirectory = upstreamDir
+
+		uc := api.NewController(upstreamConfig)
+		So(uc.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = uc.Stop(context.Background()) }()
+
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		upstreamURL := fmt.Sprintf("http://127.0.0.1:%d", uc.Port())
+		config.Proxy = &proxy.Config{Config: upstream.Config{URL: upstreamURL, Password: "secret"},
+			Upstreams: []proxy.UpstreamConfig{{Config: upstream.Config{URL: upstreamURL, Password: "secret"},
+				Prefix: "quay.io"}},
+			ManifestTTL: time.Minute}
+
+		So(config.Sanitize().Proxy.Password, ShouldNotEqual, "secret")
+		So(config.Sanitize().Proxy.Upstreams[0].Password, ShouldNotEqual, "secret")
+		So(config.Proxy.Password, ShouldEqual, "secret")
+		So(config.Proxy.Upstreams[0].Password, ShouldEqual, "secret")
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		digest, err := img.Digest()
+		So(err, ShouldBeNil)
+
+		resp, err := resty.R().Get(baseURL + "/v2/library/repo/manifests/1.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Header().Get("Docker-Content-Digest"), ShouldEqual, digest.String())
+
+		layer := godigest.FromBytes(img.Layers[1])
+
+		resp, err = resty.R().Get(baseURL + "/v2/library/repo/blobs/" + layer.String())
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Body(), ShouldResemble, img.Layers[1])
+
+		// the image is now served locally
+		_, err = os.Stat(path.Join(dir, "library", "repo", "blobs", "sha256", layer.Encoded()))
+		So(err, ShouldBeNil)
+
+		// and under the prefix of the other upstream, named without it there
+		resp, err = resty.R().Get(baseURL + "/v2/quay.io/library/repo/manifests/1.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Header().Get("Docker-Content-Digest"), ShouldEqual, digest.String())
+
+		_, err = os.Stat(path.Join(dir, "quay.io", "library", "repo", "blobs", "sha256", layer.Encoded()))
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestMirror(t *testing.T) {
+	Convey("Mirror another registry", t, func() {
+		upstreamDir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(upstreamDir)
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		is := storage.NewImageStore(upstreamDir, false, false, storage.Options{}, log.NewLogger("debug", ""))
+		So(test.WriteImageToStore(img, is, "library/repo", "1.0"), ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "other", "1.0"), ShouldBeNil)
+
+		upstreamConfig := api.NewConfig()
+		upstreamConfig.HTTP.Port = "0"
+		upstreamConfig.Storage.RootDirectory = upstreamDir
+
+		uc := api.NewController(upstreamConfig)
+		So(uc.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = uc.Stop(context.Background()) }()
+
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		config.Mirror = &mirror.Config{Registries: []mirror.RegistryConfig{{
+			Config:   upstream.Config{URL: fmt.Sprintf("http://127.0.0.1:%d", uc.Port()), Password: "secret"},
+			Content:  []mirror.ContentConfig{{Prefix: "library/*"}},
+			OnDemand: true,
+		}}}
+
+		So(config.Sanitize().Mirror.Registries[0].Password, ShouldNotEqual, "secret")
+		So(config.Mirror.Registries[0].Password, ShouldEqual, "secret")
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		digest, err := img.Digest()
+		So(err, ShouldBeNil)
+
+		var mirrored string
+
+		for i := 0; i < 50 && mirrored == ""; i++ {
+			_, mirrored, _, _ = c.ImageStore.GetImageManifest("library/repo", "1.0")
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		So(mirrored, ShouldEqual, digest.String())
+
+		_, err = os.Stat(path.Join(dir, "other"))
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		// pushed upstream since, and pulled before the next poll
+		late, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(late, fmt.Sprintf("http://127.0.0.1:%d", uc.Port()), "library/repo", "2.0"), ShouldBeNil)
+
+		resp, err := resty.R().Get(fmt.Sprintf("http://127.0.0.1:%d/v2/library/repo/manifests/2.0", c.Port()))
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		lateDigest, err := late.Digest()
+		So(err, ShouldBeNil)
+		So(resp.Header().Get(api.DistContentDigestKey), ShouldEqual, lateDigest.String())
+	})
+}
+
+func TestSharedStorage(t *testing.T) {
+	Convey("Serve the same storage from several instances", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		controllers := make([]*api.Controller, 2)
+
+		for i := range controllers {
+			config := api.NewConfig()
+			config.HTTP.Port = "0"
+			config.Storage.RootDirectory = dir
+			config.Storage.Shared = true
+
+			controllers[i] = api.NewController(config)
+			So(controllers[i].Start(context.Background()), ShouldBeNil)
+
+			defer func(c *api.Controller) { _ = c.Stop(context.Background()) }(controllers[i])
+		}
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(img, fmt.Sprintf("http://127.0.0.1:%d", controllers[0].Port()), "repo", "1.0"),
+			ShouldBeNil)
+
+		digest, err := img.Digest()
+		So(err, ShouldBeNil)
+
+		resp, err := resty.R().Get(fmt.Sprintf("http://127.0.0.1:%d/v2/repo/manifests/1.0", controllers[1].Port()))
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Header().Get("Docker-Content-Digest"), ShouldEqual, digest.String())
+
+		// upload sessions are shared too
+		resp, err = resty.R().Post(fmt.Sprintf("http://127.0.0.1:%d/v2/repo/blobs/uploads/", controllers[0].Port()))
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusAccepted)
+
+		content := []byte("blob")
+		blob := godigest.FromBytes(content)
+		loc := resp.Header().Get("Location")
+
+		resp, err = resty.R().SetQueryParam("digest", blob.String()).SetBody(content).
+			SetHeader("Content-Type", "application/octet-stream").
+			Put(fmt.Sprintf("http://127.0.0.1:%d%s", controllers[1].Port(), loc))
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusCreated)
+	})
+}
+
+func TestEvents(t *testing.T) {
+	Convey("Notify an endpoint of pushes, pulls and deletes", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		var lock sync.Mutex
+
+		received := []events.Event{}
+
+		endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var envelope events.Envelope
+			if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			lock.Lock()
+			received = append(received, envelope.Events...)
+			lock.Unlock()
+		}))
+		defer endpoint.Close()
+
+		htpasswdPath := makeHtpasswdFile()
+		defer os.Remove(htpasswdPath)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.Auth = &api.AuthConfig{HTPasswd: api.AuthHTPasswd{Path: htpasswdPath}}
+		config.HTTP.AllowReadAccess = true
+		config.Storage.RootDirectory = dir
+		config.Events = &events.Config{Endpoints: []events.EndpointConfig{{
+			Name:    "test",
+			URL:     endpoint.URL,
+			Headers: map[string]string{"Authorization": "secret"},
+			DeliveryConfig: events.DeliveryConfig{
+				Ignore: &events.IgnoreConfig{MediaTypes: []string{api.BinaryMediaType}},
+			},
+		}}}
+
+		So(config.Sanitize().Events.Endpoints[0].Headers["Authorization"], ShouldNotEqual, "secret")
+		So(config.Events.Endpoints[0].Headers["Authorization"], ShouldEqual, "secret")
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImageWithBasicAuth(img, baseURL, "repo", "1.0", "test", "test"), ShouldBeNil)
+
+		digest, err := img.Digest()
+		So(err, ShouldBeNil)
+
+		resp, err := resty.R().Get(baseURL + "/v2/repo/manifests/1.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		// bearer tokens which aren't verified name no actor
+		claims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"ci"}`))
+		resp, err = resty.R().SetAuthToken("header." + claims + ".signature").
+			Delete(baseURL + "/v2/repo/manifests/1.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+
+		// untagged by the user authenticated
+		resp, err = resty.R().SetBasicAuth("test", "test").Delete(baseURL + "/v2/repo/manifests/1.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusAccepted)
+
+		resp, err = resty.R().Get(baseURL + "/v2/repo/tags/list")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(string(resp.Body()), ShouldEqual, `{"name":"repo","tags":[]}`)
+
+		// pending events are delivered on shutdown
+		So(c.Stop(context.Background()), ShouldBeNil)
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		So(received, ShouldHaveLength, 3)
+
+		So(received[0].Action, ShouldEqual, events.ActionPush)
+		So(received[0].Actor.Name, ShouldEqual, "test")
+		So(received[0].Target.Repository, ShouldEqual, "repo")
+		So(received[0].Target.Tag, ShouldEqual, "1.0")
+		So(received[0].Target.Digest, ShouldEqual, digest.String())
+		So(received[0].Target.MediaType, ShouldEqual, ispec.MediaTypeImageManifest)
+		So(received[0].Target.URL, ShouldEqual, baseURL+"/v2/repo/manifests/"+digest.String())
+
+		So(received[1].Action, ShouldEqual, events.ActionPull)
+		So(received[1].Request.Method, ShouldEqual, http.MethodGet)
+		So(received[1].Actor.Name, ShouldBeEmpty)
+
+		So(received[2].Action, ShouldEqual, events.ActionDelete)
+		So(received[2].Target.Tag, ShouldEqual, "1.0")
+		So(received[2].Target.Digest, ShouldEqual, digest.String())
+		So(received[2].Actor.Name, ShouldEqual, "test")
+		So(received[2].Source.InstanceID, ShouldEqual, received[0].Source.InstanceID)
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	Convey("Expose metrics to Prometheus", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		htpasswdPath := makeHtpasswdFile()
+		defer os.Remove(htpasswdPath)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.Auth = &api.AuthConfig{HTPasswd: api.AuthHTPasswd{Path: htpasswdPath}}
+		config.Storage.RootDirectory = dir
+
+		config.Metrics = &metrics.Config{Path: "/v2/metrics"}
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldEqual, errors.ErrBadConfig)
+
+		config.Metrics = &metrics.Config{Path: "/readyz"}
+		c = api.NewController(config)
+		So(c.Start(context.Background()), ShouldEqual, errors.ErrBadConfig)
+
+		Convey("ahead of authentication", func() {
+			config.Metrics = &metrics.Config{}
+
+			c := api.NewController(config)
+			So(c.Start(context.Background()), ShouldBeNil)
+			defer func() { _ = c.Stop(context.Background()) }()
+
+			baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+			resp, err := resty.R().SetBasicAuth("test", "test").Post(baseURL + "/v2/repo/blobs/uploads/")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusAccepted)
+
+			blob := make([]byte, 100)
+			resp, err = resty.R().SetBasicAuth("test", "test").
+				SetHeader("Content-Type", "application/octet-stream").
+				SetQueryParam("digest", godigest.FromBytes(blob).String()).
+				SetBody(blob).Put(baseURL + resp.Header().Get("Location"))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusCreated)
+
+			resp, err = resty.R().Get(baseURL + "/v2/repo/manifests/1.0")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+
+			resp, err = resty.R().Get(baseURL + metrics.DefaultPath)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+			So(resp.Header().Get("Content-Type"), ShouldEqual, metrics.ContentType)
+
+			lines := strings.Split(string(resp.Body()), "\n")
+			So(lines, ShouldContain,
+				`zot_http_requests_total{method="PUT",route="/v2/{name}/blobs/uploads/{session_id}",code="201"} 1`)
+			So(lines, ShouldContain,
+				`zot_http_requests_total{method="GET",route="/v2/{name}/manifests/{reference}",code="401"} 1`)
+			So(lines, ShouldContain, "zot_blob_upload_bytes_total 100")
+			So(lines, ShouldContain, "# TYPE zot_storage_usage_bytes gauge")
+			So(lines, ShouldContain, "# TYPE zot_gc_runs_total counter")
+		})
+
+		Convey("behind authentication", func() {
+			config.Metrics = &metrics.Config{Path: "/internal/metrics", Protected: true}
+
+			c := api.NewController(config)
+			So(c.Start(context.Background()), ShouldBeNil)
+			defer func() { _ = c.Stop(context.Background()) }()
+
+			baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+			resp, err := resty.R().Get(baseURL + "/internal/metrics")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+
+			resp, err = resty.R().SetBasicAuth("test", "test").Get(baseURL + "/internal/metrics")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+			So(string(resp.Body()), ShouldContainSubstring, "zot_http_requests_total")
+
+			resp, err = resty.R().Get(baseURL + metrics.DefaultPath)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldNotEqual, http.StatusOK)
+		})
+	})
+}
+
+func TestTracing(t *testing.T) {
+	Convey("Trace requests and the storage operations serving them", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		type span struct {
+			Name         string `json:"name"`
+			TraceID      string `json:"traceId"`
+			SpanID       string `json:"spanId"`
+			ParentSpanID string `json:"parentSpanId"`
+		}
+
+		var lock sync.Mutex
+
+		spans := map[string][]span{} // by name
+
+		collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req struct {
+				ResourceSpans []struct {
+					ScopeSpans []struct {
+						Spans []span `json:"spans"`
+					} `json:"scopeSpans"`
+				} `json:"resourceSpans"`
+			}
+
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			for _, rs := range req.ResourceSpans {
+				for _, ss := range rs.ScopeSpans {
+					for _, s := range ss.Spans {
+						spans[s.Name] = append(spans[s.Name], s)
+					}
+				}
+			}
+		}))
+		defer collector.Close()
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+
+		config.Tracing = &tracing.Config{Exporter: "zipkin"}
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldEqual, errors.ErrBadConfig)
+
+		config.Tracing = &tracing.Config{Endpoint: collector.URL + "/v1/traces",
+			Headers: map[string]string{"Authorization": "Bearer secret"}}
+		So(config.Sanitize().Tracing.Headers["Authorization"], ShouldEqual, "******")
+		So(config.Tracing.Headers["Authorization"], ShouldEqual, "Bearer secret")
+
+		c = api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+		traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+		resp, err := resty.R().SetHeader(tracing.TraceparentHeader, traceparent).Post(baseURL + "/v2/repo/blobs/uploads/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusAccepted)
+
+		blob := make([]byte, 100)
+		resp, err = resty.R().SetHeader(tracing.TraceparentHeader, traceparent).
+			SetHeader("Content-Type", "application/octet-stream").
+			SetQueryParam("digest", godigest.FromBytes(blob).String()).
+			SetBody(blob).Put(baseURL + resp.Header().Get("Location"))
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusCreated)
+
+		// spans are exported once stopped, if not before
+		So(c.Stop(context.Background()), ShouldBeNil)
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		puts := spans["PUT /v2/{name}/blobs/uploads/{session_id}"]
+		So(len(puts), ShouldEqual, 1)
+		So(puts[0].TraceID, ShouldEqual, "4bf92f3577b34da6a3ce929d0e0e4736")
+		So(puts[0].ParentSpanID, ShouldEqual, "00f067aa0ba902b7")
+
+		finishes := spans["storage.FinishBlobUpload"]
+		So(len(finishes), ShouldEqual, 1)
+		So(finishes[0].ParentSpanID, ShouldEqual, puts[0].SpanID)
+
+		dedupes := spans["storage.dedupe"]
+		So(len(dedupes), ShouldEqual, 1)
+		So(dedupes[0].ParentSpanID, ShouldEqual, finishes[0].SpanID)
+
+		So(spans["POST /v2/{name}/blobs/uploads/"], ShouldNotBeEmpty)
+		So(spans["storage.NewBlobUpload"], ShouldNotBeEmpty)
+	})
+}
+
+func TestProbes(t *testing.T) {
+	Convey("Probe liveness and readiness without authenticating", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		htpasswdPath := makeHtpasswdFile()
+		defer os.Remove(htpasswdPath)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.Auth = &api.AuthConfig{HTPasswd: api.AuthHTPasswd{Path: htpasswdPath}}
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		resp, err := resty.R().Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+
+		resp, err = resty.R().Get(baseURL + "/livez")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		resp, err = resty.R().Head(baseURL + "/livez")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		var readiness api.Readiness
+
+		resp, err = resty.R().Get(baseURL + "/readyz")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(json.Unmarshal(resp.Body(), &readiness), ShouldBeNil)
+		So(readiness, ShouldResemble, api.Readiness{Storage: "ok", Extensions: "ok"})
+
+		// not ready once the storage is gone, e.g. unmounted
+		So(os.RemoveAll(dir), ShouldBeNil)
+
+		resp, err = resty.R().Get(baseURL + "/readyz")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusServiceUnavailable)
+		So(json.Unmarshal(resp.Body(), &readiness), ShouldBeNil)
+		So(readiness.Storage, ShouldNotEqual, "ok")
+		So(readiness.Extensions, ShouldEqual, "ok")
+
+		// still alive
+		resp, err = resty.R().Get(baseURL + "/livez")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		// and only for probing
+		resp, err = resty.R().Post(baseURL + "/readyz")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldNotEqual, http.StatusOK)
+	})
+}
+
+func TestOpenID(t *testing.T) {
+	Convey("Authenticate users with the ID tokens of an OpenID Connect provider", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		So(err, ShouldBeNil)
+
+		var issuer string
+
+		provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/.well-known/openid-configuration":
+				_ = json.NewEncoder(w).Encode(map[string]string{"issuer": issuer, "jwks_uri": issuer + "/keys",
+					"authorization_endpoint": issuer + "/authorize", "token_endpoint": issuer + "/token"})
+			case "/keys":
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+					"kty": "RSA", "kid": "key",
+					"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				}}})
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer provider.Close()
+
+		issuer = provider.URL
+
+		idToken := func(aud string) string {
+			header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "key"})
+			claims, _ := json.Marshal(map[string]interface{}{"iss": issuer, "aud": aud, "sub": ALICE,
+				"groups": []string{"dev"}, "exp": time.Now().Add(time.Hour).Unix()})
+
+			signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+			digest := sha256.Sum256([]byte(signed))
+
+			signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+			So(err, ShouldBeNil)
+
+			return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+		}
+
+		var lock sync.Mutex
+
+		reviewed := []admission.Request{}
+
+		service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req admission.Request
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			lock.Lock()
+			reviewed = append(reviewed, req)
+			lock.Unlock()
+
+			_ = json.NewEncoder(w).Encode(admission.Response{Allowed: true})
+		}))
+		defer service.Close()
+
+		htpasswdPath := makeHtpasswdFile()
+		defer os.Remove(htpasswdPath)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.Auth = &api.AuthConfig{HTPasswd: api.AuthHTPasswd{Path: htpasswdPath},
+			OpenID: &oidc.Config{Issuer: issuer, ClientID: "zot", ClientSecret: "secret",
+				RedirectURL: "http://zot.example.com/auth/callback"}}
+		config.Storage.RootDirectory = dir
+		config.Admission = &admission.Config{URL: service.URL}
+
+		So(config.Sanitize().HTTP.Auth.OpenID.ClientSecret, ShouldNotEqual, "secret")
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		resp, err := resty.R().Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+
+		// as bearer token
+		resp, err = resty.R().SetAuthToken(idToken("zot")).Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		resp, err = resty.R().SetAuthToken(idToken("other")).Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+
+		// as password, e.g. of docker login
+		resp, err = resty.R().SetBasicAuth(ALICE, idToken("zot")).Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		resp, err = resty.R().SetBasicAuth(ALICE, idToken("other")).Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+
+		// htpasswd users still authenticate
+		resp, err = resty.R().SetBasicAuth(username, passphrase).Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		resp, err = resty.R().SetBasicAuth(username, "wrong").Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+
+		// users log in without authenticating first, sent to the provider
+		resp, _ = resty.New().SetRedirectPolicy(resty.NoRedirectPolicy()).R().Get(baseURL + oidc.LoginPath)
+		So(resp, ShouldNotBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusFound)
+		So(resp.Header().Get("Location"), ShouldStartWith, issuer+"/authorize?")
+
+		// the groups of users are given to the admission service
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, c.ImageStore, "repo", "1.0"), ShouldBeNil)
+
+		manifest, err := img.ManifestBlob()
+		So(err, ShouldBeNil)
+
+		resp, err = resty.R().SetAuthToken(idToken("zot")).SetHeader("Content-Type", ispec.MediaTypeImageManifest).
+			SetBody(manifest).Put(baseURL + "/v2/repo/manifests/2.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusCreated)
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		So(reviewed, ShouldHaveLength, 1)
+		So(reviewed[0].Actor, ShouldEqual, ALICE)
+		So(reviewed[0].Groups, ShouldResemble, []string{"dev"})
+
+		// logins are rate limited as any other request
+		rate := 1
+		limitedDir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(limitedDir)
+
+		limited := *config
+		limited.HTTP.Ratelimit = &api.RatelimitConfig{Rate: &rate}
+		limited.Storage.RootDirectory = limitedDir
+
+		lc := api.NewController(&limited)
+		So(lc.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = lc.Stop(context.Background()) }()
+
+		client := resty.New().SetRedirectPolicy(resty.NoRedirectPolicy())
+		limitedURL := fmt.Sprintf("http://127.0.0.1:%d", lc.Port())
+
+		resp, _ = client.R().Get(limitedURL + oidc.LoginPath)
+		So(resp, ShouldNotBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusFound)
+
+		resp, _ = client.R().Get(limitedURL + oidc.CallbackPath)
+		So(resp, ShouldNotBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusTooManyRequests)
+	})
+}
+
+func TestClientIdentity(t *testing.T) {
+	Convey("Name the users of client certificates after their fields", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		caCert, err := ioutil.ReadFile(CACert)
+		So(err, ShouldBeNil)
+
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(caCert)
+
+		ca, err := tls.LoadX509KeyPair(CACert, "../../test/data/ca.key")
+		So(err, ShouldBeNil)
+
+		ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0])
+		So(err, ShouldBeNil)
+
+		// client certificates of workloads, named by their URI
+		clientCert := func(uri string) tls.Certificate {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			So(err, ShouldBeNil)
+
+			u, err := url.Parse(uri)
+			So(err, ShouldBeNil)
+
+			template := &x509.Certificate{SerialNumber: big.NewInt(time.Now().UnixNano()),
+				NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+				KeyUsage: x509.KeyUsageDigitalSignature, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+				URIs: []*url.URL{u}}
+
+			der, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, &key.PublicKey, ca.PrivateKey)
+			So(err, ShouldBeNil)
+
+			return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+		}
+
+		var lock sync.Mutex
+
+		reviewed := []admission.Request{}
+
+		service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req admission.Request
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			lock.Lock()
+			reviewed = append(reviewed, req)
+			lock.Unlock()
+
+			_ = json.NewEncoder(w).Encode(admission.Response{Allowed: true})
+		}))
+		defer service.Close()
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.TLS = &api.TLSConfig{Cert: ServerCert, Key: ServerKey, CACert: CACert,
+			ClientIdentity: &api.ClientIdentityConfig{Field: api.ClientIdentityURI,
+				Pattern: "^spiffe://example.org/ci/(.+)$",
+				Users:   map[string]string{"spiffe://example.org/admin": "root"}}}
+		config.Storage.RootDirectory = dir
+		config.Admission = &admission.Config{URL: service.URL}
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("https://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, c.ImageStore, "repo", "1.0"), ShouldBeNil)
+
+		manifest, err := img.ManifestBlob()
+		So(err, ShouldBeNil)
+
+		for i, uri := range []string{"spiffe://example.org/ci/build", "spiffe://example.org/admin",
+			"spiffe://example.org/other"} {
+			client := resty.New().SetTLSClientConfig(&tls.Config{RootCAs: caCertPool,
+				Certificates: []tls.Certificate{clientCert(uri)}})
+
+			resp, err := client.R().SetHeader("Content-Type", ispec.MediaTypeImageManifest).
+				SetBody(manifest).Put(fmt.Sprintf("%s/v2/repo/manifests/%d.0", baseURL, i+2))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusCreated)
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		So(reviewed, ShouldHaveLength, 3)
+		So(reviewed[0].Actor, ShouldEqual, "build")
+		So(reviewed[1].Actor, ShouldEqual, "root")
+		// not matching the pattern, anonymous
+		So(reviewed[2].Actor, ShouldBeEmpty)
+	})
+
+	Convey("Validate client identity configurations", t, func() {
+		log := log.NewLogger("debug", "")
+
+		config := api.NewConfig()
+		config.HTTP.TLS = &api.TLSConfig{Cert: ServerCert, Key: ServerKey,
+			ClientIdentity: &api.ClientIdentityConfig{}}
+		So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+
+		config.HTTP.TLS.CACert = CACert
+		So(config.Validate(log), ShouldBeNil)
+
+		config.HTTP.TLS.ClientIdentity.Field = "serial"
+		So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+
+		config.HTTP.TLS.ClientIdentity.Field = api.ClientIdentityEmail
+		config.HTTP.TLS.ClientIdentity.Pattern = "("
+		So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+
+		// an error rather than a panic
+		config.HTTP.Port = "0"
+		So(api.NewController(config).Start(context.Background()), ShouldEqual, errors.ErrBadConfig)
+	})
+}
+
+func TestAPIKeys(t *testing.T) {
+	Convey("Authenticate CI pipelines with API keys minted by users", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		htpasswdPath := makeHtpasswdFile()
+		defer os.Remove(htpasswdPath)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.Auth = &api.AuthConfig{HTPasswd: api.AuthHTPasswd{Path: htpasswdPath},
+			APIKey: &apikey.Config{MaxExpiry: 24 * time.Hour}}
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		// only by users authenticated
+		resp, err := resty.R().SetBody(api.APIKeyRequest{Label: "ci"}).Post(baseURL + "/v2/_zot/apikeys")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+
+		resp, err = resty.R().SetBasicAuth(username, passphrase).SetBody(api.APIKeyRequest{ExpiresIn: "48h"}).
+			Post(baseURL + "/v2/_zot/apikeys")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusBadRequest)
+
+		resp, err = resty.R().SetBasicAuth(username, passphrase).SetBody(api.APIKeyRequest{Label: "ci",
+			ExpiresIn: "1h"}).Post(baseURL + "/v2/_zot/apikeys")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusCreated)
+
+		var key api.APIKeyResponse
+		So(json.Unmarshal(resp.Body(), &key), ShouldBeNil)
+		So(key.Token, ShouldStartWith, apikey.Prefix)
+		So(key.User, ShouldEqual, username)
+		So(key.Label, ShouldEqual, "ci")
+
+		// as password, e.g. of docker login, or in a header
+		resp, err = resty.R().SetBasicAuth("ci", key.Token).Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		resp, err = resty.R().SetHeader(apikey.Header, key.Token).Get(baseURL + "/v2/_catalog")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		resp, err = resty.R().SetHeader(apikey.Header, key.Token+"0").Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+
+		// authenticating as their user, but not minting others
+		var keys []apikey.Key
+
+		resp, err = resty.R().SetHeader(apikey.Header, key.Token).Get(baseURL + "/v2/_zot/apikeys")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(json.Unmarshal(resp.Body(), &keys), ShouldBeNil)
+		So(keys, ShouldHaveLength, 1)
+		So(keys[0].ID, ShouldEqual, key.ID)
+		So(string(resp.Body()), ShouldNotContainSubstring, key.Token)
+
+		resp, err = resty.R().SetHeader(apikey.Header, key.Token).Post(baseURL + "/v2/_zot/apikeys")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusForbidden)
+
+		// until revoked
+		resp, err = resty.R().SetBasicAuth(username, passphrase).Delete(baseURL + "/v2/_zot/apikeys/" + key.ID)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusNoContent)
+
+		resp, err = resty.R().SetBasicAuth(username, passphrase).Delete(baseURL + "/v2/_zot/apikeys/" + key.ID)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusNotFound)
+
+		resp, err = resty.R().SetBasicAuth("ci", key.Token).Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+
+		// users still authenticate with their password
+		resp, err = resty.R().SetBasicAuth(username, passphrase).Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+	})
+}
+
+func TestRetention(t *testing.T) {
+	Convey("Remove tags according to retention policies", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log.NewLogger("debug", ""))
+
+		for tag, days := range map[string]int{"old": 30, "new": 0} {
+			img, err := test.GetRandomImage(64, 1)
+			So(err, ShouldBeNil)
+
+			created := time.Now().AddDate(0, 0, -days)
+			img.Config.Created = &created
+
+			cblob, err := img.ConfigBlob()
+			So(err, ShouldBeNil)
+
+			img.Manifest.Config.Digest = godigest.FromBytes(cblob)
+			img.Manifest.Config.Size = int64(len(cblob))
+
+			So(test.WriteImageToStore(img, is, "repo", tag), ShouldBeNil)
+		}
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		config.Retention = &retention.Config{Policies: []retention.PolicyConfig{{
+			Repositories:  []string{"*"},
+			OlderThanDays: 7,
+		}}}
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		var tags []string
+
+		for i := 0; i < 50; i++ {
+			tags, err = c.ImageStore.GetImageTags("repo")
+			So(err, ShouldBeNil)
+
+			if len(tags) == 1 {
+				break
+			}
+
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		So(tags, ShouldResemble, []string{"new"})
+	})
+}
+
+func TestImmutableTags(t *testing.T) {
+	Convey("Refuse to move or delete immutable tags", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		config.Storage.ImmutableTags = []storage.ImmutableTagsConfig{{Tags: []string{`^v\d+\.\d+\.\d+$`}}}
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+
+		other, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+
+		So(test.UploadImage(img, baseURL, "repo", "v1.0.0"), ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "repo", "latest"), ShouldBeNil)
+
+		// pushing the same content again is fine, as is moving mutable tags
+		So(test.UploadImage(img, baseURL, "repo", "v1.0.0"), ShouldBeNil)
+		So(test.UploadImage(other, baseURL, "repo", "latest"), ShouldBeNil)
+
+		digest, err := img.Digest()
+		So(err, ShouldBeNil)
+
+		mblob, err := other.ManifestBlob()
+		So(err, ShouldBeNil)
+
+		_, err = c.ImageStore.PutImageManifest("repo", "v1.0.0", ispec.MediaTypeImageManifest, mblob)
+		So(err, ShouldEqual, errors.ErrTagImmutable)
+		So(c.ImageStore.DeleteImageManifest("repo", digest.String()), ShouldEqual, errors.ErrTagImmutable)
+
+		resp, err := resty.R().SetHeader("Content-Type", ispec.MediaTypeImageManifest).SetBody(mblob).
+			Put(baseURL + "/v2/repo/manifests/v1.0.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusConflict)
+
+		resp, err = resty.R().Delete(baseURL + "/v2/repo/manifests/" + digest.String())
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusForbidden)
+
+		resp, err = resty.R().Get(baseURL + "/v2/repo/manifests/v1.0.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Header().Get(api.DistContentDigestKey), ShouldEqual, digest.String())
+	})
+}
+
+func TestArtifactTypes(t *testing.T) {
+	Convey("Accept the artifacts allowed", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		config.Storage.ArtifactTypes = []string{"application/vnd.cncf.helm.*"}
+
+		So(config.Validate(log.NewLogger("debug", "")), ShouldBeNil)
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "app", "1.0"), ShouldBeNil)
+
+		chart := img
+		chart.Manifest.Config.MediaType = "application/vnd.cncf.helm.config.v1+json"
+		So(test.UploadImage(chart, baseURL, "chart", "1.0"), ShouldBeNil)
+
+		module := img
+		module.Manifest.Config.MediaType = "application/vnd.wasm.config.v1+json"
+
+		mblob, err := module.ManifestBlob()
+		So(err, ShouldBeNil)
+
+		resp, err := resty.R().SetHeader("Content-Type", ispec.MediaTypeImageManifest).SetBody(mblob).
+			Put(baseURL + "/v2/app/manifests/module")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusBadRequest)
+		So(string(resp.Body()), ShouldContainSubstring, "MANIFEST_INVALID")
+	})
+
+	Convey("Reject invalid artifact types", t, func() {
+		config := api.NewConfig()
+		config.Storage.ArtifactTypes = []string{"["}
+
+		So(config.Validate(log.NewLogger("debug", "")), ShouldEqual, errors.ErrBadConfig)
+	})
+}
+
+func TestCopyBufferSize(t *testing.T) {
+	Convey("Transfer blobs with pooled buffers of the configured size", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		config.Storage.CopyBufferSize = "1KB"
+		config.Storage.WriteBufferSize = "4KB"
+		config.Storage.DropUploadCache = true
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		// several buffers' worth
+		img, err := test.GetRandomImage(10000, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "repo", "1.0"), ShouldBeNil)
+
+		resp, err := resty.R().Get(baseURL + "/v2/repo/blobs/" + godigest.FromBytes(img.Layers[0]).String())
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Body(), ShouldResemble, img.Layers[0])
+	})
+
+	Convey("Reject invalid copy buffer sizes", t, func() {
+		config := api.NewConfig()
+		log := api.NewController(config).Log
+
+		for _, size := range []string{"big", "0", "1GB"} {
+			config.Storage.CopyBufferSize = size
+			So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+		}
+
+		config.Storage.CopyBufferSize = ""
+
+		for _, size := range []string{"big", "0", "1GB"} {
+			config.Storage.WriteBufferSize = size
+			So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+		}
+	})
+}
+
+func TestDedupeCacheShards(t *testing.T) {
+	Convey("Spread the dedupe cache over the configured dbs", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		config.Storage.DedupeCacheShards = 4
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(64, 4)
+		So(err, ShouldBeNil)
+
+		for _, repo := range []string{"a", "b"} {
+			So(test.UploadImage(img, baseURL, repo, "1.0"), ShouldBeNil)
+		}
+
+		for _, db := range []string{storage.CacheName + ".db", storage.CacheName + ".3.db"} {
+			_, err = os.Stat(path.Join(dir, db))
+			So(err, ShouldBeNil)
+		}
+
+		// deduped
+		for _, layer := range img.Manifest.Layers {
+			a, err := os.Stat(path.Join(dir, "a", "blobs", "sha256", layer.Digest.Encoded()))
+			So(err, ShouldBeNil)
+			b, err := os.Stat(path.Join(dir, "b", "blobs", "sha256", layer.Digest.Encoded()))
+			So(err, ShouldBeNil)
+			So(os.SameFile(a, b), ShouldBeTrue)
+		}
+	})
+
+	Convey("Reject invalid dedupe cache shards", t, func() {
+		config := api.NewConfig()
+		log := api.NewController(config).Log
+
+		for _, shards := range []int{-1, storage.MaxCacheShards + 1} {
+			config.Storage.DedupeCacheShards = shards
+			So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+		}
+	})
+}
+
+func TestGCInterval(t *testing.T) {
+	Convey("Reject an invalid garbage collection interval", t, func() {
+		config := api.NewConfig()
+		log := api.NewController(config).Log
+
+		config.Storage.GCInterval = 10 * time.Minute
+		So(config.Validate(log), ShouldBeNil)
+
+		config.Storage.GCInterval = -time.Minute
+		So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+
+		config.Storage.GCInterval = 0
+		config.Storage.GCParallelism = 4
+		config.Storage.GCDeleteRate = 100
+		So(config.Validate(log), ShouldBeNil)
+
+		config.Storage.GCParallelism = -1
+		So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+
+		config.Storage.GCParallelism = 0
+		config.Storage.GCDeleteRate = -1
+		So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+	})
+}
+
+func TestUploadDirectory(t *testing.T) {
+	Convey("Stage uploads in the configured directory", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		uploadDir, err := ioutil.TempDir("", "oci-upload-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(uploadDir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		config.Storage.UploadDirectory = path.Join(uploadDir, "staging")
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		resp, err := resty.R().Post(baseURL + "/v2/a/blobs/uploads/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusAccepted)
+
+		files, err := ioutil.ReadDir(path.Join(uploadDir, "staging", "a"))
+		So(err, ShouldBeNil)
+		So(files, ShouldHaveLength, 1)
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "a", "1.0"), ShouldBeNil)
+
+		resp, err = resty.R().Get(baseURL + "/v2/a/tags/list")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+	})
+
+	Convey("Reject an upload directory for shared storage", t, func() {
+		config := api.NewConfig()
+		config.Storage.Shared = true
+		config.Storage.UploadDirectory = "/tmp/uploads"
+
+		So(config.Validate(api.NewController(config).Log), ShouldEqual, errors.ErrBadConfig)
+	})
+}
+
+func TestS3(t *testing.T) {
+	Convey("Validate S3 storage", t, func() {
+		config := api.NewConfig()
+		config.Storage.S3 = &storage.S3Config{Bucket: "zot", Region: "us-east-1", SecretAccessKey: "secret"}
+		log := api.NewController(config).Log
+
+		So(config.Validate(log), ShouldBeNil)
+		So(config.Sanitize().Storage.S3.SecretAccessKey, ShouldNotEqual, "secret")
+		So(config.Storage.S3.SecretAccessKey, ShouldEqual, "secret")
+
+		config.Storage.Shared = true
+		So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+
+		config.Storage.Shared = false
+		config.Storage.S3.Region = ""
+		So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+	})
+}
+
+func TestStorageDriver(t *testing.T) {
+	Convey("Serve images with a storage driver", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.StorageDriver = map[string]interface{}{"name": "filesystem", "rootdirectory": dir}
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "a", "1.0"), ShouldBeNil)
+
+		resp, err := resty.R().Get(baseURL + "/v2/a/tags/list")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		_, err = os.Stat(path.Join(dir, "a", "index.json"))
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Validate storage drivers", t, func() {
+		config := api.NewConfig()
+		config.Storage.StorageDriver = map[string]interface{}{"name": "s3", "secretaccesskey": "secret"}
+		log := api.NewController(config).Log
+
+		So(config.Validate(log), ShouldBeNil)
+		So(config.Sanitize().Storage.StorageDriver["secretaccesskey"], ShouldNotEqual, "secret")
+		So(config.Storage.StorageDriver["secretaccesskey"], ShouldEqual, "secret")
+
+		config.Storage.StorageDriver["name"] = "unknown"
+		So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+	})
+}
+
+func TestDedupeCacheDriver(t *testing.T) {
+	Convey("Dedupe with a cache driver", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		config.Storage.Dedupe = true
+		config.Storage.DedupeCacheDriver = map[string]interface{}{"name": storage.BoltCacheDriverName}
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "a", "1.0"), ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "b", "1.0"), ShouldBeNil)
+
+		layer := img.Manifest.Layers[0].Digest
+		fia, err := os.Stat(path.Join(dir, "a", "blobs", layer.Algorithm().String(), layer.Encoded()))
+		So(err, ShouldBeNil)
+		fib, err := os.Stat(path.Join(dir, "b", "blobs", layer.Algorithm().String(), layer.Encoded()))
+		So(err, ShouldBeNil)
+		So(os.SameFile(fia, fib), ShouldBeTrue)
+	})
+
+	Convey("Validate dedupe cache drivers", t, func() {
+		config := api.NewConfig()
+		config.Storage.RootDirectory = "/tmp"
+		config.Storage.Dedupe = true
+		config.Storage.DedupeCacheDriver = map[string]interface{}{"name": "redis", "address": "redis:6379",
+			"password": "secret"}
+		log := api.NewController(config).Log
+
+		So(config.Validate(log), ShouldBeNil)
+		So(config.Sanitize().Storage.DedupeCacheDriver["password"], ShouldNotEqual, "secret")
+		So(config.Storage.DedupeCacheDriver["password"], ShouldEqual, "secret")
+
+		config.Storage.Dedupe = false
+		So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+
+		config.Storage.Dedupe = true
+		config.Storage.DedupeCacheDriver["name"] = "unknown"
+		So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+	})
+}
+
+func TestLargeManifest(t *testing.T) {
+	Convey("Reject manifests over the maximum size", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(1000, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "repo", "1.0"), ShouldBeNil)
+
+		// padded with an annotation, still within the limit
+		img.Manifest.Annotations = map[string]string{"pad": strings.Repeat("a", 1024*1024)}
+		body, err := json.Marshal(img.Manifest)
+		So(err, ShouldBeNil)
+
+		resp, err := resty.R().SetHeader("Content-Type", ispec.MediaTypeImageManifest).
+			SetBody(body).Put(baseURL + "/v2/repo/manifests/1.1")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusCreated)
+
+		resp, err = resty.R().Get(baseURL + "/v2/repo/manifests/1.1")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Body(), ShouldResemble, body)
+
+		img.Manifest.Annotations["pad"] = strings.Repeat("a", api.MaxManifestSize)
+		body, err = json.Marshal(img.Manifest)
+		So(err, ShouldBeNil)
+
+		resp, err = resty.R().SetHeader("Content-Type", ispec.MediaTypeImageManifest).
+			SetBody(body).Put(baseURL + "/v2/repo/manifests/1.2")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusRequestEntityTooLarge)
+
+		tags, err := c.ImageStore.GetImageTags("repo")
+		So(err, ShouldBeNil)
+		So(tags, ShouldNotContain, "1.2")
+	})
+
+	Convey("Reject manifests over the maximum size configured", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.MaxManifestSize = 1024
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(1000, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "repo", "1.0"), ShouldBeNil)
+
+		img.Manifest.Annotations = map[string]string{"pad": strings.Repeat("a", 1024)}
+		body, err := json.Marshal(img.Manifest)
+		So(err, ShouldBeNil)
+
+		resp, err := resty.R().SetHeader("Content-Type", ispec.MediaTypeImageManifest).
+			SetBody(body).Put(baseURL + "/v2/repo/manifests/1.1")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusRequestEntityTooLarge)
+		So(string(resp.Body()), ShouldContainSubstring, "SIZE_INVALID")
+	})
+}
+
+func TestReload(t *testing.T) {
+	Convey("Reload the configuration without restarting", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		htpasswdPath := makeHtpasswdFile()
+		defer os.Remove(htpasswdPath)
+
+		logFile, err := ioutil.TempFile("", "zot-log")
+		So(err, ShouldBeNil)
+		defer os.Remove(logFile.Name())
+
+		newConfig := func(level string) *api.Config {
+			config := api.NewConfig()
+			config.HTTP.Port = "0"
+			config.HTTP.Auth = &api.AuthConfig{HTPasswd: api.AuthHTPasswd{Path: htpasswdPath}}
+			config.Storage.RootDirectory = dir
+			config.Log = &api.LogConfig{Level: level, Output: logFile.Name()}
+			config.Mirror = &mirror.Config{}
+
+			return config
+		}
+
+		c := api.NewController(newConfig("debug"))
+
+		level := "warn"
+		c.LoadConfig = func() (*api.Config, error) {
+			if level == "" {
+				return nil, errors.ErrBadConfig
+			}
+
+			return newConfig(level), nil
+		}
+
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		resp, err := resty.R().SetBasicAuth(username, passphrase).Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		// users of the htpasswd file changed since
+		So(ioutil.WriteFile(htpasswdPath, []byte(getCredString("other", "secret")+"\n"), 0600), ShouldBeNil)
+
+		resp, err = resty.R().SetBasicAuth(username, passphrase).Post(baseURL + "/v2/_zot/config/reload")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusNoContent)
+
+		logged, err := ioutil.ReadFile(logFile.Name())
+		So(err, ShouldBeNil)
+		So(string(logged), ShouldContainSubstring, "configuration reloaded")
+		So(c.Config.Log.Level, ShouldEqual, "warn")
+
+		resp, err = resty.R().SetBasicAuth(username, passphrase).Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+
+		resp, err = resty.R().SetBasicAuth("other", "secret").Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		// requests aren't logged anymore at the level reloaded
+		after, err := ioutil.ReadFile(logFile.Name())
+		So(err, ShouldBeNil)
+		So(strings.Count(string(after), "HTTP API"), ShouldEqual, strings.Count(string(logged), "HTTP API"))
+
+		// nothing reloaded from a configuration which can't be loaded
+		level = ""
+
+		resp, err = resty.R().SetBasicAuth("other", "secret").Post(baseURL + "/v2/_zot/config/reload")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusBadRequest)
+
+		// or which isn't valid
+		invalid := newConfig("info")
+		invalid.HTTP.MaxBlobSize = -1
+		So(c.Reload(invalid), ShouldEqual, errors.ErrBadConfig)
+
+		// or of which a part can't be applied, the others being left as they were
+		So(ioutil.WriteFile(htpasswdPath, []byte(getCredString(username, passphrase)+"\n"), 0600), ShouldBeNil)
+
+		broken := newConfig("debug")
+		broken.Mirror = &mirror.Config{Registries: []mirror.RegistryConfig{{
+			Config: upstream.Config{URL: "https://127.0.0.1:1", CACert: path.Join(dir, "missing.crt")},
+		}}}
+		So(c.Reload(broken), ShouldNotBeNil)
+		So(c.Config.Log.Level, ShouldEqual, "warn")
+		So(c.Config.Mirror.Registries, ShouldBeEmpty)
+
+		resp, err = resty.R().SetBasicAuth(username, passphrase).Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+	})
+}
+
+func TestLargeBlob(t *testing.T) {
+	Convey("Reject blobs uploaded over the maximum size", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.MaxBlobSize = 1024
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		So(c.ImageStore.InitRepo("repo"), ShouldBeNil)
+
+		content := make([]byte, 2048)
+		_, err = rand.Read(content)
+		So(err, ShouldBeNil)
+
+		newUpload := func() string {
+			resp, err := resty.R().Post(baseURL + "/v2/repo/blobs/uploads/")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusAccepted)
+
+			return baseURL + resp.Header().Get("Location")
+		}
+
+		// monolithic, rejected before being read
+		resp, err := resty.R().SetHeader("Content-Type", api.BinaryMediaType).SetBody(content).
+			SetQueryParam("digest", godigest.FromBytes(content).String()).Post(baseURL + "/v2/repo/blobs/uploads/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusRequestEntityTooLarge)
+		So(string(resp.Body()), ShouldContainSubstring, "SIZE_INVALID")
+
+		// in chunks, the blob exceeding the maximum size, not each chunk
+		loc := newUpload()
+
+		resp, err = resty.R().SetHeader("Content-Type", api.BinaryMediaType).
+			SetHeader("Content-Range", "0-511").SetBody(content[:512]).Patch(loc)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusAccepted)
+
+		resp, err = resty.R().SetHeader("Content-Type", api.BinaryMediaType).
+			SetHeader("Content-Range", "512-1535").SetBody(content[512:1536]).Patch(loc)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusRequestEntityTooLarge)
+
+		resp, err = resty.R().SetHeader("Content-Type", api.BinaryMediaType).SetBody(content[512:1536]).
+			SetQueryParam("digest", godigest.FromBytes(content[:1536]).String()).Put(loc)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusRequestEntityTooLarge)
+
+		resp, err = resty.R().SetQueryParam("digest", godigest.FromBytes(content[:512]).String()).Put(loc)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusCreated)
+
+		// streamed without a length, stopped once over the maximum size
+		loc = newUpload()
+
+		req, err := http.NewRequest(http.MethodPatch, loc, ioutil.NopCloser(bytes.NewReader(content)))
+		So(err, ShouldBeNil)
+		req.Header.Set("Content-Type", api.BinaryMediaType)
+		So(req.ContentLength, ShouldEqual, 0)
+
+		r, err := http.DefaultClient.Do(req)
+		So(err, ShouldBeNil)
+		r.Body.Close()
+		So(r.StatusCode, ShouldEqual, http.StatusRequestEntityTooLarge)
+
+		ok, _, _ := c.ImageStore.CheckBlob("repo", godigest.FromBytes(content).String(), api.BinaryMediaType)
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestBlobMount(t *testing.T) {
+	Convey("Mount blobs already stored rather than uploading them", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(1000, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "a", "1.0"), ShouldBeNil)
+
+		layer := godigest.FromBytes(img.Layers[0])
+
+		resp, err := resty.R().SetQueryParams(map[string]string{"mount": layer.String(), "from": "a"}).
+			Post(baseURL + "/v2/b/blobs/uploads/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusCreated)
+		So(resp.Header().Get("Location"), ShouldEqual, "/v2/b/blobs/"+layer.String())
+		So(resp.Header().Get(api.DistContentDigestKey), ShouldEqual, layer.String())
+
+		resp, err = resty.R().Get(baseURL + "/v2/b/blobs/" + layer.String())
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Body(), ShouldResemble, img.Layers[0])
+
+		// uploaded in one go, acknowledged as is
+		resp, err = resty.R().SetQueryParam("digest", layer.String()).
+			SetHeader("Content-Type", api.BinaryMediaType).SetBody(img.Layers[0]).
+			Post(baseURL + "/v2/c/blobs/uploads/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusCreated)
+
+		resp, err = resty.R().Head(baseURL + "/v2/c/blobs/" + layer.String())
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		// not stored, to be uploaded
+		resp, err = resty.R().SetQueryParams(map[string]string{"mount": godigest.FromString("x").String(),
+			"from": "a"}).Post(baseURL + "/v2/b/blobs/uploads/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusAccepted)
+		So(resp.Header().Get("Location"), ShouldNotBeEmpty)
+
+		resp, err = resty.R().SetQueryParam("from", "a").Post(baseURL + "/v2/b/blobs/uploads/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusMethodNotAllowed)
+	})
+}
+
+func TestImageIndex(t *testing.T) {
+	Convey("Push and pull multiarch images", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		platforms := []ispec.Platform{{Architecture: "amd64", OS: "linux"}, {Architecture: "arm64", OS: "linux"}}
+		mi, err := test.GetRandomMultiarchImage(100, platforms)
+		So(err, ShouldBeNil)
+
+		iblob, err := mi.IndexBlob()
+		So(err, ShouldBeNil)
+
+		// its manifests must be pushed first
+		resp, err := resty.R().SetHeader("Content-Type", ispec.MediaTypeImageIndex).SetBody(iblob).
+			Put(baseURL + "/v2/a/manifests/1.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusBadRequest)
+
+		So(test.UploadMultiarchImage(mi, baseURL, "a", "1.0"), ShouldBeNil)
+
+		resp, err = resty.R().Get(baseURL + "/v2/a/manifests/1.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Header().Get("Content-Type"), ShouldEqual, ispec.MediaTypeImageIndex)
+		So(resp.Header().Get(api.DistContentDigestKey), ShouldEqual, godigest.FromBytes(iblob).String())
+		So(resp.Body(), ShouldResemble, iblob)
+
+		// and so are the images it references, along with their layers
+		for _, img := range mi.Images {
+			d, err := img.Digest()
+			So(err, ShouldBeNil)
+
+			resp, err = resty.R().Get(baseURL + "/v2/a/manifests/" + d.String())
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+			So(resp.Header().Get("Content-Type"), ShouldEqual, ispec.MediaTypeImageManifest)
+
+			resp, err = resty.R().Head(baseURL + "/v2/a/blobs/" + img.Manifest.Layers[0].Digest.String())
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		}
+
+		resp, err = resty.R().Get(baseURL + "/v2/a/tags/list")
+		So(err, ShouldBeNil)
+		So(string(resp.Body()), ShouldEqual, `{"name":"a","tags":["1.0"]}`)
+
+		resp, err = resty.R().SetHeader("Content-Type", "application/vnd.oci.image.unknown.v1+json").
+			SetBody(iblob).Put(baseURL + "/v2/a/manifests/1.1")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnsupportedMediaType)
+	})
+}
+
+func TestReferrers(t *testing.T) {
+	Convey("List the referrers of manifests", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(100, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "a", "1.0"), ShouldBeNil)
+
+		subject, err := img.Digest()
+		So(err, ShouldBeNil)
+
+		// a signature, of the config's media type
+		sig := img
+		sig.Manifest.Config.MediaType = "application/vnd.example.signature"
+		sig.Manifest.Annotations = map[string]string{"org.example.signer": "me"}
+
+		mblob, err := sig.ManifestBlob()
+		So(err, ShouldBeNil)
+
+		var manifest map[string]interface{}
+		So(json.Unmarshal(mblob, &manifest), ShouldBeNil)
+		manifest["subject"] = ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: subject, Size: 1}
+		mblob, err = json.Marshal(manifest)
+		So(err, ShouldBeNil)
+
+		digest := godigest.FromBytes(mblob)
+
+		resp, err := resty.R().SetHeader("Content-Type", ispec.MediaTypeImageManifest).SetBody(mblob).
+			Put(baseURL + "/v2/a/manifests/" + digest.String())
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusCreated)
+		So(resp.Header().Get(api.SubjectHeader), ShouldEqual, subject.String())
+
+		resp, err = resty.R().Get(baseURL + "/v2/a/referrers/" + subject.String())
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Header().Get("Content-Type"), ShouldEqual, ispec.MediaTypeImageIndex)
+		So(resp.Header().Get(api.FiltersAppliedHeader), ShouldBeEmpty)
+
+		var list api.ReferrersList
+		So(json.Unmarshal(resp.Body(), &list), ShouldBeNil)
+		So(list.SchemaVersion, ShouldEqual, 2)
+		So(list.MediaType, ShouldEqual, ispec.MediaTypeImageIndex)
+		So(list.Manifests, ShouldHaveLength, 1)
+		So(list.Manifests[0].Digest, ShouldEqual, digest)
+		So(list.Manifests[0].ArtifactType, ShouldEqual, "application/vnd.example.signature")
+		So(list.Manifests[0].Size, ShouldEqual, len(mblob))
+		So(list.Manifests[0].Annotations, ShouldResemble, map[string]string{"org.example.signer": "me"})
+
+		resp, err = resty.R().SetQueryParam("artifactType", "application/vnd.example.sbom").
+			Get(baseURL + "/v2/a/referrers/" + subject.String())
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Header().Get(api.FiltersAppliedHeader), ShouldEqual, "artifactType")
+		So(string(resp.Body()), ShouldEqual,
+			`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+
+		// images without a subject aren't referrers
+		iblob, err := img.ManifestBlob()
+		So(err, ShouldBeNil)
+
+		resp, err = resty.R().SetHeader("Content-Type", ispec.MediaTypeImageManifest).SetBody(iblob).
+			Put(baseURL + "/v2/a/manifests/1.1")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusCreated)
+		So(resp.Header().Get(api.SubjectHeader), ShouldBeEmpty)
+
+		resp, err = resty.R().Get(baseURL + "/v2/a/referrers/" + godigest.FromString("x").String())
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		resp, err = resty.R().Get(baseURL + "/v2/a/referrers/x")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusBadRequest)
+
+		resp, err = resty.R().Get(baseURL + "/v2/b/referrers/" + subject.String())
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusNotFound)
+	})
+}
+
+func TestSHA512(t *testing.T) {
+	Convey("Push and pull blobs addressed with sha512", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		content := []byte("this is a sha512 blob")
+		digest := godigest.SHA512.FromBytes(content)
+
+		resp, err := resty.R().SetQueryParam("digest", digest.String()).
+			SetHeader("Content-Type", api.BinaryMediaType).SetBody(content).
+			Post(baseURL + "/v2/a/blobs/uploads/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusCreated)
+		So(resp.Header().Get(api.DistContentDigestKey), ShouldEqual, digest.String())
+
+		resp, err = resty.R().Get(baseURL + "/v2/a/blobs/" + digest.String())
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Body(), ShouldResemble, content)
+
+		_, err = os.Stat(path.Join(dir, "a", "blobs", "sha512", digest.Encoded()))
+		So(err, ShouldBeNil)
+
+		// in chunks
+		resp, err = resty.R().Post(baseURL + "/v2/a/blobs/uploads/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusAccepted)
+		loc := baseURL + resp.Header().Get("Location")
+
+		content = []byte("this is another sha512 blob")
+		digest = godigest.SHA512.FromBytes(content)
+
+		resp, err = resty.R().SetHeader("Content-Type", api.BinaryMediaType).
+			SetHeader("Content-Range", fmt.Sprintf("0-%d", len(content)-1)).SetBody(content).Patch(loc)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusAccepted)
+		loc = baseURL + resp.Header().Get("Location")
+
+		resp, err = resty.R().SetQueryParam("digest", digest.String()).Put(loc)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusCreated)
+
+		resp, err = resty.R().Get(baseURL + "/v2/a/blobs/" + digest.String())
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Body(), ShouldResemble, content)
+	})
+}
+
+func TestBlobRange(t *testing.T) {
+	Convey("Serve ranges of blobs", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(1000, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "a", "1.0"), ShouldBeNil)
+
+		layer := godigest.FromBytes(img.Layers[0])
+		blobURL := baseURL + "/v2/a/blobs/" + layer.String()
+
+		resp, err := resty.R().Head(blobURL)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Header().Get("Accept-Ranges"), ShouldEqual, "bytes")
+
+		resp, err = resty.R().SetHeader("Range", "bytes=10-19").Get(blobURL)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusPartialContent)
+		So(resp.Header().Get("Content-Range"), ShouldEqual, "bytes 10-19/1000")
+		So(resp.Header().Get(api.DistContentDigestKey), ShouldEqual, layer.String())
+		So(resp.Body(), ShouldResemble, img.Layers[0][10:20])
+
+		// to the end, however far it is asked for
+		resp, err = resty.R().SetHeader("Range", "bytes=990-").Get(blobURL)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusPartialContent)
+		So(resp.Header().Get("Content-Range"), ShouldEqual, "bytes 990-999/1000")
+		So(resp.Body(), ShouldResemble, img.Layers[0][990:])
+
+		resp, err = resty.R().SetHeader("Range", "bytes=990-2000").Get(blobURL)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusPartialContent)
+		So(resp.Body(), ShouldResemble, img.Layers[0][990:])
+
+		resp, err = resty.R().SetHeader("Range", "bytes=1000-").Get(blobURL)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusRequestedRangeNotSatisfiable)
+		So(resp.Header().Get("Content-Range"), ShouldEqual, "bytes */1000")
+
+		resp, err = resty.R().SetHeader("Range", "bytes=10-19").
+			Get(baseURL + "/v2/a/blobs/" + godigest.FromString("x").String())
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusNotFound)
+
+		// not supported, served whole
+		for _, r := range []string{"bytes=-10", "bytes=0-1,5-6", "bytes=20-10", "items=0-1"} {
+			resp, err = resty.R().SetHeader("Range", r).Get(blobURL)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+			So(resp.Body(), ShouldResemble, img.Layers[0])
+		}
+	})
+}
+
+// walkCounter counts the walks of the repositories of a store.
+type walkCounter struct {
+	storage.ImageStore
+	walks int32
+}
+
+func (w *walkCounter) GetRepositories() ([]string, error) {
+	atomic.AddInt32(&w.walks, 1)
+	return w.ImageStore.GetRepositories()
+}
+
+func TestLazyStartup(t *testing.T) {
+	Convey("Start without walking the storage", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		backupDir, err := ioutil.TempDir("", "oci-backup-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(backupDir)
+
+		is := storage.NewImageStore(dir, true, true, storage.Options{}, log.NewLogger("debug", ""))
+
+		for _, repo := range []string{"a", "b/c"} {
+			img, err := test.GetRandomImage(64, 1)
+			So(err, ShouldBeNil)
+			So(test.WriteImageToStore(img, is, repo, "1.0"), ShouldBeNil)
+		}
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		config.Backup = &backup.Config{Directory: backupDir, Interval: time.Hour}
+
+		store := &walkCounter{ImageStore: is}
+
+		c := api.NewController(config)
+		c.ImageStore = store
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		resp, err := resty.R().Get(baseURL + "/v2/b/c/tags/list")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(atomic.LoadInt32(&store.walks), ShouldEqual, 0)
+
+		// only once listed
+		resp, err = resty.R().Get(baseURL + "/v2/_catalog")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(atomic.LoadInt32(&store.walks), ShouldEqual, 1)
+	})
+}
+
+func TestStrict(t *testing.T) {
+	Convey("Untag manifests deleted by tag unless strict", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "a", "1.0"), ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "a", "1.1"), ShouldBeNil)
+
+		resp, err := resty.R().Delete(baseURL + "/v2/a/manifests/1.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusAccepted)
+
+		// the manifest is still tagged otherwise
+		resp, err = resty.R().Get(baseURL + "/v2/a/tags/list")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(string(resp.Body()), ShouldEqual, `{"name":"a","tags":["1.1"]}`)
+
+		resp, err = resty.R().Get(baseURL + "/v2/a/manifests/1.1")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+	})
+
+	Convey("Turn off whatever isn't in the spec", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.Strict = true
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "a", "1.0"), ShouldBeNil)
+
+		resp, err := resty.R().Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		for _, u := range []string{"/v2/_zot/version", "/swagger/v2/index.html"} {
+			resp, err = resty.R().Get(baseURL + u)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusNotFound)
+		}
+
+		// blobs are served as such
+		resp, err = resty.R().SetHeader("Accept", "text/html").
+			Get(baseURL + "/v2/a/blobs/" + img.Manifest.Layers[0].Digest.String())
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Header().Get("Content-Type"), ShouldEqual, api.BinaryMediaType)
+
+		// and manifests deleted by digest only
+		resp, err = resty.R().Delete(baseURL + "/v2/a/manifests/1.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusBadRequest)
+
+		d, err := img.Digest()
+		So(err, ShouldBeNil)
+		resp, err = resty.R().Delete(baseURL + "/v2/a/manifests/" + d.String())
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusAccepted)
+	})
+}
+
+func TestPagination(t *testing.T) {
+	Convey("Page through long lists of tags and repositories", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		is := storage.NewImageStore(dir, true, true, storage.Options{}, log.NewLogger("debug", ""))
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+
+		tags := []string{}
+
+		for i := 0; i < 10; i++ {
+			tag := fmt.Sprintf("1.%d", i)
+			So(test.WriteImageToStore(img, is, "a", tag), ShouldBeNil)
+			tags = append(tags, tag)
+		}
+
+		repos := []string{"a", "b/c", "b/d", "e", "f"}
+
+		for _, repo := range repos[1:] {
+			So(test.WriteImageToStore(img, is, repo, "1.0"), ShouldBeNil)
+		}
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		c.ImageStore = is
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		resp, err := resty.R().Get(baseURL + "/v2/a/tags/list")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Header().Get("Link"), ShouldBeEmpty)
+
+		var list api.ImageTags
+		So(json.Unmarshal(resp.Body(), &list), ShouldBeNil)
+		So(list.Name, ShouldEqual, "a")
+		So(list.Tags, ShouldHaveLength, len(tags))
+
+		// follows the links to the next pages, returning all the pages' entries
+		pages := func(url string, entries func([]byte) []string) []string {
+			all := []string{}
+
+			for url != "" {
+				resp, err := resty.R().Get(url)
+				So(err, ShouldBeNil)
+				So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+				page := entries(resp.Body())
+				So(len(page), ShouldBeLessThanOrEqualTo, 3)
+				all = append(all, page...)
+
+				url = ""
+				if next := resp.Header().Get("Link"); next != "" {
+					url = baseURL + strings.Trim(strings.Split(next, ";")[0], "<>")
+				}
+			}
+
+			return all
+		}
+
+		So(pages(baseURL+"/v2/a/tags/list?n=3", func(body []byte) []string {
+			var list api.ImageTags
+			So(json.Unmarshal(body, &list), ShouldBeNil)
+			So(list.Name, ShouldEqual, "a")
+
+			return list.Tags
+		}), ShouldResemble, tags)
+
+		So(pages(baseURL+"/v2/_catalog?n=3", func(body []byte) []string {
+			var list api.RepositoryList
+			So(json.Unmarshal(body, &list), ShouldBeNil)
+
+			return list.Repositories
+		}), ShouldResemble, repos)
+
+		resp, err = resty.R().Get(baseURL + "/v2/_catalog?n=2&last=b/c")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(string(resp.Body()), ShouldEqual, `{"repositories":["b/d","e"]}`)
+		So(resp.Header().Get("Link"), ShouldEqual, `</v2/_catalog?n=2&last=e>; rel="next"`)
+
+		// after last, even if not listed
+		resp, err = resty.R().Get(baseURL + "/v2/a/tags/list?n=2&last=1.55")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(string(resp.Body()), ShouldEqual, `{"name":"a","tags":["1.6","1.7"]}`)
+
+		// all of them after last
+		resp, err = resty.R().Get(baseURL + "/v2/a/tags/list?last=1.55")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Header().Get("Link"), ShouldBeEmpty)
+		So(string(resp.Body()), ShouldEqual, `{"name":"a","tags":["1.6","1.7","1.8","1.9"]}`)
+
+		resp, err = resty.R().Get(baseURL + "/v2/a/tags/list?n=0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(string(resp.Body()), ShouldEqual, `{"name":"a","tags":[]}`)
+		So(resp.Header().Get("Link"), ShouldBeEmpty)
+
+		resp, err = resty.R().Get(baseURL + "/v2/_catalog?n=0&last=b/c")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(string(resp.Body()), ShouldEqual, `{"repositories":[]}`)
+		So(resp.Header().Get("Link"), ShouldBeEmpty)
+
+		for _, query := range []string{"n=-1", "n=x", "n=1&n=2", "last=a&last=b"} {
+			resp, err = resty.R().Get(baseURL + "/v2/_catalog?" + query)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusBadRequest)
+
+			resp, err = resty.R().Get(baseURL + "/v2/a/tags/list?" + query)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusBadRequest)
+		}
+
+		resp, err = resty.R().Get(baseURL + "/v2/_catalog?n=2&last=z")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(string(resp.Body()), ShouldEqual, `{"repositories":[]}`)
+		So(resp.Header().Get("Link"), ShouldBeEmpty)
+	})
+}
+
+func TestCatalog(t *testing.T) {
+	Convey("Enumerate repositories pushed, page by page", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		catalog := func(query string) ([]string, string) {
+			resp, err := resty.R().Get(baseURL + "/v2/_catalog" + query)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+			var list api.RepositoryList
+			So(json.Unmarshal(resp.Body(), &list), ShouldBeNil)
+
+			return list.Repositories, resp.Header().Get("Link")
+		}
+
+		repos, link := catalog("")
+		So(repos, ShouldBeEmpty)
+		So(link, ShouldBeEmpty)
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+
+		// listed sorted, whatever the order pushed
+		for _, repo := range []string{"zeta", "alpine", "library/busybox", "library/alpine"} {
+			So(test.UploadImage(img, baseURL, repo, "1.0"), ShouldBeNil)
+		}
+
+		repos, link = catalog("")
+		So(repos, ShouldResemble, []string{"alpine", "library/alpine", "library/busybox", "zeta"})
+		So(link, ShouldBeEmpty)
+
+		// the last repository listed is escaped in the link to the next page
+		repos, link = catalog("?n=2")
+		So(repos, ShouldResemble, []string{"alpine", "library/alpine"})
+		So(link, ShouldEqual, `</v2/_catalog?n=2&last=library%2Falpine>; rel="next"`)
+
+		// followed as is, the last page, even if full, having no link
+		repos, link = catalog(strings.TrimPrefix(strings.Trim(strings.Split(link, ";")[0], "<>"), "/v2/_catalog"))
+		So(repos, ShouldResemble, []string{"library/busybox", "zeta"})
+		So(link, ShouldBeEmpty)
+
+		repos, link = catalog("?n=10")
+		So(repos, ShouldHaveLength, 4)
+		So(link, ShouldBeEmpty)
+
+		repos, link = catalog("?last=library%2Fbusybox")
+		So(repos, ShouldResemble, []string{"zeta"})
+		So(link, ShouldBeEmpty)
+	})
+}
+
+func TestEviction(t *testing.T) {
+	Convey("Evict proxied images over budget", t, func() {
+		upstreamDir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(upstreamDir)
+
+		is := storage.NewImageStore(upstreamDir, false, false, storage.Options{}, log.NewLogger("debug", ""))
+
+		for _, repo := range []string{"a", "b"} {
+			img, err := test.GetRandomImage(1000, 1)
+			So(err, ShouldBeNil)
+			So(test.WriteImageToStore(img, is, repo, "1.0"), ShouldBeNil)
+		}
+
+		upstreamConfig := api.NewConfig()
+		upstreamConfig.HTTP.Port = "0"
+		upstreamConfig.Storage.RootDirectory = upstreamDir
+
+		uc := api.NewController(upstreamConfig)
+		So(uc.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = uc.Stop(context.Background()) }()
+
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		config.Eviction = &eviction.Config{MaxSize: "2500B", Interval: 100 * time.Millisecond}
+
+		// only caches can be evicted from
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldEqual, errors.ErrBadConfig)
+
+		config.Proxy = &proxy.Config{Config: upstream.Config{URL: fmt.Sprintf("http://127.0.0.1:%d", uc.Port())}}
+
+		c = api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		for _, repo := range []string{"a", "b"} {
+			resp, err := resty.R().Get(baseURL + "/v2/" + repo + "/manifests/1.0")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		}
+
+		local := storage.NewImageStore(dir, false, false, storage.Options{}, log.NewLogger("debug", ""))
+
+		var tags []string
+
+		for i := 0; i < 50; i++ {
+			tags, err = local.GetImageTags("a")
+			So(err, ShouldBeNil)
+
+			if len(tags) == 0 {
+				break
+			}
+
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		So(tags, ShouldBeEmpty)
+
+		tags, err = local.GetImageTags("b")
+		So(err, ShouldBeNil)
+		So(tags, ShouldResemble, []string{"1.0"})
+	})
+}
+
+func TestBackup(t *testing.T) {
+	Convey("Take storage snapshots", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		backupDir, err := ioutil.TempDir("", "oci-backup-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(backupDir)
+
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log.NewLogger("debug", ""))
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		config.Backup = &backup.Config{Directory: backupDir}
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		resp, err := resty.R().Post(baseURL + "/v2/_zot/backup")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusCreated)
+
+		var snapshot backup.Snapshot
+		So(json.Unmarshal(resp.Body(), &snapshot), ShouldBeNil)
+		So(snapshot.Repositories, ShouldHaveLength, 1)
+		So(snapshot.Repositories[0].Name, ShouldEqual, "repo")
+		So(snapshot.Copied, ShouldEqual, 3)
+
+		resp, err = resty.R().Get(baseURL + "/v2/_zot/backup")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		var snapshots []backup.Snapshot
+		So(json.Unmarshal(resp.Body(), &snapshots), ShouldBeNil)
+		So(snapshots, ShouldHaveLength, 1)
+		So(snapshots[0].ID, ShouldEqual, snapshot.ID)
+	})
+}
+
+func TestScrub(t *testing.T) {
+	Convey("Scrub the storage", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log.NewLogger("debug", ""))
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+		layer := img.Manifest.Layers[0].Digest
+		So(os.Remove(is.BlobPath("repo", layer)), ShouldBeNil)
+		So(ioutil.WriteFile(is.BlobPath("repo", layer), []byte("corrupt"), 0600), ShouldBeNil)
+
+		htpasswdPath := makeHtpasswdFileFromString(getCredString(username, passphrase) + "\n" +
+			getCredString("admin", "admin") + "\n")
+		defer os.Remove(htpasswdPath)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.Auth = &api.AuthConfig{HTPasswd: api.AuthHTPasswd{Path: htpasswdPath}}
+		config.HTTP.AccessControl = &api.AccessControlConfig{AdminPolicy: api.Policy{Users: []string{"admin"}}}
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		// only by admins
+		resp, err := resty.R().Post(baseURL + "/v2/_zot/scrub")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+
+		resp, err = resty.R().SetBasicAuth(username, passphrase).Post(baseURL + "/v2/_zot/scrub")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusForbidden)
+
+		resp, err = resty.R().SetBasicAuth("admin", "admin").Get(baseURL + "/v2/_zot/scrub")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		var status api.ScrubStatus
+		So(json.Unmarshal(resp.Body(), &status), ShouldBeNil)
+		So(status.Report, ShouldBeNil)
+
+		resp, err = resty.R().SetBasicAuth("admin", "admin").Post(baseURL + "/v2/_zot/scrub")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusAccepted)
+		So(resp.Header().Get("Location"), ShouldEqual, "/v2/_zot/scrub")
+
+		// done in the background
+		for i := 0; i < 100; i++ {
+			resp, err = resty.R().SetBasicAuth("admin", "admin").Get(baseURL + "/v2/_zot/scrub")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+			status = api.ScrubStatus{}
+			So(json.Unmarshal(resp.Body(), &status), ShouldBeNil)
+
+			if !status.Running && status.Report != nil {
+				break
+			}
+
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		So(status.Report, ShouldNotBeNil)
+		So(status.Report.Repos, ShouldEqual, 1)
+		So(status.Report.Blobs, ShouldEqual, 3)
+		So(status.Report.Problems, ShouldResemble, []storage.ScrubProblem{
+			{Repo: "repo", Digest: layer, Problem: storage.ScrubCorrupt},
+		})
+	})
+}
+
+func TestExportImport(t *testing.T) {
+	Convey("Export and import repositories", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "repo", "1.0"), ShouldBeNil)
+
+		resp, err := resty.R().Get(baseURL + "/v2/_zot/export/missing")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusNotFound)
+
+		resp, err = resty.R().Get(baseURL + "/v2/_zot/export/repo?tag=2.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusNotFound)
+
+		resp, err = resty.R().Get(baseURL + "/v2/_zot/export/repo?tag=1.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Header().Get("Content-Type"), ShouldEqual, "application/x-tar")
+
+		layout := resp.Body()
+
+		resp, err = resty.R().SetBody(layout).Post(baseURL + "/v2/_zot/import/a/copy")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusCreated)
+
+		var imported api.ImportedTags
+		So(json.Unmarshal(resp.Body(), &imported), ShouldBeNil)
+		So(imported.Tags, ShouldResemble, []string{"1.0"})
+
+		d, err := img.Digest()
+		So(err, ShouldBeNil)
+
+		resp, err = resty.R().Head(baseURL + "/v2/a/copy/manifests/1.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(resp.Header().Get("Docker-Content-Digest"), ShouldEqual, d.String())
+
+		resp, err = resty.R().SetBody([]byte("not a tar")).Post(baseURL + "/v2/_zot/import/a/copy")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusBadRequest)
+	})
+}
+
+func TestReplicas(t *testing.T) {
+	Convey("Redirect blob pulls to regional replicas", t, func() {
+		replicaDir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(replicaDir)
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+
+		is := storage.NewImageStore(replicaDir, false, false, storage.Options{}, log.NewLogger("debug", ""))
+		So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+		replicaConfig := api.NewConfig()
+		replicaConfig.HTTP.Port = "0"
+		replicaConfig.Storage.RootDirectory = replicaDir
+
+		rc := api.NewController(replicaConfig)
+		So(rc.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = rc.Stop(context.Background()) }()
+
+		replicaURL := fmt.Sprintf("http://127.0.0.1:%d", rc.Port())
+
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		is = storage.NewImageStore(dir, false, false, storage.Options{}, log.NewLogger("debug", ""))
+		So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		config.Replicas = &replicas.Config{
+			Region:       "us-east",
+			RegionHeader: "X-Zot-Region",
+			Replicas:     []replicas.ReplicaConfig{{Config: upstream.Config{URL: replicaURL}, Region: "eu-west"}},
+		}
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		blobURL := fmt.Sprintf("http://127.0.0.1:%d/v2/repo/blobs/%s", c.Port(), godigest.FromBytes(img.Layers[0]))
+
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+
+		get := func(region string) *http.Response {
+			req, err := http.NewRequest(http.MethodGet, blobURL, nil)
+			So(err, ShouldBeNil)
+			req.Header.Set("X-Zot-Region", region)
+
+			resp, err := client.Do(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+
+			return resp
+		}
+
+		resp := get("eu-west")
+		So(resp.StatusCode, ShouldEqual, http.StatusTemporaryRedirect)
+		So(resp.Header.Get("Location"), ShouldEqual,
+			fmt.Sprintf("%s/v2/repo/blobs/%s", replicaURL, godigest.FromBytes(img.Layers[0])))
+
+		So(get("us-east").StatusCode, ShouldEqual, http.StatusOK)
+		So(get("ap-south").StatusCode, ShouldEqual, http.StatusOK)
+	})
+}
+
+func TestBus(t *testing.T) {
+	Convey("Publish pushes on the bus", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		var lock sync.Mutex
+
+		pushed := []string{}
+
+		c.Bus.Subscribe(func(e bus.Event) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			pushed = append(pushed, e.Repository+":"+e.Reference)
+		}, bus.ManifestPushed)
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "repo", "1.0"), ShouldBeNil)
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		So(pushed, ShouldResemble, []string{"repo:1.0"})
+	})
+}
+
+func TestAdmission(t *testing.T) {
+	Convey("Review pushed manifests with the admission service", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		var lock sync.Mutex
+
+		reviewed := []admission.Request{}
+
+		service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req admission.Request
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			lock.Lock()
+			reviewed = append(reviewed, req)
+			lock.Unlock()
+
+			_ = json.NewEncoder(w).Encode(admission.Response{Allowed: true})
+		}))
+		defer service.Close()
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		config.Admission = &admission.Config{URL: service.URL, Headers: map[string]string{"Authorization": "secret"}}
+
+		So(config.Sanitize().Admission.Headers["Authorization"], ShouldNotEqual, "secret")
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "repo", "1.0"), ShouldBeNil)
+
+		digest, err := img.Digest()
+		So(err, ShouldBeNil)
+
+		cblob, err := img.ConfigBlob()
+		So(err, ShouldBeNil)
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		So(reviewed, ShouldHaveLength, 1)
+		So(reviewed[0].Repository, ShouldEqual, "repo")
+		So(reviewed[0].Reference, ShouldEqual, "1.0")
+		So(reviewed[0].Digest, ShouldEqual, digest.String())
+		So(reviewed[0].MediaType, ShouldEqual, ispec.MediaTypeImageManifest)
+		So(string(reviewed[0].Config), ShouldEqual, string(cblob))
+	})
+}
+
+func TestActions(t *testing.T) {
+	Convey("Run actions on pushed images", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		registry := test.NewRegistry()
+		defer registry.Close()
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		config.Actions = &actions.Config{
+			Rules: []actions.RuleConfig{{Tags: `^v\d+$`, Retag: []string{"latest"}, Replicate: []string{"dr"}}},
+			Destinations: []actions.DestinationConfig{{Name: "dr",
+				Config: upstream.Config{URL: registry.URL, Password: "secret"}}},
+		}
+
+		So(config.Sanitize().Actions.Destinations[0].Password, ShouldNotEqual, "secret")
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "repo", "v1"), ShouldBeNil)
+
+		digest, err := img.Digest()
+		So(err, ShouldBeNil)
+
+		// actions run in the background
+		for i := 0; i < 100; i++ {
+			if len(c.Actions.Replications()) > 0 {
+				break
+			}
+
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		_, ok := registry.Manifest("repo", "v1")
+		So(ok, ShouldBeTrue)
+
+		_, latest, _, err := c.ImageStore.GetImageManifest("repo", "latest")
+		So(err, ShouldBeNil)
+		So(latest, ShouldEqual, digest.String())
+
+		// replication is tracked, and repaired if incomplete
+		registry.DeleteBlob("repo", godigest.FromBytes(img.Layers[0]).String())
+
+		resp, err := resty.R().Post(baseURL + "/v2/_zot/replication")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		var replications []actions.Replication
+		So(json.Unmarshal(resp.Body(), &replications), ShouldBeNil)
+		So(replications, ShouldHaveLength, 1)
+		So(replications[0].Repairs, ShouldEqual, 1)
+
+		resp, err = resty.R().Get(baseURL + "/v2/_zot/replication")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+		So(json.Unmarshal(resp.Body(), &replications), ShouldBeNil)
+		So(replications[0].State, ShouldEqual, actions.ReplicationReplicated)
+		So(replications[0].Digest, ShouldEqual, digest.String())
+
+		// and so is the health of destinations
+		resp, err = resty.R().Get(baseURL + "/v2/_zot/sync")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+
+		var status []upstream.Status
+		So(json.Unmarshal(resp.Body(), &status), ShouldBeNil)
+		So(status, ShouldHaveLength, 1)
+		So(status[0].Name, ShouldEqual, "dr")
+		So(status[0].LastSync, ShouldNotBeNil)
+		So(status[0].Lag, ShouldEqual, 0)
+		So(status[0].BytesTransferred, ShouldBeGreaterThan, 0)
+	})
+}
+
+func TestHTTP2(t *testing.T) {
+	Convey("Serve HTTP/2", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		caCert, err := ioutil.ReadFile(CACert)
+		So(err, ShouldBeNil)
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(caCert)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+
+		start := func() string {
+			c := api.NewController(config)
+			So(c.Start(context.Background()), ShouldBeNil)
+			Reset(func() { _ = c.Stop(context.Background()) })
+
+			return fmt.Sprintf("127.0.0.1:%d", c.Port())
+		}
+
+		h2 := &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{RootCAs: caCertPool}}}
+		h2c := &http.Client{Transport: &http2.Transport{AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			}}}
+
+		Convey("over TLS", func() {
+			config.HTTP.TLS = &api.TLSConfig{Cert: ServerCert, Key: ServerKey}
+			addr := start()
+
+			resp, err := h2.Get("https://" + addr + "/v2/")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(resp.ProtoMajor, ShouldEqual, 2)
+		})
+
+		Convey("not over TLS if disabled", func() {
+			config.HTTP.TLS = &api.TLSConfig{Cert: ServerCert, Key: ServerKey}
+			config.HTTP.DisableHTTP2 = true
+			addr := start()
+
+			_, err := h2.Get("https://" + addr + "/v2/")
+			So(err, ShouldNotBeNil)
+
+			h1 := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caCertPool},
+				ForceAttemptHTTP2: true}}
+			resp, err := h1.Get("https://" + addr + "/v2/")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(resp.ProtoMajor, ShouldEqual, 1)
+		})
+
+		Convey("without TLS, only if h2c is enabled", func() {
+			addr := start()
+
+			_, err := h2c.Get("http://" + addr + "/v2/")
+			So(err, ShouldNotBeNil)
+
+			config.HTTP.H2C = true
+			addr = start()
+
+			resp, err := h2c.Get("http://" + addr + "/v2/")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(resp.ProtoMajor, ShouldEqual, 2)
+
+			// HTTP/1.1 clients still served
+			h1, err := resty.R().Get("http://" + addr + "/v2/")
+			So(err, ShouldBeNil)
+			So(h1.StatusCode(), ShouldEqual, http.StatusOK)
+		})
+
+		Convey("h2c not enabled with HTTP/2 disabled", func() {
+			config.HTTP.H2C = true
+			config.HTTP.DisableHTTP2 = true
+			So(config.Validate(api.NewController(config).Log), ShouldEqual, errors.ErrBadConfig)
+		})
+	})
+}
+
+func TestCompression(t *testing.T) {
+	Convey("Compress JSON lists, not blobs", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		So(c.ImageStore.InitRepo("repo"), ShouldBeNil)
+
+		content := []byte(`{"not":"compressed"}`)
+		digest := godigest.FromBytes(content).String()
+		_, _, err = c.ImageStore.FullBlobUpload("repo", bytes.NewReader(content), digest)
+		So(err, ShouldBeNil)
+
+		// asking for it, net/http doesn't decompress responses itself
+		get := func(url string, encoding string) (*http.Response, []byte) {
+			req, err := http.NewRequest(http.MethodGet, url, nil)
+			So(err, ShouldBeNil)
+
+			if encoding != "" {
+				req.Header.Set("Accept-Encoding", encoding)
+			}
+
+			client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+			resp, err := client.Do(req)
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+
+			return resp, body
+		}
+
+		gunzip := func(body []byte) []byte {
+			r, err := gzip.NewReader(bytes.NewReader(body))
+			So(err, ShouldBeNil)
+
+			buf, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+
+			return buf
+		}
+
+		for _, path := range []string{"/v2/_catalog", "/v2/repo/tags/list"} {
+			resp, body := get(baseURL+path, "gzip")
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(resp.Header.Get("Content-Encoding"), ShouldEqual, "gzip")
+			So(resp.Header.Get("Vary"), ShouldContainSubstring, "Accept-Encoding")
+			So(json.Valid(gunzip(body)), ShouldBeTrue)
+
+			resp, body = get(baseURL+path, "")
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(resp.Header.Get("Content-Encoding"), ShouldBeEmpty)
+			So(json.Valid(body), ShouldBeTrue)
+		}
+
+		var catalog api.RepositoryList
+		_, body := get(baseURL+"/v2/_catalog", "gzip")
+		So(json.Unmarshal(gunzip(body), &catalog), ShouldBeNil)
+		So(catalog.Repositories, ShouldContain, "repo")
+
+		resp, body := get(baseURL+"/v2/repo/blobs/"+digest, "gzip")
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		So(resp.Header.Get("Content-Encoding"), ShouldBeEmpty)
+		So(body, ShouldResemble, content)
+	})
+}
+
+func TestDockerManifests(t *testing.T) {
+	Convey("Push and pull Docker manifests as they are", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		So(c.ImageStore.InitRepo("repo"), ShouldBeNil)
+
+		cblob, layer := []byte(`{"architecture":"amd64","os":"linux"}`), []byte("layer")
+		for _, blob := range [][]byte{cblob, layer} {
+			_, _, err := c.ImageStore.FullBlobUpload("repo", bytes.NewReader(blob), godigest.FromBytes(blob).String())
+			So(err, ShouldBeNil)
+		}
+
+		manifest, err := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     storage.MediaTypeDockerManifest,
+			"config": ispec.Descriptor{MediaType: "application/vnd.docker.container.image.v1+json",
+				Digest: godigest.FromBytes(cblob), Size: int64(len(cblob))},
+			"layers": []ispec.Descriptor{{MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip",
+				Digest: godigest.FromBytes(layer), Size: int64(len(layer))}},
+		})
+		So(err, ShouldBeNil)
+
+		resp, err := resty.R().SetHeader("Content-Type", storage.MediaTypeDockerManifest).SetBody(manifest).
+			Put(baseURL + "/v2/repo/manifests/1.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusCreated)
+		So(resp.Header().Get(api.DistContentDigestKey), ShouldEqual, godigest.FromBytes(manifest).String())
+
+		list, err := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     storage.MediaTypeDockerManifestList,
+			"manifests": []ispec.Descriptor{{MediaType: storage.MediaTypeDockerManifest,
+				Digest: godigest.FromBytes(manifest), Size: int64(len(manifest))}},
+		})
+		So(err, ShouldBeNil)
+
+		resp, err = resty.R().SetHeader("Content-Type", storage.MediaTypeDockerManifestList).SetBody(list).
+			Put(baseURL + "/v2/repo/manifests/latest")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusCreated)
+
+		for ref, mediaType := range map[string]string{"1.0": storage.MediaTypeDockerManifest,
+			"latest": storage.MediaTypeDockerManifestList} {
+			resp, err = resty.R().Get(baseURL + "/v2/repo/manifests/" + ref)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, http.StatusOK)
+			So(resp.Header().Get("Content-Type"), ShouldEqual, mediaType)
+		}
+
+		resp, err = resty.R().Get(baseURL + "/v2/repo/manifests/1.0")
+		So(err, ShouldBeNil)
+		So(resp.Body(), ShouldResemble, manifest)
+
+		// not schema 1
+		resp, err = resty.R().SetHeader("Content-Type", "application/vnd.docker.distribution.manifest.v1+json").
+			SetBody(manifest).Put(baseURL + "/v2/repo/manifests/2.0")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnsupportedMediaType)
+	})
+}
+
+func TestContentHeaders(t *testing.T) {
+	Convey("Describe manifests and blobs the same for HEAD and GET", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		htpasswdPath := makeHtpasswdFile()
+		defer os.Remove(htpasswdPath)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.Auth = &api.AuthConfig{HTPasswd: api.AuthHTPasswd{Path: htpasswdPath}}
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, c.ImageStore, "repo", "1.0"), ShouldBeNil)
+
+		mDigest, err := img.Digest()
+		So(err, ShouldBeNil)
+
+		// even when not authenticated
+		resp, err := resty.R().Get(baseURL + "/v2/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, http.StatusUnauthorized)
+		So(resp.Header().Get(api.DistAPIVersion), ShouldEqual, "registry/2.0")
+
+		for _, tc := range []struct {
+			path      string
+			accept    string
+			mediaType string
+			digest    string
+		}{
+			{"/v2/repo/manifests/1.0", "", ispec.MediaTypeImageManifest, mDigest.String()},
+			{"/v2/repo/manifests/" + mDigest.String(), ispec.MediaTypeImageManifest, ispec.MediaTypeImageManifest,
+				mDigest.String()},
+			{"/v2/repo/blobs/" + img.Manifest.Layers[0].Digest.String(), "*/*", api.BinaryMediaType,
+				img.Manifest.Layers[0].Digest.String()},
+			{"/v2/repo/blobs/" + img.Manifest.Layers[0].Digest.String(), ispec.MediaTypeImageLayerGzip + ", */*",
+				api.BinaryMediaType, img.Manifest.Layers[0].Digest.String()},
+		} {
+			head, err := resty.R().SetBasicAuth(username, passphrase).SetHeader("Accept", tc.accept).
+				Head(baseURL + tc.path)
+			So(err, ShouldBeNil)
+			So(head.StatusCode(), ShouldEqual, http.StatusOK)
+
+			get, err := resty.R().SetBasicAuth(username, passphrase).SetHeader("Accept", tc.accept).
+				Get(baseURL + tc.path)
+			So(err, ShouldBeNil)
+			So(get.StatusCode(), ShouldEqual, http.StatusOK)
+
+			for _, h := range []string{"Content-Type", "Content-Length", api.DistContentDigestKey, "ETag",
+				api.DistAPIVersion} {
+				So(head.Header().Get(h), ShouldNotBeEmpty)
+				So(head.Header().Get(h), ShouldEqual, get.Header().Get(h))
+			}
+
+			So(get.Header().Get("Content-Type"), ShouldEqual, tc.mediaType)
+			So(get.Header().Get("Content-Length"), ShouldEqual, fmt.Sprintf("%d", len(get.Body())))
+			So(get.Header().Get(api.DistContentDigestKey), ShouldEqual, tc.digest)
+			So(get.Header().Get("ETag"), ShouldEqual, `"`+tc.digest+`"`)
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"github.com/anuvu/zot/errors"
+)
+
+const (
+	// PresetMinimal turns off everything but serving images.
+	PresetMinimal = "minimal"
+	// PresetSecure requires TLS, disables deletes and rate limits requests.
+	PresetSecure = "secure"
+	// PresetCI suits short-lived registries in CI pipelines.
+	PresetCI = "ci"
+
+	// default requests per second allowed by the secure preset.
+	secureRatelimit = 100
+)
+
+// presets maps preset names to the defaults they set.
+// nolint: gochecknoglobals
+var presets = map[string]func(c *Config){
+	PresetMinimal: func(c *Config) {
+		c.Storage.GC = false
+		c.Storage.Dedupe = false
+		c.Log.Level = "info"
+		c.Extensions = nil
+	},
+	PresetSecure: func(c *Config) {
+		rate := secureRatelimit
+
+		c.HTTP.AllowReadAccess = false
+		c.HTTP.DisableDelete = true
+		c.HTTP.Ratelimit = &RatelimitConfig{Rate: &rate}
+		c.Log.Level = "info"
+	},
+	PresetCI: func(c *Config) {
+		c.Storage.GC = false
+		c.Storage.Dedupe = false
+		c.Log.Level = "debug"
+	},
+}
+
+// ApplyPreset sets the defaults of the named preset. It is meant to be called before
+// explicitly configured values are applied, so that those take precedence.
+func (c *Config) ApplyPreset(name string) error {
+	apply, ok := presets[name]
+	if !ok {
+		return errors.ErrBadConfig
+	}
+
+	if c.Log == nil {
+		c.Log = &LogConfig{}
+	}
+
+	apply(c)
+	c.Preset = name
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// tokenBucket allows rate events per second on average, with bursts of up to rate events.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// allow reports whether an event may happen now, and consumes a token if so.
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// RateLimiter returns a middleware which rejects requests exceeding the configured
+// rates, overall and per HTTP method.
+func RateLimiter(c *Controller, config *RatelimitConfig) mux.MiddlewareFunc {
+	var global *tokenBucket
+	if config.Rate != nil {
+		global = newTokenBucket(*config.Rate)
+	}
+
+	methods := make(map[string]*tokenBucket)
+	for _, m := range config.Methods {
+		methods[strings.ToUpper(m.Method)] = newTokenBucket(m.Rate)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if b, ok := methods[r.Method]; ok && !b.allow() {
+				c.Log.Warn().Str("method", r.Method).Msg("method rate limit exceeded")
+				w.WriteHeader(http.StatusTooManyRequests)
+
+				return
+			}
+
+			if global != nil && !global.allow() {
+				c.Log.Warn().Msg("rate limit exceeded")
+				w.WriteHeader(http.StatusTooManyRequests)
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -12,21 +12,37 @@
 package api
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"path"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/anuvu/zot/docs" // as required by swaggo
 	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/admission"
+	"github.com/anuvu/zot/pkg/apikey"
+	"github.com/anuvu/zot/pkg/events"
 	ext "github.com/anuvu/zot/pkg/extensions"
 	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/oidc"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/tracing"
+	"github.com/anuvu/zot/pkg/upstream"
+	guuid "github.com/gofrs/uuid"
+	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	jsoniter "github.com/json-iterator/go"
+	dspec "github.com/opencontainers/distribution-spec"
+	godigest "github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	httpSwagger "github.com/swaggo/http-swagger"
 )
@@ -38,6 +54,15 @@ const (
 	BlobUploadUUID       = "Blob-Upload-UUID"
 	DefaultMediaType     = "application/json"
 	BinaryMediaType      = "application/octet-stream"
+
+	// MaxManifestSize is the size of the largest manifest accepted, as read into memory whole,
+	// unless configured otherwise.
+	MaxManifestSize = 4 * 1024 * 1024
+
+	// SubjectHeader is set on pushes of manifests with a subject, as listed among its referrers.
+	SubjectHeader = "OCI-Subject"
+	// FiltersAppliedHeader lists the filters applied to the referrers listed.
+	FiltersAppliedHeader = "OCI-Filters-Applied"
 )
 
 type RouteHandler struct {
@@ -52,11 +77,29 @@ func NewRouteHandler(c *Controller) *RouteHandler {
 }
 
 func (rh *RouteHandler) SetupRoutes() {
-	rh.c.Router.Use(AuthHandler(rh.c))
-	g := rh.c.Router.PathPrefix(RoutePrefix).Subrouter()
+	// authenticating users themselves, so only behind the logging, recovery and rate limiting
+	// of every request
+	if rh.c.issuer != nil {
+		rh.c.Router.HandleFunc(TokenPath,
+			tokenHandler(rh.c, rh.c.issuer)).Methods("GET")
+	}
+
+	if rh.c.OpenID != nil && rh.c.OpenID.LoginEnabled() {
+		rh.c.Router.HandleFunc(oidc.LoginPath,
+			rh.c.OpenID.ServeLogin).Methods("GET")
+		rh.c.Router.HandleFunc(oidc.CallbackPath,
+			rh.c.OpenID.ServeCallback).Methods("GET")
+		rh.c.Router.HandleFunc(oidc.LogoutPath,
+			rh.c.OpenID.ServeLogout).Methods("GET")
+	}
+
+	router := rh.c.Router.NewRoute().Subrouter()
+	router.Use(DistAPIVersionHandler, ClientIdentityHandler(rh.c), ReadOnlyHandler(rh.c), AuthHandler(rh.c),
+		AccessHandler(rh.c))
+	g := router.PathPrefix(RoutePrefix).Subrouter()
 	{
-		g.HandleFunc(fmt.Sprintf("/{name:%s}/tags/list", NameRegexp.String()),
-			rh.ListTags).Methods("GET")
+		g.Handle(fmt.Sprintf("/{name:%s}/tags/list", NameRegexp.String()),
+			compressed(rh.ListTags)).Methods("GET")
 		g.HandleFunc(fmt.Sprintf("/{name:%s}/manifests/{reference}", NameRegexp.String()),
 			rh.CheckManifest).Methods("HEAD")
 		g.HandleFunc(fmt.Sprintf("/{name:%s}/manifests/{reference}", NameRegexp.String()),
@@ -65,6 +108,8 @@ func (rh *RouteHandler) SetupRoutes() {
 			rh.UpdateManifest).Methods("PUT")
 		g.HandleFunc(fmt.Sprintf("/{name:%s}/manifests/{reference}", NameRegexp.String()),
 			rh.DeleteManifest).Methods("DELETE")
+		g.HandleFunc(fmt.Sprintf("/{name:%s}/referrers/{digest}", NameRegexp.String()),
+			rh.GetReferrers).Methods("GET")
 		g.HandleFunc(fmt.Sprintf("/{name:%s}/blobs/{digest}", NameRegexp.String()),
 			rh.CheckBlob).Methods("HEAD")
 		g.HandleFunc(fmt.Sprintf("/{name:%s}/blobs/{digest}", NameRegexp.String()),
@@ -81,19 +126,82 @@ func (rh *RouteHandler) SetupRoutes() {
 			rh.UpdateBlobUpload).Methods("PUT")
 		g.HandleFunc(fmt.Sprintf("/{name:%s}/blobs/uploads/{session_id}", NameRegexp.String()),
 			rh.DeleteBlobUpload).Methods("DELETE")
-		g.HandleFunc("/_catalog",
-			rh.ListRepositories).Methods("GET")
+		g.Handle("/_catalog",
+			compressed(rh.ListRepositories)).Methods("GET")
 		g.HandleFunc("/",
 			rh.CheckVersionSupport).Methods("GET")
 	}
+
+	// behind authentication, otherwise served ahead of the router
+	if rh.c.Metrics != nil && rh.c.Config.Metrics.Protected {
+		router.Handle(rh.c.Config.Metrics.Endpoint(), rh.c.Metrics).Methods("GET")
+	}
+
+	// the rest isn't in the spec
+	if rh.c.Config.HTTP.Strict {
+		return
+	}
+
+	g.HandleFunc("/_zot/version",
+		rh.GetVersion).Methods("GET")
+
+	if rh.c.Backup != nil {
+		g.HandleFunc("/_zot/backup",
+			rh.ListSnapshots).Methods("GET")
+		g.HandleFunc("/_zot/backup",
+			rh.CreateSnapshot).Methods("POST")
+	}
+
+	g.HandleFunc("/_zot/scrub",
+		rh.GetScrubStatus).Methods("GET")
+	g.HandleFunc("/_zot/scrub",
+		rh.ScrubStorage).Methods("POST")
+
+	g.HandleFunc(fmt.Sprintf("/_zot/export/{name:%s}", NameRegexp.String()),
+		rh.ExportRepository).Methods("GET")
+	g.HandleFunc(fmt.Sprintf("/_zot/import/{name:%s}", NameRegexp.String()),
+		rh.ImportRepository).Methods("POST")
+
+	if rh.c.Actions != nil {
+		g.HandleFunc("/_zot/replication",
+			rh.ListReplications).Methods("GET")
+		g.HandleFunc("/_zot/replication",
+			rh.ReconcileReplications).Methods("POST")
+	}
+
+	if rh.c.Mirrorer != nil || rh.c.Actions != nil {
+		g.HandleFunc("/_zot/sync",
+			rh.GetSyncStatus).Methods("GET")
+	}
+
+	if rh.c.LoadConfig != nil {
+		g.HandleFunc("/_zot/config/reload",
+			rh.ReloadConfig).Methods("POST")
+	}
+
+	if rh.c.APIKeys != nil {
+		g.HandleFunc("/_zot/apikeys",
+			rh.ListAPIKeys).Methods("GET")
+		g.HandleFunc("/_zot/apikeys",
+			rh.CreateAPIKey).Methods("POST")
+		g.HandleFunc("/_zot/apikeys/{id}",
+			rh.RevokeAPIKey).Methods("DELETE")
+	}
+
 	// swagger docs "/swagger/v2/index.html"
-	rh.c.Router.PathPrefix("/swagger/v2/").Methods("GET").Handler(httpSwagger.WrapHandler)
+	router.PathPrefix("/swagger/v2/").Methods("GET").Handler(httpSwagger.WrapHandler)
 	// Setup Extensions Routes
 	if rh.c.Config != nil && rh.c.Config.Extensions != nil {
-		ext.SetupRoutes(rh.c.Router, rh.c.Config.Storage.RootDirectory, rh.c.ImageStore, rh.c.Log)
+		ext.SetupRoutes(router, rh.c.Config.Storage.RootDirectory, rh.c.ImageStore, rh.c.Log)
 	}
 }
 
+// compressed gzips the responses of h for clients accepting it, e.g. long JSON lists, while blobs
+// and manifests, already compressed or verified against their digest, are served as they are.
+func compressed(h http.HandlerFunc) http.Handler {
+	return handlers.CompressHandler(h)
+}
+
 // Method handlers
 
 // CheckVersionSupport godoc
@@ -104,7 +212,6 @@ func (rh *RouteHandler) SetupRoutes() {
 // @Produce json
 // @Success 200 {string} string	"ok".
 func (rh *RouteHandler) CheckVersionSupport(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set(DistAPIVersion, "registry/2.0")
 	// NOTE: compatibility workaround - return this header in "allowed-read" mode to allow for clients to
 	// work correctly
 	if rh.c.Config.HTTP.AllowReadAccess {
@@ -132,8 +239,8 @@ type ImageTags struct {
 // @Accept  json
 // @Produce json
 // @Param   name     path    string     true        "test"
-// @Param 	n	 			 query 	 integer 		true				"limit entries for pagination"
-// @Param 	last	 	 query 	 string 		true				"last tag value for pagination"
+// @Param 	n	 			 query 	 integer 		false				"limit entries for pagination"
+// @Param 	last	 	 query 	 string 		false				"last tag value for pagination"
 // @Success 200 {object} 	api.ImageTags
 // @Failure 404 {string} 	string 				"not found"
 // @Failure 400 {string} 	string 				"bad request".
@@ -146,92 +253,41 @@ func (rh *RouteHandler) ListTags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	paginate := false
-	n := -1
-
-	var err error
-
-	nQuery, ok := r.URL.Query()["n"]
-
-	if ok {
-		if len(nQuery) != 1 {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-
-		var n1 int64
-
-		if n1, err = strconv.ParseInt(nQuery[0], 10, 0); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-
-		n = int(n1)
-		paginate = true
-	}
-
-	last := ""
-	lastQuery, ok := r.URL.Query()["last"]
-
-	if ok {
-		if len(lastQuery) != 1 {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-
-		last = lastQuery[0]
+	n, last, err := pagination(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
-	tags, err := rh.c.ImageStore.GetImageTags(name)
+	tags, err := rh.store(r).GetImageTags(name)
 	if err != nil {
 		WriteJSON(w, http.StatusNotFound, NewErrorList(NewError(NAME_UNKNOWN, map[string]string{"name": name})))
 		return
 	}
 
-	if paginate && (n < len(tags)) {
-		sort.Strings(tags)
+	// listed in lexical order, paginated or not
+	sort.Strings(tags)
 
-		pTags := ImageTags{Name: name}
+	if n >= 0 || last != "" {
+		page, more := paginate(tags, n, last)
 
-		if last == "" {
-			// first
-			pTags.Tags = tags[:n]
-		} else {
-			// next
-			i := -1
-			tag := ""
-			found := false
-			for i, tag = range tags {
-				if tag == last {
-					found = true
-					break
-				}
-			}
-			if !found {
-				w.WriteHeader(http.StatusNotFound)
-				return
-			}
-			if n >= len(tags)-i {
-				pTags.Tags = tags[i+1:]
-				WriteJSON(w, http.StatusOK, pTags)
-				return
-			}
-			pTags.Tags = tags[i+1 : i+1+n]
+		if more {
+			w.Header().Set("Link", fmt.Sprintf("</v2/%s/tags/list?n=%d&last=%s>; rel=\"next\"",
+				name, n, url.QueryEscape(pageEnd(page, last))))
 		}
 
-		if len(pTags.Tags) == 0 {
-			last = ""
-		} else {
-			last = pTags.Tags[len(pTags.Tags)-1]
-		}
+		tags = page
+	}
 
-		w.Header().Set("Link", fmt.Sprintf("/v2/%s/tags/list?n=%d&last=%s; rel=\"next\"", name, n, last))
-		WriteJSON(w, http.StatusOK, pTags)
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
+	head, err := json.Marshal(name)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	WriteJSON(w, http.StatusOK, ImageTags{Name: name, Tags: tags})
+	writeList(w, fmt.Sprintf(`{"name":%s,"tags":`, head), tags, rh.c.Log)
 }
 
 // CheckManifest godoc
@@ -261,7 +317,7 @@ func (rh *RouteHandler) CheckManifest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, digest, _, err := rh.c.ImageStore.GetImageManifest(name, reference)
+	content, digest, mediaType, err := rh.store(r).GetImageManifest(name, reference)
 	if err != nil {
 		switch err {
 		case errors.ErrRepoNotFound:
@@ -279,8 +335,7 @@ func (rh *RouteHandler) CheckManifest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set(DistContentDigestKey, digest)
-	w.Header().Set("Content-Length", "0")
+	setContentHeaders(w, mediaType, digest, int64(len(content)))
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -316,7 +371,7 @@ func (rh *RouteHandler) GetManifest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	content, digest, mediaType, err := rh.c.ImageStore.GetImageManifest(name, reference)
+	content, digest, mediaType, err := rh.store(r).GetImageManifest(name, reference)
 	if err != nil {
 		switch err {
 		case errors.ErrRepoNotFound:
@@ -336,8 +391,11 @@ func (rh *RouteHandler) GetManifest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set(DistContentDigestKey, digest)
+	setContentHeaders(w, mediaType, digest, int64(len(content)))
 	WriteData(w, http.StatusOK, mediaType, content)
+
+	rh.notify(r, events.ActionPull, "manifests", events.Target{MediaType: mediaType, Size: int64(len(content)),
+		Digest: digest, Length: int64(len(content)), Repository: name, Tag: tagOf(reference)})
 }
 
 // UpdateManifest godoc
@@ -350,7 +408,10 @@ func (rh *RouteHandler) GetManifest(w http.ResponseWriter, r *http.Request) {
 // @Header  201 {object} api.DistContentDigestKey
 // @Success 201 {string} string	"created"
 // @Failure 400 {string} string "bad request"
+// @Failure 403 {string} string "denied"
 // @Failure 404 {string} string "not found"
+// @Failure 409 {string} string "immutable tag"
+// @Failure 413 {string} string "manifest too large"
 // @Failure 500 {string} string "internal server error"
 // @Router /v2/{name}/manifests/{reference} [put].
 func (rh *RouteHandler) UpdateManifest(w http.ResponseWriter, r *http.Request) {
@@ -369,12 +430,28 @@ func (rh *RouteHandler) UpdateManifest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	mediaType := r.Header.Get("Content-Type")
-	if mediaType != ispec.MediaTypeImageManifest {
+	if !storage.IsImageManifest(mediaType) && !storage.IsImageIndex(mediaType) {
 		w.WriteHeader(http.StatusUnsupportedMediaType)
 		return
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	maxSize := rh.maxManifestSize()
+
+	if r.ContentLength > maxSize {
+		WriteJSON(w, http.StatusRequestEntityTooLarge, NewErrorList(NewError(SIZE_INVALID,
+			map[string]string{"reference": reference, "limit": strconv.FormatInt(maxSize, 10)})))
+
+		return
+	}
+
+	body, err := readManifest(r, maxSize)
+	if err == errors.ErrBadManifest {
+		WriteJSON(w, http.StatusRequestEntityTooLarge, NewErrorList(NewError(SIZE_INVALID,
+			map[string]string{"reference": reference, "limit": strconv.FormatInt(maxSize, 10)})))
+
+		return
+	}
+
 	if err != nil {
 		rh.c.Log.Error().Err(err).Msg("unexpected error")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -382,7 +459,14 @@ func (rh *RouteHandler) UpdateManifest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	digest, err := rh.c.ImageStore.PutImageManifest(name, reference, mediaType, body)
+	if resp := rh.admit(r, name, reference, mediaType, body); !resp.Allowed {
+		WriteJSON(w, http.StatusForbidden,
+			NewErrorList(NewError(DENIED, map[string]string{"reference": reference, "reason": resp.Reason})))
+
+		return
+	}
+
+	digest, err := rh.store(r).PutImageManifest(name, reference, mediaType, body)
 	if err != nil {
 		switch err {
 		case errors.ErrRepoNotFound:
@@ -394,9 +478,18 @@ func (rh *RouteHandler) UpdateManifest(w http.ResponseWriter, r *http.Request) {
 		case errors.ErrBadManifest:
 			WriteJSON(w, http.StatusBadRequest,
 				NewErrorList(NewError(MANIFEST_INVALID, map[string]string{"reference": reference})))
+		case errors.ErrMediaTypeNotAllowed:
+			WriteJSON(w, http.StatusBadRequest,
+				NewErrorList(NewError(MANIFEST_INVALID, map[string]string{"reference": reference,
+					"reason": "media type not allowed"})))
 		case errors.ErrBlobNotFound:
 			WriteJSON(w, http.StatusBadRequest,
 				NewErrorList(NewError(BLOB_UNKNOWN, map[string]string{"blob": digest})))
+		case errors.ErrTagImmutable:
+			// the tag is there already, with other content
+			WriteJSON(w, http.StatusConflict,
+				NewErrorList(NewError(DENIED, map[string]string{"reference": reference,
+					"reason": "tag is immutable"})))
 		default:
 			rh.c.Log.Error().Err(err).Msg("unexpected error")
 			w.WriteHeader(http.StatusInternalServerError)
@@ -407,7 +500,15 @@ func (rh *RouteHandler) UpdateManifest(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", name, digest))
 	w.Header().Set(DistContentDigestKey, digest)
+
+	if subject := subjectOf(body); subject != "" {
+		w.Header().Set(SubjectHeader, subject)
+	}
+
 	w.WriteHeader(http.StatusCreated)
+
+	rh.notify(r, events.ActionPush, "manifests", events.Target{MediaType: mediaType, Size: int64(len(body)),
+		Digest: digest, Length: int64(len(body)), Repository: name, Tag: tagOf(reference)})
 }
 
 // DeleteManifest godoc
@@ -418,8 +519,14 @@ func (rh *RouteHandler) UpdateManifest(w http.ResponseWriter, r *http.Request) {
 // @Param   name     			path    string     true        "repository name"
 // @Param   reference     path    string     true        "image reference or digest"
 // @Success 200 {string} string	"ok"
+// @Failure 405 {string} string "method not allowed"
 // @Router /v2/{name}/manifests/{reference} [delete].
 func (rh *RouteHandler) DeleteManifest(w http.ResponseWriter, r *http.Request) {
+	if rh.c.Config.HTTP.DisableDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
 	vars := mux.Vars(r)
 	name, ok := vars["name"]
 
@@ -434,7 +541,31 @@ func (rh *RouteHandler) DeleteManifest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := rh.c.ImageStore.DeleteImageManifest(name, reference)
+	// the spec only has manifests deleted by digest
+	if _, err := godigest.Parse(reference); err != nil && rh.c.Config.HTTP.Strict {
+		WriteJSON(w, http.StatusBadRequest,
+			NewErrorList(NewError(UNSUPPORTED, map[string]string{"reference": reference})))
+
+		return
+	}
+
+	// looked up before the tag is gone, for its event to tell which manifest it was
+	tag := tagOf(reference)
+	digest := reference
+
+	if tag != "" && rh.c.Events != nil {
+		digest = rh.taggedDigest(name, tag)
+	}
+
+	var err error
+
+	// only untagged, the manifest being left to other tags, if any, or garbage collection
+	if tag != "" {
+		err = rh.store(r).DeleteImageTag(name, tag)
+	} else {
+		err = rh.store(r).DeleteImageManifest(name, reference)
+	}
+
 	if err != nil {
 		switch err {
 		case errors.ErrRepoNotFound:
@@ -446,6 +577,9 @@ func (rh *RouteHandler) DeleteManifest(w http.ResponseWriter, r *http.Request) {
 		case errors.ErrBadManifest:
 			WriteJSON(w, http.StatusBadRequest,
 				NewErrorList(NewError(UNSUPPORTED, map[string]string{"reference": reference})))
+		case errors.ErrTagImmutable:
+			WriteJSON(w, http.StatusForbidden,
+				NewErrorList(NewError(DENIED, map[string]string{"reference": reference})))
 		default:
 			rh.c.Log.Error().Err(err).Msg("unexpected error")
 			w.WriteHeader(http.StatusInternalServerError)
@@ -455,6 +589,78 @@ func (rh *RouteHandler) DeleteManifest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.WriteHeader(http.StatusAccepted)
+
+	rh.notify(r, events.ActionDelete, "manifests", events.Target{Repository: name, Tag: tag, Digest: digest})
+}
+
+// ReferrersList is the image index listing the manifests referring to another.
+type ReferrersList struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	MediaType     string             `json:"mediaType"`
+	Manifests     []storage.Referrer `json:"manifests"`
+}
+
+// GetReferrers godoc
+// @Summary List referrers
+// @Description List the manifests referring to another, its subject, e.g. signatures or SBOMs
+// @Accept  json
+// @Produce application/vnd.oci.image.index.v1+json
+// @Param   name     path    string     true        "repository name"
+// @Param   digest   path    string     true        "subject digest"
+// @Param   artifactType  query  string  false      "artifact type of the referrers listed"
+// @Success 200 {object} api.ReferrersList
+// @Failure 400 {string} string "bad request"
+// @Failure 404 {string} string "not found"
+// @Failure 500 {string} string "internal server error"
+// @Router /v2/{name}/referrers/{digest} [get].
+func (rh *RouteHandler) GetReferrers(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, ok := vars["name"]
+
+	if !ok || name == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	digest, ok := vars["digest"]
+	if !ok || digest == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	artifactType := r.URL.Query().Get("artifactType")
+
+	referrers, err := rh.store(r).GetReferrers(name, digest, artifactType)
+	if err != nil {
+		switch err {
+		case errors.ErrBadBlobDigest:
+			WriteJSON(w, http.StatusBadRequest, NewErrorList(NewError(DIGEST_INVALID, map[string]string{"digest": digest})))
+		case errors.ErrRepoNotFound:
+			WriteJSON(w, http.StatusNotFound, NewErrorList(NewError(NAME_UNKNOWN, map[string]string{"name": name})))
+		default:
+			rh.c.Log.Error().Err(err).Msg("unexpected error")
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	if artifactType != "" {
+		w.Header().Set(FiltersAppliedHeader, "artifactType")
+	}
+
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	body, err := json.Marshal(ReferrersList{SchemaVersion: 2, MediaType: ispec.MediaTypeImageIndex,
+		Manifests: referrers})
+	if err != nil {
+		rh.c.Log.Error().Err(err).Msg("unable to marshal JSON")
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	WriteData(w, http.StatusOK, ispec.MediaTypeImageIndex, body)
 }
 
 // CheckBlob godoc
@@ -482,9 +688,9 @@ func (rh *RouteHandler) CheckBlob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mediaType := r.Header.Get("Accept")
+	mediaType := rh.blobMediaType(r)
 
-	ok, blen, err := rh.c.ImageStore.CheckBlob(name, digest, mediaType)
+	ok, blen, err := rh.store(r).CheckBlob(name, digest, mediaType)
 	if err != nil {
 		switch err {
 		case errors.ErrBadBlobDigest:
@@ -506,8 +712,8 @@ func (rh *RouteHandler) CheckBlob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", blen))
-	w.Header().Set(DistContentDigestKey, digest)
+	setContentHeaders(w, mediaType, digest, blen)
+	w.Header().Set("Accept-Ranges", "bytes")
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -520,6 +726,9 @@ func (rh *RouteHandler) CheckBlob(w http.ResponseWriter, r *http.Request) {
 // @Param   digest     	path    string     true        "blob/layer digest"
 // @Header  200 {object} api.DistContentDigestKey
 // @Success 200 {object} api.ImageManifest
+// @Success 206 {object} api.ImageManifest
+// @Success 307 {string} string "redirected to a replica in the region of the client"
+// @Failure 416 {string} string "range not satisfiable"
 // @Router /v2/{name}/blobs/{digest} [get].
 func (rh *RouteHandler) GetBlob(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -536,9 +745,23 @@ func (rh *RouteHandler) GetBlob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mediaType := r.Header.Get("Accept")
+	// spare the egress if a replica closer to the client has it
+	if rh.c.Replicas != nil {
+		if url, ok := rh.c.Replicas.Redirect(r, name, digest); ok {
+			http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+			return
+		}
+	}
+
+	mediaType := rh.blobMediaType(r)
+
+	// resuming an interrupted download
+	if from, to, ok := getRange(r); ok {
+		rh.getBlobRange(w, r, name, digest, mediaType, from, to)
+		return
+	}
 
-	br, blen, err := rh.c.ImageStore.GetBlob(name, digest, mediaType)
+	br, blen, err := rh.store(r).GetBlob(name, digest, mediaType)
 	if err != nil {
 		switch err {
 		case errors.ErrBadBlobDigest:
@@ -555,10 +778,56 @@ func (rh *RouteHandler) GetBlob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", blen))
-	w.Header().Set(DistContentDigestKey, digest)
+	setContentHeaders(w, mediaType, digest, blen)
+	w.Header().Set("Accept-Ranges", "bytes")
 	// return the blob data
-	WriteDataFromReader(w, http.StatusOK, blen, mediaType, br, rh.c.Log)
+	WriteDataFromReader(w, http.StatusOK, blen, mediaType, br, rh.c.copies, rh.c.Log)
+
+	rh.notify(r, events.ActionPull, "blobs", events.Target{MediaType: BinaryMediaType, Size: blen,
+		Digest: digest, Length: blen, Repository: name})
+}
+
+// getBlobRange serves a range of a blob, from and to included, to being -1 for its end.
+func (rh *RouteHandler) getBlobRange(w http.ResponseWriter, r *http.Request, name string, digest string,
+	mediaType string, from int64, to int64) {
+	br, length, size, err := rh.store(r).GetBlobPartial(name, digest, mediaType, from, to)
+	if err != nil {
+		switch err {
+		case errors.ErrBadRange:
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		case errors.ErrBadBlobDigest:
+			WriteJSON(w, http.StatusBadRequest, NewErrorList(NewError(DIGEST_INVALID, map[string]string{"digest": digest})))
+		case errors.ErrRepoNotFound:
+			WriteJSON(w, http.StatusNotFound, NewErrorList(NewError(NAME_UNKNOWN, map[string]string{"name": name})))
+		case errors.ErrBlobNotFound:
+			WriteJSON(w, http.StatusNotFound, NewErrorList(NewError(BLOB_UNKNOWN, map[string]string{"digest": digest})))
+		default:
+			rh.c.Log.Error().Err(err).Msg("unexpected error")
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	setContentHeaders(w, mediaType, digest, length)
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, from+length-1, size))
+	w.Header().Set("Accept-Ranges", "bytes")
+	WriteDataFromReader(w, http.StatusPartialContent, length, mediaType, br, rh.c.copies, rh.c.Log)
+
+	rh.notify(r, events.ActionPull, "blobs", events.Target{MediaType: BinaryMediaType, Size: size,
+		Digest: digest, Length: length, Repository: name})
+}
+
+// blobMediaType returns the media type blobs are served as, that accepted by the client if a
+// single one, e.g. not "*/*", unless strict, or BinaryMediaType, as per the spec.
+func (rh *RouteHandler) blobMediaType(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	if rh.c.Config.HTTP.Strict || accept == "" || strings.ContainsAny(accept, ",*") {
+		return BinaryMediaType
+	}
+
+	return accept
 }
 
 // DeleteBlob godoc
@@ -569,8 +838,14 @@ func (rh *RouteHandler) GetBlob(w http.ResponseWriter, r *http.Request) {
 // @Param   name				path    string     true        "repository name"
 // @Param   digest     	path    string     true        "blob/layer digest"
 // @Success 202 {string} string "accepted"
+// @Failure 405 {string} string "method not allowed"
 // @Router /v2/{name}/blobs/{digest} [delete].
 func (rh *RouteHandler) DeleteBlob(w http.ResponseWriter, r *http.Request) {
+	if rh.c.Config.HTTP.DisableDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
 	vars := mux.Vars(r)
 	name, ok := vars["name"]
 
@@ -585,7 +860,7 @@ func (rh *RouteHandler) DeleteBlob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := rh.c.ImageStore.DeleteBlob(name, digest)
+	err := rh.store(r).DeleteBlob(name, digest)
 	if err != nil {
 		switch err {
 		case errors.ErrBadBlobDigest:
@@ -603,6 +878,8 @@ func (rh *RouteHandler) DeleteBlob(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.WriteHeader(http.StatusAccepted)
+
+	rh.notify(r, events.ActionDelete, "blobs", events.Target{Digest: digest, Repository: name})
 }
 
 // CreateBlobUpload godoc
@@ -611,6 +888,10 @@ func (rh *RouteHandler) DeleteBlob(w http.ResponseWriter, r *http.Request) {
 // @Accept  json
 // @Produce json
 // @Param   name				path    string     true        "repository name"
+// @Param   mount				query   string     false       "digest of a blob to mount from another repository"
+// @Param   digest				query   string     false       "digest of the blob uploaded in one go"
+// @Success 201 {string} string	"created"
+// @Header  201 {string} Location "/v2/{name}/blobs/{digest}"
 // @Success 202 {string} string	"accepted"
 // @Header  202 {string} Location "/v2/{name}/blobs/uploads/{session_id}"
 // @Header  202 {string} Range "bytes=0-0"
@@ -626,14 +907,20 @@ func (rh *RouteHandler) CreateBlobUpload(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// blob mounts not allowed since we don't have access control yet, and this
-	// may be a uncommon use case, but remain compliant
-	if _, ok := r.URL.Query()["mount"]; ok {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
+	// blobs already stored are mounted from wherever they are, whichever repository they're
+	// said to be "from", as any can be read by any client, and otherwise uploaded, as clients
+	// then expect to
+	if digests, ok := r.URL.Query()["mount"]; ok {
+		if len(digests) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
-	if _, ok := r.URL.Query()["from"]; ok {
+		if rh.mountBlob(w, r, name, digests[0]) {
+			return
+		}
+	} else if _, ok := r.URL.Query()["from"]; ok {
+		// nothing to mount
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
@@ -655,6 +942,11 @@ func (rh *RouteHandler) CreateBlobUpload(w http.ResponseWriter, r *http.Request)
 			return
 		}
 
+		// acknowledged without reading the blob, if already stored
+		if rh.mountBlob(w, r, name, digest) {
+			return
+		}
+
 		rh.c.Log.Info().Int64("r.ContentLength", r.ContentLength).Msg("DEBUG")
 
 		var contentLength int64
@@ -669,7 +961,11 @@ func (rh *RouteHandler) CreateBlobUpload(w http.ResponseWriter, r *http.Request)
 			return
 		}
 
-		sessionID, size, err := rh.c.ImageStore.FullBlobUpload(name, r.Body, digest)
+		if rh.blobTooLarge(w, name, contentLength) {
+			return
+		}
+
+		sessionID, size, err := rh.store(r).FullBlobUpload(name, r.Body, digest)
 		if err != nil {
 			rh.c.Log.Error().Err(err).Int64("actual", size).Int64("expected", contentLength).Msg("failed full upload")
 			w.WriteHeader(http.StatusInternalServerError)
@@ -686,12 +982,13 @@ func (rh *RouteHandler) CreateBlobUpload(w http.ResponseWriter, r *http.Request)
 
 		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
 		w.Header().Set(BlobUploadUUID, sessionID)
+		w.Header().Set(DistContentDigestKey, digest)
 		w.WriteHeader(http.StatusCreated)
 
 		return
 	}
 
-	u, err := rh.c.ImageStore.NewBlobUpload(name)
+	u, err := rh.store(r).NewBlobUpload(name)
 	if err != nil {
 		switch err {
 		case errors.ErrRepoNotFound:
@@ -709,6 +1006,30 @@ func (rh *RouteHandler) CreateBlobUpload(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusAccepted)
 }
 
+// mountBlob responds that a blob is created if it could be mounted into a repository from
+// wherever it's already stored, rather than uploaded, returning whether it was.
+func (rh *RouteHandler) mountBlob(w http.ResponseWriter, r *http.Request, name string, digest string) bool {
+	ok, size, err := rh.store(r).MountBlob(name, digest)
+	if err != nil {
+		rh.c.Log.Warn().Err(err).Str("digest", digest).Msg("unable to mount blob")
+		return false
+	}
+
+	if !ok {
+		return false
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
+	w.Header().Set("Content-Length", "0")
+	w.Header().Set(DistContentDigestKey, digest)
+	w.WriteHeader(http.StatusCreated)
+
+	rh.notify(r, events.ActionMount, "blobs", events.Target{MediaType: BinaryMediaType, Digest: digest,
+		Size: size, Repository: name})
+
+	return true
+}
+
 // GetBlobUpload godoc
 // @Summary Get image blob/layer upload
 // @Description Get an image's blob/layer upload given a session_id
@@ -737,7 +1058,7 @@ func (rh *RouteHandler) GetBlobUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	size, err := rh.c.ImageStore.GetBlobUpload(name, sessionID)
+	size, err := rh.store(r).GetBlobUpload(name, sessionID)
 	if err != nil {
 		switch err {
 		case errors.ErrBadUploadRange:
@@ -809,7 +1130,13 @@ func (rh *RouteHandler) PatchBlobUpload(w http.ResponseWriter, r *http.Request)
 
 	if r.Header.Get("Content-Length") == "" || r.Header.Get("Content-Range") == "" {
 		// streamed blob upload
-		clen, err = rh.c.ImageStore.PutBlobChunkStreamed(name, sessionID, r.Body)
+		uploaded := rh.uploadedSize(r, name, sessionID)
+
+		if r.ContentLength > 0 && rh.blobTooLarge(w, name, uploaded+r.ContentLength) {
+			return
+		}
+
+		clen, err = rh.store(r).PutBlobChunkStreamed(name, sessionID, rh.limitBlob(r, uploaded))
 	} else {
 		// chunked blob upload
 
@@ -836,7 +1163,11 @@ func (rh *RouteHandler) PatchBlobUpload(w http.ResponseWriter, r *http.Request)
 			return
 		}
 
-		clen, err = rh.c.ImageStore.PutBlobChunk(name, sessionID, from, to, r.Body)
+		if rh.blobTooLarge(w, name, to+1) {
+			return
+		}
+
+		clen, err = rh.store(r).PutBlobChunk(name, sessionID, from, to, r.Body)
 	}
 
 	if err != nil {
@@ -844,6 +1175,8 @@ func (rh *RouteHandler) PatchBlobUpload(w http.ResponseWriter, r *http.Request)
 		case errors.ErrBadUploadRange:
 			WriteJSON(w, http.StatusRequestedRangeNotSatisfiable,
 				NewErrorList(NewError(BLOB_UPLOAD_INVALID, map[string]string{"session_id": sessionID})))
+		case errors.ErrBlobTooLarge:
+			rh.blobTooLarge(w, name, rh.c.Config.HTTP.MaxBlobSize+1)
 		case errors.ErrRepoNotFound:
 			WriteJSON(w, http.StatusNotFound,
 				NewErrorList(NewError(NAME_UNKNOWN, map[string]string{"name": name})))
@@ -927,6 +1260,8 @@ func (rh *RouteHandler) UpdateBlobUpload(w http.ResponseWriter, r *http.Request)
 
 	var from, to int64
 
+	uploaded := rh.uploadedSize(r, name, sessionID)
+
 	if contentPresent {
 		contentRange := r.Header.Get("Content-Range")
 		if contentRange == "" { // monolithic upload
@@ -937,17 +1272,25 @@ func (rh *RouteHandler) UpdateBlobUpload(w http.ResponseWriter, r *http.Request)
 			}
 
 			to = contentLen
+
+			if rh.blobTooLarge(w, name, uploaded+contentLen) {
+				return
+			}
 		} else if from, to, err = getContentRange(r); err != nil { // finish chunked upload
 			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
 			return
+		} else if rh.blobTooLarge(w, name, to+1) {
+			return
 		}
 
-		_, err = rh.c.ImageStore.PutBlobChunk(name, sessionID, from, to, r.Body)
+		_, err = rh.store(r).PutBlobChunk(name, sessionID, from, to, rh.limitBlob(r, uploaded))
 		if err != nil {
 			switch err {
 			case errors.ErrBadUploadRange:
 				WriteJSON(w, http.StatusBadRequest,
 					NewErrorList(NewError(BLOB_UPLOAD_INVALID, map[string]string{"session_id": sessionID})))
+			case errors.ErrBlobTooLarge:
+				rh.blobTooLarge(w, name, rh.c.Config.HTTP.MaxBlobSize+1)
 			case errors.ErrRepoNotFound:
 				WriteJSON(w, http.StatusNotFound,
 					NewErrorList(NewError(NAME_UNKNOWN, map[string]string{"name": name})))
@@ -965,11 +1308,13 @@ func (rh *RouteHandler) UpdateBlobUpload(w http.ResponseWriter, r *http.Request)
 
 finish:
 	// blob chunks already transferred, just finish
-	if err := rh.c.ImageStore.FinishBlobUpload(name, sessionID, r.Body, digest); err != nil {
+	if err := rh.store(r).FinishBlobUpload(name, sessionID, rh.limitBlob(r, uploaded), digest); err != nil {
 		switch err {
 		case errors.ErrBadBlobDigest:
 			WriteJSON(w, http.StatusBadRequest,
 				NewErrorList(NewError(DIGEST_INVALID, map[string]string{"digest": digest})))
+		case errors.ErrBlobTooLarge:
+			rh.blobTooLarge(w, name, rh.c.Config.HTTP.MaxBlobSize+1)
 		case errors.ErrBadUploadRange:
 			WriteJSON(w, http.StatusBadRequest,
 				NewErrorList(NewError(BLOB_UPLOAD_INVALID, map[string]string{"session_id": sessionID})))
@@ -991,6 +1336,9 @@ finish:
 	w.Header().Set("Content-Length", "0")
 	w.Header().Set(DistContentDigestKey, digest)
 	w.WriteHeader(http.StatusCreated)
+
+	rh.notify(r, events.ActionPush, "blobs", events.Target{MediaType: BinaryMediaType, Digest: digest,
+		Repository: name})
 }
 
 // DeleteBlobUpload godoc
@@ -1019,7 +1367,7 @@ func (rh *RouteHandler) DeleteBlobUpload(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if err := rh.c.ImageStore.DeleteBlobUpload(name, sessionID); err != nil {
+	if err := rh.store(r).DeleteBlobUpload(name, sessionID); err != nil {
 		switch err {
 		case errors.ErrRepoNotFound:
 			WriteJSON(w, http.StatusNotFound,
@@ -1047,34 +1395,846 @@ type RepositoryList struct {
 // @Description List all image repositories
 // @Accept  json
 // @Produce json
+// @Param 	n	 			 query 	 integer 		false				"limit entries for pagination"
+// @Param 	last	 	 query 	 string 		false				"last repository for pagination"
 // @Success 200 {object} 	api.RepositoryList
+// @Failure 400 {string} string "bad request"
 // @Failure 500 {string} string "internal server error"
 // @Router /v2/_catalog [get].
 func (rh *RouteHandler) ListRepositories(w http.ResponseWriter, r *http.Request) {
-	repos, err := rh.c.ImageStore.GetRepositories()
+	n, last, err := pagination(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	is := RepositoryList{Repositories: repos}
+	repos, err := rh.store(r).GetRepositories()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	WriteJSON(w, http.StatusOK, is)
-}
+	sort.Strings(repos)
 
-// helper routines
+	if n >= 0 || last != "" {
+		page, more := paginate(repos, n, last)
 
-func getContentRange(r *http.Request) (int64 /* from */, int64 /* to */, error) {
-	contentRange := r.Header.Get("Content-Range")
-	tokens := strings.Split(contentRange, "-")
-	from, err := strconv.ParseInt(tokens[0], 10, 64)
+		if more {
+			w.Header().Set("Link", fmt.Sprintf("</v2/_catalog?n=%d&last=%s>; rel=\"next\"",
+				n, url.QueryEscape(pageEnd(page, last))))
+		}
 
-	if err != nil {
-		return -1, -1, errors.ErrBadUploadRange
+		repos = page
 	}
 
-	to, err := strconv.ParseInt(tokens[1], 10, 64)
-	if err != nil {
+	writeList(w, `{"repositories":`, repos, rh.c.Log)
+}
+
+// pagination returns the number of entries, n, and the last entry already listed, of a
+// paginated list, n being -1 if the whole list is requested.
+func pagination(r *http.Request) (int, string, error) {
+	n := -1
+
+	if nQuery, ok := r.URL.Query()["n"]; ok {
+		if len(nQuery) != 1 {
+			return -1, "", errors.ErrBadPagination
+		}
+
+		n1, err := strconv.ParseInt(nQuery[0], 10, 0)
+		if err != nil || n1 < 0 {
+			return -1, "", errors.ErrBadPagination
+		}
+
+		n = int(n1)
+	}
+
+	last := ""
+
+	if lastQuery, ok := r.URL.Query()["last"]; ok {
+		if len(lastQuery) != 1 {
+			return -1, "", errors.ErrBadPagination
+		}
+
+		last = lastQuery[0]
+	}
+
+	return n, last, nil
+}
+
+// paginate returns up to n, or all if n is -1, of the sorted entries lexically after last,
+// which needn't be one of them, and whether more follow. None follow an empty page, for
+// clients following links to the next page not to be sent to the same one forever.
+func paginate(entries []string, n int, last string) ([]string, bool) {
+	if n == 0 {
+		return []string{}, false
+	}
+
+	start := sort.SearchStrings(entries, last)
+	if start < len(entries) && entries[start] == last {
+		start++
+	}
+
+	end := len(entries)
+	if n >= 0 && n < end-start {
+		end = start + n
+	}
+
+	return entries[start:end], end < len(entries)
+}
+
+// pageEnd returns the last entry listed so far, that of page or, if empty, the previous one.
+func pageEnd(page []string, last string) string {
+	if len(page) == 0 {
+		return last
+	}
+
+	return page[len(page)-1]
+}
+
+// writeList writes a JSON object, of which head is the beginning, up to its last field, which
+// holds entries. They're encoded one at a time, as they're written, instead of marshalling the
+// whole object in memory, as lists of repositories or tags may hold thousands of them.
+func writeList(w http.ResponseWriter, head string, entries []string, logger log.Logger) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	w.Header().Set("Content-Type", DefaultMediaType)
+	w.WriteHeader(http.StatusOK)
+
+	bw := bufio.NewWriter(w)
+	_, _ = bw.WriteString(head)
+
+	if entries == nil {
+		_, _ = bw.WriteString("null")
+	} else {
+		_ = bw.WriteByte('[')
+
+		for i, entry := range entries {
+			if i > 0 {
+				_ = bw.WriteByte(',')
+			}
+
+			e, err := json.Marshal(entry)
+			if err != nil {
+				logger.Error().Err(err).Msg("encoding list into http response")
+				return
+			}
+
+			_, _ = bw.Write(e)
+		}
+
+		_ = bw.WriteByte(']')
+	}
+
+	_ = bw.WriteByte('}')
+
+	if err := bw.Flush(); err != nil {
+		logger.Error().Err(err).Msg("writing list into http response")
+	}
+}
+
+type VersionInfo struct {
+	Version            string   `json:"version"`
+	Commit             string   `json:"commit"`
+	BuildDate          string   `json:"buildDate"`
+	GoVersion          string   `json:"goVersion"`
+	DistSpecVersion    string   `json:"distSpecVersion"`
+	CompiledExtensions []string `json:"compiledExtensions"`
+	EnabledExtensions  []string `json:"enabledExtensions"`
+}
+
+// GetVersion godoc
+// @Summary Get build information
+// @Description Get the version and build information of this registry, and its extensions
+// @Accept  json
+// @Produce json
+// @Success 200 {object} 	api.VersionInfo
+// @Router /v2/_zot/version [get].
+func (rh *RouteHandler) GetVersion(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, http.StatusOK, VersionInfo{
+		Version:            ReleaseTag,
+		Commit:             Commit,
+		BuildDate:          BuildDate,
+		GoVersion:          runtime.Version(),
+		DistSpecVersion:    dspec.Version,
+		CompiledExtensions: ext.Compiled(),
+		EnabledExtensions:  ext.Enabled(rh.c.Config.Extensions),
+	})
+}
+
+// Readiness is how the checks of the readiness of the registry went, "ok" or why not.
+type Readiness struct {
+	Storage    string `json:"storage"`
+	Extensions string `json:"extensions"`
+}
+
+// Livez godoc
+// @Summary Check liveness
+// @Description Check the registry is serving requests, without authentication, e.g. for liveness probes
+// @Produce plain
+// @Success 200 {string} string "ok"
+// @Router /livez [get].
+func (rh *RouteHandler) Livez(w http.ResponseWriter, r *http.Request) {
+	WriteData(w, http.StatusOK, "text/plain; charset=utf-8", []byte("ok\n"))
+}
+
+// Readyz godoc
+// @Summary Check readiness
+// @Description Check the storage and the databases of extensions can be accessed, without authentication,
+// @Description e.g. for readiness probes
+// @Produce json
+// @Success 200 {object} api.Readiness
+// @Failure 503 {object} api.Readiness
+// @Router /readyz [get].
+func (rh *RouteHandler) Readyz(w http.ResponseWriter, r *http.Request) {
+	readiness := Readiness{Storage: "ok", Extensions: "ok"}
+	status := http.StatusOK
+
+	if err := storage.Ready(rh.c.store); err != nil {
+		rh.c.Log.Warn().Err(err).Msg("storage is not ready")
+
+		readiness.Storage = err.Error()
+		status = http.StatusServiceUnavailable
+	}
+
+	if err := ext.Ready(rh.c.Config.Extensions, rh.c.Config.Storage.RootDirectory); err != nil {
+		rh.c.Log.Warn().Err(err).Msg("extensions are not ready")
+
+		readiness.Extensions = err.Error()
+		status = http.StatusServiceUnavailable
+	}
+
+	WriteJSON(w, status, readiness)
+}
+
+// ListSnapshots godoc
+// @Summary List storage snapshots
+// @Description List the snapshots of the storage taken so far, oldest first
+// @Accept  json
+// @Produce json
+// @Success 200 {array} 	backup.Snapshot
+// @Failure 500 {string} string "internal server error"
+// @Router /v2/_zot/backup [get].
+func (rh *RouteHandler) ListSnapshots(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := rh.c.Backup.Snapshots()
+	if err != nil {
+		rh.c.Log.Error().Err(err).Msg("unable to list snapshots")
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, snapshots)
+}
+
+// CreateSnapshot godoc
+// @Summary Take a storage snapshot
+// @Description Back up the index of every repository, the blobs new since the last snapshot, and the dbs
+// @Accept  json
+// @Produce json
+// @Success 201 {object} 	backup.Snapshot
+// @Failure 500 {string} string "internal server error"
+// @Router /v2/_zot/backup [post].
+func (rh *RouteHandler) CreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := rh.c.Backup.Backup()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSON(w, http.StatusCreated, snapshot)
+}
+
+// ScrubStatus is whether the storage is being scrubbed, and the report of the last scrub done.
+type ScrubStatus struct {
+	Running bool                 `json:"running"`
+	Report  *storage.ScrubReport `json:"report,omitempty"`
+}
+
+// GetScrubStatus godoc
+// @Summary Get the status of the storage scrub
+// @Description Whether the storage is being scrubbed, and the report of the last scrub done, if any
+// @Accept  json
+// @Produce json
+// @Success 200 {object} 	api.ScrubStatus
+// @Failure 403 {string} string "forbidden"
+// @Router /v2/_zot/scrub [get].
+func (rh *RouteHandler) GetScrubStatus(w http.ResponseWriter, r *http.Request) {
+	if !rh.c.adminRequest(r) {
+		WriteJSON(w, http.StatusForbidden, NewErrorList(NewError(DENIED)))
+		return
+	}
+
+	running, report := rh.c.ScrubStatus()
+
+	WriteJSON(w, http.StatusOK, ScrubStatus{Running: running, Report: report})
+}
+
+// ScrubStorage godoc
+// @Summary Scrub the storage
+// @Description Start hashing every blob the manifests of the storage reference again, in the background, to report
+// @Description those corrupt or missing at /v2/_zot/scrub once done, unless a scrub is already running. Blobs
+// @Description referenced by nothing, and fixing problems, are left to the scrub command, while the registry isn't
+// @Description running
+// @Accept  json
+// @Produce json
+// @Success 202 {string} string "accepted"
+// @Header  202 {string} Location "/v2/_zot/scrub"
+// @Failure 403 {string} string "forbidden"
+// @Failure 409 {string} string "already running"
+// @Router /v2/_zot/scrub [post].
+func (rh *RouteHandler) ScrubStorage(w http.ResponseWriter, r *http.Request) {
+	if !rh.c.adminRequest(r) {
+		WriteJSON(w, http.StatusForbidden, NewErrorList(NewError(DENIED)))
+		return
+	}
+
+	if !rh.c.Scrub(rh.store(r)) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Location", "/v2/_zot/scrub")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ExportRepository godoc
+// @Summary Export a repository
+// @Description Export the images of a repository, or only the one tagged, along with its referrers, as a tar of
+// @Description an OCI image layout, e.g. to import into an air-gapped registry
+// @Accept  json
+// @Produce application/x-tar
+// @Param   name     path    string     true        "repository name"
+// @Param   tag      query   string     false       "tag of the image to export, all if not set"
+// @Success 200 {string} string "OCI image layout tar"
+// @Failure 404 {string} string "not found"
+// @Router /v2/_zot/export/{name} [get].
+func (rh *RouteHandler) ExportRepository(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	tag := r.URL.Query().Get("tag")
+
+	if _, err := rh.store(r).GetIndexContent(name); err != nil {
+		WriteJSON(w, http.StatusNotFound, NewErrorList(NewError(NAME_UNKNOWN, map[string]string{"name": name})))
+		return
+	}
+
+	if tag != "" {
+		if _, _, _, err := rh.store(r).GetImageManifest(name, tag); err != nil {
+			WriteJSON(w, http.StatusNotFound, NewErrorList(NewError(MANIFEST_UNKNOWN, map[string]string{"tag": tag})))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.WriteHeader(http.StatusOK)
+
+	// streamed, so it's too late to answer otherwise
+	if err := storage.ExportRepo(rh.store(r), name, tag, w); err != nil {
+		rh.c.Log.Error().Err(err).Str("repo", name).Str("tag", tag).Msg("unable to export repository")
+	}
+}
+
+// ImportedTags are the tags pushed importing a repository.
+type ImportedTags struct {
+	Tags []string `json:"tags"`
+}
+
+// ImportRepository godoc
+// @Summary Import a repository
+// @Description Import a tar of an OCI image layout into a repository, pushing its blobs, then the manifests of
+// @Description its index, tagged as they are there
+// @Accept  application/x-tar
+// @Produce json
+// @Param   name     path    string     true        "repository name"
+// @Success 201 {object} 	api.ImportedTags
+// @Failure 400 {string} string "bad request"
+// @Failure 409 {string} string "conflict"
+// @Failure 500 {string} string "internal server error"
+// @Router /v2/_zot/import/{name} [post].
+func (rh *RouteHandler) ImportRepository(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	tags, err := storage.ImportRepo(rh.store(r), name, r.Body)
+	if err != nil {
+		rh.c.Log.Error().Err(err).Str("repo", name).Msg("unable to import repository")
+
+		switch err {
+		case errors.ErrBadLayout, errors.ErrBadBlobDigest, errors.ErrBadManifest, errors.ErrBlobNotFound:
+			WriteJSON(w, http.StatusBadRequest, NewErrorList(NewError(MANIFEST_INVALID, map[string]string{
+				"reason": err.Error()})))
+		case errors.ErrTagImmutable:
+			WriteJSON(w, http.StatusConflict, NewErrorList(NewError(DENIED, map[string]string{
+				"reason": "tag is immutable"})))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	WriteJSON(w, http.StatusCreated, ImportedTags{Tags: tags})
+}
+
+// ReloadConfig godoc
+// @Summary Reload the configuration
+// @Description Load the configuration again and apply what can change without restarting: the htpasswd users,
+// @Description the log level, the registries mirrored and the rules and destinations of actions
+// @Accept  json
+// @Produce json
+// @Success 204 {string} string "no content"
+// @Failure 400 {string} string "bad request"
+// @Router /v2/_zot/config/reload [post].
+func (rh *RouteHandler) ReloadConfig(w http.ResponseWriter, r *http.Request) {
+	config, err := rh.c.LoadConfig()
+	if err != nil {
+		rh.c.Log.Error().Err(err).Msg("unable to load configuration")
+		w.WriteHeader(http.StatusBadRequest)
+
+		return
+	}
+
+	if err := rh.c.Reload(config); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListReplications godoc
+// @Summary List image replications
+// @Description List the state of the images replicated to destinations, as last pushed or reconciled
+// @Accept  json
+// @Produce json
+// @Success 200 {array} 	actions.Replication
+// @Router /v2/_zot/replication [get].
+func (rh *RouteHandler) ListReplications(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, http.StatusOK, rh.c.Actions.Replications())
+}
+
+// ReconcileReplications godoc
+// @Summary Reconcile image replications
+// @Description Push again the images replicated to destinations which are incomplete there, or failed to be
+// @Accept  json
+// @Produce json
+// @Success 200 {array} 	actions.Replication
+// @Router /v2/_zot/replication [post].
+func (rh *RouteHandler) ReconcileReplications(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, http.StatusOK, rh.c.Actions.Reconcile())
+}
+
+// GetSyncStatus godoc
+// @Summary Get the status of syncing with other registries
+// @Description Get when each registry mirrored, or replicated to, was last synced, how far behind it is, and more
+// @Accept  json
+// @Produce json
+// @Success 200 {array} 	upstream.Status
+// @Router /v2/_zot/sync [get].
+func (rh *RouteHandler) GetSyncStatus(w http.ResponseWriter, r *http.Request) {
+	statuses := []upstream.Status{}
+
+	if rh.c.Mirrorer != nil {
+		statuses = append(statuses, rh.c.Mirrorer.Status()...)
+	}
+
+	if rh.c.Actions != nil {
+		statuses = append(statuses, rh.c.Actions.Status()...)
+	}
+
+	WriteJSON(w, http.StatusOK, statuses)
+}
+
+// APIKeyRequest is what an API key is minted with.
+type APIKeyRequest struct {
+	Label     string `json:"label"`
+	ExpiresIn string `json:"expiresIn"` // e.g. "720h", the maximum expiry if not set
+}
+
+// APIKeyResponse is an API key minted, only ever given then.
+type APIKeyResponse struct {
+	apikey.Key
+	Token string `json:"token"`
+}
+
+// ListAPIKeys godoc
+// @Summary List API keys
+// @Description List the API keys of the user, without the keys themselves
+// @Produce json
+// @Success 200 {array} 	apikey.Key
+// @Failure 401 {string} string "unauthorized"
+// @Router /v2/_zot/apikeys [get].
+func (rh *RouteHandler) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	user := actorOf(r)
+	if user == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	keys, err := rh.c.APIKeys.List(user)
+	if err != nil {
+		rh.c.Log.Error().Err(err).Str("user", user).Msg("unable to list API keys")
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, keys)
+}
+
+// CreateAPIKey godoc
+// @Summary Create an API key
+// @Description Mint an API key authenticating as the user, e.g. for CI pipelines, given as password or in the
+// @Description X-Zot-API-Key header; API keys can't mint others
+// @Accept  json
+// @Produce json
+// @Param   key      body    api.APIKeyRequest true "label and expiry"
+// @Success 201 {object} 	api.APIKeyResponse
+// @Failure 400 {string} string "bad request"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 403 {string} string "forbidden"
+// @Router /v2/_zot/apikeys [post].
+func (rh *RouteHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	user := actorOf(r)
+	if user == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// for a leaked key not to outlive its revocation
+	if apikey.KeyFromContext(r.Context()) != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var req APIKeyRequest
+
+	if err := jsoniter.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var expiry time.Duration
+
+	if req.ExpiresIn != "" {
+		var err error
+
+		if expiry, err = time.ParseDuration(req.ExpiresIn); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	token, key, err := rh.c.APIKeys.Create(user, req.Label, expiry)
+	if err != nil {
+		if err == errors.ErrBadAPIKeyExpiry {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	WriteJSON(w, http.StatusCreated, APIKeyResponse{Key: *key, Token: token})
+}
+
+// RevokeAPIKey godoc
+// @Summary Revoke an API key
+// @Description Revoke an API key of the user
+// @Param   id       path    string     true        "API key id"
+// @Success 204 {string} string "revoked"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 404 {string} string "not found"
+// @Router /v2/_zot/apikeys/{id} [delete].
+func (rh *RouteHandler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	user := actorOf(r)
+	if user == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if err := rh.c.APIKeys.Revoke(user, mux.Vars(r)["id"]); err != nil {
+		if err == errors.ErrAPIKeyNotFound {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			rh.c.Log.Error().Err(err).Str("user", user).Msg("unable to revoke API key")
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// helper routines
+
+// notify sends an event about a manifest or blob, if events are configured.
+func (rh *RouteHandler) notify(r *http.Request, action string, kind string, target events.Target) {
+	if rh.c.Events == nil {
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	reference := target.Digest
+	if reference == "" {
+		reference = target.Tag
+	}
+
+	target.URL = fmt.Sprintf("%s://%s/v2/%s/%s/%s", scheme, r.Host, target.Repository, kind, reference)
+
+	var requestID string
+	if u, err := guuid.NewV4(); err == nil {
+		requestID = u.String()
+	}
+
+	rh.c.Events.Notify(events.Event{
+		Action: action,
+		Target: target,
+		Request: events.Request{ID: requestID, Addr: r.RemoteAddr, Host: r.Host, Method: r.Method,
+			UserAgent: r.UserAgent()},
+		Actor: events.Actor{Name: actorOf(r)},
+	})
+}
+
+// store returns the image store serving a request, tracing its operations as part of the request
+// if traced.
+func (rh *RouteHandler) store(r *http.Request) storage.ImageStore {
+	if ts, ok := rh.c.ImageStore.(*tracing.ImageStore); ok {
+		return ts.WithContext(r.Context())
+	}
+
+	return rh.c.ImageStore
+}
+
+// taggedDigest returns the digest of the manifest a tag of a repository refers to, if any.
+func (rh *RouteHandler) taggedDigest(name string, tag string) string {
+	buf, err := rh.c.ImageStore.GetIndexContent(name)
+	if err != nil {
+		return ""
+	}
+
+	var index ispec.Index
+	if err := jsoniter.Unmarshal(buf, &index); err != nil {
+		return ""
+	}
+
+	for _, m := range index.Manifests {
+		if m.Annotations[ispec.AnnotationRefName] == tag {
+			return m.Digest.String()
+		}
+	}
+
+	return ""
+}
+
+// actorOf returns the user a request was made by, if authenticated: the user of the API key or
+// of the ID token, that authenticated by a password or a bearer token, or that of the verified
+// client certificate.
+func actorOf(r *http.Request) string {
+	if key := apikey.KeyFromContext(r.Context()); key != nil {
+		return key.User
+	}
+
+	if identity := oidc.IdentityFromContext(r.Context()); identity != nil {
+		return identity.Username
+	}
+
+	if user, ok := r.Context().Value(authUserKey{}).(string); ok {
+		return user
+	}
+
+	if user, ok := r.Context().Value(clientUserKey{}).(string); ok {
+		return user
+	}
+
+	return ""
+}
+
+// admit returns whether the admission service, if any, accepts a push of a manifest.
+func (rh *RouteHandler) admit(r *http.Request, name string, reference string, mediaType string,
+	body []byte) admission.Response {
+	// invalid manifests are left for the store to reject
+	if rh.c.Admission == nil || !rh.c.Admission.Reviews(name) || !jsoniter.Valid(body) {
+		return admission.Response{Allowed: true}
+	}
+
+	req := admission.Request{Repository: name, Reference: reference, Digest: godigest.FromBytes(body).String(),
+		MediaType: mediaType, Manifest: body, Actor: actorOf(r), Addr: r.RemoteAddr, UserAgent: r.UserAgent()}
+
+	if identity := oidc.IdentityFromContext(r.Context()); identity != nil {
+		req.Groups = identity.Groups
+	}
+
+	// policies on labels and base images need the image config, pushed before the manifest
+	req.Config = rh.imageConfig(name, body)
+
+	return rh.c.Admission.Review(req)
+}
+
+// imageConfig returns the config of the image of a manifest, nil if not found.
+func (rh *RouteHandler) imageConfig(name string, body []byte) []byte {
+	// only the config is needed of what may be a large manifest
+	var manifest struct {
+		Config ispec.Descriptor `json:"config"`
+	}
+
+	if err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(body, &manifest); err != nil ||
+		manifest.Config.Digest == "" {
+		return nil
+	}
+
+	r, _, err := rh.c.ImageStore.GetBlob(name, manifest.Config.Digest.String(), manifest.Config.MediaType)
+	if err != nil {
+		return nil
+	}
+
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	config, err := ioutil.ReadAll(r)
+	if err != nil || !jsoniter.Valid(config) {
+		return nil
+	}
+
+	return config
+}
+
+// readManifest reads a pushed manifest into a buffer of its announced size, if any, rather
+// than one grown as it's read, failing with ErrBadManifest if over maxSize.
+func readManifest(r *http.Request, maxSize int64) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if r.ContentLength > 0 {
+		buf.Grow(int(r.ContentLength) + bytes.MinRead)
+	}
+
+	if _, err := buf.ReadFrom(io.LimitReader(r.Body, maxSize+1)); err != nil {
+		return nil, err
+	}
+
+	if int64(buf.Len()) > maxSize {
+		return nil, errors.ErrBadManifest
+	}
+
+	return buf.Bytes(), nil
+}
+
+// maxManifestSize returns the size of the largest manifest accepted.
+func (rh *RouteHandler) maxManifestSize() int64 {
+	if rh.c.Config.HTTP.MaxManifestSize > 0 {
+		return rh.c.Config.HTTP.MaxManifestSize
+	}
+
+	return MaxManifestSize
+}
+
+// blobTooLarge responds that a blob is too large if an upload would make it larger than the
+// maximum size configured, size being that it would be uploaded, returning whether it would.
+func (rh *RouteHandler) blobTooLarge(w http.ResponseWriter, name string, size int64) bool {
+	maxSize := rh.c.Config.HTTP.MaxBlobSize
+	if maxSize <= 0 || size <= maxSize {
+		return false
+	}
+
+	rh.c.Log.Warn().Str("name", name).Int64("size", size).Int64("limit", maxSize).Msg("blob too large")
+	WriteJSON(w, http.StatusRequestEntityTooLarge, NewErrorList(NewError(SIZE_INVALID,
+		map[string]string{"name": name, "limit": strconv.FormatInt(maxSize, 10)})))
+
+	return true
+}
+
+// limitBlob returns the body of a request uploading to a blob of which uploaded bytes are
+// already, failing with ErrBlobTooLarge once read beyond the maximum size configured, if any,
+// for uploads of unannounced size not to be written whole.
+func (rh *RouteHandler) limitBlob(r *http.Request, uploaded int64) io.Reader {
+	if rh.c.Config.HTTP.MaxBlobSize <= 0 {
+		return r.Body
+	}
+
+	return &sizeLimitedReader{r: r.Body, n: rh.c.Config.HTTP.MaxBlobSize - uploaded}
+}
+
+// uploadedSize returns the bytes of a blob upload written so far, 0 if unknown, only with a
+// maximum blob size configured.
+func (rh *RouteHandler) uploadedSize(r *http.Request, name string, sessionID string) int64 {
+	if rh.c.Config.HTTP.MaxBlobSize <= 0 {
+		return 0
+	}
+
+	size, err := rh.store(r).GetBlobUpload(name, sessionID)
+	if err != nil {
+		return 0
+	}
+
+	return size
+}
+
+// sizeLimitedReader reads at most n bytes of r, failing with ErrBlobTooLarge if it has more.
+type sizeLimitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errors.ErrBlobTooLarge
+	}
+
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		n, l.n = int(l.n), -1
+
+		return n, errors.ErrBlobTooLarge
+	}
+
+	l.n -= int64(n)
+
+	return n, err
+}
+
+// subjectOf returns the digest of the subject of a manifest, if any.
+func subjectOf(body []byte) string {
+	var manifest struct {
+		Subject *ispec.Descriptor `json:"subject"`
+	}
+
+	if err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(body, &manifest); err != nil ||
+		manifest.Subject == nil {
+		return ""
+	}
+
+	return manifest.Subject.Digest.String()
+}
+
+// tagOf returns the tag a manifest reference is, if not a digest.
+func tagOf(reference string) string {
+	if _, err := godigest.Parse(reference); err == nil {
+		return ""
+	}
+
+	return reference
+}
+
+func getContentRange(r *http.Request) (int64 /* from */, int64 /* to */, error) {
+	contentRange := r.Header.Get("Content-Range")
+	tokens := strings.Split(contentRange, "-")
+	from, err := strconv.ParseInt(tokens[0], 10, 64)
+
+	if err != nil {
+		return -1, -1, errors.ErrBadUploadRange
+	}
+
+	to, err := strconv.ParseInt(tokens[1], 10, 64)
+	if err != nil {
 		return -1, -1, errors.ErrBadUploadRange
 	}
 
@@ -1085,6 +2245,39 @@ func getContentRange(r *http.Request) (int64 /* from */, int64 /* to */, error)
 	return from, to, nil
 }
 
+// getRange returns the first and last bytes of the range requested by the Range header, the
+// last being -1 for the end, and whether a range was. Suffix and multiple ranges aren't
+// supported, the whole blob being served instead, as HTTP allows.
+func getRange(r *http.Request) (int64 /* from */, int64 /* to */, bool) {
+	header := r.Header.Get("Range")
+
+	spec := strings.TrimPrefix(header, "bytes=")
+	if spec == header || strings.Contains(spec, ",") {
+		return -1, -1, false
+	}
+
+	tokens := strings.SplitN(spec, "-", 2)
+	if len(tokens) != 2 {
+		return -1, -1, false
+	}
+
+	from, err := strconv.ParseInt(strings.TrimSpace(tokens[0]), 10, 64)
+	if err != nil || from < 0 {
+		return -1, -1, false
+	}
+
+	to := int64(-1)
+
+	if t := strings.TrimSpace(tokens[1]); t != "" {
+		to, err = strconv.ParseInt(t, 10, 64)
+		if err != nil || to < from {
+			return -1, -1, false
+		}
+	}
+
+	return from, to, true
+}
+
 func WriteJSON(w http.ResponseWriter, status int, data interface{}) {
 	var json = jsoniter.ConfigCompatibleWithStandardLibrary
 	body, err := json.Marshal(data)
@@ -1096,6 +2289,24 @@ func WriteJSON(w http.ResponseWriter, status int, data interface{}) {
 	WriteData(w, status, DefaultMediaType, body)
 }
 
+// DistAPIVersionHandler tells clients, e.g. docker, checking it before pushing or pulling, the
+// version of the API served, in responses to all requests, authenticated or not.
+func DistAPIVersionHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(DistAPIVersion, "registry/2.0")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setContentHeaders sets the headers describing the manifests and blobs served, the same for
+// HEAD requests as for GET ones, for clients, e.g. containerd, to check them before pulling.
+func setContentHeaders(w http.ResponseWriter, mediaType string, digest string, length int64) {
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.Header().Set(DistContentDigestKey, digest)
+	w.Header().Set("ETag", fmt.Sprintf("%q", digest))
+}
+
 func WriteData(w http.ResponseWriter, status int, mediaType string, data []byte) {
 	w.Header().Set("Content-Type", mediaType)
 	w.WriteHeader(status)
@@ -1103,7 +2314,11 @@ func WriteData(w http.ResponseWriter, status int, mediaType string, data []byte)
 }
 
 func WriteDataFromReader(w http.ResponseWriter, status int, length int64, mediaType string,
-	reader io.Reader, logger log.Logger) {
+	reader io.Reader, copies *storage.CopyBuffers, logger log.Logger) {
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
 	w.Header().Set("Content-Type", mediaType)
 	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
 	w.WriteHeader(status)
@@ -1111,7 +2326,7 @@ func WriteDataFromReader(w http.ResponseWriter, status int, length int64, mediaT
 	const maxSize = 10 * 1024 * 1024
 
 	for {
-		_, err := io.CopyN(w, reader, maxSize)
+		_, err := copies.CopyN(w, reader, maxSize)
 		if err == io.EOF {
 			break
 		} else if err != nil {
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net"
+	"os"
+	"strconv"
+)
+
+const (
+	// first file descriptor passed in by systemd socket activation, see sd_listen_fds(3).
+	sdListenFdsStart = 3
+	// sd_notify(3) state sent once the server is ready to accept connections.
+	sdNotifyReady = "READY=1"
+	// sd_notify(3) state sent when the server begins shutting down.
+	sdNotifyStopping = "STOPPING=1"
+)
+
+// sdListener returns the listener passed in by systemd socket activation
+// (LISTEN_PID/LISTEN_FDS), or nil if the process was not socket-activated.
+func sdListener() (net.Listener, int, error) {
+	defer func() {
+		// don't let children inherit the activation environment
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, 0, nil
+	}
+
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, 0, nil
+	}
+
+	f := os.NewFile(uintptr(sdListenFdsStart), "LISTEN_FD_"+strconv.Itoa(sdListenFdsStart))
+	defer f.Close()
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, nfds, err
+	}
+
+	return l, nfds, nil
+}
+
+// sdNotify sends a state notification to the service manager if NOTIFY_SOCKET
+// is set, and returns false if notifications are not supported.
+func sdNotify(state string) (bool, error) {
+	addr := &net.UnixAddr{Name: os.Getenv("NOTIFY_SOCKET"), Net: "unixgram"}
+	if addr.Name == "" {
+		return false, nil
+	}
+
+	conn, err := net.DialUnix(addr.Net, nil, addr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
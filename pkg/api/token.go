@@ -0,0 +1,205 @@
+package api
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/chartmuseum/auth"
+)
+
+const (
+	// TokenPath is where bearer tokens are issued, if zot issues them itself.
+	TokenPath = "/auth/token"
+
+	// how long tokens issued are valid for, clients asking for others once expired
+	tokenExpiry = 5 * time.Minute
+
+	// random bytes of the ids of tokens
+	tokenIDSize = 16
+)
+
+// tokenIssuer issues bearer tokens to users, as the token service of the docker registry token
+// authentication would, signed with the private key of the certificate tokens are verified with.
+type tokenIssuer struct {
+	key     *rsa.PrivateKey
+	realm   string
+	service string
+}
+
+func newTokenIssuer(config *BearerConfig, log log.Logger) (*tokenIssuer, error) {
+	buf, err := ioutil.ReadFile(config.Key)
+	if err != nil {
+		log.Error().Err(err).Str("key", config.Key).Msg("unable to read bearer token signing key")
+		return nil, err
+	}
+
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		log.Error().Str("key", config.Key).Msg("bearer token signing key isn't PEM encoded")
+		return nil, errors.ErrBadConfig
+	}
+
+	var key *rsa.PrivateKey
+
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = k
+	} else if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		key, _ = k.(*rsa.PrivateKey)
+	}
+
+	if key == nil {
+		log.Error().Str("key", config.Key).Msg("bearer token signing key isn't an RSA private key")
+		return nil, errors.ErrBadConfig
+	}
+
+	return &tokenIssuer{key: key, realm: config.Realm, service: config.Service}, nil
+}
+
+// issue returns a token granting access to a user, anonymous if not named.
+func (t *tokenIssuer) issue(user string, access []auth.AccessEntry, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"typ": "JWT", "alg": "RS256"})
+	if err != nil {
+		return "", err
+	}
+
+	id := make([]byte, tokenIDSize)
+	_, _ = rand.Read(id)
+
+	c := map[string]interface{}{
+		"iss":    t.realm,
+		"aud":    t.service,
+		"exp":    now.Add(tokenExpiry).Unix(),
+		"nbf":    now.Unix(),
+		"iat":    now.Unix(),
+		"jti":    hex.EncodeToString(id),
+		"access": access,
+	}
+
+	if user != "" {
+		c["sub"] = user
+	}
+
+	claims, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, t.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// tokenResponse is that of the docker registry token authentication.
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	IssuedAt    string `json:"issued_at"`
+}
+
+// tokenHandler issues tokens to the users authenticated with their password, granting them the
+// pulls and pushes of the repositories of the scopes they ask for their access control policies
+// allow, and to anonymous users only pulls, with read access allowed.
+func tokenHandler(c *Controller, issuer *tokenIssuer) http.HandlerFunc {
+	realm := basicRealm(c)
+	authenticate := passwordChecker(c)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		if service := q.Get("service"); service != "" && service != issuer.service {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		user, password, authenticated := r.BasicAuth()
+		if authenticated && !authenticate(user, password) {
+			c.Log.Warn().Str("user", user).Msg("bearer token denied")
+			authFail(w, realm, c.Config.HTTP.Auth.FailDelay)
+
+			return
+		}
+
+		if !authenticated && !c.Config.HTTP.AllowReadAccess {
+			authFail(w, realm, c.Config.HTTP.Auth.FailDelay)
+			return
+		}
+
+		// the base of the API and the catalog, checked as a repository without name
+		access := []auth.AccessEntry{{Type: bearerAuthDefaultAccessEntryType, Name: "",
+			Actions: []string{auth.PullAction}}}
+
+		allowed := func(name, action string) bool {
+			if action == auth.PushAction && (!authenticated || c.Config.HTTP.ReadOnly) {
+				return false
+			}
+
+			return !authenticated || c.allowed(user, name, action)
+		}
+
+		for _, scope := range q["scope"] {
+			if entry, ok := parseScope(scope, allowed); ok {
+				access = append(access, entry)
+			}
+		}
+
+		now := time.Now()
+
+		token, err := issuer.issue(user, access, now)
+		if err != nil {
+			c.Log.Error().Err(err).Msg("unable to issue bearer token")
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		WriteJSON(w, http.StatusOK, tokenResponse{Token: token, AccessToken: token,
+			ExpiresIn: int(tokenExpiry.Seconds()), IssuedAt: now.UTC().Format(time.RFC3339)})
+	}
+}
+
+// parseScope returns the access granted of a scope, "repository:<name>:<actions>", the actions
+// asked for allowed on the repository, and whether any is.
+func parseScope(scope string, allowed func(name, action string) bool) (auth.AccessEntry, bool) {
+	first, last := strings.Index(scope, ":"), strings.LastIndex(scope, ":")
+	if first < 0 || first == last || scope[:first] != bearerAuthDefaultAccessEntryType {
+		return auth.AccessEntry{}, false
+	}
+
+	entry := auth.AccessEntry{Type: bearerAuthDefaultAccessEntryType, Name: scope[first+1 : last]}
+	pull, push := false, false
+
+	for _, action := range strings.Split(scope[last+1:], ",") {
+		pull = pull || action == auth.PullAction || action == "*"
+		push = push || action == auth.PushAction || action == "*"
+	}
+
+	if pull && allowed(entry.Name, auth.PullAction) {
+		entry.Actions = append(entry.Actions, auth.PullAction)
+	}
+
+	if push && allowed(entry.Name, auth.PushAction) {
+		entry.Actions = append(entry.Actions, auth.PushAction)
+	}
+
+	return entry, len(entry.Actions) > 0
+}
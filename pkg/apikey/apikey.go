@@ -0,0 +1,275 @@
+// Package apikey lets users mint API keys, e.g. for CI pipelines not to use their password,
+// authenticating as them until revoked or expired. Only the hashes of keys are stored.
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// DBName is the name of the db of keys under the storage root directory, if not configured.
+	DBName = "apikeys.db"
+
+	// Prefix starts every key, for keys given as passwords to be told apart from those of users.
+	Prefix = "zak_"
+
+	// Header is that keys may be given in, instead of as the password of basic authentication.
+	Header = "X-Zot-API-Key"
+
+	keysBucket = "keys"
+
+	// random bytes of keys and of their ids
+	tokenSize = 32
+	idSize    = 8
+
+	// how long to wait for another process to release the db
+	openTimeout = time.Second
+)
+
+type Config struct {
+	// Path is that of the db of keys, apikeys.db under the storage root directory if not set
+	Path string
+	// MaxExpiry bounds how long keys are valid for, and is that of keys minted without one;
+	// keys may be minted never to expire if 0
+	MaxExpiry time.Duration
+}
+
+// Validate checks the maximum expiry isn't negative.
+func (c *Config) Validate(log log.Logger) error {
+	if c.MaxExpiry < 0 {
+		log.Error().Str("maxExpiry", c.MaxExpiry.String()).Msg("invalid API key maximum expiry")
+		return errors.ErrBadConfig
+	}
+
+	return nil
+}
+
+// Key describes an API key, without the key itself, which is only known to its user.
+type Key struct {
+	ID      string     `json:"id"`
+	User    string     `json:"user"`
+	Label   string     `json:"label,omitempty"` // e.g. the pipeline it's for
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"` // never, if not set
+}
+
+type contextKey struct{}
+
+// ContextWithKey returns a copy of ctx carrying the key a request was authenticated with.
+func ContextWithKey(ctx context.Context, key *Key) context.Context {
+	return context.WithValue(ctx, contextKey{}, key)
+}
+
+// KeyFromContext returns the key carried by ctx, nil if none.
+func KeyFromContext(ctx context.Context) *Key {
+	key, _ := ctx.Value(contextKey{}).(*Key)
+
+	return key
+}
+
+// TokenOf returns the API key of a request, given in the Header, or as the password of basic
+// authentication, e.g. by docker login.
+func TokenOf(r *http.Request) (string, bool) {
+	if token := r.Header.Get(Header); token != "" {
+		return token, true
+	}
+
+	if _, password, ok := r.BasicAuth(); ok && strings.HasPrefix(password, Prefix) {
+		return password, true
+	}
+
+	return "", false
+}
+
+// Store keeps the keys of users in a bolt db, by the hashes of the keys.
+type Store struct {
+	db        *bbolt.DB
+	maxExpiry time.Duration
+	log       log.Logger
+}
+
+// NewStore opens the db of keys of a valid config, creating it if missing, rootDir being the
+// storage root directory.
+func NewStore(config *Config, rootDir string, log log.Logger) (*Store, error) {
+	path := config.Path
+	if path == "" {
+		path = filepath.Join(rootDir, DBName)
+	}
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: openTimeout})
+	if err != nil {
+		log.Error().Err(err).Str("path", path).Msg("unable to open API keys db")
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(keysBucket))
+		return err
+	}); err != nil {
+		log.Error().Err(err).Str("path", path).Msg("unable to create API keys bucket")
+		db.Close()
+
+		return nil, err
+	}
+
+	return &Store{db: db, maxExpiry: config.MaxExpiry, log: log}, nil
+}
+
+// Close closes the db of keys.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Create mints a key for a user, valid for expiry, or the maximum expiry if 0, returning the
+// key itself, only known from then on to the user.
+func (s *Store) Create(user string, label string, expiry time.Duration) (string, *Key, error) {
+	if expiry < 0 || (s.maxExpiry > 0 && expiry > s.maxExpiry) {
+		return "", nil, errors.ErrBadAPIKeyExpiry
+	}
+
+	if expiry == 0 {
+		expiry = s.maxExpiry
+	}
+
+	token := Prefix + randomHex(tokenSize)
+	key := &Key{ID: randomHex(idSize), User: user, Label: label, Created: time.Now().UTC()}
+
+	if expiry > 0 {
+		expires := key.Created.Add(expiry)
+		key.Expires = &expires
+	}
+
+	buf, err := json.Marshal(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(keysBucket)).Put(hash(token), buf)
+	}); err != nil {
+		s.log.Error().Err(err).Str("user", user).Msg("unable to store API key")
+		return "", nil, err
+	}
+
+	s.log.Info().Str("user", user).Str("id", key.ID).Str("label", label).Msg("API key created")
+
+	return token, key, nil
+}
+
+// List returns the keys of a user, oldest first, expired ones included until revoked.
+func (s *Store) List(user string) ([]Key, error) {
+	keys := []Key{}
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(keysBucket)).ForEach(func(_, v []byte) error {
+			var key Key
+			if err := json.Unmarshal(v, &key); err != nil {
+				return err
+			}
+
+			if key.User == user {
+				keys = append(keys, key)
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+
+	return keys, nil
+}
+
+// Revoke deletes the key of an id, if that of the user.
+func (s *Store) Revoke(user string, id string) error {
+	found := false
+
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(keysBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var key Key
+			if err := json.Unmarshal(v, &key); err != nil {
+				return err
+			}
+
+			if key.ID == id && key.User == user {
+				found = true
+				return c.Delete()
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return errors.ErrAPIKeyNotFound
+	}
+
+	s.log.Info().Str("user", user).Str("id", id).Msg("API key revoked")
+
+	return nil
+}
+
+// Authenticate returns the key of a token, if neither revoked nor expired.
+func (s *Store) Authenticate(token string) (*Key, error) {
+	if !strings.HasPrefix(token, Prefix) {
+		return nil, errors.ErrBadAPIKey
+	}
+
+	var key *Key
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket([]byte(keysBucket)).Get(hash(token))
+		if v == nil {
+			return errors.ErrBadAPIKey
+		}
+
+		key = &Key{}
+
+		return json.Unmarshal(v, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if key.Expires != nil && time.Now().After(*key.Expires) {
+		return nil, errors.ErrBadAPIKey
+	}
+
+	return key, nil
+}
+
+// hash returns the hash keys are stored by, keys being random enough for it not to be salted.
+func hash(token string) []byte {
+	h := sha256.Sum256([]byte(token))
+
+	return h[:]
+}
+
+func randomHex(size int) string {
+	buf := make([]byte, size)
+	_, _ = rand.Read(buf)
+
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,160 @@
+package apikey_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/apikey"
+	"github.com/anuvu/zot/pkg/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfig(t *testing.T) {
+	Convey("Validate API key configurations", t, func() {
+		log := log.NewLogger("debug", "")
+
+		So((&apikey.Config{}).Validate(log), ShouldBeNil)
+		So((&apikey.Config{MaxExpiry: 24 * time.Hour}).Validate(log), ShouldBeNil)
+		So((&apikey.Config{MaxExpiry: -time.Hour}).Validate(log), ShouldEqual, errors.ErrBadConfig)
+	})
+}
+
+func TestStore(t *testing.T) {
+	Convey("Mint, list and revoke API keys", t, func() {
+		dir, err := ioutil.TempDir("", "apikey-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.NewLogger("debug", "")
+
+		store, err := apikey.NewStore(&apikey.Config{MaxExpiry: 24 * time.Hour}, dir, log)
+		So(err, ShouldBeNil)
+
+		token, key, err := store.Create("alice", "ci", 0)
+		So(err, ShouldBeNil)
+		So(token, ShouldStartWith, apikey.Prefix)
+		So(key.User, ShouldEqual, "alice")
+		So(key.Label, ShouldEqual, "ci")
+		So(key.Expires, ShouldNotBeNil)
+		So(key.Expires.Sub(key.Created), ShouldEqual, 24*time.Hour)
+
+		// only hashes are stored
+		buf, err := ioutil.ReadFile(filepath.Join(dir, apikey.DBName))
+		So(err, ShouldBeNil)
+		So(strings.Contains(string(buf), token), ShouldBeFalse)
+
+		authenticated, err := store.Authenticate(token)
+		So(err, ShouldBeNil)
+		So(authenticated.ID, ShouldEqual, key.ID)
+		So(authenticated.User, ShouldEqual, "alice")
+
+		for _, token := range []string{"", "password", apikey.Prefix, token + "0"} {
+			_, err := store.Authenticate(token)
+			So(err, ShouldEqual, errors.ErrBadAPIKey)
+		}
+
+		// not beyond the maximum expiry
+		_, _, err = store.Create("alice", "", 48*time.Hour)
+		So(err, ShouldEqual, errors.ErrBadAPIKeyExpiry)
+
+		_, _, err = store.Create("alice", "", -time.Hour)
+		So(err, ShouldEqual, errors.ErrBadAPIKeyExpiry)
+
+		other, _, err := store.Create("alice", "release", time.Hour)
+		So(err, ShouldBeNil)
+
+		_, _, err = store.Create("bob", "", 0)
+		So(err, ShouldBeNil)
+
+		keys, err := store.List("alice")
+		So(err, ShouldBeNil)
+		So(keys, ShouldHaveLength, 2)
+		So(keys[0].ID, ShouldEqual, key.ID)
+		So(keys[1].Label, ShouldEqual, "release")
+
+		// only by their users
+		So(store.Revoke("bob", key.ID), ShouldEqual, errors.ErrAPIKeyNotFound)
+		So(store.Revoke("alice", key.ID), ShouldBeNil)
+		So(store.Revoke("alice", key.ID), ShouldEqual, errors.ErrAPIKeyNotFound)
+
+		_, err = store.Authenticate(token)
+		So(err, ShouldEqual, errors.ErrBadAPIKey)
+
+		// kept across restarts
+		So(store.Close(), ShouldBeNil)
+
+		store, err = apikey.NewStore(&apikey.Config{}, dir, log)
+		So(err, ShouldBeNil)
+		defer store.Close()
+
+		_, err = store.Authenticate(other)
+		So(err, ShouldBeNil)
+
+		keys, err = store.List("alice")
+		So(err, ShouldBeNil)
+		So(keys, ShouldHaveLength, 1)
+
+		// never expiring, without a maximum expiry
+		_, key, err = store.Create("alice", "", 0)
+		So(err, ShouldBeNil)
+		So(key.Expires, ShouldBeNil)
+	})
+
+	Convey("Expired keys don't authenticate", t, func() {
+		dir, err := ioutil.TempDir("", "apikey-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		store, err := apikey.NewStore(&apikey.Config{Path: filepath.Join(dir, "keys.db")}, "",
+			log.NewLogger("debug", ""))
+		So(err, ShouldBeNil)
+		defer store.Close()
+
+		token, _, err := store.Create("alice", "", time.Millisecond)
+		So(err, ShouldBeNil)
+
+		time.Sleep(10 * time.Millisecond)
+
+		_, err = store.Authenticate(token)
+		So(err, ShouldEqual, errors.ErrBadAPIKey)
+
+		// until revoked
+		keys, err := store.List("alice")
+		So(err, ShouldBeNil)
+		So(keys, ShouldHaveLength, 1)
+	})
+}
+
+func TestTokenOf(t *testing.T) {
+	Convey("Find the API key of requests", t, func() {
+		r := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+
+		_, ok := apikey.TokenOf(r)
+		So(ok, ShouldBeFalse)
+
+		// a password of a user
+		r.SetBasicAuth("alice", "password")
+
+		_, ok = apikey.TokenOf(r)
+		So(ok, ShouldBeFalse)
+
+		r.SetBasicAuth("alice", apikey.Prefix+"key")
+
+		token, ok := apikey.TokenOf(r)
+		So(ok, ShouldBeTrue)
+		So(token, ShouldEqual, apikey.Prefix+"key")
+
+		r.Header.Set(apikey.Header, apikey.Prefix+"other")
+
+		token, ok = apikey.TokenOf(r)
+		So(ok, ShouldBeTrue)
+		So(token, ShouldEqual, apikey.Prefix+"other")
+	})
+}
@@ -0,0 +1,599 @@
+// Package backup takes point-in-time snapshots of a registry's storage, and restores them.
+//
+// A backup directory holds a pool of blobs, shared by all snapshots so that each one only
+// copies the blobs new since the last, and a directory per snapshot with the index of each
+// repository, and exports of the dedupe cache and search dbs:
+//
+//	blobs/sha256/<hex>
+//	snapshots/<id>/snapshot.json
+//	snapshots/<id>/repos/<repo>/index.json
+//	snapshots/<id>/cache.db
+//	snapshots/<id>/db/trivy.db
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	blobsDir     = "blobs"
+	snapshotsDir = "snapshots"
+	reposDir     = "repos"
+	snapshotFile = "snapshot.json"
+
+	// the search extension's vulnerability db, under the storage root directory
+	searchDBDir = "db"
+
+	// snapshot IDs are their creation time, which sorts them
+	idFormat = "20060102T150405.000Z"
+)
+
+// searchDBFiles are the files of the search extension's vulnerability db.
+var searchDBFiles = []string{"trivy.db", "metadata.json"}
+
+type Config struct {
+	Directory string        // where snapshots are kept
+	Interval  time.Duration // how often to take a snapshot, only on demand if 0
+}
+
+// Validate checks a backup directory is given.
+func (c *Config) Validate(log log.Logger) error {
+	if c.Directory == "" {
+		log.Error().Msg("backup directory not set")
+		return errors.ErrBadConfig
+	}
+
+	if c.Interval < 0 {
+		log.Error().Dur("interval", c.Interval).Msg("invalid backup interval")
+		return errors.ErrBadConfig
+	}
+
+	return nil
+}
+
+// Snapshot describes the contents of a snapshot.
+type Snapshot struct {
+	ID           string       `json:"id"`
+	Created      time.Time    `json:"created"`
+	Repositories []Repository `json:"repositories"`
+	Cache        bool         `json:"cache"`    // whether the dedupe cache db was exported
+	SearchDB     bool         `json:"searchDB"` // whether the search db was exported
+	Copied       int          `json:"copied"`   // how many blobs weren't in earlier snapshots
+}
+
+// Repository describes a repository in a snapshot.
+type Repository struct {
+	Name  string   `json:"name"`
+	Blobs []string `json:"blobs"` // digests of the manifests, configs and layers referenced by its index
+}
+
+// cacheExporter is implemented by image stores with a dedupe cache db.
+type cacheExporter interface {
+	ExportCache(w io.Writer) error
+}
+
+// Manager takes snapshots of an image store, one at a time.
+type Manager struct {
+	config  *Config
+	is      storage.ImageStore
+	rootDir string
+	log     log.Logger
+
+	lock sync.Mutex
+}
+
+// NewManager returns a manager of the snapshots of is, whose root directory, if any, has
+// the dbs to export along with it.
+func NewManager(config *Config, is storage.ImageStore, rootDir string, log log.Logger) *Manager {
+	return &Manager{config: config, is: is, rootDir: rootDir, log: log}
+}
+
+// Run takes snapshots in the background every interval, if configured, until ctx is done.
+func (m *Manager) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if m.config.Interval == 0 {
+		return
+	}
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-ctx.Done():
+				m.log.Info().Msg("stopping scheduled backups")
+				return
+			case <-time.After(m.config.Interval):
+			}
+
+			if _, err := m.Backup(); err != nil {
+				m.log.Error().Err(err).Msg("unable to back up storage")
+			}
+		}
+	}()
+}
+
+// Snapshots returns the snapshots taken so far, oldest first.
+func (m *Manager) Snapshots() ([]Snapshot, error) {
+	return List(m.config.Directory)
+}
+
+// Backup takes a snapshot, returning it. The index of each repository is read first, and
+// the blobs it references copied after, so each repository is restored as it was at a
+// point in time, although not all of them at quite the same one.
+func (m *Manager) Backup() (*Snapshot, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now().UTC()
+	snapshot := &Snapshot{ID: now.Format(idFormat), Created: now, Repositories: []Repository{}}
+
+	dir := filepath.Join(m.config.Directory, snapshotsDir, snapshot.ID)
+	tmp := filepath.Join(m.config.Directory, snapshotsDir, "."+snapshot.ID)
+
+	if err := os.MkdirAll(filepath.Join(tmp, reposDir), 0700); err != nil {
+		m.log.Error().Err(err).Str("dir", tmp).Msg("unable to create snapshot dir")
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	repos, err := m.is.GetRepositories()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(repos)
+
+	indexes := make([][]byte, len(repos))
+
+	for i, repo := range repos {
+		if indexes[i], err = m.is.GetIndexContent(repo); err != nil {
+			m.log.Error().Err(err).Str("repo", repo).Msg("unable to read index")
+			return nil, err
+		}
+	}
+
+	for i, repo := range repos {
+		buf := indexes[i]
+
+		blobs, err := m.blobs(repo, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		r := Repository{Name: repo, Blobs: []string{}}
+
+		for _, d := range blobs {
+			copied, err := m.copyBlob(repo, d)
+			if err != nil {
+				return nil, err
+			}
+
+			if copied {
+				snapshot.Copied++
+			}
+
+			r.Blobs = append(r.Blobs, d.String())
+		}
+
+		snapshot.Repositories = append(snapshot.Repositories, r)
+
+		if err := writeFile(filepath.Join(tmp, reposDir, repo, "index.json"), buf); err != nil {
+			m.log.Error().Err(err).Str("repo", repo).Msg("unable to write index")
+			return nil, err
+		}
+	}
+
+	if snapshot.Cache, err = m.exportCache(filepath.Join(tmp, storage.CacheName+".db")); err != nil {
+		return nil, err
+	}
+
+	if snapshot.SearchDB, err = m.exportSearchDB(filepath.Join(tmp, searchDBDir)); err != nil {
+		return nil, err
+	}
+
+	buf, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFile(filepath.Join(tmp, snapshotFile), buf); err != nil {
+		return nil, err
+	}
+
+	// only complete snapshots are ever visible
+	if err := os.Rename(tmp, dir); err != nil {
+		m.log.Error().Err(err).Str("dir", dir).Msg("unable to save snapshot")
+		return nil, err
+	}
+
+	m.log.Info().Str("id", snapshot.ID).Int("repos", len(snapshot.Repositories)).Int("copied", snapshot.Copied).
+		Msg("snapshot taken")
+
+	return snapshot, nil
+}
+
+// blobs returns the digests of the blobs referenced by the index of a repository: those
+// of the manifests, recursively for image indexes, and of their configs and layers.
+func (m *Manager) blobs(repo string, buf []byte) ([]godigest.Digest, error) {
+	var index ispec.Index
+	if err := json.Unmarshal(buf, &index); err != nil {
+		m.log.Error().Err(err).Str("repo", repo).Msg("invalid index")
+		return nil, errors.ErrBadManifest
+	}
+
+	seen := map[godigest.Digest]bool{}
+	blobs := []godigest.Digest{}
+	pending := append([]ispec.Descriptor{}, index.Manifests...)
+
+	for len(pending) > 0 {
+		desc := pending[0]
+		pending = pending[1:]
+
+		if seen[desc.Digest] {
+			continue
+		}
+
+		seen[desc.Digest] = true
+		blobs = append(blobs, desc.Digest)
+
+		r, _, err := m.is.GetBlob(repo, desc.Digest.String(), desc.MediaType)
+		if err != nil {
+			m.log.Error().Err(err).Str("repo", repo).Str("digest", desc.Digest.String()).Msg("unable to read manifest")
+			return nil, err
+		}
+
+		buf, err := ioutil.ReadAll(r)
+		closeReader(r)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// whatever its media type, a manifest references blobs or other manifests
+		var manifest struct {
+			Config    *ispec.Descriptor  `json:"config"`
+			Layers    []ispec.Descriptor `json:"layers"`
+			Manifests []ispec.Descriptor `json:"manifests"`
+		}
+
+		if err := json.Unmarshal(buf, &manifest); err != nil {
+			m.log.Error().Err(err).Str("repo", repo).Str("digest", desc.Digest.String()).Msg("invalid manifest")
+			return nil, errors.ErrBadManifest
+		}
+
+		pending = append(pending, manifest.Manifests...)
+
+		if manifest.Config != nil {
+			manifest.Layers = append(manifest.Layers, *manifest.Config)
+		}
+
+		for _, l := range manifest.Layers {
+			if !seen[l.Digest] {
+				seen[l.Digest] = true
+				blobs = append(blobs, l.Digest)
+			}
+		}
+	}
+
+	return blobs, nil
+}
+
+// copyBlob copies a blob to the pool, verifying its digest, unless already there. It
+// returns whether it was copied.
+func (m *Manager) copyBlob(repo string, d godigest.Digest) (bool, error) {
+	if err := d.Validate(); err != nil {
+		return false, errors.ErrBadBlobDigest
+	}
+
+	dst := blobPath(m.config.Directory, d)
+	if _, err := os.Stat(dst); err == nil {
+		return false, nil
+	}
+
+	r, _, err := m.is.GetBlob(repo, d.String(), "")
+	if err != nil {
+		// removed since its index was read, e.g. by garbage collection
+		m.log.Error().Err(err).Str("repo", repo).Str("digest", d.String()).Msg("unable to read blob")
+		return false, err
+	}
+	defer closeReader(r)
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return false, err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(dst), ".blob-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name())
+
+	verifier := d.Verifier()
+
+	_, err = io.Copy(io.MultiWriter(f, verifier), r)
+	f.Close()
+
+	if err != nil {
+		m.log.Error().Err(err).Str("repo", repo).Str("digest", d.String()).Msg("unable to copy blob")
+		return false, err
+	}
+
+	if !verifier.Verified() {
+		m.log.Error().Str("repo", repo).Str("digest", d.String()).Msg("blob doesn't match its digest")
+		return false, errors.ErrBadBlobDigest
+	}
+
+	if err := os.Rename(f.Name(), dst); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// exportCache writes the dedupe cache db, if any, to path, returning whether there was one.
+func (m *Manager) exportCache(path string) (bool, error) {
+	export := func(w io.Writer) error { return storage.ExportCache(m.rootDir, storage.CacheName, w, m.log) }
+
+	if e, ok := m.is.(cacheExporter); ok {
+		export = e.ExportCache
+	} else if m.rootDir == "" {
+		return false, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return false, err
+	}
+
+	err = export(f)
+	f.Close()
+
+	if err == errors.ErrCacheNotFound {
+		return false, os.Remove(path)
+	}
+
+	if err != nil {
+		m.log.Error().Err(err).Msg("unable to export cache db")
+		return false, err
+	}
+
+	return true, nil
+}
+
+// exportSearchDB copies the search extension's db, if any, to dir, returning whether there
+// was one. The db is replaced rather than modified by updates, so a copy is consistent.
+func (m *Manager) exportSearchDB(dir string) (bool, error) {
+	if m.rootDir == "" {
+		return false, nil
+	}
+
+	return copyFiles(filepath.Join(m.rootDir, searchDBDir), dir, searchDBFiles)
+}
+
+// List returns the snapshots in a backup directory, oldest first.
+func List(dir string) ([]Snapshot, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(dir, snapshotsDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Snapshot{}, nil
+		}
+
+		return nil, err
+	}
+
+	snapshots := []Snapshot{}
+
+	for _, e := range entries {
+		if !e.IsDir() || e.Name()[0] == '.' {
+			continue
+		}
+
+		s, err := readSnapshot(dir, e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		snapshots = append(snapshots, *s)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ID < snapshots[j].ID })
+
+	return snapshots, nil
+}
+
+func readSnapshot(dir string, id string) (*Snapshot, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, snapshotsDir, id, snapshotFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.ErrSnapshotNotFound
+		}
+
+		return nil, err
+	}
+
+	var s Snapshot
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// Restore restores a snapshot, the latest if id is empty, from a backup directory into a
+// storage root directory, which the registry must not be serving. The repositories of the
+// snapshot are brought back to their state then, and the cache and search dbs replaced by
+// those exported with it; other repositories are left as they are.
+func Restore(dir string, id string, rootDir string, log log.Logger) (*Snapshot, error) {
+	if id == "" {
+		snapshots, err := List(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(snapshots) == 0 {
+			log.Error().Str("dir", dir).Msg("no snapshot to restore")
+			return nil, errors.ErrSnapshotNotFound
+		}
+
+		id = snapshots[len(snapshots)-1].ID
+	}
+
+	snapshot, err := readSnapshot(dir, id)
+	if err != nil {
+		log.Error().Err(err).Str("dir", dir).Str("id", id).Msg("unable to read snapshot")
+		return nil, err
+	}
+
+	is := storage.NewImageStore(rootDir, false, false, storage.Options{}, log)
+	if is == nil {
+		return nil, errors.ErrImgStoreNotFound
+	}
+	defer is.Close()
+
+	for _, r := range snapshot.Repositories {
+		if err := restoreRepo(dir, snapshot.ID, r.Name, r.Blobs, is, rootDir, log); err != nil {
+			return nil, err
+		}
+	}
+
+	if snapshot.Cache {
+		src := filepath.Join(dir, snapshotsDir, snapshot.ID, storage.CacheName+".db")
+		if _, err := copyFiles(filepath.Dir(src), rootDir, []string{filepath.Base(src)}); err != nil {
+			return nil, err
+		}
+
+		// blobs may have been deduped to paths no longer there
+		if _, err := storage.RepairCache(rootDir, storage.CacheName, false, log); err != nil {
+			return nil, err
+		}
+	}
+
+	if snapshot.SearchDB {
+		if _, err := copyFiles(filepath.Join(dir, snapshotsDir, snapshot.ID, searchDBDir),
+			filepath.Join(rootDir, searchDBDir), searchDBFiles); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Info().Str("id", snapshot.ID).Int("repos", len(snapshot.Repositories)).Msg("snapshot restored")
+
+	return snapshot, nil
+}
+
+// restoreRepo copies the blobs of a repository which are missing, then its index.
+func restoreRepo(dir string, id string, repo string, blobs []string, is *storage.ImageStoreLocal,
+	rootDir string, log log.Logger) error {
+	if err := is.InitRepo(repo); err != nil {
+		return err
+	}
+
+	for _, digest := range blobs {
+		if ok, _, err := is.CheckBlob(repo, digest, ""); err == nil && ok {
+			continue
+		}
+
+		f, err := os.Open(blobPath(dir, godigest.Digest(digest)))
+		if err != nil {
+			log.Error().Err(err).Str("repo", repo).Str("digest", digest).Msg("blob missing from backup")
+			return err
+		}
+
+		_, _, err = is.FullBlobUpload(repo, f, digest)
+		f.Close()
+
+		if err != nil {
+			log.Error().Err(err).Str("repo", repo).Str("digest", digest).Msg("unable to restore blob")
+			return err
+		}
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, snapshotsDir, id, reposDir, repo, "index.json"))
+	if err != nil {
+		return err
+	}
+
+	return writeFile(filepath.Join(rootDir, repo, "index.json"), buf)
+}
+
+func blobPath(dir string, d godigest.Digest) string {
+	return filepath.Join(dir, blobsDir, d.Algorithm().String(), d.Encoded())
+}
+
+// writeFile writes a file atomically, creating its directory if needed.
+func writeFile(path string, buf []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path+".tmp", buf, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// copyFiles copies the named files from src to dst, if the first is in src, returning
+// whether it was.
+func copyFiles(src string, dst string, names []string) (bool, error) {
+	if _, err := os.Stat(filepath.Join(src, names[0])); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return false, err
+	}
+
+	for _, name := range names {
+		if err := copyFile(filepath.Join(src, name), filepath.Join(dst, name)); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// copyFile copies a file atomically.
+func copyFile(src string, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(dst+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, r)
+	w.Close()
+
+	if err != nil {
+		os.Remove(dst + ".tmp")
+		return err
+	}
+
+	return os.Rename(dst+".tmp", dst)
+}
+
+func closeReader(r io.Reader) {
+	if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+}
@@ -0,0 +1,133 @@
+package backup_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/backup"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBackup(t *testing.T) {
+	Convey("Back up and restore storage", t, func() {
+		log := log.NewLogger("debug", "")
+
+		rootDir, err := ioutil.TempDir("", "zot-backup-root")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(rootDir)
+
+		dir, err := ioutil.TempDir("", "zot-backup")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		is := storage.NewImageStore(rootDir, false, true, storage.Options{}, log)
+		So(is, ShouldNotBeNil)
+
+		img, err := test.GetRandomImage(64, 2)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "a", "1.0"), ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "b", "1.0"), ShouldBeNil)
+
+		config := &backup.Config{Directory: dir}
+		So(config.Validate(log), ShouldBeNil)
+
+		m := backup.NewManager(config, is, rootDir, log)
+
+		first, err := m.Backup()
+		So(err, ShouldBeNil)
+		So(first.Repositories, ShouldHaveLength, 2)
+		So(first.Repositories[0].Name, ShouldEqual, "a")
+		So(first.Repositories[0].Blobs, ShouldHaveLength, 4) // manifest, config and layers
+		So(first.Copied, ShouldEqual, 4)
+		So(first.Cache, ShouldBeTrue)
+
+		other, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(other, is, "a", "2.0"), ShouldBeNil)
+
+		digest, err := img.Digest()
+		So(err, ShouldBeNil)
+		So(is.DeleteImageManifest("b", digest.String()), ShouldBeNil)
+
+		// only what's new is copied
+		second, err := m.Backup()
+		So(err, ShouldBeNil)
+		So(second.Copied, ShouldEqual, 3)
+
+		snapshots, err := m.Snapshots()
+		So(err, ShouldBeNil)
+		So(snapshots, ShouldHaveLength, 2)
+		So(snapshots[0].ID, ShouldEqual, first.ID)
+		So(snapshots[1].ID, ShouldEqual, second.ID)
+
+		So(is.Close(), ShouldBeNil)
+
+		Convey("Restore a point in time", func() {
+			restoreDir, err := ioutil.TempDir("", "zot-backup-restore")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(restoreDir)
+
+			restored, err := backup.Restore(dir, first.ID, restoreDir, log)
+			So(err, ShouldBeNil)
+			So(restored.ID, ShouldEqual, first.ID)
+
+			is := storage.NewImageStore(restoreDir, false, true, storage.Options{}, log)
+			So(is, ShouldNotBeNil)
+			defer is.Close()
+
+			for _, repo := range []string{"a", "b"} {
+				_, d, _, err := is.GetImageManifest(repo, "1.0")
+				So(err, ShouldBeNil)
+				So(d, ShouldEqual, digest.String())
+			}
+
+			_, _, _, err = is.GetImageManifest("a", "2.0")
+			So(err, ShouldEqual, errors.ErrManifestNotFound)
+
+			problems, err := storage.CheckImageStore(is, log)
+			So(err, ShouldBeNil)
+			So(problems, ShouldBeEmpty)
+		})
+
+		Convey("Restore the latest snapshot", func() {
+			So(os.RemoveAll(path.Join(rootDir, "a")), ShouldBeNil)
+
+			restored, err := backup.Restore(dir, "", rootDir, log)
+			So(err, ShouldBeNil)
+			So(restored.ID, ShouldEqual, second.ID)
+
+			is := storage.NewImageStore(rootDir, false, true, storage.Options{}, log)
+			So(is, ShouldNotBeNil)
+			defer is.Close()
+
+			tags, err := is.GetImageTags("a")
+			So(err, ShouldBeNil)
+			So(tags, ShouldResemble, []string{"1.0", "2.0"})
+		})
+
+		Convey("Restore a missing snapshot", func() {
+			_, err := backup.Restore(dir, "missing", rootDir, log)
+			So(err, ShouldEqual, errors.ErrSnapshotNotFound)
+
+			empty, err := ioutil.TempDir("", "zot-backup-empty")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(empty)
+
+			_, err = backup.Restore(empty, "", rootDir, log)
+			So(err, ShouldEqual, errors.ErrSnapshotNotFound)
+		})
+	})
+
+	Convey("Validate backup configuration", t, func() {
+		log := log.NewLogger("debug", "")
+
+		So((&backup.Config{}).Validate(log), ShouldEqual, errors.ErrBadConfig)
+		So((&backup.Config{Directory: "/tmp", Interval: -1}).Validate(log), ShouldEqual, errors.ErrBadConfig)
+	})
+}
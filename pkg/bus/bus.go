@@ -0,0 +1,111 @@
+// Package bus carries the events of an image store in-process, to the modules reacting to
+// them, so that those needn't wrap the store or know about each other.
+package bus
+
+import (
+	"sync"
+
+	"github.com/anuvu/zot/pkg/log"
+)
+
+// EventType is what happened in the store.
+type EventType string
+
+const (
+	ManifestPushed  EventType = "manifest.pushed"
+	ManifestDeleted EventType = "manifest.deleted"
+	TagDeleted      EventType = "tag.deleted"
+	BlobAdded       EventType = "blob.added"
+	ImageScanned    EventType = "image.scanned" // by scanning on push
+)
+
+// Event describes a change to the contents of a repository, or a finding about them.
+type Event struct {
+	Type            EventType `json:"type"`
+	Repository      string    `json:"repository"`
+	Reference       string    `json:"reference,omitempty"` // tag or digest a manifest was pushed or deleted by
+	Digest          string    `json:"digest,omitempty"`
+	MediaType       string    `json:"mediaType,omitempty"`
+	Size            int64     `json:"size,omitempty"`
+	Vulnerabilities int       `json:"vulnerabilities,omitempty"` // found scanning an image
+}
+
+// Handler reacts to events. Handlers are called synchronously, so those with much to do
+// should hand it off to a worker of their own.
+type Handler func(Event)
+
+type subscription struct {
+	id      int
+	handler Handler
+	types   map[EventType]bool // all if empty
+}
+
+// Bus publishes events to the handlers subscribed to them.
+type Bus struct {
+	log log.Logger
+
+	lock          sync.RWMutex
+	nextID        int
+	subscriptions []subscription
+}
+
+// New returns a bus without any subscriptions.
+func New(log log.Logger) *Bus {
+	return &Bus{log: log}
+}
+
+// Subscribe calls handler with the events of the given types, all if none, published from
+// now on. It returns a function ending the subscription.
+func (b *Bus) Subscribe(handler Handler, types ...EventType) func() {
+	s := subscription{handler: handler, types: map[EventType]bool{}}
+
+	for _, t := range types {
+		s.types[t] = true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	s.id = b.nextID
+	b.nextID++
+	b.subscriptions = append(b.subscriptions, s)
+
+	return func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		for i, sub := range b.subscriptions {
+			if sub.id == s.id {
+				b.subscriptions = append(b.subscriptions[:i:i], b.subscriptions[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Publish calls the handlers subscribed to the type of event, in the order they subscribed,
+// returning once all have. A handler panicking doesn't keep the others from being called.
+func (b *Bus) Publish(event Event) {
+	b.lock.RLock()
+	subscriptions := b.subscriptions
+	b.lock.RUnlock()
+
+	for _, s := range subscriptions {
+		if len(s.types) > 0 && !s.types[event.Type] {
+			continue
+		}
+
+		b.call(s.handler, event)
+	}
+}
+
+func (b *Bus) call(handler Handler, event Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			b.log.Error().Interface("panic", r).Str("type", string(event.Type)).Str("repo", event.Repository).
+				Msg("event handler failed")
+		}
+	}()
+
+	handler(event)
+}
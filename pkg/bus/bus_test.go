@@ -0,0 +1,79 @@
+package bus_test
+
+import (
+	"testing"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/bus"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBus(t *testing.T) {
+	Convey("Publish events to subscribers", t, func() {
+		b := bus.New(log.NewLogger("debug", ""))
+
+		all := []bus.Event{}
+		pushed := []bus.Event{}
+
+		b.Subscribe(func(e bus.Event) { all = append(all, e) })
+		b.Subscribe(func(e bus.Event) { panic("broken") }, bus.BlobAdded)
+		unsubscribe := b.Subscribe(func(e bus.Event) { pushed = append(pushed, e) }, bus.ManifestPushed)
+
+		b.Publish(bus.Event{Type: bus.BlobAdded, Repository: "a"})
+		b.Publish(bus.Event{Type: bus.ManifestPushed, Repository: "a"})
+
+		unsubscribe()
+		b.Publish(bus.Event{Type: bus.ManifestPushed, Repository: "b"})
+
+		So(all, ShouldHaveLength, 3)
+		So(pushed, ShouldResemble, []bus.Event{{Type: bus.ManifestPushed, Repository: "a"}})
+	})
+
+	Convey("Publish the changes made to a store", t, func() {
+		log := log.NewLogger("debug", "")
+		b := bus.New(log)
+
+		events := []bus.Event{}
+		b.Subscribe(func(e bus.Event) { events = append(events, e) })
+
+		is := bus.NewImageStore(storage.NewImageStoreMem(log), b)
+
+		img, err := test.GetRandomImage(16, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "a", "1.0"), ShouldBeNil)
+
+		digest, err := img.Digest()
+		So(err, ShouldBeNil)
+
+		mblob, err := img.ManifestBlob()
+		So(err, ShouldBeNil)
+
+		// config, layer and manifest
+		So(events, ShouldHaveLength, 3)
+		So(events[0].Type, ShouldEqual, bus.BlobAdded)
+		So(events[1].Type, ShouldEqual, bus.BlobAdded)
+		So(events[1].Size, ShouldEqual, 16)
+		So(events[2], ShouldResemble, bus.Event{Type: bus.ManifestPushed, Repository: "a", Reference: "1.0",
+			Digest: digest.String(), MediaType: ispec.MediaTypeImageManifest, Size: int64(len(mblob))})
+
+		_, err = is.PutImageManifest("a", "latest", ispec.MediaTypeImageManifest, mblob)
+		So(err, ShouldBeNil)
+
+		So(is.DeleteImageTag("a", "1.0"), ShouldBeNil)
+		So(events[4], ShouldResemble, bus.Event{Type: bus.TagDeleted, Repository: "a", Reference: "1.0",
+			Digest: digest.String(), MediaType: ispec.MediaTypeImageManifest})
+
+		So(is.DeleteImageManifest("a", digest.String()), ShouldBeNil)
+		So(events[5], ShouldResemble, bus.Event{Type: bus.ManifestDeleted, Repository: "a",
+			Reference: digest.String(), Digest: digest.String(), MediaType: ispec.MediaTypeImageManifest,
+			Size: int64(len(mblob))})
+
+		// nothing's published when a change fails
+		So(is.DeleteImageManifest("a", digest.String()), ShouldEqual, errors.ErrManifestNotFound)
+		So(events, ShouldHaveLength, 6)
+	})
+}
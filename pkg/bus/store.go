@@ -0,0 +1,97 @@
+package bus
+
+import (
+	"io"
+
+	"github.com/anuvu/zot/pkg/storage"
+)
+
+// ImageStore publishes the changes made to the wrapped store, once they succeed.
+type ImageStore struct {
+	storage.ImageStore
+	bus *Bus
+}
+
+// NewImageStore returns a store publishing the changes made to is on bus.
+func NewImageStore(is storage.ImageStore, bus *Bus) *ImageStore {
+	return &ImageStore{ImageStore: is, bus: bus}
+}
+
+// PutImageManifest adds a manifest, publishing it as pushed.
+func (is *ImageStore) PutImageManifest(repo string, reference string, mediaType string,
+	body []byte) (string, error) {
+	digest, err := is.ImageStore.PutImageManifest(repo, reference, mediaType, body)
+	if err != nil {
+		return digest, err
+	}
+
+	is.bus.Publish(Event{Type: ManifestPushed, Repository: repo, Reference: reference, Digest: digest,
+		MediaType: mediaType, Size: int64(len(body))})
+
+	return digest, nil
+}
+
+// DeleteImageManifest removes a manifest, publishing it as deleted.
+func (is *ImageStore) DeleteImageManifest(repo string, reference string) error {
+	// look up what's about to be deleted, for subscribers to know even if given a tag
+	body, digest, mediaType, _ := is.ImageStore.GetImageManifest(repo, reference)
+
+	if err := is.ImageStore.DeleteImageManifest(repo, reference); err != nil {
+		return err
+	}
+
+	is.bus.Publish(Event{Type: ManifestDeleted, Repository: repo, Reference: reference, Digest: digest,
+		MediaType: mediaType, Size: int64(len(body))})
+
+	return nil
+}
+
+// DeleteImageTag removes a tag, publishing it as deleted.
+func (is *ImageStore) DeleteImageTag(repo string, tag string) error {
+	_, digest, mediaType, _ := is.ImageStore.GetImageManifest(repo, tag)
+
+	if err := is.ImageStore.DeleteImageTag(repo, tag); err != nil {
+		return err
+	}
+
+	is.bus.Publish(Event{Type: TagDeleted, Repository: repo, Reference: tag, Digest: digest, MediaType: mediaType})
+
+	return nil
+}
+
+// FinishBlobUpload completes an upload, publishing its blob as added.
+func (is *ImageStore) FinishBlobUpload(repo string, uuid string, body io.Reader, digest string) error {
+	if err := is.ImageStore.FinishBlobUpload(repo, uuid, body, digest); err != nil {
+		return err
+	}
+
+	_, size, _ := is.ImageStore.CheckBlob(repo, digest, "")
+
+	is.bus.Publish(Event{Type: BlobAdded, Repository: repo, Digest: digest, Size: size})
+
+	return nil
+}
+
+// FullBlobUpload adds a blob in one go, publishing it as added.
+func (is *ImageStore) FullBlobUpload(repo string, body io.Reader, digest string) (string, int64, error) {
+	uuid, size, err := is.ImageStore.FullBlobUpload(repo, body, digest)
+	if err != nil {
+		return uuid, size, err
+	}
+
+	is.bus.Publish(Event{Type: BlobAdded, Repository: repo, Digest: digest, Size: size})
+
+	return uuid, size, nil
+}
+
+// MountBlob adds a blob stored in another repository, publishing it as added if it was.
+func (is *ImageStore) MountBlob(repo string, digest string) (bool, int64, error) {
+	ok, size, err := is.ImageStore.MountBlob(repo, digest)
+	if err != nil || !ok {
+		return ok, size, err
+	}
+
+	is.bus.Publish(Event{Type: BlobAdded, Repository: repo, Digest: digest, Size: size})
+
+	return true, size, nil
+}
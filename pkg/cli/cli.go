@@ -8,4 +8,8 @@ func enableCli(rootCmd *cobra.Command) {
 	rootCmd.AddCommand(NewConfigCommand())
 	rootCmd.AddCommand(NewImageCommand(NewSearchService()))
 	rootCmd.AddCommand(NewCveCommand(NewSearchService()))
+	rootCmd.AddCommand(NewScanCommand(NewSearchService()))
+	rootCmd.AddCommand(NewTokenCommand())
+	rootCmd.AddCommand(newCompleteConfigsCommand())
+	rootCmd.AddCommand(newCompleteReposCommand())
 }
@@ -8,6 +8,7 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -46,6 +47,37 @@ func makeGETRequest(url, username, password string, verifyTLS bool, resultsPtr i
 	return doHTTPRequest(req, verifyTLS, resultsPtr)
 }
 
+// makeJSONRequest sends body, if any, as JSON to url with method, decoding the response into
+// resultsPtr, if any.
+func makeJSONRequest(method, url, username, password string, verifyTLS bool, body interface{},
+	resultsPtr interface{}) error {
+	var reader io.Reader
+
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+
+		reader = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(username, password)
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	_, err = doHTTPRequest(req, verifyTLS, resultsPtr)
+
+	return err
+}
+
 func makeGraphQLRequest(url, query, username,
 	password string, verifyTLS bool, resultsPtr interface{}) error {
 	req, err := http.NewRequest("GET", url, bytes.NewBufferString(query))
@@ -81,16 +113,24 @@ func doHTTPRequest(req *http.Request, verifyTLS bool, resultsPtr interface{}) (h
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
 		if resp.StatusCode == http.StatusUnauthorized {
 			return nil, zotErrors.ErrUnauthorizedAccess
 		}
 
 		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		if len(bodyBytes) == 0 {
+			return nil, errors.New(resp.Status) //nolint: goerr113
+		}
 
 		return nil, errors.New(string(bodyBytes)) //nolint: goerr113
 	}
 
+	// e.g. no content
+	if resultsPtr == nil {
+		return resp.Header, nil
+	}
+
 	if err := json.NewDecoder(resp.Body).Decode(resultsPtr); err != nil {
 		return nil, err
 	}
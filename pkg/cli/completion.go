@@ -0,0 +1,146 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// configNameArgAnnotation marks commands taking a CLI config name as their first argument.
+const configNameArgAnnotation = "zot_config_name_arg"
+
+// bashCompletionFunc completes the config-name argument of zli commands, and the image names
+// of their flags, by calling back into the binary. See newCompleteConfigsCommand.
+const bashCompletionFunc = `__zot_complete_repos()
+{
+    local out
+    if out=$(${words[0]} __complete-repos "${nouns[0]}" 2>/dev/null); then
+        COMPREPLY=( $(compgen -W "${out}" -- "$cur") )
+    fi
+}
+
+__zot_custom_func()
+{
+    local out
+    case ${last_command} in
+        zot_images | zot_cve | zot_scan | zot_config)
+            if [[ ${#nouns[@]} -eq 0 ]] && out=$(${words[0]} __complete-configs 2>/dev/null); then
+                COMPREPLY=( $(compgen -W "${out}" -- "$cur") )
+            fi
+            ;;
+    esac
+}
+`
+
+// NewCompletionCommand returns the command generating shell completion scripts.
+func NewCompletionCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "completion bash|zsh|fish|powershell",
+		Short: "Generate shell completion scripts",
+		Long: `Generate a completion script for the given shell, e.g. for bash:
+
+  source <(zot completion bash)
+
+Names of CLI configs, and of the images they point to, are completed in bash and fish`,
+		ValidArgs: []string{"bash", "zsh", "fish", "powershell"},
+		Args:      cobra.ExactValidArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			out := cmd.OutOrStdout()
+
+			switch args[0] {
+			case "bash":
+				return cmd.Root().GenBashCompletion(out)
+			case "zsh":
+				return cmd.Root().GenZshCompletion(out)
+			case "fish":
+				return genFishCompletion(cmd.Root(), out)
+			case "powershell":
+				return cmd.Root().GenPowerShellCompletion(out)
+			}
+
+			return errors.ErrInvalidArgs
+		},
+	}
+}
+
+// genFishCompletion writes a fish completion script for the subcommands and flags of root,
+// since cobra doesn't generate one.
+func genFishCompletion(root *cobra.Command, w io.Writer) error {
+	name := root.Name()
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# fish completion for %s\n\n", name)
+	fmt.Fprintf(&b, `function __%[1]s_complete_repos
+    set -l args (commandline -opc)
+    for arg in $args[3..-1]
+        if not string match -q -- '-*' $arg
+            %[1]s __complete-repos $arg 2>/dev/null
+            return
+        end
+    end
+end
+
+`, name)
+	var walk func(cmd *cobra.Command, path []string)
+
+	walk = func(cmd *cobra.Command, path []string) {
+		cond := "__fish_use_subcommand"
+		if len(path) > 0 {
+			cond = "__fish_seen_subcommand_from " + path[len(path)-1]
+		}
+
+		for _, sub := range cmd.Commands() {
+			if sub.Hidden || !sub.IsAvailableCommand() {
+				continue
+			}
+
+			fmt.Fprintf(&b, "complete -c %s -n '%s' -a %s -d %s\n", name, cond, sub.Name(), fishQuote(sub.Short))
+			walk(sub, append(path, sub.Name()))
+		}
+
+		if len(path) == 0 {
+			return
+		}
+
+		cmd.LocalNonPersistentFlags().VisitAll(func(f *pflag.Flag) {
+			if f.Hidden || f.Name == "help" {
+				return
+			}
+
+			fmt.Fprintf(&b, "complete -c %s -n '%s' -l %s", name, cond, f.Name)
+
+			if f.Shorthand != "" {
+				fmt.Fprintf(&b, " -s %s", f.Shorthand)
+			}
+
+			if f.Value.Type() != "bool" {
+				fmt.Fprint(&b, " -r")
+			}
+
+			if custom, ok := f.Annotations[cobra.BashCompCustom]; ok && len(custom) > 0 {
+				fmt.Fprintf(&b, " -a '(__%s_complete_repos)'", name)
+			}
+
+			fmt.Fprintf(&b, " -d %s\n", fishQuote(f.Usage))
+		})
+
+		if cmd.Annotations[configNameArgAnnotation] != "" {
+			fmt.Fprintf(&b, "complete -c %s -n '%s' -a '(%s __complete-configs 2>/dev/null)'\n", name, cond, name)
+		}
+	}
+
+	walk(root, nil)
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), "'", `\'`) + "'"
+}
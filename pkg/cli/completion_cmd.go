@@ -0,0 +1,112 @@
+// +build extended
+
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// completions are computed while the user waits at the prompt.
+const completionTimeout = 2 * time.Second
+
+// newCompleteConfigsCommand returns the hidden command listing the names of the CLI configs,
+// called back by the shell completion scripts.
+func newCompleteConfigsCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:           "__complete-configs",
+		Hidden:        true,
+		Args:          cobra.NoArgs,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return err
+			}
+
+			configs, err := getConfigMapFromFile(path.Join(home, ".zot"))
+			if err != nil {
+				if errors.Is(err, ErrEmptyJSON) {
+					return nil
+				}
+
+				return err
+			}
+
+			for _, val := range configs {
+				if configMap, ok := val.(map[string]interface{}); ok {
+					fmt.Fprintln(cmd.OutOrStdout(), configMap[nameKey])
+				}
+			}
+
+			return nil
+		},
+	}
+}
+
+// newCompleteReposCommand returns the hidden command listing the repositories of the server
+// a CLI config points to, called back by the shell completion scripts. Servers requiring
+// credentials can't be queried.
+func newCompleteReposCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:           "__complete-repos <config-name>",
+		Hidden:        true,
+		Args:          cobra.ExactArgs(1),
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return err
+			}
+
+			configPath := path.Join(home, ".zot")
+
+			servURL, err := getConfigValue(configPath, args[0], "url")
+			if err != nil {
+				return err
+			}
+
+			verifyTLS, err := parseBooleanConfig(configPath, args[0], verifyTLSConfig)
+			if err != nil {
+				return err
+			}
+
+			client := createHTTPClient(verifyTLS)
+			client.Timeout = completionTimeout
+
+			resp, err := client.Get(strings.TrimSuffix(servURL, "/") + "/v2/_catalog")
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("%s: %s", servURL, resp.Status) //nolint: goerr113
+			}
+
+			var catalog struct {
+				Repositories []string `json:"repositories"`
+			}
+
+			if err := json.NewDecoder(resp.Body).Decode(&catalog); err != nil {
+				return err
+			}
+
+			for _, repo := range catalog.Repositories {
+				fmt.Fprintln(cmd.OutOrStdout(), repo)
+			}
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,75 @@
+// +build extended
+
+package cli //nolint:testpackage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/anuvu/zot/pkg/api"
+	"github.com/spf13/cobra"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCompletionCallbacks(t *testing.T) {
+	Convey("Complete config and repository names", t, func() {
+		dir, err := ioutil.TempDir("", "zot-completion-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		repoDir := path.Join(dir, "repo")
+		So(os.MkdirAll(path.Join(repoDir, "blobs"), 0755), ShouldBeNil)
+		So(ioutil.WriteFile(path.Join(repoDir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0600),
+			ShouldBeNil)
+		So(ioutil.WriteFile(path.Join(repoDir, "index.json"), []byte(`{"schemaVersion":2,"manifests":[]}`), 0600),
+			ShouldBeNil)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		url := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		configPath := makeConfigFile(`{"configs":[{"_name":"local","url":"` + url + `","verify-tls":true},` +
+			`{"_name":"down","url":"http://127.0.0.1:1","verify-tls":true}]}`)
+		defer os.Remove(configPath)
+
+		run := func(cmd *cobra.Command, args ...string) (string, error) {
+			buff := bytes.NewBufferString("")
+			cmd.SetOut(buff)
+			cmd.SetErr(ioutil.Discard)
+			cmd.SetArgs(args)
+			err := cmd.Execute()
+
+			return buff.String(), err
+		}
+
+		out, err := run(newCompleteConfigsCommand())
+		So(err, ShouldBeNil)
+		So(out, ShouldEqual, "local\ndown\n")
+
+		out, err = run(newCompleteReposCommand(), "local")
+		So(err, ShouldBeNil)
+		So(out, ShouldEqual, "repo\n")
+
+		_, err = run(newCompleteReposCommand(), "down")
+		So(err, ShouldNotBeNil)
+
+		_, err = run(newCompleteReposCommand(), "unknown")
+		So(err, ShouldNotBeNil)
+
+		So(ioutil.WriteFile(configPath, []byte{}, 0600), ShouldBeNil)
+		out, err = run(newCompleteConfigsCommand())
+		So(err, ShouldBeNil)
+		So(out, ShouldBeEmpty)
+	})
+}
@@ -1,3 +1,4 @@
+//go:build extended
 // +build extended
 
 package cli
@@ -25,11 +26,12 @@ func NewConfigCommand() *cobra.Command {
 	var isReset bool
 
 	var configCmd = &cobra.Command{
-		Use:     "config <config-name> [variable] [value]",
-		Example: examples,
-		Short:   "Configure zot CLI",
-		Long:    `Configure default parameters for CLI`,
-		Args:    cobra.ArbitraryArgs,
+		Use:         "config <config-name> [variable] [value]",
+		Example:     examples,
+		Short:       "Configure zot CLI",
+		Long:        `Configure default parameters for CLI`,
+		Args:        cobra.ArbitraryArgs,
+		Annotations: map[string]string{configNameArgAnnotation: "true"},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			home, err := os.UserHomeDir()
 			if err != nil {
@@ -93,6 +95,7 @@ func NewConfigCommand() *cobra.Command {
 	configCmd.Flags().BoolVar(&isReset, "reset", false, "Reset a variable value")
 	configCmd.SetUsageTemplate(configCmd.UsageTemplate() + supportedOptions)
 	configCmd.AddCommand(NewConfigAddCommand())
+	configCmd.AddCommand(NewConfigDumpCommand())
 
 	return configCmd
 }
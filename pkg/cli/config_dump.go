@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/api"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+// NewConfigDumpCommand returns the command printing the effective server configuration.
+func NewConfigDumpCommand() *cobra.Command {
+	var outFmt string
+
+	configDumpCmd := &cobra.Command{
+		Use:   "dump [config]",
+		Short: "Print the effective server configuration",
+		Long: `Print the server configuration in effect, i.e. the defaults overridden
+by the given config file (and any presets and includes it uses), with secrets redacted`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config := api.NewConfig()
+
+			if len(args) > 0 {
+				if err := LoadConfiguration(config, args[0]); err != nil {
+					return err
+				}
+			}
+
+			var (
+				buf []byte
+				err error
+			)
+
+			switch outFmt {
+			case "", "json":
+				buf, err = json.MarshalIndent(config.Sanitize(), "", "  ")
+			case "yaml", "yml":
+				buf, err = yaml.Marshal(config.Sanitize())
+			default:
+				return errors.ErrInvalidArgs
+			}
+
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintln(cmd.OutOrStdout(), string(buf))
+
+			return nil
+		},
+	}
+
+	configDumpCmd.Flags().StringVarP(&outFmt, "output", "o", "json", "Output format: json, yaml")
+
+	return configDumpCmd
+}
@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// nolint: gochecknoglobals
+var keyIndexRegexp = regexp.MustCompile(`\[\d+\]$`)
+
+// locateConfigKey returns the line on which a dotted key path, as reported by mapstructure
+// (e.g. "http.auth.htpasswd.paht"), is set in a JSON, YAML or TOML config file, or 0 if
+// it can't be found. Each path element is searched for after its parent.
+func locateConfigKey(path string, key string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	elems := strings.Split(key, ".")
+	elem := 0
+	re := keyRegexp(elems[elem])
+	line := 0
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line++
+
+		// nested keys may be set on the same line, as in {"http":{"port":"8080"}}
+		text := scanner.Text()
+		for loc := re.FindStringIndex(text); loc != nil; loc = re.FindStringIndex(text) {
+			elem++
+			if elem == len(elems) {
+				return line
+			}
+
+			re = keyRegexp(elems[elem])
+			text = text[loc[1]:]
+		}
+	}
+
+	return 0
+}
+
+// keyRegexp matches a key being set, quoted or not, ignoring any slice index.
+func keyRegexp(elem string) *regexp.Regexp {
+	name := keyIndexRegexp.ReplaceAllString(elem, "")
+
+	return regexp.MustCompile(`(?i)(^|[\s{,"'\[])` + regexp.QuoteMeta(name) + `["']?\s*[:=]`)
+}
@@ -0,0 +1,74 @@
+package cli //nolint:testpackage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLocateConfigKey(t *testing.T) {
+	Convey("Locate config keys", t, func() {
+		dir, err := ioutil.TempDir("", "zot-config-keys-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		writeFile := func(name string, content string) string {
+			p := path.Join(dir, name)
+			So(ioutil.WriteFile(p, []byte(content), 0600), ShouldBeNil)
+
+			return p
+		}
+
+		Convey("in json", func() {
+			p := writeFile("zot.json", `{
+  "storage": {"rootDirectory": "/tmp/zot"},
+  "http": {
+    "path": "/",
+    "auth": {
+      "htpasswd": {
+        "paht": "/etc/htpasswd"
+      }
+    },
+    "ratelimit": {"methods": [{"method": "GET", "rat": 1}]}
+  }
+}`)
+			So(locateConfigKey(p, "http.auth.htpasswd.paht"), ShouldEqual, 7)
+			So(locateConfigKey(p, "http.ratelimit.methods[0].rat"), ShouldEqual, 10)
+			So(locateConfigKey(p, "http.path"), ShouldEqual, 4)
+			So(locateConfigKey(p, "http.missing"), ShouldEqual, 0)
+			So(locateConfigKey(path.Join(dir, "missing.json"), "http"), ShouldEqual, 0)
+		})
+
+		Convey("in yaml", func() {
+			p := writeFile("zot.yaml", `storage:
+  rootDirectory: /tmp/zot
+http:
+  Auth:
+    htpasswd:
+      paht: /etc/htpasswd
+`)
+			So(locateConfigKey(p, "http.auth.htpasswd.paht"), ShouldEqual, 6)
+		})
+	})
+
+	Convey("Report unknown keys", t, func() {
+		dir, err := ioutil.TempDir("", "zot-config-keys-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		So(ioutil.WriteFile(path.Join(dir, "auth.json"), []byte(`{"http":{"auth":{"htpasswd":{"paht":"x"}}}}`),
+			0600), ShouldBeNil)
+		p := path.Join(dir, "zot.json")
+		So(ioutil.WriteFile(p, []byte(`{"include":["auth.json"], "storage":{"rootDirectory":"/tmp/zot"}}`),
+			0600), ShouldBeNil)
+
+		_, files, err := readConfigFile(p, nil)
+		So(err, ShouldBeNil)
+		So(files, ShouldResemble, []string{path.Join(dir, "auth.json"), p})
+		So(locateConfigKey(files[0], "http.auth.htpasswd.paht"), ShouldEqual, 1)
+		So(locateConfigKey(files[1], "http.auth.htpasswd.paht"), ShouldEqual, 0)
+	})
+}
@@ -1,3 +1,4 @@
+//go:build extended
 // +build extended
 
 package cli
@@ -21,9 +22,10 @@ func NewCveCommand(searchService SearchService) *cobra.Command {
 	var isSpinner, verifyTLS, fixedFlag bool
 
 	var cveCmd = &cobra.Command{
-		Use:   "cve [config-name]",
-		Short: "Lookup CVEs in images hosted on zot",
-		Long:  `List CVEs (Common Vulnerabilities and Exposures) of images hosted on a zot instance`,
+		Use:         "cve [config-name]",
+		Short:       "Lookup CVEs in images hosted on zot",
+		Long:        `List CVEs (Common Vulnerabilities and Exposures) of images hosted on a zot instance`,
+		Annotations: map[string]string{configNameArgAnnotation: "true"},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			home, err := os.UserHomeDir()
 			if err != nil {
@@ -111,6 +113,8 @@ func setupCveFlags(cveCmd *cobra.Command, variables cveFlagVariables) {
 		" JSON and YAML format return all info for CVEs")
 
 	cveCmd.Flags().BoolVar(variables.fixedFlag, "fixed", false, "List tags which have fixed a CVE")
+
+	_ = cveCmd.MarkFlagCustom("image", "__zot_complete_repos")
 }
 
 type cveFlagVariables struct {
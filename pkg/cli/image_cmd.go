@@ -1,3 +1,4 @@
+//go:build extended
 // +build extended
 
 package cli
@@ -21,9 +22,10 @@ func NewImageCommand(searchService SearchService) *cobra.Command {
 	var isSpinner, verifyTLS bool
 
 	var imageCmd = &cobra.Command{
-		Use:   "images [config-name]",
-		Short: "List hosted images",
-		Long:  `List images hosted on zot`,
+		Use:         "images [config-name]",
+		Short:       "List hosted images",
+		Long:        `List images hosted on zot`,
+		Annotations: map[string]string{configNameArgAnnotation: "true"},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			home, err := os.UserHomeDir()
 			if err != nil {
@@ -113,6 +115,8 @@ func setupImageFlags(imageCmd *cobra.Command, searchImageParams map[string]*stri
 	imageCmd.Flags().StringVar(servURL, "url", "", "Specify zot server URL if config-name is not mentioned")
 	imageCmd.Flags().StringVarP(user, "user", "u", "", `User Credentials of zot server in "username:password" format`)
 	imageCmd.Flags().StringVarP(outputFormat, "output", "o", "", "Specify output format [text/json/yaml]")
+
+	_ = imageCmd.MarkFlagCustom("name", "__zot_complete_repos")
 }
 
 func searchImage(searchConfig searchConfig) error {
@@ -523,6 +523,36 @@ func (service mockService) getCveByImage(ctx context.Context, config searchConfi
 	c <- stringResult{str, nil}
 }
 
+func (service mockService) getCVEListForImage(config searchConfig, username, password,
+	imageName string) (cveListForImage, error) {
+	if imageName == "missing:tag" {
+		return cveListForImage{}, zotErrors.ErrManifestNotFound
+	}
+
+	return cveListForImage{
+		Tag: imageName,
+		CVEList: []cve{
+			{
+				ID:       "lowCVEID",
+				Title:    "Title of a low CVE",
+				Severity: "LOW",
+			},
+			{
+				ID:       "dummyCVEID",
+				Title:    "Title of that CVE",
+				Severity: "HIGH",
+				PackageList: []packageList{
+					{
+						Name:             "packagename",
+						FixedVersion:     "fixedver",
+						InstalledVersion: "installedver",
+					},
+				},
+			},
+		},
+	}, nil
+}
+
 func (service mockService) getImagesByCveID(ctx context.Context, config searchConfig, username, password, cveID string,
 	c chan stringResult, wg *sync.WaitGroup) {
 	service.getImageByName(ctx, config, username, password, "anImage", c, wg)
@@ -5,4 +5,11 @@ package cli
 import "github.com/spf13/cobra"
 
 func enableCli(rootCmd *cobra.Command) {
+	// the CLI client is not included, only the server configuration commands
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the server configuration",
+	}
+	configCmd.AddCommand(NewConfigDumpCommand())
+	rootCmd.AddCommand(configCmd)
 }
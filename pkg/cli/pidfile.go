@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// writePidfile records the process ID in path. A pidfile left behind by a process which
+// is no longer running is replaced, while one belonging to a running process is an error.
+func writePidfile(path string) error {
+	buf, err := ioutil.ReadFile(path)
+
+	switch {
+	case err == nil:
+		pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+		if err == nil && processExists(pid) {
+			log.Error().Str("pidfile", path).Int("pid", pid).Msg("pidfile is in use by a running process")
+			return errors.ErrPidfileInUse
+		}
+
+		log.Warn().Str("pidfile", path).Msg("removing stale pidfile")
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	// O_EXCL so that we don't race with another instance starting up
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644) //nolint: gosec
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(f, "%d\n", os.Getpid()); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// removePidfile removes the pidfile at path if it is still ours.
+func removePidfile(path string) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(buf))); err != nil || pid != os.Getpid() {
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		log.Warn().Err(err).Str("pidfile", path).Msg("unable to remove pidfile")
+	}
+}
+
+// processExists reports whether a process other than this one is running with the given pid.
+func processExists(pid int) bool {
+	// a restarted container can get the same pid as its previous incarnation
+	if pid <= 0 || pid == os.Getpid() {
+		return false
+	}
+
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	err = p.Signal(syscall.Signal(0))
+
+	return err == nil || err == syscall.EPERM
+}
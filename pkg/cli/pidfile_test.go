@@ -0,0 +1,66 @@
+package cli //nolint:testpackage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	zotErrors "github.com/anuvu/zot/errors"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPidfile(t *testing.T) {
+	Convey("Test pidfile", t, func() {
+		dir, err := ioutil.TempDir("", "zot-pidfile-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		pidfile := path.Join(dir, "zot.pid")
+
+		readPid := func() int {
+			buf, err := ioutil.ReadFile(pidfile)
+			So(err, ShouldBeNil)
+			pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+			So(err, ShouldBeNil)
+
+			return pid
+		}
+
+		Convey("write and remove", func() {
+			So(writePidfile(pidfile), ShouldBeNil)
+			So(readPid(), ShouldEqual, os.Getpid())
+
+			removePidfile(pidfile)
+			_, err := os.Stat(pidfile)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("in use by a running process", func() {
+			So(ioutil.WriteFile(pidfile, []byte(fmt.Sprintf("%d\n", os.Getppid())), 0600), ShouldBeNil)
+			So(writePidfile(pidfile), ShouldEqual, zotErrors.ErrPidfileInUse)
+
+			// not ours, so left alone
+			removePidfile(pidfile)
+			So(readPid(), ShouldEqual, os.Getppid())
+		})
+
+		Convey("stale", func() {
+			So(ioutil.WriteFile(pidfile, []byte("garbage"), 0600), ShouldBeNil)
+			So(writePidfile(pidfile), ShouldBeNil)
+			So(readPid(), ShouldEqual, os.Getpid())
+
+			So(ioutil.WriteFile(pidfile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0600), ShouldBeNil)
+			So(writePidfile(pidfile), ShouldBeNil)
+			So(readPid(), ShouldEqual, os.Getpid())
+		})
+
+		Convey("unwritable", func() {
+			So(writePidfile(path.Join(dir, "missing", "zot.pid")), ShouldNotBeNil)
+		})
+	})
+}
@@ -1,8 +1,20 @@
 package cli
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+
 	"github.com/anuvu/zot/errors"
 	"github.com/anuvu/zot/pkg/api"
+	"github.com/anuvu/zot/pkg/backup"
+	zlog "github.com/anuvu/zot/pkg/log"
 	"github.com/anuvu/zot/pkg/storage"
 	"github.com/mitchellh/mapstructure"
 	dspec "github.com/opencontainers/distribution-spec"
@@ -11,6 +23,15 @@ import (
 	"github.com/spf13/viper"
 )
 
+const (
+	// includeKey is the top-level config key listing other config files to merge in.
+	includeKey = "include"
+
+	// envPrefix starts the environment variables overriding config keys, named after their
+	// path, e.g. ZOT_HTTP_PORT for http.port.
+	envPrefix = "ZOT_"
+)
+
 // metadataConfig reports metadata after parsing, which we use to track
 // errors.
 func metadataConfig(md *mapstructure.Metadata) viper.DecoderConfigOption {
@@ -24,6 +45,9 @@ func NewRootCmd() *cobra.Command {
 	config := api.NewConfig()
 
 	// "serve"
+	pidfile := ""
+	check := false
+
 	serveCmd := &cobra.Command{
 		Use:     "serve <config>",
 		Aliases: []string{"serve"},
@@ -31,29 +55,47 @@ func NewRootCmd() *cobra.Command {
 		Long:    "`serve` stores and distributes OCI images",
 		Run: func(cmd *cobra.Command, args []string) {
 			if len(args) > 0 {
-				viper.SetConfigFile(args[0])
-				if err := viper.ReadInConfig(); err != nil {
+				if err := LoadConfiguration(config, args[0]); err != nil {
 					panic(err)
 				}
-
-				md := &mapstructure.Metadata{}
-				if err := viper.Unmarshal(&config, metadataConfig(md)); err != nil {
+			}
+			if check {
+				config.Storage.Check = true
+			}
+			if pidfile != "" {
+				if err := writePidfile(pidfile); err != nil {
 					panic(err)
 				}
+				defer removePidfile(pidfile)
+			}
+			c := api.NewController(config)
+			if config.Storage.GC {
+				storage.CaptureGCLogs(c.Log)
+			}
+			if len(args) > 0 {
+				c.LoadConfig = func() (*api.Config, error) {
+					config := api.NewConfig()
+					err := LoadConfiguration(config, args[0])
 
-				// if haven't found a single key or there were unused keys, report it as
-				// a error
-				if len(md.Keys) == 0 || len(md.Unused) > 0 {
-					panic(errors.ErrBadConfig)
+					return config, err
 				}
+				reloadOnSignal(c)
 			}
-			c := api.NewController(config)
+			stopped := stopOnSignal(c)
 			if err := c.Run(); err != nil {
-				panic(err)
+				if err != http.ErrServerClosed {
+					panic(err)
+				}
+				<-stopped
 			}
 		},
 	}
 
+	serveCmd.Flags().StringVar(&pidfile, "pidfile", "",
+		"Write the process ID to the specified file, removed on shutdown")
+	serveCmd.Flags().BoolVar(&check, "check", false,
+		"Verify the integrity of all repositories before serving, and exit if any is corrupted")
+
 	// "garbage-collect"
 	gcDelUntagged := false
 	gcDryRun := false
@@ -66,7 +108,7 @@ func NewRootCmd() *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			log.Info().Interface("values", config).Msg("configuration settings")
 			if config.Storage.RootDirectory != "" {
-				if err := storage.Scrub(config.Storage.RootDirectory, gcDryRun); err != nil {
+				if _, err := storage.Scrub(config.Storage.RootDirectory, !gcDryRun, zlog.NewLogger("info", "")); err != nil {
 					panic(err)
 				}
 			}
@@ -82,13 +124,260 @@ func NewRootCmd() *cobra.Command {
 	gcCmd.Flags().BoolVarP(&gcDryRun, "dry-run", "d", false,
 		"do everything except remove the blobs")
 
+	// "repair-cache"
+	cacheDryRun := false
+
+	cacheCmd := &cobra.Command{
+		Use:   "repair-cache",
+		Short: "`repair-cache` removes stale records from the dedupe cache and compacts it",
+		Long: "`repair-cache` removes records of blobs which no longer exist from the dedupe cache " +
+			"and compacts it. The registry must not be running.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			removed, err := storage.RepairCache(config.Storage.RootDirectory, storage.CacheName, cacheDryRun,
+				zlog.NewLogger("info", ""))
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "%d stale record(s)\n", removed)
+
+			return nil
+		},
+	}
+
+	cacheCmd.Flags().StringVarP(&config.Storage.RootDirectory, "storage-root-dir", "r", "",
+		"Use specified directory for filestore backing image data")
+
+	_ = cacheCmd.MarkFlagRequired("storage-root-dir")
+	cacheCmd.Flags().BoolVarP(&cacheDryRun, "dry-run", "d", false,
+		"report stale records without changing the cache")
+
+	// "scrub"
+	scrubFix := false
+
+	scrubCmd := &cobra.Command{
+		Use:   "scrub",
+		Short: "`scrub` verifies every blob of the storage",
+		Long: "`scrub` hashes every blob of the storage again, and looks for the blobs missing or referenced " +
+			"by nothing. With --fix, corrupt and missing blobs are restored from intact copies in other " +
+			"repositories, if any, and those referenced by nothing removed. The registry must not be running " +
+			"then, and the dedupe cache should be repaired afterwards. While it is, the storage is scrubbed " +
+			"through its API instead.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			report, err := storage.Scrub(config.Storage.RootDirectory, scrubFix, zlog.NewLogger("info", ""))
+			if err != nil {
+				return err
+			}
+
+			for _, p := range report.Problems {
+				fixed := ""
+				if p.Fixed {
+					fixed = " (fixed)"
+				}
+
+				fmt.Fprintf(cmd.OutOrStdout(), "%s %s: %s%s\n", p.Repo, p.Digest, p.Problem, fixed)
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "%d repo(s), %d blob(s), %d problem(s)\n", report.Repos, report.Blobs,
+				len(report.Problems))
+
+			return nil
+		},
+	}
+
+	scrubCmd.Flags().StringVarP(&config.Storage.RootDirectory, "storage-root-dir", "r", "",
+		"Use specified directory for filestore backing image data")
+
+	_ = scrubCmd.MarkFlagRequired("storage-root-dir")
+	scrubCmd.Flags().BoolVar(&scrubFix, "fix", false,
+		"restore corrupt and missing blobs from intact copies, and remove those referenced by nothing")
+
+	// "dedupe"
+	dedupeDryRun := false
+
+	dedupeCmd := &cobra.Command{
+		Use:   "dedupe",
+		Short: "`dedupe` deduplicates the blobs of the storage and rebuilds the dedupe cache",
+		Long: "`dedupe` hard links the identical blobs of all repositories to a single intact copy, " +
+			"and rebuilds the dedupe cache from them, e.g. for a storage created with dedupe disabled or " +
+			"whose cache was lost. The registry must not be running, unless read-only with dedupe disabled.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			report, err := storage.Dedupe(config.Storage.RootDirectory, dedupeDryRun, zlog.NewLogger("info", ""))
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "%d blob(s), %d deduped, %d byte(s) saved\n", report.Blobs,
+				report.Deduped, report.Saved)
+
+			return nil
+		},
+	}
+
+	dedupeCmd.Flags().StringVarP(&config.Storage.RootDirectory, "storage-root-dir", "r", "",
+		"Use specified directory for filestore backing image data")
+
+	_ = dedupeCmd.MarkFlagRequired("storage-root-dir")
+	dedupeCmd.Flags().BoolVarP(&dedupeDryRun, "dry-run", "d", false,
+		"report the blobs to deduplicate without changing the storage")
+
+	// "export" and "import"
+	layoutFile := ""
+	exportTag := ""
+
+	exportCmd := &cobra.Command{
+		Use:   "export <repository>",
+		Short: "`export` exports a repository as a tar of an OCI image layout",
+		Long: "`export` writes the images of a repository, or only the one tagged, along with its referrers, " +
+			"to a tar of an OCI image layout, e.g. to carry to an air-gapped registry. While the registry is " +
+			"running, repositories are exported through its API instead.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			is := storage.NewImageStore(config.Storage.RootDirectory, false, false, storage.Options{},
+				zlog.NewLogger("info", ""))
+			if is == nil {
+				return errors.ErrImgStoreNotFound
+			}
+			defer is.Close()
+
+			f, err := os.Create(layoutFile)
+			if err != nil {
+				return err
+			}
+
+			if err := storage.ExportRepo(is, args[0], exportTag, f); err != nil {
+				f.Close()
+				os.Remove(layoutFile)
+
+				return err
+			}
+
+			return f.Close()
+		},
+	}
+
+	exportCmd.Flags().StringVarP(&config.Storage.RootDirectory, "storage-root-dir", "r", "",
+		"Use specified directory for filestore backing image data")
+	exportCmd.Flags().StringVarP(&layoutFile, "output", "o", "", "Tar file to export the repository to")
+	exportCmd.Flags().StringVarP(&exportTag, "tag", "t", "", "Tag of the image to export, all if not set")
+
+	_ = exportCmd.MarkFlagRequired("storage-root-dir")
+	_ = exportCmd.MarkFlagRequired("output")
+
+	importCmd := &cobra.Command{
+		Use:   "import <repository>",
+		Short: "`import` imports a tar of an OCI image layout into a repository",
+		Long: "`import` pushes the blobs of a tar of an OCI image layout into a repository, then the manifests " +
+			"of its index, tagged as they are there. While the registry is running, repositories are imported " +
+			"through its API instead.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			is := storage.NewImageStore(config.Storage.RootDirectory, false, false, storage.Options{},
+				zlog.NewLogger("info", ""))
+			if is == nil {
+				return errors.ErrImgStoreNotFound
+			}
+			defer is.Close()
+
+			f, err := os.Open(layoutFile)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			tags, err := storage.ImportRepo(is, args[0], f)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "%d tag(s) imported: %s\n", len(tags), strings.Join(tags, ", "))
+
+			return nil
+		},
+	}
+
+	importCmd.Flags().StringVarP(&config.Storage.RootDirectory, "storage-root-dir", "r", "",
+		"Use specified directory for filestore backing image data")
+	importCmd.Flags().StringVarP(&layoutFile, "input", "i", "", "Tar file to import the repository from")
+
+	_ = importCmd.MarkFlagRequired("storage-root-dir")
+	_ = importCmd.MarkFlagRequired("input")
+
+	// "backup" and "restore"
+	backupDir := ""
+	snapshotID := ""
+
+	backupCmd := &cobra.Command{
+		Use:   "backup",
+		Short: "`backup` takes a snapshot of the storage",
+		Long: "`backup` takes a snapshot of the index of every repository, copying the blobs new since " +
+			"the last snapshot, and of the dedupe cache and search dbs. While the registry is running, " +
+			"snapshots are taken through its API instead.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logger := zlog.NewLogger("info", "")
+
+			is := storage.NewImageStore(config.Storage.RootDirectory, false, false, storage.Options{}, logger)
+			if is == nil {
+				return errors.ErrImgStoreNotFound
+			}
+			defer is.Close()
+
+			snapshot, err := backup.NewManager(&backup.Config{Directory: backupDir}, is,
+				config.Storage.RootDirectory, logger).Backup()
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "snapshot %s: %d repo(s), %d blob(s) copied\n", snapshot.ID,
+				len(snapshot.Repositories), snapshot.Copied)
+
+			return nil
+		},
+	}
+
+	backupCmd.Flags().StringVarP(&config.Storage.RootDirectory, "storage-root-dir", "r", "",
+		"Use specified directory for filestore backing image data")
+	backupCmd.Flags().StringVarP(&backupDir, "output", "o", "", "Directory to keep snapshots in")
+
+	_ = backupCmd.MarkFlagRequired("storage-root-dir")
+	_ = backupCmd.MarkFlagRequired("output")
+
+	restoreCmd := &cobra.Command{
+		Use:   "restore",
+		Short: "`restore` restores a snapshot of the storage",
+		Long: "`restore` brings the repositories of a snapshot, the latest by default, back to their state " +
+			"then, along with the dedupe cache and search dbs. The registry must not be running.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			snapshot, err := backup.Restore(backupDir, snapshotID, config.Storage.RootDirectory,
+				zlog.NewLogger("info", ""))
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "snapshot %s: %d repo(s) restored\n", snapshot.ID,
+				len(snapshot.Repositories))
+
+			return nil
+		},
+	}
+
+	restoreCmd.Flags().StringVarP(&config.Storage.RootDirectory, "storage-root-dir", "r", "",
+		"Use specified directory for filestore backing image data")
+	restoreCmd.Flags().StringVarP(&backupDir, "input", "i", "", "Directory snapshots are kept in")
+	restoreCmd.Flags().StringVarP(&snapshotID, "snapshot", "s", "", "ID of the snapshot to restore, the latest if not set")
+
+	_ = restoreCmd.MarkFlagRequired("storage-root-dir")
+	_ = restoreCmd.MarkFlagRequired("input")
+
 	rootCmd := &cobra.Command{
-		Use:   "zot",
-		Short: "`zot`",
-		Long:  "`zot`",
+		Use:                    "zot",
+		Short:                  "`zot`",
+		Long:                   "`zot`",
+		BashCompletionFunction: bashCompletionFunc,
 		Run: func(cmd *cobra.Command, args []string) {
 			if showVersion {
-				log.Info().Str("distribution-spec", dspec.Version).Str("commit", api.Commit).Msg("version")
+				log.Info().Str("distribution-spec", dspec.Version).Str("commit", api.Commit).
+					Str("release-tag", api.ReleaseTag).Str("build-date", api.BuildDate).Msg("version")
 			}
 			_ = cmd.Usage()
 		},
@@ -96,6 +385,14 @@ func NewRootCmd() *cobra.Command {
 
 	rootCmd.AddCommand(serveCmd)
 	rootCmd.AddCommand(gcCmd)
+	rootCmd.AddCommand(cacheCmd)
+	rootCmd.AddCommand(scrubCmd)
+	rootCmd.AddCommand(dedupeCmd)
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(importCmd)
+	rootCmd.AddCommand(backupCmd)
+	rootCmd.AddCommand(restoreCmd)
+	rootCmd.AddCommand(NewCompletionCommand())
 
 	enableCli(rootCmd)
 
@@ -103,3 +400,256 @@ func NewRootCmd() *cobra.Command {
 
 	return rootCmd
 }
+
+// ExitError is returned by commands which need the process to exit with a specific code.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// stopOnSignal gracefully stops the controller on SIGINT or SIGTERM, and closes the
+// returned channel once it is stopped.
+func stopOnSignal(c *api.Controller) <-chan struct{} {
+	stopped := make(chan struct{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigCh
+		signal.Stop(sigCh)
+		c.Log.Info().Str("signal", sig.String()).Msg("shutting down")
+
+		if err := c.Stop(context.Background()); err != nil {
+			c.Log.Error().Err(err).Msg("unable to stop gracefully")
+		}
+
+		close(stopped)
+	}()
+
+	return stopped
+}
+
+// reloadOnSignal reloads the configuration of the controller on SIGHUP, for as long as the
+// process runs.
+func reloadOnSignal(c *api.Controller) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	go func() {
+		for range sigCh {
+			c.Log.Info().Msg("reloading configuration")
+
+			config, err := c.LoadConfig()
+			if err != nil {
+				c.Log.Error().Err(err).Msg("unable to load configuration")
+				continue
+			}
+
+			// failures are logged
+			_ = c.Reload(config)
+		}
+	}()
+}
+
+// LoadConfiguration reads the config file at configPath, merged with the files it includes,
+// into config, overridden by environment variables, e.g. ZOT_HTTP_PORT. If the result selects
+// a preset, its defaults are applied first so that explicit values take precedence.
+func LoadConfiguration(config *api.Config, configPath string) error {
+	settings, files, err := readConfigFile(configPath, nil)
+	if err != nil {
+		return err
+	}
+
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return err
+	}
+
+	// other variables may share the prefix, e.g. those of tests, a single value can't replace a
+	// section either
+	for key, e := range envOverrides(os.Environ()) {
+		if !isConfigKey(reflect.TypeOf(config), strings.Split(key, ".")) {
+			log.Warn().Str("env", e.name).Msg("skipping environment variable not overriding a configuration key")
+			continue
+		}
+
+		v.Set(key, e.value)
+	}
+
+	if preset := v.GetString("preset"); preset != "" {
+		if err := config.ApplyPreset(preset); err != nil {
+			log.Error().Str("preset", preset).Msg("unknown configuration preset")
+			return err
+		}
+	}
+
+	md := &mapstructure.Metadata{}
+	if err := v.Unmarshal(&config, metadataConfig(md)); err != nil {
+		return err
+	}
+
+	// if haven't found a single key or there were unused keys, report it as
+	// a error
+	if len(md.Keys) == 0 {
+		log.Error().Str("config", configPath).Msg("no configuration keys found")
+		return errors.ErrBadConfig
+	}
+
+	if len(md.Unused) > 0 {
+		for _, key := range md.Unused {
+			reportUnknownKey(files, key)
+		}
+
+		return errors.ErrBadConfig
+	}
+
+	return nil
+}
+
+type envOverride struct {
+	name  string
+	value string
+}
+
+// envOverrides returns the config keys overridden by the ZOT_ variables of environ, lowercase
+// as viper's. Config keys having no underscores, those of variables separate their path.
+func envOverrides(environ []string) map[string]envOverride {
+	env := map[string]envOverride{}
+
+	for _, kv := range environ {
+		i := strings.Index(kv, "=")
+		if i < 0 || !strings.HasPrefix(kv[:i], envPrefix) || i == len(envPrefix) {
+			continue
+		}
+
+		name := kv[:i]
+		key := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(name, envPrefix), "_", "."))
+		env[key] = envOverride{name: name, value: kv[i+1:]}
+	}
+
+	return env
+}
+
+// isConfigKey tells whether the path of a key leads to a setting of a config of type t, through
+// its fields, named as mapstructure does, and the keys of its maps.
+func isConfigKey(t reflect.Type, path []string) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() { //nolint: exhaustive
+	case reflect.Interface:
+		return true
+	case reflect.Map:
+		return len(path) > 0 && isConfigKey(t.Elem(), path[1:])
+	case reflect.Struct:
+		if len(path) == 0 {
+			return false
+		}
+
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := strings.Split(f.Tag.Get("mapstructure"), ",")
+
+			if f.Anonymous && len(tag) > 1 && tag[1] == "squash" {
+				if isConfigKey(f.Type, path) {
+					return true
+				}
+
+				continue
+			}
+
+			name := tag[0]
+			if name == "" {
+				name = f.Name
+			}
+
+			if strings.EqualFold(name, path[0]) && isConfigKey(f.Type, path[1:]) {
+				return true
+			}
+		}
+
+		return false
+	default:
+		return len(path) == 0
+	}
+}
+
+// reportUnknownKey logs an unknown configuration key, along with where it is set.
+// Since the including file overrides its includes, files are searched last to first.
+func reportUnknownKey(files []string, key string) {
+	for i := len(files) - 1; i >= 0; i-- {
+		if line := locateConfigKey(files[i], key); line > 0 {
+			log.Error().Str("key", key).Str("file", files[i]).Int("line", line).Msg("unknown configuration key")
+			return
+		}
+	}
+
+	log.Error().Str("key", key).Msg("unknown configuration key")
+}
+
+// readConfigFile returns the settings of a config file merged with those of the files listed
+// under its top-level "include" key, along with all the files read in the order they were
+// merged. Included files are merged in order, so later ones override earlier ones, and the
+// including file overrides them all. Relative include paths are resolved against the
+// directory of the including file.
+// The including files are tracked in stack to detect cycles.
+func readConfigFile(configPath string, stack []string) (map[string]interface{}, []string, error) {
+	configPath, err := filepath.Abs(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, p := range stack {
+		if p == configPath {
+			log.Error().Strs("includes", append(stack, configPath)).Msg("config include cycle")
+			return nil, nil, errors.ErrConfigIncludeCycle
+		}
+	}
+
+	stack = append(stack, configPath)
+
+	f := viper.New()
+	f.SetConfigFile(configPath)
+
+	if err := f.ReadInConfig(); err != nil {
+		return nil, nil, err
+	}
+
+	v := viper.New()
+	files := []string{}
+
+	for _, include := range f.GetStringSlice(includeKey) {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(configPath), include)
+		}
+
+		settings, included, err := readConfigFile(include, stack)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := v.MergeConfigMap(settings); err != nil {
+			return nil, nil, err
+		}
+
+		files = append(files, included...)
+	}
+
+	settings := f.AllSettings()
+	delete(settings, includeKey)
+
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, nil, err
+	}
+
+	return v.AllSettings(), append(files, configPath), nil
+}
@@ -1,12 +1,19 @@
 package cli_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path"
 	"testing"
 
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/api"
 	"github.com/anuvu/zot/pkg/cli"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -65,6 +72,198 @@ func TestServe(t *testing.T) {
 	})
 }
 
+func TestLoadConfiguration(t *testing.T) {
+	Convey("Test config presets", t, func(c C) {
+		tmpfile, err := ioutil.TempFile("", "zot-test*.json")
+		So(err, ShouldBeNil)
+		defer os.Remove(tmpfile.Name()) // clean up
+		content := []byte(`{"preset":"minimal", "storage":{"rootDirectory":"/tmp/zot", "gc":true}}`)
+		_, err = tmpfile.Write(content)
+		So(err, ShouldBeNil)
+		err = tmpfile.Close()
+		So(err, ShouldBeNil)
+
+		config := api.NewConfig()
+		So(cli.LoadConfiguration(config, tmpfile.Name()), ShouldBeNil)
+		So(config.Preset, ShouldEqual, "minimal")
+		So(config.Storage.RootDirectory, ShouldEqual, "/tmp/zot")
+		// explicit values take precedence over the preset
+		So(config.Storage.GC, ShouldBeTrue)
+		So(config.Storage.Dedupe, ShouldBeFalse)
+	})
+
+	Convey("Test unknown config preset", t, func(c C) {
+		tmpfile, err := ioutil.TempFile("", "zot-test*.json")
+		So(err, ShouldBeNil)
+		defer os.Remove(tmpfile.Name()) // clean up
+		content := []byte(`{"preset":"unknown", "storage":{"rootDirectory":"/tmp/zot"}}`)
+		_, err = tmpfile.Write(content)
+		So(err, ShouldBeNil)
+		err = tmpfile.Close()
+		So(err, ShouldBeNil)
+
+		So(cli.LoadConfiguration(api.NewConfig(), tmpfile.Name()), ShouldNotBeNil)
+	})
+
+	Convey("Test config formats and environment overrides", t, func(c C) {
+		dir, err := ioutil.TempDir("", "zot-config-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		p := path.Join(dir, "zot.toml")
+		content := "[storage]\nrootDirectory = \"/tmp/zot\"\ngc = true\n\n[http]\nport = \"8080\"\n"
+		So(ioutil.WriteFile(p, []byte(content), 0600), ShouldBeNil)
+
+		config := api.NewConfig()
+		So(cli.LoadConfiguration(config, p), ShouldBeNil)
+		So(config.Storage.RootDirectory, ShouldEqual, "/tmp/zot")
+		So(config.HTTP.Port, ShouldEqual, "8080")
+
+		setenv := func(name string, value string) {
+			So(os.Setenv(name, value), ShouldBeNil)
+			Reset(func() { os.Unsetenv(name) })
+		}
+
+		Convey("override keys", func(c C) {
+			setenv("ZOT_HTTP_PORT", "9000")
+			setenv("ZOT_STORAGE_GC", "false")
+			setenv("ZOT_HTTP_TLS_CERT", "/etc/zot/cert.pem")
+			setenv("ZOT_LOG_LEVEL", "warn")
+
+			config := api.NewConfig()
+			So(cli.LoadConfiguration(config, p), ShouldBeNil)
+			So(config.Storage.RootDirectory, ShouldEqual, "/tmp/zot")
+			So(config.Storage.GC, ShouldBeFalse)
+			So(config.HTTP.Port, ShouldEqual, "9000")
+			So(config.HTTP.TLS, ShouldNotBeNil)
+			So(config.HTTP.TLS.Cert, ShouldEqual, "/etc/zot/cert.pem")
+			So(config.Log.Level, ShouldEqual, "warn")
+		})
+
+		Convey("skip other variables", func(c C) {
+			setenv("ZOT_HTTP_UNKNOWN", "true")
+			setenv("ZOT_HTTP", "true")
+			setenv("ZOT_SOAK_DURATION", "2h")
+			setenv("ZOT_HTTP_PORT", "9000")
+
+			config := api.NewConfig()
+			So(cli.LoadConfiguration(config, p), ShouldBeNil)
+			So(config.HTTP.Port, ShouldEqual, "9000")
+		})
+	})
+}
+
+func TestConfigInclude(t *testing.T) {
+	Convey("Test config includes", t, func(c C) {
+		dir, err := ioutil.TempDir("", "zot-config-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		writeFile := func(name string, content string) string {
+			p := path.Join(dir, name)
+			So(ioutil.WriteFile(p, []byte(content), 0600), ShouldBeNil)
+
+			return p
+		}
+
+		Convey("merge included files", func(c C) {
+			writeFile("storage.json", `{"storage":{"rootDirectory":"/tmp/included", "gc":false, "dedupe":false}}`)
+			writeFile("http.yaml", "http:\n  address: 0.0.0.0\n  port: \"9000\"\n")
+			writeFile("override.json", `{"storage":{"dedupe":true}, "http":{"port":"9001"}}`)
+			p := writeFile("zot.json", `{"include":["storage.json", "http.yaml", "override.json"],
+				"storage":{"rootDirectory":"/tmp/zot"}}`)
+
+			config := api.NewConfig()
+			So(cli.LoadConfiguration(config, p), ShouldBeNil)
+			So(config.Storage.RootDirectory, ShouldEqual, "/tmp/zot")
+			So(config.Storage.GC, ShouldBeFalse)
+			So(config.Storage.Dedupe, ShouldBeTrue)
+			So(config.HTTP.Address, ShouldEqual, "0.0.0.0")
+			So(config.HTTP.Port, ShouldEqual, "9001")
+		})
+
+		Convey("nested includes", func(c C) {
+			So(os.Mkdir(path.Join(dir, "sub"), 0700), ShouldBeNil)
+			writeFile("sub/log.json", `{"log":{"level":"warn"}}`)
+			writeFile("sub/storage.json", `{"include":["log.json"], "storage":{"rootDirectory":"/tmp/nested"}}`)
+			p := writeFile("zot.json", `{"include":["sub/storage.json"]}`)
+
+			config := api.NewConfig()
+			So(cli.LoadConfiguration(config, p), ShouldBeNil)
+			So(config.Storage.RootDirectory, ShouldEqual, "/tmp/nested")
+			So(config.Log.Level, ShouldEqual, "warn")
+		})
+
+		Convey("include cycle", func(c C) {
+			writeFile("a.json", `{"include":["b.json"], "storage":{"rootDirectory":"/tmp/zot"}}`)
+			writeFile("b.json", `{"include":["a.json"]}`)
+
+			So(cli.LoadConfiguration(api.NewConfig(), path.Join(dir, "a.json")), ShouldEqual, errors.ErrConfigIncludeCycle)
+		})
+
+		Convey("missing include", func(c C) {
+			p := writeFile("zot.json", `{"include":["missing.json"], "storage":{"rootDirectory":"/tmp/zot"}}`)
+			So(cli.LoadConfiguration(api.NewConfig(), p), ShouldNotBeNil)
+		})
+
+		Convey("invalid merged result", func(c C) {
+			writeFile("bad.json", `{"storage":{"unknown":true}}`)
+			p := writeFile("zot.json", `{"include":["bad.json"], "storage":{"rootDirectory":"/tmp/zot"}}`)
+			So(cli.LoadConfiguration(api.NewConfig(), p), ShouldEqual, errors.ErrBadConfig)
+		})
+	})
+}
+
+func TestConfigDump(t *testing.T) {
+	Convey("Test config dump", t, func(c C) {
+		tmpfile, err := ioutil.TempFile("", "zot-test*.json")
+		So(err, ShouldBeNil)
+		defer os.Remove(tmpfile.Name()) // clean up
+		content := []byte(`{"storage":{"rootDirectory":"/tmp/zot"}, "http":{"port":"9000",
+			"auth":{"ldap":{"address":"ldap.example.org", "bindPassword":"secret", "userAttribute":"uid"}}}}`)
+		_, err = tmpfile.Write(content)
+		So(err, ShouldBeNil)
+		err = tmpfile.Close()
+		So(err, ShouldBeNil)
+
+		dump := func(args ...string) (string, error) {
+			cmd := cli.NewRootCmd()
+			buff := bytes.NewBufferString("")
+			cmd.SetOut(buff)
+			cmd.SetErr(ioutil.Discard)
+			cmd.SetArgs(append([]string{"config", "dump"}, args...))
+			err := cmd.Execute()
+
+			return buff.String(), err
+		}
+
+		out, err := dump(tmpfile.Name())
+		So(err, ShouldBeNil)
+		config := api.NewConfig()
+		So(json.Unmarshal([]byte(out), config), ShouldBeNil)
+		So(config.HTTP.Port, ShouldEqual, "9000")
+		So(config.HTTP.Address, ShouldEqual, "127.0.0.1")
+		So(config.Storage.RootDirectory, ShouldEqual, "/tmp/zot")
+		So(config.HTTP.Auth.LDAP.BindPassword, ShouldEqual, "******")
+
+		out, err = dump("-o", "yaml", tmpfile.Name())
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "port: \"9000\"")
+		So(out, ShouldNotContainSubstring, "secret")
+
+		// defaults only
+		out, err = dump()
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "8080")
+
+		_, err = dump("-o", "xml", tmpfile.Name())
+		So(err, ShouldNotBeNil)
+
+		_, err = dump(path.Join(os.TempDir(), "/x.yaml"))
+		So(err, ShouldNotBeNil)
+	})
+}
+
 func TestGC(t *testing.T) {
 	oldArgs := os.Args
 
@@ -76,3 +275,259 @@ func TestGC(t *testing.T) {
 		So(err, ShouldBeNil)
 	})
 }
+
+func TestRepairCache(t *testing.T) {
+	Convey("Test repair-cache", t, func(c C) {
+		dir, err := ioutil.TempDir("", "zot-repair-cache-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		repair := func(args ...string) (string, error) {
+			cmd := cli.NewRootCmd()
+			buff := bytes.NewBufferString("")
+			cmd.SetOut(buff)
+			cmd.SetErr(ioutil.Discard)
+			cmd.SetArgs(append([]string{"repair-cache"}, args...))
+			err := cmd.Execute()
+
+			return buff.String(), err
+		}
+
+		_, err = repair()
+		So(err, ShouldNotBeNil)
+
+		_, err = repair("-r", dir)
+		So(err, ShouldEqual, errors.ErrCacheNotFound)
+
+		cache := storage.NewCache(dir, storage.CacheName, 1, log.NewLogger("debug", ""))
+		So(cache, ShouldNotBeNil)
+		So(cache.PutBlob("key", path.Join(dir, "missing")), ShouldBeNil)
+		So(cache.Close(), ShouldBeNil)
+
+		out, err := repair("-r", dir, "--dry-run")
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "1 stale record(s)")
+
+		out, err = repair("-r", dir)
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "1 stale record(s)")
+
+		out, err = repair("-r", dir)
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "0 stale record(s)")
+	})
+}
+
+func TestScrub(t *testing.T) {
+	Convey("Test scrub", t, func(c C) {
+		dir, err := ioutil.TempDir("", "zot-scrub-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		scrub := func(args ...string) (string, error) {
+			cmd := cli.NewRootCmd()
+			buff := bytes.NewBufferString("")
+			cmd.SetOut(buff)
+			cmd.SetErr(ioutil.Discard)
+			cmd.SetArgs(append([]string{"scrub"}, args...))
+			err := cmd.Execute()
+
+			return buff.String(), err
+		}
+
+		_, err = scrub()
+		So(err, ShouldNotBeNil)
+
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log.NewLogger("debug", ""))
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+		layer := img.Manifest.Layers[0].Digest
+		So(os.Remove(is.BlobPath("repo", layer)), ShouldBeNil)
+
+		out, err := scrub("-r", dir)
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "repo "+layer.String()+": missing\n")
+		So(out, ShouldContainSubstring, "1 repo(s), 2 blob(s), 1 problem(s)")
+
+		// not there to be restored from
+		out, err = scrub("-r", dir, "--fix")
+		So(err, ShouldBeNil)
+		So(out, ShouldNotContainSubstring, "(fixed)")
+	})
+}
+
+func TestDedupe(t *testing.T) {
+	Convey("Test dedupe", t, func(c C) {
+		dir, err := ioutil.TempDir("", "zot-dedupe-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		dedupe := func(args ...string) (string, error) {
+			cmd := cli.NewRootCmd()
+			buff := bytes.NewBufferString("")
+			cmd.SetOut(buff)
+			cmd.SetErr(ioutil.Discard)
+			cmd.SetArgs(append([]string{"dedupe"}, args...))
+			err := cmd.Execute()
+
+			return buff.String(), err
+		}
+
+		_, err = dedupe()
+		So(err, ShouldNotBeNil)
+
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log.NewLogger("debug", ""))
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo1", "1.0"), ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo2", "1.0"), ShouldBeNil)
+
+		out, err := dedupe("-r", dir, "--dry-run")
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "3 blob(s), 3 deduped")
+
+		out, err = dedupe("-r", dir)
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "3 blob(s), 3 deduped")
+
+		out, err = dedupe("-r", dir)
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "3 blob(s), 0 deduped, 0 byte(s) saved")
+	})
+}
+
+func TestExportImport(t *testing.T) {
+	Convey("Test export and import", t, func(c C) {
+		dir, err := ioutil.TempDir("", "zot-layout-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		run := func(args ...string) (string, error) {
+			cmd := cli.NewRootCmd()
+			buff := bytes.NewBufferString("")
+			cmd.SetOut(buff)
+			cmd.SetErr(ioutil.Discard)
+			cmd.SetArgs(args)
+			err := cmd.Execute()
+
+			return buff.String(), err
+		}
+
+		rootDir := path.Join(dir, "root")
+		layout := path.Join(dir, "repo.tar")
+
+		is := storage.NewImageStore(rootDir, false, false, storage.Options{}, log.NewLogger("debug", ""))
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+		_, err = run("export", "-r", rootDir, "repo")
+		So(err, ShouldNotBeNil)
+
+		_, err = run("export", "-r", rootDir, "-o", layout, "-t", "2.0", "repo")
+		So(err, ShouldNotBeNil)
+
+		_, err = os.Stat(layout)
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		_, err = run("export", "-r", rootDir, "-o", layout, "repo")
+		So(err, ShouldBeNil)
+
+		out, err := run("import", "-r", rootDir, "-i", layout, "copy")
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "1 tag(s) imported: 1.0")
+
+		tags, err := is.GetImageTags("copy")
+		So(err, ShouldBeNil)
+		So(tags, ShouldResemble, []string{"1.0"})
+	})
+}
+
+func TestBackupRestore(t *testing.T) {
+	Convey("Test backup and restore", t, func(c C) {
+		dir, err := ioutil.TempDir("", "zot-backup-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		run := func(args ...string) (string, error) {
+			cmd := cli.NewRootCmd()
+			buff := bytes.NewBufferString("")
+			cmd.SetOut(buff)
+			cmd.SetErr(ioutil.Discard)
+			cmd.SetArgs(args)
+			err := cmd.Execute()
+
+			return buff.String(), err
+		}
+
+		rootDir := path.Join(dir, "root")
+		backupDir := path.Join(dir, "backup")
+
+		is := storage.NewImageStore(rootDir, false, false, storage.Options{}, log.NewLogger("debug", ""))
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+		_, err = run("backup", "-r", rootDir)
+		So(err, ShouldNotBeNil)
+
+		out, err := run("backup", "-r", rootDir, "-o", backupDir)
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "1 repo(s), 3 blob(s) copied")
+
+		So(os.RemoveAll(rootDir), ShouldBeNil)
+
+		_, err = run("restore", "-r", rootDir, "-i", backupDir, "-s", "missing")
+		So(err, ShouldEqual, errors.ErrSnapshotNotFound)
+
+		out, err = run("restore", "-r", rootDir, "-i", backupDir)
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "1 repo(s) restored")
+
+		tags, err := is.GetImageTags("repo")
+		So(err, ShouldBeNil)
+		So(tags, ShouldResemble, []string{"1.0"})
+	})
+}
+
+func TestCompletion(t *testing.T) {
+	Convey("Test completion", t, func(c C) {
+		complete := func(args ...string) (string, error) {
+			cmd := cli.NewRootCmd()
+			buff := bytes.NewBufferString("")
+			cmd.SetOut(buff)
+			cmd.SetErr(ioutil.Discard)
+			cmd.SetArgs(append([]string{"completion"}, args...))
+			err := cmd.Execute()
+
+			return buff.String(), err
+		}
+
+		out, err := complete("bash")
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "__start_zot")
+		So(out, ShouldContainSubstring, "__zot_custom_func")
+
+		out, err = complete("zsh")
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "#compdef _zot zot")
+
+		out, err = complete("fish")
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "complete -c zot -n '__fish_use_subcommand' -a serve")
+		So(out, ShouldContainSubstring, "-l pidfile -r")
+		So(out, ShouldNotContainSubstring, "__complete-configs -d")
+
+		out, err = complete("powershell")
+		So(err, ShouldBeNil)
+		So(out, ShouldNotBeEmpty)
+
+		_, err = complete("tcsh")
+		So(err, ShouldNotBeNil)
+
+		_, err = complete()
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,236 @@
+// +build extended
+
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	zotErrors "github.com/anuvu/zot/errors"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+// severities, from the least to the most severe.
+// nolint: gochecknoglobals
+var severities = []string{"UNKNOWN", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+func NewScanCommand(searchService SearchService) *cobra.Command {
+	var servURL, user, outputFormat, severity string
+
+	var exitCode int
+
+	var scanCmd = &cobra.Command{
+		Use:   "scan [config-name] <image:tag>",
+		Short: "Scan an image hosted on zot for vulnerabilities",
+		Long: `Scan an image hosted on zot for known vulnerabilities (CVEs) and list them by package.
+With --exit-code, exits with the given code if any vulnerability is found, e.g. to fail CI pipelines`,
+		Args:        cobra.RangeArgs(1, 2), //nolint: gomnd
+		Annotations: map[string]string{configNameArgAnnotation: "true"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			imageName := args[len(args)-1]
+			if !validateImageNameTag(imageName) {
+				return errInvalidImageNameAndTag
+			}
+
+			verifyTLS := true
+
+			if len(args) == twoArgs {
+				home, err := os.UserHomeDir()
+				if err != nil {
+					panic(err)
+				}
+
+				configPath := path.Join(home + "/.zot")
+				if servURL == "" {
+					urlFromConfig, err := getConfigValue(configPath, args[0], "url")
+					if err != nil {
+						cmd.SilenceUsage = true
+						return err
+					}
+					servURL = urlFromConfig
+				}
+
+				verifyTLS, err = parseBooleanConfig(configPath, args[0], verifyTLSConfig)
+				if err != nil {
+					cmd.SilenceUsage = true
+					return err
+				}
+			}
+
+			if servURL == "" {
+				return zotErrors.ErrNoURLProvided
+			}
+
+			filter, err := parseSeverities(severity)
+			if err != nil {
+				return err
+			}
+
+			cmd.SilenceUsage = true
+
+			username, password := getUsernameAndPassword(user)
+			config := searchConfig{servURL: &servURL, verifyTLS: &verifyTLS}
+
+			cveList, err := searchService.getCVEListForImage(config, username, password, imageName)
+			if err != nil {
+				return err
+			}
+
+			cveList.CVEList = filterCVEsBySeverity(cveList.CVEList, filter)
+
+			if err := printScanResult(cmd.OutOrStdout(), imageName, cveList, outputFormat); err != nil {
+				return err
+			}
+
+			if exitCode != 0 && len(cveList.CVEList) > 0 {
+				cmd.SilenceErrors = true
+
+				return &ExitError{Code: exitCode, Err: zotErrors.ErrVulnerabilitiesFound}
+			}
+
+			return nil
+		},
+	}
+
+	scanCmd.Flags().StringVar(&servURL, "url", "", "Specify zot server URL if config-name is not mentioned")
+	scanCmd.Flags().StringVarP(&user, "user", "u", "", `User Credentials of zot server in "username:password" format`)
+	scanCmd.Flags().StringVarP(&outputFormat, "output", "o", "", "Specify output format [text/json/yaml]")
+	scanCmd.Flags().StringVarP(&severity, "severity", "s", "",
+		"Comma-separated severities to report, e.g. HIGH,CRITICAL (default all)")
+	scanCmd.Flags().IntVar(&exitCode, "exit-code", 0, "Exit code when vulnerabilities are found")
+
+	return scanCmd
+}
+
+// parseSeverities parses a comma-separated list of severities into a set, empty meaning all.
+func parseSeverities(list string) (map[string]bool, error) {
+	set := map[string]bool{}
+
+	for _, s := range strings.Split(list, ",") {
+		s = strings.ToUpper(strings.TrimSpace(s))
+		if s == "" {
+			continue
+		}
+
+		if severityRank(s) < 0 {
+			return nil, zotErrors.ErrInvalidArgs
+		}
+
+		set[s] = true
+	}
+
+	return set, nil
+}
+
+func severityRank(severity string) int {
+	for i, s := range severities {
+		if s == severity {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// filterCVEsBySeverity keeps the CVEs with a severity in filter, if not empty, and sorts
+// them from the most severe.
+func filterCVEsBySeverity(cveList []cve, filter map[string]bool) []cve {
+	filtered := make([]cve, 0, len(cveList))
+
+	for _, c := range cveList {
+		if len(filter) == 0 || filter[strings.ToUpper(c.Severity)] {
+			filtered = append(filtered, c)
+		}
+	}
+
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return severityRank(strings.ToUpper(filtered[i].Severity)) >
+			severityRank(strings.ToUpper(filtered[j].Severity))
+	})
+
+	return filtered
+}
+
+func printScanResult(w io.Writer, imageName string, cveList cveListForImage, format string) error {
+	switch strings.ToLower(format) {
+	case "", defaultOutoutFormat:
+	case "json":
+		var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+		body, err := json.MarshalIndent(cveList, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(w, string(body))
+
+		return nil
+	case "yml", "yaml":
+		body, err := yaml.Marshal(&cveList)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprint(w, string(body))
+
+		return nil
+	default:
+		return ErrInvalidOutputFormat
+	}
+
+	counts := map[string]int{}
+	for _, c := range cveList.CVEList {
+		counts[strings.ToUpper(c.Severity)]++
+	}
+
+	summary := []string{}
+
+	for i := len(severities) - 1; i >= 0; i-- {
+		if n := counts[severities[i]]; n > 0 {
+			summary = append(summary, fmt.Sprintf("%s: %d", severities[i], n))
+		}
+	}
+
+	fmt.Fprintf(w, "%s\n%s\nTotal: %d", imageName, strings.Repeat("=", len(imageName)), len(cveList.CVEList))
+
+	if len(summary) > 0 {
+		fmt.Fprintf(w, " (%s)", strings.Join(summary, ", "))
+	}
+
+	fmt.Fprint(w, "\n\n")
+
+	if len(cveList.CVEList) == 0 {
+		return nil
+	}
+
+	table := tablewriter.NewWriter(w)
+	table.SetAutoWrapText(false)
+	table.SetAutoFormatHeaders(true)
+	table.SetHeader([]string{"Library", "Vulnerability ID", "Severity", "Installed Version", "Fixed Version", "Title"})
+	table.SetAutoMergeCells(true)
+	table.SetRowLine(true)
+
+	for _, c := range cveList.CVEList {
+		title := ellipsize(c.Title, cveTitleWidth, ellipsis)
+
+		if len(c.PackageList) == 0 {
+			table.Append([]string{"", c.ID, c.Severity, "", "", title})
+			continue
+		}
+
+		for _, p := range c.PackageList {
+			table.Append([]string{p.Name, c.ID, c.Severity, p.InstalledVersion, p.FixedVersion, title})
+		}
+	}
+
+	table.Render()
+
+	return nil
+}
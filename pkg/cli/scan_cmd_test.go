@@ -0,0 +1,98 @@
+// +build extended
+
+package cli //nolint:testpackage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	zotErrors "github.com/anuvu/zot/errors"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestScanCmd(t *testing.T) {
+	configPath := makeConfigFile(`{"configs":[{"_name":"scantest","url":"https://test-url.com","verify-tls":false},` +
+		`{"_name":"nourl","verify-tls":false}]}`)
+	defer os.Remove(configPath)
+
+	scan := func(args ...string) (string, error) {
+		cmd := NewScanCommand(new(mockService))
+		buff := bytes.NewBufferString("")
+		cmd.SetOut(buff)
+		cmd.SetErr(ioutil.Discard)
+		cmd.SetArgs(args)
+		err := cmd.Execute()
+
+		return buff.String(), err
+	}
+
+	Convey("Test scan", t, func() {
+		out, err := scan("scantest", "repo:1.0")
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "Total: 2 (HIGH: 1, LOW: 1)")
+		So(out, ShouldContainSubstring, "packagename")
+		So(out, ShouldContainSubstring, "dummyCVEID")
+		So(out, ShouldContainSubstring, "installedver")
+		So(out, ShouldContainSubstring, "fixedver")
+		// most severe first
+		So(bytes.Index([]byte(out), []byte("dummyCVEID")), ShouldBeLessThan,
+			bytes.Index([]byte(out), []byte("lowCVEID")))
+
+		out, err = scan("--url", "https://test-url.com", "repo:1.0", "--severity", "high,critical")
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "Total: 1 (HIGH: 1)")
+		So(out, ShouldNotContainSubstring, "lowCVEID")
+
+		out, err = scan("scantest", "repo:1.0", "-s", "CRITICAL", "--exit-code", "3")
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "Total: 0")
+
+		out, err = scan("scantest", "repo:1.0", "-o", "json")
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, `"Id": "dummyCVEID"`)
+
+		out, err = scan("scantest", "repo:1.0", "-o", "yaml", "-s", "LOW")
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, "lowCVEID")
+		So(out, ShouldNotContainSubstring, "dummyCVEID")
+	})
+
+	Convey("Test scan exit code", t, func() {
+		_, err := scan("scantest", "repo:1.0", "--exit-code", "3")
+		So(err, ShouldNotBeNil)
+
+		exitErr, ok := err.(*ExitError)
+		So(ok, ShouldBeTrue)
+		So(exitErr.Code, ShouldEqual, 3)
+		So(exitErr.Err, ShouldEqual, zotErrors.ErrVulnerabilitiesFound)
+	})
+
+	Convey("Test scan errors", t, func() {
+		_, err := scan("scantest")
+		So(err, ShouldEqual, errInvalidImageNameAndTag)
+
+		_, err = scan("repo:1.0")
+		So(err, ShouldEqual, zotErrors.ErrNoURLProvided)
+
+		_, err = scan("nourl", "repo:1.0")
+		So(err, ShouldEqual, zotErrors.ErrNoURLProvided)
+
+		_, err = scan("unknown", "repo:1.0")
+		So(err, ShouldEqual, zotErrors.ErrConfigNotFound)
+
+		_, err = scan("scantest", "repo:1.0", "-s", "SEVERE")
+		So(err, ShouldEqual, zotErrors.ErrInvalidArgs)
+
+		_, err = scan("scantest", "repo:1.0", "-o", "xml")
+		So(err, ShouldEqual, ErrInvalidOutputFormat)
+
+		_, err = scan("scantest", "missing:tag")
+		So(err, ShouldEqual, zotErrors.ErrManifestNotFound)
+
+		_, err = scan()
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -27,6 +27,7 @@ type SearchService interface {
 		channel chan stringResult, wg *sync.WaitGroup)
 	getCveByImage(ctx context.Context, config searchConfig, username, password, imageName string,
 		channel chan stringResult, wg *sync.WaitGroup)
+	getCVEListForImage(config searchConfig, username, password, imageName string) (cveListForImage, error)
 	getImagesByCveID(ctx context.Context, config searchConfig, username, password, cveID string,
 		channel chan stringResult, wg *sync.WaitGroup)
 	getImageByNameAndCVEID(ctx context.Context, config searchConfig, username, password, imageName, cveID string,
@@ -273,12 +274,7 @@ func (service searchService) getCveByImage(ctx context.Context, config searchCon
 	defer wg.Done()
 	defer close(c)
 
-	query := fmt.Sprintf(`{ CVEListForImage (image:"%s")`+
-		` { Tag CVEList { Id Title Severity Description `+
-		`PackageList {Name InstalledVersion FixedVersion}} } }`, imageName)
-	result := &cveResult{}
-
-	endPoint, err := combineServerAndEndpointURL(*config.servURL, "/query")
+	cveList, err := service.getCVEListForImage(config, username, password, imageName)
 	if err != nil {
 		if isContextDone(ctx) {
 			return
@@ -288,7 +284,10 @@ func (service searchService) getCveByImage(ctx context.Context, config searchCon
 		return
 	}
 
-	err = makeGraphQLRequest(endPoint, query, username, password, *config.verifyTLS, result)
+	cveList.CVEList = groupCVEsBySeverity(cveList.CVEList)
+	result := &cveResult{Data: cveData{CVEListForImage: cveList}}
+
+	str, err := result.string(*config.outputFormat)
 	if err != nil {
 		if isContextDone(ctx) {
 			return
@@ -298,37 +297,41 @@ func (service searchService) getCveByImage(ctx context.Context, config searchCon
 		return
 	}
 
-	if result.Errors != nil {
-		var errBuilder strings.Builder
+	if isContextDone(ctx) {
+		return
+	}
+	c <- stringResult{str, nil}
+}
 
-		for _, err := range result.Errors {
-			fmt.Fprintln(&errBuilder, err.Message)
-		}
+// getCVEListForImage returns the CVEs affecting an image, which the server scans if needed.
+func (service searchService) getCVEListForImage(config searchConfig, username, password,
+	imageName string) (cveListForImage, error) {
+	query := fmt.Sprintf(`{ CVEListForImage (image:"%s")`+
+		` { Tag CVEList { Id Title Severity Description `+
+		`PackageList {Name InstalledVersion FixedVersion}} } }`, imageName)
+	result := &cveResult{}
 
-		if isContextDone(ctx) {
-			return
-		}
-		c <- stringResult{"", errors.New(errBuilder.String())} //nolint: goerr113
+	endPoint, err := combineServerAndEndpointURL(*config.servURL, "/query")
+	if err != nil {
+		return cveListForImage{}, err
+	}
 
-		return
+	err = makeGraphQLRequest(endPoint, query, username, password, *config.verifyTLS, result)
+	if err != nil {
+		return cveListForImage{}, err
 	}
 
-	result.Data.CVEListForImage.CVEList = groupCVEsBySeverity(result.Data.CVEListForImage.CVEList)
+	if result.Errors != nil {
+		var errBuilder strings.Builder
 
-	str, err := result.string(*config.outputFormat)
-	if err != nil {
-		if isContextDone(ctx) {
-			return
+		for _, err := range result.Errors {
+			fmt.Fprintln(&errBuilder, err.Message)
 		}
-		c <- stringResult{"", err}
 
-		return
+		return cveListForImage{}, errors.New(errBuilder.String()) //nolint: goerr113
 	}
 
-	if isContextDone(ctx) {
-		return
-	}
-	c <- stringResult{str, nil}
+	return result.Data.CVEListForImage, nil
 }
 
 func groupCVEsBySeverity(cveList []cve) []cve {
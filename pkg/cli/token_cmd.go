@@ -0,0 +1,220 @@
+// +build extended
+
+package cli
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	zotErrors "github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/api"
+	"github.com/anuvu/zot/pkg/apikey"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+const apiKeysPath = "/v2/_zot/apikeys"
+
+func NewTokenCommand() *cobra.Command {
+	var servURL, user string
+
+	var tokenCmd = &cobra.Command{
+		Use:   "token",
+		Short: "Manage API keys",
+		Long: `Create, list and revoke the API keys of a user of zot, e.g. for CI pipelines, given as password
+or in the X-Zot-API-Key header. The user authenticates with a password, as API keys can't mint others`,
+	}
+
+	tokenCmd.PersistentFlags().StringVar(&servURL, "url", "", "Specify zot server URL if config-name is not mentioned")
+	tokenCmd.PersistentFlags().StringVarP(&user, "user", "u", "",
+		`User Credentials of zot server in "username:password" format`)
+
+	tokenCmd.AddCommand(newTokenCreateCommand(&servURL, &user))
+	tokenCmd.AddCommand(newTokenListCommand(&servURL, &user))
+	tokenCmd.AddCommand(newTokenRevokeCommand(&servURL, &user))
+
+	return tokenCmd
+}
+
+func newTokenCreateCommand(servURL, user *string) *cobra.Command {
+	var label, expiresIn string
+
+	var createCmd = &cobra.Command{
+		Use:   "create [config-name]",
+		Short: "Create an API key",
+		Long: `Create an API key authenticating as the user, printing its token, which isn't shown again.
+Its expiry is the maximum allowed by the server if not given`,
+		Args:        cobra.MaximumNArgs(oneArg),
+		Annotations: map[string]string{configNameArgAnnotation: "true"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if expiresIn != "" {
+				if _, err := time.ParseDuration(expiresIn); err != nil {
+					return err
+				}
+			}
+
+			servURL, verifyTLS, err := tokenServer(*servURL, args)
+			if err != nil {
+				cmd.SilenceUsage = true
+				return err
+			}
+
+			cmd.SilenceUsage = true
+
+			username, password := getUsernameAndPassword(*user)
+
+			var key api.APIKeyResponse
+
+			if err := makeJSONRequest(http.MethodPost, servURL+apiKeysPath, username, password, verifyTLS,
+				api.APIKeyRequest{Label: label, ExpiresIn: expiresIn}, &key); err != nil {
+				return err
+			}
+
+			fmt.Fprintf(cmd.ErrOrStderr(), "created API key %s, expiring %s\n", key.ID, expiry(key.Expires))
+			fmt.Fprintln(cmd.OutOrStdout(), key.Token)
+
+			return nil
+		},
+	}
+
+	createCmd.Flags().StringVarP(&label, "label", "l", "", "Label the API key, e.g. with the pipeline it's for")
+	createCmd.Flags().StringVar(&expiresIn, "expires-in", "", `How long the API key is valid for, e.g. "720h"`)
+
+	return createCmd
+}
+
+func newTokenListCommand(servURL, user *string) *cobra.Command {
+	var listCmd = &cobra.Command{
+		Use:         "list [config-name]",
+		Short:       "List API keys",
+		Long:        `List the API keys of the user, without their tokens`,
+		Args:        cobra.MaximumNArgs(oneArg),
+		Annotations: map[string]string{configNameArgAnnotation: "true"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			servURL, verifyTLS, err := tokenServer(*servURL, args)
+			if err != nil {
+				cmd.SilenceUsage = true
+				return err
+			}
+
+			cmd.SilenceUsage = true
+
+			username, password := getUsernameAndPassword(*user)
+
+			var keys []apikey.Key
+
+			if err := makeJSONRequest(http.MethodGet, servURL+apiKeysPath, username, password, verifyTLS,
+				nil, &keys); err != nil {
+				return err
+			}
+
+			printAPIKeys(cmd.OutOrStdout(), keys)
+
+			return nil
+		},
+	}
+
+	return listCmd
+}
+
+func newTokenRevokeCommand(servURL, user *string) *cobra.Command {
+	var revokeCmd = &cobra.Command{
+		Use:         "revoke [config-name] <id>",
+		Short:       "Revoke an API key",
+		Long:        `Revoke an API key of the user, by the id listed`,
+		Args:        cobra.RangeArgs(oneArg, twoArgs),
+		Annotations: map[string]string{configNameArgAnnotation: "true"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id := args[len(args)-1]
+
+			servURL, verifyTLS, err := tokenServer(*servURL, args[:len(args)-1])
+			if err != nil {
+				cmd.SilenceUsage = true
+				return err
+			}
+
+			cmd.SilenceUsage = true
+
+			username, password := getUsernameAndPassword(*user)
+
+			if err := makeJSONRequest(http.MethodDelete, servURL+apiKeysPath+"/"+url.PathEscape(id),
+				username, password, verifyTLS, nil, nil); err != nil {
+				return err
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "revoked API key %s\n", id)
+
+			return nil
+		},
+	}
+
+	return revokeCmd
+}
+
+// tokenServer returns the URL of the zot server, that of the config named in args, if any,
+// unless given, along with whether to verify its TLS certificate.
+func tokenServer(servURL string, args []string) (string, bool, error) {
+	verifyTLS := true
+
+	if len(args) > 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", false, err
+		}
+
+		configPath := path.Join(home + "/.zot")
+		if servURL == "" {
+			if servURL, err = getConfigValue(configPath, args[0], "url"); err != nil {
+				return "", false, err
+			}
+		}
+
+		if verifyTLS, err = parseBooleanConfig(configPath, args[0], verifyTLSConfig); err != nil {
+			return "", false, err
+		}
+	}
+
+	if servURL == "" {
+		return "", false, zotErrors.ErrNoURLProvided
+	}
+
+	return strings.TrimSuffix(servURL, "/"), verifyTLS, nil
+}
+
+func printAPIKeys(w io.Writer, keys []apikey.Key) {
+	table := tablewriter.NewWriter(w)
+
+	table.SetAutoWrapText(false)
+	table.SetAutoFormatHeaders(true)
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetCenterSeparator("")
+	table.SetColumnSeparator("")
+	table.SetRowSeparator("")
+	table.SetHeaderLine(false)
+	table.SetBorder(false)
+	table.SetTablePadding("  ")
+	table.SetNoWhiteSpace(true)
+	table.SetHeader([]string{"ID", "Label", "Created", "Expires"})
+
+	for _, key := range keys {
+		table.Append([]string{key.ID, key.Label, key.Created.Format(time.RFC3339), expiry(key.Expires)})
+	}
+
+	table.Render()
+}
+
+// expiry formats when an API key expires, if ever.
+func expiry(expires *time.Time) string {
+	if expires == nil {
+		return "never"
+	}
+
+	return expires.Format(time.RFC3339)
+}
@@ -0,0 +1,116 @@
+// +build extended
+
+package cli //nolint:testpackage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	zotErrors "github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/api"
+	"github.com/anuvu/zot/pkg/apikey"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/resty.v1"
+)
+
+func TestTokenCmd(t *testing.T) {
+	Convey("Manage API keys", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.DefaultCost)
+		So(err, ShouldBeNil)
+
+		htpasswd, err := ioutil.TempFile("", "htpasswd")
+		So(err, ShouldBeNil)
+		defer os.Remove(htpasswd.Name())
+
+		_, err = fmt.Fprintf(htpasswd, "admin:%s\n", hash)
+		So(err, ShouldBeNil)
+		So(htpasswd.Close(), ShouldBeNil)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.HTTP.Auth = &api.AuthConfig{HTPasswd: api.AuthHTPasswd{Path: htpasswd.Name()},
+			APIKey: &apikey.Config{MaxExpiry: 24 * time.Hour}}
+		config.Storage.RootDirectory = dir
+
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		token := func(args ...string) (string, string, error) {
+			cmd := NewTokenCommand()
+			out := bytes.NewBufferString("")
+			errOut := bytes.NewBufferString("")
+			cmd.SetOut(out)
+			cmd.SetErr(errOut)
+			cmd.SetArgs(args)
+			err := cmd.Execute()
+
+			return out.String(), errOut.String(), err
+		}
+
+		authenticated := func(key string) int {
+			resp, err := resty.R().SetHeader(apikey.Header, key).Get(baseURL + "/v2/")
+			So(err, ShouldBeNil)
+
+			return resp.StatusCode()
+		}
+
+		out, errOut, err := token("create", "--url", baseURL, "-u", "admin:secret", "-l", "ci", "--expires-in", "1h")
+		So(err, ShouldBeNil)
+
+		key := strings.TrimSpace(out)
+		So(key, ShouldStartWith, apikey.Prefix)
+		So(authenticated(key), ShouldEqual, http.StatusOK)
+
+		fields := strings.Fields(errOut)
+		So(len(fields), ShouldBeGreaterThan, 3)
+		id := strings.TrimSuffix(fields[3], ",")
+
+		out, _, err = token("list", "--url", baseURL, "-u", "admin:secret")
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, id)
+		So(out, ShouldContainSubstring, "ci")
+
+		out, _, err = token("revoke", "--url", baseURL, "-u", "admin:secret", id)
+		So(err, ShouldBeNil)
+		So(out, ShouldContainSubstring, id)
+		So(authenticated(key), ShouldEqual, http.StatusUnauthorized)
+
+		out, _, err = token("list", "--url", baseURL, "-u", "admin:secret")
+		So(err, ShouldBeNil)
+		So(out, ShouldNotContainSubstring, id)
+
+		Convey("Errors", func() {
+			_, _, err := token("revoke", "--url", baseURL, "-u", "admin:secret", id)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "404")
+
+			_, _, err = token("list", "--url", baseURL, "-u", "admin:wrong")
+			So(err, ShouldEqual, zotErrors.ErrUnauthorizedAccess)
+
+			_, _, err = token("list", "-u", "admin:secret")
+			So(err, ShouldEqual, zotErrors.ErrNoURLProvided)
+
+			_, _, err = token("create", "--url", baseURL, "-u", "admin:secret", "--expires-in", "forever")
+			So(err, ShouldNotBeNil)
+
+			// over the maximum expiry
+			_, _, err = token("create", "--url", baseURL, "-u", "admin:secret", "--expires-in", "48h")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,67 @@
+package compliance
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/anuvu/zot/errors"
+	"gopkg.in/resty.v1"
+)
+
+// BaseURL returns the URL of the registry to check.
+func (c *Config) BaseURL() string {
+	if c.URL != "" {
+		return strings.TrimSuffix(c.URL, "/")
+	}
+
+	return fmt.Sprintf("http://%s:%s", c.Address, c.Port)
+}
+
+// Connect has the default resty client, which the workflows send their requests with, replaced
+// by one authenticating with the registry of config, as configured, returning a function
+// restoring it.
+func Connect(config *Config) (func(), error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.TLSVerify != nil && !*config.TLSVerify {
+		tlsConfig.InsecureSkipVerify = true //nolint: gosec
+	}
+
+	if config.CACert != "" {
+		caCert, err := ioutil.ReadFile(config.CACert)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, errors.ErrBadCACert
+		}
+	}
+
+	if config.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	client := resty.New().SetTLSClientConfig(tlsConfig)
+
+	switch {
+	case config.Token != "":
+		client.SetAuthToken(config.Token)
+	case config.Username != "":
+		client.SetBasicAuth(config.Username, config.Password)
+	}
+
+	old := resty.DefaultClient
+	resty.DefaultClient = client
+
+	return func() { resty.DefaultClient = old }, nil
+}
@@ -1,13 +1,95 @@
 package compliance
 
+import (
+	"path"
+
+	. "github.com/smartystreets/goconvey/convey" // nolint:golint,stylecheck
+)
+
+// Feature is a set of features of the spec which registries may intentionally disable.
+type Feature int
+
+const (
+	// Delete is the deletion of blobs, manifests and uploads.
+	Delete Feature = iota
+	// ChunkedUpload is the upload of blobs in chunks.
+	ChunkedUpload
+)
+
 type Config struct {
+	// URL is that of the registry to check, e.g. https://registry.example.com, if not the one
+	// listening on Address and Port over plain HTTP
+	URL        string
 	Address    string
 	Port       string
 	Version    string
 	OutputJSON bool
 	Compliance bool
+
+	// JSONReport and JUnitReport are the paths of the report files to write, if any
+	JSONReport  string
+	JUnitReport string
+
+	// Include and Exclude select the workflows to check by name, as path.Match patterns, all of
+	// them unless Include has any, and SkipDelete and SkipChunkedUpload skip those which require
+	// features registries may disable
+	Include           []string
+	Exclude           []string
+	SkipDelete        bool
+	SkipChunkedUpload bool
+
+	// Username and Password, or Token, are the basic or bearer credentials to authenticate with
+	Username  string
+	Password  string
+	Token     string
+	TLSVerify *bool  // verify the registry's certificate, true if not set
+	CACert    string // CA certificate to verify the registry's certificate with, if not a well-known one
+	Cert      string // client certificate and key, for registries requiring mutual TLS
+	Key       string
+}
+
+// Reporting reports whether the results of the workflows are to be captured, to be output as
+// JSON or written to report files.
+func (c *Config) Reporting() bool {
+	return c.OutputJSON || c.JSONReport != "" || c.JUnitReport != ""
 }
 
 func NewConfig() *Config {
 	return &Config{Compliance: true}
 }
+
+// Selected reports whether the named workflow, which requires the given features, is to be checked.
+func (c *Config) Selected(name string, features ...Feature) bool {
+	for _, f := range features {
+		if (f == Delete && c.SkipDelete) || (f == ChunkedUpload && c.SkipChunkedUpload) {
+			return false
+		}
+	}
+
+	if len(c.Include) > 0 && !matchAny(c.Include, name) {
+		return false
+	}
+
+	return !matchAny(c.Exclude, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Workflow checks the named workflow, which requires the given features, if selected by config,
+// or else reports it skipped.
+func Workflow(config *Config, name string, f func(), features ...Feature) {
+	if config.Selected(name, features...) {
+		Convey(name, f)
+		return
+	}
+
+	SkipConvey(name, f)
+}
@@ -0,0 +1,32 @@
+package compliance_test
+
+import (
+	"testing"
+
+	"github.com/anuvu/zot/pkg/compliance"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSelected(t *testing.T) {
+	Convey("Select workflows", t, func() {
+		config := compliance.NewConfig()
+		So(config.Selected("Manifests"), ShouldBeTrue)
+		So(config.Selected("Chunked blob upload", compliance.ChunkedUpload), ShouldBeTrue)
+
+		config.SkipChunkedUpload = true
+		So(config.Selected("Chunked blob upload", compliance.ChunkedUpload), ShouldBeFalse)
+		So(config.Selected("Create and delete blobs", compliance.Delete), ShouldBeTrue)
+
+		config.SkipDelete = true
+		So(config.Selected("Create and delete blobs", compliance.Delete), ShouldBeFalse)
+
+		config.Include = []string{"Monolithic*", "Manifests"}
+		So(config.Selected("Manifests"), ShouldBeTrue)
+		So(config.Selected("Monolithic blob upload with body"), ShouldBeTrue)
+		So(config.Selected("Pagination"), ShouldBeFalse)
+
+		config.Exclude = []string{"*with body"}
+		So(config.Selected("Monolithic blob upload"), ShouldBeTrue)
+		So(config.Selected("Monolithic blob upload with body"), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,128 @@
+package compliance
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/smartystreets/goconvey/convey/reporting"
+)
+
+// nolint: gochecknoglobals
+var (
+	old  *os.File
+	r    *os.File
+	w    *os.File
+	outC chan string
+)
+
+// OutputJSONEnter has the results of the workflows checked from then on reported as JSON,
+// capturing stdout until OutputJSONExit.
+func OutputJSONEnter() {
+	// this env var instructs goconvey to output results to JSON (stdout)
+	os.Setenv("GOCONVEY_REPORTER", "json")
+
+	// stdout capture copied from: https://stackoverflow.com/a/29339052
+	old = os.Stdout
+	// keep backup of the real stdout
+	r, w, _ = os.Pipe()
+	outC = make(chan string)
+	os.Stdout = w
+
+	// copy the output in a separate goroutine so printing can't block indefinitely
+	go func() {
+		var buf bytes.Buffer
+
+		_, err := io.Copy(&buf, r)
+		if err != nil {
+			panic(err)
+		}
+
+		outC <- buf.String()
+	}()
+}
+
+// OutputJSONExit reports the results captured since OutputJSONEnter, checking for compliance
+// with the given version of the spec: printed as minified JSON if config.OutputJSON, or else
+// summarized, and written to the report files of config, if any.
+func OutputJSONExit(config *Config, version string) {
+	// back to normal state
+	w.Close()
+
+	os.Stdout = old // restoring the real stdout
+
+	out := <-outC
+
+	// The output of JSON is combined with regular output, so we look for the
+	// first occurrence of the "{" character and take everything after that
+	rawJSON := "[{" + strings.Join(strings.Split(out, "{")[1:], "{")
+	rawJSON = strings.Replace(rawJSON, reporting.OpenJson, "", 1)
+	rawJSON = strings.Replace(rawJSON, reporting.CloseJson, "", 1)
+	tmp := strings.Split(rawJSON, ",")
+	rawJSON = strings.Join(tmp[0:len(tmp)-1], ",") + "]"
+
+	var scopes []reporting.ScopeResult
+
+	if err := json.Unmarshal([]byte(rawJSON), &scopes); err != nil {
+		panic(err)
+	}
+
+	report := NewReport(version, scopes)
+
+	if config.OutputJSON {
+		rawJSONMinified := validateMinifyRawJSON(rawJSON)
+		fmt.Println(rawJSONMinified)
+	} else {
+		printSummary(report)
+	}
+
+	if config.JSONReport != "" {
+		if err := writeReport(config.JSONReport, report.WriteJSON); err != nil {
+			panic(err)
+		}
+	}
+
+	if config.JUnitReport != "" {
+		if err := writeReport(config.JUnitReport, report.WriteJUnit); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// printSummary prints whether each workflow passed, in place of goconvey's own output,
+// which is captured.
+func printSummary(report *Report) {
+	for _, r := range report.Results {
+		if !r.Failed() {
+			fmt.Printf("PASS %s\n", r.Name)
+			continue
+		}
+
+		fmt.Printf("FAIL %s\n", r.Name)
+
+		for _, f := range r.Failures {
+			fmt.Printf("\t%s\n", f)
+		}
+	}
+
+	fmt.Printf("%d passed, %d failed\n", report.Passed, report.Failed)
+}
+
+func validateMinifyRawJSON(rawJSON string) string {
+	var j interface{}
+
+	err := json.Unmarshal([]byte(rawJSON), &j)
+	if err != nil {
+		panic(err)
+	}
+
+	rawJSONBytesMinified, err := json.Marshal(j)
+	if err != nil {
+		panic(err)
+	}
+
+	return string(rawJSONBytesMinified)
+}
@@ -0,0 +1,196 @@
+package compliance
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/smartystreets/goconvey/convey/reporting"
+)
+
+// Result is the outcome of one of the workflows checked, i.e. of one convey scope.
+type Result struct {
+	Name     string   `json:"name"`
+	File     string   `json:"file"`
+	Line     int      `json:"line"`
+	Passed   int      `json:"passed"`
+	Skipped  int      `json:"skipped"`
+	Failures []string `json:"failures,omitempty"`
+	Output   string   `json:"output,omitempty"`
+}
+
+// Failed reports whether any of the assertions of the workflow failed.
+func (r Result) Failed() bool {
+	return len(r.Failures) > 0
+}
+
+// Report is the outcome of the workflows checked for compliance with a version of the spec.
+type Report struct {
+	Version string   `json:"version"`
+	Passed  int      `json:"passed"`
+	Failed  int      `json:"failed"`
+	Results []Result `json:"results"`
+}
+
+// NewReport summarizes the scope results reported by goconvey, which reports scopes again
+// each time it runs through them, into a result per workflow, named after its path.
+func NewReport(version string, scopes []reporting.ScopeResult) *Report {
+	report := &Report{Version: version, Results: []Result{}}
+	index := map[string]int{}
+	path := []reporting.ScopeResult{}
+
+	for _, scope := range scopes {
+		for len(path) > 0 && path[len(path)-1].Depth >= scope.Depth {
+			path = path[:len(path)-1]
+		}
+
+		path = append(path, scope)
+
+		// scopes merely grouping others needn't be reported
+		if len(scope.Assertions) == 0 && scope.Output == "" {
+			continue
+		}
+
+		titles := make([]string, 0, len(path))
+		for _, p := range path {
+			titles = append(titles, p.Title)
+		}
+
+		name := strings.Join(titles, "/")
+
+		i, ok := index[name]
+		if !ok {
+			i = len(report.Results)
+			index[name] = i
+			report.Results = append(report.Results, Result{Name: name, File: scope.File, Line: scope.Line})
+		}
+
+		result := &report.Results[i]
+		result.Output += scope.Output
+
+		for _, a := range scope.Assertions {
+			switch {
+			case a.Skipped:
+				result.Skipped++
+			case a.Error != nil:
+				result.Failures = append(result.Failures, fmt.Sprintf("%s:%d: %v", a.File, a.Line, a.Error))
+			case a.Failure != "":
+				result.Failures = append(result.Failures, fmt.Sprintf("%s:%d: %s", a.File, a.Line, a.Failure))
+			default:
+				result.Passed++
+			}
+		}
+	}
+
+	for _, r := range report.Results {
+		if r.Failed() {
+			report.Failed++
+		} else {
+			report.Passed++
+		}
+	}
+
+	return report
+}
+
+// WriteJSON writes the report as JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(r)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr,omitempty"`
+	Line      int           `xml:"line,attr,omitempty"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit writes the report as JUnit XML, a test suite whose test cases are the workflows.
+func (r *Report) WriteJUnit(w io.Writer) error {
+	suite := junitTestSuite{
+		Name:     fmt.Sprintf("OCI distribution-spec %s compliance", r.Version),
+		Tests:    len(r.Results),
+		Failures: r.Failed,
+		Cases:    make([]junitTestCase, 0, len(r.Results)),
+	}
+
+	for _, res := range r.Results {
+		tc := junitTestCase{
+			Name:      res.Name,
+			ClassName: "compliance." + r.Version,
+			File:      res.File,
+			Line:      res.Line,
+			SystemOut: res.Output,
+		}
+
+		switch {
+		case res.Failed():
+			tc.Failure = &junitFailure{
+				Message: fmt.Sprintf("%d assertion(s) failed", len(res.Failures)),
+				Text:    strings.Join(res.Failures, "\n"),
+			}
+		case res.Passed == 0 && res.Skipped > 0:
+			tc.Skipped = &struct{}{}
+			suite.Skipped++
+		}
+
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+
+	if err := enc.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+
+	return err
+}
+
+// writeReport writes the report to a file with the given writer.
+func writeReport(path string, write func(io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,65 @@
+package compliance_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"testing"
+
+	"github.com/anuvu/zot/pkg/compliance"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/smartystreets/goconvey/convey/reporting"
+)
+
+func TestReport(t *testing.T) {
+	Convey("Summarize scope results", t, func() {
+		scopes := []reporting.ScopeResult{
+			{Title: "API", Depth: 1},
+			{Title: "Pass", Depth: 2, Output: "pass\n",
+				Assertions: []*reporting.AssertionResult{{}, {}}},
+			{Title: "API", Depth: 1},
+			{Title: "Fail", Depth: 2,
+				Assertions: []*reporting.AssertionResult{{}, {File: "check.go", Line: 3, Failure: "expected 200"}}},
+			{Title: "API", Depth: 1},
+			{Title: "Pass", Depth: 2, Output: "again\n",
+				Assertions: []*reporting.AssertionResult{{}, {Skipped: true}}},
+		}
+
+		report := compliance.NewReport("v1.0.0", scopes)
+		So(report.Passed, ShouldEqual, 1)
+		So(report.Failed, ShouldEqual, 1)
+		So(len(report.Results), ShouldEqual, 2)
+		So(report.Results[0].Name, ShouldEqual, "API/Pass")
+		So(report.Results[0].Passed, ShouldEqual, 3)
+		So(report.Results[0].Skipped, ShouldEqual, 1)
+		So(report.Results[0].Output, ShouldEqual, "pass\nagain\n")
+		So(report.Results[1].Name, ShouldEqual, "API/Fail")
+		So(report.Results[1].Failures, ShouldResemble, []string{"check.go:3: expected 200"})
+
+		var buf bytes.Buffer
+		So(report.WriteJSON(&buf), ShouldBeNil)
+		var r compliance.Report
+		So(json.Unmarshal(buf.Bytes(), &r), ShouldBeNil)
+		So(r, ShouldResemble, *report)
+
+		buf.Reset()
+		So(report.WriteJUnit(&buf), ShouldBeNil)
+		var suites struct {
+			Suites []struct {
+				Tests    int `xml:"tests,attr"`
+				Failures int `xml:"failures,attr"`
+				Cases    []struct {
+					Name    string    `xml:"name,attr"`
+					Failure *struct{} `xml:"failure"`
+				} `xml:"testcase"`
+			} `xml:"testsuite"`
+		}
+		So(xml.Unmarshal(buf.Bytes(), &suites), ShouldBeNil)
+		So(len(suites.Suites), ShouldEqual, 1)
+		So(suites.Suites[0].Tests, ShouldEqual, 2)
+		So(suites.Suites[0].Failures, ShouldEqual, 1)
+		So(suites.Suites[0].Cases[0].Failure, ShouldBeNil)
+		So(suites.Suites[0].Cases[1].Name, ShouldEqual, "API/Fail")
+		So(suites.Suites[0].Cases[1].Failure, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,269 @@
+// Package soak pushes, pulls and deletes random images to and from a registry, concurrently and
+// for as long as configured, e.g. hours, checking invariants all along, to catch the concurrency
+// and locking bugs short tests miss.
+package soak
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/compliance"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"gopkg.in/resty.v1"
+)
+
+// maxImages is how many images each worker keeps pushed at most, deleting rather than pushing
+// more, so that storage doesn't grow over long runs.
+const maxImages = 16
+
+// Config is how long and how hard to soak a registry.
+type Config struct {
+	Duration  time.Duration // how long to run for
+	Workers   int           // clients pushing, pulling and deleting concurrently
+	Repos     int           // repositories shared by the workers, so that they contend
+	LayerSize int           // of the single layer of the random images pushed
+	// RootDirectory, if set, is that of the registry's storage, checked for uploads left over
+	RootDirectory string
+	// HeapInUse, if set, returns the memory in use by the registry, e.g. of the process it runs
+	// in, which mustn't grow by more than MaxHeapGrowth over the run
+	HeapInUse     func() uint64
+	MaxHeapGrowth uint64
+}
+
+// Stats counts what was done while soaking.
+type Stats struct {
+	Pushes  int64
+	Pulls   int64
+	Deletes int64
+}
+
+// Run soaks the registry of config for soak.Duration, or until ctx is done, returning the
+// first invariant found violated, if any.
+func Run(ctx context.Context, config *compliance.Config, soak Config) (Stats, error) {
+	var stats Stats
+
+	restore, err := compliance.Connect(config)
+	if err != nil {
+		return stats, err
+	}
+	defer restore()
+
+	ctx, cancel := context.WithTimeout(ctx, soak.Duration)
+	defer cancel()
+
+	var heap uint64
+	if soak.HeapInUse != nil {
+		heap = soak.HeapInUse()
+	}
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, soak.Workers)
+
+	for i := 0; i < soak.Workers; i++ {
+		wg.Add(1)
+
+		go func(id int) {
+			defer wg.Done()
+
+			w := &worker{id: id, baseURL: config.BaseURL(), soak: soak, stats: &stats}
+			if err := w.run(ctx); err != nil {
+				errs <- err
+				// no need to go on
+				cancel()
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return stats, err
+	}
+
+	if soak.RootDirectory != "" {
+		if err := checkUploads(soak.RootDirectory); err != nil {
+			return stats, err
+		}
+	}
+
+	if soak.HeapInUse != nil {
+		if now := soak.HeapInUse(); now > heap+soak.MaxHeapGrowth {
+			return stats, fmt.Errorf("%w: heap grew from %d to %d bytes", errors.ErrSoakInvariant, heap, now)
+		}
+	}
+
+	return stats, nil
+}
+
+// pushed is an image a worker pushed, and which it's the only one to pull or delete.
+type pushed struct {
+	repo   string
+	tag    string
+	digest godigest.Digest
+	image  test.Image
+}
+
+type worker struct {
+	id      int
+	baseURL string
+	soak    Config
+	stats   *Stats
+	images  []pushed
+	pushes  int
+}
+
+func (w *worker) run(ctx context.Context) error {
+	for ctx.Err() == nil {
+		var err error
+
+		switch op := rand.Intn(4); { //nolint: gosec
+		case len(w.images) == 0 || (op == 0 && len(w.images) < maxImages):
+			err = w.push()
+		case op <= 1:
+			err = w.delete()
+		default:
+			err = w.pull()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *worker) push() error {
+	img, err := test.GetRandomImage(w.soak.LayerSize, 1)
+	if err != nil {
+		return err
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+
+	repo := fmt.Sprintf("soak/repo%d", rand.Intn(w.soak.Repos)) //nolint: gosec
+	tag := fmt.Sprintf("w%d-%d", w.id, w.pushes)
+
+	if err := test.UploadImage(img, w.baseURL, repo, tag); err != nil {
+		return fmt.Errorf("pushing %s:%s: %w", repo, tag, err)
+	}
+
+	w.pushes++
+	w.images = append(w.images, pushed{repo: repo, tag: tag, digest: digest, image: img})
+	atomic.AddInt64(&w.stats.Pushes, 1)
+
+	return nil
+}
+
+// pull checks an image pushed is still there as it was, whatever was deleted since.
+func (w *worker) pull() error {
+	p := w.images[rand.Intn(len(w.images))] //nolint: gosec
+
+	resp, err := resty.R().SetHeader("Accept", ispec.MediaTypeImageManifest).
+		Get(fmt.Sprintf("%s/v2/%s/manifests/%s", w.baseURL, p.repo, p.tag))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("%w: pulling %s:%s: %s", errors.ErrSoakInvariant, p.repo, p.tag, resp.Status())
+	}
+
+	if d := godigest.FromBytes(resp.Body()); d != p.digest || resp.Header().Get("Docker-Content-Digest") != d.String() {
+		return fmt.Errorf("%w: manifest of %s:%s is %s, not %s", errors.ErrSoakInvariant, p.repo, p.tag, d, p.digest)
+	}
+
+	// blobs may be shared with images deleted since, e.g. configs, but mustn't be collected
+	blobs := append([]ispec.Descriptor{p.image.Manifest.Config}, p.image.Manifest.Layers...)
+
+	for _, desc := range blobs {
+		resp, err := resty.R().Get(fmt.Sprintf("%s/v2/%s/blobs/%s", w.baseURL, p.repo, desc.Digest))
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			return fmt.Errorf("%w: pulling blob %s of %s:%s: %s", errors.ErrSoakInvariant, desc.Digest,
+				p.repo, p.tag, resp.Status())
+		}
+
+		if d := godigest.FromBytes(resp.Body()); d != desc.Digest {
+			return fmt.Errorf("%w: blob %s of %s:%s is %s", errors.ErrSoakInvariant, desc.Digest, p.repo, p.tag, d)
+		}
+	}
+
+	atomic.AddInt64(&w.stats.Pulls, 1)
+
+	return nil
+}
+
+func (w *worker) delete() error {
+	i := rand.Intn(len(w.images)) //nolint: gosec
+	p := w.images[i]
+
+	u := fmt.Sprintf("%s/v2/%s/manifests/%s", w.baseURL, p.repo, p.digest)
+
+	resp, err := resty.R().Delete(u)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode() != http.StatusAccepted {
+		return fmt.Errorf("%w: deleting %s@%s: %s", errors.ErrSoakInvariant, p.repo, p.digest, resp.Status())
+	}
+
+	if resp, err = resty.R().Get(u); err != nil {
+		return err
+	}
+
+	if resp.StatusCode() != http.StatusNotFound {
+		return fmt.Errorf("%w: %s@%s deleted, but pulled: %s", errors.ErrSoakInvariant, p.repo, p.digest, resp.Status())
+	}
+
+	w.images = append(w.images[:i], w.images[i+1:]...)
+	atomic.AddInt64(&w.stats.Deletes, 1)
+
+	return nil
+}
+
+// checkUploads checks no uploads were left over in the repositories under root, all of them
+// having been finished.
+func checkUploads(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() || info.Name() != storage.BlobUploadDir {
+			return nil
+		}
+
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+
+		if len(entries) > 0 {
+			return fmt.Errorf("%w: %d uploads left over in %s", errors.ErrSoakInvariant, len(entries), path)
+		}
+
+		return filepath.SkipDir
+	})
+}
@@ -0,0 +1,86 @@
+package soak_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/anuvu/zot/pkg/api"
+	"github.com/anuvu/zot/pkg/compliance"
+	"github.com/anuvu/zot/pkg/compliance/soak"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// nolint: gochecknoglobals
+var (
+	listenAddress = "127.0.0.1"
+)
+
+// soakDuration is a few seconds, unless overridden with ZOT_SOAK_DURATION, e.g. "2h".
+func soakDuration() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("ZOT_SOAK_DURATION")); err == nil {
+		return d
+	}
+
+	return 5 * time.Second
+}
+
+func heapInUse() uint64 {
+	var stats runtime.MemStats
+
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+
+	return stats.HeapAlloc
+}
+
+func TestSoak(t *testing.T) {
+	Convey("Soak a registry collecting garbage and deduping", t, func() {
+		config := api.NewConfig()
+		config.HTTP.Address = listenAddress
+		config.HTTP.Port = "0"
+
+		dir, err := ioutil.TempDir("", "oci-repo-soak")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config.Storage.RootDirectory = dir
+		ctrl := api.NewController(config)
+		So(ctrl.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = ctrl.Stop(context.Background()) }()
+
+		stats, err := soak.Run(context.Background(), &compliance.Config{
+			Address: listenAddress,
+			Port:    fmt.Sprintf("%d", ctrl.Port()),
+		}, soak.Config{
+			Duration:      soakDuration(),
+			Workers:       8,
+			Repos:         3,
+			LayerSize:     1024,
+			RootDirectory: dir,
+			HeapInUse:     heapInUse,
+			MaxHeapGrowth: 64 << 20,
+		})
+		So(err, ShouldBeNil)
+		So(stats.Pushes, ShouldBeGreaterThan, 0)
+		So(stats.Pulls, ShouldBeGreaterThan, 0)
+		So(stats.Deletes, ShouldBeGreaterThan, 0)
+	})
+
+	Convey("Stop soaking when cancelled", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		stats, err := soak.Run(ctx, &compliance.Config{URL: "http://127.0.0.1:1"}, soak.Config{
+			Duration: time.Hour,
+			Workers:  2,
+			Repos:    1,
+		})
+		So(err, ShouldBeNil)
+		So(stats.Pushes, ShouldEqual, 0)
+	})
+}
@@ -5,17 +5,15 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
-	"os"
 	"strings"
 	"testing"
 
 	"github.com/anuvu/zot/pkg/api"
 	"github.com/anuvu/zot/pkg/compliance"
+	"github.com/anuvu/zot/pkg/test"
 	godigest "github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	. "github.com/smartystreets/goconvey/convey" // nolint:golint,stylecheck
-	"github.com/smartystreets/goconvey/convey/reporting"
 	"gopkg.in/resty.v1"
 )
 
@@ -34,31 +32,37 @@ func Location(baseURL string, resp *resty.Response) string {
 }
 
 func CheckWorkflows(t *testing.T, config *compliance.Config) {
-	if config == nil || config.Address == "" || config.Port == "" {
+	if config == nil || (config.URL == "" && (config.Address == "" || config.Port == "")) {
 		panic("insufficient config")
 	}
 
-	if config.OutputJSON {
-		outputJSONEnter()
+	restore, err := compliance.Connect(config)
+	if err != nil {
+		panic(err)
+	}
+	defer restore()
 
-		defer outputJSONExit()
+	if config.Reporting() {
+		compliance.OutputJSONEnter()
+
+		defer compliance.OutputJSONExit(config, "v1.0.0")
 	}
 
-	baseURL := fmt.Sprintf("http://%s:%s", config.Address, config.Port)
+	baseURL := config.BaseURL()
 
 	fmt.Println("------------------------------")
 	fmt.Println("Checking for v1.0.0 compliance")
 	fmt.Println("------------------------------")
 
 	Convey("Make API calls to the controller", t, func(c C) {
-		Convey("Check version", func() {
+		compliance.Workflow(config, "Check version", func() {
 			Print("\nCheck version")
 			resp, err := resty.R().Get(baseURL + "/v2/")
 			So(err, ShouldBeNil)
 			So(resp.StatusCode(), ShouldEqual, 200)
 		})
 
-		Convey("Get repository catalog", func() {
+		compliance.Workflow(config, "Get repository catalog", func() {
 			Print("\nGet repository catalog")
 			resp, err := resty.R().Get(baseURL + "/v2/_catalog")
 			So(err, ShouldBeNil)
@@ -68,7 +72,10 @@ func CheckWorkflows(t *testing.T, config *compliance.Config) {
 			var repoList api.RepositoryList
 			err = json.Unmarshal(resp.Body(), &repoList)
 			So(err, ShouldBeNil)
-			So(len(repoList.Repositories), ShouldEqual, 0)
+			if !config.Compliance {
+				// stricter check for zot ci/cd, as registries checked may not be empty
+				So(len(repoList.Repositories), ShouldEqual, 0)
+			}
 
 			// after newly created upload should succeed
 			resp, err = resty.R().Post(baseURL + "/v2/z/blobs/uploads/")
@@ -93,7 +100,7 @@ func CheckWorkflows(t *testing.T, config *compliance.Config) {
 			}
 		})
 
-		Convey("Get images in a repository", func() {
+		compliance.Workflow(config, "Get images in a repository", func() {
 			Print("\nGet images in a repository")
 			// non-existent repository should fail
 			resp, err := resty.R().Get(baseURL + "/v2/repo1/tags/list")
@@ -115,7 +122,7 @@ func CheckWorkflows(t *testing.T, config *compliance.Config) {
 			}
 		})
 
-		Convey("Monolithic blob upload", func() {
+		compliance.Workflow(config, "Monolithic blob upload", func() {
 			Print("\nMonolithic blob upload")
 			resp, err := resty.R().Post(baseURL + "/v2/repo2/blobs/uploads/")
 			So(err, ShouldBeNil)
@@ -170,7 +177,7 @@ func CheckWorkflows(t *testing.T, config *compliance.Config) {
 			So(resp.StatusCode(), ShouldEqual, 200)
 		})
 
-		Convey("Monolithic blob upload with body", func() {
+		compliance.Workflow(config, "Monolithic blob upload with body", func() {
 			Print("\nMonolithic blob upload")
 			// create content
 			content := []byte("this is a blob2")
@@ -208,7 +215,7 @@ func CheckWorkflows(t *testing.T, config *compliance.Config) {
 			So(resp.StatusCode(), ShouldEqual, 200)
 		})
 
-		Convey("Monolithic blob upload with multiple name components", func() {
+		compliance.Workflow(config, "Monolithic blob upload with multiple name components", func() {
 			Print("\nMonolithic blob upload with multiple name components")
 			resp, err := resty.R().Post(baseURL + "/v2/repo10/repo20/repo30/blobs/uploads/")
 			So(err, ShouldBeNil)
@@ -263,7 +270,7 @@ func CheckWorkflows(t *testing.T, config *compliance.Config) {
 			So(resp.StatusCode(), ShouldEqual, 200)
 		})
 
-		Convey("Chunked blob upload", func() {
+		compliance.Workflow(config, "Chunked blob upload", func() {
 			Print("\nChunked blob upload")
 			resp, err := resty.R().Post(baseURL + "/v2/repo3/blobs/uploads/")
 			So(err, ShouldBeNil)
@@ -329,9 +336,9 @@ func CheckWorkflows(t *testing.T, config *compliance.Config) {
 			resp, err = resty.R().Get(blobLoc)
 			So(err, ShouldBeNil)
 			So(resp.StatusCode(), ShouldEqual, 200)
-		})
+		}, compliance.ChunkedUpload)
 
-		Convey("Chunked blob upload with multiple name components", func() {
+		compliance.Workflow(config, "Chunked blob upload with multiple name components", func() {
 			Print("\nChunked blob upload with multiple name components")
 			resp, err := resty.R().Post(baseURL + "/v2/repo40/repo50/repo60/blobs/uploads/")
 			So(err, ShouldBeNil)
@@ -397,9 +404,9 @@ func CheckWorkflows(t *testing.T, config *compliance.Config) {
 			resp, err = resty.R().Get(blobLoc)
 			So(err, ShouldBeNil)
 			So(resp.StatusCode(), ShouldEqual, 200)
-		})
+		}, compliance.ChunkedUpload)
 
-		Convey("Create and delete uploads", func() {
+		compliance.Workflow(config, "Create and delete uploads", func() {
 			Print("\nCreate and delete uploads")
 			// create a upload
 			resp, err := resty.R().Post(baseURL + "/v2/repo4/blobs/uploads/")
@@ -412,9 +419,9 @@ func CheckWorkflows(t *testing.T, config *compliance.Config) {
 			resp, err = resty.R().Delete(loc)
 			So(err, ShouldBeNil)
 			So(resp.StatusCode(), ShouldEqual, 204)
-		})
+		}, compliance.Delete)
 
-		Convey("Create and delete blobs", func() {
+		compliance.Workflow(config, "Create and delete blobs", func() {
 			Print("\nCreate and delete blobs")
 			// create a upload
 			resp, err := resty.R().Post(baseURL + "/v2/repo5/blobs/uploads/")
@@ -440,9 +447,9 @@ func CheckWorkflows(t *testing.T, config *compliance.Config) {
 			So(err, ShouldBeNil)
 			So(resp.StatusCode(), ShouldEqual, 202)
 			So(resp.Header().Get("Content-Length"), ShouldEqual, "0")
-		})
+		}, compliance.Delete)
 
-		Convey("Mount blobs", func() {
+		compliance.Workflow(config, "Mount blobs", func() {
 			Print("\nMount blobs from another repository")
 			// create a upload
 			resp, err := resty.R().Post(baseURL + "/v2/repo6/blobs/uploads/?digest=\"abc\"&&from=\"xyz\"")
@@ -450,7 +457,7 @@ func CheckWorkflows(t *testing.T, config *compliance.Config) {
 			So(resp.StatusCode(), ShouldBeIn, []int{201, 202, 405})
 		})
 
-		Convey("Manifests", func() {
+		compliance.Workflow(config, "Manifests", func() {
 			Print("\nManifests")
 			// create a blob/layer
 			resp, err := resty.R().Post(baseURL + "/v2/repo7/blobs/uploads/")
@@ -555,6 +562,10 @@ func CheckWorkflows(t *testing.T, config *compliance.Config) {
 			So(resp.StatusCode(), ShouldEqual, 200)
 			So(resp.Body(), ShouldNotBeEmpty)
 
+			if config.SkipDelete {
+				return
+			}
+
 			// delete manifest by tag should fail
 			resp, err = resty.R().Delete(baseURL + "/v2/repo7/manifests/test:1.0")
 			So(err, ShouldBeNil)
@@ -598,59 +609,15 @@ func CheckWorkflows(t *testing.T, config *compliance.Config) {
 		})
 
 		// pagination
-		Convey("Pagination", func() {
+		compliance.Workflow(config, "Pagination", func() {
 			Print("\nPagination")
 
-			for i := 0; i <= 4; i++ {
-				// create a blob/layer
-				resp, err := resty.R().Post(baseURL + "/v2/page0/blobs/uploads/")
-				So(err, ShouldBeNil)
-				So(resp.StatusCode(), ShouldEqual, 202)
-				loc := Location(baseURL, resp)
-				So(loc, ShouldNotBeEmpty)
+			img, err := test.GetRandomImage(15, 1)
+			So(err, ShouldBeNil)
 
-				resp, err = resty.R().Get(loc)
-				So(err, ShouldBeNil)
-				So(resp.StatusCode(), ShouldEqual, 204)
-				content := []byte("this is a blob7")
-				digest := godigest.FromBytes(content)
-				So(digest, ShouldNotBeNil)
-				// monolithic blob upload: success
-				resp, err = resty.R().SetQueryParam("digest", digest.String()).
-					SetHeader("Content-Type", "application/octet-stream").SetBody(content).Put(loc)
-				So(err, ShouldBeNil)
-				So(resp.StatusCode(), ShouldEqual, 201)
-				blobLoc := resp.Header().Get("Location")
-				So(blobLoc, ShouldNotBeEmpty)
-				So(resp.Header().Get("Content-Length"), ShouldEqual, "0")
-				So(resp.Header().Get(api.DistContentDigestKey), ShouldNotBeEmpty)
-
-				// create a manifest
-				m := ispec.Manifest{
-					Config: ispec.Descriptor{
-						Digest: digest,
-						Size:   int64(len(content)),
-					},
-					Layers: []ispec.Descriptor{
-						{
-							MediaType: "application/vnd.oci.image.layer.v1.tar",
-							Digest:    digest,
-							Size:      int64(len(content)),
-						},
-					},
-				}
-				m.SchemaVersion = 2
-				content, err = json.Marshal(m)
-				So(err, ShouldBeNil)
-				digest = godigest.FromBytes(content)
-				So(digest, ShouldNotBeNil)
-				resp, err = resty.R().SetHeader("Content-Type", "application/vnd.oci.image.manifest.v1+json").
-					SetBody(content).Put(baseURL + fmt.Sprintf("/v2/page0/manifests/test:%d.0", i))
+			for i := 0; i <= 4; i++ {
+				err := test.UploadImage(img, baseURL, "page0", fmt.Sprintf("test:%d.0", i))
 				So(err, ShouldBeNil)
-				So(resp.StatusCode(), ShouldEqual, 201)
-				d := resp.Header().Get(api.DistContentDigestKey)
-				So(d, ShouldNotBeEmpty)
-				So(d, ShouldEqual, digest.String())
 			}
 
 			resp, err := resty.R().Get(baseURL + "/v2/page0/tags/list")
@@ -667,7 +634,7 @@ func CheckWorkflows(t *testing.T, config *compliance.Config) {
 			next := resp.Header().Get("Link")
 			So(next, ShouldNotBeEmpty)
 
-			u := baseURL + strings.Split(next, ";")[0]
+			u := baseURL + strings.Trim(strings.Split(next, ";")[0], "<>")
 			resp, err = resty.R().Get(u)
 			So(err, ShouldBeNil)
 			So(resp.StatusCode(), ShouldEqual, 200)
@@ -675,84 +642,203 @@ func CheckWorkflows(t *testing.T, config *compliance.Config) {
 			So(next, ShouldBeEmpty)
 		})
 
-		// this is an additional test for repository names (alphanumeric)
-		Convey("Repository names", func() {
-			Print("\nRepository names")
-			// create a blob/layer
-			resp, err := resty.R().Post(baseURL + "/v2/repotest/blobs/uploads/")
+		compliance.Workflow(config, "Unknown repositories", func() {
+			Print("\nUnknown repositories")
+			digest := godigest.FromBytes([]byte("this is an unknown blob"))
+
+			resp, err := resty.R().Get(baseURL + "/v2/unknown1/tags/list")
 			So(err, ShouldBeNil)
-			So(resp.StatusCode(), ShouldEqual, 202)
-			resp, err = resty.R().Post(baseURL + "/v2/repotest123/blobs/uploads/")
+			So(resp.StatusCode(), ShouldEqual, 404)
+			So(errorCodes(resp), ShouldContain, "NAME_UNKNOWN")
+
+			resp, err = resty.R().Get(baseURL + "/v2/unknown1/manifests/1.0")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 404)
+			So(errorCodes(resp), ShouldBeIn, [][]string{{"NAME_UNKNOWN"}, {"MANIFEST_UNKNOWN"}})
+
+			resp, err = resty.R().Head(baseURL + "/v2/unknown1/manifests/1.0")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 404)
+
+			resp, err = resty.R().Get(baseURL + "/v2/unknown1/blobs/" + digest.String())
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 404)
+			So(errorCodes(resp), ShouldBeIn, [][]string{{"NAME_UNKNOWN"}, {"BLOB_UNKNOWN"}})
+
+			resp, err = resty.R().Head(baseURL + "/v2/unknown1/blobs/" + digest.String())
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 404)
+
+			// unknown upload sessions
+			resp, err = resty.R().Post(baseURL + "/v2/negative1/blobs/uploads/")
 			So(err, ShouldBeNil)
 			So(resp.StatusCode(), ShouldEqual, 202)
+
+			resp, err = resty.R().Get(baseURL + "/v2/negative1/blobs/uploads/unknown")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 404)
+			So(errorCodes(resp), ShouldContain, "BLOB_UPLOAD_UNKNOWN")
 		})
-	})
-}
 
-// nolint: gochecknoglobals
-var (
-	old  *os.File
-	r    *os.File
-	w    *os.File
-	outC chan string
-)
+		compliance.Workflow(config, "Invalid digests", func() {
+			Print("\nInvalid digests")
+			resp, err := resty.R().Get(baseURL + "/v2/negative2/blobs/sha256:invalid")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldBeIn, []int{400, 404})
 
-func outputJSONEnter() {
-	// this env var instructs goconvey to output results to JSON (stdout)
-	os.Setenv("GOCONVEY_REPORTER", "json")
+			resp, err = resty.R().Head(baseURL + "/v2/negative2/blobs/sha256:invalid")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldBeIn, []int{400, 404})
 
-	// stdout capture copied from: https://stackoverflow.com/a/29339052
-	old = os.Stdout
-	// keep backup of the real stdout
-	r, w, _ = os.Pipe()
-	outC = make(chan string)
-	os.Stdout = w
+			content := []byte("this is a blob6")
 
-	// copy the output in a separate goroutine so printing can't block indefinitely
-	go func() {
-		var buf bytes.Buffer
+			// the digest of an upload must be valid and that of its content
+			for _, digest := range []string{"sha256:invalid", godigest.FromBytes([]byte("x")).String()} {
+				resp, err = resty.R().Post(baseURL + "/v2/negative2/blobs/uploads/")
+				So(err, ShouldBeNil)
+				So(resp.StatusCode(), ShouldEqual, 202)
+				loc := Location(baseURL, resp)
 
-		_, err := io.Copy(&buf, r)
-		if err != nil {
-			panic(err)
-		}
+				resp, err = resty.R().SetQueryParam("digest", digest).
+					SetHeader("Content-Type", "application/octet-stream").SetBody(content).Put(loc)
+				So(err, ShouldBeNil)
+				So(resp.StatusCode(), ShouldEqual, 400)
+				So(errorCodes(resp), ShouldContain, "DIGEST_INVALID")
+			}
 
-		outC <- buf.String()
-	}()
-}
+			// and so must manifests be pushed by their digest, and with their blobs
+			m := ispec.Manifest{
+				Config: ispec.Descriptor{
+					Digest: godigest.FromBytes(content),
+					Size:   int64(len(content)),
+				},
+				Layers: []ispec.Descriptor{
+					{
+						MediaType: "application/vnd.oci.image.layer.v1.tar",
+						Digest:    godigest.FromBytes(content),
+						Size:      int64(len(content)),
+					},
+				},
+			}
+			m.SchemaVersion = 2
+			body, err := json.Marshal(m)
+			So(err, ShouldBeNil)
+
+			resp, err = resty.R().SetHeader("Content-Type", "application/vnd.oci.image.manifest.v1+json").
+				SetBody(body).Put(baseURL + "/v2/negative2/manifests/1.0")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 400)
+		})
+
+		compliance.Workflow(config, "Bad ranges", func() {
+			Print("\nBad ranges")
+			resp, err := resty.R().Post(baseURL + "/v2/negative3/blobs/uploads/")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 202)
+			loc := Location(baseURL, resp)
+
+			content := []byte("this is a blob7")
+
+			// chunks must be uploaded in order
+			resp, err = resty.R().SetHeader("Content-Length", fmt.Sprintf("%d", len(content))).
+				SetHeader("Content-Type", "application/octet-stream").
+				SetHeader("Content-Range", fmt.Sprintf("%d-%d", 5, 5+len(content)-1)).
+				SetBody(content).Patch(loc)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 416)
+
+			resp, err = resty.R().SetHeader("Content-Length", fmt.Sprintf("%d", len(content))).
+				SetHeader("Content-Type", "application/octet-stream").
+				SetHeader("Content-Range", "invalid").
+				SetBody(content).Patch(loc)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldBeIn, []int{400, 416})
+
+			// the upload is left as it was
+			resp, err = resty.R().Get(loc)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 204)
+		}, compliance.ChunkedUpload)
+
+		compliance.Workflow(config, "Oversized manifests", func() {
+			Print("\nOversized manifests")
+			m := ispec.Manifest{
+				Config: ispec.Descriptor{
+					Digest: godigest.FromBytes([]byte("this is a blob8")),
+					Size:   15,
+				},
+				Annotations: map[string]string{"padding": strings.Repeat("x", 5*1024*1024)},
+			}
+			m.SchemaVersion = 2
+			body, err := json.Marshal(m)
+			So(err, ShouldBeNil)
 
-func outputJSONExit() {
-	// back to normal state
-	w.Close()
+			resp, err := resty.R().SetHeader("Content-Type", "application/vnd.oci.image.manifest.v1+json").
+				SetBody(body).Put(baseURL + "/v2/negative4/manifests/1.0")
+			So(err, ShouldBeNil)
+			if !config.Compliance {
+				// stricter check for zot ci/cd
+				So(resp.StatusCode(), ShouldEqual, 413)
+			} else {
+				So(resp.StatusCode(), ShouldBeIn, []int{400, 413})
+			}
+		})
 
-	os.Stdout = old // restoring the real stdout
+		compliance.Workflow(config, "Malformed references", func() {
+			Print("\nMalformed references")
+			resp, err := resty.R().Get(baseURL + "/v2/negative5/manifests/sha256:invalid")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldBeIn, []int{400, 404})
 
-	out := <-outC
+			// repository names are lower case
+			resp, err = resty.R().Get(baseURL + "/v2/Negative5/tags/list")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldBeIn, []int{400, 404})
 
-	// The output of JSON is combined with regular output, so we look for the
-	// first occurrence of the "{" character and take everything after that
-	rawJSON := "[{" + strings.Join(strings.Split(out, "{")[1:], "{")
-	rawJSON = strings.Replace(rawJSON, reporting.OpenJson, "", 1)
-	rawJSON = strings.Replace(rawJSON, reporting.CloseJson, "", 1)
-	tmp := strings.Split(rawJSON, ",")
-	rawJSON = strings.Join(tmp[0:len(tmp)-1], ",") + "]"
+			resp, err = resty.R().Post(baseURL + "/v2/Negative5/blobs/uploads/")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldBeIn, []int{400, 404})
 
-	rawJSONMinified := validateMinifyRawJSON(rawJSON)
-	fmt.Println(rawJSONMinified)
+			// a manifest pushed by digest must be that digest's
+			img, err := test.GetRandomImage(15, 1)
+			So(err, ShouldBeNil)
+			err = test.UploadImage(img, baseURL, "negative5", "1.0")
+			So(err, ShouldBeNil)
+			body, err := img.ManifestBlob()
+			So(err, ShouldBeNil)
+
+			resp, err = resty.R().SetHeader("Content-Type", "application/vnd.oci.image.manifest.v1+json").
+				SetBody(body).Put(baseURL + "/v2/negative5/manifests/" + godigest.FromBytes([]byte("x")).String())
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 400)
+		})
+
+		// this is an additional test for repository names (alphanumeric)
+		compliance.Workflow(config, "Repository names", func() {
+			Print("\nRepository names")
+			// create a blob/layer
+			resp, err := resty.R().Post(baseURL + "/v2/repotest/blobs/uploads/")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 202)
+			resp, err = resty.R().Post(baseURL + "/v2/repotest123/blobs/uploads/")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 202)
+		})
+	})
 }
 
-func validateMinifyRawJSON(rawJSON string) string {
-	var j interface{}
+// errorCodes returns the codes of the errors in a response's body.
+func errorCodes(resp *resty.Response) []string {
+	var e api.ErrorList
 
-	err := json.Unmarshal([]byte(rawJSON), &j)
-	if err != nil {
-		panic(err)
+	if err := json.Unmarshal(resp.Body(), &e); err != nil {
+		return nil
 	}
 
-	rawJSONBytesMinified, err := json.Marshal(j)
-	if err != nil {
-		panic(err)
+	codes := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		codes = append(codes, err.Code)
 	}
 
-	return string(rawJSONBytesMinified)
+	return codes
 }
@@ -2,17 +2,18 @@ package v1_0_0_test
 
 import (
 	"context"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
+	"strings"
 	"testing"
-	"time"
 
 	"github.com/anuvu/zot/pkg/api"
 	"github.com/anuvu/zot/pkg/compliance"
 	"github.com/anuvu/zot/pkg/compliance/v1_0_0"
-	"github.com/phayes/freeport"
-	"gopkg.in/resty.v1"
 )
 
 // nolint: gochecknoglobals
@@ -39,19 +40,122 @@ func TestWorkflowsOutputJSON(t *testing.T) {
 	})
 }
 
-// start local server on random open port.
-func startServer() (*api.Controller, string) {
-	portInt, err := freeport.GetFreePort()
+func TestWorkflowsReports(t *testing.T) {
+	ctrl, randomPort := startServer()
+	defer stopServer(ctrl)
+
+	dir, err := ioutil.TempDir("", "oci-repo-report")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &compliance.Config{
+		Address:     listenAddress,
+		Port:        randomPort,
+		JSONReport:  path.Join(dir, "report.json"),
+		JUnitReport: path.Join(dir, "report.xml"),
+	}
+	v1_0_0.CheckWorkflows(t, config)
+
+	buf, err := ioutil.ReadFile(config.JSONReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report compliance.Report
+	if err := json.Unmarshal(buf, &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Version != "v1.0.0" || report.Passed == 0 || report.Failed != 0 {
+		t.Errorf("unexpected report: %d passed, %d failed of %s", report.Passed, report.Failed, report.Version)
+	}
+
+	buf, err = ioutil.ReadFile(config.JUnitReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xml.Unmarshal(buf, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWorkflowsSubset(t *testing.T) {
+	ctrl, randomPort := startServer()
+	defer stopServer(ctrl)
+
+	dir, err := ioutil.TempDir("", "oci-repo-report")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &compliance.Config{
+		Address:           listenAddress,
+		Port:              randomPort,
+		JSONReport:        path.Join(dir, "report.json"),
+		Exclude:           []string{"Monolithic*"},
+		SkipDelete:        true,
+		SkipChunkedUpload: true,
+	}
+	v1_0_0.CheckWorkflows(t, config)
+
+	buf, err := ioutil.ReadFile(config.JSONReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report compliance.Report
+	if err := json.Unmarshal(buf, &report); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range report.Results {
+		if strings.Contains(r.Name, "Monolithic") || strings.Contains(r.Name, "Chunked") ||
+			strings.Contains(r.Name, "delete") {
+			if r.Passed != 0 {
+				t.Errorf("%s not skipped", r.Name)
+			}
+		}
+	}
+}
+
+func TestWorkflowsBasicAuth(t *testing.T) {
+	f, err := ioutil.TempFile("", "htpasswd-")
 	if err != nil {
 		panic(err)
 	}
+	defer os.Remove(f.Name())
 
-	randomPort := fmt.Sprintf("%d", portInt)
-	fmt.Println(randomPort)
+	// bcrypt(username="test", passwd="test")
+	if _, err := f.WriteString("test:$2y$05$hlbSXDp6hzDLu6VwACS39ORvVRpr3OMR4RlJ31jtlaOEGnPjKZI1m\n"); err != nil {
+		panic(err)
+	}
+	f.Close()
 
 	config := api.NewConfig()
+	config.HTTP.Auth = &api.AuthConfig{HTPasswd: api.AuthHTPasswd{Path: f.Name()}}
+
+	ctrl, randomPort := startServerWithConfig(config)
+	defer stopServer(ctrl)
+
+	v1_0_0.CheckWorkflows(t, &compliance.Config{
+		URL:      fmt.Sprintf("http://%s:%s/", listenAddress, randomPort),
+		Username: "test",
+		Password: "test",
+	})
+}
+
+// start local server on random open port.
+func startServer() (*api.Controller, string) {
+	return startServerWithConfig(api.NewConfig())
+}
+
+func startServerWithConfig(config *api.Config) (*api.Controller, string) {
 	config.HTTP.Address = listenAddress
-	config.HTTP.Port = randomPort
+	config.HTTP.Port = "0"
 	ctrl := api.NewController(config)
 
 	dir, err := ioutil.TempDir("", "oci-repo-test")
@@ -61,30 +165,16 @@ func startServer() (*api.Controller, string) {
 
 	ctrl.Config.Storage.RootDirectory = dir
 
-	go func() {
-		// this blocks
-		if err := ctrl.Run(); err != nil {
-			return
-		}
-	}()
-
-	baseURL := fmt.Sprintf("http://%s:%s", listenAddress, randomPort)
-
-	for {
-		// poll until ready
-		resp, _ := resty.R().Get(baseURL)
-		if resp.StatusCode() == 404 {
-			break
-		}
-
-		time.Sleep(100 * time.Millisecond)
+	// returns once the server is listening
+	if err := ctrl.Start(context.Background()); err != nil {
+		panic(err)
 	}
 
-	return ctrl, randomPort
+	return ctrl, fmt.Sprintf("%d", ctrl.Port())
 }
 
 func stopServer(ctrl *api.Controller) {
-	err := ctrl.Server.Shutdown(context.Background())
+	err := ctrl.Stop(context.Background())
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,392 @@
+// nolint: dupl
+package v1_1_0 // nolint:stylecheck,golint
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/anuvu/zot/pkg/api"
+	"github.com/anuvu/zot/pkg/compliance"
+	"github.com/anuvu/zot/pkg/test"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	. "github.com/smartystreets/goconvey/convey" // nolint:golint,stylecheck
+	"gopkg.in/resty.v1"
+)
+
+const (
+	// MediaTypeEmptyJSON is that of the empty JSON object, used as config of artifacts without one.
+	MediaTypeEmptyJSON = "application/vnd.oci.empty.v1+json"
+
+	// SubjectHeader is set by registries which process the subject of pushed manifests.
+	SubjectHeader = "OCI-Subject"
+
+	// FiltersAppliedHeader lists the filters applied by registries to referrers.
+	FiltersAppliedHeader = "OCI-Filters-Applied"
+
+	artifactType      = "application/vnd.zot.compliance.test"
+	otherArtifactType = "application/vnd.zot.compliance.other"
+)
+
+// Descriptor is an ispec.Descriptor which may have an artifact type, as of image-spec v1.1.
+type Descriptor struct {
+	MediaType    string            `json:"mediaType,omitempty"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Digest       godigest.Digest   `json:"digest"`
+	Size         int64             `json:"size"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// Manifest is an ispec.Manifest which may have an artifact type and a subject, as of image-spec v1.1.
+type Manifest struct {
+	specs.Versioned
+
+	MediaType    string            `json:"mediaType,omitempty"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Config       Descriptor        `json:"config"`
+	Layers       []Descriptor      `json:"layers"`
+	Subject      *Descriptor       `json:"subject,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// Index is an ispec.Index whose manifests may have an artifact type, as returned by the referrers API.
+type Index struct {
+	specs.Versioned
+
+	MediaType string       `json:"mediaType,omitempty"`
+	Manifests []Descriptor `json:"manifests"`
+}
+
+func Location(baseURL string, resp *resty.Response) string {
+	// see v1_0_0.Location, registries return either absolute URLs or paths
+	loc := resp.Header().Get("Location")
+	if loc[0] == '/' {
+		return baseURL + loc
+	}
+
+	return loc
+}
+
+// NextLink returns the URL of the next page of a list from its Link header, if any.
+func NextLink(baseURL string, resp *resty.Response) string {
+	link := resp.Header().Get("Link")
+	if link == "" {
+		return ""
+	}
+
+	// as per RFC 5988, e.g. </v2/_catalog?n=2&last=b>; rel="next"
+	u := strings.Trim(strings.TrimSpace(strings.Split(link, ";")[0]), "<>")
+	if u[0] == '/' {
+		return baseURL + u
+	}
+
+	return u
+}
+
+func CheckWorkflows(t *testing.T, config *compliance.Config) {
+	if config == nil || (config.URL == "" && (config.Address == "" || config.Port == "")) {
+		panic("insufficient config")
+	}
+
+	restore, err := compliance.Connect(config)
+	if err != nil {
+		panic(err)
+	}
+	defer restore()
+
+	if config.Reporting() {
+		compliance.OutputJSONEnter()
+
+		defer compliance.OutputJSONExit(config, "v1.1.0")
+	}
+
+	baseURL := config.BaseURL()
+
+	fmt.Println("------------------------------")
+	fmt.Println("Checking for v1.1.0 compliance")
+	fmt.Println("------------------------------")
+
+	uploadBlob := func(repo string, content []byte) godigest.Digest {
+		digest := godigest.FromBytes(content)
+
+		resp, err := resty.R().Post(baseURL + "/v2/" + repo + "/blobs/uploads/")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, 202)
+		loc := Location(baseURL, resp)
+		So(loc, ShouldNotBeEmpty)
+
+		resp, err = resty.R().SetQueryParam("digest", digest.String()).
+			SetHeader("Content-Type", "application/octet-stream").SetBody(content).Put(loc)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, 201)
+
+		return digest
+	}
+
+	// artifact returns an artifact manifest of the given type, of a single layer, referring to subject if any
+	artifact := func(repo string, aType string, content []byte, subject *Descriptor) []byte {
+		cdigest := uploadBlob(repo, []byte("{}"))
+		ldigest := uploadBlob(repo, content)
+
+		m := Manifest{
+			MediaType:    ispec.MediaTypeImageManifest,
+			ArtifactType: aType,
+			Config: Descriptor{
+				MediaType: MediaTypeEmptyJSON,
+				Digest:    cdigest,
+				Size:      2,
+			},
+			Layers: []Descriptor{
+				{
+					MediaType: "application/octet-stream",
+					Digest:    ldigest,
+					Size:      int64(len(content)),
+				},
+			},
+			Subject: subject,
+		}
+		m.SchemaVersion = 2
+
+		body, err := json.Marshal(m)
+		So(err, ShouldBeNil)
+
+		return body
+	}
+
+	// list follows the Link headers from u, returning the entries of all pages under key
+	list := func(u string, key string) []string {
+		entries := []string{}
+
+		for u != "" {
+			resp, err := resty.R().Get(u)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 200)
+
+			var page map[string]json.RawMessage
+			err = json.Unmarshal(resp.Body(), &page)
+			So(err, ShouldBeNil)
+
+			var l []string
+			err = json.Unmarshal(page[key], &l)
+			So(err, ShouldBeNil)
+
+			entries = append(entries, l...)
+
+			if link := resp.Header().Get("Link"); link != "" {
+				So(link, ShouldStartWith, "<")
+				So(link, ShouldContainSubstring, `rel="next"`)
+			}
+
+			u = NextLink(baseURL, resp)
+		}
+
+		return entries
+	}
+
+	Convey("Make API calls to the controller", t, func(c C) {
+		compliance.Workflow(config, "Check version", func() {
+			Print("\nCheck version")
+			resp, err := resty.R().Get(baseURL + "/v2/")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 200)
+		})
+
+		compliance.Workflow(config, "Artifact manifests", func() {
+			Print("\nArtifact manifests")
+			body := artifact("artifact1", artifactType, []byte("this is an artifact"), nil)
+			digest := godigest.FromBytes(body)
+
+			resp, err := resty.R().SetHeader("Content-Type", ispec.MediaTypeImageManifest).
+				SetBody(body).Put(baseURL + "/v2/artifact1/manifests/1.0")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 201)
+			So(resp.Header().Get(api.DistContentDigestKey), ShouldEqual, digest.String())
+
+			// the manifest must be returned as pushed, artifact type included
+			for _, ref := range []string{"1.0", digest.String()} {
+				resp, err = resty.R().Get(baseURL + "/v2/artifact1/manifests/" + ref)
+				So(err, ShouldBeNil)
+				So(resp.StatusCode(), ShouldEqual, 200)
+				So(resp.Header().Get("Content-Type"), ShouldEqual, ispec.MediaTypeImageManifest)
+				So(resp.Header().Get(api.DistContentDigestKey), ShouldEqual, digest.String())
+				So(string(resp.Body()), ShouldEqual, string(body))
+			}
+
+			// and so must its empty config
+			resp, err = resty.R().Get(baseURL + "/v2/artifact1/blobs/" + godigest.FromBytes([]byte("{}")).String())
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 200)
+			So(string(resp.Body()), ShouldEqual, "{}")
+
+			resp, err = resty.R().Get(baseURL + "/v2/artifact1/tags/list")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 200)
+			So(resp.String(), ShouldContainSubstring, `"1.0"`)
+		})
+
+		compliance.Workflow(config, "Referrers", func() {
+			Print("\nReferrers")
+			img, err := test.GetRandomImage(15, 1)
+			So(err, ShouldBeNil)
+			err = test.UploadImage(img, baseURL, "referrers1", "1.0")
+			So(err, ShouldBeNil)
+
+			mblob, err := img.ManifestBlob()
+			So(err, ShouldBeNil)
+			subject := &Descriptor{
+				MediaType: ispec.MediaTypeImageManifest,
+				Digest:    godigest.FromBytes(mblob),
+				Size:      int64(len(mblob)),
+			}
+
+			// manifests referring to a subject must be accepted, whether or not it is processed
+			body := artifact("referrers1", artifactType, []byte("this is a signature"), subject)
+			digest := godigest.FromBytes(body)
+
+			resp, err := resty.R().SetHeader("Content-Type", ispec.MediaTypeImageManifest).
+				SetBody(body).Put(baseURL + "/v2/referrers1/manifests/" + digest.String())
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 201)
+			So(resp.Header().Get(api.DistContentDigestKey), ShouldEqual, digest.String())
+			if s := resp.Header().Get(SubjectHeader); s != "" {
+				So(s, ShouldEqual, subject.Digest.String())
+			}
+
+			resp, err = resty.R().Get(baseURL + "/v2/referrers1/manifests/" + digest.String())
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 200)
+			So(string(resp.Body()), ShouldEqual, string(body))
+
+			other := artifact("referrers1", otherArtifactType, []byte("this is an sbom"), subject)
+			resp, err = resty.R().SetHeader("Content-Type", ispec.MediaTypeImageManifest).
+				SetBody(other).Put(baseURL + "/v2/referrers1/manifests/" + godigest.FromBytes(other).String())
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 201)
+
+			resp, err = resty.R().Get(baseURL + "/v2/referrers1/referrers/" + subject.Digest.String())
+			So(err, ShouldBeNil)
+			// registries which don't support the referrers API must say so, leaving clients to
+			// fall back to the tag schema
+			So(resp.StatusCode(), ShouldBeIn, []int{200, 404})
+			if resp.StatusCode() == 404 {
+				Print("\nReferrers API not supported")
+				return
+			}
+
+			So(resp.Header().Get("Content-Type"), ShouldEqual, ispec.MediaTypeImageIndex)
+			var index Index
+			err = json.Unmarshal(resp.Body(), &index)
+			So(err, ShouldBeNil)
+			So(index.SchemaVersion, ShouldEqual, 2)
+			So(index.MediaType, ShouldEqual, ispec.MediaTypeImageIndex)
+			So(len(index.Manifests), ShouldEqual, 2)
+
+			found := false
+			for _, desc := range index.Manifests {
+				if desc.Digest == digest {
+					found = true
+					So(desc.MediaType, ShouldEqual, ispec.MediaTypeImageManifest)
+					So(desc.ArtifactType, ShouldEqual, artifactType)
+					So(desc.Size, ShouldEqual, len(body))
+				}
+			}
+			So(found, ShouldBeTrue)
+
+			// filtering is optional, but must be reported
+			resp, err = resty.R().SetQueryParam("artifactType", artifactType).
+				Get(baseURL + "/v2/referrers1/referrers/" + subject.Digest.String())
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 200)
+			index = Index{}
+			err = json.Unmarshal(resp.Body(), &index)
+			So(err, ShouldBeNil)
+			if resp.Header().Get(FiltersAppliedHeader) == "artifactType" {
+				So(len(index.Manifests), ShouldEqual, 1)
+				So(index.Manifests[0].Digest, ShouldEqual, digest)
+			} else {
+				So(len(index.Manifests), ShouldEqual, 2)
+			}
+
+			// nothing referring to a manifest isn't an error
+			resp, err = resty.R().Get(baseURL + "/v2/referrers1/referrers/" + godigest.FromString("x").String())
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 200)
+			index = Index{}
+			err = json.Unmarshal(resp.Body(), &index)
+			So(err, ShouldBeNil)
+			So(len(index.Manifests), ShouldEqual, 0)
+		})
+
+		compliance.Workflow(config, "Tags pagination", func() {
+			Print("\nTags pagination")
+			img, err := test.GetRandomImage(15, 1)
+			So(err, ShouldBeNil)
+
+			for _, tag := range []string{"e", "b", "d", "a", "c"} {
+				err := test.UploadImage(img, baseURL, "page1", tag)
+				So(err, ShouldBeNil)
+			}
+
+			// tags are listed in lexical order
+			all := list(baseURL+"/v2/page1/tags/list", "tags")
+			So(all, ShouldResemble, []string{"a", "b", "c", "d", "e"})
+
+			for n := 1; n <= 5; n++ {
+				So(list(fmt.Sprintf("%s/v2/page1/tags/list?n=%d", baseURL, n), "tags"), ShouldResemble, all)
+			}
+
+			// last needn't be one of the tags
+			resp, err := resty.R().Get(baseURL + "/v2/page1/tags/list?n=2&last=b0")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 200)
+			var tags api.ImageTags
+			err = json.Unmarshal(resp.Body(), &tags)
+			So(err, ShouldBeNil)
+			So(tags.Tags, ShouldResemble, []string{"c", "d"})
+
+			resp, err = resty.R().Get(baseURL + "/v2/page1/tags/list?n=2&last=z")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 200)
+			So(resp.Header().Get("Link"), ShouldBeEmpty)
+			tags = api.ImageTags{}
+			err = json.Unmarshal(resp.Body(), &tags)
+			So(err, ShouldBeNil)
+			So(len(tags.Tags), ShouldEqual, 0)
+		})
+
+		compliance.Workflow(config, "Catalog pagination", func() {
+			Print("\nCatalog pagination")
+			img, err := test.GetRandomImage(15, 1)
+			So(err, ShouldBeNil)
+
+			for _, repo := range []string{"page2/c", "page2/a", "page2/b"} {
+				err := test.UploadImage(img, baseURL, repo, "1.0")
+				So(err, ShouldBeNil)
+			}
+
+			all := list(baseURL+"/v2/_catalog", "repositories")
+			So(sort.StringsAreSorted(all), ShouldBeTrue)
+			So(all, ShouldContain, "page2/a")
+			So(all, ShouldContain, "page2/b")
+			So(all, ShouldContain, "page2/c")
+
+			So(list(baseURL+"/v2/_catalog?n=1", "repositories"), ShouldResemble, all)
+			So(list(baseURL+"/v2/_catalog?n=2", "repositories"), ShouldResemble, all)
+
+			// last needn't be one of the repositories
+			resp, err := resty.R().Get(baseURL + "/v2/_catalog?n=2&last=" + url.QueryEscape("page2/a0"))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode(), ShouldEqual, 200)
+			var repos api.RepositoryList
+			err = json.Unmarshal(resp.Body(), &repos)
+			So(err, ShouldBeNil)
+			So(len(repos.Repositories), ShouldBeGreaterThan, 0)
+			So(repos.Repositories[0], ShouldEqual, "page2/b")
+		})
+	})
+}
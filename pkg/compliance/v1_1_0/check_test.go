@@ -0,0 +1,71 @@
+package v1_1_0_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/anuvu/zot/pkg/api"
+	"github.com/anuvu/zot/pkg/compliance"
+	"github.com/anuvu/zot/pkg/compliance/v1_1_0"
+)
+
+// nolint: gochecknoglobals
+var (
+	listenAddress = "127.0.0.1"
+)
+
+func TestWorkflows(t *testing.T) {
+	ctrl, randomPort := startServer()
+	defer stopServer(ctrl)
+	v1_1_0.CheckWorkflows(t, &compliance.Config{
+		Address: listenAddress,
+		Port:    randomPort,
+	})
+}
+
+func TestWorkflowsOutputJSON(t *testing.T) {
+	ctrl, randomPort := startServer()
+	defer stopServer(ctrl)
+	v1_1_0.CheckWorkflows(t, &compliance.Config{
+		Address:    listenAddress,
+		Port:       randomPort,
+		OutputJSON: true,
+	})
+}
+
+// start local server on random open port.
+func startServer() (*api.Controller, string) {
+	config := api.NewConfig()
+	config.HTTP.Address = listenAddress
+	config.HTTP.Port = "0"
+	ctrl := api.NewController(config)
+
+	dir, err := ioutil.TempDir("", "oci-repo-test")
+	if err != nil {
+		panic(err)
+	}
+
+	ctrl.Config.Storage.RootDirectory = dir
+
+	// returns once the server is listening
+	if err := ctrl.Start(context.Background()); err != nil {
+		panic(err)
+	}
+
+	return ctrl, fmt.Sprintf("%d", ctrl.Port())
+}
+
+func stopServer(ctrl *api.Controller) {
+	err := ctrl.Stop(context.Background())
+	if err != nil {
+		panic(err)
+	}
+
+	err = os.RemoveAll(ctrl.Config.Storage.RootDirectory)
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,70 @@
+// Package events notifies other systems of registry activity, with events compatible with
+// those of docker/distribution.
+package events
+
+import (
+	"time"
+)
+
+// EventsMediaType is the media type of the envelopes events are delivered in.
+const EventsMediaType = "application/vnd.docker.distribution.events.v1+json"
+
+const (
+	ActionPush   = "push"
+	ActionPull   = "pull"
+	ActionDelete = "delete"
+	ActionMount  = "mount"
+)
+
+// Event describes an action on the contents of a repository.
+type Event struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Action    string    `json:"action"`
+	Target    Target    `json:"target"`
+	Request   Request   `json:"request"`
+	Actor     Actor     `json:"actor"`
+	Source    Source    `json:"source"`
+}
+
+// Target is the manifest or blob acted on.
+type Target struct {
+	MediaType  string `json:"mediaType,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+	Length     int64  `json:"length,omitempty"`
+	Repository string `json:"repository"`
+	URL        string `json:"url,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+}
+
+// Request is the HTTP request which led to an event.
+type Request struct {
+	ID        string `json:"id"`
+	Addr      string `json:"addr"`
+	Host      string `json:"host"`
+	Method    string `json:"method"`
+	UserAgent string `json:"useragent"`
+}
+
+// Actor is the user who made the request, if authenticated.
+type Actor struct {
+	Name string `json:"name,omitempty"`
+}
+
+// Source is the registry instance which emitted an event.
+type Source struct {
+	Addr       string `json:"addr"`
+	InstanceID string `json:"instanceID"`
+}
+
+// Envelope is the JSON document events are delivered in.
+type Envelope struct {
+	Events []Event `json:"events"`
+}
+
+// Sink delivers events to another system.
+type Sink interface {
+	Write(events ...Event) error
+	Close() error
+}
@@ -0,0 +1,61 @@
+package events
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+)
+
+// httpSink posts events to a webhook.
+type httpSink struct {
+	url           string
+	headers       map[string]string
+	serialization string
+	client        *http.Client
+	log           log.Logger
+}
+
+func newHTTPSink(url string, headers map[string]string, timeout time.Duration, serialization string,
+	log log.Logger) *httpSink {
+	return &httpSink{url: url, headers: headers, serialization: serialization,
+		client: &http.Client{Timeout: timeout}, log: log}
+}
+
+func (s *httpSink) Write(events ...Event) error {
+	body, mediaType, err := marshalEvents(events, s.serialization)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", mediaType)
+
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// any 2xx or 3xx response counts as delivered, as with docker/distribution
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		s.log.Warn().Str("url", s.url).Int("status", resp.StatusCode).Msg("events endpoint failed")
+		return errors.ErrEventsNotDelivered
+	}
+
+	return nil
+}
+
+func (s *httpSink) Close() error {
+	return nil
+}
@@ -0,0 +1,102 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+)
+
+const kafkaMediaType = "application/vnd.kafka.json.v2+json"
+
+// kafkaSink produces events to a Kafka topic through a Kafka REST proxy, keyed by repository
+// so that events of a repository stay ordered.
+type kafkaSink struct {
+	config KafkaConfig
+	client *http.Client
+	log    log.Logger
+}
+
+func newKafkaSink(config KafkaConfig, log log.Logger) *kafkaSink {
+	return &kafkaSink{config: config, client: &http.Client{Timeout: config.timeout()}, log: log}
+}
+
+type kafkaRecord struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+type kafkaRecords struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+type kafkaOffsets struct {
+	Offsets []struct {
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+func (s *kafkaSink) Write(events ...Event) error {
+	records := kafkaRecords{Records: make([]kafkaRecord, 0, len(events))}
+
+	for _, e := range events {
+		value, _, err := marshalEvent(e, s.config.Serialization)
+		if err != nil {
+			return err
+		}
+
+		records.Records = append(records.Records, kafkaRecord{Key: e.Target.Repository, Value: value})
+	}
+
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSuffix(s.config.URL, "/") + "/topics/" + s.config.Topic
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", kafkaMediaType)
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	if s.config.Username != "" {
+		req.SetBasicAuth(s.config.Username, s.config.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		s.log.Warn().Str("url", url).Int("status", resp.StatusCode).Msg("Kafka REST proxy failed")
+		return errors.ErrEventsNotDelivered
+	}
+
+	var offsets kafkaOffsets
+	if err := json.NewDecoder(resp.Body).Decode(&offsets); err != nil {
+		return err
+	}
+
+	for _, o := range offsets.Offsets {
+		if o.ErrorCode != nil {
+			s.log.Warn().Str("url", url).Int("code", *o.ErrorCode).Str("error", o.Error).Msg("Kafka produce failed")
+			return errors.ErrEventsNotDelivered
+		}
+	}
+
+	return nil
+}
+
+func (s *kafkaSink) Close() error {
+	return nil
+}
@@ -0,0 +1,178 @@
+package events
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+)
+
+// natsSink publishes events on a NATS subject, speaking the core NATS client protocol. Each
+// publish is followed by a PING, so that it's only considered delivered once the server has
+// processed it.
+type natsSink struct {
+	config NATSConfig
+	log    log.Logger
+
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newNATSSink(config NATSConfig, log log.Logger) *natsSink {
+	return &natsSink{config: config, log: log}
+}
+
+// natsConnect is the CONNECT message of the NATS protocol.
+type natsConnect struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	Lang      string `json:"lang"`
+	Version   string `json:"version"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+func (s *natsSink) Write(events ...Event) error {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			s.log.Warn().Err(err).Str("url", s.config.URL).Msg("unable to connect to NATS server")
+			return err
+		}
+	}
+
+	if err := s.conn.SetDeadline(time.Now().Add(s.config.timeout())); err != nil {
+		return s.fail(err)
+	}
+
+	w := bufio.NewWriter(s.conn)
+
+	for _, e := range events {
+		body, _, err := marshalEvent(e, s.config.Serialization)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "PUB %s %d\r\n", s.config.Subject, len(body))
+		_, _ = w.Write(body)
+		_, _ = w.WriteString("\r\n")
+	}
+
+	_, _ = w.WriteString("PING\r\n")
+
+	if err := w.Flush(); err != nil {
+		return s.fail(err)
+	}
+
+	return s.fail(s.waitPong())
+}
+
+func (s *natsSink) connect() error {
+	u, err := url.Parse(s.config.URL)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", u.Host, s.config.timeout())
+	if err != nil {
+		return err
+	}
+
+	s.conn, s.reader = conn, bufio.NewReader(conn)
+
+	if err := s.conn.SetDeadline(time.Now().Add(s.config.timeout())); err != nil {
+		return s.fail(err)
+	}
+
+	// the server speaks first
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		return s.fail(err)
+	}
+
+	if !strings.HasPrefix(line, "INFO ") {
+		return s.fail(errors.ErrEventsNotDelivered)
+	}
+
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+
+	if err := json.Unmarshal([]byte(line[len("INFO "):]), &info); err != nil {
+		return s.fail(err)
+	}
+
+	if u.Scheme == "tls" || info.TLSRequired {
+		host, _, _ := net.SplitHostPort(u.Host)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
+		s.conn, s.reader = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	connect, err := json.Marshal(natsConnect{
+		Name:      "zot",
+		Lang:      "go",
+		Version:   "1.0.0",
+		User:      s.config.Username,
+		Pass:      s.config.Password,
+		AuthToken: s.config.Token,
+	})
+	if err != nil {
+		return s.fail(err)
+	}
+
+	if _, err := fmt.Fprintf(s.conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		return s.fail(err)
+	}
+
+	return s.fail(s.waitPong())
+}
+
+// waitPong reads server messages until a PONG, answering its PINGs.
+func (s *natsSink) waitPong() error {
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := s.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			s.log.Warn().Str("url", s.config.URL).Str("error", line).Msg("NATS server error")
+			return errors.ErrEventsNotDelivered
+		}
+	}
+}
+
+// fail closes the connection if err is not nil, to reconnect on the next write.
+func (s *natsSink) fail(err error) error {
+	if err != nil && s.conn != nil {
+		s.conn.Close()
+		s.conn, s.reader = nil, nil
+	}
+
+	return err
+}
+
+func (s *natsSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	return s.conn.Close()
+}
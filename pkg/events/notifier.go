@@ -0,0 +1,333 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	guuid "github.com/gofrs/uuid"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+	defaultRetries = 3
+	defaultBackoff = time.Second
+
+	// events waiting to be delivered to an endpoint, beyond which they are dead-lettered.
+	queueSize = 1024
+)
+
+type Config struct {
+	Endpoints []EndpointConfig
+	NATS      []NATSConfig
+	Kafka     []KafkaConfig
+}
+
+// DeliveryConfig describes how events are delivered to a destination.
+type DeliveryConfig struct {
+	Timeout       time.Duration // of each attempt
+	Retries       int           // after the first attempt
+	Backoff       time.Duration // before the first retry, doubled before each next one
+	DeadLetter    string        // file undeliverable events are appended to, one per line, if set
+	Ignore        *IgnoreConfig
+	Serialization string // SerializationJSON, by default, or SerializationCloudEvents
+}
+
+// EndpointConfig locates a webhook events are posted to.
+type EndpointConfig struct {
+	Name           string
+	URL            string
+	Headers        map[string]string // e.g. Authorization
+	DeliveryConfig `mapstructure:",squash" yaml:",inline"`
+}
+
+// NATSConfig locates a NATS server, e.g. nats://localhost:4222 or tls://localhost:4222, and
+// the subject events are published on.
+type NATSConfig struct {
+	Name           string
+	URL            string
+	Subject        string
+	Username       string
+	Password       string
+	Token          string
+	DeliveryConfig `mapstructure:",squash" yaml:",inline"`
+}
+
+// KafkaConfig locates a Kafka REST proxy and the topic events are produced to, keyed by repository.
+type KafkaConfig struct {
+	Name           string
+	URL            string
+	Topic          string
+	Username       string
+	Password       string
+	DeliveryConfig `mapstructure:",squash" yaml:",inline"`
+}
+
+// IgnoreConfig filters out events not to deliver.
+type IgnoreConfig struct {
+	MediaTypes []string
+	Actions    []string
+}
+
+// Validate checks all destinations are located.
+func (c *Config) Validate(log log.Logger) error {
+	for _, e := range c.Endpoints {
+		if e.URL == "" {
+			log.Error().Str("name", e.Name).Msg("events endpoint URL is required")
+			return errors.ErrBadConfig
+		}
+
+		if err := e.validate(e.Name, log); err != nil {
+			return err
+		}
+	}
+
+	for _, n := range c.NATS {
+		if n.URL == "" || n.Subject == "" {
+			log.Error().Str("name", n.Name).Msg("events NATS URL and subject are required")
+			return errors.ErrBadConfig
+		}
+
+		if err := n.validate(n.Name, log); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range c.Kafka {
+		if k.URL == "" || k.Topic == "" {
+			log.Error().Str("name", k.Name).Msg("events Kafka URL and topic are required")
+			return errors.ErrBadConfig
+		}
+
+		if err := k.validate(k.Name, log); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d DeliveryConfig) validate(name string, log log.Logger) error {
+	if d.Retries < 0 || d.Timeout < 0 || d.Backoff < 0 {
+		log.Error().Str("name", name).Msg("invalid events delivery settings")
+		return errors.ErrBadConfig
+	}
+
+	switch d.Serialization {
+	case "", SerializationJSON, SerializationCloudEvents:
+	default:
+		log.Error().Str("name", name).Str("serialization", d.Serialization).Msg("unknown events serialization")
+		return errors.ErrBadConfig
+	}
+
+	return nil
+}
+
+// Notifier delivers events to each configured endpoint in the background.
+type Notifier struct {
+	source Source
+	queues []*queue
+	log    log.Logger
+}
+
+// NewNotifier returns a notifier of the destinations in config, marking events as emitted
+// by source.
+func NewNotifier(config *Config, source Source, log log.Logger) *Notifier {
+	n := &Notifier{source: source, log: log}
+
+	for _, e := range config.Endpoints {
+		n.AddSink(e.Name, newHTTPSink(e.URL, e.Headers, e.timeout(), e.Serialization, log), e.DeliveryConfig)
+	}
+
+	for _, c := range config.NATS {
+		n.AddSink(c.Name, newNATSSink(c, log), c.DeliveryConfig)
+	}
+
+	for _, c := range config.Kafka {
+		n.AddSink(c.Name, newKafkaSink(c, log), c.DeliveryConfig)
+	}
+
+	return n
+}
+
+func (d DeliveryConfig) timeout() time.Duration {
+	if d.Timeout == 0 {
+		return defaultTimeout
+	}
+
+	return d.Timeout
+}
+
+// AddSink adds a destination of events, delivered as described by config.
+func (n *Notifier) AddSink(name string, sink Sink, config DeliveryConfig) {
+	q := &queue{
+		name:       name,
+		sink:       sink,
+		ignore:     config.Ignore,
+		retries:    config.Retries,
+		backoff:    config.Backoff,
+		deadLetter: config.DeadLetter,
+		events:     make(chan Event, queueSize),
+		log:        n.log,
+	}
+
+	if q.retries == 0 {
+		q.retries = defaultRetries
+	}
+
+	if q.backoff == 0 {
+		q.backoff = defaultBackoff
+	}
+
+	n.queues = append(n.queues, q)
+}
+
+// Run delivers events until ctx is done, then makes one last attempt to deliver those
+// still queued before returning.
+func (n *Notifier) Run(ctx context.Context, wg *sync.WaitGroup) {
+	for _, q := range n.queues {
+		q := q
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			q.run(ctx)
+		}()
+	}
+}
+
+// Notify queues an event for delivery, without waiting for it.
+func (n *Notifier) Notify(event Event) {
+	if u, err := guuid.NewV4(); err == nil {
+		event.ID = u.String()
+	}
+
+	event.Timestamp = time.Now().UTC()
+	event.Source = n.source
+
+	for _, q := range n.queues {
+		if q.ignores(event) {
+			continue
+		}
+
+		select {
+		case q.events <- event:
+		default:
+			n.log.Warn().Str("endpoint", q.name).Msg("events queue is full")
+			q.drop(event)
+		}
+	}
+}
+
+type queue struct {
+	name       string
+	sink       Sink
+	ignore     *IgnoreConfig
+	retries    int
+	backoff    time.Duration
+	deadLetter string
+	events     chan Event
+	log        log.Logger
+}
+
+func (q *queue) run(ctx context.Context) {
+	defer func() {
+		if err := q.sink.Close(); err != nil {
+			q.log.Warn().Err(err).Str("endpoint", q.name).Msg("unable to close events sink")
+		}
+	}()
+
+	for {
+		select {
+		case event := <-q.events:
+			q.deliver(ctx, event)
+		case <-ctx.Done():
+			for {
+				select {
+				case event := <-q.events:
+					q.deliver(ctx, event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver writes an event to the sink, retrying with exponential backoff, unless ctx is done.
+func (q *queue) deliver(ctx context.Context, event Event) {
+	backoff := q.backoff
+
+	for attempt := 0; ; attempt++ {
+		err := q.sink.Write(event)
+		if err == nil {
+			return
+		}
+
+		if attempt == q.retries {
+			q.log.Error().Err(err).Str("endpoint", q.name).Str("id", event.ID).Msg("unable to deliver event")
+			q.drop(event)
+
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			q.drop(event)
+			return
+		case <-time.After(backoff):
+			backoff *= 2
+		}
+	}
+}
+
+// drop records an undeliverable event in the dead letter file, if any.
+func (q *queue) drop(event Event) {
+	if q.deadLetter == "" {
+		q.log.Warn().Str("endpoint", q.name).Str("id", event.ID).Msg("dropping undeliverable event")
+		return
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		q.log.Error().Err(err).Msg("unable to serialize event")
+		return
+	}
+
+	f, err := os.OpenFile(q.deadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		q.log.Error().Err(err).Str("deadLetter", q.deadLetter).Msg("unable to open dead letter file")
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		q.log.Error().Err(err).Str("deadLetter", q.deadLetter).Msg("unable to write dead letter file")
+	}
+}
+
+func (q *queue) ignores(event Event) bool {
+	if q.ignore == nil {
+		return false
+	}
+
+	for _, a := range q.ignore.Actions {
+		if a == event.Action {
+			return true
+		}
+	}
+
+	for _, m := range q.ignore.MediaTypes {
+		if m == event.Target.MediaType {
+			return true
+		}
+	}
+
+	return false
+}
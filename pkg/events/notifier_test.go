@@ -0,0 +1,155 @@
+package events_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/events"
+	"github.com/anuvu/zot/pkg/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type endpoint struct {
+	sync.Mutex
+	failures int // before succeeding
+	attempts int
+	events   []events.Event
+}
+
+func (e *endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.attempts++
+
+	if r.Header.Get("Content-Type") != events.EventsMediaType || r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if e.failures > 0 {
+		e.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+
+		return
+	}
+
+	var envelope events.Envelope
+	if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	e.events = append(e.events, envelope.Events...)
+}
+
+func TestNotifier(t *testing.T) {
+	Convey("Notify endpoints of events", t, func() {
+		dir, err := ioutil.TempDir("", "events-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.NewLogger("debug", "")
+
+		flaky := &endpoint{failures: 2}
+		flakyServer := httptest.NewServer(flaky)
+		defer flakyServer.Close()
+
+		down := &endpoint{failures: 1000}
+		downServer := httptest.NewServer(down)
+		defer downServer.Close()
+
+		headers := map[string]string{"Authorization": "Bearer token"}
+		deadLetter := path.Join(dir, "dead-letter.json")
+
+		config := &events.Config{Endpoints: []events.EndpointConfig{
+			{Name: "flaky", URL: flakyServer.URL, Headers: headers, DeliveryConfig: events.DeliveryConfig{
+				Backoff: 10 * time.Millisecond, Ignore: &events.IgnoreConfig{Actions: []string{events.ActionPull}}}},
+			{Name: "down", URL: downServer.URL, Headers: headers, DeliveryConfig: events.DeliveryConfig{
+				Backoff: 10 * time.Millisecond, Retries: 1, DeadLetter: deadLetter}},
+		}}
+		So(config.Validate(log), ShouldBeNil)
+
+		source := events.Source{Addr: "127.0.0.1:8080", InstanceID: "instance"}
+		n := events.NewNotifier(config, source, log)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		wg := &sync.WaitGroup{}
+		n.Run(ctx, wg)
+
+		n.Notify(events.Event{Action: events.ActionPush, Target: events.Target{Repository: "repo", Tag: "1.0"}})
+		n.Notify(events.Event{Action: events.ActionPull, Target: events.Target{Repository: "repo", Tag: "1.0"}})
+
+		for i := 0; i < 50; i++ {
+			flaky.Lock()
+			delivered := len(flaky.events)
+			flaky.Unlock()
+
+			if delivered > 0 {
+				break
+			}
+
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		cancel()
+		wg.Wait()
+
+		// retried until delivered, without the ignored pull
+		So(flaky.attempts, ShouldEqual, 3)
+		So(flaky.events, ShouldHaveLength, 1)
+		So(flaky.events[0].Action, ShouldEqual, events.ActionPush)
+		So(flaky.events[0].Target.Tag, ShouldEqual, "1.0")
+		So(flaky.events[0].Source, ShouldResemble, source)
+		So(flaky.events[0].ID, ShouldNotBeEmpty)
+
+		// dead-lettered after retrying
+		So(down.events, ShouldBeEmpty)
+
+		f, err := os.Open(deadLetter)
+		So(err, ShouldBeNil)
+		defer f.Close()
+
+		actions := []string{}
+		scanner := bufio.NewScanner(f)
+
+		for scanner.Scan() {
+			var event events.Event
+			So(json.Unmarshal(scanner.Bytes(), &event), ShouldBeNil)
+			actions = append(actions, event.Action)
+		}
+
+		So(actions, ShouldResemble, []string{events.ActionPush, events.ActionPull})
+	})
+
+	Convey("Validate events configuration", t, func() {
+		log := log.NewLogger("debug", "")
+
+		config := &events.Config{Endpoints: []events.EndpointConfig{{Name: "noURL"}}}
+		So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+
+		config = &events.Config{Endpoints: []events.EndpointConfig{{URL: "http://localhost",
+			DeliveryConfig: events.DeliveryConfig{Retries: -1}}}}
+		So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+
+		config = &events.Config{Endpoints: []events.EndpointConfig{{URL: "http://localhost",
+			DeliveryConfig: events.DeliveryConfig{Serialization: "xml"}}}}
+		So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+
+		config = &events.Config{NATS: []events.NATSConfig{{URL: "nats://localhost:4222"}}}
+		So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+
+		config = &events.Config{Kafka: []events.KafkaConfig{{URL: "http://localhost:8082"}}}
+		So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+	})
+}
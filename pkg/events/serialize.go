@@ -0,0 +1,80 @@
+package events
+
+import (
+	"encoding/json"
+)
+
+const (
+	// SerializationJSON serializes events as docker/distribution does.
+	SerializationJSON = "json"
+	// SerializationCloudEvents serializes events as CloudEvents 1.0, in structured JSON mode.
+	SerializationCloudEvents = "cloudevents"
+
+	cloudEventsMediaType      = "application/cloudevents+json"
+	cloudEventsBatchMediaType = "application/cloudevents-batch+json"
+
+	// cloudEventsTypePrefix is followed by the action in the type of CloudEvents.
+	cloudEventsTypePrefix = "io.zot.registry."
+)
+
+// cloudEvent wraps an event as a CloudEvent.
+type cloudEvent struct {
+	SpecVersion     string `json:"specversion"`
+	ID              string `json:"id"`
+	Source          string `json:"source"`
+	Type            string `json:"type"`
+	Subject         string `json:"subject,omitempty"`
+	Time            string `json:"time"`
+	DataContentType string `json:"datacontenttype"`
+	Data            Event  `json:"data"`
+}
+
+func newCloudEvent(e Event) cloudEvent {
+	subject := e.Target.Repository
+	if e.Target.Tag != "" {
+		subject += ":" + e.Target.Tag
+	} else if e.Target.Digest != "" {
+		subject += "@" + e.Target.Digest
+	}
+
+	return cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              e.ID,
+		Source:          "//" + e.Source.Addr + "/" + e.Source.InstanceID,
+		Type:            cloudEventsTypePrefix + e.Action,
+		Subject:         subject,
+		Time:            e.Timestamp.Format("2006-01-02T15:04:05.999999999Z07:00"),
+		DataContentType: "application/json",
+		Data:            e,
+	}
+}
+
+// marshalEvent serializes a single event, returning its media type.
+func marshalEvent(e Event, serialization string) ([]byte, string, error) {
+	if serialization == SerializationCloudEvents {
+		body, err := json.Marshal(newCloudEvent(e))
+		return body, cloudEventsMediaType, err
+	}
+
+	body, err := json.Marshal(e)
+
+	return body, "application/json", err
+}
+
+// marshalEvents serializes a batch of events, returning its media type.
+func marshalEvents(events []Event, serialization string) ([]byte, string, error) {
+	if serialization == SerializationCloudEvents {
+		batch := make([]cloudEvent, 0, len(events))
+		for _, e := range events {
+			batch = append(batch, newCloudEvent(e))
+		}
+
+		body, err := json.Marshal(batch)
+
+		return body, cloudEventsBatchMediaType, err
+	}
+
+	body, err := json.Marshal(Envelope{Events: events})
+
+	return body, EventsMediaType, err
+}
@@ -0,0 +1,236 @@
+package events_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anuvu/zot/pkg/events"
+	"github.com/anuvu/zot/pkg/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// natsServer accepts a single client and records what it publishes, speaking just enough of
+// the NATS protocol.
+type natsServer struct {
+	sync.Mutex
+	listener net.Listener
+	connect  map[string]interface{}
+	subjects []string
+	payloads [][]byte
+}
+
+func newNATSServer() (*natsServer, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &natsServer{listener: l}
+
+	go s.serve()
+
+	return s, nil
+}
+
+func (s *natsServer) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"auth_required\":true}\r\n")
+
+	r := bufio.NewReader(conn)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "CONNECT":
+			s.Lock()
+			_ = json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "CONNECT ")), &s.connect)
+			s.Unlock()
+		case "PING":
+			fmt.Fprintf(conn, "PONG\r\n")
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+
+			s.Lock()
+			s.subjects = append(s.subjects, fields[1])
+			s.payloads = append(s.payloads, payload[:size])
+			s.Unlock()
+		}
+	}
+}
+
+func (s *natsServer) published() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.payloads)
+}
+
+func TestStreams(t *testing.T) {
+	Convey("Publish events on NATS", t, func() {
+		log := log.NewLogger("debug", "")
+
+		server, err := newNATSServer()
+		So(err, ShouldBeNil)
+		defer server.listener.Close()
+
+		config := &events.Config{NATS: []events.NATSConfig{{
+			Name:    "nats",
+			URL:     "nats://" + server.listener.Addr().String(),
+			Subject: "zot.events",
+			Token:   "token",
+			DeliveryConfig: events.DeliveryConfig{
+				Backoff: 10 * time.Millisecond, Serialization: events.SerializationCloudEvents},
+		}}}
+		So(config.Validate(log), ShouldBeNil)
+
+		source := events.Source{Addr: "127.0.0.1:8080", InstanceID: "instance"}
+		n := events.NewNotifier(config, source, log)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		wg := &sync.WaitGroup{}
+		n.Run(ctx, wg)
+
+		n.Notify(events.Event{Action: events.ActionPush, Target: events.Target{Repository: "repo", Tag: "1.0"}})
+		n.Notify(events.Event{Action: events.ActionDelete, Target: events.Target{Repository: "repo", Digest: "sha256:0"}})
+
+		for i := 0; i < 50 && server.published() < 2; i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		cancel()
+		wg.Wait()
+
+		So(server.connect["auth_token"], ShouldEqual, "token")
+		So(server.subjects, ShouldResemble, []string{"zot.events", "zot.events"})
+
+		var ce map[string]interface{}
+		So(json.Unmarshal(server.payloads[0], &ce), ShouldBeNil)
+		So(ce["specversion"], ShouldEqual, "1.0")
+		So(ce["type"], ShouldEqual, "io.zot.registry.push")
+		So(ce["source"], ShouldEqual, "//127.0.0.1:8080/instance")
+		So(ce["subject"], ShouldEqual, "repo:1.0")
+		So(ce["id"], ShouldNotBeEmpty)
+
+		So(json.Unmarshal(server.payloads[1], &ce), ShouldBeNil)
+		So(ce["type"], ShouldEqual, "io.zot.registry.delete")
+		So(ce["subject"], ShouldEqual, "repo@sha256:0")
+	})
+
+	Convey("Produce events to Kafka", t, func() {
+		log := log.NewLogger("debug", "")
+
+		var lock sync.Mutex
+
+		attempts := 0
+		keys := []string{}
+		received := []events.Event{}
+
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			attempts++
+
+			username, password, _ := r.BasicAuth()
+			if r.URL.Path != "/topics/registry" || username != "user" || password != "pass" ||
+				r.Header.Get("Content-Type") != "application/vnd.kafka.json.v2+json" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			// the first produce fails on the broker side
+			if attempts == 1 {
+				_, _ = w.Write([]byte(`{"offsets":[{"partition":null,"offset":null,"error_code":50301,` +
+					`"error":"broker unavailable"}]}`))
+				return
+			}
+
+			var records struct {
+				Records []struct {
+					Key   string
+					Value events.Event
+				}
+			}
+			if err := json.NewDecoder(r.Body).Decode(&records); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			for _, record := range records.Records {
+				keys = append(keys, record.Key)
+				received = append(received, record.Value)
+			}
+
+			_, _ = w.Write([]byte(`{"offsets":[{"partition":0,"offset":1}]}`))
+		}))
+		defer proxy.Close()
+
+		config := &events.Config{Kafka: []events.KafkaConfig{{
+			Name:           "kafka",
+			URL:            proxy.URL,
+			Topic:          "registry",
+			Username:       "user",
+			Password:       "pass",
+			DeliveryConfig: events.DeliveryConfig{Backoff: 10 * time.Millisecond},
+		}}}
+		So(config.Validate(log), ShouldBeNil)
+
+		n := events.NewNotifier(config, events.Source{}, log)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		wg := &sync.WaitGroup{}
+		n.Run(ctx, wg)
+
+		n.Notify(events.Event{Action: events.ActionPull, Target: events.Target{Repository: "repo", Tag: "1.0"}})
+
+		for i := 0; i < 50; i++ {
+			lock.Lock()
+			delivered := len(received)
+			lock.Unlock()
+
+			if delivered > 0 {
+				break
+			}
+
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		cancel()
+		wg.Wait()
+
+		So(attempts, ShouldEqual, 2)
+		So(keys, ShouldResemble, []string{"repo"})
+		So(received[0].Action, ShouldEqual, events.ActionPull)
+		So(received[0].Target.Tag, ShouldEqual, "1.0")
+	})
+}
@@ -0,0 +1,300 @@
+// Package eviction keeps the images cached from upstream registries within a size budget,
+// evicting those least recently pulled.
+package eviction
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/bus"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/dustin/go-humanize"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// how often the budget is enforced, if not configured.
+const defaultInterval = 5 * time.Minute
+
+type Config struct {
+	MaxSize  string // total size of cached images, e.g. "50GB"
+	Interval time.Duration
+	Pinned   []string // glob patterns matching repositories never evicted
+}
+
+// Validate checks the budget and repository patterns are well-formed.
+func (c *Config) Validate(log log.Logger) error {
+	if _, err := humanize.ParseBytes(c.MaxSize); err != nil {
+		log.Error().Err(err).Str("maxSize", c.MaxSize).Msg("invalid eviction max size")
+		return errors.ErrBadConfig
+	}
+
+	if c.Interval < 0 {
+		log.Error().Dur("interval", c.Interval).Msg("invalid eviction interval")
+		return errors.ErrBadConfig
+	}
+
+	for _, p := range c.Pinned {
+		if _, err := path.Match(p, ""); err != nil {
+			log.Error().Err(err).Str("pinned", p).Msg("invalid pinned repositories pattern")
+			return errors.ErrBadConfig
+		}
+	}
+
+	return nil
+}
+
+// Evictor removes the least recently pulled images of a store once they outgrow the budget.
+// Pulls are recorded as they go through ImageStore, and pushes as they are published on the
+// bus; images never pulled since the evictor started count as pulled when it first saw them.
+type Evictor struct {
+	config  *Config
+	maxSize uint64
+	is      storage.ImageStore
+	log     log.Logger
+
+	lock   sync.Mutex
+	pulled map[string]time.Time // by repository and digest
+}
+
+// NewEvictor returns an evictor of the images of is, with a valid config.
+func NewEvictor(config *Config, is storage.ImageStore, log log.Logger) *Evictor {
+	maxSize, _ := humanize.ParseBytes(config.MaxSize)
+
+	return &Evictor{config: config, maxSize: maxSize, is: is, log: log, pulled: map[string]time.Time{}}
+}
+
+// Touch records a pull of the image with the given manifest digest.
+func (e *Evictor) Touch(repo string, digest string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.pulled[repo+"@"+digest] = time.Now()
+}
+
+// Subscribe records the images pushed, by clients or mirroring, as just pulled.
+func (e *Evictor) Subscribe(b *bus.Bus) {
+	b.Subscribe(func(event bus.Event) {
+		e.Touch(event.Repository, event.Digest)
+	}, bus.ManifestPushed)
+}
+
+// Run enforces the budget in the background, until ctx is done.
+func (e *Evictor) Run(ctx context.Context, wg *sync.WaitGroup) {
+	interval := e.config.Interval
+	if interval == 0 {
+		interval = defaultInterval
+	}
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			if _, err := e.Evict(); err != nil {
+				e.log.Error().Err(err).Msg("unable to evict images")
+			}
+
+			select {
+			case <-ctx.Done():
+				e.log.Info().Msg("stopping image eviction")
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+type image struct {
+	repo   string
+	digest string
+	blobs  map[string]int64 // sizes by digest, including the manifest's
+	pulled time.Time
+}
+
+// Evict removes the least recently pulled images, but those of pinned repositories, until
+// the blobs of those left fit in the budget, returning the images removed as repo@digest.
+// Blobs are counted once however many repositories share them, as with deduplication, and
+// left for garbage collection to reclaim.
+func (e *Evictor) Evict() ([]string, error) {
+	images, err := e.images()
+	if err != nil {
+		return nil, err
+	}
+
+	// how many images reference each blob, and their total size
+	refs := map[string]int{}
+	sizes := map[string]int64{}
+
+	var total uint64
+
+	for _, img := range images {
+		for d, size := range img.blobs {
+			if refs[d] == 0 {
+				total += uint64(size)
+			}
+
+			refs[d]++
+			sizes[d] = size
+		}
+	}
+
+	evicted := []string{}
+
+	if total <= e.maxSize {
+		return evicted, nil
+	}
+
+	e.log.Info().Uint64("size", total).Uint64("maxSize", e.maxSize).Msg("evicting images over budget")
+
+	sort.SliceStable(images, func(i, j int) bool { return images[i].pulled.Before(images[j].pulled) })
+
+	for _, img := range images {
+		if total <= e.maxSize {
+			break
+		}
+
+		if e.pinned(img.repo) {
+			continue
+		}
+
+		e.log.Info().Str("repo", img.repo).Str("digest", img.digest).Time("pulled", img.pulled).Msg("evicting image")
+
+		if err := e.is.DeleteImageManifest(img.repo, img.digest); err != nil {
+			e.log.Error().Err(err).Str("repo", img.repo).Str("digest", img.digest).Msg("unable to evict image")
+			continue
+		}
+
+		for d := range img.blobs {
+			refs[d]--
+			if refs[d] == 0 {
+				total -= uint64(sizes[d])
+			}
+		}
+
+		e.lock.Lock()
+		delete(e.pulled, img.repo+"@"+img.digest)
+		e.lock.Unlock()
+
+		evicted = append(evicted, img.repo+"@"+img.digest)
+	}
+
+	if total > e.maxSize {
+		e.log.Warn().Uint64("size", total).Uint64("maxSize", e.maxSize).Msg("unable to evict enough images")
+	}
+
+	return evicted, nil
+}
+
+// images returns the images of all repositories, with when they were last pulled.
+func (e *Evictor) images() ([]image, error) {
+	repos, err := e.is.GetRepositories()
+	if err != nil {
+		return nil, err
+	}
+
+	images := []image{}
+
+	for _, repo := range repos {
+		buf, err := e.is.GetIndexContent(repo)
+		if err != nil {
+			return nil, err
+		}
+
+		var index ispec.Index
+		if err := json.Unmarshal(buf, &index); err != nil {
+			return nil, err
+		}
+
+		seen := map[string]bool{}
+
+		for _, desc := range index.Manifests {
+			if seen[desc.Digest.String()] || !storage.IsImageManifest(desc.MediaType) {
+				continue
+			}
+
+			seen[desc.Digest.String()] = true
+
+			buf, _, _, err := e.is.GetImageManifest(repo, desc.Digest.String())
+			if err != nil {
+				return nil, err
+			}
+
+			var manifest ispec.Manifest
+			if err := json.Unmarshal(buf, &manifest); err != nil {
+				return nil, err
+			}
+
+			img := image{repo: repo, digest: desc.Digest.String(), blobs: map[string]int64{
+				desc.Digest.String():            desc.Size,
+				manifest.Config.Digest.String(): manifest.Config.Size,
+			}}
+
+			for _, l := range manifest.Layers {
+				img.blobs[l.Digest.String()] = l.Size
+			}
+
+			images = append(images, img)
+		}
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	now := time.Now()
+	pulled := make(map[string]time.Time, len(images))
+
+	for i := range images {
+		key := images[i].repo + "@" + images[i].digest
+
+		t, ok := e.pulled[key]
+		if !ok {
+			t = now
+		}
+
+		images[i].pulled = t
+		pulled[key] = t
+	}
+
+	// forget images removed since
+	e.pulled = pulled
+
+	return images, nil
+}
+
+func (e *Evictor) pinned(repo string) bool {
+	for _, p := range e.config.Pinned {
+		if ok, _ := path.Match(p, repo); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ImageStore records the pulls of manifests of the wrapped store with an evictor.
+type ImageStore struct {
+	storage.ImageStore
+	evictor *Evictor
+}
+
+// NewImageStore returns a store recording the pulls of images of is with evictor.
+func NewImageStore(is storage.ImageStore, evictor *Evictor) *ImageStore {
+	return &ImageStore{ImageStore: is, evictor: evictor}
+}
+
+// GetImageManifest returns a manifest, recording the pull of its image.
+func (is *ImageStore) GetImageManifest(repo string, reference string) ([]byte, string, string, error) {
+	body, digest, mediaType, err := is.ImageStore.GetImageManifest(repo, reference)
+	if err == nil {
+		is.evictor.Touch(repo, digest)
+	}
+
+	return body, digest, mediaType, err
+}
@@ -0,0 +1,102 @@
+package eviction_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/eviction"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEviction(t *testing.T) {
+	Convey("Evict least recently pulled images", t, func() {
+		log := log.NewLogger("debug", "")
+		is := storage.NewImageStoreMem(log)
+
+		repos := []string{"cache/a", "cache/b", "cache/c"}
+		size := 0
+
+		for _, repo := range repos {
+			img, err := test.GetRandomImage(1000, 1)
+			So(err, ShouldBeNil)
+			So(test.WriteImageToStore(img, is, repo, "latest"), ShouldBeNil)
+
+			mblob, err := img.ManifestBlob()
+			So(err, ShouldBeNil)
+
+			cblob, err := img.ConfigBlob()
+			So(err, ShouldBeNil)
+
+			size = len(mblob) + len(cblob) + 1000
+		}
+
+		// room for two images
+		config := &eviction.Config{MaxSize: fmt.Sprintf("%dB", 2*size+size/2)}
+
+		pull := func(is storage.ImageStore, repo string) {
+			_, _, _, err := is.GetImageManifest(repo, "latest")
+			So(err, ShouldBeNil)
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		Convey("Least recently pulled first", func() {
+			So(config.Validate(log), ShouldBeNil)
+
+			e := eviction.NewEvictor(config, is, log)
+			tracked := eviction.NewImageStore(is, e)
+
+			// b was never pulled, so counts as pulled when first seen, after the others
+			pull(tracked, "cache/a")
+			pull(tracked, "cache/c")
+
+			evicted, err := e.Evict()
+			So(err, ShouldBeNil)
+			So(evicted, ShouldHaveLength, 1)
+
+			_, _, _, err = is.GetImageManifest("cache/a", "latest")
+			So(err, ShouldEqual, errors.ErrManifestNotFound)
+
+			// within budget
+			evicted, err = e.Evict()
+			So(err, ShouldBeNil)
+			So(evicted, ShouldBeEmpty)
+		})
+
+		Convey("Pinned repositories", func() {
+			config.Pinned = []string{"cache/a"}
+			So(config.Validate(log), ShouldBeNil)
+
+			e := eviction.NewEvictor(config, is, log)
+			tracked := eviction.NewImageStore(is, e)
+
+			pull(tracked, "cache/a")
+			pull(tracked, "cache/c")
+
+			_, err := e.Evict()
+			So(err, ShouldBeNil)
+
+			_, _, _, err = is.GetImageManifest("cache/a", "latest")
+			So(err, ShouldBeNil)
+
+			_, _, _, err = is.GetImageManifest("cache/c", "latest")
+			So(err, ShouldEqual, errors.ErrManifestNotFound)
+		})
+	})
+
+	Convey("Validate eviction configuration", t, func() {
+		log := log.NewLogger("debug", "")
+
+		for _, config := range []*eviction.Config{
+			{MaxSize: "lots"},
+			{MaxSize: "1GB", Interval: -time.Minute},
+			{MaxSize: "1GB", Pinned: []string{"["}},
+		} {
+			So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+		}
+	})
+}
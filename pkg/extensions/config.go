@@ -13,4 +13,29 @@ type SearchConfig struct {
 
 type CVEConfig struct {
 	UpdateInterval time.Duration // should be 2 hours or more, if not specified default be kept as 24 hours
+	ScanOnPush     bool          // scan images for vulnerabilities as they are pushed
+}
+
+// Enabled returns the names of the extensions enabled by config, among those compiled in.
+func Enabled(config *ExtensionConfig) []string {
+	enabled := []string{}
+
+	if config == nil {
+		return enabled
+	}
+
+	compiled := map[string]bool{}
+	for _, name := range Compiled() {
+		compiled[name] = true
+	}
+
+	if config.Search != nil && compiled["search"] {
+		enabled = append(enabled, "search")
+
+		if config.Search.CVE != nil && compiled["search.cve"] {
+			enabled = append(enabled, "search.cve")
+		}
+	}
+
+	return enabled
 }
@@ -0,0 +1,22 @@
+package extensions_test
+
+import (
+	"testing"
+
+	"github.com/anuvu/zot/pkg/extensions"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEnabled(t *testing.T) {
+	Convey("Only report the extensions enabled which are compiled in", t, func() {
+		So(extensions.Enabled(nil), ShouldBeEmpty)
+
+		enabled := extensions.Enabled(&extensions.ExtensionConfig{
+			Search: &extensions.SearchConfig{CVE: &extensions.CVEConfig{}}})
+		So(len(enabled), ShouldEqual, len(extensions.Compiled()))
+
+		for _, name := range enabled {
+			So(extensions.Compiled(), ShouldContain, name)
+		}
+	})
+}
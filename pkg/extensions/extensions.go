@@ -3,8 +3,15 @@
 package extensions
 
 import (
+	"context"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/anuvu/zot/pkg/bus"
 	"github.com/anuvu/zot/pkg/extensions/search"
 	"github.com/anuvu/zot/pkg/storage"
+	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 
 	"time"
@@ -13,10 +20,19 @@ import (
 	cveinfo "github.com/anuvu/zot/pkg/extensions/search/cve"
 
 	"github.com/anuvu/zot/pkg/log"
+	godigest "github.com/opencontainers/go-digest"
 )
 
+// how many pushed images may wait to be scanned before further ones are skipped.
+const scanQueueSize = 100
+
+// Compiled returns the names of the extensions built into this binary.
+func Compiled() []string {
+	return []string{"search", "search.cve"}
+}
+
 // DownloadTrivyDB ...
-func downloadTrivyDB(dbDir string, log log.Logger, updateInterval time.Duration) error {
+func downloadTrivyDB(ctx context.Context, dbDir string, log log.Logger, updateInterval time.Duration) error {
 	for {
 		log.Info().Msg("updating the CVE database")
 
@@ -27,12 +43,18 @@ func downloadTrivyDB(dbDir string, log log.Logger, updateInterval time.Duration)
 
 		log.Info().Str("DB update completed, next update scheduled after", updateInterval.String()).Msg("")
 
-		time.Sleep(updateInterval)
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("stopping CVE database updates")
+			return nil
+		case <-time.After(updateInterval):
+		}
 	}
 }
 
 // EnableExtensions ...
-func EnableExtensions(extension *ExtensionConfig, log log.Logger, rootDir string) {
+func EnableExtensions(ctx context.Context, wg *sync.WaitGroup, extension *ExtensionConfig, log log.Logger,
+	rootDir string, b *bus.Bus) {
 	if extension.Search != nil && extension.Search.CVE != nil {
 		defaultUpdateInterval, _ := time.ParseDuration("2h")
 
@@ -42,22 +64,135 @@ func EnableExtensions(extension *ExtensionConfig, log log.Logger, rootDir string
 			log.Warn().Msg("CVE update interval set to too-short interval <= 1, changing update duration to 2 hours and continuing.") // nolint: lll
 		}
 
+		wg.Add(1)
+
 		go func() {
-			err := downloadTrivyDB(rootDir, log,
+			defer wg.Done()
+
+			err := downloadTrivyDB(ctx, rootDir, log,
 				extension.Search.CVE.UpdateInterval)
 			if err != nil {
 				panic(err)
 			}
 		}()
+
+		if extension.Search.CVE.ScanOnPush {
+			scanOnPush(ctx, wg, b, rootDir, log)
+		}
 	} else {
 		log.Info().Msg("CVE config not provided, skipping CVE update")
 	}
 }
 
+// scanOnPush scans the images pushed by tag for vulnerabilities in the background, one at a
+// time, logging and publishing how many are found, until ctx is done.
+func scanOnPush(ctx context.Context, wg *sync.WaitGroup, b *bus.Bus, rootDir string, log log.Logger) {
+	pushed := make(chan bus.Event, scanQueueSize)
+
+	unsubscribe := b.Subscribe(func(event bus.Event) {
+		// indexes are scanned as their manifests are pushed, and images by tag only
+		if storage.IsImageIndex(event.MediaType) {
+			return
+		}
+
+		if _, err := godigest.Parse(event.Reference); err == nil {
+			return
+		}
+
+		select {
+		case pushed <- event:
+		default:
+			log.Warn().Str("repo", event.Repository).Str("tag", event.Reference).
+				Msg("too many images waiting to be scanned, skipping")
+		}
+	}, bus.ManifestPushed)
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		defer unsubscribe()
+
+		for {
+			select {
+			case <-ctx.Done():
+				log.Info().Msg("stopping scanning pushed images")
+				return
+			case event := <-pushed:
+				count, ok := scanImage(rootDir, event.Repository+":"+event.Reference, log)
+				if !ok {
+					continue
+				}
+
+				b.Publish(bus.Event{Type: bus.ImageScanned, Repository: event.Repository,
+					Reference: event.Reference, Digest: event.Digest, MediaType: event.MediaType,
+					Vulnerabilities: count})
+			}
+		}
+	}()
+}
+
+// scanImage returns how many vulnerabilities are found in an image, and false if it
+// couldn't be scanned.
+func scanImage(rootDir string, image string, log log.Logger) (int, bool) {
+	config, err := cveinfo.NewTrivyConfig(rootDir)
+	if err != nil {
+		log.Error().Err(err).Msg("unable to configure scanner")
+		return 0, false
+	}
+
+	config.TrivyConfig.Input = path.Join(rootDir, image)
+	cveInfo := cveinfo.CveInfo{Log: log, CveTrivyConfig: config}
+
+	if ok, _ := cveInfo.IsValidImageFormat(config.TrivyConfig.Input); !ok {
+		log.Debug().Str("image", image).Msg("image media type not supported for scanning")
+		return 0, false
+	}
+
+	results, err := cveinfo.ScanImage(config)
+	if err != nil {
+		log.Error().Err(err).Str("image", image).Msg("unable to scan pushed image")
+		return 0, false
+	}
+
+	count := 0
+	for _, result := range results {
+		count += len(result.Vulnerabilities)
+	}
+
+	log.Info().Str("image", image).Int("vulnerabilities", count).Msg("scanned pushed image")
+
+	return count, true
+}
+
+// Ready returns an error if the databases of the extensions enabled can't be accessed. The CVE
+// database may be missing, still downloading in the background, but must be readable once there.
+func Ready(extension *ExtensionConfig, rootDir string) error {
+	if extension == nil || extension.Search == nil || extension.Search.CVE == nil {
+		return nil
+	}
+
+	f, err := os.Open(cveinfo.DBPath(rootDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// CloseDB closes the CVE database.
+func CloseDB() error {
+	return cveinfo.CloseDB()
+}
+
 // SetupRoutes ...
-func SetupRoutes(router *mux.Router, rootDir string, imgStore *storage.ImageStore, log log.Logger) {
+func SetupRoutes(router *mux.Router, rootDir string, imgStore storage.ImageStore, log log.Logger) {
 	log.Info().Msg("setting up extensions routes")
 	resConfig := search.GetResolverConfig(rootDir, log, imgStore)
 	router.PathPrefix("/query").Methods("GET", "POST").
-		Handler(gqlHandler.NewDefaultServer(search.NewExecutableSchema(resConfig)))
+		Handler(handlers.CompressHandler(gqlHandler.NewDefaultServer(search.NewExecutableSchema(resConfig))))
 }
@@ -3,24 +3,43 @@
 package extensions
 
 import (
+	"context"
+	"sync"
 	"time"
 
+	"github.com/anuvu/zot/pkg/bus"
 	"github.com/anuvu/zot/pkg/log"
 	"github.com/anuvu/zot/pkg/storage"
 	"github.com/gorilla/mux"
 )
 
+// Compiled returns the names of the extensions built into this binary.
+func Compiled() []string {
+	return []string{}
+}
+
 // DownloadTrivyDB ...
-func downloadTrivyDB(dbDir string, log log.Logger, updateInterval time.Duration) error {
+func downloadTrivyDB(ctx context.Context, dbDir string, log log.Logger, updateInterval time.Duration) error {
 	return nil
 }
 
 // EnableExtensions ...
-func EnableExtensions(extension *ExtensionConfig, log log.Logger, rootDir string) {
+func EnableExtensions(ctx context.Context, wg *sync.WaitGroup, extension *ExtensionConfig, log log.Logger,
+	rootDir string, b *bus.Bus) {
 	log.Warn().Msg("skipping enabling extensions because given zot binary doesn't support any extensions, please build zot full binary for this feature")
 }
 
+// Ready returns nil, as there are no extension databases in this binary.
+func Ready(extension *ExtensionConfig, rootDir string) error {
+	return nil
+}
+
+// CloseDB returns nil, as there are no extension databases in this binary.
+func CloseDB() error {
+	return nil
+}
+
 // SetupRoutes ...
-func SetupRoutes(router *mux.Router, rootDir string, imgStore *storage.ImageStore, log log.Logger) {
+func SetupRoutes(router *mux.Router, rootDir string, imgStore storage.ImageStore, log log.Logger) {
 	log.Warn().Msg("skipping setting up extensions routes because given zot binary doesn't support any extensions, please build zot full binary for this feature")
 }
@@ -7,9 +7,11 @@ import (
 	"path"
 	"sort"
 	"strings"
+	"sync/atomic"
 
 	"github.com/anuvu/zot/errors"
 	"github.com/anuvu/zot/pkg/log"
+	"github.com/aquasecurity/trivy-db/pkg/db"
 	integration "github.com/aquasecurity/trivy/integration"
 	config "github.com/aquasecurity/trivy/integration/config"
 	"github.com/aquasecurity/trivy/pkg/report"
@@ -19,8 +21,14 @@ import (
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// whether trivy may have opened its database, which it keeps in a package variable, so that
+// closing it is safe.
+var dbUsed int32
+
 // UpdateCVEDb ...
 func UpdateCVEDb(dbDir string, log log.Logger) error {
+	atomic.StoreInt32(&dbUsed, 1)
+
 	config, err := config.NewConfig(dbDir)
 	if err != nil {
 		log.Error().Err(err).Msg("unable to get config")
@@ -36,11 +44,28 @@ func UpdateCVEDb(dbDir string, log log.Logger) error {
 	return nil
 }
 
+// DBPath returns where trivy keeps the CVE database it downloads into dir.
+func DBPath(dir string) string {
+	return path.Join(dir, "db", "trivy.db")
+}
+
+// CloseDB closes the database trivy opens to update it or scan images, if it has, waiting for the
+// transactions in progress.
+func CloseDB() error {
+	if atomic.LoadInt32(&dbUsed) == 0 {
+		return nil
+	}
+
+	return db.Close()
+}
+
 func NewTrivyConfig(dir string) (*config.Config, error) {
 	return config.NewConfig(dir)
 }
 
 func ScanImage(config *config.Config) (report.Results, error) {
+	atomic.StoreInt32(&dbUsed, 1)
+
 	return integration.ScanTrivyImage(config.TrivyConfig)
 }
 
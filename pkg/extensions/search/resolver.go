@@ -16,7 +16,7 @@ import (
 // Resolver ...
 type Resolver struct {
 	cveInfo  *cveinfo.CveInfo
-	imgStore *storage.ImageStore
+	imgStore storage.ImageStore
 	dir      string
 }
 
@@ -35,7 +35,7 @@ type cveDetail struct {
 }
 
 // GetResolverConfig ...
-func GetResolverConfig(dir string, log log.Logger, imgstorage *storage.ImageStore) Config {
+func GetResolverConfig(dir string, log log.Logger, imgstorage storage.ImageStore) Config {
 	config, err := cveinfo.NewTrivyConfig(dir)
 	if err != nil {
 		panic(err)
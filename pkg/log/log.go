@@ -1,8 +1,10 @@
 package log
 
 import (
+	"context"
 	"net/http"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -12,22 +14,22 @@ import (
 // Logger extends zerolog's Logger.
 type Logger struct {
 	zerolog.Logger
+	level *int32 // shared by the loggers derived from it, for SetLevel to change theirs too
 }
 
 func (l Logger) Println(v ...interface{}) {
 	l.Logger.Error().Msg("panic recovered")
 }
 
+// NewLogger returns a logger at the given level, writing to output (or stdout if empty).
+// It doesn't touch zerolog's global settings, so it is safe to use when zot is embedded.
 func NewLogger(level string, output string) Logger {
-	zerolog.TimeFieldFormat = time.RFC3339Nano
 	lvl, err := zerolog.ParseLevel(level)
 
 	if err != nil {
 		panic(err)
 	}
 
-	zerolog.SetGlobalLevel(lvl)
-
 	var log zerolog.Logger
 
 	if output == "" {
@@ -40,9 +42,45 @@ func NewLogger(level string, output string) Logger {
 		log = zerolog.New(file)
 	}
 
-	return Logger{Logger: log.With().Caller().Timestamp().Logger()}
+	// events are filtered by the shared level, rather than the logger's own, which copies keep,
+	// before being built
+	shared := int32(lvl)
+
+	return Logger{Logger: log.Level(zerolog.TraceLevel).Sample(levelSampler{level: &shared}).Hook(timestampHook).
+		With().Caller().Logger(), level: &shared}
+}
+
+// levelSampler samples the events at or above a level which may change, as zerolog checks
+// samplers before building events.
+type levelSampler struct {
+	level *int32
+}
+
+func (s levelSampler) Sample(lvl zerolog.Level) bool {
+	return lvl >= zerolog.Level(atomic.LoadInt32(s.level))
+}
+
+// SetLevel changes the level of the logger, and of those it's copied to, at runtime, e.g. on
+// reloading the configuration.
+func (l Logger) SetLevel(level string) error {
+	lvl, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	if l.level != nil {
+		atomic.StoreInt32(l.level, int32(lvl))
+	}
+
+	return nil
 }
 
+// timestampHook adds a RFC3339Nano timestamp without changing zerolog.TimeFieldFormat.
+// nolint: gochecknoglobals
+var timestampHook = zerolog.HookFunc(func(e *zerolog.Event, level zerolog.Level, msg string) {
+	e.Str(zerolog.TimestampFieldName, time.Now().Format(time.RFC3339Nano))
+})
+
 type statusWriter struct {
 	http.ResponseWriter
 	status int
@@ -65,6 +103,15 @@ func (w *statusWriter) Write(b []byte) (int, error) {
 	return n, err
 }
 
+type userKey struct{}
+
+// SetUser records the user a request is made by, once known, for its log entry to name them.
+func SetUser(r *http.Request, user string) {
+	if u, ok := r.Context().Value(userKey{}).(*string); ok {
+		*u = user
+	}
+}
+
 func SessionLogger(log Logger) mux.MiddlewareFunc {
 	l := log.With().Str("module", "http").Logger()
 
@@ -76,9 +123,10 @@ func SessionLogger(log Logger) mux.MiddlewareFunc {
 			raw := r.URL.RawQuery
 
 			sw := statusWriter{ResponseWriter: w}
+			user := new(string)
 
 			// Process request
-			next.ServeHTTP(&sw, r)
+			next.ServeHTTP(&sw, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
 
 			// Stop timer
 			end := time.Now()
@@ -91,7 +139,8 @@ func SessionLogger(log Logger) mux.MiddlewareFunc {
 			method := r.Method
 			headers := map[string][]string{}
 			for key, value := range r.Header {
-				if key == "Authorization" { // anonymize from logs
+				// anonymize from logs, API keys and session cookies as well
+				if key == "Authorization" || key == "X-Zot-Api-Key" || key == "Cookie" {
 					value = []string{"******"}
 				}
 				headers[key] = value
@@ -102,15 +151,20 @@ func SessionLogger(log Logger) mux.MiddlewareFunc {
 				path = path + "?" + raw
 			}
 
-			l.Info().
+			e := l.Info().
 				Str("clientIP", clientIP).
 				Str("method", method).
 				Str("path", path).
 				Int("statusCode", statusCode).
 				Str("latency", latency.String()).
 				Int("bodySize", bodySize).
-				Interface("headers", headers).
-				Msg("HTTP API")
+				Interface("headers", headers)
+
+			if *user != "" {
+				e = e.Str("user", *user)
+			}
+
+			e.Msg("HTTP API")
 		})
 	}
 }
@@ -0,0 +1,389 @@
+// Package metrics exposes the metrics of the registry to Prometheus, in its text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// DefaultPath is where metrics are served if no other path is configured.
+	DefaultPath = "/metrics"
+
+	// ContentType is the media type of the Prometheus text format.
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// durationBuckets are the upper bounds of the buckets of request durations, in seconds, up to
+// those of blob transfers.
+// nolint: gochecknoglobals
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Config configures the metrics endpoint.
+type Config struct {
+	// Path metrics are served at, DefaultPath if not set
+	Path string
+	// Protected puts the endpoint behind the authentication of the API, rather than ahead of it
+	Protected bool
+}
+
+// Validate checks the path isn't one of the API.
+func (c *Config) Validate(log log.Logger) error {
+	if c.Path != "" && (!strings.HasPrefix(c.Path, "/") || c.Path == "/" || strings.HasPrefix(c.Path, "/v2/")) {
+		log.Error().Str("path", c.Path).Msg("invalid metrics path")
+		return errors.ErrBadConfig
+	}
+
+	return nil
+}
+
+// Endpoint returns the path metrics are served at.
+func (c *Config) Endpoint() string {
+	if c.Path == "" {
+		return DefaultPath
+	}
+
+	return c.Path
+}
+
+// Metrics records the metrics of HTTP requests, and collects the others on scrape.
+type Metrics struct {
+	uploadBytes int64 // first, to be aligned for atomic operations
+
+	lock       sync.Mutex
+	requests   map[requestKey]int64       // by method, route and status code
+	durations  map[durationKey]*histogram // by method and route
+	collectors []collector                // in the order added
+	names      map[string]bool            // of the collectors
+}
+
+type requestKey struct {
+	method string
+	route  string
+	code   int
+}
+
+type durationKey struct {
+	method string
+	route  string
+}
+
+type histogram struct {
+	counts []int64 // by bucket, not cumulative
+	count  int64
+	sum    float64
+}
+
+// collector is a metric whose value is read on scrape.
+type collector struct {
+	name  string
+	help  string
+	kind  string // counter or gauge
+	value func() float64
+}
+
+// New returns metrics without any recorded yet.
+func New() *Metrics {
+	return &Metrics{requests: make(map[requestKey]int64), durations: make(map[durationKey]*histogram),
+		names: make(map[string]bool)}
+}
+
+// AddCounter adds a counter read from value on scrape, e.g. one kept by another package.
+func (m *Metrics) AddCounter(name string, help string, value func() float64) {
+	m.add(collector{name: name, help: help, kind: "counter", value: value})
+}
+
+// AddGauge adds a gauge read from value on scrape.
+func (m *Metrics) AddGauge(name string, help string, value func() float64) {
+	m.add(collector{name: name, help: help, kind: "gauge", value: value})
+}
+
+func (m *Metrics) add(c collector) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.names[c.name] {
+		panic("metric already added: " + c.name)
+	}
+
+	m.names[c.name] = true
+	m.collectors = append(m.collectors, c)
+}
+
+// Cached returns value, read at most once per interval, e.g. for a gauge expensive to read on
+// each scrape.
+func Cached(interval time.Duration, value func() float64) func() float64 {
+	var lock sync.Mutex
+
+	var last float64
+
+	var read time.Time
+
+	return func() float64 {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if read.IsZero() || time.Since(read) >= interval {
+			last = value()
+			read = time.Now()
+		}
+
+		return last
+	}
+}
+
+// Instrument is a middleware recording the count and duration of requests by route, and the
+// bytes of blobs uploaded.
+func (m *Metrics) Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := RouteOf(r)
+
+		if strings.Contains(route, "/blobs/uploads/") && r.Body != nil {
+			r.Body = &countingReader{ReadCloser: r.Body, count: &m.uploadBytes}
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+
+		next.ServeHTTP(sw, r)
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		m.observe(r.Method, route, sw.status, time.Since(start))
+	})
+}
+
+func (m *Metrics) observe(method string, route string, code int, duration time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.requests[requestKey{method: method, route: route, code: code}]++
+
+	h, ok := m.durations[durationKey{method: method, route: route}]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(durationBuckets))}
+		m.durations[durationKey{method: method, route: route}] = h
+	}
+
+	seconds := duration.Seconds()
+
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+
+	h.count++
+	h.sum += seconds
+}
+
+// RouteOf returns the template of the route a request matched, without the patterns of its
+// variables, e.g. /v2/{name}/manifests/{reference}.
+func RouteOf(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+
+	tpl, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+
+	var b strings.Builder
+
+	depth := 0
+	pattern := false
+
+	for _, c := range tpl {
+		switch {
+		case c == '{':
+			depth++
+
+			if depth == 1 {
+				pattern = false
+
+				b.WriteRune(c)
+			}
+		case c == '}':
+			depth--
+
+			if depth == 0 {
+				b.WriteRune(c)
+			}
+		case depth == 1 && c == ':':
+			pattern = true
+		case depth == 0 || (depth == 1 && !pattern):
+			b.WriteRune(c)
+		}
+	}
+
+	return b.String()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(http.StatusOK)
+
+	_ = m.Write(w)
+}
+
+// Write writes the metrics in the Prometheus text format.
+func (m *Metrics) Write(w io.Writer) error {
+	var b strings.Builder
+
+	m.writeRequests(&b)
+
+	writeHeader(&b, "zot_blob_upload_bytes_total", "Bytes of blobs uploaded.", "counter")
+	fmt.Fprintf(&b, "zot_blob_upload_bytes_total %d\n", atomic.LoadInt64(&m.uploadBytes))
+
+	m.lock.Lock()
+	collectors := append([]collector{}, m.collectors...)
+	m.lock.Unlock()
+
+	for _, c := range collectors {
+		writeHeader(&b, c.name, c.help, c.kind)
+		fmt.Fprintf(&b, "%s %s\n", c.name, formatFloat(c.value()))
+	}
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+func (m *Metrics) writeRequests(b *strings.Builder) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	requests := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		requests = append(requests, k)
+	}
+
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+
+		if a.method != b.method {
+			return a.method < b.method
+		}
+
+		return a.code < b.code
+	})
+
+	writeHeader(b, "zot_http_requests_total", "HTTP requests served, by method, route and status code.", "counter")
+
+	for _, k := range requests {
+		fmt.Fprintf(b, "zot_http_requests_total{method=%s,route=%s,code=\"%d\"} %d\n", quote(k.method),
+			quote(k.route), k.code, m.requests[k])
+	}
+
+	durations := make([]durationKey, 0, len(m.durations))
+	for k := range m.durations {
+		durations = append(durations, k)
+	}
+
+	sort.Slice(durations, func(i, j int) bool {
+		a, b := durations[i], durations[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+
+		return a.method < b.method
+	})
+
+	writeHeader(b, "zot_http_request_duration_seconds", "Durations of HTTP requests, by method and route.",
+		"histogram")
+
+	for _, k := range durations {
+		h := m.durations[k]
+		labels := fmt.Sprintf("method=%s,route=%s", quote(k.method), quote(k.route))
+
+		var cumulative int64
+
+		for i, bound := range durationBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(b, "zot_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels,
+				formatFloat(bound), cumulative)
+		}
+
+		fmt.Fprintf(b, "zot_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(b, "zot_http_request_duration_seconds_sum{%s} %s\n", labels, formatFloat(h.sum))
+		fmt.Fprintf(b, "zot_http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+}
+
+func writeHeader(b *strings.Builder, name string, help string, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// quote quotes a label value, escaping backslashes, double quotes and line feeds.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// countingReader adds the bytes read to count.
+type countingReader struct {
+	io.ReadCloser
+	count *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+
+	return n, err
+}
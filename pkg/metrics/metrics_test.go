@@ -0,0 +1,105 @@
+package metrics_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/metrics"
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfig(t *testing.T) {
+	Convey("Validate metrics configurations", t, func() {
+		log := log.NewLogger("debug", "")
+
+		So((&metrics.Config{}).Validate(log), ShouldBeNil)
+		So((&metrics.Config{}).Endpoint(), ShouldEqual, metrics.DefaultPath)
+		So((&metrics.Config{Path: "/internal/metrics"}).Validate(log), ShouldBeNil)
+		So((&metrics.Config{Path: "/internal/metrics"}).Endpoint(), ShouldEqual, "/internal/metrics")
+
+		for _, path := range []string{"metrics", "/", "/v2/metrics"} {
+			So((&metrics.Config{Path: path}).Validate(log), ShouldEqual, errors.ErrBadConfig)
+		}
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	Convey("Record and expose metrics", t, func() {
+		m := metrics.New()
+
+		router := mux.NewRouter()
+		router.Use(m.Instrument)
+		router.HandleFunc("/v2/{name:[a-z]+(?:/[a-z]{1,3})*}/manifests/{reference}",
+			func(w http.ResponseWriter, r *http.Request) {
+				if mux.Vars(r)["reference"] == "missing" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				_, _ = w.Write([]byte("manifest"))
+			})
+		router.HandleFunc("/v2/{name}/blobs/uploads/{session_id}", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusAccepted)
+		})
+
+		for _, path := range []string{"/v2/repo/manifests/1.0", "/v2/repo/abc/manifests/2.0",
+			"/v2/repo/manifests/missing"} {
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		}
+
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPatch,
+			"/v2/repo/blobs/uploads/uuid", bytes.NewReader(make([]byte, 1000))))
+
+		runs := 0.0
+		m.AddCounter("zot_test_runs_total", "Test runs.", func() float64 { return runs })
+
+		reads := 0
+		m.AddGauge("zot_test_usage_bytes", "Test usage.", metrics.Cached(time.Hour, func() float64 {
+			reads++
+			return 1.5
+		}))
+
+		So(func() { m.AddGauge("zot_test_usage_bytes", "Again.", nil) }, ShouldPanic)
+
+		runs = 2
+
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, metrics.DefaultPath, nil))
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Header().Get("Content-Type"), ShouldEqual, metrics.ContentType)
+
+		body := w.Body.String()
+		lines := strings.Split(body, "\n")
+
+		So(lines, ShouldContain, "# TYPE zot_http_requests_total counter")
+		So(lines, ShouldContain,
+			`zot_http_requests_total{method="GET",route="/v2/{name}/manifests/{reference}",code="200"} 2`)
+		So(lines, ShouldContain,
+			`zot_http_requests_total{method="GET",route="/v2/{name}/manifests/{reference}",code="404"} 1`)
+		So(lines, ShouldContain,
+			`zot_http_requests_total{method="PATCH",route="/v2/{name}/blobs/uploads/{session_id}",code="202"} 1`)
+		So(lines, ShouldContain, "# TYPE zot_http_request_duration_seconds histogram")
+		So(lines, ShouldContain,
+			`zot_http_request_duration_seconds_bucket{method="GET",route="/v2/{name}/manifests/{reference}",le="+Inf"} 3`)
+		So(lines, ShouldContain,
+			`zot_http_request_duration_seconds_count{method="GET",route="/v2/{name}/manifests/{reference}"} 3`)
+		So(lines, ShouldContain, "zot_blob_upload_bytes_total 1000")
+		So(lines, ShouldContain, "# TYPE zot_test_runs_total counter")
+		So(lines, ShouldContain, "zot_test_runs_total 2")
+		So(lines, ShouldContain, "# TYPE zot_test_usage_bytes gauge")
+		So(lines, ShouldContain, "zot_test_usage_bytes 1.5")
+
+		// read once however often scraped
+		So(m.Write(ioutil.Discard), ShouldBeNil)
+		So(reads, ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,602 @@
+// Package mirror periodically copies repositories of upstream registries into local storage.
+package mirror
+
+import (
+	"context"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/upstream"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// how often registries are mirrored, if not configured.
+const defaultPollInterval = time.Hour
+
+type Config struct {
+	Registries []RegistryConfig
+}
+
+// RegistryConfig locates an upstream registry, and selects what to mirror from it and how often.
+type RegistryConfig struct {
+	upstream.Config `mapstructure:",squash" yaml:",inline"`
+	Content         []ContentConfig // all repositories if empty
+	PollInterval    time.Duration
+	Pins            []PinConfig
+	// OnDemand copies images of the selected repositories as soon as they're pulled, if not
+	// mirrored yet, whatever their tag, and mirrors them from then on.
+	OnDemand bool
+}
+
+// PinConfig pins a mirrored image to a digest: if the upstream tag points to any other
+// manifest, it isn't mirrored, and the local copy is left as is.
+type PinConfig struct {
+	Repo   string
+	Tag    string
+	Digest string
+}
+
+// ContentConfig selects repositories, and their tags, to mirror.
+type ContentConfig struct {
+	Prefix  string   // glob pattern matching repository names, e.g. "library/*"
+	Exclude []string // glob patterns matching repository names not to mirror, e.g. "library/*-dev"
+	Tags    *TagsConfig
+}
+
+// TagsConfig selects the tags to mirror, all if empty.
+type TagsConfig struct {
+	Regex   string // tags to mirror
+	Exclude string // regex matching tags not to mirror, e.g. "^nightly-"
+	Semver  *SemverConfig
+}
+
+// SemverConfig selects only tags which are semantic versions, with an optional "v" prefix.
+type SemverConfig struct {
+	Constraint  string // e.g. ">= 1.2, < 3"
+	LatestPer   string // "major" or "minor", to only mirror the latest version of each
+	Prereleases bool   // whether to mirror versions such as 1.2.0-rc.1
+}
+
+// Validate checks the registries are located and their content filters are well-formed.
+func (c *Config) Validate(log log.Logger) error {
+	for _, r := range c.Registries {
+		if r.URL == "" {
+			log.Error().Msg("mirrored registry URL is required")
+			return errors.ErrBadConfig
+		}
+
+		if r.PollInterval < 0 {
+			log.Error().Str("url", r.URL).Dur("pollInterval", r.PollInterval).Msg("invalid mirror poll interval")
+			return errors.ErrBadConfig
+		}
+
+		for _, pin := range r.Pins {
+			if _, err := godigest.Parse(pin.Digest); err != nil || pin.Repo == "" || pin.Tag == "" {
+				log.Error().Err(err).Str("repo", pin.Repo).Str("tag", pin.Tag).Str("digest", pin.Digest).
+					Msg("invalid mirrored image pin")
+
+				return errors.ErrBadConfig
+			}
+		}
+
+		for _, content := range r.Content {
+			if _, err := path.Match(content.Prefix, ""); err != nil {
+				log.Error().Err(err).Str("prefix", content.Prefix).Msg("invalid mirrored repositories pattern")
+				return errors.ErrBadConfig
+			}
+
+			for _, exclude := range content.Exclude {
+				if _, err := path.Match(exclude, ""); err != nil {
+					log.Error().Err(err).Str("exclude", exclude).Msg("invalid excluded repositories pattern")
+					return errors.ErrBadConfig
+				}
+			}
+
+			if content.Tags != nil {
+				if err := content.Tags.validate(log); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (t *TagsConfig) validate(log log.Logger) error {
+	for _, r := range []string{t.Regex, t.Exclude} {
+		if _, err := regexp.Compile(r); err != nil {
+			log.Error().Err(err).Str("regex", r).Msg("invalid mirrored tags regex")
+			return errors.ErrBadConfig
+		}
+	}
+
+	if t.Semver == nil {
+		return nil
+	}
+
+	if t.Semver.Constraint != "" {
+		if _, err := semver.NewConstraint(t.Semver.Constraint); err != nil {
+			log.Error().Err(err).Str("constraint", t.Semver.Constraint).Msg("invalid mirrored tags semver constraint")
+			return errors.ErrBadConfig
+		}
+	}
+
+	switch t.Semver.LatestPer {
+	case "", latestPerMajor, latestPerMinor:
+	default:
+		log.Error().Str("latestPer", t.Semver.LatestPer).Msg("invalid mirrored tags semver latestPer")
+		return errors.ErrBadConfig
+	}
+
+	return nil
+}
+
+// Mirrorer mirrors registries into a store, on their own schedule, and on demand.
+type Mirrorer struct {
+	is  storage.ImageStore
+	log log.Logger
+
+	lock sync.Mutex // serializes on-demand copies, so concurrent pulls copy an image once
+
+	registriesLock sync.RWMutex
+	registries     []*registry        // replaced on reload
+	ctx            context.Context    // of Run, registries reloaded being mirrored until it's done
+	wg             *sync.WaitGroup    // of Run
+	stop           context.CancelFunc // stops mirroring the registries, once replaced
+}
+
+type registry struct {
+	config RegistryConfig
+	client *upstream.Client
+
+	lock      sync.Mutex
+	requested map[string][]string // tags copied on demand, by repository
+	lastSync  time.Time
+	lag       int
+	lastError string
+}
+
+// NewMirrorer returns a mirrorer of the registries of config into is.
+func NewMirrorer(config *Config, is storage.ImageStore, log log.Logger) (*Mirrorer, error) {
+	registries, err := newRegistries(config, log)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Mirrorer{is: is, log: log, registries: registries}, nil
+}
+
+func newRegistries(config *Config, log log.Logger) ([]*registry, error) {
+	registries := make([]*registry, 0, len(config.Registries))
+
+	for _, r := range config.Registries {
+		client, err := upstream.NewClient(r.Config, log)
+		if err != nil {
+			return nil, err
+		}
+
+		registries = append(registries, &registry{config: r, client: client, requested: map[string][]string{}})
+	}
+
+	return registries, nil
+}
+
+// Run mirrors each registry in the background, on its own schedule, until ctx is done.
+func (m *Mirrorer) Run(ctx context.Context, wg *sync.WaitGroup) {
+	m.registriesLock.Lock()
+	defer m.registriesLock.Unlock()
+
+	m.ctx, m.wg = ctx, wg
+	m.run()
+}
+
+// run mirrors the current registries until replaced, with the lock of registries held.
+func (m *Mirrorer) run() {
+	var ctx context.Context
+
+	ctx, m.stop = context.WithCancel(m.ctx)
+
+	for _, r := range m.registries {
+		interval := r.config.PollInterval
+		if interval == 0 {
+			interval = defaultPollInterval
+		}
+
+		r := r
+
+		m.wg.Add(1)
+
+		go func() {
+			defer m.wg.Done()
+
+			for {
+				r.poll(m.is, m.log)
+
+				select {
+				case <-ctx.Done():
+					m.log.Info().Str("upstream", r.client.URL()).Msg("stopping registry mirroring")
+					return
+				case <-time.After(interval):
+				}
+			}
+		}()
+	}
+}
+
+// Reload replaces the registries mirrored with those of a valid config, mirroring them from
+// then on, if running. Those still mirrored keep the images copied on demand and their status.
+// Whether images are copied on demand at all, or only pulled, is as it was when created.
+func (m *Mirrorer) Reload(config *Config) error {
+	apply, err := m.PrepareReload(config)
+	if err != nil {
+		return err
+	}
+
+	apply()
+
+	return nil
+}
+
+// PrepareReload returns the function replacing the registries mirrored as Reload does, which
+// can't fail, so that they are replaced along with other settings or not at all.
+func (m *Mirrorer) PrepareReload(config *Config) (func(), error) {
+	registries, err := newRegistries(config, m.log)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { m.replace(registries) }, nil
+}
+
+// replace replaces the registries mirrored.
+func (m *Mirrorer) replace(registries []*registry) {
+	// on-demand copies of the registries replaced are over
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.registriesLock.Lock()
+	defer m.registriesLock.Unlock()
+
+	for _, r := range registries {
+		for _, old := range m.registries {
+			if old.client.URL() != r.client.URL() {
+				continue
+			}
+
+			old.lock.Lock()
+			for repo, tags := range old.requested {
+				r.requested[repo] = append([]string{}, tags...)
+			}
+
+			r.lastSync, r.lag, r.lastError = old.lastSync, old.lag, old.lastError
+			old.lock.Unlock()
+
+			break
+		}
+	}
+
+	m.registries = registries
+
+	if m.stop != nil {
+		m.stop()
+		m.run()
+	}
+
+	m.log.Info().Int("registries", len(registries)).Msg("reloaded registries mirrored")
+}
+
+// current returns the registries mirrored.
+func (m *Mirrorer) current() []*registry {
+	m.registriesLock.RLock()
+	defer m.registriesLock.RUnlock()
+
+	return m.registries
+}
+
+// Status returns the health of mirroring each registry.
+func (m *Mirrorer) Status() []upstream.Status {
+	registries := m.current()
+	statuses := make([]upstream.Status, 0, len(registries))
+
+	for _, r := range registries {
+		r.lock.Lock()
+		status := upstream.Status{Kind: "mirror", URL: r.client.URL(), Lag: r.lag, LastError: r.lastError,
+			BytesTransferred: r.client.Transferred()}
+
+		if !r.lastSync.IsZero() {
+			lastSync := r.lastSync
+			status.LastSync = &lastSync
+		}
+		r.lock.Unlock()
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// poll mirrors a registry once, recording how it went: the registry is synced with if its
+// repositories could be listed, and lags by the selected tags which couldn't be copied.
+func (r *registry) poll(is storage.ImageStore, log log.Logger) {
+	p, err := mirror(r.client, r.config, is, log)
+	if err != nil {
+		log.Error().Err(err).Str("upstream", r.client.URL()).Msg("unable to mirror registry")
+	}
+
+	failed, rerr := r.mirrorRequested(is, log)
+	if rerr != nil {
+		p.err = rerr
+	}
+
+	p.failed += failed
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	switch {
+	case err != nil:
+		r.lastError = err.Error()
+		return
+	case p.err != nil:
+		r.lastError = p.err.Error()
+	default:
+		r.lastError = ""
+	}
+
+	r.lastSync, r.lag = time.Now(), p.failed
+}
+
+// Fetch copies an image from the first registry mirrored on demand which selects its
+// repository and has it, unless it has been copied meanwhile. Unless referenced by digest,
+// the image is mirrored from then on. It fails with ErrManifestNotFound if none has it.
+func (m *Mirrorer) Fetch(repo string, reference string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// another pull may have copied it while we waited
+	if _, _, _, err := m.is.GetImageManifest(repo, reference); err == nil {
+		return nil
+	}
+
+	for _, r := range m.current() {
+		if !r.config.OnDemand {
+			continue
+		}
+
+		if _, ok := selectRepo(r.config.Content, repo); !ok {
+			continue
+		}
+
+		digest, err := r.copy(m.is, repo, reference)
+		if err == errors.ErrManifestNotFound {
+			continue
+		}
+
+		if err != nil {
+			m.log.Error().Err(err).Str("upstream", r.client.URL()).Str("repo", repo).Str("reference", reference).
+				Msg("unable to mirror image on demand")
+
+			return err
+		}
+
+		m.log.Info().Str("upstream", r.client.URL()).Str("repo", repo).Str("reference", reference).
+			Str("digest", digest.String()).Msg("mirrored image on demand")
+
+		if _, err := godigest.Parse(reference); err != nil {
+			r.request(repo, reference)
+		}
+
+		return nil
+	}
+
+	return errors.ErrManifestNotFound
+}
+
+// copy copies an image, provided it has its pinned digest, if any.
+func (r *registry) copy(is storage.ImageStore, repo string, tag string) (godigest.Digest, error) {
+	if pinned := pinnedDigest(r.config.Pins, repo, tag); pinned != "" {
+		return r.client.CopyPinnedImage(is, repo, tag, pinned)
+	}
+
+	return r.client.CopyImage(is, repo, tag)
+}
+
+// request adds a tag copied on demand to those mirrored.
+func (r *registry) request(repo string, tag string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, t := range r.requested[repo] {
+		if t == tag {
+			return
+		}
+	}
+
+	r.requested[repo] = append(r.requested[repo], tag)
+}
+
+// mirrorRequested updates the images copied on demand, which the registry's content filters
+// may not select. It returns how many couldn't be, and the last failure.
+func (r *registry) mirrorRequested(is storage.ImageStore, log log.Logger) (int, error) {
+	r.lock.Lock()
+	requested := make(map[string][]string, len(r.requested))
+
+	for repo, tags := range r.requested {
+		requested[repo] = append([]string{}, tags...)
+	}
+	r.lock.Unlock()
+
+	var lastErr error
+
+	failed := 0
+
+	for repo, tags := range requested {
+		for _, tag := range tags {
+			if _, err := r.copy(is, repo, tag); err != nil {
+				log.Error().Err(err).Str("repo", repo).Str("tag", tag).Msg("unable to mirror image")
+
+				failed++
+				lastErr = err
+			}
+		}
+	}
+
+	return failed, lastErr
+}
+
+// ImageStore copies the images the wrapped store misses from the registries mirrored on
+// demand, as they're pulled.
+type ImageStore struct {
+	storage.ImageStore
+	mirrorer *Mirrorer
+}
+
+// NewImageStore returns a store copying the images it misses with mirrorer.
+func NewImageStore(is storage.ImageStore, mirrorer *Mirrorer) *ImageStore {
+	return &ImageStore{ImageStore: is, mirrorer: mirrorer}
+}
+
+// GetImageManifest returns a manifest, copying its image first if missing.
+func (is *ImageStore) GetImageManifest(repo string, reference string) ([]byte, string, string, error) {
+	body, digest, mediaType, err := is.ImageStore.GetImageManifest(repo, reference)
+	if err != errors.ErrRepoNotFound && err != errors.ErrManifestNotFound {
+		return body, digest, mediaType, err
+	}
+
+	switch ferr := is.mirrorer.Fetch(repo, reference); ferr {
+	case nil:
+	case errors.ErrManifestNotFound:
+		return nil, "", "", err
+	default:
+		return nil, "", "", ferr
+	}
+
+	return is.ImageStore.GetImageManifest(repo, reference)
+}
+
+// Mirror copies the repositories and tags selected by config from the registry client
+// pulls from into is, returning how many images were copied or updated. Images which
+// can't be copied, or don't match their pinned digest, are logged and skipped.
+func Mirror(client *upstream.Client, config RegistryConfig, is storage.ImageStore, log log.Logger) (int, error) {
+	p, err := mirror(client, config, is, log)
+
+	return p.copied, err
+}
+
+// pass is how mirroring a registry went.
+type pass struct {
+	copied int
+	failed int   // selected tags which couldn't be copied
+	err    error // last failure to list tags or copy an image
+}
+
+func mirror(client *upstream.Client, config RegistryConfig, is storage.ImageStore, log log.Logger) (pass, error) {
+	log.Info().Str("upstream", client.URL()).Msg("mirroring registry")
+
+	repos, err := client.GetRepositories()
+	if err != nil {
+		return pass{}, err
+	}
+
+	var p pass
+
+	for _, repo := range repos {
+		content, ok := selectRepo(config.Content, repo)
+		if !ok {
+			continue
+		}
+
+		tags, err := client.GetTags(repo)
+		if err != nil {
+			log.Error().Err(err).Str("repo", repo).Msg("unable to list upstream tags")
+
+			p.err = err
+
+			continue
+		}
+
+		if content != nil && content.Tags != nil {
+			tags = filterTags(content.Tags, tags)
+		}
+
+		for _, tag := range tags {
+			_, local, _, _ := is.GetImageManifest(repo, tag)
+
+			var digest godigest.Digest
+
+			if pinned := pinnedDigest(config.Pins, repo, tag); pinned != "" {
+				digest, err = client.CopyPinnedImage(is, repo, tag, pinned)
+			} else {
+				digest, err = client.CopyImage(is, repo, tag)
+			}
+
+			if err != nil {
+				log.Error().Err(err).Str("repo", repo).Str("tag", tag).Msg("unable to mirror image")
+
+				p.failed++
+				p.err = err
+
+				continue
+			}
+
+			if digest.String() != local {
+				log.Info().Str("repo", repo).Str("tag", tag).Str("digest", digest.String()).Msg("mirrored image")
+
+				p.copied++
+			}
+		}
+	}
+
+	log.Info().Str("upstream", client.URL()).Int("images", p.copied).Msg("mirrored registry")
+
+	return p, nil
+}
+
+func pinnedDigest(pins []PinConfig, repo string, tag string) godigest.Digest {
+	for _, pin := range pins {
+		if pin.Repo == repo && pin.Tag == tag {
+			return godigest.Digest(pin.Digest)
+		}
+	}
+
+	return ""
+}
+
+// selectRepo returns whether content selects a repository and, if so, the content config
+// selecting it, if any.
+func selectRepo(content []ContentConfig, repo string) (*ContentConfig, bool) {
+	if len(content) == 0 {
+		return nil, true
+	}
+
+	for i, c := range content {
+		if ok, _ := path.Match(c.Prefix, repo); !ok && c.Prefix != "" {
+			continue
+		}
+
+		if excluded(c.Exclude, repo) {
+			continue
+		}
+
+		return &content[i], true
+	}
+
+	return nil, false
+}
+
+func excluded(patterns []string, repo string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, repo); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,382 @@
+package mirror_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/mirror"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	"github.com/anuvu/zot/pkg/upstream"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMirror(t *testing.T) {
+	Convey("Mirror an upstream registry", t, func() {
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+
+		manifest, err := img.ManifestBlob()
+		So(err, ShouldBeNil)
+
+		tags := map[string][]string{
+			"library/alpine":  {"3.12", "3.13", "latest"},
+			"library/busybox": {"1.32"},
+			"other":           {"1.0"},
+			"tools/app":       {"v1.0.0", "v1.0.1", "v1.1.0", "v1.1.1-rc.1", "v2.0.0", "nightly-20201015", "20201015"},
+			"tools/legacy":    {"1.0.0"},
+		}
+
+		server := newUpstream(img, tags)
+		defer server.Close()
+
+		log := log.NewLogger("debug", "")
+
+		client, err := upstream.NewClient(upstream.Config{URL: server.URL}, log)
+		So(err, ShouldBeNil)
+
+		is := storage.NewImageStoreMem(log)
+
+		registry := mirror.RegistryConfig{
+			Content: []mirror.ContentConfig{
+				{Prefix: "library/*", Tags: &mirror.TagsConfig{Regex: `^3\.`}},
+				{Prefix: "other"},
+				{
+					Prefix:  "tools/*",
+					Exclude: []string{"tools/legacy"},
+					Tags: &mirror.TagsConfig{
+						Exclude: `^v2\.`,
+						Semver:  &mirror.SemverConfig{LatestPer: "minor"},
+					},
+				},
+			},
+			Pins: []mirror.PinConfig{
+				{Repo: "library/alpine", Tag: "3.12", Digest: godigest.FromBytes([]byte("drifted")).String()},
+				{Repo: "other", Tag: "1.0", Digest: godigest.FromBytes(manifest).String()},
+			},
+		}
+
+		copied, err := mirror.Mirror(client, registry, is, log)
+		So(err, ShouldBeNil)
+		So(copied, ShouldEqual, 4)
+
+		repos, err := is.GetRepositories()
+		So(err, ShouldBeNil)
+		So(repos, ShouldContain, "library/alpine")
+		So(repos, ShouldContain, "other")
+		So(repos, ShouldNotContain, "library/busybox")
+		So(repos, ShouldNotContain, "tools/legacy")
+
+		// only the latest release of each minor version
+		for _, tag := range []string{"v1.0.1", "v1.1.0"} {
+			_, _, _, err = is.GetImageManifest("tools/app", tag)
+			So(err, ShouldBeNil)
+		}
+
+		for _, tag := range []string{"v1.0.0", "v1.1.1-rc.1", "v2.0.0", "nightly-20201015", "20201015"} {
+			_, _, _, err = is.GetImageManifest("tools/app", tag)
+			So(err, ShouldEqual, errors.ErrManifestNotFound)
+		}
+
+		_, _, _, err = is.GetImageManifest("library/alpine", "latest")
+		So(err, ShouldEqual, errors.ErrManifestNotFound)
+
+		// drifted from its pin
+		_, _, _, err = is.GetImageManifest("library/alpine", "3.12")
+		So(err, ShouldEqual, errors.ErrManifestNotFound)
+
+		_, digest, _, err := is.GetImageManifest("library/alpine", "3.13")
+		So(err, ShouldBeNil)
+		So(digest, ShouldEqual, godigest.FromBytes(manifest).String())
+
+		// up to date
+		copied, err = mirror.Mirror(client, registry, is, log)
+		So(err, ShouldBeNil)
+		So(copied, ShouldEqual, 0)
+
+		// everything
+		copied, err = mirror.Mirror(client, mirror.RegistryConfig{}, is, log)
+		So(err, ShouldBeNil)
+		So(copied, ShouldEqual, 9)
+	})
+}
+
+func TestOnDemand(t *testing.T) {
+	Convey("Mirror images on demand", t, func() {
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+
+		digest, err := img.Digest()
+		So(err, ShouldBeNil)
+
+		server := newUpstream(img, map[string][]string{
+			"tools/app": {"1.0", "nightly"},
+			"other":     {"1.0"},
+		})
+		defer server.Close()
+
+		log := log.NewLogger("debug", "")
+		local := storage.NewImageStoreMem(log)
+
+		config := &mirror.Config{Registries: []mirror.RegistryConfig{
+			{
+				Config:  upstream.Config{URL: server.URL},
+				Content: []mirror.ContentConfig{{Prefix: "tools/*", Tags: &mirror.TagsConfig{Regex: `^\d`}}},
+			},
+			{
+				Config:   upstream.Config{URL: server.URL},
+				Content:  []mirror.ContentConfig{{Prefix: "tools/*", Tags: &mirror.TagsConfig{Regex: `^\d`}}},
+				OnDemand: true,
+			},
+		}}
+		So(config.Validate(log), ShouldBeNil)
+
+		m, err := mirror.NewMirrorer(config, local, log)
+		So(err, ShouldBeNil)
+
+		is := mirror.NewImageStore(local, m)
+
+		// not selected by the tags filter, but pulled
+		_, d, _, err := is.GetImageManifest("tools/app", "nightly")
+		So(err, ShouldBeNil)
+		So(d, ShouldEqual, digest.String())
+
+		_, _, _, err = local.GetImageManifest("tools/app", "nightly")
+		So(err, ShouldBeNil)
+
+		// by digest
+		_, d, _, err = is.GetImageManifest("tools/app", digest.String())
+		So(err, ShouldBeNil)
+		So(d, ShouldEqual, digest.String())
+
+		// not selected, or missing upstream
+		_, _, _, err = is.GetImageManifest("other", "1.0")
+		So(err, ShouldEqual, errors.ErrRepoNotFound)
+
+		_, _, _, err = is.GetImageManifest("tools/app", "missing")
+		So(err, ShouldEqual, errors.ErrManifestNotFound)
+
+		So(m.Fetch("tools/app", "missing"), ShouldEqual, errors.ErrManifestNotFound)
+
+		// mirrored from then on
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var wg sync.WaitGroup
+
+		So(local.DeleteImageTag("tools/app", "nightly"), ShouldBeNil)
+		m.Run(ctx, &wg)
+
+		for i := 0; i < 50; i++ {
+			if _, _, _, err = local.GetImageManifest("tools/app", "nightly"); err == nil {
+				break
+			}
+
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		cancel()
+		wg.Wait()
+
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestStatus(t *testing.T) {
+	Convey("Report the status of mirroring", t, func() {
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+
+		server := newUpstream(img, map[string][]string{"tools/app": {"1.0", "2.0"}})
+		defer server.Close()
+
+		down := httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+
+		log := log.NewLogger("debug", "")
+		is := storage.NewImageStoreMem(log)
+
+		config := &mirror.Config{Registries: []mirror.RegistryConfig{
+			{
+				Config: upstream.Config{URL: server.URL},
+				// pinned to another image, so never copied
+				Pins: []mirror.PinConfig{{Repo: "tools/app", Tag: "2.0", Digest: godigest.FromString("other").String()}},
+			},
+			{Config: upstream.Config{URL: down.URL}},
+		}}
+		So(config.Validate(log), ShouldBeNil)
+
+		m, err := mirror.NewMirrorer(config, is, log)
+		So(err, ShouldBeNil)
+
+		status := m.Status()
+		So(status, ShouldHaveLength, 2)
+		So(status[0].LastSync, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var wg sync.WaitGroup
+
+		m.Run(ctx, &wg)
+
+		for i := 0; i < 50; i++ {
+			if status = m.Status(); status[0].LastSync != nil && status[1].LastError != "" {
+				break
+			}
+
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		cancel()
+		wg.Wait()
+
+		So(status[0].Kind, ShouldEqual, "mirror")
+		So(status[0].URL, ShouldEqual, server.URL)
+		So(status[0].LastSync, ShouldNotBeNil)
+		So(status[0].Lag, ShouldEqual, 1)
+		So(status[0].LastError, ShouldEqual, errors.ErrUpstreamDigestMismatch.Error())
+		So(status[0].BytesTransferred, ShouldBeGreaterThan, len(img.Layers[0]))
+
+		So(status[1].URL, ShouldEqual, down.URL)
+		So(status[1].LastSync, ShouldBeNil)
+		So(status[1].LastError, ShouldNotBeEmpty)
+		So(status[1].BytesTransferred, ShouldEqual, 0)
+	})
+}
+
+func TestReload(t *testing.T) {
+	Convey("Mirror the registries reloaded from then on", t, func() {
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+
+		server := newUpstream(img, map[string][]string{"tools/app": {"1.0"}})
+		defer server.Close()
+
+		down := httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+
+		log := log.NewLogger("debug", "")
+		is := storage.NewImageStoreMem(log)
+
+		m, err := mirror.NewMirrorer(&mirror.Config{Registries: []mirror.RegistryConfig{
+			{Config: upstream.Config{URL: down.URL}, PollInterval: time.Hour},
+		}}, is, log)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var wg sync.WaitGroup
+
+		m.Run(ctx, &wg)
+
+		So(m.Reload(&mirror.Config{Registries: []mirror.RegistryConfig{
+			{Config: upstream.Config{URL: server.URL}, PollInterval: time.Hour},
+		}}), ShouldBeNil)
+
+		for i := 0; i < 50; i++ {
+			if _, _, _, err = is.GetImageManifest("tools/app", "1.0"); err == nil {
+				break
+			}
+
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		So(err, ShouldBeNil)
+
+		status := m.Status()
+		So(status, ShouldHaveLength, 1)
+		So(status[0].URL, ShouldEqual, server.URL)
+
+		cancel()
+		wg.Wait()
+	})
+}
+
+func TestValidate(t *testing.T) {
+	Convey("Validate mirroring configuration", t, func() {
+		log := log.NewLogger("debug", "")
+
+		valid := mirror.RegistryConfig{Config: upstream.Config{URL: "http://localhost"}}
+		So((&mirror.Config{Registries: []mirror.RegistryConfig{valid}}).Validate(log), ShouldBeNil)
+
+		noURL := mirror.RegistryConfig{}
+		badPrefix := valid
+		badPrefix.Content = []mirror.ContentConfig{{Prefix: "["}}
+		badRegex := valid
+		badRegex.Content = []mirror.ContentConfig{{Tags: &mirror.TagsConfig{Regex: "("}}}
+		badExclude := valid
+		badExclude.Content = []mirror.ContentConfig{{Exclude: []string{"["}}}
+		badTagsExclude := valid
+		badTagsExclude.Content = []mirror.ContentConfig{{Tags: &mirror.TagsConfig{Exclude: "("}}}
+		badConstraint := valid
+		badConstraint.Content = []mirror.ContentConfig{{Tags: &mirror.TagsConfig{
+			Semver: &mirror.SemverConfig{Constraint: "newest"}}}}
+		badLatestPer := valid
+		badLatestPer.Content = []mirror.ContentConfig{{Tags: &mirror.TagsConfig{
+			Semver: &mirror.SemverConfig{LatestPer: "patch"}}}}
+		badPin := valid
+		badPin.Pins = []mirror.PinConfig{{Repo: "repo", Tag: "1.0", Digest: "sha256:bad"}}
+
+		for _, r := range []mirror.RegistryConfig{noURL, badPrefix, badRegex, badExclude, badTagsExclude,
+			badConstraint, badLatestPer, badPin} {
+			So((&mirror.Config{Registries: []mirror.RegistryConfig{r}}).Validate(log), ShouldEqual, errors.ErrBadConfig)
+		}
+	})
+}
+
+// newUpstream returns a registry serving img under the given tags, by repository.
+func newUpstream(img test.Image, tags map[string][]string) *httptest.Server {
+	manifest, err := img.ManifestBlob()
+	So(err, ShouldBeNil)
+
+	config, err := img.ConfigBlob()
+	So(err, ShouldBeNil)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/_catalog" {
+			repos := []string{}
+			for repo := range tags {
+				repos = append(repos, repo)
+			}
+
+			sort.Strings(repos)
+			_ = json.NewEncoder(w).Encode(map[string][]string{"repositories": repos})
+
+			return
+		}
+
+		for repo, list := range tags {
+			switch r.URL.Path {
+			case "/v2/" + repo + "/tags/list":
+				_ = json.NewEncoder(w).Encode(map[string][]string{"tags": list})
+				return
+			case "/v2/" + repo + "/blobs/" + godigest.FromBytes(config).String():
+				_, _ = w.Write(config)
+				return
+			case "/v2/" + repo + "/blobs/" + godigest.FromBytes(img.Layers[0]).String():
+				_, _ = w.Write(img.Layers[0])
+				return
+			}
+
+			for _, tag := range list {
+				if r.URL.Path == "/v2/"+repo+"/manifests/"+tag {
+					w.Header().Set("Content-Type", ispec.MediaTypeImageManifest)
+					_, _ = w.Write(manifest)
+
+					return
+				}
+			}
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+	}))
+}
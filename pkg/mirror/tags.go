@@ -0,0 +1,112 @@
+package mirror
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+const (
+	latestPerMajor = "major"
+	latestPerMinor = "minor"
+)
+
+// filterTags returns the tags selected by config, in their original order. The config must
+// be valid.
+func filterTags(config *TagsConfig, tags []string) []string {
+	var include, exclude *regexp.Regexp
+
+	if config.Regex != "" {
+		include = regexp.MustCompile(config.Regex)
+	}
+
+	if config.Exclude != "" {
+		exclude = regexp.MustCompile(config.Exclude)
+	}
+
+	selected := []string{}
+
+	for _, tag := range tags {
+		if include != nil && !include.MatchString(tag) {
+			continue
+		}
+
+		if exclude != nil && exclude.MatchString(tag) {
+			continue
+		}
+
+		selected = append(selected, tag)
+	}
+
+	if config.Semver == nil {
+		return selected
+	}
+
+	return filterSemver(config.Semver, selected)
+}
+
+// filterSemver returns the tags which are semantic versions selected by config.
+func filterSemver(config *SemverConfig, tags []string) []string {
+	var constraint *semver.Constraints
+
+	if config.Constraint != "" {
+		constraint, _ = semver.NewConstraint(config.Constraint)
+	}
+
+	versions := map[string]*semver.Version{}
+	latest := map[string]*semver.Version{} // by major or minor version
+
+	for _, tag := range tags {
+		// strictly, so that e.g. dates aren't taken for major versions
+		v, err := semver.StrictNewVersion(strings.TrimPrefix(tag, "v"))
+		if err != nil {
+			continue
+		}
+
+		if v.Prerelease() != "" && !config.Prereleases {
+			continue
+		}
+
+		if constraint != nil && !constraint.Check(v) {
+			continue
+		}
+
+		versions[tag] = v
+
+		if key := latestKey(config.LatestPer, v); key != "" {
+			if l, ok := latest[key]; !ok || v.GreaterThan(l) {
+				latest[key] = v
+			}
+		}
+	}
+
+	selected := []string{}
+
+	for _, tag := range tags {
+		v, ok := versions[tag]
+		if !ok {
+			continue
+		}
+
+		if key := latestKey(config.LatestPer, v); key != "" && latest[key] != v {
+			continue
+		}
+
+		selected = append(selected, tag)
+	}
+
+	return selected
+}
+
+func latestKey(latestPer string, v *semver.Version) string {
+	switch latestPer {
+	case latestPerMajor:
+		return fmt.Sprint(v.Major())
+	case latestPerMinor:
+		return fmt.Sprintf("%d.%d", v.Major(), v.Minor())
+	default:
+		return ""
+	}
+}
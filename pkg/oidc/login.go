@@ -0,0 +1,215 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+)
+
+const (
+	// LoginPath starts the authorization code flow, sending users to the provider, and back to
+	// the local path of its "redirect" query parameter, if any, once logged in.
+	LoginPath = "/auth/login"
+
+	// CallbackPath is where the provider sends users back to, with the code of their login.
+	CallbackPath = "/auth/callback"
+
+	// LogoutPath forgets the session of users.
+	LogoutPath = "/auth/logout"
+
+	// SessionCookie holds the ID token of users logged in, until it expires.
+	SessionCookie = "zot_session"
+
+	// loginCookie holds the state, nonce and redirect of a login, until back from the provider.
+	loginCookie = "zot_login"
+
+	// how long users have to log in with the provider
+	loginTimeout = 10 * time.Minute
+)
+
+// ServeLogin sends users to the provider to log in.
+func (p *Provider) ServeLogin(w http.ResponseWriter, r *http.Request) {
+	m, err := p.discover()
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	state, nonce := randomString(), randomString()
+
+	authURL, err := url.Parse(m.AuthorizationEndpoint)
+	if err != nil || m.AuthorizationEndpoint == "" {
+		p.log.Error().Str("authorizationEndpoint", m.AuthorizationEndpoint).
+			Msg("invalid authorization endpoint of OpenID Connect provider")
+		w.WriteHeader(http.StatusBadGateway)
+
+		return
+	}
+
+	q := authURL.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.config.ClientID)
+	q.Set("redirect_uri", p.config.RedirectURL)
+	q.Set("scope", strings.Join(append([]string{"openid"}, p.config.Scopes...), " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	authURL.RawQuery = q.Encode()
+
+	login := url.Values{"state": {state}, "nonce": {nonce}, "redirect": {localPath(r.URL.Query().Get("redirect"))}}
+
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Value: login.Encode(), Path: CallbackPath,
+		MaxAge: int(loginTimeout.Seconds()), HttpOnly: true, Secure: p.secure(), SameSite: http.SameSiteLaxMode})
+	http.Redirect(w, r, authURL.String(), http.StatusFound)
+}
+
+// ServeCallback exchanges the code of a login for an ID token, kept in the session cookie,
+// sending users back to where they logged in from.
+func (p *Provider) ServeCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	cookie, err := r.Cookie(loginCookie)
+	if err != nil {
+		p.log.Warn().Err(errors.ErrBadOIDCState).Msg("login not started, or expired")
+		w.WriteHeader(http.StatusBadRequest)
+
+		return
+	}
+
+	login, err := url.ParseQuery(cookie.Value)
+	if err != nil || login.Get("state") == "" || login.Get("state") != q.Get("state") {
+		p.log.Warn().Err(errors.ErrBadOIDCState).Msg("login state mismatch")
+		w.WriteHeader(http.StatusBadRequest)
+
+		return
+	}
+
+	// the login is done with, whatever its outcome
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Path: CallbackPath, MaxAge: -1, HttpOnly: true,
+		Secure: p.secure(), SameSite: http.SameSiteLaxMode})
+
+	if e := q.Get("error"); e != "" {
+		p.log.Warn().Str("error", e).Str("description", q.Get("error_description")).Msg("login failed")
+		w.WriteHeader(http.StatusUnauthorized)
+
+		return
+	}
+
+	token, err := p.exchange(q.Get("code"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	identity, err := p.Verify(token, login.Get("nonce"))
+	if err != nil {
+		p.log.Warn().Err(err).Msg("invalid ID token issued on login")
+		w.WriteHeader(http.StatusUnauthorized)
+
+		return
+	}
+
+	p.log.Info().Str("username", identity.Username).Strs("groups", identity.Groups).Msg("user logged in")
+
+	http.SetCookie(w, &http.Cookie{Name: SessionCookie, Value: token, Path: "/", Expires: identity.Expiry,
+		HttpOnly: true, Secure: p.secure(), SameSite: http.SameSiteLaxMode})
+	http.Redirect(w, r, localPath(login.Get("redirect")), http.StatusFound)
+}
+
+// ServeLogout forgets the session of users, sending them to the local path of the "redirect"
+// query parameter, if any.
+func (p *Provider) ServeLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: SessionCookie, Path: "/", MaxAge: -1, HttpOnly: true,
+		Secure: p.secure(), SameSite: http.SameSiteLaxMode})
+	http.Redirect(w, r, localPath(r.URL.Query().Get("redirect")), http.StatusFound)
+}
+
+// exchange exchanges the code of a login for an ID token, authenticating with the client
+// secret, as of client_secret_basic.
+func (p *Provider) exchange(code string) (string, error) {
+	m, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {p.config.RedirectURL}}
+
+	req, err := http.NewRequest(http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		p.log.Error().Err(err).Str("tokenEndpoint", m.TokenEndpoint).Msg("invalid token endpoint")
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.log.Error().Err(err).Str("tokenEndpoint", m.TokenEndpoint).Msg("unable to exchange login code")
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&tokens) != nil || tokens.IDToken == "" {
+		p.log.Error().Str("tokenEndpoint", m.TokenEndpoint).Int("status", resp.StatusCode).
+			Msg("unable to exchange login code")
+		return "", errors.ErrOIDCProvider
+	}
+
+	return tokens.IDToken, nil
+}
+
+// TokenOf returns the ID token of a request, given as bearer token, as password, e.g. by
+// clients only doing basic authentication, or by the session cookie of users logged in, and
+// whether it was given as password, which may also be one of a user otherwise authenticated.
+func TokenOf(r *http.Request) (string, bool, bool) {
+	header := r.Header.Get("Authorization")
+	if token := strings.TrimPrefix(header, "Bearer "); token != header {
+		return token, false, true
+	}
+
+	if _, password, ok := r.BasicAuth(); ok {
+		if strings.Count(password, ".") == 2 {
+			return password, true, true
+		}
+
+		return "", false, false
+	}
+
+	if cookie, err := r.Cookie(SessionCookie); err == nil && cookie.Value != "" {
+		return cookie.Value, false, true
+	}
+
+	return "", false, false
+}
+
+// secure tells whether cookies are only to be sent over HTTPS, as zot is served over.
+func (p *Provider) secure() bool {
+	return strings.HasPrefix(p.config.RedirectURL, "https://")
+}
+
+// localPath returns path if local to zot, rather than another site users would be sent to,
+// "/" otherwise.
+func localPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+
+	return path
+}
+
+func randomString() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+
+	return hex.EncodeToString(buf)
+}
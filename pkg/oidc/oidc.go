@@ -0,0 +1,489 @@
+// Package oidc authenticates users with an OpenID Connect provider, verifying the ID tokens it
+// issues, whether given by clients, e.g. CI workloads, or obtained on their behalf with the
+// authorization code flow, e.g. for users logging in with a browser.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // for crypto.SHA256
+	_ "crypto/sha512" // for crypto.SHA384 and crypto.SHA512
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+)
+
+const (
+	defaultUsernameClaim = "sub"
+	defaultGroupsClaim   = "groups"
+
+	discoveryPath  = "/.well-known/openid-configuration"
+	requestTimeout = 10 * time.Second
+
+	// leeway given to the clocks of the provider and zot to differ by
+	clockSkew = time.Minute
+
+	// how often keys are fetched, at most, for tokens signed with keys not fetched yet
+	keysInterval = time.Minute
+)
+
+type Config struct {
+	// Issuer identifies the provider, e.g. "https://accounts.google.com", which serves its
+	// metadata under /.well-known/openid-configuration
+	Issuer string
+	// ClientID is that of zot registered with the provider, which ID tokens must be issued to
+	ClientID string
+	// ClientSecret authenticates zot with the provider, in the authorization code flow
+	ClientSecret string
+	// RedirectURL is where the provider sends users back to once logged in, zot's CallbackPath,
+	// e.g. "https://zot.example.com/auth/callback"; the authorization code flow is off if not set
+	RedirectURL string
+	// Scopes are requested besides "openid", e.g. "profile", "email" or "groups"
+	Scopes []string
+	// Audiences are accepted besides ClientID, e.g. that of the ID tokens of CI workloads
+	Audiences []string
+	// UsernameClaim names users, "sub" if not set, e.g. "email" or "preferred_username"
+	UsernameClaim string
+	// GroupsClaim lists the groups of users, "groups" if not set
+	GroupsClaim string
+}
+
+// Validate checks the issuer and redirect URL are HTTP URLs, and a client is identified.
+func (c *Config) Validate(log log.Logger) error {
+	if u, err := url.Parse(c.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		log.Error().Str("issuer", c.Issuer).Msg("invalid OpenID Connect issuer")
+		return errors.ErrBadConfig
+	}
+
+	if c.ClientID == "" {
+		log.Error().Msg("OpenID Connect client ID is required")
+		return errors.ErrBadConfig
+	}
+
+	if c.RedirectURL != "" {
+		u, err := url.Parse(c.RedirectURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.Path != CallbackPath {
+			log.Error().Str("redirectURL", c.RedirectURL).Str("path", CallbackPath).
+				Msg("invalid OpenID Connect redirect URL, must be an absolute URL of the callback path")
+			return errors.ErrBadConfig
+		}
+
+		if c.ClientSecret == "" {
+			log.Error().Msg("OpenID Connect client secret is required for logins")
+			return errors.ErrBadConfig
+		}
+	}
+
+	return nil
+}
+
+// Identity is who an ID token was issued to.
+type Identity struct {
+	Username string
+	Groups   []string
+	Expiry   time.Time // of the token
+}
+
+type contextKey struct{}
+
+// ContextWithIdentity returns a copy of ctx carrying the identity of the user making a request,
+// e.g. for access to be controlled by their groups.
+func ContextWithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, identity)
+}
+
+// IdentityFromContext returns the identity carried by ctx, nil if none.
+func IdentityFromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(contextKey{}).(*Identity)
+
+	return identity
+}
+
+// Provider verifies the ID tokens issued by the provider of a config, discovering its metadata
+// and keys on first use, for zot to start while the provider is unreachable.
+type Provider struct {
+	config *Config
+	client *http.Client
+	log    log.Logger
+
+	lock      sync.Mutex
+	metadata  *metadata
+	keys      map[string]crypto.PublicKey // by key id
+	keysFetch time.Time                   // last fetched at
+}
+
+// metadata is what's used of the metadata of a provider.
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewProvider returns the provider of a valid config.
+func NewProvider(config *Config, log log.Logger) *Provider {
+	return &Provider{config: config, client: &http.Client{Timeout: requestTimeout}, log: log}
+}
+
+// LoginEnabled tells whether users may log in with the authorization code flow.
+func (p *Provider) LoginEnabled() bool {
+	return p.config.RedirectURL != ""
+}
+
+// discover returns the metadata of the provider, fetched once.
+func (p *Provider) discover() (*metadata, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	var m metadata
+	if err := p.getJSON(strings.TrimSuffix(p.config.Issuer, "/")+discoveryPath, &m); err != nil {
+		return nil, err
+	}
+
+	if m.Issuer != p.config.Issuer || m.JWKSURI == "" {
+		p.log.Error().Str("issuer", m.Issuer).Str("expected", p.config.Issuer).
+			Msg("OpenID Connect provider metadata doesn't match its issuer")
+		return nil, errors.ErrOIDCProvider
+	}
+
+	p.metadata = &m
+
+	return p.metadata, nil
+}
+
+// key returns the public key of an id, fetching the keys of the provider if not fetched yet, or
+// fetched over keysInterval ago, for keys to be rotated.
+func (p *Provider) key(m *metadata, kid string) (crypto.PublicKey, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	if time.Since(p.keysFetch) < keysInterval {
+		return nil, errors.ErrBadIDToken
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	if err := p.getJSON(m.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	p.keysFetch = time.Now()
+	p.keys = make(map[string]crypto.PublicKey, len(jwks.Keys))
+
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		if key, ok := k.publicKey(); ok {
+			p.keys[k.Kid] = key
+		}
+	}
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, errors.ErrBadIDToken
+	}
+
+	return key, nil
+}
+
+func (p *Provider) getJSON(url string, v interface{}) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		p.log.Error().Err(err).Str("url", url).Msg("unable to reach OpenID Connect provider")
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		p.log.Error().Str("url", url).Int("status", resp.StatusCode).Msg("OpenID Connect provider failed")
+		return errors.ErrOIDCProvider
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		p.log.Error().Err(err).Str("url", url).Msg("invalid response of OpenID Connect provider")
+		return errors.ErrOIDCProvider
+	}
+
+	return nil
+}
+
+// jwk is a JSON web key, RSA or elliptic curve.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, bool) {
+	switch k.Kty {
+	case "RSA":
+		n, ok := decodeInt(k.N)
+		if !ok {
+			return nil, false
+		}
+
+		e, ok := decodeInt(k.E)
+		if !ok || !e.IsInt64() {
+			return nil, false
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, true
+	case "EC":
+		var curve elliptic.Curve
+
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, false
+		}
+
+		x, ok := decodeInt(k.X)
+		if !ok {
+			return nil, false
+		}
+
+		y, ok := decodeInt(k.Y)
+		if !ok || !curve.IsOnCurve(x, y) {
+			return nil, false
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, true
+	}
+
+	return nil, false
+}
+
+func decodeInt(s string) (*big.Int, bool) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(buf) == 0 {
+		return nil, false
+	}
+
+	return new(big.Int).SetBytes(buf), true
+}
+
+// Verify returns the identity an ID token was issued to, if signed by the provider for zot, or
+// any of the audiences configured, and not expired, nor issued for another login than that of
+// nonce, if given.
+func (p *Provider) Verify(token string, nonce string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.ErrBadIDToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.ErrBadIDToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.ErrBadIDToken
+	}
+
+	m, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := p.key(m, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.ErrBadIDToken
+	}
+
+	return p.identity(m, claims, nonce)
+}
+
+// identity checks the claims of a token, returning who it was issued to.
+func (p *Provider) identity(m *metadata, claims map[string]interface{}, nonce string) (*Identity, error) {
+	if iss, _ := claims["iss"].(string); iss != m.Issuer {
+		return nil, errors.ErrBadIDToken
+	}
+
+	if !p.audienceOf(claims["aud"]) {
+		return nil, errors.ErrBadIDToken
+	}
+
+	now := time.Now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, errors.ErrBadIDToken
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.ErrBadIDToken
+	}
+
+	if n, _ := claims["nonce"].(string); nonce != "" && n != nonce {
+		return nil, errors.ErrBadIDToken
+	}
+
+	usernameClaim := p.config.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = defaultUsernameClaim
+	}
+
+	username, _ := claims[usernameClaim].(string)
+	if username == "" {
+		return nil, errors.ErrBadIDToken
+	}
+
+	groupsClaim := p.config.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = defaultGroupsClaim
+	}
+
+	identity := &Identity{Username: username, Expiry: time.Unix(int64(exp), 0)}
+
+	// a list of groups, or a single one
+	switch groups := claims[groupsClaim].(type) {
+	case []interface{}:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				identity.Groups = append(identity.Groups, s)
+			}
+		}
+	case string:
+		identity.Groups = []string{groups}
+	}
+
+	return identity, nil
+}
+
+// audienceOf tells whether the audience of a token, one or several, is zot.
+func (p *Provider) audienceOf(aud interface{}) bool {
+	var audiences []string
+
+	switch a := aud.(type) {
+	case string:
+		audiences = []string{a}
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+	}
+
+	for _, a := range audiences {
+		if a == p.config.ClientID {
+			return true
+		}
+
+		for _, accepted := range p.config.Audiences {
+			if a == accepted {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func decodeSegment(s string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buf, v)
+}
+
+// verifySignature verifies the signature of a JWS with the RSA or ECDSA algorithms of JWA,
+// rejecting any other, e.g. "none" or HMACs, keyed with what's public.
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	if len(alg) != 5 {
+		return errors.ErrBadIDToken
+	}
+
+	var hash crypto.Hash
+
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return errors.ErrBadIDToken
+	}
+
+	h := hash.New()
+	_, _ = h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			if rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil {
+				return nil
+			}
+		case "PS":
+			if rsa.VerifyPSS(k, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil {
+				return nil
+			}
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+
+		if alg[:2] == "ES" && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+
+			if ecdsa.Verify(k, digest, r, s) {
+				return nil
+			}
+		}
+	}
+
+	return errors.ErrBadIDToken
+}
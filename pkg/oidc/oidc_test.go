@@ -0,0 +1,409 @@
+package oidc_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/oidc"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const clientID = "zot"
+
+// issuer is an OpenID Connect provider issuing ID tokens signed with an RSA key.
+type issuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	// the claims of the token issued in exchange for a code, nonce excepted
+	claims map[string]interface{}
+	nonce  string
+	code   string
+	secret string
+}
+
+func newIssuer() *issuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	p := &issuer{key: key, code: "code", secret: "secret"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "key", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != clientID || secret != p.secret || r.FormValue("code") != p.code ||
+			r.FormValue("grant_type") != "authorization_code" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		claims := map[string]interface{}{"nonce": p.nonce}
+		for k, v := range p.claims {
+			claims[k] = v
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": p.sign("RS256", claims)})
+	})
+
+	p.Server = httptest.NewServer(mux)
+
+	return p
+}
+
+// token returns a token issued to alice, of the groups dev and ops, with claims overridden.
+func (p *issuer) token(claims map[string]interface{}) string {
+	c := map[string]interface{}{
+		"iss":    p.URL,
+		"aud":    clientID,
+		"sub":    "alice",
+		"groups": []string{"dev", "ops"},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	}
+
+	for k, v := range claims {
+		c[k] = v
+	}
+
+	return p.sign("RS256", c)
+}
+
+func (p *issuer) sign(alg string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": "key", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+
+	if alg == "RS256" {
+		digest := sha256.Sum256([]byte(signed))
+
+		var err error
+
+		signature, err = rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestConfig(t *testing.T) {
+	Convey("Validate OpenID Connect configurations", t, func() {
+		log := log.NewLogger("debug", "")
+
+		So((&oidc.Config{Issuer: "https://accounts.example.com", ClientID: clientID}).Validate(log), ShouldBeNil)
+		So((&oidc.Config{Issuer: "https://accounts.example.com", ClientID: clientID, ClientSecret: "secret",
+			RedirectURL: "https://zot.example.com/auth/callback"}).Validate(log), ShouldBeNil)
+
+		for _, c := range []oidc.Config{
+			{ClientID: clientID},
+			{Issuer: "accounts.example.com", ClientID: clientID},
+			{Issuer: "https://accounts.example.com"},
+			{Issuer: "https://accounts.example.com", ClientID: clientID,
+				RedirectURL: "https://zot.example.com/auth/callback"},
+			{Issuer: "https://accounts.example.com", ClientID: clientID, ClientSecret: "secret",
+				RedirectURL: "https://zot.example.com/login"},
+			{Issuer: "https://accounts.example.com", ClientID: clientID, ClientSecret: "secret",
+				RedirectURL: "/auth/callback"},
+		} {
+			So(c.Validate(log), ShouldEqual, errors.ErrBadConfig)
+		}
+	})
+}
+
+func TestVerify(t *testing.T) {
+	Convey("Verify ID tokens", t, func() {
+		p := newIssuer()
+		defer p.Close()
+
+		log := log.NewLogger("debug", "")
+
+		provider := oidc.NewProvider(&oidc.Config{Issuer: p.URL, ClientID: clientID, Audiences: []string{"ci"}}, log)
+
+		Convey("Valid tokens name their users and groups", func() {
+			identity, err := provider.Verify(p.token(nil), "")
+			So(err, ShouldBeNil)
+			So(identity.Username, ShouldEqual, "alice")
+			So(identity.Groups, ShouldResemble, []string{"dev", "ops"})
+			So(identity.Expiry, ShouldHappenAfter, time.Now())
+
+			// a single group
+			identity, err = provider.Verify(p.token(map[string]interface{}{"groups": "dev"}), "")
+			So(err, ShouldBeNil)
+			So(identity.Groups, ShouldResemble, []string{"dev"})
+
+			// no groups
+			identity, err = provider.Verify(p.token(map[string]interface{}{"groups": nil}), "")
+			So(err, ShouldBeNil)
+			So(identity.Groups, ShouldBeEmpty)
+
+			// issued to another audience accepted
+			_, err = provider.Verify(p.token(map[string]interface{}{"aud": []string{"other", "ci"}}), "")
+			So(err, ShouldBeNil)
+
+			// issued for the login of the nonce
+			_, err = provider.Verify(p.token(map[string]interface{}{"nonce": "nonce"}), "nonce")
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Users may be named by other claims", func() {
+			provider := oidc.NewProvider(&oidc.Config{Issuer: p.URL, ClientID: clientID,
+				UsernameClaim: "email", GroupsClaim: "roles"}, log)
+
+			identity, err := provider.Verify(p.token(map[string]interface{}{"email": "alice@example.com",
+				"roles": []string{"admin"}}), "")
+			So(err, ShouldBeNil)
+			So(identity.Username, ShouldEqual, "alice@example.com")
+			So(identity.Groups, ShouldResemble, []string{"admin"})
+
+			_, err = provider.Verify(p.token(nil), "")
+			So(err, ShouldEqual, errors.ErrBadIDToken)
+		})
+
+		Convey("Invalid tokens are rejected", func() {
+			for _, claims := range []map[string]interface{}{
+				{"iss": "https://accounts.example.com"},
+				{"aud": "other"},
+				{"aud": nil},
+				{"exp": time.Now().Add(-time.Hour).Unix()},
+				{"exp": nil},
+				{"nbf": time.Now().Add(time.Hour).Unix()},
+				{"sub": ""},
+			} {
+				_, err := provider.Verify(p.token(claims), "")
+				So(err, ShouldEqual, errors.ErrBadIDToken)
+			}
+
+			// issued for another login, or none
+			_, err := provider.Verify(p.token(map[string]interface{}{"nonce": "other"}), "nonce")
+			So(err, ShouldEqual, errors.ErrBadIDToken)
+
+			_, err = provider.Verify(p.token(nil), "nonce")
+			So(err, ShouldEqual, errors.ErrBadIDToken)
+
+			// tampered with
+			token := p.token(nil)
+			parts := strings.Split(token, ".")
+			claims, _ := json.Marshal(map[string]interface{}{"iss": p.URL, "aud": clientID, "sub": "admin",
+				"exp": time.Now().Add(time.Hour).Unix()})
+			parts[1] = base64.RawURLEncoding.EncodeToString(claims)
+
+			_, err = provider.Verify(strings.Join(parts, "."), "")
+			So(err, ShouldEqual, errors.ErrBadIDToken)
+
+			// unsigned, or signed with what's public
+			valid := map[string]interface{}{"iss": p.URL, "aud": clientID, "sub": "alice",
+				"exp": time.Now().Add(time.Hour).Unix()}
+
+			for _, alg := range []string{"none", "HS256"} {
+				_, err := provider.Verify(p.sign(alg, valid), "")
+				So(err, ShouldEqual, errors.ErrBadIDToken)
+			}
+
+			for _, token := range []string{"", "token", "a.b.c", "a.b"} {
+				_, err := provider.Verify(token, "")
+				So(err, ShouldEqual, errors.ErrBadIDToken)
+			}
+		})
+
+		Convey("Tokens can't be verified without the provider", func() {
+			provider := oidc.NewProvider(&oidc.Config{Issuer: "http://127.0.0.1:0", ClientID: clientID}, log)
+
+			_, err := provider.Verify(p.token(nil), "")
+			So(err, ShouldNotBeNil)
+
+			// nor if its metadata isn't that of the issuer
+			provider = oidc.NewProvider(&oidc.Config{Issuer: p.URL + "/", ClientID: clientID}, log)
+
+			_, err = provider.Verify(p.token(nil), "")
+			So(err, ShouldEqual, errors.ErrOIDCProvider)
+		})
+	})
+}
+
+func TestLogin(t *testing.T) {
+	Convey("Log users in with the authorization code flow", t, func() {
+		p := newIssuer()
+		defer p.Close()
+
+		log := log.NewLogger("debug", "")
+
+		provider := oidc.NewProvider(&oidc.Config{Issuer: p.URL, ClientID: clientID, ClientSecret: p.secret,
+			RedirectURL: "http://zot.example.com/auth/callback", Scopes: []string{"groups"}}, log)
+		So(provider.LoginEnabled(), ShouldBeTrue)
+
+		login := func(redirect string) (*url.URL, *http.Cookie) {
+			w := httptest.NewRecorder()
+			provider.ServeLogin(w, httptest.NewRequest(http.MethodGet, oidc.LoginPath+"?redirect="+
+				url.QueryEscape(redirect), nil))
+			So(w.Code, ShouldEqual, http.StatusFound)
+
+			location, err := url.Parse(w.Header().Get("Location"))
+			So(err, ShouldBeNil)
+			So(location.Path, ShouldEqual, "/authorize")
+
+			cookies := w.Result().Cookies()
+			So(len(cookies), ShouldEqual, 1)
+			So(cookies[0].HttpOnly, ShouldBeTrue)
+
+			return location, cookies[0]
+		}
+
+		callback := func(query url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, oidc.CallbackPath+"?"+query.Encode(), nil)
+			if cookie != nil {
+				r.AddCookie(cookie)
+			}
+
+			w := httptest.NewRecorder()
+			provider.ServeCallback(w, r)
+
+			return w
+		}
+
+		location, cookie := login("/v2/_catalog")
+
+		q := location.Query()
+		So(q.Get("response_type"), ShouldEqual, "code")
+		So(q.Get("client_id"), ShouldEqual, clientID)
+		So(q.Get("redirect_uri"), ShouldEqual, "http://zot.example.com/auth/callback")
+		So(q.Get("scope"), ShouldEqual, "openid groups")
+		So(q.Get("state"), ShouldNotBeEmpty)
+		So(q.Get("nonce"), ShouldNotBeEmpty)
+
+		p.claims = map[string]interface{}{"iss": p.URL, "aud": clientID, "sub": "alice",
+			"exp": time.Now().Add(time.Hour).Unix()}
+
+		Convey("Users are sent back where they logged in from, with a session", func() {
+			p.nonce = q.Get("nonce")
+
+			w := callback(url.Values{"state": {q.Get("state")}, "code": {p.code}}, cookie)
+			So(w.Code, ShouldEqual, http.StatusFound)
+			So(w.Header().Get("Location"), ShouldEqual, "/v2/_catalog")
+
+			var session *http.Cookie
+
+			for _, c := range w.Result().Cookies() {
+				if c.Name == oidc.SessionCookie {
+					session = c
+				}
+			}
+
+			So(session, ShouldNotBeNil)
+
+			identity, err := provider.Verify(session.Value, "")
+			So(err, ShouldBeNil)
+			So(identity.Username, ShouldEqual, "alice")
+
+			// which requests are authenticated by
+			r := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+			r.AddCookie(session)
+
+			token, password, ok := oidc.TokenOf(r)
+			So(ok, ShouldBeTrue)
+			So(password, ShouldBeFalse)
+			So(token, ShouldEqual, session.Value)
+
+			// until logged out
+			w = httptest.NewRecorder()
+			provider.ServeLogout(w, httptest.NewRequest(http.MethodGet, oidc.LogoutPath, nil))
+			So(w.Code, ShouldEqual, http.StatusFound)
+			So(w.Header().Get("Location"), ShouldEqual, "/")
+			So(w.Result().Cookies()[0].MaxAge, ShouldBeLessThan, 0)
+		})
+
+		Convey("Logins are rejected unless started here, by the same user", func() {
+			p.nonce = q.Get("nonce")
+
+			So(callback(url.Values{"state": {q.Get("state")}, "code": {p.code}}, nil).Code,
+				ShouldEqual, http.StatusBadRequest)
+			So(callback(url.Values{"state": {"other"}, "code": {p.code}}, cookie).Code,
+				ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Logins are rejected if failed or replayed", func() {
+			So(callback(url.Values{"state": {q.Get("state")}, "error": {"access_denied"}}, cookie).Code,
+				ShouldEqual, http.StatusUnauthorized)
+			So(callback(url.Values{"state": {q.Get("state")}, "code": {"other"}}, cookie).Code,
+				ShouldEqual, http.StatusBadGateway)
+
+			// issued for another login
+			p.nonce = "other"
+
+			So(callback(url.Values{"state": {q.Get("state")}, "code": {p.code}}, cookie).Code,
+				ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Users are only sent back to zot", func() {
+			for _, redirect := range []string{"https://evil.example.com", "//evil.example.com", "/\\evil.example.com"} {
+				_, cookie := login(redirect)
+
+				login, err := url.ParseQuery(cookie.Value)
+				So(err, ShouldBeNil)
+				So(login.Get("redirect"), ShouldEqual, "/")
+			}
+		})
+	})
+}
+
+func TestTokenOf(t *testing.T) {
+	Convey("Find the ID token of requests", t, func() {
+		r := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+
+		_, _, ok := oidc.TokenOf(r)
+		So(ok, ShouldBeFalse)
+
+		r.Header.Set("Authorization", "Bearer a.b.c")
+
+		token, password, ok := oidc.TokenOf(r)
+		So(ok, ShouldBeTrue)
+		So(password, ShouldBeFalse)
+		So(token, ShouldEqual, "a.b.c")
+
+		// as password, e.g. of docker login
+		r.SetBasicAuth("alice", "a.b.c")
+
+		token, password, ok = oidc.TokenOf(r)
+		So(ok, ShouldBeTrue)
+		So(password, ShouldBeTrue)
+		So(token, ShouldEqual, "a.b.c")
+
+		// a password of a user otherwise authenticated
+		r.SetBasicAuth("alice", "password")
+
+		_, _, ok = oidc.TokenOf(r)
+		So(ok, ShouldBeFalse)
+	})
+}
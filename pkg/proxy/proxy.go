@@ -0,0 +1,322 @@
+// Package proxy implements a pull-through cache of upstream registries.
+package proxy
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/upstream"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// Config configures a pull-through cache of upstream registries.
+type Config struct {
+	// the registry repositories are cached from, if any, unless under the prefix of one of Upstreams
+	upstream.Config `mapstructure:",squash" yaml:",inline"`
+	// Upstreams are registries cached under a prefix each, with their own credentials
+	Upstreams []UpstreamConfig
+	// ManifestTTL is how long manifests fetched by tag are served before checking the tag upstream
+	// again, e.g. "10m" for tags moving upstream, such as "latest", to be followed, forever if not set
+	ManifestTTL time.Duration
+}
+
+// UpstreamConfig locates a registry cached under a prefix, e.g. "docker.io" for its repository
+// "library/alpine" to be cached as "docker.io/library/alpine".
+type UpstreamConfig struct {
+	upstream.Config `mapstructure:",squash" yaml:",inline"`
+	Prefix          string
+}
+
+// Validate checks the configuration.
+func (c *Config) Validate(log log.Logger) error {
+	if c.URL == "" && len(c.Upstreams) == 0 {
+		log.Error().Msg("proxy upstream registry URL is required")
+		return errors.ErrBadConfig
+	}
+
+	for _, u := range c.Upstreams {
+		if u.URL == "" || u.Prefix == "" || strings.Trim(u.Prefix, "/") != u.Prefix {
+			log.Error().Str("url", u.URL).Str("prefix", u.Prefix).Msg("invalid proxy upstream registry")
+			return errors.ErrBadConfig
+		}
+	}
+
+	if c.ManifestTTL < 0 {
+		log.Error().Dur("manifestTTL", c.ManifestTTL).Msg("invalid proxy manifest TTL")
+		return errors.ErrBadConfig
+	}
+
+	return nil
+}
+
+// ImageStore serves manifests and blobs from the wrapped store, fetching them from the
+// upstream registry of their repository and storing them there first if missing.
+type ImageStore struct {
+	storage.ImageStore
+	upstreams []source
+	ttl       time.Duration
+	log       log.Logger
+
+	lock    sync.Mutex           // serializes fetches, so concurrent misses fetch an image once
+	checked map[string]time.Time // when tags were last fetched, or checked upstream, by repo:tag
+}
+
+// source is an upstream registry, and the prefix of the repositories cached from it, if any.
+type source struct {
+	prefix string
+	client *upstream.Client
+}
+
+// NewImageStore returns a store caching the contents of the registry client pulls from in is.
+func NewImageStore(is storage.ImageStore, client *upstream.Client, log log.Logger) *ImageStore {
+	return &ImageStore{ImageStore: is, upstreams: []source{{client: client}}, log: log,
+		checked: make(map[string]time.Time)}
+}
+
+// NewProxy returns a store caching in is the contents of the upstream registries configured.
+func NewProxy(config *Config, is storage.ImageStore, log log.Logger) (*ImageStore, error) {
+	p := &ImageStore{ImageStore: is, ttl: config.ManifestTTL, log: log, checked: make(map[string]time.Time)}
+
+	for _, u := range config.Upstreams {
+		client, err := upstream.NewClient(u.Config, log)
+		if err != nil {
+			return nil, err
+		}
+
+		p.upstreams = append(p.upstreams, source{prefix: u.Prefix, client: client})
+	}
+
+	// the most specific prefix first, and the registry of the other repositories last
+	sort.SliceStable(p.upstreams, func(i, j int) bool {
+		return len(p.upstreams[i].prefix) > len(p.upstreams[j].prefix)
+	})
+
+	if config.URL != "" {
+		client, err := upstream.NewClient(config.Config, log)
+		if err != nil {
+			return nil, err
+		}
+
+		p.upstreams = append(p.upstreams, source{client: client})
+	}
+
+	return p, nil
+}
+
+// upstreamOf returns the upstream registry a repository is cached from, if any, and the store
+// to copy it into, as named there.
+func (is *ImageStore) upstreamOf(repo string) (*upstream.Client, storage.ImageStore, string, bool) {
+	for _, s := range is.upstreams {
+		if s.prefix == "" {
+			return s.client, is.ImageStore, repo, true
+		}
+
+		if name := strings.TrimPrefix(repo, s.prefix+"/"); name != repo {
+			return s.client, renamedStore{ImageStore: is.ImageStore, repo: repo}, name, true
+		}
+	}
+
+	return nil, nil, "", false
+}
+
+// GetImageManifest returns a manifest, fetching the image it belongs to if missing, or checking
+// the tag upstream again if fetched over the TTL ago, serving the manifest cached if it can't be.
+func (is *ImageStore) GetImageManifest(repo string, reference string) ([]byte, string, string, error) {
+	body, digest, mediaType, err := is.ImageStore.GetImageManifest(repo, reference)
+	if err == nil && is.expired(repo, reference) {
+		if err := is.fetchImage(repo, reference, true); err != nil {
+			is.log.Warn().Err(err).Str("repo", repo).Str("reference", reference).
+				Msg("unable to check cached tag upstream, serving it as cached")
+		}
+
+		return is.ImageStore.GetImageManifest(repo, reference)
+	}
+
+	if !isMiss(err) {
+		return body, digest, mediaType, err
+	}
+
+	if _, _, _, ok := is.upstreamOf(repo); !ok {
+		return nil, "", "", err
+	}
+
+	if err := is.fetchImage(repo, reference, false); err != nil {
+		return nil, "", "", err
+	}
+
+	return is.ImageStore.GetImageManifest(repo, reference)
+}
+
+// CheckBlob checks a blob is present, fetching it if missing.
+func (is *ImageStore) CheckBlob(repo string, digest string, mediaType string) (bool, int64, error) {
+	ok, size, err := is.ImageStore.CheckBlob(repo, digest, mediaType)
+	if !isMiss(err) {
+		return ok, size, err
+	}
+
+	if err := is.fetchBlob(repo, digest, err); err != nil {
+		return false, -1, err
+	}
+
+	return is.ImageStore.CheckBlob(repo, digest, mediaType)
+}
+
+// GetBlob returns a blob, fetching it if missing.
+func (is *ImageStore) GetBlob(repo string, digest string, mediaType string) (io.Reader, int64, error) {
+	r, size, err := is.ImageStore.GetBlob(repo, digest, mediaType)
+	if !isMiss(err) {
+		return r, size, err
+	}
+
+	if err := is.fetchBlob(repo, digest, err); err != nil {
+		return nil, -1, err
+	}
+
+	return is.ImageStore.GetBlob(repo, digest, mediaType)
+}
+
+// GetBlobPartial returns a range of a blob, fetching the whole blob if missing.
+func (is *ImageStore) GetBlobPartial(repo string, digest string, mediaType string, from int64,
+	to int64) (io.Reader, int64, int64, error) {
+	r, length, size, err := is.ImageStore.GetBlobPartial(repo, digest, mediaType, from, to)
+	if !isMiss(err) {
+		return r, length, size, err
+	}
+
+	if err := is.fetchBlob(repo, digest, err); err != nil {
+		return nil, -1, -1, err
+	}
+
+	return is.ImageStore.GetBlobPartial(repo, digest, mediaType, from, to)
+}
+
+func isMiss(err error) bool {
+	return err == errors.ErrRepoNotFound || err == errors.ErrManifestNotFound || err == errors.ErrBlobNotFound
+}
+
+// expired returns whether a manifest cached by tag is due to be checked upstream again.
+func (is *ImageStore) expired(repo string, reference string) bool {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	return is.due(repo, reference)
+}
+
+// due is expired for callers holding the lock. Tags not fetched since startup are due.
+func (is *ImageStore) due(repo string, reference string) bool {
+	if is.ttl <= 0 {
+		return false
+	}
+
+	if _, err := godigest.Parse(reference); err == nil {
+		return false
+	}
+
+	if _, _, _, ok := is.upstreamOf(repo); !ok {
+		return false
+	}
+
+	return time.Since(is.checked[repo+":"+reference]) >= is.ttl
+}
+
+// fetchImage stores the manifest of an image, along with its config and layers, unless already
+// there, or, to refresh it, checked upstream meanwhile.
+func (is *ImageStore) fetchImage(repo string, reference string, refresh bool) error {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	// another request may have fetched it while we waited
+	if refresh && !is.due(repo, reference) {
+		return nil
+	}
+
+	if _, _, _, err := is.ImageStore.GetImageManifest(repo, reference); err == nil && !refresh {
+		return nil
+	}
+
+	client, store, name, _ := is.upstreamOf(repo)
+
+	// not checked again before the TTL is over, even if upstream is unreachable
+	is.checked[repo+":"+reference] = time.Now()
+
+	digest, err := client.CopyImage(store, name, reference)
+	if err != nil {
+		return err
+	}
+
+	is.log.Info().Str("upstream", client.URL()).Str("repo", repo).Str("reference", reference).
+		Str("digest", digest.String()).Msg("cached image from upstream")
+
+	return nil
+}
+
+// fetchBlob stores a blob, unless already there, returning miss if not cached from upstream.
+func (is *ImageStore) fetchBlob(repo string, digest string, miss error) error {
+	client, store, name, ok := is.upstreamOf(repo)
+	if !ok {
+		return miss
+	}
+
+	d, err := godigest.Parse(digest)
+	if err != nil {
+		return errors.ErrBadBlobDigest
+	}
+
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	if ok, _, err := is.ImageStore.CheckBlob(repo, digest, ""); err == nil && ok {
+		return nil
+	}
+
+	return client.CopyBlob(store, name, d)
+}
+
+// renamedStore is a store whose repository is named otherwise upstream, for upstream clients to
+// copy it, which name it the same in both.
+type renamedStore struct {
+	storage.ImageStore
+	repo string // as named locally
+}
+
+func (s renamedStore) InitRepo(string) error {
+	return s.ImageStore.InitRepo(s.repo)
+}
+
+func (s renamedStore) GetImageManifest(_ string, reference string) ([]byte, string, string, error) {
+	return s.ImageStore.GetImageManifest(s.repo, reference)
+}
+
+func (s renamedStore) PutImageManifest(_ string, reference string, mediaType string, body []byte) (string, error) {
+	return s.ImageStore.PutImageManifest(s.repo, reference, mediaType, body)
+}
+
+func (s renamedStore) CheckBlob(_ string, digest string, mediaType string) (bool, int64, error) {
+	return s.ImageStore.CheckBlob(s.repo, digest, mediaType)
+}
+
+func (s renamedStore) NewBlobUpload(string) (string, error) {
+	return s.ImageStore.NewBlobUpload(s.repo)
+}
+
+func (s renamedStore) GetBlobUpload(_ string, uuid string) (int64, error) {
+	return s.ImageStore.GetBlobUpload(s.repo, uuid)
+}
+
+func (s renamedStore) PutBlobChunkStreamed(_ string, uuid string, body io.Reader) (int64, error) {
+	return s.ImageStore.PutBlobChunkStreamed(s.repo, uuid, body)
+}
+
+func (s renamedStore) FinishBlobUpload(_ string, uuid string, body io.Reader, digest string) error {
+	return s.ImageStore.FinishBlobUpload(s.repo, uuid, body, digest)
+}
+
+func (s renamedStore) DeleteBlobUpload(_ string, uuid string) error {
+	return s.ImageStore.DeleteBlobUpload(s.repo, uuid)
+}
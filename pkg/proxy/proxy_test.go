@@ -0,0 +1,319 @@
+package proxy_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/proxy"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	"github.com/anuvu/zot/pkg/upstream"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestImageStore(t *testing.T) {
+	Convey("Cache images of an upstream registry", t, func() {
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+
+		manifest, err := img.ManifestBlob()
+		So(err, ShouldBeNil)
+
+		config, err := img.ConfigBlob()
+		So(err, ShouldBeNil)
+
+		blobs := map[string][]byte{
+			godigest.FromBytes(config).String():        config,
+			godigest.FromBytes(img.Layers[0]).String(): img.Layers[0],
+		}
+		requests := 0
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+
+			if r.URL.Path == "/v2/repo/manifests/1.0" {
+				w.Header().Set("Content-Type", ispec.MediaTypeImageManifest)
+				_, _ = w.Write(manifest)
+
+				return
+			}
+
+			for digest, blob := range blobs {
+				if r.URL.Path == "/v2/repo/blobs/"+digest {
+					_, _ = w.Write(blob)
+					return
+				}
+			}
+
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer server.Close()
+
+		log := log.NewLogger("debug", "")
+
+		client, err := upstream.NewClient(upstream.Config{URL: server.URL}, log)
+		So(err, ShouldBeNil)
+
+		local := storage.NewImageStoreMem(log)
+		is := proxy.NewImageStore(local, client, log)
+
+		body, _, mediaType, err := is.GetImageManifest("repo", "1.0")
+		So(err, ShouldBeNil)
+		So(body, ShouldResemble, manifest)
+		So(mediaType, ShouldEqual, ispec.MediaTypeImageManifest)
+		So(requests, ShouldEqual, 3)
+
+		// now served locally
+		r, _, err := is.GetBlob("repo", godigest.FromBytes(img.Layers[0]).String(), "")
+		So(err, ShouldBeNil)
+		layer, err := ioutil.ReadAll(r)
+		So(err, ShouldBeNil)
+		So(layer, ShouldResemble, img.Layers[0])
+		So(requests, ShouldEqual, 3)
+
+		_, _, _, err = local.GetImageManifest("repo", "1.0")
+		So(err, ShouldBeNil)
+
+		_, _, _, err = is.GetImageManifest("repo", "2.0")
+		So(err, ShouldEqual, errors.ErrManifestNotFound)
+
+		ok, _, err := is.CheckBlob("other", godigest.FromBytes([]byte("missing")).String(), "")
+		So(err, ShouldEqual, errors.ErrBlobNotFound)
+		So(ok, ShouldBeFalse)
+	})
+}
+
+// registry is an upstream registry serving the images pushed to it as the user given.
+type registry struct {
+	*httptest.Server
+	lock  sync.Mutex
+	store storage.ImageStore
+	pulls int
+}
+
+func newRegistry(username string, password string) *registry {
+	r := &registry{store: storage.NewImageStoreMem(log.NewLogger("debug", ""))}
+
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if u, p, ok := req.BasicAuth(); !ok || u != username || p != password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
+		parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/v2/"), "/manifests/", 2)
+		if len(parts) == 2 {
+			r.pulls++
+
+			body, digest, mediaType, err := r.store.GetImageManifest(parts[0], parts[1])
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			w.Header().Set("Content-Type", mediaType)
+			w.Header().Set("Docker-Content-Digest", digest)
+			_, _ = w.Write(body)
+
+			return
+		}
+
+		parts = strings.SplitN(strings.TrimPrefix(req.URL.Path, "/v2/"), "/blobs/", 2)
+		if len(parts) == 2 {
+			br, size, err := r.store.GetBlob(parts[0], parts[1], "")
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			_, _ = io.Copy(w, br)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	return r
+}
+
+func (r *registry) push(repo string, tag string) godigest.Digest {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	img, err := test.GetRandomImage(64, 1)
+	So(err, ShouldBeNil)
+	So(test.WriteImageToStore(img, r.store, repo, tag), ShouldBeNil)
+
+	digest, err := img.Digest()
+	So(err, ShouldBeNil)
+
+	return digest
+}
+
+func (r *registry) pulled() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.pulls
+}
+
+func TestProxy(t *testing.T) {
+	Convey("Validate proxy configurations", t, func() {
+		log := log.NewLogger("debug", "")
+
+		So((&proxy.Config{}).Validate(log), ShouldEqual, errors.ErrBadConfig)
+		So((&proxy.Config{Config: upstream.Config{URL: "http://upstream"}}).Validate(log), ShouldBeNil)
+
+		for _, u := range []proxy.UpstreamConfig{
+			{Config: upstream.Config{URL: "http://upstream"}},
+			{Config: upstream.Config{URL: "http://upstream"}, Prefix: "docker.io/"},
+			{Prefix: "docker.io"},
+		} {
+			So((&proxy.Config{Upstreams: []proxy.UpstreamConfig{u}}).Validate(log), ShouldEqual, errors.ErrBadConfig)
+		}
+
+		So((&proxy.Config{Upstreams: []proxy.UpstreamConfig{
+			{Config: upstream.Config{URL: "http://upstream"}, Prefix: "docker.io"}}}).Validate(log), ShouldBeNil)
+		So((&proxy.Config{Config: upstream.Config{URL: "http://upstream"}, ManifestTTL: -time.Second}).Validate(log),
+			ShouldEqual, errors.ErrBadConfig)
+	})
+
+	Convey("Cache images of several upstream registries", t, func() {
+		docker := newRegistry("docker", "secret")
+		defer docker.Close()
+
+		quay := newRegistry("quay", "other")
+		defer quay.Close()
+
+		other := newRegistry("other", "secret")
+		defer other.Close()
+
+		library := docker.push("library/alpine", "latest")
+		prefixed := quay.push("org/app", "1.0")
+		unprefixed := other.push("library/busybox", "1.0")
+		specific := other.push("tool", "1.0")
+
+		log := log.NewLogger("debug", "")
+		local := storage.NewImageStoreMem(log)
+
+		is, err := proxy.NewProxy(&proxy.Config{
+			Config: upstream.Config{URL: other.URL, Username: "other", Password: "secret"},
+			Upstreams: []proxy.UpstreamConfig{
+				{Config: upstream.Config{URL: quay.URL, Username: "quay", Password: "other"}, Prefix: "quay.io"},
+				{Config: upstream.Config{URL: docker.URL, Username: "docker", Password: "secret"}, Prefix: "docker.io"},
+				// more specific than the one above
+				{Config: upstream.Config{URL: other.URL, Username: "other", Password: "secret"},
+					Prefix: "docker.io/library/other"},
+			},
+		}, local, log)
+		So(err, ShouldBeNil)
+
+		Convey("by prefix, with their own credentials", func() {
+			_, digest, _, err := is.GetImageManifest("docker.io/library/alpine", "latest")
+			So(err, ShouldBeNil)
+			So(digest, ShouldEqual, library.String())
+
+			_, digest, _, err = is.GetImageManifest("quay.io/org/app", "1.0")
+			So(err, ShouldBeNil)
+			So(digest, ShouldEqual, prefixed.String())
+
+			// stored locally under the prefix
+			_, digest, _, err = local.GetImageManifest("quay.io/org/app", "1.0")
+			So(err, ShouldBeNil)
+			So(digest, ShouldEqual, prefixed.String())
+
+			_, _, _, err = local.GetImageManifest("org/app", "1.0")
+			So(err, ShouldNotBeNil)
+
+			// the others from the unprefixed upstream, by their full name
+			_, digest, _, err = is.GetImageManifest("library/busybox", "1.0")
+			So(err, ShouldBeNil)
+			So(digest, ShouldEqual, unprefixed.String())
+
+			_, digest, _, err = is.GetImageManifest("docker.io/library/other/tool", "1.0")
+			So(err, ShouldBeNil)
+			So(digest, ShouldEqual, specific.String())
+
+			_, _, _, err = is.GetImageManifest("docker.io/library/busybox", "1.0")
+			So(err, ShouldEqual, errors.ErrManifestNotFound)
+		})
+
+		Convey("only from upstreams configured", func() {
+			p, err := proxy.NewProxy(&proxy.Config{Upstreams: []proxy.UpstreamConfig{
+				{Config: upstream.Config{URL: quay.URL, Username: "quay", Password: "other"}, Prefix: "quay.io"},
+			}}, local, log)
+			So(err, ShouldBeNil)
+
+			// the others are served as the local store would
+			_, _, _, err = p.GetImageManifest("docker.io/library/alpine", "latest")
+			So(err, ShouldEqual, errors.ErrRepoNotFound)
+
+			ok, _, err := p.CheckBlob("docker.io/library/alpine", library.String(), "")
+			So(err, ShouldEqual, errors.ErrBlobNotFound)
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("Check cached tags upstream again once their TTL is over", t, func() {
+		registry := newRegistry("user", "secret")
+		defer registry.Close()
+
+		first := registry.push("repo", "latest")
+
+		log := log.NewLogger("debug", "")
+		local := storage.NewImageStoreMem(log)
+
+		is, err := proxy.NewProxy(&proxy.Config{
+			Config:      upstream.Config{URL: registry.URL, Username: "user", Password: "secret"},
+			ManifestTTL: 200 * time.Millisecond,
+		}, local, log)
+		So(err, ShouldBeNil)
+
+		_, digest, _, err := is.GetImageManifest("repo", "latest")
+		So(err, ShouldBeNil)
+		So(digest, ShouldEqual, first.String())
+		pulls := registry.pulled()
+
+		// moved upstream, but served as cached until the TTL is over
+		second := registry.push("repo", "latest")
+
+		_, digest, _, err = is.GetImageManifest("repo", "latest")
+		So(err, ShouldBeNil)
+		So(digest, ShouldEqual, first.String())
+		So(registry.pulled(), ShouldEqual, pulls)
+
+		// never by digest
+		_, _, _, err = is.GetImageManifest("repo", first.String())
+		So(err, ShouldBeNil)
+
+		time.Sleep(300 * time.Millisecond)
+
+		_, digest, _, err = is.GetImageManifest("repo", "latest")
+		So(err, ShouldBeNil)
+		So(digest, ShouldEqual, second.String())
+		So(registry.pulled(), ShouldBeGreaterThan, pulls)
+
+		// served as cached if upstream is unreachable
+		registry.Close()
+		time.Sleep(300 * time.Millisecond)
+
+		_, digest, _, err = is.GetImageManifest("repo", "latest")
+		So(err, ShouldBeNil)
+		So(digest, ShouldEqual, second.String())
+	})
+}
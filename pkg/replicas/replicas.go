@@ -0,0 +1,214 @@
+// Package replicas redirects blob pulls to sibling instances in the region of the client,
+// so that content isn't served across regions when a closer copy exists.
+package replicas
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/upstream"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// how long whether a replica has a blob is remembered for.
+const checkTTL = time.Minute
+
+type Config struct {
+	Region       string // region of this instance
+	RegionHeader string // request header clients may give their region in, e.g. "X-Zot-Region"
+	Clients      []ClientsConfig
+	Replicas     []ReplicaConfig
+}
+
+// ClientsConfig maps the addresses of clients to their region.
+type ClientsConfig struct {
+	Region string
+	CIDRs  []string
+}
+
+// ReplicaConfig locates a sibling instance, and the credentials to check its content with.
+type ReplicaConfig struct {
+	upstream.Config `mapstructure:",squash" yaml:",inline"`
+	Region          string
+}
+
+// Validate checks regions are given, and addresses and URLs well-formed.
+func (c *Config) Validate(log log.Logger) error {
+	if c.Region == "" {
+		log.Error().Msg("region of this instance not set")
+		return errors.ErrBadConfig
+	}
+
+	for _, clients := range c.Clients {
+		if clients.Region == "" {
+			log.Error().Msg("region of clients not set")
+			return errors.ErrBadConfig
+		}
+
+		for _, cidr := range clients.CIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				log.Error().Err(err).Str("cidr", cidr).Msg("invalid clients CIDR")
+				return errors.ErrBadConfig
+			}
+		}
+	}
+
+	for _, r := range c.Replicas {
+		if r.Region == "" || r.URL == "" {
+			log.Error().Str("url", r.URL).Str("region", r.Region).Msg("URL and region of replica required")
+			return errors.ErrBadConfig
+		}
+	}
+
+	return nil
+}
+
+type replica struct {
+	region string
+	url    string
+	client *upstream.Client
+}
+
+type clients struct {
+	region string
+	nets   []*net.IPNet
+}
+
+type check struct {
+	found   bool
+	expires time.Time
+}
+
+// Redirector picks the replica to redirect a blob pull to.
+type Redirector struct {
+	config   *Config
+	replicas []replica
+	clients  []clients
+	log      log.Logger
+
+	lock   sync.Mutex
+	checks map[string]check // by replica URL, repository and digest
+}
+
+// NewRedirector returns a redirector to the replicas of a valid config.
+func NewRedirector(config *Config, log log.Logger) (*Redirector, error) {
+	r := &Redirector{config: config, log: log, checks: map[string]check{}}
+
+	for _, rc := range config.Replicas {
+		client, err := upstream.NewClient(rc.Config, log)
+		if err != nil {
+			return nil, err
+		}
+
+		r.replicas = append(r.replicas, replica{region: rc.Region, url: strings.TrimSuffix(rc.URL, "/"), client: client})
+	}
+
+	for _, cc := range config.Clients {
+		c := clients{region: cc.Region}
+
+		for _, cidr := range cc.CIDRs {
+			_, n, _ := net.ParseCIDR(cidr)
+			c.nets = append(c.nets, n)
+		}
+
+		r.clients = append(r.clients, c)
+	}
+
+	return r, nil
+}
+
+// Region returns the region of the client of a request, from its header if configured and
+// given, or else from its address, empty if unknown.
+func (r *Redirector) Region(req *http.Request) string {
+	if r.config.RegionHeader != "" {
+		if region := req.Header.Get(r.config.RegionHeader); region != "" {
+			return region
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+
+	for _, c := range r.clients {
+		for _, n := range c.nets {
+			if n.Contains(ip) {
+				return c.region
+			}
+		}
+	}
+
+	return ""
+}
+
+// Redirect returns the URL to redirect a pull of a blob to: that of the first replica, in
+// the order configured, in the region of the client which has the blob. It returns false if
+// the client is in the region of this instance, or none of the replicas in its region has
+// the blob.
+func (r *Redirector) Redirect(req *http.Request, repo string, digest string) (string, bool) {
+	region := r.Region(req)
+	if region == "" || region == r.config.Region {
+		return "", false
+	}
+
+	d, err := godigest.Parse(digest)
+	if err != nil {
+		return "", false
+	}
+
+	for _, rep := range r.replicas {
+		if rep.region != region || !r.has(rep, repo, d) {
+			continue
+		}
+
+		r.log.Debug().Str("region", region).Str("replica", rep.url).Str("repo", repo).Str("digest", digest).
+			Msg("redirecting blob pull to replica")
+
+		return rep.url + req.URL.RequestURI(), true
+	}
+
+	return "", false
+}
+
+// has returns whether a replica has a blob, as last checked.
+func (r *Redirector) has(rep replica, repo string, digest godigest.Digest) bool {
+	key := rep.url + "/" + repo + "@" + digest.String()
+
+	r.lock.Lock()
+	c, ok := r.checks[key]
+	r.lock.Unlock()
+
+	if ok && time.Now().Before(c.expires) {
+		return c.found
+	}
+
+	found, err := rep.client.CheckBlob(repo, digest)
+	if err != nil {
+		// serve it here in the meantime
+		r.log.Warn().Err(err).Str("replica", rep.url).Msg("unable to check replica content")
+	}
+
+	r.lock.Lock()
+	r.checks[key] = check{found: found, expires: time.Now().Add(checkTTL)}
+
+	// forget expired checks, so that they don't pile up
+	for k, c := range r.checks {
+		if time.Now().After(c.expires) {
+			delete(r.checks, k)
+		}
+	}
+	r.lock.Unlock()
+
+	return found
+}
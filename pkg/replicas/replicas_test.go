@@ -0,0 +1,116 @@
+package replicas_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/replicas"
+	"github.com/anuvu/zot/pkg/upstream"
+	godigest "github.com/opencontainers/go-digest"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRedirect(t *testing.T) {
+	Convey("Redirect blob pulls to replicas", t, func() {
+		digest := godigest.FromBytes([]byte("blob"))
+		checks := 0
+
+		replica := func(has bool) *httptest.Server {
+			return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				checks++
+
+				if has && r.Method == http.MethodHead && r.URL.Path == "/v2/repo/blobs/"+digest.String() {
+					return
+				}
+
+				w.WriteHeader(http.StatusNotFound)
+			}))
+		}
+
+		empty := replica(false)
+		defer empty.Close()
+
+		full := replica(true)
+		defer full.Close()
+
+		other := replica(true)
+		defer other.Close()
+
+		log := log.NewLogger("debug", "")
+
+		config := &replicas.Config{
+			Region:       "us-east",
+			RegionHeader: "X-Zot-Region",
+			Clients: []replicas.ClientsConfig{
+				{Region: "eu-west", CIDRs: []string{"10.1.0.0/16"}},
+				{Region: "us-east", CIDRs: []string{"10.2.0.0/16"}},
+			},
+			Replicas: []replicas.ReplicaConfig{
+				{Config: upstream.Config{URL: empty.URL}, Region: "eu-west"},
+				{Config: upstream.Config{URL: full.URL + "/"}, Region: "eu-west"},
+				{Config: upstream.Config{URL: other.URL}, Region: "ap-south"},
+			},
+		}
+		So(config.Validate(log), ShouldBeNil)
+
+		r, err := replicas.NewRedirector(config, log)
+		So(err, ShouldBeNil)
+
+		request := func(addr string, region string) *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "/v2/repo/blobs/"+digest.String()+"?ns=docker.io", nil)
+			req.RemoteAddr = addr
+
+			if region != "" {
+				req.Header.Set("X-Zot-Region", region)
+			}
+
+			return req
+		}
+
+		So(r.Region(request("10.1.2.3:1234", "")), ShouldEqual, "eu-west")
+		So(r.Region(request("10.1.2.3:1234", "ap-south")), ShouldEqual, "ap-south")
+		So(r.Region(request("192.168.1.1:1234", "")), ShouldEqual, "")
+
+		// the first replica in the region which has the blob
+		url, ok := r.Redirect(request("10.1.2.3:1234", ""), "repo", digest.String())
+		So(ok, ShouldBeTrue)
+		So(url, ShouldEqual, full.URL+"/v2/repo/blobs/"+digest.String()+"?ns=docker.io")
+		So(checks, ShouldEqual, 2)
+
+		// remembered
+		_, ok = r.Redirect(request("10.1.2.3:1234", ""), "repo", digest.String())
+		So(ok, ShouldBeTrue)
+		So(checks, ShouldEqual, 2)
+
+		url, ok = r.Redirect(request("10.2.2.3:1234", "ap-south"), "repo", digest.String())
+		So(ok, ShouldBeTrue)
+		So(url, ShouldStartWith, other.URL)
+
+		// served here
+		for _, req := range []*http.Request{request("10.2.2.3:1234", ""), request("192.168.1.1:1234", ""),
+			request("10.1.2.3:1234", "us-west")} {
+			_, ok = r.Redirect(req, "repo", digest.String())
+			So(ok, ShouldBeFalse)
+		}
+
+		_, ok = r.Redirect(request("10.1.2.3:1234", ""), "other", digest.String())
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Validate replicas configuration", t, func() {
+		log := log.NewLogger("debug", "")
+
+		for _, config := range []*replicas.Config{
+			{},
+			{Region: "us-east", Clients: []replicas.ClientsConfig{{CIDRs: []string{"10.0.0.0/8"}}}},
+			{Region: "us-east", Clients: []replicas.ClientsConfig{{Region: "eu-west", CIDRs: []string{"10.0.0.0"}}}},
+			{Region: "us-east", Replicas: []replicas.ReplicaConfig{{Region: "eu-west"}}},
+			{Region: "us-east", Replicas: []replicas.ReplicaConfig{{Config: upstream.Config{URL: "http://replica"}}}},
+		} {
+			So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+		}
+	})
+}
@@ -0,0 +1,423 @@
+// Package retention periodically removes tags of repositories according to retention policies.
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/bus"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// how often policies are enforced, if not configured.
+const defaultInterval = 24 * time.Hour
+
+type Config struct {
+	Interval time.Duration
+	DryRun   bool // only log the tags which would be removed
+	Policies []PolicyConfig
+}
+
+// PolicyConfig selects the tags to remove from repositories. If KeepLast or OlderThanDays
+// is set, a tag is removed unless it matches one of KeepTags or is one of the KeepLast
+// most recently created tags, and, if OlderThanDays is set, it was created longer ago than
+// that. Tags of images without a creation time are always kept. If UntaggedAfter is set,
+// manifests without any tag, e.g. pushed by digest, are removed once seen untagged for that
+// long.
+type PolicyConfig struct {
+	Repositories  []string // glob patterns matching repository names, e.g. "ci/*"
+	KeepLast      int
+	KeepTags      []string // regexes
+	OlderThanDays int
+	UntaggedAfter time.Duration
+}
+
+// Validate checks the repository patterns and tag regexes are well-formed, and that each
+// policy removes only some tags.
+func (c *Config) Validate(log log.Logger) error {
+	if c.Interval < 0 {
+		log.Error().Dur("interval", c.Interval).Msg("invalid retention interval")
+		return errors.ErrBadConfig
+	}
+
+	for _, p := range c.Policies {
+		if len(p.Repositories) == 0 {
+			log.Error().Msg("retention policy repositories are required")
+			return errors.ErrBadConfig
+		}
+
+		if p.KeepLast < 0 || p.OlderThanDays < 0 || p.UntaggedAfter < 0 ||
+			(p.KeepLast == 0 && p.OlderThanDays == 0 && p.UntaggedAfter == 0) {
+			log.Error().Strs("repositories", p.Repositories).Int("keepLast", p.KeepLast).
+				Int("olderThanDays", p.OlderThanDays).Dur("untaggedAfter", p.UntaggedAfter).
+				Msg("retention policy needs keepLast, olderThanDays or untaggedAfter")
+
+			return errors.ErrBadConfig
+		}
+
+		for _, r := range p.Repositories {
+			if _, err := path.Match(r, ""); err != nil {
+				log.Error().Err(err).Str("repositories", r).Msg("invalid retention repositories pattern")
+				return errors.ErrBadConfig
+			}
+		}
+
+		for _, t := range p.KeepTags {
+			if _, err := regexp.Compile(t); err != nil {
+				log.Error().Err(err).Str("keepTags", t).Msg("invalid retention tags regex")
+				return errors.ErrBadConfig
+			}
+		}
+	}
+
+	return nil
+}
+
+// Enforcer applies retention policies to an image store, remembering between runs since
+// when manifests have been untagged.
+type Enforcer struct {
+	config *Config
+	is     storage.ImageStore
+	log    log.Logger
+
+	lock     sync.Mutex
+	untagged map[string]time.Time // by repository and digest, since when first seen untagged
+}
+
+// NewEnforcer returns an enforcer of the policies in config on is.
+func NewEnforcer(config *Config, is storage.ImageStore, log log.Logger) *Enforcer {
+	return &Enforcer{config: config, is: is, log: log, untagged: map[string]time.Time{}}
+}
+
+// Subscribe forgets since when manifests have been untagged as they are pushed again or
+// deleted, so that those pushed back untagged don't expire early.
+func (e *Enforcer) Subscribe(b *bus.Bus) {
+	b.Subscribe(func(event bus.Event) {
+		e.lock.Lock()
+		defer e.lock.Unlock()
+
+		delete(e.untagged, event.Repository+"@"+event.Digest)
+	}, bus.ManifestPushed, bus.ManifestDeleted)
+}
+
+// Run enforces the policies in the background, until ctx is done.
+func (e *Enforcer) Run(ctx context.Context, wg *sync.WaitGroup) {
+	interval := e.config.Interval
+	if interval == 0 {
+		interval = defaultInterval
+	}
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			if _, err := e.Enforce(); err != nil {
+				e.log.Error().Err(err).Msg("unable to enforce retention policies")
+			}
+
+			select {
+			case <-ctx.Done():
+				e.log.Info().Msg("stopping retention policies")
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// Enforce removes the tags, and untagged manifests, selected by the first policy matching
+// each repository, returning the references removed, or which would be in a dry run, by
+// repository. The manifests and blobs left unreferenced are reclaimed by garbage collection.
+func (e *Enforcer) Enforce() (map[string][]string, error) {
+	repos, err := e.is.GetRepositories()
+	if err != nil {
+		return nil, err
+	}
+
+	removed := map[string][]string{}
+	untagged := map[string]bool{} // still untagged, by repository and digest
+
+	for _, repo := range repos {
+		policy := match(e.config.Policies, repo)
+		if policy == nil {
+			continue
+		}
+
+		tags, err := expired(*policy, e.is, repo, time.Now(), e.log)
+		if err != nil {
+			e.log.Error().Err(err).Str("repo", repo).Msg("unable to apply retention policy")
+			continue
+		}
+
+		for _, tag := range tags {
+			if im, ok := e.is.(immutable); ok && im.IsImmutable(repo, tag) {
+				e.log.Debug().Str("repo", repo).Str("tag", tag).Msg("keeping immutable tag")
+				continue
+			}
+
+			e.log.Info().Str("repo", repo).Str("tag", tag).Bool("dryRun", e.config.DryRun).Msg("removing expired tag")
+
+			if !e.config.DryRun {
+				if err := e.is.DeleteImageTag(repo, tag); err != nil {
+					e.log.Error().Err(err).Str("repo", repo).Str("tag", tag).Msg("unable to remove tag")
+					continue
+				}
+			}
+
+			removed[repo] = append(removed[repo], tag)
+		}
+
+		if policy.UntaggedAfter == 0 {
+			continue
+		}
+
+		digests, err := e.untaggedManifests(repo)
+		if err != nil {
+			e.log.Error().Err(err).Str("repo", repo).Msg("unable to list untagged manifests")
+			continue
+		}
+
+		for _, digest := range digests {
+			key := repo + "@" + digest
+
+			if time.Since(e.untaggedSince(key)) < policy.UntaggedAfter {
+				untagged[key] = true
+				continue
+			}
+
+			e.log.Info().Str("repo", repo).Str("digest", digest).Bool("dryRun", e.config.DryRun).
+				Msg("removing untagged manifest")
+
+			if e.config.DryRun {
+				untagged[key] = true
+			} else {
+				if err := e.is.DeleteImageManifest(repo, digest); err != nil {
+					e.log.Error().Err(err).Str("repo", repo).Str("digest", digest).Msg("unable to remove manifest")
+					untagged[key] = true
+
+					continue
+				}
+			}
+
+			removed[repo] = append(removed[repo], digest)
+		}
+	}
+
+	// forget manifests which were tagged or removed since
+	e.lock.Lock()
+	for key := range e.untagged {
+		if !untagged[key] {
+			delete(e.untagged, key)
+		}
+	}
+	e.lock.Unlock()
+
+	return removed, nil
+}
+
+// untaggedSince returns since when a manifest has been untagged, now if first seen so.
+func (e *Enforcer) untaggedSince(key string) time.Time {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	since, ok := e.untagged[key]
+	if !ok {
+		since = time.Now()
+		e.untagged[key] = since
+	}
+
+	return since
+}
+
+// untaggedManifests returns the digests of the manifests of repo without any tag, which no
+// image index of repo references either.
+func (e *Enforcer) untaggedManifests(repo string) ([]string, error) {
+	buf, err := e.is.GetIndexContent(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var index ispec.Index
+	if err := json.Unmarshal(buf, &index); err != nil {
+		return nil, err
+	}
+
+	tagged := map[string]bool{}
+	referenced := map[string]bool{}
+
+	for _, m := range index.Manifests {
+		if _, ok := m.Annotations[ispec.AnnotationRefName]; ok {
+			tagged[m.Digest.String()] = true
+		}
+
+		if !storage.IsImageIndex(m.MediaType) {
+			continue
+		}
+
+		buf, _, _, err := e.is.GetImageManifest(repo, m.Digest.String())
+		if err != nil {
+			return nil, err
+		}
+
+		var child ispec.Index
+		if err := json.Unmarshal(buf, &child); err != nil {
+			return nil, err
+		}
+
+		for _, c := range child.Manifests {
+			referenced[c.Digest.String()] = true
+		}
+	}
+
+	digests := []string{}
+
+	for _, m := range index.Manifests {
+		d := m.Digest.String()
+		if !tagged[d] && !referenced[d] {
+			digests = append(digests, d)
+		}
+	}
+
+	return digests, nil
+}
+
+// immutable is implemented by stores protecting some tags, such as storage.ImmutableImageStore.
+type immutable interface {
+	IsImmutable(repo string, tag string) bool
+}
+
+func match(policies []PolicyConfig, repo string) *PolicyConfig {
+	for i, p := range policies {
+		for _, r := range p.Repositories {
+			if ok, _ := path.Match(r, repo); ok {
+				return &policies[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+type taggedImage struct {
+	tag     string
+	created time.Time
+}
+
+// expired returns the tags of repo the policy removes.
+func expired(policy PolicyConfig, is storage.ImageStore, repo string, now time.Time,
+	log log.Logger) ([]string, error) {
+	if policy.KeepLast == 0 && policy.OlderThanDays == 0 {
+		return nil, nil
+	}
+
+	tags, err := is.GetImageTags(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]taggedImage, 0, len(tags))
+
+	for _, tag := range tags {
+		created, err := createdAt(is, repo, tag)
+		if err != nil {
+			return nil, err
+		}
+
+		images = append(images, taggedImage{tag: tag, created: created})
+	}
+
+	// most recent first
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].created.Equal(images[j].created) {
+			return images[i].tag > images[j].tag
+		}
+
+		return images[i].created.After(images[j].created)
+	})
+
+	cutoff := now.AddDate(0, 0, -policy.OlderThanDays)
+	expired := []string{}
+
+	for i, image := range images {
+		switch {
+		case i < policy.KeepLast:
+			continue
+		case image.created.IsZero():
+			log.Debug().Str("repo", repo).Str("tag", image.tag).Msg("keeping tag of image without creation time")
+			continue
+		case policy.OlderThanDays > 0 && image.created.After(cutoff):
+			continue
+		case keeps(policy.KeepTags, image.tag):
+			continue
+		}
+
+		expired = append(expired, image.tag)
+	}
+
+	return expired, nil
+}
+
+func keeps(regexes []string, tag string) bool {
+	for _, r := range regexes {
+		if ok, _ := regexp.MatchString(r, tag); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// createdAt returns the creation time in the config of the tagged image, if any.
+func createdAt(is storage.ImageStore, repo string, tag string) (time.Time, error) {
+	buf, _, mediaType, err := is.GetImageManifest(repo, tag)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// indexes have no config to tell their age by
+	if !storage.IsImageManifest(mediaType) {
+		return time.Time{}, nil
+	}
+
+	var manifest ispec.Manifest
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return time.Time{}, err
+	}
+
+	r, _, err := is.GetBlob(repo, manifest.Config.Digest.String(), manifest.Config.MediaType)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	buf, err = ioutil.ReadAll(r)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var config ispec.Image
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return time.Time{}, err
+	}
+
+	if config.Created == nil {
+		return time.Time{}, nil
+	}
+
+	return *config.Created, nil
+}
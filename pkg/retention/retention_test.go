@@ -0,0 +1,223 @@
+package retention_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/bus"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/retention"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	godigest "github.com/opencontainers/go-digest"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// pushImage writes a new image created days ago, or without creation time if days is negative.
+func pushImage(is storage.ImageStore, repo string, tag string, days int) {
+	img, err := test.GetRandomImage(16, 1)
+	So(err, ShouldBeNil)
+
+	if days >= 0 {
+		created := time.Now().AddDate(0, 0, -days)
+		img.Config.Created = &created
+	}
+
+	cblob, err := img.ConfigBlob()
+	So(err, ShouldBeNil)
+
+	img.Manifest.Config.Digest = godigest.FromBytes(cblob)
+	img.Manifest.Config.Size = int64(len(cblob))
+
+	So(test.WriteImageToStore(img, is, repo, tag), ShouldBeNil)
+}
+
+func TestRetention(t *testing.T) {
+	Convey("Enforce retention policies", t, func() {
+		log := log.NewLogger("debug", "")
+		is := storage.NewImageStoreMem(log)
+
+		// tag: age in days
+		pushImage(is, "ci/app", "build-1", 40)
+		pushImage(is, "ci/app", "build-2", 30)
+		pushImage(is, "ci/app", "build-3", 12)
+		pushImage(is, "ci/app", "build-4", 10)
+		pushImage(is, "ci/app", "build-5", 1)
+		pushImage(is, "ci/app", "v1.0", 50)
+		pushImage(is, "ci/app", "unknown", -1)
+		pushImage(is, "ci/tool", "a", 3)
+		pushImage(is, "ci/tool", "b", 2)
+		pushImage(is, "ci/tool", "c", 1)
+		pushImage(is, "library/base", "old", 400)
+
+		config := &retention.Config{Policies: []retention.PolicyConfig{
+			{Repositories: []string{"ci/app"}, KeepLast: 2, KeepTags: []string{`^v\d+`}, OlderThanDays: 15},
+			{Repositories: []string{"ci/*"}, KeepLast: 1},
+		}}
+		So(config.Validate(log), ShouldBeNil)
+
+		Convey("Dry run", func() {
+			config.DryRun = true
+
+			removed, err := retention.NewEnforcer(config, is, log).Enforce()
+			So(err, ShouldBeNil)
+			So(removed, ShouldResemble, map[string][]string{
+				"ci/app":  {"build-2", "build-1"},
+				"ci/tool": {"b", "a"},
+			})
+
+			tags, err := is.GetImageTags("ci/app")
+			So(err, ShouldBeNil)
+			So(tags, ShouldHaveLength, 7)
+		})
+
+		Convey("Remove tags", func() {
+			removed, err := retention.NewEnforcer(config, is, log).Enforce()
+			So(err, ShouldBeNil)
+			So(removed, ShouldHaveLength, 2)
+
+			// the most recent tags, those kept by regex or of unknown age, and younger ones
+			tags, err := is.GetImageTags("ci/app")
+			So(err, ShouldBeNil)
+			So(tags, ShouldResemble, []string{"build-3", "build-4", "build-5", "v1.0", "unknown"})
+
+			tags, err = is.GetImageTags("ci/tool")
+			So(err, ShouldBeNil)
+			So(tags, ShouldResemble, []string{"c"})
+
+			// no policy applies
+			tags, err = is.GetImageTags("library/base")
+			So(err, ShouldBeNil)
+			So(tags, ShouldResemble, []string{"old"})
+
+			removed, err = retention.NewEnforcer(config, is, log).Enforce()
+			So(err, ShouldBeNil)
+			So(removed, ShouldBeEmpty)
+		})
+	})
+
+	Convey("Keep immutable tags", t, func() {
+		log := log.NewLogger("debug", "")
+		is := storage.NewImmutableImageStore(storage.NewImageStoreMem(log),
+			[]storage.ImmutableTagsConfig{{Tags: []string{`^v`}}}, log)
+
+		pushImage(is, "app", "v1", 30)
+		pushImage(is, "app", "build-1", 30)
+
+		config := &retention.Config{Policies: []retention.PolicyConfig{{Repositories: []string{"*"}, OlderThanDays: 7}}}
+
+		removed, err := retention.NewEnforcer(config, is, log).Enforce()
+		So(err, ShouldBeNil)
+		So(removed, ShouldResemble, map[string][]string{"app": {"build-1"}})
+
+		tags, err := is.GetImageTags("app")
+		So(err, ShouldBeNil)
+		So(tags, ShouldResemble, []string{"v1"})
+	})
+
+	Convey("Remove untagged manifests", t, func() {
+		log := log.NewLogger("debug", "")
+		is := storage.NewImageStoreMem(log)
+
+		images := make([]test.Image, 3)
+		digests := make([]string, 3)
+
+		for i := range images {
+			img, err := test.GetRandomImage(16, 1)
+			So(err, ShouldBeNil)
+
+			d, err := img.Digest()
+			So(err, ShouldBeNil)
+
+			images[i], digests[i] = img, d.String()
+			So(test.WriteImageToStore(img, is, "app", digests[i]), ShouldBeNil)
+		}
+
+		So(test.WriteImageToStore(images[0], is, "app", "latest"), ShouldBeNil)
+
+		config := &retention.Config{Policies: []retention.PolicyConfig{{
+			Repositories:  []string{"*"},
+			UntaggedAfter: 100 * time.Millisecond,
+		}}}
+		So(config.Validate(log), ShouldBeNil)
+
+		e := retention.NewEnforcer(config, is, log)
+
+		// not untagged for long enough yet
+		removed, err := e.Enforce()
+		So(err, ShouldBeNil)
+		So(removed, ShouldBeEmpty)
+
+		// tagged since, so no longer expiring
+		So(test.WriteImageToStore(images[1], is, "app", "1.0"), ShouldBeNil)
+
+		time.Sleep(200 * time.Millisecond)
+
+		removed, err = e.Enforce()
+		So(err, ShouldBeNil)
+		So(removed, ShouldResemble, map[string][]string{"app": {digests[2]}})
+
+		tags, err := is.GetImageTags("app")
+		So(err, ShouldBeNil)
+		So(tags, ShouldResemble, []string{"latest", "1.0"})
+
+		_, _, _, err = is.GetImageManifest("app", digests[2])
+		So(err, ShouldEqual, errors.ErrManifestNotFound)
+	})
+
+	Convey("Restart expiry of manifests pushed again", t, func() {
+		log := log.NewLogger("debug", "")
+		b := bus.New(log)
+		is := bus.NewImageStore(storage.NewImageStoreMem(log), b)
+
+		img, err := test.GetRandomImage(16, 1)
+		So(err, ShouldBeNil)
+
+		d, err := img.Digest()
+		So(err, ShouldBeNil)
+
+		digest := d.String()
+		So(test.WriteImageToStore(img, is, "app", digest), ShouldBeNil)
+
+		config := &retention.Config{Policies: []retention.PolicyConfig{{
+			Repositories:  []string{"*"},
+			UntaggedAfter: 100 * time.Millisecond,
+		}}}
+		So(config.Validate(log), ShouldBeNil)
+
+		e := retention.NewEnforcer(config, is, log)
+		e.Subscribe(b)
+
+		removed, err := e.Enforce()
+		So(err, ShouldBeNil)
+		So(removed, ShouldBeEmpty)
+
+		time.Sleep(200 * time.Millisecond)
+
+		So(is.DeleteImageManifest("app", digest), ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "app", digest), ShouldBeNil)
+
+		removed, err = e.Enforce()
+		So(err, ShouldBeNil)
+		So(removed, ShouldBeEmpty)
+	})
+
+	Convey("Validate retention configuration", t, func() {
+		log := log.NewLogger("debug", "")
+
+		for _, policy := range []retention.PolicyConfig{
+			{KeepLast: 1},
+			{Repositories: []string{"*"}},
+			{Repositories: []string{"*"}, KeepLast: -1},
+			{Repositories: []string{"["}, KeepLast: 1},
+			{Repositories: []string{"*"}, KeepLast: 1, KeepTags: []string{"("}},
+		} {
+			config := &retention.Config{Policies: []retention.PolicyConfig{policy}}
+			So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+		}
+
+		config := &retention.Config{Interval: -time.Hour}
+		So(config.Validate(log), ShouldEqual, errors.ErrBadConfig)
+	})
+}
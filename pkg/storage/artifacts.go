@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"encoding/json"
+	"path"
+
+	"github.com/anuvu/zot/errors"
+	zlog "github.com/anuvu/zot/pkg/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// MediaTypeEmptyJSON is that of the empty JSON object, the config of artifacts without one.
+const MediaTypeEmptyJSON = "application/vnd.oci.empty.v1+json"
+
+// imageMediaTypes are those of the configs and layers of images, always accepted.
+var imageMediaTypes = map[string]bool{ // nolint:gochecknoglobals
+	ispec.MediaTypeImageConfig:                          true,
+	ispec.MediaTypeImageLayer:                           true,
+	ispec.MediaTypeImageLayerGzip:                       true,
+	ispec.MediaTypeImageLayerNonDistributable:           true,
+	ispec.MediaTypeImageLayerNonDistributableGzip:       true,
+	"application/vnd.oci.image.layer.v1.tar+zstd":       true,
+	"application/vnd.docker.container.image.v1+json":    true,
+	"application/vnd.docker.image.rootfs.diff.tar.gzip": true,
+	MediaTypeEmptyJSON:                                  true,
+}
+
+// ValidateArtifactTypes checks the patterns of the artifact media types allowed are well-formed.
+func ValidateArtifactTypes(types []string, log zlog.Logger) error {
+	for _, t := range types {
+		if _, err := path.Match(t, ""); err != nil {
+			log.Error().Err(err).Str("artifactTypes", t).Msg("invalid artifact media type pattern")
+			return errors.ErrBadConfig
+		}
+	}
+
+	return nil
+}
+
+// ArtifactImageStore refuses manifests of artifacts, e.g. helm charts or SBOMs, pushed to the
+// wrapped store unless their artifact type and the media types of their config and layers are
+// those of images or among those allowed.
+type ArtifactImageStore struct {
+	ImageStore
+	types []string
+	log   zlog.Logger
+}
+
+// NewArtifactImageStore returns a store accepting the artifacts of the media types matching
+// the glob patterns of types, e.g. "application/vnd.cncf.helm.*", besides images, in is. The
+// patterns must be valid.
+func NewArtifactImageStore(is ImageStore, types []string, log zlog.Logger) *ArtifactImageStore {
+	return &ArtifactImageStore{ImageStore: is, types: types, log: log}
+}
+
+// IsAllowed reports whether the config or layers of manifests may be of mediaType.
+func (is *ArtifactImageStore) IsAllowed(mediaType string) bool {
+	if imageMediaTypes[mediaType] {
+		return true
+	}
+
+	for _, pattern := range is.types {
+		if ok, _ := path.Match(pattern, mediaType); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PutImageManifest adds an image manifest to the repository, unless that of an artifact
+// whose media types aren't allowed.
+func (is *ArtifactImageStore) PutImageManifest(repo string, reference string, mediaType string,
+	body []byte) (string, error) {
+	var m struct {
+		ArtifactType string `json:"artifactType"`
+		Config       struct {
+			MediaType string `json:"mediaType"`
+		} `json:"config"`
+		Layers []struct {
+			MediaType string `json:"mediaType"`
+		} `json:"layers"`
+	}
+
+	// invalid manifests are left for the wrapped store to reject
+	if !IsImageManifest(mediaType) || json.Unmarshal(body, &m) != nil {
+		return is.ImageStore.PutImageManifest(repo, reference, mediaType, body)
+	}
+
+	types := []string{m.Config.MediaType}
+	if m.ArtifactType != "" {
+		types = append(types, m.ArtifactType)
+	}
+
+	for _, l := range m.Layers {
+		types = append(types, l.MediaType)
+	}
+
+	for _, t := range types {
+		if !is.IsAllowed(t) {
+			is.log.Error().Str("repo", repo).Str("reference", reference).Str("mediaType", t).
+				Msg("refusing artifact of media type not allowed")
+
+			return "", errors.ErrMediaTypeNotAllowed
+		}
+	}
+
+	return is.ImageStore.PutImageManifest(repo, reference, mediaType, body)
+}
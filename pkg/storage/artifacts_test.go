@@ -0,0 +1,79 @@
+package storage_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestArtifactTypes(t *testing.T) {
+	Convey("Accept the artifacts allowed", t, func() {
+		log := log.NewLogger("debug", "")
+
+		types := []string{"application/vnd.cncf.helm.*", "application/spdx+json"}
+		So(storage.ValidateArtifactTypes(types, log), ShouldBeNil)
+
+		is := storage.NewArtifactImageStore(storage.NewImageStoreMem(log), types, log)
+
+		So(is.IsAllowed(ispec.MediaTypeImageConfig), ShouldBeTrue)
+		So(is.IsAllowed(ispec.MediaTypeImageLayerGzip), ShouldBeTrue)
+		So(is.IsAllowed("application/vnd.cncf.helm.chart.content.v1.tar+gzip"), ShouldBeTrue)
+		So(is.IsAllowed("application/spdx+json"), ShouldBeTrue)
+		So(is.IsAllowed("application/vnd.wasm.config.v1+json"), ShouldBeFalse)
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "app", "1.0"), ShouldBeNil)
+
+		// its config and layers of other media types
+		artifact := func(config string, layer string) test.Image {
+			a := img
+			a.Manifest.Config.MediaType = config
+			a.Manifest.Layers = append([]ispec.Descriptor{}, img.Manifest.Layers...)
+			a.Manifest.Layers[0].MediaType = layer
+
+			return a
+		}
+
+		chart := artifact("application/vnd.cncf.helm.config.v1+json", "application/vnd.cncf.helm.chart.content.v1.tar+gzip")
+		So(test.WriteImageToStore(chart, is, "chart", "1.0"), ShouldBeNil)
+
+		module := artifact("application/vnd.wasm.config.v1+json", "application/vnd.wasm.content.layer.v1+wasm")
+		So(test.WriteImageToStore(module, is, "module", "1.0"), ShouldEqual, errors.ErrMediaTypeNotAllowed)
+
+		// whose layers may not all be allowed
+		mixed := artifact("application/vnd.cncf.helm.config.v1+json", "application/vnd.wasm.content.layer.v1+wasm")
+		So(test.WriteImageToStore(mixed, is, "chart", "1.1"), ShouldEqual, errors.ErrMediaTypeNotAllowed)
+
+		// nor their artifact type
+		mblob, err := img.ManifestBlob()
+		So(err, ShouldBeNil)
+
+		var manifest map[string]interface{}
+		So(json.Unmarshal(mblob, &manifest), ShouldBeNil)
+
+		manifest["artifactType"] = "application/vnd.example.unknown"
+		mblob, err = json.Marshal(manifest)
+		So(err, ShouldBeNil)
+
+		_, err = is.PutImageManifest("app", "1.1", ispec.MediaTypeImageManifest, mblob)
+		So(err, ShouldEqual, errors.ErrMediaTypeNotAllowed)
+
+		manifest["artifactType"] = "application/spdx+json"
+		mblob, err = json.Marshal(manifest)
+		So(err, ShouldBeNil)
+
+		_, err = is.PutImageManifest("app", "1.1", ispec.MediaTypeImageManifest, mblob)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Validate artifact types configuration", t, func() {
+		So(storage.ValidateArtifactTypes([]string{"["}, log.NewLogger("debug", "")), ShouldEqual, errors.ErrBadConfig)
+	})
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// maxCachedBlobs bounds the blobs whose size is remembered, past which they're all forgotten.
+const maxCachedBlobs = 64 * 1024
+
+// blobSizes remembers the size of blobs, by path, or that they don't exist, so that clients
+// checking for the same blobs over and over (e.g. buildkit, before each push) don't stat them
+// each time. Blobs being content-addressed, their size only changes with their existence, when
+// they're written or removed, which this store then forgets. It's nil for a shared storage,
+// whose blobs other processes may write or remove.
+type blobSizes struct {
+	lock  sync.Mutex
+	sizes map[string]int64 // -1 if the blob doesn't exist
+}
+
+func newBlobSizes() *blobSizes {
+	return &blobSizes{sizes: make(map[string]int64)}
+}
+
+// stat returns the size of a blob, or an error if it can't be found.
+func (b *blobSizes) stat(path string) (int64, error) {
+	if b == nil {
+		return statSize(path)
+	}
+
+	b.lock.Lock()
+	size, ok := b.sizes[path]
+	b.lock.Unlock()
+
+	if ok {
+		if size < 0 {
+			return -1, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+		}
+
+		return size, nil
+	}
+
+	size, err := statSize(path)
+	if err != nil && !os.IsNotExist(err) {
+		return -1, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(b.sizes) >= maxCachedBlobs {
+		b.sizes = make(map[string]int64)
+	}
+
+	b.sizes[path] = size
+
+	return size, err
+}
+
+// forget has a blob stat'ed again, once written or removed.
+func (b *blobSizes) forget(path string) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.sizes, path)
+}
+
+// forgetRepo has the blobs of a repository, at dir, stat'ed again, once it's deleted.
+func (b *blobSizes) forgetRepo(dir string) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	prefix := dir + string(filepath.Separator)
+
+	for path := range b.sizes {
+		if strings.HasPrefix(path, prefix) {
+			delete(b.sizes, path)
+		}
+	}
+}
+
+func statSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return -1, err
+	}
+
+	return fi.Size(), nil
+}
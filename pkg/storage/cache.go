@@ -1,9 +1,14 @@
 package storage
 
 import (
-	"path"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/anuvu/zot/errors"
 	zlog "github.com/anuvu/zot/pkg/log"
@@ -12,26 +17,114 @@ import (
 
 const (
 	BlobsCache = "blobs"
+	// CacheName is the name of the dedupe cache db of an image store.
+	CacheName = "cache"
+
+	// how long to wait for another process to release the cache db.
+	cacheOpenTimeout = time.Second
+
+	// how long to wait for other instances to release a shared cache db.
+	sharedCacheOpenTimeout = 10 * time.Second
+
+	// MaxCacheShards bounds how many dbs a dedupe cache is spread over.
+	MaxCacheShards = 256
 )
 
+// Cache records where blobs are stored, by digest, for identical blobs to be deduped. Its records
+// are spread over one or more bolt dbs, whose single writer each otherwise serializes all pushes.
 type Cache struct {
 	rootDir string
-	db      *bbolt.DB
+	shards  []*cacheShard
 	log     zlog.Logger
 }
 
+// cacheShard is one of the dbs holding the records of a cache, those of the digests hashed to it.
+type cacheShard struct {
+	db     *bbolt.DB // nil if shared
+	dbPath string
+}
+
 // Blob is a blob record.
 type Blob struct {
 	Path string
 }
 
-func NewCache(rootDir string, name string, log zlog.Logger) *Cache {
-	dbPath := path.Join(rootDir, name+".db")
-	db, err := bbolt.Open(dbPath, 0600, nil)
+// cacheDBPath returns the path of a shard of the cache db under rootDir, the first of which is
+// that of a cache in a single db.
+func cacheDBPath(rootDir string, name string, shard int) string {
+	if shard == 0 {
+		return filepath.Join(rootDir, name+".db")
+	}
+
+	return filepath.Join(rootDir, fmt.Sprintf("%s.%d.db", name, shard))
+}
+
+// cacheDBPaths returns the paths of the shards of the cache db under rootDir which exist.
+func cacheDBPaths(rootDir string, name string) []string {
+	paths := []string{}
+
+	for shard := 0; ; shard++ {
+		dbPath := cacheDBPath(rootDir, name, shard)
+		if _, err := os.Stat(dbPath); err != nil {
+			return paths
+		}
+
+		paths = append(paths, dbPath)
+	}
+}
+
+// cacheShardOf returns the shard holding the records of a digest, out of count.
+func cacheShardOf(digest []byte, count int) int {
+	h := fnv.New32a()
+	_, _ = h.Write(digest)
+
+	return int(h.Sum32() % uint32(count))
+}
+
+// NewCache returns a cache whose records are in the db named name under rootDir, spread over
+// shards dbs, e.g. 8 for them to be written by 8 writers at a time under heavy concurrent
+// pushes, instead of one, if not set.
+func NewCache(rootDir string, name string, shards int, log zlog.Logger) *Cache {
+	count := shards
+	if count < 1 {
+		count = 1
+	}
+
+	c := &Cache{rootDir: rootDir, log: log}
+
+	// created if missing, unless the root directory itself is
+	existing := len(cacheDBPaths(rootDir, name))
+
+	for shard := 0; shard < count; shard++ {
+		dbPath := cacheDBPath(rootDir, name, shard)
+
+		db, err := openCacheDB(dbPath, log)
+		if err != nil {
+			c.Close()
+			return nil
+		}
+
+		c.shards = append(c.shards, &cacheShard{db: db, dbPath: dbPath})
+	}
+
+	// records are moved once the shards change, e.g. when restored from a single db
+	if count > 1 || existing > 1 {
+		if err := c.reshard(name, existing); err != nil {
+			log.Error().Err(err).Str("rootDir", rootDir).Msg("unable to spread the cache over its dbs")
+			c.Close()
+
+			return nil
+		}
+	}
+
+	return c
+}
 
+func openCacheDB(dbPath string, log zlog.Logger) (*bbolt.DB, error) {
+	db, err := bbolt.Open(dbPath, 0600, nil)
 	if err != nil {
 		log.Error().Err(err).Str("dbPath", dbPath).Msg("unable to create cache db")
-		return nil
+		return nil, err
 	}
 
 	if err := db.Update(func(tx *bbolt.Tx) error {
@@ -44,10 +137,162 @@ func NewCache(rootDir string, name string, log zlog.Logger) *Cache {
 	}); err != nil {
 		// something went wrong
 		log.Error().Err(err).Msg("unable to create a cache")
+		db.Close()
+
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// reshard moves the records of the digests which aren't in their shard, out of the existing
+// dbs, to it, removing the dbs beyond the shards.
+func (c *Cache) reshard(name string, existing int) error {
+	for shard := 0; shard < existing; shard++ {
+		src := c.shards[0].db
+
+		if shard < len(c.shards) {
+			src = c.shards[shard].db
+		} else {
+			db, err := bbolt.Open(cacheDBPath(c.rootDir, name, shard), 0600, nil)
+			if err != nil {
+				return err
+			}
+
+			src = db
+		}
+
+		err := src.Update(func(tx *bbolt.Tx) error {
+			root := tx.Bucket([]byte(BlobsCache))
+			if root == nil {
+				return nil
+			}
+
+			misplaced := [][]byte{}
+
+			if err := root.ForEach(func(digest, _ []byte) error {
+				if cacheShardOf(digest, len(c.shards)) != shard {
+					misplaced = append(misplaced, append([]byte{}, digest...))
+				}
+
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			// buckets can't be modified while iterating over them
+			for _, digest := range misplaced {
+				if err := c.shards[cacheShardOf(digest, len(c.shards))].db.Update(func(dstTx *bbolt.Tx) error {
+					b, err := dstTx.Bucket([]byte(BlobsCache)).CreateBucketIfNotExists(digest)
+					if err != nil {
+						return err
+					}
+
+					return copyBucket(root.Bucket(digest), b)
+				}); err != nil {
+					return err
+				}
+
+				if err := root.DeleteBucket(digest); err != nil {
+					return err
+				}
+			}
+
+			if len(misplaced) > 0 {
+				c.log.Info().Str("dbPath", src.Path()).Int("moved", len(misplaced)).Msg("cache records moved to their db")
+			}
+
+			return nil
+		})
+
+		if shard >= len(c.shards) {
+			dbPath := src.Path()
+			src.Close()
+
+			if err == nil {
+				err = os.Remove(dbPath)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NewSharedCache returns a cache whose db can be shared with other processes, e.g. zot
+// instances serving the same storage, since it is only opened for each transaction.
+func NewSharedCache(rootDir string, name string, shards int, log zlog.Logger) *Cache {
+	c := NewCache(rootDir, name, shards, log)
+	if c == nil {
 		return nil
 	}
 
-	return &Cache{rootDir: rootDir, db: db, log: log}
+	for _, shard := range c.shards {
+		if err := shard.db.Close(); err != nil {
+			log.Error().Err(err).Str("dbPath", shard.dbPath).Msg("unable to close cache db")
+			return nil
+		}
+
+		shard.db = nil
+	}
+
+	return c
+}
+
+// shard returns the shard holding the records of a digest.
+func (c *Cache) shard(digest string) *cacheShard {
+	return c.shards[cacheShardOf([]byte(digest), len(c.shards))]
+}
+
+// update runs fn in a read-write transaction of the shard holding the records of a digest.
+func (c *Cache) update(digest string, fn func(tx *bbolt.Tx) error) error {
+	shard := c.shard(digest)
+	if shard.db != nil {
+		return shard.db.Update(fn)
+	}
+
+	db, err := c.open(shard.dbPath, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(fn)
+}
+
+// view runs fn in a read-only transaction of the shard holding the records of a digest.
+func (c *Cache) view(digest string, fn func(tx *bbolt.Tx) error) error {
+	shard := c.shard(digest)
+	if shard.db != nil {
+		return shard.db.View(fn)
+	}
+
+	db, err := c.open(shard.dbPath, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(fn)
+}
+
+// open opens a shared cache db, waiting for other processes to release it.
+func (c *Cache) open(dbPath string, readOnly bool) (*bbolt.DB, error) {
+	db, err := bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: sharedCacheOpenTimeout, ReadOnly: readOnly})
+	if err != nil {
+		c.log.Error().Err(err).Str("dbPath", dbPath).Msg("unable to open shared cache db")
+
+		if err == bbolt.ErrTimeout {
+			return nil, errors.ErrCacheInUse
+		}
+
+		return nil, err
+	}
+
+	return db, nil
 }
 
 func (c *Cache) PutBlob(digest string, path string) error {
@@ -57,7 +302,10 @@ func (c *Cache) PutBlob(digest string, path string) error {
 		c.log.Error().Err(err).Str("path", path).Msg("unable to get relative path")
 	}
 
-	if err := c.db.Update(func(tx *bbolt.Tx) error {
+	// records are kept with forward slashes, regardless of the platform
+	relp = filepath.ToSlash(relp)
+
+	if err := c.update(digest, func(tx *bbolt.Tx) error {
 		root := tx.Bucket([]byte(BlobsCache))
 		if root == nil {
 			// this is a serious failure
@@ -84,9 +332,13 @@ func (c *Cache) PutBlob(digest string, path string) error {
 }
 
 func (c *Cache) GetBlob(digest string) (string, error) {
+	if faulty(FaultCacheMiss) {
+		return "", errors.ErrCacheMiss
+	}
+
 	var blobPath strings.Builder
 
-	if err := c.db.View(func(tx *bbolt.Tx) error {
+	if err := c.view(digest, func(tx *bbolt.Tx) error {
 		root := tx.Bucket([]byte(BlobsCache))
 		if root == nil {
 			// this is a serious failure
@@ -113,11 +365,15 @@ func (c *Cache) GetBlob(digest string) (string, error) {
 		return "", nil
 	}
 
-	return blobPath.String(), nil
+	return filepath.FromSlash(blobPath.String()), nil
 }
 
 func (c *Cache) HasBlob(digest string, blob string) bool {
-	if err := c.db.View(func(tx *bbolt.Tx) error {
+	if faulty(FaultCacheMiss) {
+		return false
+	}
+
+	if err := c.view(digest, func(tx *bbolt.Tx) error {
 		root := tx.Bucket([]byte(BlobsCache))
 		if root == nil {
 			// this is a serious failure
@@ -149,7 +405,9 @@ func (c *Cache) DeleteBlob(digest string, path string) error {
 		c.log.Error().Err(err).Str("path", path).Msg("unable to get relative path")
 	}
 
-	if err := c.db.Update(func(tx *bbolt.Tx) error {
+	relp = filepath.ToSlash(relp)
+
+	if err := c.update(digest, func(tx *bbolt.Tx) error {
 		root := tx.Bucket([]byte(BlobsCache))
 		if root == nil {
 			// this is a serious failure
@@ -186,3 +444,293 @@ func (c *Cache) DeleteBlob(digest string, path string) error {
 
 	return nil
 }
+
+// Name returns the name the driver is registered as.
+func (c *Cache) Name() string {
+	return BoltCacheDriverName
+}
+
+// Close closes the underlying cache dbs.
+func (c *Cache) Close() error {
+	var err error
+
+	for _, shard := range c.shards {
+		if shard.db == nil {
+			continue
+		}
+
+		if cerr := shard.db.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// Export writes a consistent copy of the cache db to w, as a single db even if spread over
+// several, each shard being copied as of when it's read.
+func (c *Cache) Export(w io.Writer) error {
+	dbs := make([]*bbolt.DB, 0, len(c.shards))
+
+	for _, shard := range c.shards {
+		if shard.db != nil {
+			dbs = append(dbs, shard.db)
+			continue
+		}
+
+		db, err := c.open(shard.dbPath, true)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		dbs = append(dbs, db)
+	}
+
+	return writeCacheDBs(dbs, c.rootDir, w)
+}
+
+// ExportCache writes a consistent copy of the cache db under rootDir to w, for when it isn't
+// open in this process. It fails with ErrCacheInUse if another process has it open, unless
+// it is shared.
+func ExportCache(rootDir string, name string, w io.Writer, log zlog.Logger) error {
+	paths := cacheDBPaths(rootDir, name)
+	if len(paths) == 0 {
+		return errors.ErrCacheNotFound
+	}
+
+	dbs := make([]*bbolt.DB, 0, len(paths))
+
+	for _, dbPath := range paths {
+		db, err := bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: cacheOpenTimeout, ReadOnly: true})
+		if err != nil {
+			if err == bbolt.ErrTimeout {
+				err = errors.ErrCacheInUse
+			}
+
+			log.Error().Err(err).Str("dbPath", dbPath).Msg("unable to open cache db")
+
+			return err
+		}
+		defer db.Close()
+
+		dbs = append(dbs, db)
+	}
+
+	return writeCacheDBs(dbs, rootDir, w)
+}
+
+// writeCacheDBs writes a copy of the records of dbs to w, as a single db, merging them into a
+// temporary one under dir first if there are several.
+func writeCacheDBs(dbs []*bbolt.DB, dir string, w io.Writer) error {
+	if len(dbs) == 1 {
+		return dbs[0].View(func(tx *bbolt.Tx) error {
+			_, err := tx.WriteTo(w)
+			return err
+		})
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".cache-export-")
+	if err != nil {
+		return err
+	}
+
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	merged, err := bbolt.Open(tmp.Name(), 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer merged.Close()
+
+	for _, db := range dbs {
+		if err := db.View(func(srcTx *bbolt.Tx) error {
+			return merged.Update(func(dstTx *bbolt.Tx) error {
+				return srcTx.ForEach(func(name []byte, src *bbolt.Bucket) error {
+					b, err := dstTx.CreateBucketIfNotExists(name)
+					if err != nil {
+						return err
+					}
+
+					return copyBucket(src, b)
+				})
+			})
+		}); err != nil {
+			return err
+		}
+	}
+
+	return merged.View(func(tx *bbolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// RepairCache removes the records of the cache db under rootDir which point to blobs missing
+// from rootDir, and compacts the db files. It must not be run while the db is in use.
+// With dryRun, the records are only reported. It returns the number of such records.
+func RepairCache(rootDir string, name string, dryRun bool, log zlog.Logger) (int, error) {
+	paths := cacheDBPaths(rootDir, name)
+	if len(paths) == 0 {
+		return 0, errors.ErrCacheNotFound
+	}
+
+	removed := 0
+
+	for _, dbPath := range paths {
+		n, err := repairCacheDB(rootDir, dbPath, dryRun, log)
+		removed += n
+
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+// repairCacheDB repairs one of the dbs of a cache, at dbPath.
+func repairCacheDB(rootDir string, dbPath string, dryRun bool, log zlog.Logger) (int, error) {
+	db, err := bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: cacheOpenTimeout, ReadOnly: dryRun})
+	if err != nil {
+		if err == bbolt.ErrTimeout {
+			err = errors.ErrCacheInUse
+		}
+
+		log.Error().Err(err).Str("dbPath", dbPath).Msg("unable to open cache db")
+
+		return 0, err
+	}
+
+	removed := 0
+	fix := func(tx *bbolt.Tx) error {
+		root := tx.Bucket([]byte(BlobsCache))
+		if root == nil {
+			return errors.ErrCacheRootBucket
+		}
+
+		missing := map[string][][]byte{}
+
+		if err := root.ForEach(func(digest, _ []byte) error {
+			b := root.Bucket(digest)
+			if b == nil {
+				return nil
+			}
+
+			return b.ForEach(func(relp, _ []byte) error {
+				if _, err := os.Stat(filepath.Join(rootDir, filepath.FromSlash(string(relp)))); os.IsNotExist(err) {
+					log.Info().Str("digest", string(digest)).Str("path", string(relp)).Msg("blob missing")
+					missing[string(digest)] = append(missing[string(digest)], relp)
+					removed++
+				}
+
+				return nil
+			})
+		}); err != nil {
+			return err
+		}
+
+		if dryRun {
+			return nil
+		}
+
+		// buckets can't be modified while iterating over them
+		for digest, paths := range missing {
+			b := root.Bucket([]byte(digest))
+
+			for _, relp := range paths {
+				if err := b.Delete(relp); err != nil {
+					return err
+				}
+			}
+
+			if k, _ := b.Cursor().First(); k == nil {
+				if err := root.DeleteBucket([]byte(digest)); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	if dryRun {
+		err = db.View(fix)
+	} else {
+		err = db.Update(fix)
+	}
+
+	if err != nil {
+		db.Close()
+		log.Error().Err(err).Str("dbPath", dbPath).Msg("unable to repair cache db")
+
+		return removed, err
+	}
+
+	if dryRun {
+		return removed, db.Close()
+	}
+
+	err = compactCache(db, dbPath+".compact")
+	db.Close()
+
+	if err != nil {
+		os.Remove(dbPath + ".compact")
+		log.Error().Err(err).Str("dbPath", dbPath).Msg("unable to compact cache db")
+
+		return removed, err
+	}
+
+	if err := os.Rename(dbPath+".compact", dbPath); err != nil {
+		return removed, err
+	}
+
+	log.Info().Str("dbPath", dbPath).Int("removed", removed).Msg("cache db repaired")
+
+	return removed, nil
+}
+
+// compactCache copies the contents of db to a new db at dstPath. Since bolt never shrinks
+// its file, this is the only way to reclaim the space of deleted records.
+func compactCache(db *bbolt.DB, dstPath string) error {
+	dst, err := bbolt.Open(dstPath, 0600, nil)
+	if err != nil {
+		return err
+	}
+
+	err = db.View(func(srcTx *bbolt.Tx) error {
+		return dst.Update(func(dstTx *bbolt.Tx) error {
+			return srcTx.ForEach(func(name []byte, src *bbolt.Bucket) error {
+				b, err := dstTx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+
+				return copyBucket(src, b)
+			})
+		})
+	})
+
+	if err != nil {
+		dst.Close()
+		return err
+	}
+
+	return dst.Close()
+}
+
+func copyBucket(src *bbolt.Bucket, dst *bbolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if nested := src.Bucket(k); nested != nil {
+			b, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+
+			return copyBucket(nested, b)
+		}
+
+		return dst.Put(k, v)
+	})
+}
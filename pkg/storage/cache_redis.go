@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	zlog "github.com/anuvu/zot/pkg/log"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	// RedisCacheDriverName is the name the cache on a redis server is registered as.
+	RedisCacheDriverName = "redis"
+
+	// how long to wait for the redis server, to connect or for a reply.
+	redisTimeout = 5 * time.Second
+)
+
+func init() { //nolint: gochecknoinits
+	RegisterCacheDriver(RedisCacheDriverName,
+		func(rootDir string, parameters map[string]interface{}, log zlog.Logger) (CacheDriver, error) {
+			var config RedisCacheConfig
+
+			if err := mapstructure.Decode(parameters, &config); err != nil || config.Address == "" {
+				return nil, errors.ErrBadConfig
+			}
+
+			return NewRedisCache(rootDir, config, log)
+		})
+}
+
+// RedisCacheConfig configures a cache on a redis server.
+type RedisCacheConfig struct {
+	// Address is the host:port of the server
+	Address  string
+	Password string
+	DB       int
+	// Prefix namespaces the keys of the cache, e.g. for the caches of several storages to share
+	// a server, "zot:" if not set
+	Prefix string
+}
+
+// RedisCache records where blobs are stored on a redis server, as a set of paths per digest,
+// for replicas serving the same storage, e.g. a network filesystem, to share it.
+type RedisCache struct {
+	rootDir string
+	config  RedisCacheConfig
+	lock    sync.Mutex // serializes commands on the connection
+	conn    net.Conn   // nil until connected, or again after failing
+	reader  *bufio.Reader
+	log     zlog.Logger
+}
+
+// redisError is an error replied by the redis server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// NewRedisCache returns a cache on the redis server configured for the storage under rootDir,
+// failing if it can't be reached.
+func NewRedisCache(rootDir string, config RedisCacheConfig, log zlog.Logger) (*RedisCache, error) {
+	if config.Prefix == "" {
+		config.Prefix = "zot:"
+	}
+
+	c := &RedisCache{rootDir: rootDir, config: config, log: log}
+
+	if _, err := c.do("PING"); err != nil {
+		log.Error().Err(err).Str("address", config.Address).Msg("unable to reach redis server")
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Name returns the name the driver is registered as.
+func (c *RedisCache) Name() string {
+	return RedisCacheDriverName
+}
+
+func (c *RedisCache) key(digest string) string {
+	return c.config.Prefix + digest
+}
+
+func (c *RedisCache) PutBlob(digest string, path string) error {
+	if _, err := c.do("SADD", c.key(digest), cacheRelPath(c.rootDir, path)); err != nil {
+		c.log.Error().Err(err).Str("digest", digest).Str("path", path).Msg("unable to put record")
+		return err
+	}
+
+	return nil
+}
+
+func (c *RedisCache) GetBlob(digest string) (string, error) {
+	if faulty(FaultCacheMiss) {
+		return "", errors.ErrCacheMiss
+	}
+
+	reply, err := c.do("SRANDMEMBER", c.key(digest))
+	if err != nil {
+		return "", err
+	}
+
+	relp, ok := reply.(string)
+	if !ok {
+		return "", errors.ErrCacheMiss
+	}
+
+	return filepath.FromSlash(relp), nil
+}
+
+func (c *RedisCache) HasBlob(digest string, path string) bool {
+	if faulty(FaultCacheMiss) {
+		return false
+	}
+
+	reply, err := c.do("SISMEMBER", c.key(digest), cacheRelPath(c.rootDir, path))
+
+	return err == nil && reply == int64(1)
+}
+
+func (c *RedisCache) DeleteBlob(digest string, path string) error {
+	// emptied sets are removed by the server
+	reply, err := c.do("SREM", c.key(digest), cacheRelPath(c.rootDir, path))
+	if err != nil {
+		c.log.Error().Err(err).Str("digest", digest).Str("path", path).Msg("unable to delete")
+		return err
+	}
+
+	if reply == int64(0) {
+		return errors.ErrCacheMiss
+	}
+
+	return nil
+}
+
+// Close closes the connection to the server, if any.
+func (c *RedisCache) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+
+	err := c.conn.Close()
+	c.conn = nil
+
+	return err
+}
+
+// do sends a command to the server, connecting first if not already, and returns its reply: a
+// string, an int64, nil, or a slice of those. The connection is dropped, to connect again on the
+// next command, if it fails.
+func (c *RedisCache) do(args ...string) (interface{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.command(args...)
+
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.conn.Close()
+		c.conn = nil
+	}
+
+	return reply, err
+}
+
+// connect connects to the server, authenticating and selecting the db configured.
+func (c *RedisCache) connect() error {
+	conn, err := net.DialTimeout("tcp", c.config.Address, redisTimeout)
+	if err != nil {
+		return err
+	}
+
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+
+	setup := [][]string{}
+	if c.config.Password != "" {
+		setup = append(setup, []string{"AUTH", c.config.Password})
+	}
+
+	if c.config.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.config.DB)})
+	}
+
+	for _, args := range setup {
+		if _, err := c.command(args...); err != nil {
+			c.conn.Close()
+			c.conn = nil
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// command sends a command on the connection and reads its reply.
+func (c *RedisCache) command(args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(c.reader)
+}
+
+// readRedisReply reads a reply in the redis protocol (RESP).
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.ErrRedisReply
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		replies := make([]interface{}, n)
+
+		for i := range replies {
+			if replies[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+
+		return replies, nil
+	}
+
+	return nil, errors.ErrRedisReply
+}
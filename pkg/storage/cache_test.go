@@ -1,14 +1,17 @@
 package storage_test
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"sync/atomic"
 	"testing"
 
 	"github.com/anuvu/zot/errors"
 	"github.com/anuvu/zot/pkg/log"
 	"github.com/anuvu/zot/pkg/storage"
+	godigest "github.com/opencontainers/go-digest"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -22,9 +25,9 @@ func TestCache(t *testing.T) {
 		log := log.NewLogger("debug", "")
 		So(log, ShouldNotBeNil)
 
-		So(storage.NewCache("/deadBEEF", "cache_test", log), ShouldBeNil)
+		So(storage.NewCache("/deadBEEF", "cache_test", 1, log), ShouldBeNil)
 
-		c := storage.NewCache(dir, "cache_test", log)
+		c := storage.NewCache(dir, "cache_test", 1, log)
 		So(c, ShouldNotBeNil)
 
 		v, err := c.GetBlob("key")
@@ -51,3 +54,207 @@ func TestCache(t *testing.T) {
 		So(err, ShouldBeNil)
 	})
 }
+
+func TestRepairCache(t *testing.T) {
+	Convey("Repair a cache", t, func() {
+		dir, err := ioutil.TempDir("", "cache_test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.NewLogger("debug", "")
+
+		_, err = storage.RepairCache(dir, "cache_test", false, log)
+		So(err, ShouldEqual, errors.ErrCacheNotFound)
+
+		c := storage.NewCache(dir, "cache_test", 1, log)
+		So(c, ShouldNotBeNil)
+
+		So(ioutil.WriteFile(path.Join(dir, "present"), []byte("blob"), 0600), ShouldBeNil)
+		So(c.PutBlob("key", path.Join(dir, "present")), ShouldBeNil)
+		So(c.PutBlob("key", path.Join(dir, "missing1")), ShouldBeNil)
+		So(c.PutBlob("gone", path.Join(dir, "missing2")), ShouldBeNil)
+
+		Convey("while in use", func() {
+			defer c.Close()
+
+			_, err := storage.RepairCache(dir, "cache_test", false, log)
+			So(err, ShouldEqual, errors.ErrCacheInUse)
+		})
+
+		Convey("dry run and repair", func() {
+			So(c.Close(), ShouldBeNil)
+
+			removed, err := storage.RepairCache(dir, "cache_test", true, log)
+			So(err, ShouldBeNil)
+			So(removed, ShouldEqual, 2)
+
+			removed, err = storage.RepairCache(dir, "cache_test", false, log)
+			So(err, ShouldBeNil)
+			So(removed, ShouldEqual, 2)
+
+			removed, err = storage.RepairCache(dir, "cache_test", true, log)
+			So(err, ShouldBeNil)
+			So(removed, ShouldEqual, 0)
+
+			c := storage.NewCache(dir, "cache_test", 1, log)
+			So(c, ShouldNotBeNil)
+			defer c.Close()
+
+			So(c.HasBlob("key", "present"), ShouldBeTrue)
+			So(c.HasBlob("key", "missing1"), ShouldBeFalse)
+			_, err = c.GetBlob("gone")
+			So(err, ShouldEqual, errors.ErrCacheMiss)
+
+			_, err = os.Stat(path.Join(dir, "cache_test.db.compact"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}
+
+func TestShardedCache(t *testing.T) {
+	Convey("Spread a cache over several dbs", t, func() {
+		dir, err := ioutil.TempDir("", "cache_test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.NewLogger("debug", "")
+
+		c := storage.NewCache(dir, "cache_test", 1, log)
+		So(c, ShouldNotBeNil)
+
+		So(ioutil.WriteFile(path.Join(dir, "present"), []byte("blob"), 0600), ShouldBeNil)
+
+		digests := make([]string, 0, 32)
+
+		for i := 0; i < 32; i++ {
+			digest := godigest.FromString(fmt.Sprintf("%d", i)).String()
+			So(c.PutBlob(digest, path.Join(dir, "present")), ShouldBeNil)
+			digests = append(digests, digest)
+		}
+
+		So(c.PutBlob(digests[0], path.Join(dir, "missing")), ShouldBeNil)
+		So(c.Close(), ShouldBeNil)
+
+		// records are moved to the shards
+		c = storage.NewCache(dir, "cache_test", 4, log)
+		So(c, ShouldNotBeNil)
+
+		for _, db := range []string{"cache_test.1.db", "cache_test.2.db", "cache_test.3.db"} {
+			_, err = os.Stat(path.Join(dir, db))
+			So(err, ShouldBeNil)
+		}
+
+		for _, digest := range digests {
+			So(c.HasBlob(digest, "present"), ShouldBeTrue)
+		}
+
+		// exported as a single db
+		export, err := os.Create(path.Join(dir, "export.db"))
+		So(err, ShouldBeNil)
+		So(c.Export(export), ShouldBeNil)
+		So(export.Close(), ShouldBeNil)
+		So(c.Close(), ShouldBeNil)
+
+		exported := storage.NewCache(dir, "export", 1, log)
+		So(exported, ShouldNotBeNil)
+
+		for _, digest := range digests {
+			So(exported.HasBlob(digest, "present"), ShouldBeTrue)
+		}
+
+		So(exported.Close(), ShouldBeNil)
+
+		removed, err := storage.RepairCache(dir, "cache_test", false, log)
+		So(err, ShouldBeNil)
+		So(removed, ShouldEqual, 1)
+
+		// and back to a single one
+		c = storage.NewCache(dir, "cache_test", 1, log)
+		So(c, ShouldNotBeNil)
+		defer c.Close()
+
+		_, err = os.Stat(path.Join(dir, "cache_test.1.db"))
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		for _, digest := range digests {
+			So(c.HasBlob(digest, "present"), ShouldBeTrue)
+		}
+
+		So(c.HasBlob(digests[0], "missing"), ShouldBeFalse)
+	})
+}
+
+func BenchmarkCachePutBlob(b *testing.B) {
+	for _, shards := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "cache_test")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			c := storage.NewCache(dir, "cache_test", shards, log.NewLogger("error", ""))
+			if c == nil {
+				b.Fatal("unable to create cache")
+			}
+			defer c.Close()
+
+			var n int64
+
+			b.ResetTimer()
+
+			// as concurrent pushes of new blobs do
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddInt64(&n, 1)
+					digest := godigest.FromString(fmt.Sprintf("%d", i)).String()
+
+					if err := c.PutBlob(digest, path.Join(dir, digest)); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkCacheGetBlob(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "cache_test")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			c := storage.NewCache(dir, "cache_test", shards, log.NewLogger("error", ""))
+			if c == nil {
+				b.Fatal("unable to create cache")
+			}
+			defer c.Close()
+
+			digests := make([]string, 1000)
+			for i := range digests {
+				digests[i] = godigest.FromString(fmt.Sprintf("%d", i)).String()
+
+				if err := c.PutBlob(digests[i], path.Join(dir, digests[i])); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			var n int64
+
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddInt64(&n, 1)
+
+					if _, err := c.GetBlob(digests[i%int64(len(digests))]); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
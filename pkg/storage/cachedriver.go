@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/anuvu/zot/errors"
+	zlog "github.com/anuvu/zot/pkg/log"
+	"github.com/mitchellh/mapstructure"
+)
+
+// BoltCacheDriverName is the name the cache in bolt dbs under the root directory, the default,
+// is registered as.
+const BoltCacheDriverName = "boltdb"
+
+func init() { //nolint: gochecknoinits
+	RegisterCacheDriver(BoltCacheDriverName,
+		func(rootDir string, parameters map[string]interface{}, log zlog.Logger) (CacheDriver, error) {
+			// spread over as many dbs as its shards, if given
+			var config struct{ Shards int }
+
+			if err := mapstructure.Decode(parameters, &config); err != nil || config.Shards > MaxCacheShards {
+				return nil, errors.ErrBadConfig
+			}
+
+			c := NewCache(rootDir, CacheName, config.Shards, log)
+			if c == nil {
+				return nil, errors.ErrCacheRootBucket
+			}
+
+			return c, nil
+		})
+}
+
+// CacheDriver records where blobs are stored, by digest, for identical blobs to be deduped, e.g.
+// in bolt dbs under the root directory or on a server several replicas share. Paths are recorded
+// relative to the root directory, and returned so.
+type CacheDriver interface {
+	// Name returns the name the driver is registered as.
+	Name() string
+	// PutBlob records a path of a blob.
+	PutBlob(digest string, path string) error
+	// GetBlob returns one of the paths recorded of a blob, or errors.ErrCacheMiss.
+	GetBlob(digest string) (string, error)
+	// HasBlob returns whether a path of a blob is recorded.
+	HasBlob(digest string, path string) bool
+	// DeleteBlob removes a path of a blob, or returns errors.ErrCacheMiss if none is recorded.
+	DeleteBlob(digest string, path string) error
+	// Close releases what the driver holds, e.g. its dbs or connections.
+	Close() error
+}
+
+// CacheDriverFactory returns a cache driver for the storage under rootDir, configured with
+// parameters, e.g. from the dedupeCacheDriver section of the configuration.
+type CacheDriverFactory func(rootDir string, parameters map[string]interface{}, log zlog.Logger) (CacheDriver, error)
+
+// nolint: gochecknoglobals
+var (
+	cacheDriversLock sync.RWMutex
+	cacheDrivers     = map[string]CacheDriverFactory{}
+)
+
+// RegisterCacheDriver makes a cache driver available by name, e.g. from the init function of
+// the package implementing it, linked in with a blank import, replacing any registered by the
+// same name.
+func RegisterCacheDriver(name string, factory CacheDriverFactory) {
+	cacheDriversLock.Lock()
+	defer cacheDriversLock.Unlock()
+
+	cacheDrivers[name] = factory
+}
+
+// CacheDrivers returns the names of the cache drivers registered, sorted.
+func CacheDrivers() []string {
+	cacheDriversLock.RLock()
+	defer cacheDriversLock.RUnlock()
+
+	names := make([]string, 0, len(cacheDrivers))
+	for name := range cacheDrivers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// NewCacheDriver returns the cache driver registered by name for the storage under rootDir,
+// configured with parameters.
+func NewCacheDriver(name string, rootDir string, parameters map[string]interface{},
+	log zlog.Logger) (CacheDriver, error) {
+	cacheDriversLock.RLock()
+	factory, ok := cacheDrivers[name]
+	cacheDriversLock.RUnlock()
+
+	if !ok {
+		return nil, errors.ErrCacheDriverNotFound
+	}
+
+	return factory(rootDir, parameters, log)
+}
+
+// cacheRelPath returns the path of a blob relative to rootDir, with forward slashes, as recorded
+// in caches regardless of the platform, or the path itself if not under rootDir.
+func cacheRelPath(rootDir string, path string) string {
+	relp, err := filepath.Rel(rootDir, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+
+	return filepath.ToSlash(relp)
+}
@@ -0,0 +1,288 @@
+package storage_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	godigest "github.com/opencontainers/go-digest"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// redisServer is a redis server with just enough commands for the redis cache driver.
+type redisServer struct {
+	listener net.Listener
+	password string
+	lock     sync.Mutex
+	sets     map[string]map[string]bool
+}
+
+func newRedisServer(password string) *redisServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	s := &redisServer{listener: l, password: password, sets: map[string]map[string]bool{}}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *redisServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	authed := s.password == ""
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+
+		for i := range args {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+
+			arg, _ := r.ReadString('\n')
+			args[i] = strings.TrimSuffix(arg, "\r\n")
+		}
+
+		var reply string
+
+		switch {
+		case args[0] == "AUTH":
+			authed = args[1] == s.password
+			reply = "+OK\r\n"
+
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		default:
+			reply = s.command(args)
+		}
+
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (s *redisServer) command(args []string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var set map[string]bool
+	if len(args) > 1 {
+		set = s.sets[args[1]]
+	}
+
+	switch args[0] {
+	case "PING":
+		return "+PONG\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "SADD":
+		if set == nil {
+			set = map[string]bool{}
+			s.sets[args[1]] = set
+		}
+
+		set[args[2]] = true
+
+		return ":1\r\n"
+	case "SREM":
+		if !set[args[2]] {
+			return ":0\r\n"
+		}
+
+		delete(set, args[2])
+
+		if len(set) == 0 {
+			delete(s.sets, args[1])
+		}
+
+		return ":1\r\n"
+	case "SISMEMBER":
+		if set[args[2]] {
+			return ":1\r\n"
+		}
+
+		return ":0\r\n"
+	case "SRANDMEMBER":
+		for member := range set {
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(member), member)
+		}
+
+		return "$-1\r\n"
+	}
+
+	return "-ERR unknown command\r\n"
+}
+
+func (s *redisServer) Close() {
+	s.listener.Close()
+}
+
+func TestRegisterCacheDriver(t *testing.T) {
+	Convey("Register cache drivers", t, func() {
+		So(storage.CacheDrivers(), ShouldContain, storage.BoltCacheDriverName)
+		So(storage.CacheDrivers(), ShouldContain, storage.RedisCacheDriverName)
+
+		dir, err := ioutil.TempDir("", "cache_test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.NewLogger("debug", "")
+
+		_, err = storage.NewCacheDriver("unknown", dir, nil, log)
+		So(err, ShouldEqual, errors.ErrCacheDriverNotFound)
+
+		_, err = storage.NewCacheDriver(storage.RedisCacheDriverName, dir, map[string]interface{}{}, log)
+		So(err, ShouldEqual, errors.ErrBadConfig)
+
+		c, err := storage.NewCacheDriver(storage.BoltCacheDriverName, dir, nil, log)
+		So(err, ShouldBeNil)
+		So(c.Name(), ShouldEqual, storage.BoltCacheDriverName)
+		So(c.Close(), ShouldBeNil)
+
+		_, err = os.Stat(path.Join(dir, storage.CacheName+".db"))
+		So(err, ShouldBeNil)
+
+		// spread over its shards
+		c, err = storage.NewCacheDriver(storage.BoltCacheDriverName, dir,
+			map[string]interface{}{"name": storage.BoltCacheDriverName, "shards": 2}, log)
+		So(err, ShouldBeNil)
+		So(c.Close(), ShouldBeNil)
+
+		_, err = os.Stat(path.Join(dir, storage.CacheName+".1.db"))
+		So(err, ShouldBeNil)
+
+		_, err = storage.NewCacheDriver(storage.BoltCacheDriverName, dir,
+			map[string]interface{}{"shards": storage.MaxCacheShards + 1}, log)
+		So(err, ShouldEqual, errors.ErrBadConfig)
+	})
+}
+
+func TestRedisCache(t *testing.T) {
+	Convey("Record blobs on a redis server", t, func() {
+		server := newRedisServer("secret")
+		defer server.Close()
+
+		dir, err := ioutil.TempDir("", "cache_test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.NewLogger("debug", "")
+		address := server.listener.Addr().String()
+
+		_, err = storage.NewCacheDriver(storage.RedisCacheDriverName, dir,
+			map[string]interface{}{"address": address, "password": "wrong"}, log)
+		So(err, ShouldNotBeNil)
+
+		_, err = storage.NewCacheDriver(storage.RedisCacheDriverName, dir,
+			map[string]interface{}{"address": "127.0.0.1:1"}, log)
+		So(err, ShouldNotBeNil)
+
+		c, err := storage.NewCacheDriver(storage.RedisCacheDriverName, dir,
+			map[string]interface{}{"address": address, "password": "secret", "db": 1}, log)
+		So(err, ShouldBeNil)
+		So(c.Name(), ShouldEqual, storage.RedisCacheDriverName)
+
+		_, err = c.GetBlob("key")
+		So(err, ShouldEqual, errors.ErrCacheMiss)
+		So(c.DeleteBlob("key", path.Join(dir, "value")), ShouldEqual, errors.ErrCacheMiss)
+
+		So(c.PutBlob("key", path.Join(dir, "value")), ShouldBeNil)
+		So(c.HasBlob("key", path.Join(dir, "value")), ShouldBeTrue)
+		So(c.HasBlob("key", path.Join(dir, "other")), ShouldBeFalse)
+
+		// relative to the root directory, for replicas to share
+		v, err := c.GetBlob("key")
+		So(err, ShouldBeNil)
+		So(v, ShouldEqual, "value")
+
+		server.lock.Lock()
+		So(server.sets["zot:key"], ShouldResemble, map[string]bool{"value": true})
+		server.lock.Unlock()
+
+		So(c.DeleteBlob("key", path.Join(dir, "value")), ShouldBeNil)
+
+		_, err = c.GetBlob("key")
+		So(err, ShouldEqual, errors.ErrCacheMiss)
+
+		// connected again once closed
+		So(c.Close(), ShouldBeNil)
+		So(c.PutBlob("key", path.Join(dir, "value")), ShouldBeNil)
+		So(c.HasBlob("key", path.Join(dir, "value")), ShouldBeTrue)
+		So(c.Close(), ShouldBeNil)
+	})
+
+	Convey("Dedupe blobs with a redis server", t, func() {
+		server := newRedisServer("")
+		defer server.Close()
+
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.NewLogger("debug", "")
+
+		c, err := storage.NewCacheDriver(storage.RedisCacheDriverName, dir,
+			map[string]interface{}{"address": server.listener.Addr().String()}, log)
+		So(err, ShouldBeNil)
+
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log)
+		So(is.SetCacheDriver(c), ShouldBeNil)
+		defer is.Close()
+
+		content := []byte("test-data")
+		digest := godigest.FromBytes(content)
+
+		for _, repo := range []string{"repo1", "repo2"} {
+			_, _, err := is.FullBlobUpload(repo, bytes.NewReader(content), digest.String())
+			So(err, ShouldBeNil)
+		}
+
+		fi1, err := os.Stat(is.BlobPath("repo1", digest))
+		So(err, ShouldBeNil)
+		fi2, err := os.Stat(is.BlobPath("repo2", digest))
+		So(err, ShouldBeNil)
+		So(os.SameFile(fi1, fi2), ShouldBeTrue)
+
+		// not exported, as not under the root directory
+		So(is.ExportCache(ioutil.Discard), ShouldEqual, errors.ErrCacheNotFound)
+
+		_, err = os.Stat(path.Join(dir, storage.CacheName+".db"))
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	zlog "github.com/anuvu/zot/pkg/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// RepoProblem is an integrity problem found in a repository, along with the suggested repair.
+type RepoProblem struct {
+	Repo      string
+	Reference string
+	Problem   string
+	Repair    string
+}
+
+// CheckImageStore verifies that every repository of the store has a valid layout and index,
+// and that all the blobs referenced by its manifests are present.
+// It returns the problems found, each of which is also logged along with its repair.
+func CheckImageStore(is ImageStore, log zlog.Logger) ([]RepoProblem, error) {
+	repos, err := is.GetRepositories()
+	if err != nil {
+		return nil, err
+	}
+
+	problems := []RepoProblem{}
+
+	for _, repo := range repos {
+		problems = append(problems, checkRepo(is, repo)...)
+	}
+
+	for _, p := range problems {
+		log.Error().Str("repo", p.Repo).Str("reference", p.Reference).Str("problem", p.Problem).
+			Str("repair", p.Repair).Msg("repository failed integrity check")
+	}
+
+	log.Info().Int("repos", len(repos)).Int("problems", len(problems)).Msg("integrity check done")
+
+	return problems, nil
+}
+
+func checkRepo(is ImageStore, repo string) []RepoProblem {
+	if ok, err := is.ValidateRepo(repo); !ok {
+		problem := "invalid image layout"
+		if err != nil {
+			problem = fmt.Sprintf("%s: %v", problem, err)
+		}
+
+		return []RepoProblem{{Repo: repo, Problem: problem, Repair: "remove the repository and push its images again"}}
+	}
+
+	buf, err := is.GetIndexContent(repo)
+	if err != nil {
+		return []RepoProblem{{Repo: repo, Problem: fmt.Sprintf("unreadable index: %v", err),
+			Repair: "remove the repository and push its images again"}}
+	}
+
+	var index ispec.Index
+	if err := json.Unmarshal(buf, &index); err != nil {
+		return []RepoProblem{{Repo: repo, Problem: fmt.Sprintf("invalid index: %v", err),
+			Repair: "remove the repository and push its images again"}}
+	}
+
+	problems := []RepoProblem{}
+
+	for _, desc := range index.Manifests {
+		reference := desc.Digest.String()
+		if tag, ok := desc.Annotations[ispec.AnnotationRefName]; ok {
+			reference = tag
+		}
+
+		if problem := checkManifest(is, repo, desc); problem != "" {
+			problems = append(problems, RepoProblem{Repo: repo, Reference: reference, Problem: problem,
+				Repair: fmt.Sprintf("delete manifest %s and push the image again", desc.Digest)})
+		}
+	}
+
+	return problems
+}
+
+// checkManifest returns a description of what is wrong with a manifest and its blobs, or an index
+// and its manifests, if anything.
+func checkManifest(is ImageStore, repo string, desc ispec.Descriptor) string {
+	r, _, err := is.GetBlob(repo, desc.Digest.String(), desc.MediaType)
+	if err != nil {
+		return "manifest blob missing"
+	}
+
+	buf, err := ioutil.ReadAll(r)
+	if closer, ok := r.(io.Closer); ok {
+		closer.Close()
+	}
+
+	if err != nil {
+		return fmt.Sprintf("unreadable manifest: %v", err)
+	}
+
+	if IsImageIndex(desc.MediaType) {
+		var index ispec.Index
+		if err := json.Unmarshal(buf, &index); err != nil {
+			return fmt.Sprintf("invalid index: %v", err)
+		}
+
+		for _, m := range index.Manifests {
+			if problem := checkManifest(is, repo, m); problem != "" {
+				return fmt.Sprintf("manifest %s: %s", m.Digest, problem)
+			}
+		}
+
+		return ""
+	}
+
+	var manifest ispec.Manifest
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return fmt.Sprintf("invalid manifest: %v", err)
+	}
+
+	// opened rather than checked, which the store may answer from memory, without the disk
+	blobs := append([]ispec.Descriptor{manifest.Config}, manifest.Layers...)
+	for _, blob := range blobs {
+		r, _, err := is.GetBlob(repo, blob.Digest.String(), blob.MediaType)
+		if err != nil {
+			return fmt.Sprintf("blob %s missing", blob.Digest)
+		}
+
+		if closer, ok := r.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+
+	return ""
+}
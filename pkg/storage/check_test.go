@@ -0,0 +1,113 @@
+package storage_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCheckImageStore(t *testing.T) {
+	Convey("Check the integrity of an image store", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.NewLogger("debug", "")
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log)
+
+		img, err := test.GetRandomImage(64, 2)
+		So(err, ShouldBeNil)
+
+		for _, repo := range []string{"good", "nolayer", "nomanifest", "badindex"} {
+			So(test.WriteImageToStore(img, is, repo, "1.0"), ShouldBeNil)
+		}
+
+		problems, err := storage.CheckImageStore(is, log)
+		So(err, ShouldBeNil)
+		So(problems, ShouldBeEmpty)
+
+		digest, err := img.Digest()
+		So(err, ShouldBeNil)
+
+		layer := godigest.FromBytes(img.Layers[0])
+		So(os.Remove(path.Join(dir, "nolayer", "blobs", "sha256", layer.Encoded())), ShouldBeNil)
+		So(os.Remove(path.Join(dir, "nomanifest", "blobs", "sha256", digest.Encoded())), ShouldBeNil)
+		So(ioutil.WriteFile(path.Join(dir, "badindex", "index.json"), []byte("{"), 0600), ShouldBeNil)
+
+		problems, err = storage.CheckImageStore(is, log)
+		So(err, ShouldBeNil)
+		So(len(problems), ShouldEqual, 3)
+
+		byRepo := map[string]storage.RepoProblem{}
+		for _, p := range problems {
+			So(p.Repair, ShouldNotBeEmpty)
+			byRepo[p.Repo] = p
+		}
+
+		So(byRepo, ShouldNotContainKey, "good")
+		So(byRepo["nolayer"].Reference, ShouldEqual, "1.0")
+		So(byRepo["nolayer"].Problem, ShouldContainSubstring, layer.String())
+		So(byRepo["nomanifest"].Problem, ShouldEqual, "manifest blob missing")
+		So(byRepo["badindex"].Problem, ShouldContainSubstring, "invalid index")
+	})
+
+	Convey("Check the manifests of indexes rather than a config", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.NewLogger("debug", "")
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log)
+
+		mi, err := test.GetRandomMultiarchImage(64, []ispec.Platform{{Architecture: "amd64", OS: "linux"},
+			{Architecture: "arm64", OS: "linux"}})
+		So(err, ShouldBeNil)
+
+		for _, img := range mi.Images {
+			digest, err := img.Digest()
+			So(err, ShouldBeNil)
+			So(test.WriteImageToStore(img, is, "multiarch", digest.String()), ShouldBeNil)
+		}
+
+		iblob, err := mi.IndexBlob()
+		So(err, ShouldBeNil)
+		_, err = is.PutImageManifest("multiarch", "1.0", ispec.MediaTypeImageIndex, iblob)
+		So(err, ShouldBeNil)
+
+		problems, err := storage.CheckImageStore(is, log)
+		So(err, ShouldBeNil)
+		So(problems, ShouldBeEmpty)
+
+		// reported for the index too
+		layer := godigest.FromBytes(mi.Images[1].Layers[0])
+		So(os.Remove(path.Join(dir, "multiarch", "blobs", "sha256", layer.Encoded())), ShouldBeNil)
+
+		problems, err = storage.CheckImageStore(is, log)
+		So(err, ShouldBeNil)
+		So(len(problems), ShouldEqual, 2)
+
+		for _, p := range problems {
+			So(p.Problem, ShouldContainSubstring, layer.String())
+		}
+	})
+
+	Convey("Check the integrity of an in-memory store", t, func() {
+		is := storage.NewImageStoreMem(log.NewLogger("debug", ""))
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+		problems, err := storage.CheckImageStore(is, log.NewLogger("debug", ""))
+		So(err, ShouldBeNil)
+		So(problems, ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/anuvu/zot/errors"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// MediaTypeDockerManifest is that of Docker image manifests, schema 2, pushed by docker.
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	// MediaTypeDockerManifestList is that of Docker manifest lists, the indexes of Docker images.
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// IsImageManifest reports whether mediaType is that of an image manifest, OCI or Docker's.
+func IsImageManifest(mediaType string) bool {
+	return mediaType == ispec.MediaTypeImageManifest || mediaType == MediaTypeDockerManifest
+}
+
+// IsImageIndex reports whether mediaType is that of an index of manifests, OCI or Docker's.
+func IsImageIndex(mediaType string) bool {
+	return mediaType == ispec.MediaTypeImageIndex || mediaType == MediaTypeDockerManifestList
+}
+
+// ImageStore is the interface implemented by image storage backends.
+type ImageStore interface {
+	InitRepo(name string) error
+	ValidateRepo(name string) (bool, error)
+	DeleteRepo(name string) error
+	GetRepositories() ([]string, error)
+	GetImageTags(repo string) ([]string, error)
+	GetIndexContent(repo string) ([]byte, error)
+	GetImageManifest(repo string, reference string) ([]byte, string, string, error)
+	PutImageManifest(repo string, reference string, mediaType string, body []byte) (string, error)
+	DeleteImageManifest(repo string, reference string) error
+	DeleteImageTag(repo string, tag string) error
+	GetReferrers(repo string, digest string, artifactType string) ([]Referrer, error)
+	NewBlobUpload(repo string) (string, error)
+	GetBlobUpload(repo string, uuid string) (int64, error)
+	PutBlobChunkStreamed(repo string, uuid string, body io.Reader) (int64, error)
+	PutBlobChunk(repo string, uuid string, from int64, to int64, body io.Reader) (int64, error)
+	BlobUploadInfo(repo string, uuid string) (int64, error)
+	FinishBlobUpload(repo string, uuid string, body io.Reader, digest string) error
+	FullBlobUpload(repo string, body io.Reader, digest string) (string, int64, error)
+	MountBlob(repo string, digest string) (bool, int64, error)
+	DeleteBlobUpload(repo string, uuid string) error
+	CheckBlob(repo string, digest string, mediaType string) (bool, int64, error)
+	GetBlob(repo string, digest string, mediaType string) (io.Reader, int64, error)
+	GetBlobPartial(repo string, digest string, mediaType string, from int64, to int64) (io.Reader, int64, int64, error)
+	DeleteBlob(repo string, digest string) error
+	Close() error
+}
+
+// blobRange checks a range of a blob of size, from and to included, to being -1 for its end,
+// returning its length.
+func blobRange(from int64, to int64, size int64) (int64, error) {
+	if to < 0 || to >= size {
+		to = size - 1
+	}
+
+	if from < 0 || from > to {
+		return -1, errors.ErrBadRange
+	}
+
+	return to - from + 1, nil
+}
+
+// partialReader returns a reader of length bytes from offset from of a blob read by r, seeking
+// there if r can, or reading up to there otherwise, and closing r once read, if it can.
+func partialReader(r io.Reader, from int64, length int64) (io.Reader, error) {
+	var err error
+
+	if s, ok := r.(io.Seeker); ok {
+		_, err = s.Seek(from, io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, r, from)
+	}
+
+	c, closer := r.(io.Closer)
+
+	if err != nil {
+		if closer {
+			c.Close()
+		}
+
+		return nil, err
+	}
+
+	lr := io.LimitReader(r, length)
+	if closer {
+		return struct {
+			io.Reader
+			io.Closer
+		}{lr, c}, nil
+	}
+
+	return lr, nil
+}
+
+// manifestRefs is what's checked of a manifest, or index, about to be pushed: its schema
+// version and the blobs, or manifests, it references, leaving the rest, e.g. annotations,
+// which may be large, unparsed.
+type manifestRefs struct {
+	SchemaVersion int `json:"schemaVersion"`
+	Layers        []struct {
+		Digest godigest.Digest `json:"digest"`
+	} `json:"layers"`
+	Manifests []struct {
+		Digest godigest.Digest `json:"digest"`
+	} `json:"manifests"`
+}
+
+// digests returns the digests of the blobs, or manifests, referenced, which must be found in
+// the repository for the manifest to be pushed.
+func (m manifestRefs) digests() []godigest.Digest {
+	digests := make([]godigest.Digest, 0, len(m.Layers)+len(m.Manifests))
+
+	for _, l := range m.Layers {
+		digests = append(digests, l.Digest)
+	}
+
+	for _, d := range m.Manifests {
+		digests = append(digests, d.Digest)
+	}
+
+	return digests
+}
+
+// validateManifest checks the media type and contents of a manifest, or index, about to be
+// pushed.
+func validateManifest(mediaType string, body []byte, log zerolog.Logger) (manifestRefs, error) {
+	var m manifestRefs
+
+	if !IsImageManifest(mediaType) && !IsImageIndex(mediaType) {
+		log.Debug().Interface("actual", mediaType).Msg("bad manifest media type")
+		return m, errors.ErrBadManifest
+	}
+
+	if len(body) == 0 {
+		log.Debug().Int("len", len(body)).Msg("invalid body length")
+		return m, errors.ErrBadManifest
+	}
+
+	if err := json.Unmarshal(body, &m); err != nil {
+		log.Error().Err(err).Msg("unable to unmarshal JSON")
+		return m, errors.ErrBadManifest
+	}
+
+	if m.SchemaVersion != schemaVersion {
+		log.Error().Int("SchemaVersion", m.SchemaVersion).Msg("invalid manifest")
+		return m, errors.ErrBadManifest
+	}
+
+	return m, nil
+}
+
+// manifestDigest returns the digest of a manifest pushed under reference, computed with the
+// algorithm of reference, if a digest, e.g. sha512, or the canonical one otherwise.
+func manifestDigest(reference string, body []byte) godigest.Digest {
+	if d, err := godigest.Parse(reference); err == nil {
+		return d.Algorithm().FromBytes(body)
+	}
+
+	return godigest.FromBytes(body)
+}
+
+// checkManifestReference verifies that a digest reference matches the manifest's digest,
+// and reports whether the reference is a digest (as opposed to a tag).
+func checkManifestReference(reference string, mDigest godigest.Digest, log zerolog.Logger) (bool, error) {
+	d, err := godigest.Parse(reference)
+	if err != nil {
+		return false, nil
+	}
+
+	if d.String() != mDigest.String() {
+		log.Error().Str("actual", mDigest.String()).Str("expected", d.String()).
+			Msg("manifest digest is not valid")
+		return false, errors.ErrBadManifest
+	}
+
+	return true, nil
+}
+
+// findManifest looks up a manifest descriptor in an index by digest or tag.
+func findManifest(index ispec.Index, reference string) (ispec.Descriptor, bool) {
+	for _, m := range index.Manifests {
+		if reference == m.Digest.String() {
+			return m, true
+		}
+
+		v, ok := m.Annotations[ispec.AnnotationRefName]
+		if ok && v == reference {
+			return m, true
+		}
+	}
+
+	return ispec.Descriptor{}, false
+}
+
+// getTags returns the tags referenced by an index.
+func getTags(index ispec.Index) []string {
+	tags := make([]string, 0)
+
+	for _, manifest := range index.Manifests {
+		v, ok := manifest.Annotations[ispec.AnnotationRefName]
+		if ok {
+			tags = append(tags, v)
+		}
+	}
+
+	return tags
+}
+
+// updateIndex adds (or retags) a manifest in the index, and returns the resulting descriptor
+// and whether the index changed.
+func updateIndex(index *ispec.Index, reference string, refIsDigest bool, mediaType string,
+	mDigest godigest.Digest, size int64, log zerolog.Logger) (ispec.Descriptor, bool) {
+	// create a new descriptor, whose platform, if any, is that of the manifests of an index
+	desc := ispec.Descriptor{MediaType: mediaType, Size: size, Digest: mDigest}
+	if !refIsDigest {
+		desc.Annotations = map[string]string{ispec.AnnotationRefName: reference}
+	}
+
+	for i, m := range index.Manifests {
+		if reference == m.Digest.String() {
+			// nothing changed, so don't update
+			return m, false
+		}
+
+		v, ok := m.Annotations[ispec.AnnotationRefName]
+		if ok && v == reference {
+			if m.Digest.String() == mDigest.String() {
+				// nothing changed, so don't update
+				return m, false
+			}
+			// manifest contents have changed for the same tag,
+			// so update index.json descriptor
+			log.Info().
+				Int64("old size", m.Size).
+				Int64("new size", size).
+				Str("old digest", m.Digest.String()).
+				Str("new digest", mDigest.String()).
+				Msg("updating existing tag with new manifest contents")
+
+			desc = m
+			desc.Size = size
+			desc.Digest = mDigest
+
+			index.Manifests = append(index.Manifests[:i], index.Manifests[i+1:]...)
+
+			break
+		}
+	}
+
+	index.Manifests = append(index.Manifests, desc)
+
+	return desc, true
+}
+
+// removeManifest returns a copy of the index without the manifests matching the digest
+// reference, and whether any was found.
+func removeManifest(index ispec.Index, reference string) (ispec.Index, bool) {
+	found := false
+
+	// we are deleting, so keep only those manifests that don't match
+	outIndex := index
+	outIndex.Manifests = []ispec.Descriptor{}
+
+	for _, m := range index.Manifests {
+		if reference == m.Digest.String() {
+			found = true
+			continue
+		}
+
+		outIndex.Manifests = append(outIndex.Manifests, m)
+	}
+
+	return outIndex, found
+}
+
+// removeTag returns a copy of the index without the manifest tagged tag, and whether it
+// was found.
+func removeTag(index ispec.Index, tag string) (ispec.Index, bool) {
+	found := false
+
+	outIndex := index
+	outIndex.Manifests = []ispec.Descriptor{}
+
+	for _, m := range index.Manifests {
+		if v, ok := m.Annotations[ispec.AnnotationRefName]; ok && v == tag {
+			found = true
+			continue
+		}
+
+		outIndex.Manifests = append(outIndex.Manifests, m)
+	}
+
+	return outIndex, found
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	// DefaultCopyBufferSize is the size of the buffers blobs are copied with, if not set, as
+	// io.Copy allocates.
+	DefaultCopyBufferSize = 32 * 1024
+	// MaxCopyBufferSize bounds the size of copy buffers, of which there's one per transfer.
+	MaxCopyBufferSize = 64 * 1024 * 1024
+)
+
+// CopyBuffers pool the buffers blobs are copied with, so that many concurrent layer transfers
+// don't each allocate buffers for the garbage collector to reclaim.
+type CopyBuffers struct {
+	pool *sync.Pool
+}
+
+// NewCopyBuffers returns a pool of buffers of size, DefaultCopyBufferSize if not positive.
+func NewCopyBuffers(size int) *CopyBuffers {
+	if size <= 0 {
+		size = DefaultCopyBufferSize
+	}
+
+	return &CopyBuffers{pool: &sync.Pool{New: func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}}}
+}
+
+// defaultCopyBuffers are those of Copy and CopyN.
+var defaultCopyBuffers = NewCopyBuffers(DefaultCopyBufferSize) //nolint: gochecknoglobals
+
+// Copy copies from src to dst like io.Copy, but with a pooled buffer of the default size rather
+// than a new one, unless src is a file, which can then be copied without any (e.g. with sendfile).
+func Copy(dst io.Writer, src io.Reader) (int64, error) {
+	return defaultCopyBuffers.Copy(dst, src)
+}
+
+// CopyN copies n bytes, or until an error, from src to dst like io.CopyN, as Copy does.
+func CopyN(dst io.Writer, src io.Reader, n int64) (int64, error) {
+	return defaultCopyBuffers.CopyN(dst, src, n)
+}
+
+// Copy copies from src to dst like io.Copy, but with a pooled buffer rather than a new one,
+// unless src is a file, which can then be copied without any (e.g. with sendfile).
+func (b *CopyBuffers) Copy(dst io.Writer, src io.Reader) (int64, error) {
+	return b.copyFrom(dst, src, src)
+}
+
+// CopyN copies n bytes, or until an error, from src to dst like io.CopyN, as Copy does.
+func (b *CopyBuffers) CopyN(dst io.Writer, src io.Reader, n int64) (int64, error) {
+	written, err := b.copyFrom(dst, io.LimitReader(src, n), src)
+	if written == n {
+		return n, nil
+	}
+
+	if written < n && err == nil {
+		// src stopped early
+		err = io.EOF
+	}
+
+	return written, err
+}
+
+func (b *CopyBuffers) copyFrom(dst io.Writer, src io.Reader, orig io.Reader) (int64, error) {
+	if _, ok := orig.(*os.File); ok {
+		return io.Copy(dst, src)
+	}
+
+	buf := b.pool.Get().(*[]byte)
+	defer b.pool.Put(buf)
+
+	// files read from anything else into a buffer of their own
+	return io.CopyBuffer(writerOnly{dst}, src, *buf)
+}
+
+// writerOnly hides the ReadFrom method of a writer, which would copy with its own buffer.
+type writerOnly struct {
+	io.Writer
+}
+
+// bufferWrites returns the writer an upload is written to its file with, through a buffer of
+// size, if any, and the function flushing it, once done.
+func bufferWrites(file *os.File, size int) (io.Writer, func() error) {
+	if size <= 0 {
+		return faultyWrites(file), func() error { return nil }
+	}
+
+	w := bufio.NewWriterSize(faultyWrites(file), size)
+
+	return w, w.Flush
+}
+
+// copyFile copies the file at src to a new file at dst, e.g. to another filesystem, which
+// files can't be renamed to.
+func copyFile(src string, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
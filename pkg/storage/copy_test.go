@@ -0,0 +1,98 @@
+package storage_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"testing/iotest"
+
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCopy(t *testing.T) {
+	Convey("Copy with pooled buffers", t, func() {
+		content := bytes.Repeat([]byte("0123456789"), 1000)
+
+		copies := storage.NewCopyBuffers(64)
+
+		f, err := ioutil.TempFile("", "copy-test")
+		So(err, ShouldBeNil)
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		// a reader which can't write itself to the file
+		n, err := copies.Copy(f, iotest.HalfReader(bytes.NewReader(content)))
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, len(content))
+
+		_, err = f.Seek(0, io.SeekStart)
+		So(err, ShouldBeNil)
+
+		// a file, copied without any
+		var buf bytes.Buffer
+
+		n, err = copies.CopyN(&buf, f, 100)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 100)
+
+		n, err = copies.CopyN(&buf, iotest.OneByteReader(f), int64(len(content)))
+		So(err, ShouldEqual, io.EOF)
+		So(n, ShouldEqual, len(content)-100)
+		So(buf.Bytes(), ShouldResemble, content)
+
+		n, err = storage.CopyN(&buf, f, 1)
+		So(err, ShouldEqual, io.EOF)
+		So(n, ShouldEqual, 0)
+	})
+}
+
+func TestUploadWrites(t *testing.T) {
+	Convey("Write uploads through buffers and drop them from the page cache", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		// several buffers' worth, written in a few writes
+		is := storage.NewImageStore(dir, false, false,
+			storage.Options{CopyBufferSize: 64, WriteBufferSize: 1000, DropUploadCache: true},
+			log.Logger{Logger: zerolog.New(os.Stdout)})
+		So(is, ShouldNotBeNil)
+
+		chunks := [][]byte{bytes.Repeat([]byte("a"), 1500), bytes.Repeat([]byte("b"), 2500)}
+		content := bytes.Join(chunks, nil)
+		digest := godigest.FromBytes(content)
+
+		uuid, err := is.NewBlobUpload("repo")
+		So(err, ShouldBeNil)
+
+		n, err := is.PutBlobChunk("repo", uuid, 0, int64(len(chunks[0])), bytes.NewReader(chunks[0]))
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, len(chunks[0]))
+
+		n, err = is.PutBlobChunkStreamed("repo", uuid, iotest.HalfReader(bytes.NewReader(chunks[1])))
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, len(chunks[1]))
+
+		So(is.FinishBlobUpload("repo", uuid, nil, digest.String()), ShouldBeNil)
+
+		buf, err := ioutil.ReadFile(is.BlobPath("repo", digest))
+		So(err, ShouldBeNil)
+		So(buf, ShouldResemble, content)
+
+		So(os.Remove(is.BlobPath("repo", digest)), ShouldBeNil)
+
+		_, n, err = is.FullBlobUpload("repo", bytes.NewReader(content), digest.String())
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, len(content))
+
+		buf, err = ioutil.ReadFile(is.BlobPath("repo", digest))
+		So(err, ShouldBeNil)
+		So(buf, ShouldResemble, content)
+	})
+}
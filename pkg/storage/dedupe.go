@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/anuvu/zot/errors"
+	zlog "github.com/anuvu/zot/pkg/log"
+	godigest "github.com/opencontainers/go-digest"
+	"go.etcd.io/bbolt"
+)
+
+// DedupeReport is what was found deduping the storage, and done unless a dry run.
+type DedupeReport struct {
+	Blobs   int   `json:"blobs"`   // distinct, each recorded in the dedupe cache
+	Deduped int   `json:"deduped"` // copies hard linked to another
+	Saved   int64 `json:"saved"`   // bytes
+}
+
+// blobCopy is one of the copies of a blob across the repositories.
+type blobCopy struct {
+	path string
+	fi   os.FileInfo
+}
+
+// Dedupe rebuilds the dedupe cache db under rootDir from the blobs of its repositories, e.g. for
+// a storage created with dedupe disabled or whose cache was lost, and hard links the identical
+// copies of each blob to a single one, checked to be intact first. No registry may be running
+// over the storage, but one with dedupe disabled in read-only mode, whose pulls keep reading the
+// copies replaced. With dryRun, what would be deduped is only reported.
+func Dedupe(rootDir string, dryRun bool, log zlog.Logger) (*DedupeReport, error) {
+	if _, err := os.Stat(rootDir); err != nil {
+		return nil, err
+	}
+
+	paths := cacheDBPaths(rootDir, CacheName)
+
+	for _, dbPath := range paths {
+		db, err := bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: cacheOpenTimeout, ReadOnly: true})
+		if err != nil {
+			if err == bbolt.ErrTimeout {
+				err = errors.ErrCacheInUse
+			}
+
+			log.Error().Err(err).Str("dbPath", dbPath).Msg("dedupe: unable to open cache db")
+
+			return nil, err
+		}
+
+		db.Close()
+	}
+
+	copies, err := blobCopies(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	digests := make([]godigest.Digest, 0, len(copies))
+	for d := range copies {
+		digests = append(digests, d)
+	}
+
+	sort.Slice(digests, func(i, j int) bool { return digests[i] < digests[j] })
+
+	report := &DedupeReport{}
+	kept := make(map[godigest.Digest]string, len(digests))
+
+	for _, d := range digests {
+		keep, deduped, saved := dedupeCopies(d, copies[d], dryRun, log)
+		if keep == "" {
+			continue
+		}
+
+		kept[d] = keep
+		report.Blobs++
+		report.Deduped += deduped
+		report.Saved += saved
+	}
+
+	if dryRun {
+		return report, nil
+	}
+
+	// rebuilt from scratch, rather than leaving records of blobs no longer there
+	for _, dbPath := range paths {
+		if err := os.Remove(dbPath); err != nil {
+			log.Error().Err(err).Str("dbPath", dbPath).Msg("dedupe: unable to remove cache db")
+			return nil, err
+		}
+	}
+
+	// over as many dbs as it was
+	cache := NewCache(rootDir, CacheName, len(paths), log)
+	if cache == nil {
+		return nil, errors.ErrCacheRootBucket
+	}
+	defer cache.Close()
+
+	for _, d := range digests {
+		if keep, ok := kept[d]; ok {
+			if err := cache.PutBlob(d.String(), keep); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	log.Info().Int("blobs", report.Blobs).Int("deduped", report.Deduped).Int64("saved", report.Saved).
+		Msg("dedupe done")
+
+	return report, nil
+}
+
+// blobCopies returns the copies of each blob of the repositories under rootDir.
+func blobCopies(rootDir string) (map[godigest.Digest][]blobCopy, error) {
+	repos, err := NewImageStore(rootDir, false, false, Options{}, zlog.NewLogger("error", "")).GetRepositories()
+	if err != nil {
+		return nil, err
+	}
+
+	copies := map[godigest.Digest][]blobCopy{}
+
+	for _, repo := range repos {
+		dir := filepath.Join(rootDir, repo, "blobs")
+
+		algs, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, alg := range algs {
+			files, err := ioutil.ReadDir(filepath.Join(dir, alg.Name()))
+			if err != nil {
+				return nil, err
+			}
+
+			for _, fi := range files {
+				// e.g. temporary files
+				d := godigest.NewDigestFromEncoded(godigest.Algorithm(alg.Name()), fi.Name())
+				if fi.IsDir() || d.Validate() != nil {
+					continue
+				}
+
+				copies[d] = append(copies[d], blobCopy{path: filepath.Join(dir, alg.Name(), fi.Name()), fi: fi})
+			}
+		}
+	}
+
+	return copies, nil
+}
+
+// dedupeCopies hard links the copies of a blob to the first one intact, returning its path,
+// how many copies were replaced, and the bytes saved. A blob without copies to dedupe isn't
+// checked, as the image stores don't check those they dedupe either, but one with no intact
+// copy is left alone, returning no path.
+func dedupeCopies(d godigest.Digest, copies []blobCopy, dryRun bool, log zlog.Logger) (string, int, int64) {
+	keep := copies[0]
+
+	distinct := false
+
+	for _, c := range copies[1:] {
+		if !os.SameFile(keep.fi, c.fi) {
+			distinct = true
+			break
+		}
+	}
+
+	if !distinct {
+		return keep.path, 0, 0
+	}
+
+	found := false
+
+	for _, c := range copies {
+		if ok, err := verifyBlob(c.path, d); err == nil && ok {
+			keep, found = c, true
+			break
+		}
+	}
+
+	if !found {
+		log.Error().Str("digest", d.String()).Msg("dedupe: no intact copy of blob, left as is")
+		return "", 0, 0
+	}
+
+	deduped := 0
+	saved := int64(0)
+	freed := []os.FileInfo{} // copies may be hard linked to each other already
+
+	for _, c := range copies {
+		if os.SameFile(keep.fi, c.fi) {
+			continue
+		}
+
+		if !dryRun {
+			// replaced at once, for pulls to read either copy
+			tmp := c.path + ".dedupe"
+
+			if err := os.Link(keep.path, tmp); err != nil {
+				log.Warn().Err(err).Str("blobPath", c.path).Str("link", keep.path).
+					Msg("dedupe: unable to hard link, keeping a copy")
+
+				continue
+			}
+
+			if err := os.Rename(tmp, c.path); err != nil {
+				log.Error().Err(err).Str("blobPath", c.path).Msg("dedupe: unable to replace blob")
+				os.Remove(tmp)
+
+				continue
+			}
+		}
+
+		deduped++
+
+		if !sameFileAsAny(c.fi, freed) {
+			freed = append(freed, c.fi)
+			saved += c.fi.Size()
+		}
+	}
+
+	return keep.path, deduped, saved
+}
+
+func sameFileAsAny(fi os.FileInfo, others []os.FileInfo) bool {
+	for _, other := range others {
+		if os.SameFile(fi, other) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,91 @@
+package storage_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDedupeStorage(t *testing.T) {
+	Convey("Dedupe a storage created without", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.NewLogger("debug", "")
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log)
+		So(is, ShouldNotBeNil)
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo1", "1.0"), ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo2", "1.0"), ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo3", "1.0"), ShouldBeNil)
+
+		layer := img.Manifest.Layers[0].Digest
+		config := img.Manifest.Config.Digest
+
+		sameFile := func(repo string, other string) bool {
+			fi, err := os.Stat(is.BlobPath(repo, layer))
+			So(err, ShouldBeNil)
+			ofi, err := os.Stat(is.BlobPath(other, layer))
+			So(err, ShouldBeNil)
+
+			return os.SameFile(fi, ofi)
+		}
+
+		// the first copy of the layer corrupt
+		So(os.Remove(is.BlobPath("repo1", layer)), ShouldBeNil)
+		So(ioutil.WriteFile(is.BlobPath("repo1", layer), []byte("corrupt"), 0600), ShouldBeNil)
+
+		report, err := storage.Dedupe(dir, true, log)
+		So(err, ShouldBeNil)
+		So(report.Blobs, ShouldEqual, 3)
+		So(report.Deduped, ShouldEqual, 6)
+		So(sameFile("repo2", "repo3"), ShouldBeFalse)
+
+		_, err = os.Stat(path.Join(dir, storage.CacheName+".db"))
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		report, err = storage.Dedupe(dir, false, log)
+		So(err, ShouldBeNil)
+		So(report.Blobs, ShouldEqual, 3)
+		So(report.Deduped, ShouldEqual, 6)
+		So(sameFile("repo1", "repo2"), ShouldBeTrue)
+		So(sameFile("repo2", "repo3"), ShouldBeTrue)
+
+		// recorded in the cache rebuilt, for pushes to dedupe against
+		cache := storage.NewCache(dir, storage.CacheName, 1, log)
+		So(cache, ShouldNotBeNil)
+
+		for _, d := range []string{layer.String(), config.String()} {
+			record, err := cache.GetBlob(d)
+			So(err, ShouldBeNil)
+			So(record, ShouldNotBeEmpty)
+		}
+
+		// not while the cache is in use
+		_, err = storage.Dedupe(dir, false, log)
+		So(err, ShouldEqual, errors.ErrCacheInUse)
+
+		So(cache.Close(), ShouldBeNil)
+
+		report, err = storage.Dedupe(dir, false, log)
+		So(err, ShouldBeNil)
+		So(report.Blobs, ShouldEqual, 3)
+		So(report.Deduped, ShouldEqual, 0)
+		So(report.Saved, ShouldEqual, 0)
+	})
+
+	Convey("Dedupe a storage not there", t, func() {
+		_, err := storage.Dedupe("/does/not/exist", false, log.NewLogger("debug", ""))
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+)
+
+// StorageDriver is what an ImageStoreDriver keeps repositories on, e.g. a filesystem or an S3
+// bucket. Paths are slash-separated, and relative to the root of the driver. An ImageStoreLocal
+// keeps its root directory without one.
+type StorageDriver interface {
+	// Name returns the name the driver is registered as.
+	Name() string
+	// Stat returns the size and modification time of a file, or errors.ErrPathNotFound.
+	Stat(path string) (FileInfo, error)
+	// Reader returns the contents of a file from offset on, or errors.ErrPathNotFound.
+	Reader(path string, offset int64) (io.ReadCloser, error)
+	// Writer returns a writer to a file, created along with its parents if need be, whose
+	// contents are only replaced once it's closed, and not at all if it's cancelled.
+	Writer(path string) (FileWriter, error)
+	// Move renames a file, replacing dst if it exists.
+	Move(src string, dst string) error
+	// Delete removes a file, or a directory and all it holds, which isn't an error if it
+	// doesn't exist.
+	Delete(path string) error
+	// Walk calls fn with each file under a directory, at any depth, in lexical order.
+	Walk(path string, fn WalkFunc) error
+}
+
+// FileInfo describes a file of a storage driver.
+type FileInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// FileWriter writes a file of a storage driver.
+type FileWriter interface {
+	io.Writer
+	// Close replaces the contents of the file with what was written.
+	Close() error
+	// Cancel discards what was written, leaving the file as it was.
+	Cancel() error
+}
+
+// WalkFunc is called with each file walked, stopping the walk if it returns an error.
+type WalkFunc func(fi FileInfo) error
+
+// DriverFactory returns a storage driver configured with parameters, e.g. from the
+// storageDriver section of the configuration.
+type DriverFactory func(parameters map[string]interface{}) (StorageDriver, error)
+
+// nolint: gochecknoglobals
+var (
+	driversLock sync.RWMutex
+	drivers     = map[string]DriverFactory{}
+)
+
+// RegisterDriver makes a storage driver available by name, e.g. from the init function of
+// the package implementing it, linked in with a blank import, replacing any registered by
+// the same name.
+func RegisterDriver(name string, factory DriverFactory) {
+	driversLock.Lock()
+	defer driversLock.Unlock()
+
+	drivers[name] = factory
+}
+
+// Drivers returns the names of the storage drivers registered, sorted.
+func Drivers() []string {
+	driversLock.RLock()
+	defer driversLock.RUnlock()
+
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// NewDriver returns the storage driver registered by name, configured with parameters.
+func NewDriver(name string, parameters map[string]interface{}) (StorageDriver, error) {
+	driversLock.RLock()
+	factory, ok := drivers[name]
+	driversLock.RUnlock()
+
+	if !ok {
+		return nil, errors.ErrDriverNotFound
+	}
+
+	return factory(parameters)
+}
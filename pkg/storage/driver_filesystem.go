@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/mitchellh/mapstructure"
+)
+
+// FilesystemDriverName is the name the filesystem driver is registered as.
+const FilesystemDriverName = "filesystem"
+
+func init() { //nolint: gochecknoinits
+	RegisterDriver(FilesystemDriverName, func(parameters map[string]interface{}) (StorageDriver, error) {
+		var config struct {
+			RootDirectory string
+		}
+
+		if err := mapstructure.Decode(parameters, &config); err != nil || config.RootDirectory == "" {
+			return nil, errors.ErrBadConfig
+		}
+
+		return NewFilesystemDriver(config.RootDirectory), nil
+	})
+}
+
+// FilesystemDriver keeps files under a root directory.
+type FilesystemDriver struct {
+	rootDir string
+}
+
+// NewFilesystemDriver returns a storage driver keeping files under rootDir.
+func NewFilesystemDriver(rootDir string) *FilesystemDriver {
+	return &FilesystemDriver{rootDir: rootDir}
+}
+
+// Name returns the name the driver is registered as.
+func (d *FilesystemDriver) Name() string {
+	return FilesystemDriverName
+}
+
+func (d *FilesystemDriver) fullPath(path string) string {
+	return filepath.Join(d.rootDir, filepath.FromSlash(path))
+}
+
+func notFound(err error) error {
+	if os.IsNotExist(err) {
+		return errors.ErrPathNotFound
+	}
+
+	return err
+}
+
+// Stat returns the size and modification time of a file.
+func (d *FilesystemDriver) Stat(path string) (FileInfo, error) {
+	fi, err := os.Stat(d.fullPath(path))
+	if err != nil {
+		return FileInfo{}, notFound(err)
+	}
+
+	return FileInfo{Path: path, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// Reader returns the contents of a file from offset on.
+func (d *FilesystemDriver) Reader(path string, offset int64) (io.ReadCloser, error) {
+	f, err := os.Open(d.fullPath(path))
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Writer returns a writer to a temporary file next to the file, renamed over it once closed.
+func (d *FilesystemDriver) Writer(path string) (FileWriter, error) {
+	dst := d.fullPath(path)
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileWriter{File: f, dst: dst}, nil
+}
+
+type fileWriter struct {
+	*os.File
+	dst string
+}
+
+func (w *fileWriter) Close() error {
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+
+	if err := rename(w.Name(), w.dst); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+
+	return nil
+}
+
+func (w *fileWriter) Cancel() error {
+	w.File.Close()
+
+	return os.Remove(w.Name())
+}
+
+// Move renames a file, creating the parents of dst if need be.
+func (d *FilesystemDriver) Move(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(d.fullPath(dst)), 0755); err != nil {
+		return err
+	}
+
+	return notFound(rename(d.fullPath(src), d.fullPath(dst)))
+}
+
+// Delete removes a file, or a directory and all it holds.
+func (d *FilesystemDriver) Delete(path string) error {
+	return os.RemoveAll(d.fullPath(path))
+}
+
+// Walk calls fn with each file under a directory, which isn't an error if it doesn't exist,
+// skipping hidden files, e.g. those being written.
+func (d *FilesystemDriver) Walk(path string, fn WalkFunc) error {
+	root := d.fullPath(path)
+
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == root {
+				return nil
+			}
+
+			return err
+		}
+
+		// nor files being written
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(d.rootDir, p)
+		if err != nil {
+			return err
+		}
+
+		return fn(FileInfo{Path: filepath.ToSlash(rel), Size: fi.Size(), ModTime: fi.ModTime()})
+	})
+
+	return err
+}
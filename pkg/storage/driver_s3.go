@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/anuvu/zot/errors"
+	zlog "github.com/anuvu/zot/pkg/log"
+	"github.com/mitchellh/mapstructure"
+)
+
+// S3DriverName is the name the S3 driver is registered as.
+const S3DriverName = "s3"
+
+func init() { //nolint: gochecknoinits
+	RegisterDriver(S3DriverName, func(parameters map[string]interface{}) (StorageDriver, error) {
+		var config S3Config
+
+		if err := mapstructure.Decode(parameters, &config); err != nil || config.Bucket == "" || config.Region == "" {
+			return nil, errors.ErrBadConfig
+		}
+
+		return NewS3Driver(config)
+	})
+}
+
+// S3Config selects the S3 bucket, or S3-compatible one, e.g. on MinIO, images are kept in.
+type S3Config struct {
+	Bucket string
+	Region string
+	// Endpoint is the URL of the service, e.g. http://minio:9000, that of AWS in the region if not set
+	Endpoint string
+	// Prefix is the path in the bucket repositories are kept under, its root if not set
+	Prefix string
+	// AccessKeyID, SecretAccessKey and SessionToken default to those of the AWS_ACCESS_KEY_ID,
+	// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// Validate checks the bucket and its region are set, and the endpoint, if set, is a URL.
+func (c S3Config) Validate(log zlog.Logger) error {
+	if c.Bucket == "" || c.Region == "" {
+		log.Error().Str("bucket", c.Bucket).Str("region", c.Region).Msg("S3 bucket and region are required")
+		return errors.ErrBadConfig
+	}
+
+	if c.Endpoint != "" {
+		u, err := url.Parse(c.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Error().Err(err).Str("endpoint", c.Endpoint).Msg("invalid S3 endpoint")
+			return errors.ErrBadConfig
+		}
+	}
+
+	return nil
+}
+
+// S3Driver keeps files as the objects of an S3 bucket, under a prefix. As objects can't be
+// appended to or renamed, files are spooled to temporary files as they're written, and moved
+// by being copied.
+type S3Driver struct {
+	client *s3Client
+	prefix string
+}
+
+// NewS3Driver returns a storage driver keeping files in the bucket of config.
+func NewS3Driver(config S3Config) (*S3Driver, error) {
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", config.Region)
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &s3Client{
+		endpoint:  u,
+		bucket:    config.Bucket,
+		region:    config.Region,
+		accessKey: config.AccessKeyID,
+		secretKey: config.SecretAccessKey,
+		token:     config.SessionToken,
+		client:    &http.Client{},
+	}
+
+	if client.accessKey == "" && client.secretKey == "" {
+		client.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		client.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		client.token = os.Getenv("AWS_SESSION_TOKEN")
+	}
+
+	return &S3Driver{client: client, prefix: strings.Trim(config.Prefix, "/")}, nil
+}
+
+// Name returns the name the driver is registered as.
+func (d *S3Driver) Name() string {
+	return S3DriverName
+}
+
+func (d *S3Driver) key(p string) string {
+	return path.Join(d.prefix, p)
+}
+
+func s3NotFound(err error) error {
+	if isNotFound(err) {
+		return errors.ErrPathNotFound
+	}
+
+	return err
+}
+
+// Stat returns the size and modification time of an object.
+func (d *S3Driver) Stat(p string) (FileInfo, error) {
+	resp, err := d.client.do(http.MethodHead, d.key(p), nil, nil, nil, 0)
+	if err != nil {
+		return FileInfo{}, s3NotFound(err)
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return FileInfo{Path: p, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// Reader returns the contents of an object from offset on.
+func (d *S3Driver) Reader(p string, offset int64) (io.ReadCloser, error) {
+	body, _, err := d.client.get(d.key(p), offset)
+	if err != nil {
+		return nil, s3NotFound(err)
+	}
+
+	return body, nil
+}
+
+// Writer returns a writer to a temporary file, put as the object once closed, with its size.
+func (d *S3Driver) Writer(p string) (FileWriter, error) {
+	f, err := ioutil.TempFile("", "zot-s3-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Writer{File: f, client: d.client, key: d.key(p)}, nil
+}
+
+type s3Writer struct {
+	*os.File
+	client *s3Client
+	key    string
+}
+
+func (w *s3Writer) Close() error {
+	defer os.Remove(w.Name())
+	defer w.File.Close()
+
+	size, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return w.client.put(w.key, w.File, size)
+}
+
+func (w *s3Writer) Cancel() error {
+	w.File.Close()
+
+	return os.Remove(w.Name())
+}
+
+// Move copies an object, and then deletes it.
+func (d *S3Driver) Move(src string, dst string) error {
+	if err := d.client.copy(d.key(src), d.key(dst)); err != nil {
+		return s3NotFound(err)
+	}
+
+	return d.client.delete(d.key(src))
+}
+
+// Delete removes an object, or all those under a prefix.
+func (d *S3Driver) Delete(p string) error {
+	if err := d.Walk(p, func(fi FileInfo) error {
+		return d.client.delete(d.key(fi.Path))
+	}); err != nil {
+		return err
+	}
+
+	return d.client.delete(d.key(p))
+}
+
+// Walk calls fn with each object under a prefix, as if it were a directory.
+func (d *S3Driver) Walk(p string, fn WalkFunc) error {
+	prefix := d.key(p)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	objects, _, err := d.client.list(prefix, "")
+	if err != nil {
+		return err
+	}
+
+	for _, o := range objects {
+		rel := strings.TrimPrefix(o.Key, d.prefix)
+		if err := fn(FileInfo{Path: strings.TrimPrefix(rel, "/"), Size: o.Size, ModTime: o.LastModified}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
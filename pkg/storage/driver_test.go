@@ -0,0 +1,192 @@
+package storage_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRegisterDriver(t *testing.T) {
+	Convey("Register storage drivers", t, func() {
+		So(storage.Drivers(), ShouldContain, storage.FilesystemDriverName)
+		So(storage.Drivers(), ShouldContain, storage.S3DriverName)
+
+		_, err := storage.NewDriver("unknown", nil)
+		So(err, ShouldEqual, errors.ErrDriverNotFound)
+
+		_, err = storage.NewDriver(storage.FilesystemDriverName, map[string]interface{}{})
+		So(err, ShouldEqual, errors.ErrBadConfig)
+
+		_, err = storage.NewDriver(storage.S3DriverName, map[string]interface{}{"bucket": "zot"})
+		So(err, ShouldEqual, errors.ErrBadConfig)
+
+		d, err := storage.NewDriver(storage.S3DriverName, map[string]interface{}{"bucket": "zot", "region": "r"})
+		So(err, ShouldBeNil)
+		So(d.Name(), ShouldEqual, storage.S3DriverName)
+
+		storage.RegisterDriver("custom", func(parameters map[string]interface{}) (storage.StorageDriver, error) {
+			return storage.NewFilesystemDriver(parameters["dir"].(string)), nil
+		})
+
+		So(storage.Drivers(), ShouldContain, "custom")
+
+		d, err = storage.NewDriver("custom", map[string]interface{}{"dir": "/tmp"})
+		So(err, ShouldBeNil)
+		So(d.Name(), ShouldEqual, storage.FilesystemDriverName)
+	})
+}
+
+func TestDrivers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-driver-test")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(newS3Bucket("zot"))
+	defer server.Close()
+
+	s3, err := storage.NewS3Driver(storage.S3Config{Bucket: "zot", Region: "us-east-1", Endpoint: server.URL,
+		AccessKeyID: "akid", SecretAccessKey: "secret"})
+	if err != nil {
+		panic(err)
+	}
+
+	for _, d := range []storage.StorageDriver{storage.NewFilesystemDriver(dir), s3} {
+		d := d
+
+		Convey("Files of the "+d.Name()+" driver", t, func() {
+			_, err := d.Stat("a/b")
+			So(err, ShouldEqual, errors.ErrPathNotFound)
+
+			_, err = d.Reader("a/b", 0)
+			So(err, ShouldEqual, errors.ErrPathNotFound)
+
+			w, err := d.Writer("a/b")
+			So(err, ShouldBeNil)
+			_, err = w.Write([]byte("hello"))
+			So(err, ShouldBeNil)
+
+			// not until closed
+			_, err = d.Stat("a/b")
+			So(err, ShouldEqual, errors.ErrPathNotFound)
+			So(w.Close(), ShouldBeNil)
+
+			fi, err := d.Stat("a/b")
+			So(err, ShouldBeNil)
+			So(fi.Size, ShouldEqual, 5)
+			So(fi.ModTime.IsZero(), ShouldBeFalse)
+
+			r, err := d.Reader("a/b", 1)
+			So(err, ShouldBeNil)
+			buf, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(string(buf), ShouldEqual, "ello")
+			So(r.Close(), ShouldBeNil)
+
+			w, err = d.Writer("a/b")
+			So(err, ShouldBeNil)
+			_, err = w.Write([]byte("discarded"))
+			So(err, ShouldBeNil)
+			So(w.Cancel(), ShouldBeNil)
+
+			fi, err = d.Stat("a/b")
+			So(err, ShouldBeNil)
+			So(fi.Size, ShouldEqual, 5)
+
+			So(d.Move("a/b", "a/c/d"), ShouldBeNil)
+			_, err = d.Stat("a/b")
+			So(err, ShouldEqual, errors.ErrPathNotFound)
+			So(d.Move("a/b", "a/c/e"), ShouldEqual, errors.ErrPathNotFound)
+
+			w, err = d.Writer("a/f")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+
+			walked := []string{}
+			So(d.Walk("a", func(fi storage.FileInfo) error {
+				walked = append(walked, fi.Path)
+				return nil
+			}), ShouldBeNil)
+			So(walked, ShouldResemble, []string{"a/c/d", "a/f"})
+
+			So(d.Walk("none", func(fi storage.FileInfo) error {
+				return errors.ErrBadConfig
+			}), ShouldBeNil)
+
+			So(d.Delete("a"), ShouldBeNil)
+			So(d.Delete("a"), ShouldBeNil)
+
+			_, err = d.Stat("a/c/d")
+			So(err, ShouldEqual, errors.ErrPathNotFound)
+		})
+	}
+}
+
+func TestImageStoreDriver(t *testing.T) {
+	Convey("Push and pull images on a filesystem driver", t, func() {
+		dir, err := ioutil.TempDir("", "oci-driver-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		driver, err := storage.NewDriver(storage.FilesystemDriverName, map[string]interface{}{"rootDirectory": dir})
+		So(err, ShouldBeNil)
+
+		is := storage.NewImageStoreDriver(driver, true, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
+		So(is.Driver(), ShouldEqual, driver)
+
+		img, err := test.GetRandomImage(64, 2)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "a/b", "1.0"), ShouldBeNil)
+
+		repos, err := is.GetRepositories()
+		So(err, ShouldBeNil)
+		So(repos, ShouldResemble, []string{"a/b"})
+
+		digest, err := img.Digest()
+		So(err, ShouldBeNil)
+
+		_, d, _, err := is.GetImageManifest("a/b", "1.0")
+		So(err, ShouldBeNil)
+		So(d, ShouldEqual, digest.String())
+
+		for _, l := range img.Manifest.Layers {
+			ok, size, err := is.CheckBlob("a/b", l.Digest.String(), "")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(size, ShouldEqual, l.Size)
+		}
+
+		r, length, size, err := is.GetBlobPartial("a/b", img.Manifest.Layers[0].Digest.String(), "", 10, 19)
+		So(err, ShouldBeNil)
+		So(length, ShouldEqual, 10)
+		So(size, ShouldEqual, 64)
+		buf, err := ioutil.ReadAll(r)
+		So(err, ShouldBeNil)
+		So(buf, ShouldResemble, img.Layers[0][10:20])
+		r.(io.Closer).Close()
+
+		_, _, _, err = is.GetBlobPartial("a/b", img.Manifest.Layers[0].Digest.String(), "", 64, -1)
+		So(err, ShouldEqual, errors.ErrBadRange)
+
+		// nothing left over of the uploads
+		_, err = os.Stat(dir + "/a/b/" + storage.BlobUploadDir)
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		So(is.DeleteRepo("a/b"), ShouldBeNil)
+
+		repos, err = is.GetRepositories()
+		So(err, ShouldBeNil)
+		So(repos, ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,1061 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	zlog "github.com/anuvu/zot/pkg/log"
+	guuid "github.com/gofrs/uuid"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog"
+)
+
+// ImageStoreDriver provides the image storage operations on a storage driver, e.g. an S3
+// bucket, laid out as they are on a local filesystem: each repository has its index.json,
+// oci-layout and blobs under its path. As it's only locked in-process, the storage mustn't be
+// used by several zot instances.
+type ImageStoreDriver struct {
+	driver      StorageDriver
+	lock        *sync.RWMutex
+	gc          bool
+	gcs         *gcScheduler
+	copyBuffers *CopyBuffers
+	tracer      Tracer
+	log         zerolog.Logger
+}
+
+// NewImageStoreDriver returns a new image store backed by a storage driver, written to with
+// copy buffers only of the options.
+func NewImageStoreDriver(driver StorageDriver, gc bool, opts Options, log zlog.Logger) *ImageStoreDriver {
+	is := &ImageStoreDriver{
+		driver:      driver,
+		lock:        &sync.RWMutex{},
+		gc:          gc,
+		copyBuffers: NewCopyBuffers(opts.CopyBufferSize),
+		log:         log.With().Caller().Str("driver", driver.Name()).Logger(),
+	}
+
+	is.gcs = newGCScheduler(func(repo string) error {
+		traced := trace(is.tracer, "gc", repo, "")
+		err := is.garbageCollect(repo)
+		traced(err)
+
+		return err
+	}, is.log)
+
+	return is
+}
+
+// NewImageStoreS3 returns a new image store backed by an S3 bucket. The config must be valid.
+func NewImageStoreS3(config S3Config, gc bool, opts Options, log zlog.Logger) *ImageStoreDriver {
+	driver, err := NewS3Driver(config)
+	if err != nil {
+		log.Error().Err(err).Str("endpoint", config.Endpoint).Msg("invalid S3 endpoint")
+		return nil
+	}
+
+	return NewImageStoreDriver(driver, gc, opts, log)
+}
+
+// Driver returns the storage driver of the image store.
+func (is *ImageStoreDriver) Driver() StorageDriver {
+	return is.driver
+}
+
+// Close releases resources held by the image store, once done collecting garbage, if at it.
+func (is *ImageStoreDriver) Close() error {
+	is.gcs.close()
+
+	return nil
+}
+
+// SetGCInterval sets how long after being written to repositories are collected garbage in,
+// in the background, as soon as possible by default.
+func (is *ImageStoreDriver) SetGCInterval(interval time.Duration) {
+	is.gcs.setInterval(interval)
+}
+
+// SetGCParallelism sets how many repositories are collected garbage in at once, one if not set.
+func (is *ImageStoreDriver) SetGCParallelism(parallel int) {
+	is.gcs.setParallel(parallel)
+}
+
+// SetGCDeleteRate sets how many blobs garbage collection removes per second at most, across
+// repositories, for it not to slow down pulls, unlimited if not set.
+func (is *ImageStoreDriver) SetGCDeleteRate(rate int) {
+	is.gcs.setDeleteRate(rate)
+}
+
+// SetTracer has garbage collection traced with t. It must be set before the store is used.
+func (is *ImageStoreDriver) SetTracer(t Tracer) {
+	is.tracer = t
+}
+
+// key returns the path of a file of a repository.
+func (is *ImageStoreDriver) key(repo string, elem ...string) string {
+	return path.Join(append([]string{repo}, elem...)...)
+}
+
+// blobKey returns the path of a blob of a repository.
+func (is *ImageStoreDriver) blobKey(repo string, digest godigest.Digest) string {
+	return is.key(repo, "blobs", digest.Algorithm().String(), digest.Encoded())
+}
+
+// uploadKey returns the directory of the parts of an upload, each named after its offset, as
+// files may not be appended to.
+func (is *ImageStoreDriver) uploadKey(repo string, uuid string) string {
+	return is.key(repo, BlobUploadDir, uuid)
+}
+
+func (is *ImageStoreDriver) partKey(repo string, uuid string, offset int64) string {
+	return path.Join(is.uploadKey(repo, uuid), fmt.Sprintf("%020d", offset))
+}
+
+// readFile returns the contents of a small file, e.g. an index.
+func (is *ImageStoreDriver) readFile(p string) ([]byte, error) {
+	r, err := is.driver.Reader(p, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// writeFile replaces the contents of a small file.
+func (is *ImageStoreDriver) writeFile(p string, buf []byte) error {
+	w, err := is.driver.Writer(p)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(buf); err != nil {
+		_ = w.Cancel()
+		return err
+	}
+
+	return w.Close()
+}
+
+// InitRepo creates an image repository under this store.
+func (is *ImageStoreDriver) InitRepo(name string) error {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	if _, err := is.driver.Stat(is.key(name, "index.json")); err == nil {
+		return nil
+	} else if err != errors.ErrPathNotFound { // nolint:goerr113
+		is.log.Error().Err(err).Str("repo", name).Msg("unable to look up index.json")
+		return err
+	}
+
+	buf, err := json.Marshal(ispec.ImageLayout{Version: ispec.ImageLayoutVersion})
+	if err != nil {
+		is.log.Panic().Err(err).Msg("unable to marshal JSON")
+	}
+
+	if err := is.writeFile(is.key(name, ispec.ImageLayoutFile), buf); err != nil {
+		is.log.Error().Err(err).Str("repo", name).Msg("unable to write oci-layout")
+		return err
+	}
+
+	index := ispec.Index{}
+	index.SchemaVersion = schemaVersion
+
+	return is.writeIndex(name, index)
+}
+
+// ValidateRepo validates that the repository layout is complaint with the OCI repo layout.
+func (is *ImageStoreDriver) ValidateRepo(name string) (bool, error) {
+	if _, err := is.driver.Stat(is.key(name, "index.json")); err != nil {
+		if err == errors.ErrPathNotFound { // nolint:goerr113
+			return false, errors.ErrRepoNotFound
+		}
+
+		return false, err
+	}
+
+	buf, err := is.readFile(is.key(name, ispec.ImageLayoutFile))
+	if err != nil {
+		if err == errors.ErrPathNotFound { // nolint:goerr113
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	var il ispec.ImageLayout
+	if err := json.Unmarshal(buf, &il); err != nil {
+		return false, err
+	}
+
+	if il.Version != ispec.ImageLayoutVersion {
+		return false, errors.ErrRepoBadVersion
+	}
+
+	return true, nil
+}
+
+// DeleteRepo deletes an image repository from this store, with its images, blobs and uploads,
+// leaving the repositories nested under it, if any.
+func (is *ImageStoreDriver) DeleteRepo(name string) error {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	if ok, err := is.ValidateRepo(name); !ok || err != nil {
+		return errors.ErrRepoNotFound
+	}
+
+	// index.json first, for what's left, if failing midway, not to be a repository anymore
+	for _, entry := range []string{"index.json", ispec.ImageLayoutFile, ReferrersFile, "blobs", BlobUploadDir} {
+		if err := is.driver.Delete(is.key(name, entry)); err != nil {
+			is.log.Error().Err(err).Str("repo", name).Msg("unable to delete repository")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetRepositories returns a list of all the repositories under this store, sorted.
+func (is *ImageStoreDriver) GetRepositories() ([]string, error) {
+	stores := []string{}
+
+	// every file is walked, as repositories may be nested at any depth
+	if err := is.driver.Walk("", func(fi FileInfo) error {
+		if path.Base(fi.Path) == "index.json" && path.Dir(fi.Path) != "." {
+			stores = append(stores, path.Dir(fi.Path))
+		}
+
+		return nil
+	}); err != nil {
+		is.log.Error().Err(err).Msg("unable to list repositories")
+		return nil, err
+	}
+
+	sort.Strings(stores)
+
+	return stores, nil
+}
+
+// readIndex returns the index of a repository.
+func (is *ImageStoreDriver) readIndex(repo string) (ispec.Index, error) {
+	var index ispec.Index
+
+	buf, err := is.readFile(is.key(repo, "index.json"))
+	if err != nil {
+		if err == errors.ErrPathNotFound { // nolint:goerr113
+			return index, errors.ErrRepoNotFound
+		}
+
+		return index, err
+	}
+
+	if err := json.Unmarshal(buf, &index); err != nil {
+		is.log.Error().Err(err).Str("repo", repo).Msg("invalid JSON")
+		return index, err
+	}
+
+	return index, nil
+}
+
+// writeIndex replaces the index of a repository, which must be called with the lock held.
+func (is *ImageStoreDriver) writeIndex(repo string, index ispec.Index) error {
+	buf, err := json.Marshal(index)
+	if err != nil {
+		is.log.Error().Err(err).Msg("unable to marshal JSON")
+		return err
+	}
+
+	if err := is.writeFile(is.key(repo, "index.json"), buf); err != nil {
+		is.log.Error().Err(err).Str("repo", repo).Msg("unable to write index.json")
+		return err
+	}
+
+	return nil
+}
+
+// readReferrers returns the referrers index of a repository.
+func (is *ImageStoreDriver) readReferrers(repo string) (referrers, error) {
+	buf, err := is.readFile(is.key(repo, ReferrersFile))
+	if err != nil && err != errors.ErrPathNotFound { // nolint:goerr113
+		return nil, err
+	}
+
+	return parseReferrers(buf)
+}
+
+// writeReferrers replaces the referrers index of a repository, which must be called with the
+// lock held.
+func (is *ImageStoreDriver) writeReferrers(repo string, refs referrers) error {
+	buf, err := json.Marshal(refs)
+	if err != nil {
+		is.log.Error().Err(err).Msg("unable to marshal JSON")
+		return err
+	}
+
+	if err := is.writeFile(is.key(repo, ReferrersFile), buf); err != nil {
+		is.log.Error().Err(err).Str("repo", repo).Msg("unable to write referrers")
+		return err
+	}
+
+	return nil
+}
+
+// addReferrer adds a manifest referring to subject to the referrers index of a repository, of
+// which index is the index about to be written, which must be called with the lock held.
+func (is *ImageStoreDriver) addReferrer(repo string, index ispec.Index, subject godigest.Digest,
+	r Referrer) error {
+	refs, err := is.readReferrers(repo)
+	if err != nil {
+		is.log.Error().Err(err).Str("repo", repo).Msg("unable to read referrers")
+		return err
+	}
+
+	refs.add(subject, r)
+	refs.prune(index)
+
+	return is.writeReferrers(repo, refs)
+}
+
+// pruneReferrers removes the manifests no longer in index from the referrers index of a
+// repository, which is otherwise only filtered as read, which must be called with the lock held.
+func (is *ImageStoreDriver) pruneReferrers(repo string, index ispec.Index) {
+	refs, err := is.readReferrers(repo)
+	if err == nil && refs.prune(index) {
+		err = is.writeReferrers(repo, refs)
+	}
+
+	if err != nil {
+		is.log.Error().Err(err).Str("repo", repo).Msg("unable to update referrers")
+	}
+}
+
+// GetImageTags returns a list of image tags available in the specified repository.
+func (is *ImageStoreDriver) GetImageTags(repo string) ([]string, error) {
+	index, err := is.readIndex(repo)
+	if err != nil {
+		is.log.Error().Err(err).Str("repo", repo).Msg("failed to read index.json")
+		return nil, errors.ErrRepoNotFound
+	}
+
+	return getTags(index), nil
+}
+
+// GetIndexContent returns the contents of the index.json of a repository.
+func (is *ImageStoreDriver) GetIndexContent(repo string) ([]byte, error) {
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+
+	buf, err := is.readFile(is.key(repo, "index.json"))
+	if err != nil {
+		is.log.Error().Err(err).Str("repo", repo).Msg("failed to read index.json")
+		return nil, errors.ErrRepoNotFound
+	}
+
+	return buf, nil
+}
+
+// GetImageManifest returns the image manifest of an image in the specific repository.
+func (is *ImageStoreDriver) GetImageManifest(repo string, reference string) ([]byte, string, string, error) {
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+
+	index, err := is.readIndex(repo)
+	if err != nil {
+		is.log.Error().Err(err).Str("repo", repo).Msg("failed to read index.json")
+		return nil, "", "", err
+	}
+
+	desc, found := findManifest(index, reference)
+	if !found {
+		return nil, "", "", errors.ErrManifestNotFound
+	}
+
+	buf, err := is.readFile(is.blobKey(repo, desc.Digest))
+	if err != nil {
+		is.log.Error().Err(err).Str("repo", repo).Str("digest", desc.Digest.String()).Msg("failed to read manifest")
+
+		if err == errors.ErrPathNotFound { // nolint:goerr113
+			return nil, "", "", errors.ErrManifestNotFound
+		}
+
+		return nil, "", "", err
+	}
+
+	// checked rather than parsed, as it's returned as is
+	if !json.Valid(buf) {
+		is.log.Error().Str("repo", repo).Str("digest", desc.Digest.String()).Msg("invalid JSON")
+		return nil, "", "", errors.ErrBadManifest
+	}
+
+	return buf, desc.Digest.String(), desc.MediaType, nil
+}
+
+// PutImageManifest adds an image manifest to the repository.
+func (is *ImageStoreDriver) PutImageManifest(repo string, reference string, mediaType string,
+	body []byte) (string, error) {
+	if err := is.InitRepo(repo); err != nil {
+		is.log.Debug().Err(err).Msg("init repo")
+		return "", err
+	}
+
+	m, err := validateManifest(mediaType, body, is.log)
+	if err != nil {
+		return "", err
+	}
+
+	for _, d := range m.digests() {
+		if _, err := is.driver.Stat(is.blobKey(repo, d)); err != nil {
+			is.log.Error().Err(err).Str("digest", d.String()).Msg("unable to find blob")
+			return d.String(), errors.ErrBlobNotFound
+		}
+	}
+
+	mDigest := manifestDigest(reference, body)
+
+	refIsDigest, err := checkManifestReference(reference, mDigest, is.log)
+	if err != nil {
+		return "", err
+	}
+
+	is.lock.Lock()
+
+	index, err := is.readIndex(repo)
+	if err != nil {
+		is.lock.Unlock()
+		return "", err
+	}
+
+	desc, changed := updateIndex(&index, reference, refIsDigest, mediaType, mDigest, int64(len(body)), is.log)
+	if changed {
+		// the manifest first, for the index never to reference a missing one
+		if err := is.writeFile(is.blobKey(repo, mDigest), body); err != nil {
+			is.log.Error().Err(err).Str("digest", mDigest.String()).Msg("unable to write manifest")
+			is.lock.Unlock()
+
+			return "", err
+		}
+
+		// and the referrers, for those of manifests not in the index to be ignored if it fails
+		if subject, ref, ok := referrerOf(mediaType, mDigest, body); ok {
+			if err := is.addReferrer(repo, index, subject, ref); err != nil {
+				is.lock.Unlock()
+				return "", err
+			}
+		}
+
+		if err := is.writeIndex(repo, index); err != nil {
+			is.lock.Unlock()
+			return "", err
+		}
+	}
+
+	is.lock.Unlock()
+
+	// garbage is collected in the background
+	if changed && is.gc {
+		is.gcs.queue(repo)
+	}
+
+	return desc.Digest.String(), nil
+}
+
+// DeleteImageManifest deletes the image manifest from the repository.
+func (is *ImageStoreDriver) DeleteImageManifest(repo string, reference string) error {
+	// as per spec "reference" can only be a digest and not a tag
+	digest, err := godigest.Parse(reference)
+	if err != nil {
+		is.log.Error().Err(err).Msg("invalid reference")
+		return errors.ErrBadManifest
+	}
+
+	is.lock.Lock()
+
+	index, err := is.readIndex(repo)
+	if err != nil {
+		is.lock.Unlock()
+		return err
+	}
+
+	outIndex, found := removeManifest(index, reference)
+	if !found {
+		is.lock.Unlock()
+		return errors.ErrManifestNotFound
+	}
+
+	if err := is.writeIndex(repo, outIndex); err != nil {
+		is.lock.Unlock()
+		return err
+	}
+
+	_ = is.driver.Delete(is.blobKey(repo, digest))
+	is.pruneReferrers(repo, outIndex)
+
+	is.lock.Unlock()
+
+	if is.gc {
+		is.gcs.queue(repo)
+	}
+
+	return nil
+}
+
+// GetReferrers returns the descriptors of the manifests of a repository whose subject is
+// digest, of artifactType unless empty.
+func (is *ImageStoreDriver) GetReferrers(repo string, digest string, artifactType string) ([]Referrer, error) {
+	subject, err := godigest.Parse(digest)
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to parse digest")
+		return nil, errors.ErrBadBlobDigest
+	}
+
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+
+	index, err := is.readIndex(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := is.readReferrers(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	return refs.list(index, subject, artifactType), nil
+}
+
+// DeleteImageTag removes a tag from the repository, leaving garbage collection, if enabled,
+// to remove the manifest and blobs nothing else references.
+func (is *ImageStoreDriver) DeleteImageTag(repo string, tag string) error {
+	is.lock.Lock()
+
+	index, err := is.readIndex(repo)
+	if err != nil {
+		is.lock.Unlock()
+		return err
+	}
+
+	outIndex, found := removeTag(index, tag)
+	if !found {
+		is.lock.Unlock()
+		return errors.ErrManifestNotFound
+	}
+
+	if err := is.writeIndex(repo, outIndex); err != nil {
+		is.lock.Unlock()
+		return err
+	}
+
+	is.lock.Unlock()
+
+	if is.gc {
+		is.gcs.queue(repo)
+	}
+
+	return nil
+}
+
+// NewBlobUpload returns the unique ID for an upload in progress.
+func (is *ImageStoreDriver) NewBlobUpload(repo string) (string, error) {
+	if err := is.InitRepo(repo); err != nil {
+		return "", err
+	}
+
+	uuid, err := guuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+
+	u := uuid.String()
+
+	// an empty first part, replaced by the first chunk
+	if err := is.writeFile(is.partKey(repo, u, 0), nil); err != nil {
+		is.log.Error().Err(err).Str("repo", repo).Msg("unable to start blob upload")
+		return "", err
+	}
+
+	return u, nil
+}
+
+// uploadParts returns the parts of an upload, in order, and their total size.
+func (is *ImageStoreDriver) uploadParts(repo string, uuid string) ([]FileInfo, int64, error) {
+	parts := []FileInfo{}
+	size := int64(0)
+
+	if err := is.driver.Walk(is.uploadKey(repo, uuid), func(fi FileInfo) error {
+		parts = append(parts, fi)
+		size += fi.Size
+
+		return nil
+	}); err != nil {
+		return nil, -1, err
+	}
+
+	if len(parts) == 0 {
+		return nil, -1, errors.ErrUploadNotFound
+	}
+
+	return parts, size, nil
+}
+
+// GetBlobUpload returns the current size of a blob upload.
+func (is *ImageStoreDriver) GetBlobUpload(repo string, uuid string) (int64, error) {
+	_, size, err := is.uploadParts(repo, uuid)
+
+	return size, err
+}
+
+// PutBlobChunkStreamed appends another chunk of data to the specified blob. It returns
+// the number of actual bytes to the blob.
+func (is *ImageStoreDriver) PutBlobChunkStreamed(repo string, uuid string, body io.Reader) (int64, error) {
+	_, size, err := is.uploadParts(repo, uuid)
+	if err != nil {
+		return -1, err
+	}
+
+	return is.putPart(is.partKey(repo, uuid, size), body)
+}
+
+// PutBlobChunk writes another chunk of data to the specified blob. It returns
+// the number of actual bytes to the blob.
+func (is *ImageStoreDriver) PutBlobChunk(repo string, uuid string, from int64, to int64,
+	body io.Reader) (int64, error) {
+	_, size, err := is.uploadParts(repo, uuid)
+	if err != nil {
+		return -1, err
+	}
+
+	if from != size {
+		is.log.Error().Int64("expected", from).Int64("actual", size).
+			Msg("invalid range start for blob upload")
+		return -1, errors.ErrBadUploadRange
+	}
+
+	return is.putPart(is.partKey(repo, uuid, from), body)
+}
+
+// putPart writes a chunk of an upload.
+func (is *ImageStoreDriver) putPart(p string, body io.Reader) (int64, error) {
+	w, err := is.driver.Writer(p)
+	if err != nil {
+		is.log.Error().Err(err).Str("part", p).Msg("unable to write chunk")
+		return -1, err
+	}
+
+	n, err := is.copyBuffers.Copy(w, body)
+	if err != nil {
+		_ = w.Cancel()
+		return -1, err
+	}
+
+	if err := w.Close(); err != nil {
+		is.log.Error().Err(err).Str("part", p).Msg("unable to write chunk")
+		return -1, err
+	}
+
+	return n, nil
+}
+
+// BlobUploadInfo returns the current blob size in bytes.
+func (is *ImageStoreDriver) BlobUploadInfo(repo string, uuid string) (int64, error) {
+	return is.GetBlobUpload(repo, uuid)
+}
+
+// FinishBlobUpload finalizes the blob upload and moves blob the repository.
+func (is *ImageStoreDriver) FinishBlobUpload(repo string, uuid string, body io.Reader, digest string) error {
+	dstDigest, err := godigest.Parse(digest)
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to parse digest")
+		return errors.ErrBadBlobDigest
+	}
+
+	parts, _, err := is.uploadParts(repo, uuid)
+	if err != nil {
+		is.log.Error().Err(err).Str("uuid", uuid).Msg("failed to look up blob upload")
+		return errors.ErrUploadNotFound
+	}
+
+	if _, err := is.putBlob(repo, dstDigest, is.partsReader(parts)); err != nil {
+		return err
+	}
+
+	if err := is.driver.Delete(is.uploadKey(repo, uuid)); err != nil {
+		is.log.Warn().Err(err).Str("uuid", uuid).Msg("unable to remove finished blob upload")
+	}
+
+	return nil
+}
+
+// putBlob writes a blob, digested as it's written, which is only kept if it matches, and
+// which garbage collection mustn't sweep meanwhile.
+func (is *ImageStoreDriver) putBlob(repo string, digest godigest.Digest, body io.Reader) (int64, error) {
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+
+	p := is.blobKey(repo, digest)
+
+	w, err := is.driver.Writer(p)
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest.String()).Msg("unable to write blob")
+		return -1, err
+	}
+
+	digester := digest.Algorithm().Digester()
+
+	n, err := is.copyBuffers.Copy(io.MultiWriter(w, digester.Hash()), body)
+	if err != nil {
+		_ = w.Cancel()
+
+		is.log.Error().Err(err).Str("digest", digest.String()).Msg("unable to write blob")
+
+		return -1, err
+	}
+
+	if srcDigest := digester.Digest(); srcDigest != digest {
+		_ = w.Cancel()
+
+		is.log.Error().Str("srcDigest", srcDigest.String()).
+			Str("dstDigest", digest.String()).Msg("actual digest not equal to expected digest")
+
+		return -1, errors.ErrBadBlobDigest
+	}
+
+	if err := w.Close(); err != nil {
+		is.log.Error().Err(err).Str("digest", digest.String()).Msg("unable to finish blob")
+		return -1, err
+	}
+
+	return n, nil
+}
+
+// partsReader reads the parts of an upload one after the other, each opened once the
+// previous one is read.
+func (is *ImageStoreDriver) partsReader(parts []FileInfo) io.Reader {
+	readers := make([]io.Reader, 0, len(parts))
+
+	for _, p := range parts {
+		readers = append(readers, &lazyReader{driver: is.driver, path: p.Path})
+	}
+
+	return io.MultiReader(readers...)
+}
+
+type lazyReader struct {
+	driver StorageDriver
+	path   string
+	r      io.ReadCloser
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if l.r == nil {
+		r, err := l.driver.Reader(l.path, 0)
+		if err != nil {
+			return 0, err
+		}
+
+		l.r = r
+	}
+
+	n, err := l.r.Read(p)
+	if err == io.EOF {
+		l.r.Close()
+	}
+
+	return n, err
+}
+
+// FullBlobUpload handles a full blob upload, and no partial session is created.
+func (is *ImageStoreDriver) FullBlobUpload(repo string, body io.Reader, digest string) (string, int64, error) {
+	if err := is.InitRepo(repo); err != nil {
+		return "", -1, err
+	}
+
+	dstDigest, err := godigest.Parse(digest)
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to parse digest")
+		return "", -1, errors.ErrBadBlobDigest
+	}
+
+	u, err := guuid.NewV4()
+	if err != nil {
+		return "", -1, err
+	}
+
+	n, err := is.putBlob(repo, dstDigest, body)
+	if err != nil {
+		return "", -1, err
+	}
+
+	return u.String(), n, nil
+}
+
+// MountBlob returns false, for the blob to be uploaded, as blobs aren't deduped by drivers.
+func (is *ImageStoreDriver) MountBlob(repo string, digest string) (bool, int64, error) {
+	if _, err := godigest.Parse(digest); err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to parse digest")
+		return false, -1, errors.ErrBadBlobDigest
+	}
+
+	return false, -1, nil
+}
+
+// DeleteBlobUpload deletes an existing blob upload that is currently in progress.
+func (is *ImageStoreDriver) DeleteBlobUpload(repo string, uuid string) error {
+	if _, _, err := is.uploadParts(repo, uuid); err != nil {
+		is.log.Error().Err(err).Str("uuid", uuid).Msg("error deleting blob upload")
+		return err
+	}
+
+	if err := is.driver.Delete(is.uploadKey(repo, uuid)); err != nil {
+		is.log.Error().Err(err).Str("uuid", uuid).Msg("error deleting blob upload")
+		return err
+	}
+
+	return nil
+}
+
+// CheckBlob verifies a blob and returns true if the blob is correct.
+func (is *ImageStoreDriver) CheckBlob(repo string, digest string,
+	mediaType string) (bool, int64, error) {
+	d, err := godigest.Parse(digest)
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to parse digest")
+		return false, -1, errors.ErrBadBlobDigest
+	}
+
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+
+	fi, err := is.driver.Stat(is.blobKey(repo, d))
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to stat blob")
+		return false, -1, errors.ErrBlobNotFound
+	}
+
+	return true, fi.Size, nil
+}
+
+// GetBlob returns a stream to read the blob, to be closed once read.
+func (is *ImageStoreDriver) GetBlob(repo string, digest string, mediaType string) (io.Reader, int64, error) {
+	d, err := godigest.Parse(digest)
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to parse digest")
+		return nil, -1, errors.ErrBadBlobDigest
+	}
+
+	p := is.blobKey(repo, d)
+
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+
+	fi, err := is.driver.Stat(p)
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to stat blob")
+		return nil, -1, errors.ErrBlobNotFound
+	}
+
+	r, err := is.driver.Reader(p, 0)
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to open blob")
+
+		if err == errors.ErrPathNotFound { // nolint:goerr113
+			return nil, -1, errors.ErrBlobNotFound
+		}
+
+		return nil, -1, err
+	}
+
+	return r, fi.Size, nil
+}
+
+// GetBlobPartial returns a stream to read a range of a blob, from and to included, to being
+// -1 for its end, along with the length of the range and the size of the blob, reading only
+// that range from the driver.
+func (is *ImageStoreDriver) GetBlobPartial(repo string, digest string, mediaType string, from int64,
+	to int64) (io.Reader, int64, int64, error) {
+	d, err := godigest.Parse(digest)
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to parse digest")
+		return nil, -1, -1, errors.ErrBadBlobDigest
+	}
+
+	p := is.blobKey(repo, d)
+
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+
+	fi, err := is.driver.Stat(p)
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to stat blob")
+		return nil, -1, -1, errors.ErrBlobNotFound
+	}
+
+	length, err := blobRange(from, to, fi.Size)
+	if err != nil {
+		return nil, -1, fi.Size, err
+	}
+
+	r, err := is.driver.Reader(p, from)
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to open blob")
+
+		if err == errors.ErrPathNotFound { // nolint:goerr113
+			return nil, -1, -1, errors.ErrBlobNotFound
+		}
+
+		return nil, -1, -1, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(r, length), r}, length, fi.Size, nil
+}
+
+// DeleteBlob removes the blob from the repository.
+func (is *ImageStoreDriver) DeleteBlob(repo string, digest string) error {
+	d, err := godigest.Parse(digest)
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to parse digest")
+		return errors.ErrBlobNotFound
+	}
+
+	p := is.blobKey(repo, d)
+
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	if _, err := is.driver.Stat(p); err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to stat blob")
+		return errors.ErrBlobNotFound
+	}
+
+	if err := is.driver.Delete(p); err != nil {
+		is.log.Error().Err(err).Str("blob", p).Msg("unable to remove blob")
+		return err
+	}
+
+	return nil
+}
+
+// garbageCollect removes the blobs of a repository which are no longer referenced, unless
+// written less than gcDelay ago, as blobs are pushed before the manifests referencing them,
+// in batches within the delete rate, if set.
+func (is *ImageStoreDriver) garbageCollect(repo string) error {
+	batch := is.gcs.deleteBatch()
+
+	for {
+		if !is.gcs.waitDeletes(batch) {
+			return nil
+		}
+
+		n, err := is.sweepGarbage(repo, batch)
+		if err != nil || batch == 0 || n < batch {
+			return err
+		}
+	}
+}
+
+// sweepGarbage removes up to limit blobs of a repository which are no longer referenced, all of
+// them if limit is 0, returning how many were. Unlike on a filesystem, the index can't be told
+// to have changed without being read again, so the store is locked throughout.
+func (is *ImageStoreDriver) sweepGarbage(repo string, limit int) (int, error) {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	index, err := is.readIndex(repo)
+	if err != nil {
+		return 0, err
+	}
+
+	referenced := map[godigest.Digest]bool{}
+
+	for _, desc := range index.Manifests {
+		if err := is.markReferenced(repo, desc.Digest, referenced); err != nil {
+			return 0, err
+		}
+	}
+
+	garbage := []FileInfo{}
+
+	if err := is.driver.Walk(is.key(repo, "blobs"), func(fi FileInfo) error {
+		digest := godigest.NewDigestFromEncoded(godigest.Algorithm(path.Base(path.Dir(fi.Path))), path.Base(fi.Path))
+		if digest.Validate() == nil && !referenced[digest] && fi.ModTime.Add(gcDelay).Before(time.Now()) {
+			garbage = append(garbage, fi)
+		}
+
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	if limit > 0 && len(garbage) > limit {
+		garbage = garbage[:limit]
+	}
+
+	for i, fi := range garbage {
+		is.log.Info().Str("blob", fi.Path).Msg("perform GC on blob")
+
+		if err := is.driver.Delete(fi.Path); err != nil {
+			is.log.Error().Err(err).Str("blob", fi.Path).Msg("unable to remove blob")
+			return i, err
+		}
+	}
+
+	return len(garbage), nil
+}
+
+// markReferenced marks a manifest, or index, as referenced, along with what it references.
+func (is *ImageStoreDriver) markReferenced(repo string, digest godigest.Digest,
+	referenced map[godigest.Digest]bool) error {
+	if referenced[digest] {
+		return nil
+	}
+
+	referenced[digest] = true
+
+	buf, err := is.readFile(is.blobKey(repo, digest))
+	if err != nil {
+		if err == errors.ErrPathNotFound { // nolint:goerr113
+			return nil
+		}
+
+		return err
+	}
+
+	var refs struct {
+		Config    *ispec.Descriptor  `json:"config"`
+		Layers    []ispec.Descriptor `json:"layers"`
+		Manifests []ispec.Descriptor `json:"manifests"`
+	}
+
+	if err := json.Unmarshal(buf, &refs); err != nil {
+		return nil
+	}
+
+	if refs.Config != nil {
+		referenced[refs.Config.Digest] = true
+	}
+
+	for _, l := range refs.Layers {
+		referenced[l.Digest] = true
+	}
+
+	for _, m := range refs.Manifests {
+		if err := is.markReferenced(repo, m.Digest, referenced); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,22 @@
+// +build linux
+
+package storage
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fadviseSupported is false on platforms without posix_fadvise.
+const fadviseSupported = true
+
+// dropFileCache writes a file to disk and has its pages dropped from the page cache, which
+// only drops clean ones.
+func dropFileCache(file *os.File) error {
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	return unix.Fadvise(int(file.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
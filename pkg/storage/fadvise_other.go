@@ -0,0 +1,14 @@
+// +build !linux
+
+package storage
+
+import (
+	"os"
+)
+
+// fadviseSupported is false on platforms without posix_fadvise.
+const fadviseSupported = false
+
+func dropFileCache(file *os.File) error {
+	return nil
+}
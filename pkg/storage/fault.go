@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Fault is a failure the storage layer can be made to go through deterministically, in builds
+// with the faultinject tag, to test how it copes, e.g. that it's left consistent.
+type Fault int
+
+const (
+	// FaultNoSpace fails writes to blob uploads and repository indexes with ENOSPC.
+	FaultNoSpace Fault = iota
+	// FaultSlowIO delays those writes, and renames, by SlowIODelay.
+	FaultSlowIO
+	// FaultRename fails renames, e.g. of finished uploads to their blobs.
+	FaultRename
+	// FaultCacheMiss has dedupe cache lookups miss.
+	FaultCacheMiss
+)
+
+// slowDown delays I/O, if so injected.
+func slowDown() {
+	if faulty(FaultSlowIO) {
+		time.Sleep(slowIODelay())
+	}
+}
+
+// rename is os.Rename, going through the faults injected.
+func rename(src string, dst string) error {
+	if faulty(FaultRename) {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EIO}
+	}
+
+	slowDown()
+
+	return os.Rename(src, dst)
+}
+
+// faultyWriter goes through the faults injected before each write.
+type faultyWriter struct {
+	io.Writer
+}
+
+func (w faultyWriter) Write(p []byte) (int, error) {
+	if faulty(FaultNoSpace) {
+		return 0, syscall.ENOSPC
+	}
+
+	slowDown()
+
+	return w.Writer.Write(p)
+}
+
+// faultyWrites returns w, going through the faults injected, if any can be.
+func faultyWrites(w io.Writer) io.Writer {
+	if !faultInjection {
+		return w
+	}
+
+	return faultyWriter{w}
+}
+
+// writeFile is ioutil.WriteFile, going through the faults injected.
+func writeFile(path string, buf []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := faultyWrites(f).Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,75 @@
+// +build faultinject
+
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// faultInjection is true in builds with the faultinject tag, where faults can be injected.
+const faultInjection = true
+
+// nolint: gochecknoglobals
+var faults = struct {
+	lock  sync.Mutex
+	times map[Fault]int // left to happen, forever if negative
+	delay time.Duration
+}{times: map[Fault]int{}, delay: 100 * time.Millisecond}
+
+// InjectFault has the storage layer go through fault the next times it could, or always if
+// times is negative, until ClearFaults, process-wide.
+func InjectFault(fault Fault, times int) {
+	faults.lock.Lock()
+	defer faults.lock.Unlock()
+
+	if times == 0 {
+		delete(faults.times, fault)
+		return
+	}
+
+	faults.times[fault] = times
+}
+
+// SetSlowIODelay sets how long FaultSlowIO delays I/O by.
+func SetSlowIODelay(delay time.Duration) {
+	faults.lock.Lock()
+	defer faults.lock.Unlock()
+
+	faults.delay = delay
+}
+
+// ClearFaults has the storage layer go through no more faults.
+func ClearFaults() {
+	faults.lock.Lock()
+	defer faults.lock.Unlock()
+
+	faults.times = map[Fault]int{}
+}
+
+// faulty reports whether fault is to happen now, counting it.
+func faulty(fault Fault) bool {
+	faults.lock.Lock()
+	defer faults.lock.Unlock()
+
+	n, ok := faults.times[fault]
+	if !ok {
+		return false
+	}
+
+	switch {
+	case n == 1:
+		delete(faults.times, fault)
+	case n > 1:
+		faults.times[fault] = n - 1
+	}
+
+	return true
+}
+
+func slowIODelay() time.Duration {
+	faults.lock.Lock()
+	defer faults.lock.Unlock()
+
+	return faults.delay
+}
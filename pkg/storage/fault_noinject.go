@@ -0,0 +1,16 @@
+// +build !faultinject
+
+package storage
+
+import "time"
+
+// faultInjection is false, no faults being injected but in builds with the faultinject tag.
+const faultInjection = false
+
+func faulty(Fault) bool {
+	return false
+}
+
+func slowIODelay() time.Duration {
+	return 0
+}
@@ -0,0 +1,118 @@
+// +build faultinject
+
+package storage_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFaults(t *testing.T) {
+	Convey("Go through injected faults", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		defer storage.ClearFaults()
+
+		is := storage.NewImageStore(dir, false, true, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
+		defer is.Close()
+
+		body := []byte("this is a blob")
+		digest := godigest.FromBytes(body)
+
+		Convey("Out of space", func() {
+			storage.InjectFault(storage.FaultNoSpace, 1)
+
+			_, _, err := is.FullBlobUpload("repo", bytes.NewReader(body), digest.String())
+			So(errors.Is(err, syscall.ENOSPC), ShouldBeTrue)
+
+			ok, _, _ := is.CheckBlob("repo", digest.String(), "")
+			So(ok, ShouldBeFalse)
+
+			// once
+			_, _, err = is.FullBlobUpload("repo", bytes.NewReader(body), digest.String())
+			So(err, ShouldBeNil)
+
+			// the index of a repository is left as it was
+			img, err := test.GetRandomImage(15, 1)
+			So(err, ShouldBeNil)
+			So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+			other, err := test.GetRandomImage(15, 1)
+			So(err, ShouldBeNil)
+			storage.InjectFault(storage.FaultNoSpace, -1)
+			So(test.WriteImageToStore(other, is, "repo", "2.0"), ShouldNotBeNil)
+			storage.ClearFaults()
+
+			tags, err := is.GetImageTags("repo")
+			So(err, ShouldBeNil)
+			So(tags, ShouldResemble, []string{"1.0"})
+
+			d, err := img.Digest()
+			So(err, ShouldBeNil)
+			_, mdigest, _, err := is.GetImageManifest("repo", "1.0")
+			So(err, ShouldBeNil)
+			So(mdigest, ShouldEqual, d.String())
+		})
+
+		Convey("Rename failures", func() {
+			u, err := is.NewBlobUpload("repo")
+			So(err, ShouldBeNil)
+			_, err = is.PutBlobChunkStreamed("repo", u, bytes.NewReader(body))
+			So(err, ShouldBeNil)
+
+			storage.InjectFault(storage.FaultRename, -1)
+			So(is.FinishBlobUpload("repo", u, bytes.NewReader([]byte{}), digest.String()), ShouldNotBeNil)
+			storage.ClearFaults()
+
+			ok, _, _ := is.CheckBlob("repo", digest.String(), "")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Cache misses", func() {
+			_, _, err := is.FullBlobUpload("repo1", bytes.NewReader(body), digest.String())
+			So(err, ShouldBeNil)
+
+			// not deduped, but copied
+			storage.InjectFault(storage.FaultCacheMiss, -1)
+			_, _, err = is.FullBlobUpload("repo2", bytes.NewReader(body), digest.String())
+			So(err, ShouldBeNil)
+			storage.ClearFaults()
+
+			fi1, err := os.Stat(is.BlobPath("repo1", digest))
+			So(err, ShouldBeNil)
+			fi2, err := os.Stat(is.BlobPath("repo2", digest))
+			So(err, ShouldBeNil)
+			So(os.SameFile(fi1, fi2), ShouldBeFalse)
+
+			_, _, err = is.FullBlobUpload("repo3", bytes.NewReader(body), digest.String())
+			So(err, ShouldBeNil)
+			fi3, err := os.Stat(is.BlobPath("repo3", digest))
+			So(err, ShouldBeNil)
+			So(os.SameFile(fi1, fi3) || os.SameFile(fi2, fi3), ShouldBeTrue)
+		})
+
+		Convey("Slow IO", func() {
+			storage.SetSlowIODelay(50 * time.Millisecond)
+			defer storage.SetSlowIODelay(100 * time.Millisecond)
+			storage.InjectFault(storage.FaultSlowIO, 2)
+
+			start := time.Now()
+			_, _, err := is.FullBlobUpload("repo", bytes.NewReader(body), digest.String())
+			So(err, ShouldBeNil)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 100*time.Millisecond)
+		})
+	})
+}
@@ -0,0 +1,179 @@
+// +build !windows
+
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+)
+
+// gcSupported is false on platforms where umoci, used to garbage-collect, doesn't build.
+const gcSupported = true
+
+// gcAttempts bounds how many times garbage is marked again, as the index changed meanwhile,
+// before it's left to the next collection.
+const gcAttempts = 3
+
+// for the blobs of Docker images, and the manifests of Docker lists, not to be collected, as
+// only those referenced by the media types umoci knows are walked.
+func init() { //nolint: gochecknoinits
+	mediatype.RegisterTarget(MediaTypeDockerManifest)
+	mediatype.RegisterParser(MediaTypeDockerManifest, mediatype.CustomJSONParser(ispec.Manifest{}))
+	mediatype.RegisterParser(MediaTypeDockerManifestList, mediatype.CustomJSONParser(ispec.Index{}))
+}
+
+// garbageCollect removes blobs in the repository at dir which are no longer referenced. They're
+// marked without locking the repository, from the index as it is then, which is only locked to
+// remove them, if the index didn't change since, so that reads and writes go on meanwhile.
+func (is *ImageStoreLocal) garbageCollect(dir string, repo string) error {
+	file := filepath.Join(dir, "index.json")
+
+	for attempt := 1; attempt <= gcAttempts; attempt++ {
+		index, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+
+		garbage, err := is.markGarbage(dir, repo)
+		if err != nil {
+			// e.g. a manifest deleted since the index was read, unless it didn't change
+			if fi, serr := os.Stat(file); serr == nil && !sameFile(index, fi) {
+				continue
+			}
+
+			return err
+		}
+
+		// in batches within the delete rate, if set, the repository being unlocked in between
+		batch := is.gcs.deleteBatch()
+		if batch == 0 {
+			batch = len(garbage)
+		}
+
+		for len(garbage) > 0 {
+			n := batch
+			if n > len(garbage) {
+				n = len(garbage)
+			}
+
+			if !is.gcs.waitDeletes(n) {
+				return nil
+			}
+
+			swept, err := is.sweepGarbage(file, repo, index, garbage[:n])
+			if err != nil {
+				return err
+			}
+
+			if !swept {
+				break
+			}
+
+			garbage = garbage[n:]
+		}
+
+		if len(garbage) == 0 {
+			return nil
+		}
+	}
+
+	is.log.Info().Str("repo", repo).Msg("index changed while collecting garbage, leaving it to the next collection")
+
+	return nil
+}
+
+// markGarbage returns the blobs of the repository at dir which aren't referenced, and may be
+// removed.
+func (is *ImageStoreLocal) markGarbage(dir string, repo string) ([]godigest.Digest, error) {
+	oci, err := umoci.OpenLayout(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer oci.Close()
+
+	garbage := []godigest.Digest{}
+
+	// only marked, as it's removed once the repository is locked
+	mark := func(ctx context.Context, digest godigest.Digest) (bool, error) {
+		// e.g. temporary files
+		if digest.Validate() == nil {
+			garbage = append(garbage, digest)
+		}
+
+		return false, nil
+	}
+
+	if err := oci.GC(context.Background(), ifOlderThan(is, repo, gcDelay), mark); err != nil {
+		return nil, err
+	}
+
+	return garbage, nil
+}
+
+// sweepGarbage removes the garbage marked in a repository, if its index, at file, is still as
+// it was then, returning whether it was.
+func (is *ImageStoreLocal) sweepGarbage(file string, repo string, index os.FileInfo,
+	garbage []godigest.Digest) (bool, error) {
+	is.LockRepo(repo)
+	defer is.UnlockRepo(repo)
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		return false, err
+	}
+
+	if !sameFile(index, fi) {
+		return false, nil
+	}
+
+	for _, digest := range garbage {
+		blobPath := is.BlobPath(repo, digest)
+		is.log.Info().Str("digest", digest.String()).Str("blobPath", blobPath).Msg("perform GC on blob")
+
+		if err := os.Remove(blobPath); err != nil && !os.IsNotExist(err) {
+			is.log.Error().Err(err).Str("blobPath", blobPath).Msg("unable to remove blob path")
+			return true, err
+		}
+
+		is.blobSizes.forget(blobPath)
+
+		if is.cache != nil {
+			if err := is.cache.DeleteBlob(digest.String(), blobPath); err != nil && err != errors.ErrCacheMiss {
+				is.log.Error().Err(err).Str("blobPath", blobPath).Msg("unable to remove blob path from cache")
+			}
+		}
+	}
+
+	return true, nil
+}
+
+func ifOlderThan(is *ImageStoreLocal, repo string, delay time.Duration) casext.GCPolicy {
+	return func(ctx context.Context, digest godigest.Digest) (bool, error) {
+		blobPath := is.BlobPath(repo, digest)
+		fi, err := os.Stat(blobPath)
+
+		if os.IsNotExist(err) {
+			// e.g. a temporary file, renamed since listed
+			return false, nil
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		if fi.ModTime().Add(delay).After(time.Now()) {
+			return false, nil
+		}
+
+		return true, nil
+	}
+}
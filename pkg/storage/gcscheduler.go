@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// garbage collections of repositories run, and failed, process-wide.
+// nolint: gochecknoglobals
+var gcRuns, gcFailures int64
+
+// GCRuns returns how many garbage collections of repositories ran since the process started,
+// and how many of those failed, e.g. for metrics.
+func GCRuns() (int64, int64) {
+	return atomic.LoadInt64(&gcRuns), atomic.LoadInt64(&gcFailures)
+}
+
+// gcScheduler collects garbage in the background, in the repositories queued once written to,
+// so that pushes and deletes don't wait for it. A repository is collected interval after it was
+// queued, however many times it's queued meanwhile, and up to parallel repositories are collected
+// at once, one at a time by default. Blobs are removed within the delete rate, if set, across
+// repositories, not to slow down pulls.
+type gcScheduler struct {
+	lock       sync.Mutex
+	interval   time.Duration
+	parallel   int
+	deleteRate int                  // blobs removed per second, at most, if set
+	nextDelete time.Time            // when blobs may be removed next, within the delete rate
+	queued     map[string]time.Time // by repository, when first queued
+	claimed    map[string]bool      // repositories waited for, or being collected
+	running    int                  // collecting goroutines
+	stop       chan struct{}
+	stopped    bool
+	wg         sync.WaitGroup // tracks the collecting goroutines
+	collect    func(repo string) error
+	log        zerolog.Logger
+}
+
+func newGCScheduler(collect func(repo string) error, log zerolog.Logger) *gcScheduler {
+	return &gcScheduler{parallel: 1, queued: make(map[string]time.Time), claimed: make(map[string]bool),
+		stop: make(chan struct{}), collect: collect, log: log}
+}
+
+// setInterval sets how long after being queued repositories are collected, e.g. for pushes of
+// several images to a repository to be collected at once.
+func (s *gcScheduler) setInterval(interval time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.interval = interval
+}
+
+// setParallel sets how many repositories are collected at once, one if not set.
+func (s *gcScheduler) setParallel(parallel int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	s.parallel = parallel
+}
+
+// setDeleteRate sets how many blobs are removed per second at most, in all the repositories
+// collected, unlimited if not set.
+func (s *gcScheduler) setDeleteRate(rate int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.deleteRate = rate
+}
+
+// deleteBatch returns how many blobs are removed at most after waiting for them, all at once if
+// the delete rate isn't set.
+func (s *gcScheduler) deleteBatch() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.deleteRate
+}
+
+// waitDeletes waits until n blobs may be removed within the delete rate, those removed before
+// having been spread out over time, returning false if stopped meanwhile.
+func (s *gcScheduler) waitDeletes(n int) bool {
+	s.lock.Lock()
+
+	if s.deleteRate <= 0 {
+		s.lock.Unlock()
+		return true
+	}
+
+	at := s.nextDelete
+	if now := time.Now(); at.Before(now) {
+		at = now
+	}
+
+	s.nextDelete = at.Add(time.Duration(n) * time.Second / time.Duration(s.deleteRate))
+	s.lock.Unlock()
+
+	select {
+	case <-time.After(time.Until(at)):
+		return true
+	case <-s.stop:
+		return false
+	}
+}
+
+// queue has garbage collected in a repository, starting collecting if not already, or in
+// parallel with the other repositories being collected.
+func (s *gcScheduler) queue(repo string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stopped {
+		return
+	}
+
+	if _, ok := s.queued[repo]; !ok {
+		s.queued[repo] = time.Now()
+	}
+
+	if s.running < s.parallel && s.unclaimed() > 0 {
+		s.running++
+
+		s.wg.Add(1)
+
+		go s.run()
+	}
+}
+
+// unclaimed returns how many of the repositories queued no goroutine is waiting for or
+// collecting, with the lock held.
+func (s *gcScheduler) unclaimed() int {
+	n := 0
+
+	for repo := range s.queued {
+		if !s.claimed[repo] {
+			n++
+		}
+	}
+
+	return n
+}
+
+// run collects the repositories queued, the earliest first, until none is left to it.
+func (s *gcScheduler) run() {
+	defer s.wg.Done()
+
+	for {
+		repo, wait, ok := s.next()
+		if !ok {
+			return
+		}
+
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-s.stop:
+				return
+			}
+		}
+
+		s.lock.Lock()
+		// queued again once written to while collected
+		delete(s.queued, repo)
+		s.lock.Unlock()
+
+		atomic.AddInt64(&gcRuns, 1)
+
+		if err := s.collect(repo); err != nil {
+			atomic.AddInt64(&gcFailures, 1)
+			s.log.Error().Err(err).Str("repo", repo).Msg("unable to collect garbage")
+		}
+
+		s.lock.Lock()
+		delete(s.claimed, repo)
+		s.lock.Unlock()
+	}
+}
+
+// next claims the repository queued the earliest which isn't claimed yet, and returns how long
+// until it's due, or false, no longer running, if none is.
+func (s *gcScheduler) next() (string, time.Duration, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var repo string
+
+	var earliest time.Time
+
+	for r, t := range s.queued {
+		if !s.claimed[r] && (repo == "" || t.Before(earliest)) {
+			repo, earliest = r, t
+		}
+	}
+
+	if repo == "" || s.stopped {
+		s.running--
+		return "", 0, false
+	}
+
+	s.claimed[repo] = true
+
+	return repo, time.Until(earliest.Add(s.interval)), true
+}
+
+// close stops collecting, once done with the repositories being collected, if any, leaving
+// those queued uncollected.
+func (s *gcScheduler) close() {
+	s.lock.Lock()
+
+	if !s.stopped {
+		s.stopped = true
+		close(s.stop)
+	}
+
+	s.lock.Unlock()
+
+	s.wg.Wait()
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"io"
+	"os"
+
+	"github.com/anuvu/zot/errors"
+)
+
+// readinessKey is a file of storage drivers stat'ed to tell whether they're reachable, whether it
+// exists or not.
+const readinessKey = ".zot-readiness"
+
+// Ready returns an error if the storage of a store can't be accessed, e.g. its root directory is
+// gone or unreadable, or the bucket of its driver unreachable. Stores over others, e.g. proxies,
+// are assumed ready.
+func Ready(is ImageStore) error {
+	switch s := is.(type) {
+	case *ImageStoreLocal:
+		for _, dir := range []string{s.rootDir, s.uploadDir} {
+			if dir == "" {
+				continue
+			}
+
+			if err := dirReadable(dir); err != nil {
+				return err
+			}
+		}
+	case *ImageStoreDriver:
+		if _, err := s.driver.Stat(readinessKey); err != nil && err != errors.ErrPathNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func dirReadable(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return errors.ErrStorageNotReady
+	}
+
+	// a directory which can't be listed can't be served from
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
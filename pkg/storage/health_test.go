@@ -0,0 +1,42 @@
+package storage_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReady(t *testing.T) {
+	Convey("Tell whether the storage of a store can be accessed", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.NewLogger("debug", "")
+
+		is := storage.NewImageStore(path.Join(dir, "root"), false, false, storage.Options{}, log)
+		So(is, ShouldNotBeNil)
+		So(storage.Ready(is), ShouldBeNil)
+
+		So(is.SetUploadDir(path.Join(dir, "uploads")), ShouldBeNil)
+		So(storage.Ready(is), ShouldBeNil)
+
+		So(os.RemoveAll(path.Join(dir, "uploads")), ShouldBeNil)
+		So(storage.Ready(is), ShouldNotBeNil)
+
+		So(os.RemoveAll(path.Join(dir, "root")), ShouldBeNil)
+		So(ioutil.WriteFile(path.Join(dir, "root"), []byte("not a directory"), 0600), ShouldBeNil)
+		So(storage.Ready(is), ShouldNotBeNil)
+
+		driver, err := storage.NewDriver(storage.FilesystemDriverName, map[string]interface{}{"rootdirectory": dir})
+		So(err, ShouldBeNil)
+		So(storage.Ready(storage.NewImageStoreDriver(driver, false, storage.Options{}, log)), ShouldBeNil)
+
+		So(storage.Ready(storage.NewImageStoreMem(log)), ShouldBeNil)
+	})
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"encoding/json"
+	"path"
+	"regexp"
+	"sync"
+
+	"github.com/anuvu/zot/errors"
+	zlog "github.com/anuvu/zot/pkg/log"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ImmutableTagsConfig selects tags which, once pushed, can't be moved to other content or
+// deleted, e.g. releases.
+type ImmutableTagsConfig struct {
+	Repositories []string // glob patterns matching repository names, all if empty
+	Tags         []string // regexes
+}
+
+// Validate checks the repository patterns and tag regexes are well-formed.
+func (c ImmutableTagsConfig) Validate(log zlog.Logger) error {
+	for _, r := range c.Repositories {
+		if _, err := path.Match(r, ""); err != nil {
+			log.Error().Err(err).Str("repositories", r).Msg("invalid immutable repositories pattern")
+			return errors.ErrBadConfig
+		}
+	}
+
+	for _, t := range c.Tags {
+		if _, err := regexp.Compile(t); err != nil {
+			log.Error().Err(err).Str("tags", t).Msg("invalid immutable tags regex")
+			return errors.ErrBadConfig
+		}
+	}
+
+	return nil
+}
+
+type immutableTags struct {
+	repositories []string
+	tags         []*regexp.Regexp
+}
+
+// ImmutableImageStore refuses to retag, untag or delete the images of the wrapped store
+// tagged with an immutable tag. Pushing the same content again under such a tag succeeds.
+type ImmutableImageStore struct {
+	ImageStore
+	rules []immutableTags
+	log   zlog.Logger
+
+	lock sync.Mutex // serializes checking a tag and then updating it
+}
+
+// NewImmutableImageStore returns a store protecting the tags selected by config in is.
+// The config must be valid.
+func NewImmutableImageStore(is ImageStore, config []ImmutableTagsConfig, log zlog.Logger) *ImmutableImageStore {
+	rules := make([]immutableTags, 0, len(config))
+
+	for _, c := range config {
+		rule := immutableTags{repositories: c.Repositories}
+		for _, t := range c.Tags {
+			rule.tags = append(rule.tags, regexp.MustCompile(t))
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return &ImmutableImageStore{ImageStore: is, rules: rules, log: log}
+}
+
+// IsImmutable reports whether tag is immutable in repo.
+func (is *ImmutableImageStore) IsImmutable(repo string, tag string) bool {
+	for _, rule := range is.rules {
+		if !rule.matchesRepo(repo) {
+			continue
+		}
+
+		for _, t := range rule.tags {
+			if t.MatchString(tag) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (r immutableTags) matchesRepo(repo string) bool {
+	if len(r.repositories) == 0 {
+		return true
+	}
+
+	for _, pattern := range r.repositories {
+		if ok, _ := path.Match(pattern, repo); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PutImageManifest adds an image manifest to the repository, unless the reference is an
+// immutable tag of other content.
+func (is *ImmutableImageStore) PutImageManifest(repo string, reference string, mediaType string,
+	body []byte) (string, error) {
+	if _, err := godigest.Parse(reference); err == nil || !is.IsImmutable(repo, reference) {
+		return is.ImageStore.PutImageManifest(repo, reference, mediaType, body)
+	}
+
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	_, digest, _, err := is.ImageStore.GetImageManifest(repo, reference)
+	if err == nil && digest != godigest.FromBytes(body).String() {
+		is.log.Error().Str("repo", repo).Str("tag", reference).Str("digest", digest).
+			Msg("refusing to overwrite immutable tag")
+
+		return "", errors.ErrTagImmutable
+	}
+
+	return is.ImageStore.PutImageManifest(repo, reference, mediaType, body)
+}
+
+// DeleteImageManifest deletes the image manifest from the repository, unless it has an
+// immutable tag.
+func (is *ImmutableImageStore) DeleteImageManifest(repo string, reference string) error {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	buf, err := is.ImageStore.GetIndexContent(repo)
+	if err != nil {
+		return err
+	}
+
+	var index ispec.Index
+	if err := json.Unmarshal(buf, &index); err != nil {
+		return err
+	}
+
+	for _, m := range index.Manifests {
+		tag, ok := m.Annotations[ispec.AnnotationRefName]
+		if ok && m.Digest.String() == reference && is.IsImmutable(repo, tag) {
+			is.log.Error().Str("repo", repo).Str("tag", tag).Str("digest", reference).
+				Msg("refusing to delete image with immutable tag")
+
+			return errors.ErrTagImmutable
+		}
+	}
+
+	return is.ImageStore.DeleteImageManifest(repo, reference)
+}
+
+// DeleteImageTag removes a tag from the repository, unless it's immutable.
+func (is *ImmutableImageStore) DeleteImageTag(repo string, tag string) error {
+	if is.IsImmutable(repo, tag) {
+		is.log.Error().Str("repo", repo).Str("tag", tag).Msg("refusing to delete immutable tag")
+		return errors.ErrTagImmutable
+	}
+
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	return is.ImageStore.DeleteImageTag(repo, tag)
+}
@@ -0,0 +1,81 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestImmutableTags(t *testing.T) {
+	Convey("Protect immutable tags", t, func() {
+		log := log.NewLogger("debug", "")
+
+		config := []storage.ImmutableTagsConfig{
+			{Repositories: []string{"releases/*"}, Tags: []string{`^v\d+\.\d+\.\d+$`}},
+			{Tags: []string{`^stable$`}},
+		}
+		for _, c := range config {
+			So(c.Validate(log), ShouldBeNil)
+		}
+
+		is := storage.NewImmutableImageStore(storage.NewImageStoreMem(log), config, log)
+
+		So(is.IsImmutable("releases/app", "v1.0.0"), ShouldBeTrue)
+		So(is.IsImmutable("releases/app", "latest"), ShouldBeFalse)
+		So(is.IsImmutable("dev/app", "v1.0.0"), ShouldBeFalse)
+		So(is.IsImmutable("dev/app", "stable"), ShouldBeTrue)
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+
+		other, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+
+		digest, err := img.Digest()
+		So(err, ShouldBeNil)
+
+		So(test.WriteImageToStore(img, is, "releases/app", "v1.0.0"), ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "releases/app", "latest"), ShouldBeNil)
+
+		Convey("Push the same content again", func() {
+			So(test.WriteImageToStore(img, is, "releases/app", "v1.0.0"), ShouldBeNil)
+		})
+
+		Convey("Move tags", func() {
+			So(test.WriteImageToStore(other, is, "releases/app", "v1.0.0"), ShouldEqual, errors.ErrTagImmutable)
+			So(test.WriteImageToStore(other, is, "releases/app", "latest"), ShouldBeNil)
+
+			_, d, _, err := is.GetImageManifest("releases/app", "v1.0.0")
+			So(err, ShouldBeNil)
+			So(d, ShouldEqual, digest.String())
+		})
+
+		Convey("Delete tags", func() {
+			So(is.DeleteImageTag("releases/app", "v1.0.0"), ShouldEqual, errors.ErrTagImmutable)
+			So(is.DeleteImageManifest("releases/app", digest.String()), ShouldEqual, errors.ErrTagImmutable)
+			So(is.DeleteImageTag("releases/app", "latest"), ShouldBeNil)
+
+			So(test.WriteImageToStore(other, is, "releases/app", "latest"), ShouldBeNil)
+
+			d, err := other.Digest()
+			So(err, ShouldBeNil)
+			So(is.DeleteImageManifest("releases/app", d.String()), ShouldBeNil)
+
+			_, _, mediaType, err := is.GetImageManifest("releases/app", "v1.0.0")
+			So(err, ShouldBeNil)
+			So(mediaType, ShouldEqual, ispec.MediaTypeImageManifest)
+		})
+	})
+
+	Convey("Validate immutable tags configuration", t, func() {
+		log := log.NewLogger("debug", "")
+
+		So(storage.ImmutableTagsConfig{Repositories: []string{"["}}.Validate(log), ShouldEqual, errors.ErrBadConfig)
+		So(storage.ImmutableTagsConfig{Tags: []string{"("}}.Validate(log), ShouldEqual, errors.ErrBadConfig)
+	})
+}
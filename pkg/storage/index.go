@@ -0,0 +1,324 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/anuvu/zot/errors"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// indexSnapshot is the index of a repository as parsed from its index.json, which is never
+// modified once published, so that reads needn't lock the store, nor parse the file again.
+type indexSnapshot struct {
+	index ispec.Index
+	file  os.FileInfo // of the index.json parsed
+}
+
+// readIndex returns the index of the repository at dir, from its snapshot unless its
+// index.json changed since, e.g. written by another process sharing the storage. Callers
+// mustn't modify it. As index.json is replaced rather than written in place, it's read
+// without locking the store.
+func (is *ImageStoreLocal) readIndex(dir string) (ispec.Index, error) {
+	file := filepath.Join(dir, "index.json")
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		return ispec.Index{}, err
+	}
+
+	if v, ok := is.indexes.Load(dir); ok {
+		if s := v.(*indexSnapshot); sameFile(s.file, fi) {
+			return s.index, nil
+		}
+	}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ispec.Index{}, err
+	}
+
+	var index ispec.Index
+	if err := json.Unmarshal(buf, &index); err != nil {
+		return ispec.Index{}, err
+	}
+
+	// if replaced since, fi won't match it, and it's read again
+	is.indexes.Store(dir, &indexSnapshot{index: index, file: fi})
+
+	return index, nil
+}
+
+// writeIndex replaces the index.json of the repository at dir, and publishes its snapshot.
+// The repository must be write-locked.
+func (is *ImageStoreLocal) writeIndex(dir string, index ispec.Index) error {
+	buf, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	file := filepath.Join(dir, "index.json")
+
+	if err := replaceFile(file, buf, 0644); err != nil {
+		return err
+	}
+
+	if fi, err := os.Stat(file); err == nil {
+		is.indexes.Store(dir, &indexSnapshot{index: index, file: fi})
+	}
+
+	return nil
+}
+
+// readReferrers returns the referrers index of the repository at dir. As it's replaced rather
+// than written in place, it's read without locking the store.
+func (is *ImageStoreLocal) readReferrers(dir string) (referrers, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, ReferrersFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return parseReferrers(buf)
+}
+
+// writeReferrers replaces the referrers index of the repository at dir. The repository must be
+// write-locked.
+func (is *ImageStoreLocal) writeReferrers(dir string, refs referrers) error {
+	buf, err := json.Marshal(refs)
+	if err != nil {
+		return err
+	}
+
+	return replaceFile(filepath.Join(dir, ReferrersFile), buf, 0644)
+}
+
+// pruneReferrers removes the manifests no longer in index from the referrers index of the
+// repository at dir, which is otherwise only filtered as read. The repository must be write-locked.
+func (is *ImageStoreLocal) pruneReferrers(dir string, index ispec.Index) {
+	refs, err := is.readReferrers(dir)
+	if err == nil && refs.prune(index) {
+		err = is.writeReferrers(dir, refs)
+	}
+
+	if err != nil {
+		is.log.Error().Err(err).Str("dir", dir).Msg("unable to update referrers")
+	}
+}
+
+// indexUpdate is a manifest pushed, to be added to the index of its repository.
+type indexUpdate struct {
+	reference   string
+	refIsDigest bool
+	mediaType   string
+	digest      godigest.Digest
+	body        []byte
+
+	desc    ispec.Descriptor // as added, or found if already there
+	changed bool
+	err     error
+}
+
+// indexBatch is updates to the index of a repository applied at once, by the push which queued
+// the first one, for those queued meanwhile, so that concurrent pushes to a repository rewrite
+// its index.json once, rather than each in turn.
+type indexBatch struct {
+	updates []*indexUpdate
+	done    chan struct{} // closed once applied
+}
+
+// indexBatches are the batches not yet being applied, by repository directory.
+type indexBatches struct {
+	lock    sync.Mutex
+	batches map[string]*indexBatch
+}
+
+func newIndexBatches() *indexBatches {
+	return &indexBatches{batches: make(map[string]*indexBatch)}
+}
+
+// queue adds an update to the batch of a repository, returning it, and whether it's new, and
+// to be applied by the caller.
+func (q *indexBatches) queue(dir string, u *indexUpdate) (*indexBatch, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	b, ok := q.batches[dir]
+	if !ok {
+		b = &indexBatch{done: make(chan struct{})}
+		q.batches[dir] = b
+	}
+
+	b.updates = append(b.updates, u)
+
+	return b, !ok
+}
+
+// take returns the updates of the batch of a repository, which then no longer takes any.
+func (q *indexBatches) take(dir string) []*indexUpdate {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	b := q.batches[dir]
+	delete(q.batches, dir)
+
+	return b.updates
+}
+
+// updateIndex adds a pushed manifest to the index of the repository at dir along with those
+// pushed meanwhile, returning whether it applied them, having changed the index.
+func (is *ImageStoreLocal) updateIndex(repo string, dir string, u *indexUpdate) bool {
+	b, first := is.indexBatches.queue(dir, u)
+	if !first {
+		<-b.done
+		return false
+	}
+
+	defer close(b.done)
+
+	// others join the batch while the lock is waited for
+	is.LockRepo(repo)
+	defer is.UnlockRepo(repo)
+
+	return is.applyIndexUpdates(dir, is.indexBatches.take(dir))
+}
+
+// applyIndexUpdates writes the manifests of updates, and the index with them, returning whether
+// it changed. The repository must be write-locked.
+func (is *ImageStoreLocal) applyIndexUpdates(dir string, updates []*indexUpdate) bool {
+	fail := func(err error) bool {
+		for _, u := range updates {
+			u.err = err
+		}
+
+		return false
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		is.log.Error().Err(err).Str("dir", dir).Msg("failed to read index.json")
+		return fail(err)
+	}
+
+	var index ispec.Index
+	if err := json.Unmarshal(buf, &index); err != nil {
+		is.log.Error().Err(err).Str("dir", dir).Msg("invalid JSON")
+		return fail(errors.ErrRepoBadVersion)
+	}
+
+	changed := []*indexUpdate{}
+
+	for _, u := range updates {
+		manifests := append([]ispec.Descriptor{}, index.Manifests...)
+
+		u.desc, u.changed = updateIndex(&index, u.reference, u.refIsDigest, u.mediaType, u.digest,
+			int64(len(u.body)), is.log)
+		if !u.changed {
+			continue
+		}
+
+		// write manifest to "blobs"
+		blobDir := filepath.Join(dir, "blobs", u.digest.Algorithm().String())
+		ensureDir(blobDir, is.log)
+		file := filepath.Join(blobDir, u.digest.Encoded())
+
+		err := replaceFile(file, u.body, 0600)
+		is.blobSizes.forget(file)
+
+		if err != nil {
+			is.log.Error().Err(err).Str("file", file).Msg("unable to write")
+			// leaving the index as it was before
+			index.Manifests = manifests
+			u.err = err
+
+			continue
+		}
+
+		changed = append(changed, u)
+	}
+
+	if len(changed) == 0 {
+		return false
+	}
+
+	// the referrers first, for those of manifests not in the index to be ignored if it fails
+	if err := is.updateReferrers(dir, index, changed); err != nil {
+		is.log.Error().Err(err).Str("dir", dir).Msg("unable to update referrers")
+
+		for _, u := range changed {
+			u.err = err
+		}
+
+		return false
+	}
+
+	// now update "index.json"
+	if err := is.writeIndex(dir, index); err != nil {
+		is.log.Error().Err(err).Str("dir", dir).Msg("unable to write index.json")
+
+		for _, u := range changed {
+			u.err = err
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// updateReferrers adds the manifests of updates which have a subject to the referrers index of
+// the repository at dir, of which index is the index about to be written. The repository must be
+// write-locked.
+func (is *ImageStoreLocal) updateReferrers(dir string, index ispec.Index, updates []*indexUpdate) error {
+	var refs referrers
+
+	for _, u := range updates {
+		subject, r, ok := referrerOf(u.mediaType, u.digest, u.body)
+		if !ok {
+			continue
+		}
+
+		if refs == nil {
+			var err error
+
+			if refs, err = is.readReferrers(dir); err != nil {
+				return err
+			}
+		}
+
+		refs.add(subject, r)
+	}
+
+	if refs == nil {
+		return nil
+	}
+
+	refs.prune(index)
+
+	return is.writeReferrers(dir, refs)
+}
+
+// replaceFile writes a file by renaming a temporary one over it, so that it's never read
+// partially written. The repository must be write-locked.
+func replaceFile(file string, buf []byte, perm os.FileMode) error {
+	tmp := file + ".tmp"
+
+	if err := writeFile(tmp, buf, perm); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	if err := rename(tmp, file); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+func sameFile(a os.FileInfo, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// layoutWriter writes an OCI image layout to a tar, each blob once.
+type layoutWriter struct {
+	is      ImageStore
+	repo    string
+	tw      *tar.Writer
+	written map[godigest.Digest]bool
+}
+
+// ExportRepo writes the images of a repository, or only those tagged tag if set, to w as a tar
+// of an OCI image layout, e.g. to carry them to an air-gapped registry, along with the manifests
+// referring to them, e.g. their signatures, which are part of the repository anyway.
+func ExportRepo(is ImageStore, repo string, tag string, w io.Writer) error {
+	buf, err := is.GetIndexContent(repo)
+	if err != nil {
+		return err
+	}
+
+	var index ispec.Index
+	if err := json.Unmarshal(buf, &index); err != nil {
+		return err
+	}
+
+	if tag != "" {
+		desc, ok := findManifest(index, tag)
+		if !ok || desc.Digest.String() == tag {
+			return errors.ErrManifestNotFound
+		}
+
+		index.Manifests = []ispec.Descriptor{desc}
+	}
+
+	lw := &layoutWriter{is: is, repo: repo, tw: tar.NewWriter(w), written: map[godigest.Digest]bool{}}
+
+	il, err := json.Marshal(ispec.ImageLayout{Version: ispec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+
+	if err := lw.writeFile(ispec.ImageLayoutFile, il); err != nil {
+		return err
+	}
+
+	// the referrers of those tagged added to the index as they're written
+	for i := 0; i < len(index.Manifests); i++ {
+		desc := index.Manifests[i]
+
+		if err := lw.writeManifest(desc.Digest); err != nil {
+			return err
+		}
+
+		if tag == "" {
+			continue
+		}
+
+		refs, err := is.GetReferrers(repo, desc.Digest.String(), "")
+		if err != nil {
+			return err
+		}
+
+		for _, r := range refs {
+			if !lw.written[r.Digest] {
+				index.Manifests = append(index.Manifests, ispec.Descriptor{MediaType: r.MediaType, Digest: r.Digest,
+					Size: r.Size, Annotations: r.Annotations})
+			}
+		}
+	}
+
+	buf, err = json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	if err := lw.writeFile("index.json", buf); err != nil {
+		return err
+	}
+
+	return lw.tw.Close()
+}
+
+// writeManifest writes a manifest, or index, along with the blobs, or manifests, it references.
+func (lw *layoutWriter) writeManifest(digest godigest.Digest) error {
+	if lw.written[digest] {
+		return nil
+	}
+
+	r, _, err := lw.is.GetBlob(lw.repo, digest.String(), "")
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(r)
+	closeReader(r)
+
+	if err != nil {
+		return err
+	}
+
+	var m struct {
+		Config *ispec.Descriptor  `json:"config"`
+		Layers []ispec.Descriptor `json:"layers"`
+		// those of artifact manifests
+		Blobs     []ispec.Descriptor `json:"blobs"`
+		Manifests []ispec.Descriptor `json:"manifests"`
+	}
+
+	if err := json.Unmarshal(body, &m); err != nil {
+		return errors.ErrBadManifest
+	}
+
+	for _, desc := range m.Manifests {
+		if err := lw.writeManifest(desc.Digest); err != nil {
+			return err
+		}
+	}
+
+	blobs := append(m.Layers, m.Blobs...)
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+
+	for _, desc := range blobs {
+		if err := lw.writeBlob(desc.Digest); err != nil {
+			return err
+		}
+	}
+
+	lw.written[digest] = true
+
+	return lw.writeFile(blobEntry(digest), body)
+}
+
+// writeBlob writes a blob, unless already written.
+func (lw *layoutWriter) writeBlob(digest godigest.Digest) error {
+	if lw.written[digest] {
+		return nil
+	}
+
+	r, size, err := lw.is.GetBlob(lw.repo, digest.String(), "")
+	if err != nil {
+		return err
+	}
+	defer closeReader(r)
+
+	if err := lw.tw.WriteHeader(layoutHeader(blobEntry(digest), size)); err != nil {
+		return err
+	}
+
+	if _, err := CopyN(lw.tw, r, size); err != nil {
+		return err
+	}
+
+	lw.written[digest] = true
+
+	return nil
+}
+
+func (lw *layoutWriter) writeFile(name string, body []byte) error {
+	if err := lw.tw.WriteHeader(layoutHeader(name, int64(len(body)))); err != nil {
+		return err
+	}
+
+	_, err := lw.tw.Write(body)
+
+	return err
+}
+
+// layoutHeader returns the tar header of a file of a layout, the same whenever it's exported.
+func layoutHeader(name string, size int64) *tar.Header {
+	return &tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0644, ModTime: time.Unix(0, 0),
+		Format: tar.FormatPAX}
+}
+
+func blobEntry(digest godigest.Digest) string {
+	return path.Join("blobs", digest.Algorithm().String(), digest.Encoded())
+}
+
+func closeReader(r io.Reader) {
+	if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// ImportRepo reads a tar of an OCI image layout from r, e.g. written by ExportRepo or other tools,
+// into a repository, uploading its blobs as they're read, then pushing the manifests of its index,
+// tagged as they are there, and returns the tags pushed.
+func ImportRepo(is ImageStore, repo string, r io.Reader) ([]string, error) {
+	tr := tar.NewReader(r)
+
+	var index *ispec.Index
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, errors.ErrBadLayout
+		}
+
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+
+		switch {
+		case hdr.Typeflag != tar.TypeReg:
+			continue
+		case name == "index.json":
+			index = &ispec.Index{}
+			if err := json.NewDecoder(tr).Decode(index); err != nil {
+				return nil, errors.ErrBadLayout
+			}
+		case strings.HasPrefix(name, "blobs/"):
+			parts := strings.Split(name, "/")
+			if len(parts) != 3 {
+				continue
+			}
+
+			d := godigest.NewDigestFromEncoded(godigest.Algorithm(parts[1]), parts[2])
+			if d.Validate() != nil {
+				return nil, errors.ErrBadBlobDigest
+			}
+
+			if _, _, err := is.FullBlobUpload(repo, tr, d.String()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if index == nil {
+		return nil, errors.ErrBadLayout
+	}
+
+	tags := []string{}
+	pushed := map[godigest.Digest]bool{}
+
+	for _, desc := range index.Manifests {
+		reference := desc.Digest.String()
+		if tag, ok := desc.Annotations[ispec.AnnotationRefName]; ok {
+			reference = tag
+		}
+
+		if err := pushManifest(is, repo, desc, reference, pushed); err != nil {
+			return nil, err
+		}
+
+		if reference != desc.Digest.String() {
+			tags = append(tags, reference)
+		}
+	}
+
+	return tags, nil
+}
+
+// pushManifest pushes a manifest uploaded as a blob, those of an index first, by reference.
+func pushManifest(is ImageStore, repo string, desc ispec.Descriptor, reference string,
+	pushed map[godigest.Digest]bool) error {
+	r, _, err := is.GetBlob(repo, desc.Digest.String(), "")
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(r)
+	closeReader(r)
+
+	if err != nil {
+		return err
+	}
+
+	if IsImageIndex(desc.MediaType) {
+		var index ispec.Index
+		if err := json.Unmarshal(body, &index); err != nil {
+			return errors.ErrBadManifest
+		}
+
+		for _, m := range index.Manifests {
+			if !pushed[m.Digest] {
+				if err := pushManifest(is, repo, m, m.Digest.String(), pushed); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if _, err := is.PutImageManifest(repo, reference, desc.MediaType, body); err != nil {
+		return err
+	}
+
+	pushed[desc.Digest] = true
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package storage_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExportImportRepo(t *testing.T) {
+	Convey("Export and import repositories as OCI image layouts", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.NewLogger("debug", "")
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log)
+		So(is, ShouldNotBeNil)
+
+		img, err := test.GetRandomImage(64, 2)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+		other, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(other, is, "repo", "2.0"), ShouldBeNil)
+
+		platforms := []ispec.Platform{{Architecture: "amd64", OS: "linux"}, {Architecture: "arm64", OS: "linux"}}
+		mi, err := test.GetRandomMultiarchImage(64, platforms)
+		So(err, ShouldBeNil)
+
+		for _, img := range mi.Images {
+			d, err := img.Digest()
+			So(err, ShouldBeNil)
+			So(test.WriteImageToStore(img, is, "repo", d.String()), ShouldBeNil)
+		}
+
+		iblob, err := mi.IndexBlob()
+		So(err, ShouldBeNil)
+		_, err = is.PutImageManifest("repo", "multi", ispec.MediaTypeImageIndex, iblob)
+		So(err, ShouldBeNil)
+
+		// a signature of the first image
+		subject, err := img.Digest()
+		So(err, ShouldBeNil)
+		sig := artifact(is, "repo", "application/vnd.example.signature", subject)
+		signature, err := is.PutImageManifest("repo", godigest.FromBytes(sig).String(), ispec.MediaTypeImageManifest,
+			sig)
+		So(err, ShouldBeNil)
+
+		entries := func(layout []byte) []string {
+			names := []string{}
+			tr := tar.NewReader(bytes.NewReader(layout))
+
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					return names
+				}
+
+				So(err, ShouldBeNil)
+				names = append(names, hdr.Name)
+			}
+		}
+
+		Convey("whole", func() {
+			var layout bytes.Buffer
+			So(storage.ExportRepo(is, "repo", "", &layout), ShouldBeNil)
+
+			names := entries(layout.Bytes())
+			So(names[0], ShouldEqual, ispec.ImageLayoutFile)
+			So(names[len(names)-1], ShouldEqual, "index.json")
+
+			// imported elsewhere, e.g. in memory
+			mem := storage.NewImageStoreMem(log)
+
+			tags, err := storage.ImportRepo(mem, "copy", bytes.NewReader(layout.Bytes()))
+			So(err, ShouldBeNil)
+			sort.Strings(tags)
+			So(tags, ShouldResemble, []string{"1.0", "2.0", "multi"})
+
+			for _, tag := range tags {
+				expected, digest, _, err := is.GetImageManifest("repo", tag)
+				So(err, ShouldBeNil)
+				buf, imported, _, err := mem.GetImageManifest("copy", tag)
+				So(err, ShouldBeNil)
+				So(buf, ShouldResemble, expected)
+				So(imported, ShouldEqual, digest)
+			}
+
+			for _, d := range append(img.Manifest.Layers, other.Manifest.Config) {
+				ok, _, err := mem.CheckBlob("copy", d.Digest.String(), "")
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeTrue)
+			}
+
+			refs, err := mem.GetReferrers("copy", subject.String(), "")
+			So(err, ShouldBeNil)
+			So(refs, ShouldHaveLength, 1)
+			So(refs[0].Digest.String(), ShouldEqual, signature)
+		})
+
+		Convey("by tag, with its referrers", func() {
+			var layout bytes.Buffer
+			So(storage.ExportRepo(is, "repo", "1.0", &layout), ShouldBeNil)
+
+			names := entries(layout.Bytes())
+			// oci-layout, config, 2 layers, image manifest, signature config and manifest, index.json
+			So(names, ShouldHaveLength, 8)
+
+			tags, err := storage.ImportRepo(is, "copy", bytes.NewReader(layout.Bytes()))
+			So(err, ShouldBeNil)
+			So(tags, ShouldResemble, []string{"1.0"})
+
+			_, _, _, err = is.GetImageManifest("copy", "2.0")
+			So(err, ShouldNotBeNil)
+
+			refs, err := is.GetReferrers("copy", subject.String(), "")
+			So(err, ShouldBeNil)
+			So(refs, ShouldHaveLength, 1)
+
+			So(storage.ExportRepo(is, "repo", "3.0", ioutil.Discard), ShouldEqual, errors.ErrManifestNotFound)
+			So(storage.ExportRepo(is, "repo", subject.String(), ioutil.Discard), ShouldEqual,
+				errors.ErrManifestNotFound)
+		})
+
+		Convey("rejecting what isn't one", func() {
+			_, err := storage.ImportRepo(is, "copy", bytes.NewReader([]byte("not a tar")))
+			So(err, ShouldEqual, errors.ErrBadLayout)
+
+			var layout bytes.Buffer
+			tw := tar.NewWriter(&layout)
+			So(tw.WriteHeader(&tar.Header{Name: "blobs/sha256/abc", Size: 4, Mode: 0644}), ShouldBeNil)
+			_, err = tw.Write([]byte("blob"))
+			So(err, ShouldBeNil)
+			So(tw.Close(), ShouldBeNil)
+
+			_, err = storage.ImportRepo(is, "copy", bytes.NewReader(layout.Bytes()))
+			So(err, ShouldEqual, errors.ErrBadBlobDigest)
+		})
+	})
+}
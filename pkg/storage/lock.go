@@ -0,0 +1,79 @@
+// +build !windows
+
+package storage
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+// sharedLockSupported is false on platforms without flock.
+const sharedLockSupported = true
+
+// fileLock extends an image store's lock to other processes sharing its storage, by locking
+// a file in it: shared while any goroutine holds a read-lock, exclusive with a write-lock.
+type fileLock struct {
+	file    *os.File
+	lock    sync.Mutex
+	readers int
+}
+
+func newFileLock(path string) (*fileLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileLock{file: file}, nil
+}
+
+func (l *fileLock) flock(how int) {
+	for {
+		err := syscall.Flock(int(l.file.Fd()), how)
+		if err != syscall.EINTR {
+			if err != nil {
+				// only possible with a bad file descriptor, i.e. a bug
+				panic(err)
+			}
+
+			return
+		}
+	}
+}
+
+// rlock is called with the image store read-locked.
+func (l *fileLock) rlock() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.readers == 0 {
+		l.flock(syscall.LOCK_SH)
+	}
+
+	l.readers++
+}
+
+func (l *fileLock) runlock() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.readers--
+
+	if l.readers == 0 {
+		l.flock(syscall.LOCK_UN)
+	}
+}
+
+// wlock is called with the image store write-locked, so without readers.
+func (l *fileLock) wlock() {
+	l.flock(syscall.LOCK_EX)
+}
+
+func (l *fileLock) wunlock() {
+	l.flock(syscall.LOCK_UN)
+}
+
+func (l *fileLock) close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,19 @@
+package storage
+
+import "errors"
+
+// sharedLockSupported is false on platforms without flock.
+const sharedLockSupported = false
+
+// fileLock is unused, since storage can't be shared on this platform.
+type fileLock struct{}
+
+func newFileLock(path string) (*fileLock, error) {
+	return nil, errors.New("file locks are not supported on this platform")
+}
+
+func (l *fileLock) rlock()       {}
+func (l *fileLock) runlock()     {}
+func (l *fileLock) wlock()       {}
+func (l *fileLock) wunlock()     {}
+func (l *fileLock) close() error { return nil }
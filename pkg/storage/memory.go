@@ -0,0 +1,555 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/anuvu/zot/errors"
+	zlog "github.com/anuvu/zot/pkg/log"
+	guuid "github.com/gofrs/uuid"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog"
+)
+
+// memRepo holds the contents of a single repository in memory.
+type memRepo struct {
+	index     ispec.Index
+	referrers referrers
+	blobs     map[godigest.Digest][]byte
+	uploads   map[string][]byte
+}
+
+// ImageStoreMem provides the image storage operations in memory, for tests and
+// embedders that don't need images to outlive the process.
+type ImageStoreMem struct {
+	lock  *sync.RWMutex
+	repos map[string]*memRepo
+	log   zerolog.Logger
+}
+
+// NewImageStoreMem returns a new, empty image store backed by memory.
+func NewImageStoreMem(log zlog.Logger) *ImageStoreMem {
+	return &ImageStoreMem{
+		lock:  &sync.RWMutex{},
+		repos: make(map[string]*memRepo),
+		log:   log.With().Caller().Logger(),
+	}
+}
+
+// Close releases resources held by the image store.
+func (is *ImageStoreMem) Close() error {
+	return nil
+}
+
+// InitRepo creates an image repository under this store.
+func (is *ImageStoreMem) InitRepo(name string) error {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	is.initRepo(name)
+
+	return nil
+}
+
+// initRepo must be called with the write lock held.
+func (is *ImageStoreMem) initRepo(name string) *memRepo {
+	r, ok := is.repos[name]
+	if !ok {
+		r = &memRepo{
+			index:     ispec.Index{},
+			referrers: referrers{},
+			blobs:     make(map[godigest.Digest][]byte),
+			uploads:   make(map[string][]byte),
+		}
+		r.index.SchemaVersion = schemaVersion
+		is.repos[name] = r
+	}
+
+	return r
+}
+
+// ValidateRepo validates that the repository exists, since an in-memory repository
+// is always well-formed.
+func (is *ImageStoreMem) ValidateRepo(name string) (bool, error) {
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+
+	if _, ok := is.repos[name]; !ok {
+		return false, errors.ErrRepoNotFound
+	}
+
+	return true, nil
+}
+
+// DeleteRepo deletes an image repository from this store, with its images and blobs.
+func (is *ImageStoreMem) DeleteRepo(name string) error {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	if _, ok := is.repos[name]; !ok {
+		return errors.ErrRepoNotFound
+	}
+
+	delete(is.repos, name)
+
+	return nil
+}
+
+// GetRepositories returns a list of all the repositories under this store.
+func (is *ImageStoreMem) GetRepositories() ([]string, error) {
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+
+	stores := make([]string, 0, len(is.repos))
+	for name := range is.repos {
+		stores = append(stores, name)
+	}
+
+	sort.Strings(stores)
+
+	return stores, nil
+}
+
+// GetImageTags returns a list of image tags available in the specified repository.
+func (is *ImageStoreMem) GetImageTags(repo string) ([]string, error) {
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+
+	r, ok := is.repos[repo]
+	if !ok {
+		return nil, errors.ErrRepoNotFound
+	}
+
+	return getTags(r.index), nil
+}
+
+// GetIndexContent returns the index of a repository, serialized as index.json would be.
+func (is *ImageStoreMem) GetIndexContent(repo string) ([]byte, error) {
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+
+	r, ok := is.repos[repo]
+	if !ok {
+		return nil, errors.ErrRepoNotFound
+	}
+
+	return json.Marshal(r.index)
+}
+
+// GetImageManifest returns the image manifest of an image in the specific repository.
+func (is *ImageStoreMem) GetImageManifest(repo string, reference string) ([]byte, string, string, error) {
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+
+	r, ok := is.repos[repo]
+	if !ok {
+		return nil, "", "", errors.ErrRepoNotFound
+	}
+
+	desc, found := findManifest(r.index, reference)
+	if !found {
+		return nil, "", "", errors.ErrManifestNotFound
+	}
+
+	buf, ok := r.blobs[desc.Digest]
+	if !ok {
+		return nil, "", "", errors.ErrManifestNotFound
+	}
+
+	return buf, desc.Digest.String(), desc.MediaType, nil
+}
+
+// PutImageManifest adds an image manifest to the repository.
+func (is *ImageStoreMem) PutImageManifest(repo string, reference string, mediaType string,
+	body []byte) (string, error) {
+	m, err := validateManifest(mediaType, body, is.log)
+	if err != nil {
+		return "", err
+	}
+
+	mDigest := manifestDigest(reference, body)
+
+	refIsDigest, err := checkManifestReference(reference, mDigest, is.log)
+	if err != nil {
+		return "", err
+	}
+
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	r := is.initRepo(repo)
+
+	for _, d := range m.digests() {
+		if _, ok := r.blobs[d]; !ok {
+			is.log.Error().Str("digest", d.String()).Msg("unable to find blob")
+			return d.String(), errors.ErrBlobNotFound
+		}
+	}
+
+	desc, changed := updateIndex(&r.index, reference, refIsDigest, mediaType, mDigest, int64(len(body)), is.log)
+	if changed {
+		r.blobs[mDigest] = append([]byte(nil), body...)
+
+		if subject, ref, ok := referrerOf(mediaType, mDigest, body); ok {
+			r.referrers.add(subject, ref)
+		}
+	}
+
+	return desc.Digest.String(), nil
+}
+
+// DeleteImageManifest deletes the image manifest from the repository.
+func (is *ImageStoreMem) DeleteImageManifest(repo string, reference string) error {
+	// as per spec "reference" can only be a digest and not a tag
+	digest, err := godigest.Parse(reference)
+	if err != nil {
+		is.log.Error().Err(err).Msg("invalid reference")
+		return errors.ErrBadManifest
+	}
+
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	r, ok := is.repos[repo]
+	if !ok {
+		return errors.ErrRepoNotFound
+	}
+
+	index, found := removeManifest(r.index, reference)
+	if !found {
+		return errors.ErrManifestNotFound
+	}
+
+	r.index = index
+	r.referrers.prune(index)
+	delete(r.blobs, digest)
+
+	return nil
+}
+
+// DeleteImageTag removes a tag from the repository, and the manifest it pointed to if
+// nothing else references it.
+func (is *ImageStoreMem) DeleteImageTag(repo string, tag string) error {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	r, ok := is.repos[repo]
+	if !ok {
+		return errors.ErrRepoNotFound
+	}
+
+	desc, found := findManifest(r.index, tag)
+	if !found || desc.Digest.String() == tag {
+		return errors.ErrManifestNotFound
+	}
+
+	r.index, _ = removeTag(r.index, tag)
+
+	if _, found := findManifest(r.index, desc.Digest.String()); !found {
+		r.referrers.prune(r.index)
+		delete(r.blobs, desc.Digest)
+	}
+
+	return nil
+}
+
+// GetReferrers returns the descriptors of the manifests of a repository whose subject is
+// digest, of artifactType unless empty.
+func (is *ImageStoreMem) GetReferrers(repo string, digest string, artifactType string) ([]Referrer, error) {
+	subject, err := godigest.Parse(digest)
+	if err != nil {
+		return nil, errors.ErrBadBlobDigest
+	}
+
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+
+	r, ok := is.repos[repo]
+	if !ok {
+		return nil, errors.ErrRepoNotFound
+	}
+
+	return r.referrers.list(r.index, subject, artifactType), nil
+}
+
+// NewBlobUpload returns the unique ID for an upload in progress.
+func (is *ImageStoreMem) NewBlobUpload(repo string) (string, error) {
+	u, err := guuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+
+	uuid := u.String()
+
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	is.initRepo(repo).uploads[uuid] = []byte{}
+
+	return uuid, nil
+}
+
+// upload returns the contents of an upload in progress, and must be called with the lock held.
+func (is *ImageStoreMem) upload(repo string, uuid string) ([]byte, error) {
+	r, ok := is.repos[repo]
+	if !ok {
+		return nil, errors.ErrUploadNotFound
+	}
+
+	buf, ok := r.uploads[uuid]
+	if !ok {
+		return nil, errors.ErrUploadNotFound
+	}
+
+	return buf, nil
+}
+
+// GetBlobUpload returns the current size of a blob upload.
+func (is *ImageStoreMem) GetBlobUpload(repo string, uuid string) (int64, error) {
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+
+	buf, err := is.upload(repo, uuid)
+	if err != nil {
+		return -1, err
+	}
+
+	return int64(len(buf)), nil
+}
+
+// PutBlobChunkStreamed appends another chunk of data to the specified blob. It returns
+// the number of actual bytes to the blob.
+func (is *ImageStoreMem) PutBlobChunkStreamed(repo string, uuid string, body io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(body)
+
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	buf, uerr := is.upload(repo, uuid)
+	if uerr != nil {
+		return -1, uerr
+	}
+
+	is.repos[repo].uploads[uuid] = append(buf, data...)
+
+	return int64(len(data)), err
+}
+
+// PutBlobChunk writes another chunk of data to the specified blob. It returns
+// the number of actual bytes to the blob.
+func (is *ImageStoreMem) PutBlobChunk(repo string, uuid string, from int64, to int64,
+	body io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(body)
+
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	buf, uerr := is.upload(repo, uuid)
+	if uerr != nil {
+		return -1, uerr
+	}
+
+	if from != int64(len(buf)) {
+		is.log.Error().Int64("expected", from).Int64("actual", int64(len(buf))).
+			Msg("invalid range start for blob upload")
+		return -1, errors.ErrBadUploadRange
+	}
+
+	is.repos[repo].uploads[uuid] = append(buf, data...)
+
+	return int64(len(data)), err
+}
+
+// BlobUploadInfo returns the current blob size in bytes.
+func (is *ImageStoreMem) BlobUploadInfo(repo string, uuid string) (int64, error) {
+	return is.GetBlobUpload(repo, uuid)
+}
+
+// FinishBlobUpload finalizes the blob upload and moves blob the repository.
+func (is *ImageStoreMem) FinishBlobUpload(repo string, uuid string, body io.Reader, digest string) error {
+	dstDigest, err := godigest.Parse(digest)
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to parse digest")
+		return errors.ErrBadBlobDigest
+	}
+
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	buf, err := is.upload(repo, uuid)
+	if err != nil {
+		return err
+	}
+
+	if srcDigest := dstDigest.Algorithm().FromBytes(buf); srcDigest != dstDigest {
+		is.log.Error().Str("srcDigest", srcDigest.String()).
+			Str("dstDigest", dstDigest.String()).Msg("actual digest not equal to expected digest")
+		return errors.ErrBadBlobDigest
+	}
+
+	r := is.repos[repo]
+	r.blobs[dstDigest] = buf
+	delete(r.uploads, uuid)
+
+	return nil
+}
+
+// FullBlobUpload handles a full blob upload, and no partial session is created.
+func (is *ImageStoreMem) FullBlobUpload(repo string, body io.Reader, digest string) (string, int64, error) {
+	dstDigest, err := godigest.Parse(digest)
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to parse digest")
+		return "", -1, errors.ErrBadBlobDigest
+	}
+
+	u, err := guuid.NewV4()
+	if err != nil {
+		return "", -1, err
+	}
+
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", -1, err
+	}
+
+	if srcDigest := dstDigest.Algorithm().FromBytes(buf); srcDigest != dstDigest {
+		is.log.Error().Str("srcDigest", srcDigest.String()).
+			Str("dstDigest", dstDigest.String()).Msg("actual digest not equal to expected digest")
+		return "", -1, errors.ErrBadBlobDigest
+	}
+
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	is.initRepo(repo).blobs[dstDigest] = buf
+
+	return u.String(), int64(len(buf)), nil
+}
+
+// MountBlob adds a blob already stored in another repository to a repository, sharing it
+// rather than it being uploaded again. It returns false if it isn't found.
+func (is *ImageStoreMem) MountBlob(repo string, digest string) (bool, int64, error) {
+	d, err := godigest.Parse(digest)
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to parse digest")
+		return false, -1, errors.ErrBadBlobDigest
+	}
+
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	for _, r := range is.repos {
+		if buf, ok := r.blobs[d]; ok {
+			is.initRepo(repo).blobs[d] = buf
+			return true, int64(len(buf)), nil
+		}
+	}
+
+	return false, -1, nil
+}
+
+// DeleteBlobUpload deletes an existing blob upload that is currently in progress.
+func (is *ImageStoreMem) DeleteBlobUpload(repo string, uuid string) error {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	if _, err := is.upload(repo, uuid); err != nil {
+		is.log.Error().Err(err).Str("uuid", uuid).Msg("error deleting blob upload")
+		return err
+	}
+
+	delete(is.repos[repo].uploads, uuid)
+
+	return nil
+}
+
+// blob returns the contents of a blob, and must be called with the lock held.
+func (is *ImageStoreMem) blob(repo string, digest string) ([]byte, error) {
+	d, err := godigest.Parse(digest)
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to parse digest")
+		return nil, errors.ErrBadBlobDigest
+	}
+
+	r, ok := is.repos[repo]
+	if !ok {
+		return nil, errors.ErrBlobNotFound
+	}
+
+	buf, ok := r.blobs[d]
+	if !ok {
+		return nil, errors.ErrBlobNotFound
+	}
+
+	return buf, nil
+}
+
+// CheckBlob verifies a blob and returns true if the blob is correct.
+func (is *ImageStoreMem) CheckBlob(repo string, digest string,
+	mediaType string) (bool, int64, error) {
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+
+	buf, err := is.blob(repo, digest)
+	if err != nil {
+		return false, -1, err
+	}
+
+	return true, int64(len(buf)), nil
+}
+
+// GetBlob returns a stream to read the blob.
+func (is *ImageStoreMem) GetBlob(repo string, digest string, mediaType string) (io.Reader, int64, error) {
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+
+	buf, err := is.blob(repo, digest)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	return bytes.NewReader(buf), int64(len(buf)), nil
+}
+
+// GetBlobPartial returns a stream to read a range of a blob, from and to included, to being
+// -1 for its end, along with the length of the range and the size of the blob.
+func (is *ImageStoreMem) GetBlobPartial(repo string, digest string, mediaType string, from int64,
+	to int64) (io.Reader, int64, int64, error) {
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+
+	buf, err := is.blob(repo, digest)
+	if err != nil {
+		return nil, -1, -1, err
+	}
+
+	length, err := blobRange(from, to, int64(len(buf)))
+	if err != nil {
+		return nil, -1, int64(len(buf)), err
+	}
+
+	return bytes.NewReader(buf[from : from+length]), length, int64(len(buf)), nil
+}
+
+// DeleteBlob removes the blob from the repository.
+func (is *ImageStoreMem) DeleteBlob(repo string, digest string) error {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	if _, err := is.blob(repo, digest); err != nil {
+		if err == errors.ErrBadBlobDigest { // nolint:goerr113
+			return errors.ErrBlobNotFound
+		}
+
+		return err
+	}
+
+	delete(is.repos[repo].blobs, godigest.Digest(digest))
+
+	return nil
+}
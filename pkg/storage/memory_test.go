@@ -0,0 +1,218 @@
+package storage_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMemoryAPIs(t *testing.T) {
+	var il storage.ImageStore = storage.NewImageStoreMem(log.Logger{Logger: zerolog.New(os.Stdout)})
+
+	Convey("Memory repo layout", t, func(c C) {
+		repoName := "test"
+
+		Convey("Validate repo without initialization", func() {
+			v, err := il.ValidateRepo(repoName)
+			So(v, ShouldEqual, false)
+			So(err, ShouldNotBeNil)
+
+			_, err = il.GetImageTags(repoName)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Initialize and validate repo", func() {
+			So(il.InitRepo(repoName), ShouldBeNil)
+
+			v, err := il.ValidateRepo(repoName)
+			So(err, ShouldBeNil)
+			So(v, ShouldEqual, true)
+
+			repos, err := il.GetRepositories()
+			So(err, ShouldBeNil)
+			So(repos, ShouldResemble, []string{repoName})
+
+			tags, err := il.GetImageTags(repoName)
+			So(err, ShouldBeNil)
+			So(tags, ShouldBeEmpty)
+		})
+
+		Convey("Full blob upload", func() {
+			body := []byte("this is a blob")
+			d := godigest.FromBytes(body)
+			u, n, err := il.FullBlobUpload(repoName, bytes.NewBuffer(body), d.String())
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, len(body))
+			So(u, ShouldNotBeEmpty)
+
+			_, _, err = il.FullBlobUpload(repoName, bytes.NewBuffer(body), godigest.FromString("x").String())
+			So(err, ShouldNotBeNil)
+
+			ok, size, err := il.CheckBlob(repoName, d.String(), "")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(size, ShouldEqual, len(body))
+
+			So(il.DeleteBlob(repoName, d.String()), ShouldBeNil)
+			So(il.DeleteBlob(repoName, d.String()), ShouldNotBeNil)
+			So(il.DeleteBlob(repoName, "invalid"), ShouldNotBeNil)
+		})
+
+		Convey("Mount blob", func() {
+			body := []byte("this is a mounted blob")
+			d := godigest.FromBytes(body)
+
+			ok, _, err := il.MountBlob("other", d.String())
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+
+			_, _, err = il.MountBlob("other", "invalid")
+			So(err, ShouldNotBeNil)
+
+			_, _, err = il.FullBlobUpload(repoName, bytes.NewBuffer(body), d.String())
+			So(err, ShouldBeNil)
+
+			ok, size, err := il.MountBlob("other", d.String())
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(size, ShouldEqual, len(body))
+
+			ok, size, err = il.CheckBlob("other", d.String(), "")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(size, ShouldEqual, len(body))
+		})
+
+		Convey("Chunked blob upload and manifests", func() {
+			v, err := il.NewBlobUpload(repoName)
+			So(err, ShouldBeNil)
+			So(v, ShouldNotBeEmpty)
+
+			_, err = il.GetBlobUpload(repoName, "invalid")
+			So(err, ShouldNotBeNil)
+
+			content := []byte("test-data1")
+			l := len(content)
+			d := godigest.FromBytes(content)
+
+			n, err := il.PutBlobChunk(repoName, v, 0, int64(5), bytes.NewBuffer(content[:5]))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 5)
+
+			_, err = il.PutBlobChunk(repoName, v, 0, int64(5), bytes.NewBuffer(content[5:]))
+			So(err, ShouldNotBeNil)
+
+			n, err = il.PutBlobChunkStreamed(repoName, v, bytes.NewBuffer(content[5:]))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, l-5)
+
+			b, err := il.BlobUploadInfo(repoName, v)
+			So(err, ShouldBeNil)
+			So(b, ShouldEqual, l)
+
+			So(il.FinishBlobUpload(repoName, v, nil, godigest.FromString("x").String()), ShouldNotBeNil)
+			So(il.FinishBlobUpload(repoName, v, nil, d.String()), ShouldBeNil)
+			So(il.FinishBlobUpload(repoName, v, nil, d.String()), ShouldNotBeNil)
+
+			r, size, err := il.GetBlob(repoName, d.String(), "")
+			So(err, ShouldBeNil)
+			So(size, ShouldEqual, l)
+			buf, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(buf, ShouldResemble, content)
+
+			r, length, size, err := il.GetBlobPartial(repoName, d.String(), "", 2, -1)
+			So(err, ShouldBeNil)
+			So(length, ShouldEqual, l-2)
+			So(size, ShouldEqual, l)
+			buf, err = ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(buf, ShouldResemble, content[2:])
+
+			_, _, _, err = il.GetBlobPartial(repoName, d.String(), "", int64(l), -1)
+			So(err, ShouldEqual, errors.ErrBadRange)
+
+			m := ispec.Manifest{
+				Config: ispec.Descriptor{Digest: d, Size: int64(l)},
+				Layers: []ispec.Descriptor{
+					{MediaType: "application/vnd.oci.image.layer.v1.tar", Digest: d, Size: int64(l)},
+				},
+			}
+			m.SchemaVersion = 2
+			mb, _ := json.Marshal(m)
+			md := godigest.FromBytes(mb)
+
+			_, err = il.PutImageManifest(repoName, "1.0", "application/json", mb)
+			So(err, ShouldNotBeNil)
+
+			_, err = il.PutImageManifest(repoName, godigest.FromString("x").String(), ispec.MediaTypeImageManifest, mb)
+			So(err, ShouldNotBeNil)
+
+			dgst, err := il.PutImageManifest(repoName, "1.0", ispec.MediaTypeImageManifest, mb)
+			So(err, ShouldBeNil)
+			So(dgst, ShouldEqual, md.String())
+
+			tags, err := il.GetImageTags(repoName)
+			So(err, ShouldBeNil)
+			So(tags, ShouldResemble, []string{"1.0"})
+
+			body, mdgst, mediaType, err := il.GetImageManifest(repoName, "1.0")
+			So(err, ShouldBeNil)
+			So(body, ShouldResemble, mb)
+			So(mdgst, ShouldEqual, md.String())
+			So(mediaType, ShouldEqual, ispec.MediaTypeImageManifest)
+
+			_, _, _, err = il.GetImageManifest(repoName, "2.0")
+			So(err, ShouldNotBeNil)
+
+			So(il.DeleteImageManifest(repoName, "1.0"), ShouldNotBeNil)
+			So(il.DeleteImageManifest(repoName, md.String()), ShouldBeNil)
+			So(il.DeleteImageManifest(repoName, md.String()), ShouldNotBeNil)
+
+			_, _, _, err = il.GetImageManifest(repoName, "1.0")
+			So(err, ShouldNotBeNil)
+
+			_, err = il.PutImageManifest(repoName, "1.0", ispec.MediaTypeImageManifest, mb)
+			So(err, ShouldBeNil)
+
+			So(il.DeleteImageTag(repoName, md.String()), ShouldNotBeNil)
+			So(il.DeleteImageTag(repoName, "1.0"), ShouldBeNil)
+			So(il.DeleteImageTag(repoName, "1.0"), ShouldNotBeNil)
+
+			_, _, _, err = il.GetImageManifest(repoName, md.String())
+			So(err, ShouldNotBeNil)
+
+			So(il.Close(), ShouldBeNil)
+		})
+
+		Convey("Delete blob upload", func() {
+			v, err := il.NewBlobUpload(repoName)
+			So(err, ShouldBeNil)
+			So(il.DeleteBlobUpload(repoName, v), ShouldBeNil)
+			So(il.DeleteBlobUpload(repoName, v), ShouldNotBeNil)
+		})
+
+		Convey("Delete repo", func() {
+			So(il.InitRepo(repoName), ShouldBeNil)
+			So(il.InitRepo(repoName+"/nested"), ShouldBeNil)
+
+			So(il.DeleteRepo(repoName), ShouldBeNil)
+			So(il.DeleteRepo(repoName), ShouldEqual, errors.ErrRepoNotFound)
+
+			repos, err := il.GetRepositories()
+			So(err, ShouldBeNil)
+			So(repos, ShouldContain, repoName+"/nested")
+			So(repos, ShouldNotContain, repoName)
+		})
+	})
+}
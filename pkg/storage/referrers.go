@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"encoding/json"
+	"sort"
+
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ReferrersFile is the file, next to index.json, of a repository's referrers index.
+const ReferrersFile = "referrers.json"
+
+// Referrer is the descriptor of a manifest referring to another, its subject, e.g. a signature
+// or an SBOM of an image, as listed by the referrers API. Unlike ispec.Descriptor, which
+// predates them, it has an artifact type.
+type Referrer struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Digest       godigest.Digest   `json:"digest"`
+	Size         int64             `json:"size"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// referrers is the referrers index of a repository: the descriptors of the manifests referring
+// to others, by digest of their subjects. Manifests removed from the repository may linger in
+// it until written again, so it's read along with the index of the repository.
+type referrers map[godigest.Digest][]Referrer
+
+// referrerOf returns the subject of a manifest, or index, being pushed, and its descriptor as
+// a referrer of it, if it has one.
+func referrerOf(mediaType string, digest godigest.Digest, body []byte) (godigest.Digest, Referrer, bool) {
+	var m struct {
+		ArtifactType string `json:"artifactType"`
+		Config       struct {
+			MediaType string `json:"mediaType"`
+		} `json:"config"`
+		Subject *struct {
+			Digest godigest.Digest `json:"digest"`
+		} `json:"subject"`
+		Annotations map[string]string `json:"annotations"`
+	}
+
+	if err := json.Unmarshal(body, &m); err != nil || m.Subject == nil || m.Subject.Digest.Validate() != nil {
+		return "", Referrer{}, false
+	}
+
+	// that of the config of images, unless artifacts
+	artifactType := m.ArtifactType
+	if artifactType == "" && IsImageManifest(mediaType) {
+		artifactType = m.Config.MediaType
+	}
+
+	return m.Subject.Digest, Referrer{MediaType: mediaType, ArtifactType: artifactType, Digest: digest,
+		Size: int64(len(body)), Annotations: m.Annotations}, true
+}
+
+// add adds a referrer of subject, unless already there.
+func (refs referrers) add(subject godigest.Digest, r Referrer) {
+	for _, ref := range refs[subject] {
+		if ref.Digest == r.Digest {
+			return
+		}
+	}
+
+	refs[subject] = append(refs[subject], r)
+}
+
+// prune removes the referrers no longer in the repository of index, returning whether any was.
+func (refs referrers) prune(index ispec.Index) bool {
+	pruned := false
+	manifests := manifestDigests(index)
+
+	for subject, list := range refs {
+		kept := list[:0]
+
+		for _, r := range list {
+			if manifests[r.Digest] {
+				kept = append(kept, r)
+			}
+		}
+
+		switch {
+		case len(kept) == 0:
+			delete(refs, subject)
+		case len(kept) < len(list):
+			refs[subject] = kept
+		default:
+			continue
+		}
+
+		pruned = true
+	}
+
+	return pruned
+}
+
+// list returns the referrers of subject still in the repository of index, of artifactType
+// unless empty, sorted by digest.
+func (refs referrers) list(index ispec.Index, subject godigest.Digest, artifactType string) []Referrer {
+	manifests := manifestDigests(index)
+	list := []Referrer{}
+
+	for _, r := range refs[subject] {
+		if manifests[r.Digest] && (artifactType == "" || r.ArtifactType == artifactType) {
+			list = append(list, r)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Digest < list[j].Digest })
+
+	return list
+}
+
+// manifestDigests returns the digests of the manifests of an index.
+func manifestDigests(index ispec.Index) map[godigest.Digest]bool {
+	digests := make(map[godigest.Digest]bool, len(index.Manifests))
+
+	for _, m := range index.Manifests {
+		digests[m.Digest] = true
+	}
+
+	return digests
+}
+
+// parseReferrers parses a referrers index, that of a repository without any if buf is nil.
+func parseReferrers(buf []byte) (referrers, error) {
+	refs := referrers{}
+
+	if buf == nil {
+		return refs, nil
+	}
+
+	if err := json.Unmarshal(buf, &refs); err != nil {
+		return nil, err
+	}
+
+	return refs, nil
+}
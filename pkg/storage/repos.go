@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// validRepos remembers the repositories found valid, by directory, with the modification time of their
+// directory then, so that validating or listing them needn't read their layout again
+// unless entries were added to or removed from their directory since, e.g. by hand.
+type validRepos struct {
+	lock  sync.Mutex
+	repos map[string]time.Time
+}
+
+func newValidRepos() *validRepos {
+	return &validRepos{repos: make(map[string]time.Time)}
+}
+
+// valid returns whether a repository was found valid, and its directory hasn't changed since.
+func (v *validRepos) valid(dir string, fi os.FileInfo) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	modTime, ok := v.repos[dir]
+
+	return ok && modTime.Equal(fi.ModTime())
+}
+
+func (v *validRepos) add(dir string, fi os.FileInfo) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.repos[dir] = fi.ModTime()
+}
+
+// forget has a repository validated again, once written to.
+func (v *validRepos) forget(dir string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	delete(v.repos, dir)
+}
+
+// repoCatalog lists the repositories of a store, found walking the storage when first listed,
+// then kept up to date as repositories are created or deleted through the store, so that listing
+// them needn't walk the storage each time. Repositories added by hand meanwhile are listed once the store is
+// opened again. It's nil for a shared storage, in which other processes may create repositories.
+type repoCatalog struct {
+	lock  sync.Mutex
+	repos []string // sorted, nil until walked
+}
+
+func newRepoCatalog() *repoCatalog {
+	return &repoCatalog{}
+}
+
+// list returns the repositories, sorted, or false if the storage wasn't walked yet.
+func (c *repoCatalog) list() ([]string, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.repos == nil {
+		return nil, false
+	}
+
+	return append(make([]string, 0, len(c.repos)), c.repos...), true
+}
+
+// set records the repositories found walking the storage, sorted.
+func (c *repoCatalog) set(repos []string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.repos = append(make([]string, 0, len(repos)), repos...)
+}
+
+// add records a repository once created, if the storage was walked already.
+func (c *repoCatalog) add(repo string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.repos == nil {
+		return
+	}
+
+	i := sort.SearchStrings(c.repos, repo)
+	if i < len(c.repos) && c.repos[i] == repo {
+		return
+	}
+
+	c.repos = append(c.repos, "")
+	copy(c.repos[i+1:], c.repos[i:])
+	c.repos[i] = repo
+}
+
+// remove forgets a repository once deleted.
+func (c *repoCatalog) remove(repo string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	i := sort.SearchStrings(c.repos, repo)
+	if i < len(c.repos) && c.repos[i] == repo {
+		c.repos = append(c.repos[:i], c.repos[i+1:]...)
+	}
+}
+
+// repoLocks locks repositories one by one, by name, so that writing to a repository doesn't
+// block reading or writing others. Their locks are dropped once no longer held nor waited for.
+type repoLocks struct {
+	lock  sync.Mutex
+	locks map[string]*repoLock
+}
+
+type repoLock struct {
+	sync.RWMutex
+	refs int // goroutines holding or waiting for the lock
+}
+
+func newRepoLocks() *repoLocks {
+	return &repoLocks{locks: make(map[string]*repoLock)}
+}
+
+// get returns the lock of a repository, referenced until put back.
+func (r *repoLocks) get(repo string) *repoLock {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	l, ok := r.locks[repo]
+	if !ok {
+		l = &repoLock{}
+		r.locks[repo] = l
+	}
+
+	l.refs++
+
+	return l
+}
+
+func (r *repoLocks) put(repo string, l *repoLock) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	l.refs--
+
+	if l.refs == 0 {
+		delete(r.locks, repo)
+	}
+}
+
+func (r *repoLocks) rlock(repo string) {
+	r.get(repo).RLock()
+}
+
+func (r *repoLocks) runlock(repo string) {
+	r.lock.Lock()
+	l := r.locks[repo]
+	r.lock.Unlock()
+
+	l.RUnlock()
+	r.put(repo, l)
+}
+
+func (r *repoLocks) wlock(repo string) {
+	r.get(repo).Lock()
+}
+
+func (r *repoLocks) wunlock(repo string) {
+	r.lock.Lock()
+	l := r.locks[repo]
+	r.lock.Unlock()
+
+	l.Unlock()
+	r.put(repo, l)
+}
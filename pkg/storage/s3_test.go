@@ -0,0 +1,400 @@
+package storage_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type s3Object struct {
+	data     []byte
+	modified time.Time
+}
+
+// s3Bucket is a fake S3 service with a single bucket, listing few objects at a time, for
+// listings to be continued, and whose objects can be aged, for garbage to be collected.
+type s3Bucket struct {
+	name    string
+	lock    sync.Mutex
+	objects map[string]s3Object
+}
+
+func newS3Bucket(name string) *s3Bucket {
+	return &s3Bucket{name: name, objects: map[string]s3Object{}}
+}
+
+func (b *s3Bucket) age(d time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for k, o := range b.objects {
+		o.modified = o.modified.Add(-d)
+		b.objects[k] = o
+	}
+}
+
+func (b *s3Bucket) keys() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	keys := []string{}
+	for k := range b.objects {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (b *s3Bucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=akid/") ||
+		r.Header.Get("X-Amz-Date") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+b.name), "/")
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if key == "" && r.Method == http.MethodGet {
+		b.list(w, r)
+		return
+	}
+
+	o, ok := b.objects[key]
+
+	switch r.Method {
+	case http.MethodPut:
+		if r.ContentLength < 0 {
+			w.WriteHeader(http.StatusLengthRequired)
+			return
+		}
+
+		data, _ := ioutil.ReadAll(r.Body)
+
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			o, ok := b.objects[strings.TrimPrefix(src, "/"+b.name+"/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			data = o.data
+		}
+
+		b.objects[key] = s3Object{data: data, modified: time.Now()}
+	case http.MethodGet, http.MethodHead:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("<Error><Code>NoSuchKey</Code></Error>"))
+
+			return
+		}
+
+		data := o.data
+
+		var offset int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset); err == nil {
+			data = data[offset:]
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", o.modified.UTC().Format(http.TimeFormat))
+
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(b.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (b *s3Bucket) list(w http.ResponseWriter, r *http.Request) {
+	type content struct {
+		Key          string
+		Size         int
+		LastModified time.Time
+	}
+
+	var result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	after := r.URL.Query().Get("continuation-token")
+
+	keys := []string{}
+
+	for k := range b.objects {
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	if len(keys) > 2 {
+		keys = keys[:2]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[1]
+	}
+
+	for _, k := range keys {
+		result.Contents = append(result.Contents, content{Key: k, Size: len(b.objects[k].data),
+			LastModified: b.objects[k].modified})
+	}
+
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func TestS3Config(t *testing.T) {
+	Convey("Validate S3 config", t, func() {
+		l := log.NewLogger("debug", "")
+
+		So(storage.S3Config{Bucket: "b", Region: "us-east-1"}.Validate(l), ShouldBeNil)
+		So(storage.S3Config{Bucket: "b", Region: "r", Endpoint: "http://minio:9000"}.Validate(l), ShouldBeNil)
+		So(storage.S3Config{Region: "r"}.Validate(l), ShouldEqual, errors.ErrBadConfig)
+		So(storage.S3Config{Bucket: "b"}.Validate(l), ShouldEqual, errors.ErrBadConfig)
+		So(storage.S3Config{Bucket: "b", Region: "r", Endpoint: "minio:9000"}.Validate(l), ShouldEqual,
+			errors.ErrBadConfig)
+	})
+}
+
+func TestS3APIs(t *testing.T) {
+	Convey("S3 repo layout", t, func() {
+		// a bucket of its own for each path through
+		bucket := newS3Bucket("zot")
+		server := httptest.NewServer(bucket)
+
+		defer server.Close()
+
+		is := storage.NewImageStoreS3(storage.S3Config{
+			Bucket:          "zot",
+			Region:          "us-east-1",
+			Endpoint:        server.URL,
+			Prefix:          "/registry/",
+			AccessKeyID:     "akid",
+			SecretAccessKey: "secret",
+		}, true, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
+		defer is.Close()
+
+		var il storage.ImageStore = is
+
+		repoName := "test/repo"
+
+		_, err := il.ValidateRepo(repoName)
+		So(err, ShouldEqual, errors.ErrRepoNotFound)
+
+		So(il.InitRepo(repoName), ShouldBeNil)
+		So(il.InitRepo(repoName), ShouldBeNil)
+
+		v, err := il.ValidateRepo(repoName)
+		So(err, ShouldBeNil)
+		So(v, ShouldBeTrue)
+		So(bucket.keys(), ShouldResemble, []string{"registry/test/repo/index.json", "registry/test/repo/oci-layout"})
+
+		So(il.InitRepo("other"), ShouldBeNil)
+
+		repos, err := il.GetRepositories()
+		So(err, ShouldBeNil)
+		So(repos, ShouldResemble, []string{"other", repoName})
+
+		tags, err := il.GetImageTags(repoName)
+		So(err, ShouldBeNil)
+		So(tags, ShouldBeEmpty)
+
+		Convey("Chunked blob upload", func() {
+			body := []byte("this is a blob uploaded in chunks")
+			d := godigest.FromBytes(body)
+
+			u, err := il.NewBlobUpload(repoName)
+			So(err, ShouldBeNil)
+
+			n, err := il.GetBlobUpload(repoName, u)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 0)
+
+			n, err = il.PutBlobChunk(repoName, u, 0, 9, bytes.NewBuffer(body[:10]))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 10)
+
+			_, err = il.PutBlobChunk(repoName, u, 5, 9, bytes.NewBuffer(body[5:10]))
+			So(err, ShouldEqual, errors.ErrBadUploadRange)
+
+			n, err = il.PutBlobChunkStreamed(repoName, u, bytes.NewBuffer(body[10:]))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, len(body)-10)
+
+			n, err = il.BlobUploadInfo(repoName, u)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, len(body))
+
+			So(il.FinishBlobUpload(repoName, u, nil, godigest.FromString("x").String()), ShouldEqual,
+				errors.ErrBadBlobDigest)
+			So(il.FinishBlobUpload(repoName, u, nil, d.String()), ShouldBeNil)
+
+			_, err = il.GetBlobUpload(repoName, u)
+			So(err, ShouldEqual, errors.ErrUploadNotFound)
+
+			ok, size, err := il.CheckBlob(repoName, d.String(), "")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(size, ShouldEqual, len(body))
+
+			r, size, err := il.GetBlob(repoName, d.String(), "")
+			So(err, ShouldBeNil)
+			So(size, ShouldEqual, len(body))
+
+			buf, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(buf, ShouldResemble, body)
+
+			_, err = il.PutBlobChunkStreamed(repoName, "unknown", bytes.NewBuffer(body))
+			So(err, ShouldEqual, errors.ErrUploadNotFound)
+
+			u, err = il.NewBlobUpload(repoName)
+			So(err, ShouldBeNil)
+			So(il.DeleteBlobUpload(repoName, u), ShouldBeNil)
+			So(il.DeleteBlobUpload(repoName, u), ShouldEqual, errors.ErrUploadNotFound)
+
+			So(il.DeleteBlob(repoName, d.String()), ShouldBeNil)
+			So(il.DeleteBlob(repoName, d.String()), ShouldEqual, errors.ErrBlobNotFound)
+
+			_, _, err = il.GetBlob(repoName, d.String(), "")
+			So(err, ShouldEqual, errors.ErrBlobNotFound)
+		})
+
+		Convey("Full blob upload", func() {
+			body := []byte("this is a blob")
+			d := godigest.FromBytes(body)
+
+			_, _, err := il.FullBlobUpload(repoName, bytes.NewBuffer(body), godigest.FromString("x").String())
+			So(err, ShouldEqual, errors.ErrBadBlobDigest)
+
+			u, n, err := il.FullBlobUpload(repoName, bytes.NewBuffer(body), d.String())
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, len(body))
+			So(u, ShouldNotBeEmpty)
+
+			ok, _, err := il.MountBlob("other", d.String())
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Manifests and garbage collection", func() {
+			layer := []byte("this is a layer")
+			ld := godigest.FromBytes(layer)
+			garbage := []byte("this is garbage")
+			gd := godigest.FromBytes(garbage)
+
+			m := ispec.Manifest{Layers: []ispec.Descriptor{{MediaType: ispec.MediaTypeImageLayer,
+				Digest: ld, Size: int64(len(layer))}}}
+			m.SchemaVersion = 2
+			mb, _ := json.Marshal(m)
+			md := godigest.FromBytes(mb)
+
+			_, err := il.PutImageManifest(repoName, "1.0", ispec.MediaTypeImageManifest, mb)
+			So(err, ShouldEqual, errors.ErrBlobNotFound)
+
+			_, _, err = il.FullBlobUpload(repoName, bytes.NewBuffer(layer), ld.String())
+			So(err, ShouldBeNil)
+			_, _, err = il.FullBlobUpload(repoName, bytes.NewBuffer(garbage), gd.String())
+			So(err, ShouldBeNil)
+
+			digest, err := il.PutImageManifest(repoName, "1.0", ispec.MediaTypeImageManifest, mb)
+			So(err, ShouldBeNil)
+			So(digest, ShouldEqual, md.String())
+
+			for _, ref := range []string{"1.0", md.String()} {
+				buf, digest, mediaType, err := il.GetImageManifest(repoName, ref)
+				So(err, ShouldBeNil)
+				So(buf, ShouldResemble, mb)
+				So(digest, ShouldEqual, md.String())
+				So(mediaType, ShouldEqual, ispec.MediaTypeImageManifest)
+			}
+
+			tags, err := il.GetImageTags(repoName)
+			So(err, ShouldBeNil)
+			So(tags, ShouldResemble, []string{"1.0"})
+
+			// too recent to be collected
+			_, err = il.PutImageManifest(repoName, "latest", ispec.MediaTypeImageManifest, mb)
+			So(err, ShouldBeNil)
+
+			ok, _, _ := il.CheckBlob(repoName, gd.String(), "")
+			So(ok, ShouldBeTrue)
+
+			bucket.age(2 * time.Hour)
+
+			So(il.DeleteImageTag(repoName, "latest"), ShouldBeNil)
+			So(il.DeleteImageTag(repoName, "latest"), ShouldEqual, errors.ErrManifestNotFound)
+
+			// in the background
+			collected := func(digest godigest.Digest) bool {
+				for i := 0; i < 100; i++ {
+					if ok, _, _ := il.CheckBlob(repoName, digest.String(), ""); !ok {
+						return true
+					}
+
+					time.Sleep(50 * time.Millisecond)
+				}
+
+				return false
+			}
+
+			So(collected(gd), ShouldBeTrue)
+			ok, _, _ = il.CheckBlob(repoName, ld.String(), "")
+			So(ok, ShouldBeTrue)
+
+			So(il.DeleteImageManifest(repoName, "1.0"), ShouldEqual, errors.ErrBadManifest)
+			So(il.DeleteImageManifest(repoName, md.String()), ShouldBeNil)
+			So(il.DeleteImageManifest(repoName, md.String()), ShouldEqual, errors.ErrManifestNotFound)
+
+			_, _, _, err = il.GetImageManifest(repoName, "1.0")
+			So(err, ShouldEqual, errors.ErrManifestNotFound)
+
+			So(collected(ld), ShouldBeTrue)
+
+			index, err := il.GetIndexContent(repoName)
+			So(err, ShouldBeNil)
+			So(string(index), ShouldContainSubstring, `"manifests":[]`)
+		})
+
+		Convey("Delete repo", func() {
+			So(il.DeleteRepo(repoName), ShouldBeNil)
+			So(il.DeleteRepo(repoName), ShouldEqual, errors.ErrRepoNotFound)
+			So(il.DeleteRepo("other"), ShouldBeNil)
+			So(bucket.keys(), ShouldBeEmpty)
+
+			repos, err := il.GetRepositories()
+			So(err, ShouldBeNil)
+			So(repos, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3Service         = "s3"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3DateFormat      = "20060102"
+	s3TimeFormat      = "20060102T150405Z"
+)
+
+// s3Client makes the few S3 requests the image store needs of a bucket, addressed path-style,
+// e.g. http://minio:9000/bucket/key, which AWS and S3-compatible services all support, signed
+// with AWS signature version 4.
+type s3Client struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	client    *http.Client
+}
+
+// s3Object is an object listed in a bucket.
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type s3ListResult struct {
+	Contents       []s3Object `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// s3Error is an error response from the bucket.
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("%s: %d %s: %s", errors.ErrS3Request, e.StatusCode, e.Code, e.Message)
+}
+
+func (e *s3Error) Unwrap() error {
+	return errors.ErrS3Request
+}
+
+// isNotFound reports whether err is that of an object which doesn't exist.
+func isNotFound(err error) bool {
+	e, ok := err.(*s3Error)
+
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// get returns the contents of an object from offset on, and their size.
+func (c *s3Client) get(key string, offset int64) (io.ReadCloser, int64, error) {
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	}
+
+	resp, err := c.do(http.MethodGet, key, nil, header, nil, 0)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+// getAll returns the contents of a small object, e.g. an index.
+func (c *s3Client) getAll(key string) ([]byte, error) {
+	body, _, err := c.get(key, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
+
+// head returns the size of an object.
+func (c *s3Client) head(key string) (int64, error) {
+	resp, err := c.do(http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return -1, err
+	}
+	resp.Body.Close()
+
+	return resp.ContentLength, nil
+}
+
+// put writes an object of the given size, replacing it if it exists.
+func (c *s3Client) put(key string, body io.Reader, size int64) error {
+	resp, err := c.do(http.MethodPut, key, nil, nil, body, size)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// copy copies an object within the bucket, replacing dst if it exists.
+func (c *s3Client) copy(src string, dst string) error {
+	header := http.Header{"X-Amz-Copy-Source": {s3Escape("/"+c.bucket+"/"+src, false)}}
+
+	resp, err := c.do(http.MethodPut, dst, nil, header, nil, 0)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// delete removes an object, which isn't an error if it doesn't exist.
+func (c *s3Client) delete(key string) error {
+	resp, err := c.do(http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// list returns the objects whose keys start with prefix, and, if delimiter is set, the common
+// prefixes of the keys up to it rather than the objects under them.
+func (c *s3Client) list(prefix string, delimiter string) ([]s3Object, []string, error) {
+	objects := []s3Object{}
+	prefixes := []string{}
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := c.do(http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var result s3ListResult
+
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		objects = append(objects, result.Contents...)
+
+		for _, p := range result.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, prefixes, nil
+		}
+
+		token = result.NextContinuationToken
+	}
+}
+
+// do sends a signed request for an object of the bucket, or the bucket itself if key is empty,
+// returning an *s3Error unless it succeeded.
+func (c *s3Client) do(method string, key string, query url.Values, header http.Header, body io.Reader,
+	size int64) (*http.Response, error) {
+	path := "/" + c.bucket
+	if key != "" {
+		path += "/" + key
+	}
+
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(c.endpoint.Path, "/") + path
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	// sent with their length, as S3 doesn't accept chunked requests
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+
+	c.sign(req, time.Now().UTC())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+
+	e := &s3Error{StatusCode: resp.StatusCode}
+	if method != http.MethodHead {
+		_ = xml.NewDecoder(resp.Body).Decode(e)
+	}
+
+	return nil, e
+}
+
+// sign signs a request with the credentials of the client, leaving its payload unsigned, as
+// blobs are streamed.
+func (c *s3Client) sign(req *http.Request, now time.Time) {
+	date := now.Format(s3DateFormat)
+	scope := strings.Join([]string{date, c.region, s3Service, "aws4_request"}, "/")
+
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	if c.token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3Algorithm, now.Format(s3TimeFormat), scope,
+		hex.EncodeToString(hash[:])}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+c.secretKey), date)
+	key = s3HMAC(key, c.region)
+	key = s3HMAC(key, s3Service)
+	key = s3HMAC(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, c.accessKey, scope, signedHeaders, hex.EncodeToString(s3HMAC(key, stringToSign))))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+// s3Query returns the canonical form of a query, its keys sorted and escaped as S3 expects.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+// s3Escape percent-encodes all but the unreserved characters of RFC 3986, and slashes, unless
+// escaping a query parameter.
+func s3Escape(s string, query bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !query:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
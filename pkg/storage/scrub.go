@@ -0,0 +1,358 @@
+package storage
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/anuvu/zot/errors"
+	zlog "github.com/anuvu/zot/pkg/log"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// Problems found scrubbing blobs.
+const (
+	// ScrubMissing is a blob referenced by a manifest of its repository, or its index, but not there.
+	ScrubMissing = "missing"
+	// ScrubCorrupt is a blob whose content doesn't match its digest.
+	ScrubCorrupt = "corrupt"
+	// ScrubOrphaned is a blob nothing in its repository references, left for garbage collection.
+	ScrubOrphaned = "orphaned"
+)
+
+// ScrubProblem is a problem with a blob of a repository found scrubbing the storage.
+type ScrubProblem struct {
+	Repo    string          `json:"repo"`
+	Digest  godigest.Digest `json:"digest"`
+	Problem string          `json:"problem"`
+	Fixed   bool            `json:"fixed"`
+}
+
+// ScrubReport is what was found scrubbing the storage, and fixed if asked to.
+type ScrubReport struct {
+	Repos    int            `json:"repos"`
+	Blobs    int            `json:"blobs"` // verified, i.e. read and hashed again
+	Problems []ScrubProblem `json:"problems"`
+}
+
+// scrubbedRepo is what was found scrubbing a repository, before fixing it.
+type scrubbedRepo struct {
+	name       string
+	dir        string
+	blobs      map[godigest.Digest]bool // found, whether intact
+	referenced map[godigest.Digest]bool
+	read       func(godigest.Digest) ([]byte, error) // reads a blob, e.g. a manifest
+}
+
+// Scrub verifies every blob of the repositories under rootDir, hashing it again, and looks for
+// the blobs referenced by their manifests but missing, and those referenced by nothing. With fix,
+// corrupt blobs are removed, and along with the missing ones replaced with an intact copy from
+// another repository if any, and orphaned blobs are removed. The registry mustn't be running then,
+// and the dedupe cache, whose records of blobs removed linger, should be repaired afterwards.
+func Scrub(rootDir string, fix bool, log zlog.Logger) (*ScrubReport, error) {
+	if _, err := os.Stat(rootDir); err != nil {
+		return nil, err
+	}
+
+	repos, err := NewImageStore(rootDir, false, false, Options{}, log).GetRepositories()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ScrubReport{Repos: len(repos), Problems: []ScrubProblem{}}
+	scrubbed := make(map[string]*scrubbedRepo, len(repos))
+	intact := map[godigest.Digest]string{} // a copy of each blob found intact
+
+	for _, repo := range repos {
+		r, err := scrubRepo(filepath.Join(rootDir, repo), repo)
+		if err != nil {
+			return nil, err
+		}
+
+		for d, ok := range r.blobs {
+			report.Blobs++
+
+			if ok {
+				intact[d] = r.blobPath(d)
+			}
+		}
+
+		scrubbed[repo] = r
+		report.Problems = append(report.Problems, r.problems()...)
+	}
+
+	if fix {
+		// orphaned blobs last, as they may be the intact copies of others
+		for _, orphaned := range []bool{false, true} {
+			for i, p := range report.Problems {
+				if (p.Problem == ScrubOrphaned) == orphaned {
+					report.Problems[i].Fixed = scrubbed[p.Repo].fix(p, intact[p.Digest], log)
+				}
+			}
+		}
+	}
+
+	for _, p := range report.Problems {
+		log.Error().Str("repo", p.Repo).Str("digest", p.Digest.String()).Str("problem", p.Problem).
+			Bool("fixed", p.Fixed).Msg("scrub: blob failed verification")
+	}
+
+	log.Info().Int("repos", report.Repos).Int("blobs", report.Blobs).Int("problems", len(report.Problems)).
+		Bool("fix", fix).Msg("scrub done")
+
+	return report, nil
+}
+
+// ScrubStore verifies the blobs referenced by the manifests of the repositories of a store,
+// hashing them again, and looks for those missing, through the store, whatever backs it, and
+// while it serves clients. Blobs referenced by nothing can't be listed through a store, so
+// finding them, and fixing problems, is left to Scrub.
+func ScrubStore(is ImageStore, log zlog.Logger) (*ScrubReport, error) {
+	repos, err := is.GetRepositories()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ScrubReport{Repos: len(repos), Problems: []ScrubProblem{}}
+
+	for _, repo := range repos {
+		index, err := is.GetIndexContent(repo)
+		// deleted since listed
+		if err == errors.ErrRepoNotFound { // nolint:goerr113
+			report.Repos--
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		repo := repo
+		r := &scrubbedRepo{name: repo, blobs: map[godigest.Digest]bool{}, referenced: map[godigest.Digest]bool{}}
+		r.read = func(d godigest.Digest) ([]byte, error) {
+			blob, _, err := is.GetBlob(repo, d.String(), "")
+			if err != nil {
+				return nil, err
+			}
+
+			if c, ok := blob.(io.Closer); ok {
+				defer c.Close()
+			}
+
+			return ioutil.ReadAll(blob)
+		}
+
+		r.reference(index)
+
+		for d := range r.referenced {
+			if d.Validate() != nil {
+				continue
+			}
+
+			blob, _, err := is.GetBlob(repo, d.String(), "")
+			// left missing
+			if err == errors.ErrBlobNotFound { // nolint:goerr113
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			ok, err := verifyReader(blob, d)
+			if err != nil {
+				return nil, err
+			}
+
+			report.Blobs++
+			r.blobs[d] = ok
+		}
+
+		report.Problems = append(report.Problems, r.problems()...)
+	}
+
+	for _, p := range report.Problems {
+		log.Error().Str("repo", p.Repo).Str("digest", p.Digest.String()).Str("problem", p.Problem).
+			Msg("scrub: blob failed verification")
+	}
+
+	log.Info().Int("repos", report.Repos).Int("blobs", report.Blobs).Int("problems", len(report.Problems)).
+		Msg("scrub done")
+
+	return report, nil
+}
+
+// scrubRepo hashes the blobs of the repository at dir again, and finds those its index references.
+func scrubRepo(dir string, repo string) (*scrubbedRepo, error) {
+	r := &scrubbedRepo{name: repo, dir: dir, blobs: map[godigest.Digest]bool{},
+		referenced: map[godigest.Digest]bool{}}
+	r.read = func(d godigest.Digest) ([]byte, error) { return ioutil.ReadFile(r.blobPath(d)) }
+
+	algs, err := ioutil.ReadDir(filepath.Join(dir, "blobs"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, alg := range algs {
+		files, err := ioutil.ReadDir(filepath.Join(dir, "blobs", alg.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, fi := range files {
+			// e.g. temporary files
+			d := godigest.NewDigestFromEncoded(godigest.Algorithm(alg.Name()), fi.Name())
+			if fi.IsDir() || d.Validate() != nil {
+				continue
+			}
+
+			ok, err := verifyBlob(r.blobPath(d), d)
+			if err != nil {
+				return nil, err
+			}
+
+			r.blobs[d] = ok
+		}
+	}
+
+	index, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	r.reference(index)
+
+	return r, nil
+}
+
+// reference adds the blobs referenced by a manifest, or index, to those of the repository,
+// along with those the manifests it references do in turn, as far as they can be read.
+func (r *scrubbedRepo) reference(body []byte) {
+	var m struct {
+		Config *struct {
+			Digest godigest.Digest `json:"digest"`
+		} `json:"config"`
+		Layers []struct {
+			Digest godigest.Digest `json:"digest"`
+		} `json:"layers"`
+		Manifests []struct {
+			Digest godigest.Digest `json:"digest"`
+		} `json:"manifests"`
+	}
+
+	if err := json.Unmarshal(body, &m); err != nil {
+		return
+	}
+
+	if m.Config != nil {
+		r.referenced[m.Config.Digest] = true
+	}
+
+	for _, l := range m.Layers {
+		r.referenced[l.Digest] = true
+	}
+
+	for _, desc := range m.Manifests {
+		if r.referenced[desc.Digest] {
+			continue
+		}
+
+		r.referenced[desc.Digest] = true
+
+		if desc.Digest.Validate() != nil {
+			continue
+		}
+
+		if buf, err := r.read(desc.Digest); err == nil {
+			r.reference(buf)
+		}
+	}
+}
+
+// problems returns the problems of the blobs of the repository, sorted by digest.
+func (r *scrubbedRepo) problems() []ScrubProblem {
+	problems := []ScrubProblem{}
+
+	for d, ok := range r.blobs {
+		switch {
+		case !r.referenced[d]:
+			problems = append(problems, ScrubProblem{Repo: r.name, Digest: d, Problem: ScrubOrphaned})
+		case !ok:
+			problems = append(problems, ScrubProblem{Repo: r.name, Digest: d, Problem: ScrubCorrupt})
+		}
+	}
+
+	for d := range r.referenced {
+		if _, ok := r.blobs[d]; !ok && d.Validate() == nil {
+			problems = append(problems, ScrubProblem{Repo: r.name, Digest: d, Problem: ScrubMissing})
+		}
+	}
+
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Digest < problems[j].Digest })
+
+	return problems
+}
+
+// fix fixes a problem of a blob of the repository, returning whether it could: orphaned blobs
+// are removed, and corrupt or missing ones replaced with their intact copy, if any.
+func (r *scrubbedRepo) fix(p ScrubProblem, intact string, log zlog.Logger) bool {
+	path := r.blobPath(p.Digest)
+
+	if p.Problem != ScrubMissing {
+		if err := os.Remove(path); err != nil {
+			log.Error().Err(err).Str("blobPath", path).Msg("scrub: unable to remove blob")
+			return false
+		}
+	}
+
+	if p.Problem == ScrubOrphaned {
+		return true
+	}
+
+	if intact == "" {
+		return false
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Error().Err(err).Str("blobPath", path).Msg("scrub: unable to create blob dir")
+		return false
+	}
+
+	// hard linked, as deduped, or else copied
+	if err := os.Link(intact, path); err != nil {
+		if err := copyFile(intact, path); err != nil {
+			log.Error().Err(err).Str("blobPath", path).Str("src", intact).Msg("scrub: unable to restore blob")
+			return false
+		}
+	}
+
+	return true
+}
+
+// verifyBlob returns whether the content of the blob at path matches its digest.
+func verifyBlob(path string, d godigest.Digest) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+
+	return verifyReader(f, d)
+}
+
+// verifyReader returns whether the content of a blob read by r matches its digest, closing r
+// once read, if it can.
+func verifyReader(r io.Reader, d godigest.Digest) (bool, error) {
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	actual, err := d.Algorithm().FromReader(r)
+	if err != nil {
+		return false, err
+	}
+
+	return actual == d, nil
+}
+
+func (r *scrubbedRepo) blobPath(d godigest.Digest) string {
+	return filepath.Join(r.dir, "blobs", d.Algorithm().String(), d.Encoded())
+}
@@ -0,0 +1,143 @@
+package storage_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	godigest "github.com/opencontainers/go-digest"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestScrub(t *testing.T) {
+	Convey("Scrub the storage", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.NewLogger("debug", "")
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log)
+		So(is, ShouldNotBeNil)
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo1", "1.0"), ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo2", "1.0"), ShouldBeNil)
+
+		report, err := storage.Scrub(dir, false, log)
+		So(err, ShouldBeNil)
+		So(report.Repos, ShouldEqual, 2)
+		So(report.Blobs, ShouldEqual, 6)
+		So(report.Problems, ShouldBeEmpty)
+
+		// a corrupt layer, a missing config and an orphaned blob
+		layer := img.Manifest.Layers[0].Digest
+		So(os.Remove(is.BlobPath("repo1", layer)), ShouldBeNil)
+		So(ioutil.WriteFile(is.BlobPath("repo1", layer), []byte("corrupt"), 0600), ShouldBeNil)
+
+		config := img.Manifest.Config.Digest
+		So(os.Remove(is.BlobPath("repo2", config)), ShouldBeNil)
+
+		content := []byte("orphaned")
+		orphan := godigest.FromBytes(content)
+		_, _, err = is.FullBlobUpload("repo1", bytes.NewReader(content), orphan.String())
+		So(err, ShouldBeNil)
+
+		expected := []storage.ScrubProblem{
+			{Repo: "repo1", Digest: layer, Problem: storage.ScrubCorrupt},
+			{Repo: "repo1", Digest: orphan, Problem: storage.ScrubOrphaned},
+			{Repo: "repo2", Digest: config, Problem: storage.ScrubMissing},
+		}
+
+		if orphan < layer {
+			expected[0], expected[1] = expected[1], expected[0]
+		}
+
+		report, err = storage.Scrub(dir, false, log)
+		So(err, ShouldBeNil)
+		So(report.Problems, ShouldResemble, expected)
+
+		_, err = os.Stat(is.BlobPath("repo1", orphan))
+		So(err, ShouldBeNil)
+
+		// fixed with the intact copies of the other repository
+		for i := range expected {
+			expected[i].Fixed = true
+		}
+
+		report, err = storage.Scrub(dir, true, log)
+		So(err, ShouldBeNil)
+		So(report.Problems, ShouldResemble, expected)
+
+		report, err = storage.Scrub(dir, false, log)
+		So(err, ShouldBeNil)
+		So(report.Blobs, ShouldEqual, 6)
+		So(report.Problems, ShouldBeEmpty)
+
+		_, err = os.Stat(is.BlobPath("repo1", orphan))
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		// unless there are none
+		So(os.Remove(is.BlobPath("repo1", config)), ShouldBeNil)
+		So(os.Remove(is.BlobPath("repo2", config)), ShouldBeNil)
+
+		report, err = storage.Scrub(dir, true, log)
+		So(err, ShouldBeNil)
+		So(report.Problems, ShouldResemble, []storage.ScrubProblem{
+			{Repo: "repo1", Digest: config, Problem: storage.ScrubMissing},
+			{Repo: "repo2", Digest: config, Problem: storage.ScrubMissing},
+		})
+	})
+
+	Convey("Scrub a store backed by a driver", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.NewLogger("debug", "")
+		is := storage.NewImageStoreDriver(storage.NewFilesystemDriver(dir), false, storage.Options{}, log)
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo1", "1.0"), ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo2", "1.0"), ShouldBeNil)
+
+		report, err := storage.ScrubStore(is, log)
+		So(err, ShouldBeNil)
+		So(report.Repos, ShouldEqual, 2)
+		So(report.Blobs, ShouldEqual, 6)
+		So(report.Problems, ShouldBeEmpty)
+
+		// a corrupt layer and a missing config, orphaned blobs going unnoticed
+		layer := img.Manifest.Layers[0].Digest
+		So(ioutil.WriteFile(path.Join(dir, "repo1", "blobs", "sha256", layer.Encoded()), []byte("corrupt"), 0600),
+			ShouldBeNil)
+
+		config := img.Manifest.Config.Digest
+		So(is.DeleteBlob("repo2", config.String()), ShouldBeNil)
+
+		content := []byte("orphaned")
+		_, _, err = is.FullBlobUpload("repo1", bytes.NewReader(content), godigest.FromBytes(content).String())
+		So(err, ShouldBeNil)
+
+		report, err = storage.ScrubStore(is, log)
+		So(err, ShouldBeNil)
+		So(report.Repos, ShouldEqual, 2)
+		So(report.Blobs, ShouldEqual, 5)
+
+		So(report.Problems, ShouldResemble, []storage.ScrubProblem{
+			{Repo: "repo1", Digest: layer, Problem: storage.ScrubCorrupt},
+			{Repo: "repo2", Digest: config, Problem: storage.ScrubMissing},
+		})
+	})
+
+	Convey("Scrub a storage not there", t, func() {
+		_, err := storage.Scrub("/does/not/exist", false, log.NewLogger("debug", ""))
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -1,15 +1,16 @@
 package storage
 
 import (
-	"context"
-	"crypto/sha256"
+	// digest algorithms supported, which go-digest needs linked in
+	_ "crypto/sha256"
+	_ "crypto/sha512"
 	"encoding/json"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,37 +20,89 @@ import (
 	guuid "github.com/gofrs/uuid"
 	godigest "github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
-	"github.com/opencontainers/umoci"
-	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/rs/zerolog"
 )
 
 const (
 	// BlobUploadDir defines the upload directory for blob uploads.
 	BlobUploadDir = ".uploads"
+	// LockName is the file locked by image stores sharing a storage root.
+	LockName      = ".zot.lock"
 	schemaVersion = 2
 	gcDelay       = 1 * time.Hour
+	// how many directories are read at a time looking for repositories.
+	repoWalkers = 16
+	// how many components repository names have at most, beyond which they aren't looked for.
+	maxRepoDepth = 16
+	// how many blobs are looked for at a time, checking those referenced by a manifest.
+	blobCheckers = 16
 )
 
-// BlobUpload models and upload request.
-type BlobUpload struct {
-	StoreName string
-	ID        string
+// ImageStoreLocal provides the image storage operations on a local filesystem, directly rather
+// than through a storage driver, for what drivers can't do: deduping blobs with hard links,
+// staging uploads in another directory, sharing the storage with other instances by locking
+// it, and checking and backing it up. Storage kept with a driver, the filesystem one included,
+// is served by an ImageStoreDriver instead.
+type ImageStoreLocal struct {
+	rootDir      string
+	uploadDir    string // uploads are staged in their repository's if not set
+	lock         *sync.RWMutex
+	repoLocks    *repoLocks
+	fileLock     *fileLock // extends lock to other processes, if the storage is shared
+	uploads      *uploadDigests
+	validRepos   *validRepos
+	catalog      *repoCatalog // nil if the storage is shared
+	indexBatches *indexBatches
+	blobSizes    *blobSizes // nil if the storage is shared
+	indexes      sync.Map   // *indexSnapshot by repository directory
+	cache        CacheDriver
+	gc           bool
+	gcs          *gcScheduler
+	dedupe       bool
+	copyBuffers  *CopyBuffers
+	writeBuffer  int  // size of the buffer uploads are written through, if any
+	dropCache    bool // drop finished uploads from the page cache
+	tracer       Tracer
+	log          zerolog.Logger
 }
 
-// ImageStore provides the image storage operations.
-type ImageStore struct {
-	rootDir     string
-	lock        *sync.RWMutex
-	blobUploads map[string]BlobUpload
-	cache       *Cache
-	gc          bool
-	dedupe      bool
-	log         zerolog.Logger
+// Options tune how image stores transfer blobs, those not set defaulting.
+type Options struct {
+	// CopyBufferSize is that of the buffers blobs are copied with, DefaultCopyBufferSize if not
+	// set.
+	CopyBufferSize int
+	// WriteBufferSize is that of the buffer uploads are written to their files through, on a
+	// filesystem, so that they're written in fewer, larger writes, e.g. to network filesystems;
+	// they're written as read from clients, with copy buffers, if not set.
+	WriteBufferSize int
+	// DropUploadCache has uploaded blobs written to disk and dropped from the page cache once
+	// finished, on a filesystem where supported (Linux), so that large pushes don't evict what's
+	// being pulled.
+	DropUploadCache bool
+	// CacheShards is how many dbs the dedupe cache under the root directory is spread over, one
+	// if not set.
+	CacheShards int
 }
 
 // NewImageStore returns a new image store backed by a file storage.
-func NewImageStore(rootDir string, gc bool, dedupe bool, log zlog.Logger) *ImageStore {
+func NewImageStore(rootDir string, gc bool, dedupe bool, opts Options, log zlog.Logger) *ImageStoreLocal {
+	return newImageStore(rootDir, gc, dedupe, false, opts, log)
+}
+
+// NewSharedImageStore returns a new image store backed by a file storage which other processes,
+// e.g. zot instances behind a load balancer, may use at the same time: its lock and dedupe cache
+// are shared with them.
+func NewSharedImageStore(rootDir string, gc bool, dedupe bool, opts Options, log zlog.Logger) *ImageStoreLocal {
+	if !sharedLockSupported {
+		log.Error().Msg("shared storage is not supported on this platform")
+		return nil
+	}
+
+	return newImageStore(rootDir, gc, dedupe, true, opts, log)
+}
+
+func newImageStore(rootDir string, gc bool, dedupe bool, shared bool, opts Options,
+	log zlog.Logger) *ImageStoreLocal {
 	if _, err := os.Stat(rootDir); os.IsNotExist(err) {
 		if err := os.MkdirAll(rootDir, 0700); err != nil {
 			log.Error().Err(err).Str("rootDir", rootDir).Msg("unable to create root dir")
@@ -57,74 +110,260 @@ func NewImageStore(rootDir string, gc bool, dedupe bool, log zlog.Logger) *Image
 		}
 	}
 
-	is := &ImageStore{
-		rootDir:     rootDir,
-		lock:        &sync.RWMutex{},
-		blobUploads: make(map[string]BlobUpload),
-		gc:          gc,
-		dedupe:      dedupe,
-		log:         log.With().Caller().Logger(),
+	if gc && !gcSupported {
+		log.Warn().Msg("garbage collection is not supported on this platform, disabling it")
+
+		gc = false
 	}
 
-	if dedupe {
-		is.cache = NewCache(rootDir, "cache", log)
+	if opts.DropUploadCache && !fadviseSupported {
+		log.Warn().Msg("dropping uploads from the page cache is not supported on this platform, disabling it")
+
+		opts.DropUploadCache = false
 	}
 
-	if gc {
-		// we use umoci GC to perform garbage-collection, but it uses its own logger
-		// - so capture those logs, could be useful
-		apexlog.SetLevel(apexlog.DebugLevel)
-		apexlog.SetHandler(apexlog.HandlerFunc(func(entry *apexlog.Entry) error {
-			e := log.Debug()
-			for k, v := range entry.Fields {
-				e = e.Interface(k, v)
-			}
-			e.Msg(entry.Message)
+	// dedupe hardlinks identical blobs, which not every filesystem supports
+	if dedupe && !hardlinksSupported(rootDir) {
+		log.Warn().Str("rootDir", rootDir).Msg("hard links are not supported by the filesystem, disabling dedupe")
+
+		dedupe = false
+	}
+
+	is := &ImageStoreLocal{
+		rootDir:      rootDir,
+		lock:         &sync.RWMutex{},
+		repoLocks:    newRepoLocks(),
+		uploads:      newUploadDigests(),
+		validRepos:   newValidRepos(),
+		indexBatches: newIndexBatches(),
+		gc:           gc,
+		dedupe:       dedupe,
+		copyBuffers:  NewCopyBuffers(opts.CopyBufferSize),
+		writeBuffer:  opts.WriteBufferSize,
+		dropCache:    opts.DropUploadCache,
+		log:          log.With().Caller().Logger(),
+	}
+
+	is.gcs = newGCScheduler(func(repo string) error {
+		traced := trace(is.tracer, "gc", repo, "")
+		err := is.garbageCollect(filepath.Join(rootDir, repo), repo)
+		traced(err)
+
+		return err
+	}, is.log)
+
+	if shared {
+		fl, err := newFileLock(filepath.Join(rootDir, LockName))
+		if err != nil {
+			log.Error().Err(err).Str("rootDir", rootDir).Msg("unable to create storage lock file")
 			return nil
-		}))
+		}
+
+		is.fileLock = fl
+	} else {
+		is.blobSizes = newBlobSizes()
+		is.catalog = newRepoCatalog()
+	}
+
+	// nil interfaces, rather than nil caches, if they can't be opened
+	if dedupe && shared {
+		if c := NewSharedCache(rootDir, CacheName, opts.CacheShards, log); c != nil {
+			is.cache = c
+		}
+	} else if dedupe {
+		if c := NewCache(rootDir, CacheName, opts.CacheShards, log); c != nil {
+			is.cache = c
+		}
 	}
 
 	return is
 }
 
+// SetCacheDriver dedupes blobs with the records of cache, e.g. on a server several replicas
+// share, rather than those of the dedupe cache under the root directory, closing it if open.
+// It must be set before the store is used.
+func (is *ImageStoreLocal) SetCacheDriver(cache CacheDriver) error {
+	if is.cache != nil {
+		if err := is.cache.Close(); err != nil {
+			return err
+		}
+	}
+
+	is.cache = cache
+	is.dedupe = cache != nil
+
+	return nil
+}
+
+// CaptureGCLogs redirects umoci's garbage-collection logs into log.
+// umoci uses apex/log's global logger, so this is left to the caller (the zot binary)
+// rather than done per ImageStore, which would clobber the global state of embedders.
+func CaptureGCLogs(log zlog.Logger) {
+	apexlog.SetLevel(apexlog.DebugLevel)
+	apexlog.SetHandler(apexlog.HandlerFunc(func(entry *apexlog.Entry) error {
+		e := log.Debug()
+		for k, v := range entry.Fields {
+			e = e.Interface(k, v)
+		}
+		e.Msg(entry.Message)
+		return nil
+	}))
+}
+
+// Close releases resources held by the image store, once done collecting garbage, if at it.
+func (is *ImageStoreLocal) Close() error {
+	is.gcs.close()
+
+	if is.fileLock != nil {
+		if err := is.fileLock.close(); err != nil {
+			return err
+		}
+	}
+
+	if is.cache != nil {
+		return is.cache.Close()
+	}
+
+	return nil
+}
+
+// ExportCache writes a consistent copy of the dedupe cache db to w, if dedupe is enabled with
+// the cache under the root directory.
+func (is *ImageStoreLocal) ExportCache(w io.Writer) error {
+	c, ok := is.cache.(*Cache)
+	if !ok {
+		return errors.ErrCacheNotFound
+	}
+
+	return c.Export(w)
+}
+
 // RLock read-lock.
-func (is *ImageStore) RLock() {
+func (is *ImageStoreLocal) RLock() {
 	is.lock.RLock()
+
+	if is.fileLock != nil {
+		is.fileLock.rlock()
+	}
 }
 
 // RUnlock read-unlock.
-func (is *ImageStore) RUnlock() {
+func (is *ImageStoreLocal) RUnlock() {
+	if is.fileLock != nil {
+		is.fileLock.runlock()
+	}
+
 	is.lock.RUnlock()
 }
 
 // Lock write-lock.
-func (is *ImageStore) Lock() {
+func (is *ImageStoreLocal) Lock() {
 	is.lock.Lock()
+
+	if is.fileLock != nil {
+		is.fileLock.wlock()
+	}
 }
 
 // Unlock write-unlock.
-func (is *ImageStore) Unlock() {
+func (is *ImageStoreLocal) Unlock() {
+	if is.fileLock != nil {
+		is.fileLock.wunlock()
+	}
+
 	is.lock.Unlock()
 }
 
+// RLockRepo read-locks a repository, leaving others to be written meanwhile. A shared storage
+// is read-locked as a whole, as other processes lock it.
+func (is *ImageStoreLocal) RLockRepo(repo string) {
+	if is.fileLock != nil {
+		is.RLock()
+		return
+	}
+
+	is.lock.RLock()
+	is.repoLocks.rlock(repo)
+}
+
+// RUnlockRepo read-unlocks a repository.
+func (is *ImageStoreLocal) RUnlockRepo(repo string) {
+	if is.fileLock != nil {
+		is.RUnlock()
+		return
+	}
+
+	is.repoLocks.runlock(repo)
+	is.lock.RUnlock()
+}
+
+// LockRepo write-locks a repository, leaving others to be read and written meanwhile. A shared
+// storage is write-locked as a whole, as other processes lock it.
+func (is *ImageStoreLocal) LockRepo(repo string) {
+	if is.fileLock != nil {
+		is.Lock()
+		return
+	}
+
+	// the store is only read-locked, so that Lock excludes every repository
+	is.lock.RLock()
+	is.repoLocks.wlock(repo)
+}
+
+// UnlockRepo write-unlocks a repository.
+func (is *ImageStoreLocal) UnlockRepo(repo string) {
+	if is.fileLock != nil {
+		is.Unlock()
+		return
+	}
+
+	is.repoLocks.wunlock(repo)
+	is.lock.RUnlock()
+}
+
+// SetGCInterval sets how long after being written to repositories are collected garbage in,
+// in the background, as soon as possible by default.
+func (is *ImageStoreLocal) SetGCInterval(interval time.Duration) {
+	is.gcs.setInterval(interval)
+}
+
+// SetGCParallelism sets how many repositories are collected garbage in at once, one if not set.
+func (is *ImageStoreLocal) SetGCParallelism(parallel int) {
+	is.gcs.setParallel(parallel)
+}
+
+// SetGCDeleteRate sets how many blobs garbage collection removes per second at most, across
+// repositories, for it not to slow down pulls, unlimited if not set.
+func (is *ImageStoreLocal) SetGCDeleteRate(rate int) {
+	is.gcs.setDeleteRate(rate)
+}
+
+// SetTracer has dedupe and garbage collection traced with t. It must be set before the store is
+// used.
+func (is *ImageStoreLocal) SetTracer(t Tracer) {
+	is.tracer = t
+}
+
 // InitRepo creates an image repository under this store.
-func (is *ImageStore) InitRepo(name string) error {
-	repoDir := path.Join(is.rootDir, name)
+func (is *ImageStoreLocal) InitRepo(name string) error {
+	repoDir := filepath.Join(is.rootDir, name)
 
-	is.Lock()
-	defer is.Unlock()
+	is.LockRepo(name)
+	defer is.UnlockRepo(name)
+
+	is.validRepos.forget(repoDir)
 
 	if fi, err := os.Stat(repoDir); err == nil && fi.IsDir() {
 		return nil
 	}
 
 	// create "blobs" subdir
-	ensureDir(path.Join(repoDir, "blobs"), is.log)
+	ensureDir(filepath.Join(repoDir, "blobs"), is.log)
 	// create BlobUploadDir subdir
-	ensureDir(path.Join(repoDir, BlobUploadDir), is.log)
+	ensureDir(filepath.Join(repoDir, BlobUploadDir), is.log)
 
 	// "oci-layout" file - create if it doesn't exist
-	ilPath := path.Join(repoDir, ispec.ImageLayoutFile)
+	ilPath := filepath.Join(repoDir, ispec.ImageLayoutFile)
 	if _, err := os.Stat(ilPath); err != nil {
 		il := ispec.ImageLayout{Version: ispec.ImageLayoutVersion}
 		buf, err := json.Marshal(il)
@@ -140,7 +379,7 @@ func (is *ImageStore) InitRepo(name string) error {
 	}
 
 	// "index.json" file - create if it doesn't exist
-	indexPath := path.Join(repoDir, "index.json")
+	indexPath := filepath.Join(repoDir, "index.json")
 	if _, err := os.Stat(indexPath); err != nil {
 		index := ispec.Index{}
 		index.SchemaVersion = 2
@@ -156,16 +395,89 @@ func (is *ImageStore) InitRepo(name string) error {
 		}
 	}
 
+	is.catalog.add(name)
+
+	return nil
+}
+
+// DeleteRepo deletes an image repository from this store, with its images and blobs, leaving
+// the repositories nested under it, if any.
+func (is *ImageStoreLocal) DeleteRepo(name string) error {
+	dir := filepath.Join(is.rootDir, name)
+
+	is.LockRepo(name)
+	defer is.UnlockRepo(name)
+
+	if ok, err := is.ValidateRepo(name); !ok || err != nil {
+		return errors.ErrRepoNotFound
+	}
+
+	// its blobs may no longer be deduped against
+	if is.cache != nil {
+		_ = filepath.Walk(filepath.Join(dir, "blobs"), func(path string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return nil
+			}
+
+			digest := godigest.NewDigestFromEncoded(godigest.Algorithm(filepath.Base(filepath.Dir(path))), fi.Name())
+			if err := is.cache.DeleteBlob(digest.String(), path); err != nil && err != errors.ErrCacheMiss {
+				is.log.Error().Err(err).Str("blobPath", path).Msg("unable to remove blob path from cache")
+			}
+
+			return nil
+		})
+	}
+
+	// index.json first, for what's left, if failing midway, not to be a repository anymore
+	for _, entry := range []string{"index.json", ispec.ImageLayoutFile, ReferrersFile, "blobs", BlobUploadDir} {
+		if err := os.RemoveAll(filepath.Join(dir, entry)); err != nil {
+			is.log.Error().Err(err).Str("dir", dir).Msg("unable to delete repository")
+			return err
+		}
+	}
+
+	// and its uploads in progress, if staged elsewhere
+	if is.uploadDir != "" {
+		uploads := filepath.Join(is.uploadDir, name)
+		files, _ := ioutil.ReadDir(uploads)
+
+		for _, file := range files {
+			if !file.IsDir() {
+				_ = os.Remove(filepath.Join(uploads, file.Name()))
+			}
+		}
+
+		_ = os.Remove(uploads)
+	}
+
+	// along with the directories left empty, unless other repositories are nested under it
+	for d := dir; d != is.rootDir && strings.HasPrefix(d, is.rootDir); d = filepath.Dir(d) {
+		if err := os.Remove(d); err != nil {
+			break
+		}
+	}
+
+	is.validRepos.forget(dir)
+	is.indexes.Delete(dir)
+	is.blobSizes.forgetRepo(dir)
+	is.catalog.remove(name)
+
 	return nil
 }
 
 // ValidateRepo validates that the repository layout is complaint with the OCI repo layout.
-func (is *ImageStore) ValidateRepo(name string) (bool, error) {
+func (is *ImageStoreLocal) ValidateRepo(name string) (bool, error) {
 	// https://github.com/opencontainers/image-spec/blob/master/image-layout.md#content
 	// at least, expect at least 3 entries - ["blobs", "oci-layout", "index.json"]
 	// and an additional/optional BlobUploadDir in each image store
-	dir := path.Join(is.rootDir, name)
-	if !dirExists(dir) {
+	dir := filepath.Join(is.rootDir, name)
+
+	fi, err := os.Stat(dir)
+	if err == nil && is.validRepos.valid(dir, fi) {
+		return true, nil
+	}
+
+	if !dirExists(dir) || err != nil {
 		return false, errors.ErrRepoNotFound
 	}
 
@@ -174,6 +486,27 @@ func (is *ImageStore) ValidateRepo(name string) (bool, error) {
 		is.log.Error().Err(err).Str("dir", dir).Msg("unable to read directory")
 		return false, errors.ErrRepoNotFound
 	}
+
+	ok, err := validateLayout(dir, files)
+	if ok {
+		is.validRepos.add(dir, fi)
+	}
+
+	return ok, err
+}
+
+func hasIndex(files []os.FileInfo) bool {
+	for _, file := range files {
+		if file.Name() == "index.json" && !file.IsDir() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateLayout validates the layout of a repository directory, given its entries.
+func validateLayout(dir string, files []os.FileInfo) (bool, error) {
 	// nolint:gomnd
 	if len(files) < 3 {
 		return false, errors.ErrRepoBadVersion
@@ -199,7 +532,7 @@ func (is *ImageStore) ValidateRepo(name string) (bool, error) {
 		}
 	}
 
-	buf, err := ioutil.ReadFile(path.Join(dir, ispec.ImageLayoutFile))
+	buf, err := ioutil.ReadFile(filepath.Join(dir, ispec.ImageLayoutFile))
 	if err != nil {
 		return false, err
 	}
@@ -216,93 +549,158 @@ func (is *ImageStore) ValidateRepo(name string) (bool, error) {
 	return true, nil
 }
 
-// GetRepositories returns a list of all the repositories under this store.
-func (is *ImageStore) GetRepositories() ([]string, error) {
+// GetRepositories returns a list of all the repositories under this store, sorted.
+func (is *ImageStoreLocal) GetRepositories() ([]string, error) {
+	if repos, ok := is.catalog.list(); ok {
+		return repos, nil
+	}
+
 	dir := is.rootDir
 
 	is.RLock()
 	defer is.RUnlock()
 
-	_, err := ioutil.ReadDir(dir)
+	root, err := os.Stat(dir)
+	if err == nil {
+		_, err = ioutil.ReadDir(dir)
+	}
+
 	if err != nil {
 		is.log.Error().Err(err).Msg("failure walking storage root-dir")
 		return nil, err
 	}
 
-	stores := make([]string, 0)
-	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	stores, err := is.walkRepos(root)
+
+	// repository names use forward slashes, regardless of the platform
+	for i := range stores {
+		stores[i] = filepath.ToSlash(stores[i])
+	}
+
+	sort.Strings(stores)
+
+	if err == nil {
+		is.catalog.set(stores)
+	}
+
+	return stores, err
+}
+
+// walkRepos walks the root directory with up to repoWalkers directories read at a time,
+// returning the repositories found, and the first failure to read a directory, if any.
+// Only directories which may be, or hold, repositories are descended into: not the blobs
+// of those with an index.json, be they valid repositories or not, nor hidden directories
+// such as uploads, nor beyond maxRepoDepth. The layout of repositories already found
+// valid isn't read again.
+func (is *ImageStoreLocal) walkRepos(root os.FileInfo) ([]string, error) {
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		firstErr error
+	)
+
+	repos := make([]string, 0)
+
+	walkers := make(chan struct{}, repoWalkers)
+
+	var walk func(rel string, fi os.FileInfo, depth int)
+
+	walk = func(rel string, fi os.FileInfo, depth int) {
+		defer wg.Done()
+
+		dir := filepath.Join(is.rootDir, rel)
+
+		walkers <- struct{}{}
+		files, err := ioutil.ReadDir(dir)
+
+		isRepo := false
+		if err == nil {
+			if isRepo = is.validRepos.valid(dir, fi); !isRepo {
+				if isRepo, _ = validateLayout(dir, files); isRepo {
+					is.validRepos.add(dir, fi)
+				}
+			}
 		}
+		<-walkers
 
-		if !info.IsDir() {
-			return nil
+		lock.Lock()
+		if err != nil && firstErr == nil {
+			firstErr = err
 		}
 
-		rel, err := filepath.Rel(is.rootDir, path)
-		if err != nil {
-			return nil
+		if isRepo {
+			repos = append(repos, rel)
 		}
+		lock.Unlock()
 
-		if ok, err := is.ValidateRepo(rel); !ok || err != nil {
-			return nil
+		if depth == maxRepoDepth {
+			return
 		}
 
-		//is.log.Debug().Str("dir", path).Str("name", info.Name()).Msg("found image store")
-		stores = append(stores, rel)
+		plausible := isRepo || hasIndex(files)
 
-		return nil
-	})
+		for _, file := range files {
+			if !file.IsDir() || strings.HasPrefix(file.Name(), ".") || (plausible && file.Name() == "blobs") {
+				continue
+			}
 
-	return stores, err
+			wg.Add(1)
+
+			go walk(filepath.Join(rel, file.Name()), file, depth+1)
+		}
+	}
+
+	wg.Add(1)
+	walk(".", root, 0)
+	wg.Wait()
+
+	return repos, firstErr
 }
 
 // GetImageTags returns a list of image tags available in the specified repository.
-func (is *ImageStore) GetImageTags(repo string) ([]string, error) {
-	dir := path.Join(is.rootDir, repo)
+func (is *ImageStoreLocal) GetImageTags(repo string) ([]string, error) {
+	dir := filepath.Join(is.rootDir, repo)
 	if !dirExists(dir) {
 		return nil, errors.ErrRepoNotFound
 	}
 
-	is.RLock()
-	defer is.RUnlock()
-
-	buf, err := ioutil.ReadFile(path.Join(dir, "index.json"))
+	index, err := is.readIndex(dir)
 	if err != nil {
 		is.log.Error().Err(err).Str("dir", dir).Msg("failed to read index.json")
 		return nil, errors.ErrRepoNotFound
 	}
 
-	var index ispec.Index
-	if err := json.Unmarshal(buf, &index); err != nil {
-		is.log.Error().Err(err).Str("dir", dir).Msg("invalid JSON")
+	return getTags(index), nil
+}
+
+// GetIndexContent returns the contents of the index.json of a repository.
+func (is *ImageStoreLocal) GetIndexContent(repo string) ([]byte, error) {
+	dir := filepath.Join(is.rootDir, repo)
+	if !dirExists(dir) {
 		return nil, errors.ErrRepoNotFound
 	}
 
-	tags := make([]string, 0)
+	is.RLockRepo(repo)
+	defer is.RUnlockRepo(repo)
 
-	for _, manifest := range index.Manifests {
-		v, ok := manifest.Annotations[ispec.AnnotationRefName]
-		if ok {
-			tags = append(tags, v)
-		}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		is.log.Error().Err(err).Str("dir", dir).Msg("failed to read index.json")
+		return nil, errors.ErrRepoNotFound
 	}
 
-	return tags, nil
+	return buf, nil
 }
 
 // GetImageManifest returns the image manifest of an image in the specific repository.
-func (is *ImageStore) GetImageManifest(repo string, reference string) ([]byte, string, string, error) {
-	dir := path.Join(is.rootDir, repo)
+func (is *ImageStoreLocal) GetImageManifest(repo string, reference string) ([]byte, string, string, error) {
+	dir := filepath.Join(is.rootDir, repo)
 	if !dirExists(dir) {
 		return nil, "", "", errors.ErrRepoNotFound
 	}
 
-	is.RLock()
-	defer is.RUnlock()
-
-	buf, err := ioutil.ReadFile(path.Join(dir, "index.json"))
-
+	// without locking the store: the manifest, if listed, was written before the index
+	index, err := is.readIndex(dir)
 	if err != nil {
 		is.log.Error().Err(err).Str("dir", dir).Msg("failed to read index.json")
 
@@ -313,44 +711,17 @@ func (is *ImageStore) GetImageManifest(repo string, reference string) ([]byte, s
 		return nil, "", "", err
 	}
 
-	var index ispec.Index
-	if err := json.Unmarshal(buf, &index); err != nil {
-		is.log.Error().Err(err).Str("dir", dir).Msg("invalid JSON")
-		return nil, "", "", err
-	}
-
-	found := false
-
-	var digest godigest.Digest
-
-	mediaType := ""
-
-	for _, m := range index.Manifests {
-		if reference == m.Digest.String() {
-			digest = m.Digest
-			mediaType = m.MediaType
-			found = true
-
-			break
-		}
-
-		v, ok := m.Annotations[ispec.AnnotationRefName]
-		if ok && v == reference {
-			digest = m.Digest
-			mediaType = m.MediaType
-			found = true
-
-			break
-		}
-	}
-
+	desc, found := findManifest(index, reference)
 	if !found {
 		return nil, "", "", errors.ErrManifestNotFound
 	}
 
-	p := path.Join(dir, "blobs", digest.Algorithm().String(), digest.Encoded())
+	digest := desc.Digest
+	mediaType := desc.MediaType
+
+	p := filepath.Join(dir, "blobs", digest.Algorithm().String(), digest.Encoded())
 
-	buf, err = ioutil.ReadFile(p)
+	buf, err := ioutil.ReadFile(p)
 
 	if err != nil {
 		is.log.Error().Err(err).Str("blob", p).Msg("failed to read manifest")
@@ -362,270 +733,289 @@ func (is *ImageStore) GetImageManifest(repo string, reference string) ([]byte, s
 		return nil, "", "", err
 	}
 
-	var manifest ispec.Manifest
-	if err := json.Unmarshal(buf, &manifest); err != nil {
-		is.log.Error().Err(err).Str("dir", dir).Msg("invalid JSON")
-		return nil, "", "", err
+	// checked rather than parsed, as it's returned as is
+	if !json.Valid(buf) {
+		is.log.Error().Str("dir", dir).Str("digest", digest.String()).Msg("invalid JSON")
+		return nil, "", "", errors.ErrBadManifest
 	}
 
 	return buf, digest.String(), mediaType, nil
 }
 
 // PutImageManifest adds an image manifest to the repository.
-func (is *ImageStore) PutImageManifest(repo string, reference string, mediaType string,
+func (is *ImageStoreLocal) PutImageManifest(repo string, reference string, mediaType string,
 	body []byte) (string, error) {
 	if err := is.InitRepo(repo); err != nil {
 		is.log.Debug().Err(err).Msg("init repo")
 		return "", err
 	}
 
-	if mediaType != ispec.MediaTypeImageManifest {
-		is.log.Debug().Interface("actual", mediaType).
-			Interface("expected", ispec.MediaTypeImageManifest).Msg("bad manifest media type")
-		return "", errors.ErrBadManifest
+	m, err := validateManifest(mediaType, body, is.log)
+	if err != nil {
+		return "", err
 	}
 
-	if len(body) == 0 {
-		is.log.Debug().Int("len", len(body)).Msg("invalid body length")
-		return "", errors.ErrBadManifest
+	if digest, missing := is.missingBlob(repo, reference, m.digests()); missing {
+		return digest.String(), errors.ErrBlobNotFound
+	}
+
+	mDigest := manifestDigest(reference, body)
+
+	refIsDigest, err := checkManifestReference(reference, mDigest, is.log)
+	if err != nil {
+		return "", err
 	}
 
-	var m ispec.Manifest
-	if err := json.Unmarshal(body, &m); err != nil {
-		is.log.Error().Err(err).Msg("unable to unmarshal JSON")
-		return "", errors.ErrBadManifest
+	dir := filepath.Join(is.rootDir, repo)
+	u := &indexUpdate{reference: reference, refIsDigest: refIsDigest, mediaType: mediaType, digest: mDigest,
+		body: body}
+
+	// garbage is collected in the background, once the index changed
+	if is.updateIndex(repo, dir, u) && is.gc {
+		is.gcs.queue(repo)
 	}
 
-	if m.SchemaVersion != schemaVersion {
-		is.log.Error().Int("SchemaVersion", m.SchemaVersion).Msg("invalid manifest")
-		return "", errors.ErrBadManifest
+	if u.err != nil {
+		return "", u.err
 	}
 
-	for _, l := range m.Layers {
-		digest := l.Digest
-		blobPath := is.BlobPath(repo, digest)
-		is.log.Info().Str("blobPath", blobPath).Str("reference", reference).Msg("manifest layers")
+	return u.desc.Digest.String(), nil
+}
 
-		if _, err := os.Stat(blobPath); err != nil {
-			is.log.Error().Err(err).Str("blobPath", blobPath).Msg("unable to find blob")
-			return digest.String(), errors.ErrBlobNotFound
-		}
+// missingBlob returns the first of the blobs referenced by a manifest which isn't found in its
+// repository, if any, looking for up to blobCheckers at a time, as images may have many
+// layers, and stat'ing each may take a while, e.g. on network filesystems.
+func (is *ImageStoreLocal) missingBlob(repo string, reference string,
+	digests []godigest.Digest) (godigest.Digest, bool) {
+	var wg sync.WaitGroup
+
+	missing := make([]bool, len(digests))
+	checkers := make(chan struct{}, blobCheckers)
+
+	for i, digest := range digests {
+		wg.Add(1)
+
+		checkers <- struct{}{}
+
+		go func(i int, digest godigest.Digest) {
+			defer wg.Done()
+			defer func() { <-checkers }()
+
+			blobPath := is.BlobPath(repo, digest)
+			is.log.Info().Str("blobPath", blobPath).Str("reference", reference).Msg("manifest layers")
+
+			if _, err := is.blobSizes.stat(blobPath); err != nil {
+				is.log.Error().Err(err).Str("blobPath", blobPath).Msg("unable to find blob")
+
+				missing[i] = true
+			}
+		}(i, digest)
 	}
 
-	mDigest := godigest.FromBytes(body)
-	refIsDigest := false
-	d, err := godigest.Parse(reference)
+	wg.Wait()
 
-	if err == nil {
-		if d.String() != mDigest.String() {
-			is.log.Error().Str("actual", mDigest.String()).Str("expected", d.String()).
-				Msg("manifest digest is not valid")
-			return "", errors.ErrBadManifest
+	for i, digest := range digests {
+		if missing[i] {
+			return digest, true
 		}
+	}
 
-		refIsDigest = true
+	return "", false
+}
+
+// DeleteImageManifest deletes the image manifest from the repository.
+func (is *ImageStoreLocal) DeleteImageManifest(repo string, reference string) error {
+	dir := filepath.Join(is.rootDir, repo)
+	if !dirExists(dir) {
+		return errors.ErrRepoNotFound
 	}
 
-	is.Lock()
-	defer is.Unlock()
+	// as per spec "reference" can only be a digest and not a tag
+	digest, err := godigest.Parse(reference)
+	if err != nil {
+		is.log.Error().Err(err).Msg("invalid reference")
+		return errors.ErrBadManifest
+	}
+
+	is.LockRepo(repo)
 
-	dir := path.Join(is.rootDir, repo)
-	buf, err := ioutil.ReadFile(path.Join(dir, "index.json"))
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
 
 	if err != nil {
 		is.log.Error().Err(err).Str("dir", dir).Msg("failed to read index.json")
-		return "", err
+		is.UnlockRepo(repo)
+
+		return err
 	}
 
 	var index ispec.Index
 	if err := json.Unmarshal(buf, &index); err != nil {
 		is.log.Error().Err(err).Str("dir", dir).Msg("invalid JSON")
-		return "", errors.ErrRepoBadVersion
-	}
+		is.UnlockRepo(repo)
 
-	updateIndex := true
-	// create a new descriptor
-	desc := ispec.Descriptor{MediaType: mediaType, Size: int64(len(body)), Digest: mDigest,
-		Platform: &ispec.Platform{Architecture: "amd64", OS: "linux"}}
-	if !refIsDigest {
-		desc.Annotations = map[string]string{ispec.AnnotationRefName: reference}
+		return err
 	}
 
-	for i, m := range index.Manifests {
-		if reference == m.Digest.String() {
-			// nothing changed, so don't update
-			desc = m
-			updateIndex = false
+	outIndex, found := removeManifest(index, reference)
+	if !found {
+		is.UnlockRepo(repo)
+		return errors.ErrManifestNotFound
+	}
 
-			break
-		}
+	// now update "index.json"
+	dir = filepath.Join(is.rootDir, repo)
 
-		v, ok := m.Annotations[ispec.AnnotationRefName]
-		if ok && v == reference {
-			if m.Digest.String() == mDigest.String() {
-				// nothing changed, so don't update
-				desc = m
-				updateIndex = false
+	if err := is.writeIndex(dir, outIndex); err != nil {
+		is.UnlockRepo(repo)
+		return err
+	}
 
-				break
-			}
-			// manifest contents have changed for the same tag,
-			// so update index.json descriptor
-			is.log.Info().
-				Int64("old size", desc.Size).
-				Int64("new size", int64(len(body))).
-				Str("old digest", desc.Digest.String()).
-				Str("new digest", mDigest.String()).
-				Msg("updating existing tag with new manifest contents")
+	p := filepath.Join(dir, "blobs", digest.Algorithm().String(), digest.Encoded())
 
-			desc = m
-			desc.Size = int64(len(body))
-			desc.Digest = mDigest
+	_ = os.Remove(p)
+	is.blobSizes.forget(p)
 
-			index.Manifests = append(index.Manifests[:i], index.Manifests[i+1:]...)
+	is.pruneReferrers(dir, outIndex)
 
-			break
-		}
-	}
+	is.UnlockRepo(repo)
 
-	if !updateIndex {
-		return desc.Digest.String(), nil
+	if is.gc {
+		is.gcs.queue(repo)
 	}
 
-	// write manifest to "blobs"
-	dir = path.Join(is.rootDir, repo, "blobs", mDigest.Algorithm().String())
-	ensureDir(dir, is.log)
-	file := path.Join(dir, mDigest.Encoded())
+	return nil
+}
 
-	if err := ioutil.WriteFile(file, body, 0600); err != nil {
-		is.log.Error().Err(err).Str("file", file).Msg("unable to write")
-		return "", err
+// GetReferrers returns the descriptors of the manifests of a repository whose subject is
+// digest, of artifactType unless empty.
+func (is *ImageStoreLocal) GetReferrers(repo string, digest string, artifactType string) ([]Referrer, error) {
+	dir := filepath.Join(is.rootDir, repo)
+	if !dirExists(dir) {
+		return nil, errors.ErrRepoNotFound
 	}
 
-	// now update "index.json"
-	index.Manifests = append(index.Manifests, desc)
-	dir = path.Join(is.rootDir, repo)
-	file = path.Join(dir, "index.json")
-	buf, err = json.Marshal(index)
-
+	subject, err := godigest.Parse(digest)
 	if err != nil {
-		is.log.Error().Err(err).Str("file", file).Msg("unable to marshal JSON")
-		return "", err
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to parse digest")
+		return nil, errors.ErrBadBlobDigest
 	}
 
-	if err := ioutil.WriteFile(file, buf, 0644); err != nil { //nolint: gosec
-		is.log.Error().Err(err).Str("file", file).Msg("unable to write")
-		return "", err
+	index, err := is.readIndex(dir)
+	if err != nil {
+		is.log.Error().Err(err).Str("dir", dir).Msg("failed to read index.json")
+		return nil, errors.ErrRepoNotFound
 	}
 
-	if is.gc {
-		oci, err := umoci.OpenLayout(dir)
-		if err != nil {
-			return "", err
-		}
-		defer oci.Close()
-
-		if err := oci.GC(context.Background(), ifOlderThan(is, repo, gcDelay)); err != nil {
-			return "", err
-		}
+	refs, err := is.readReferrers(dir)
+	if err != nil {
+		is.log.Error().Err(err).Str("dir", dir).Msg("failed to read referrers")
+		return nil, err
 	}
 
-	return desc.Digest.String(), nil
+	return refs.list(index, subject, artifactType), nil
 }
 
-// DeleteImageManifest deletes the image manifest from the repository.
-func (is *ImageStore) DeleteImageManifest(repo string, reference string) error {
-	dir := path.Join(is.rootDir, repo)
+// DeleteImageTag removes a tag from the repository, leaving garbage collection, if enabled,
+// to remove the manifest and blobs nothing else references.
+func (is *ImageStoreLocal) DeleteImageTag(repo string, tag string) error {
+	dir := filepath.Join(is.rootDir, repo)
 	if !dirExists(dir) {
 		return errors.ErrRepoNotFound
 	}
 
-	// as per spec "reference" can only be a digest and not a tag
-	digest, err := godigest.Parse(reference)
-	if err != nil {
-		is.log.Error().Err(err).Msg("invalid reference")
-		return errors.ErrBadManifest
-	}
-
-	is.Lock()
-	defer is.Unlock()
-
-	buf, err := ioutil.ReadFile(path.Join(dir, "index.json"))
+	is.LockRepo(repo)
 
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
 	if err != nil {
 		is.log.Error().Err(err).Str("dir", dir).Msg("failed to read index.json")
+		is.UnlockRepo(repo)
+
 		return err
 	}
 
 	var index ispec.Index
 	if err := json.Unmarshal(buf, &index); err != nil {
 		is.log.Error().Err(err).Str("dir", dir).Msg("invalid JSON")
-		return err
-	}
-
-	found := false
+		is.UnlockRepo(repo)
 
-	var m ispec.Descriptor
-
-	// we are deleting, so keep only those manifests that don't match
-	outIndex := index
-	outIndex.Manifests = []ispec.Descriptor{}
-
-	for _, m = range index.Manifests {
-		if reference == m.Digest.String() {
-			found = true
-			continue
-		}
-
-		outIndex.Manifests = append(outIndex.Manifests, m)
+		return err
 	}
 
+	outIndex, found := removeTag(index, tag)
 	if !found {
+		is.UnlockRepo(repo)
 		return errors.ErrManifestNotFound
 	}
 
-	// now update "index.json"
-	dir = path.Join(is.rootDir, repo)
-	file := path.Join(dir, "index.json")
-	buf, err = json.Marshal(outIndex)
-
-	if err != nil {
+	if err := is.writeIndex(dir, outIndex); err != nil {
+		is.UnlockRepo(repo)
 		return err
 	}
 
-	if err := ioutil.WriteFile(file, buf, 0644); err != nil { //nolint: gosec
-		return err
-	}
+	is.UnlockRepo(repo)
 
 	if is.gc {
-		oci, err := umoci.OpenLayout(dir)
-		if err != nil {
-			return err
-		}
-		defer oci.Close()
-
-		if err := oci.GC(context.Background(), ifOlderThan(is, repo, gcDelay)); err != nil {
-			return err
-		}
+		is.gcs.queue(repo)
 	}
 
-	p := path.Join(dir, "blobs", digest.Algorithm().String(), digest.Encoded())
+	return nil
+}
 
-	_ = os.Remove(p)
+// SetUploadDir has blob uploads staged under dir, e.g. on a faster filesystem than the root
+// directory, rather than in their repository. It must be set before the store is used.
+func (is *ImageStoreLocal) SetUploadDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		is.log.Error().Err(err).Str("uploadDir", dir).Msg("unable to create upload dir")
+		return err
+	}
+
+	is.uploadDir = dir
 
 	return nil
 }
 
 // BlobUploadPath returns the upload path for a blob in this store.
-func (is *ImageStore) BlobUploadPath(repo string, uuid string) string {
-	dir := path.Join(is.rootDir, repo)
-	blobUploadPath := path.Join(dir, BlobUploadDir, uuid)
+func (is *ImageStoreLocal) BlobUploadPath(repo string, uuid string) string {
+	if is.uploadDir != "" {
+		return filepath.Join(is.uploadDir, repo, uuid)
+	}
+
+	dir := filepath.Join(is.rootDir, repo)
+	blobUploadPath := filepath.Join(dir, BlobUploadDir, uuid)
 
 	return blobUploadPath
 }
 
+// stageUpload returns the path of a finished upload once in its repository, to be moved into
+// place, moving it there from the upload dir, if set, or copying it if it's on another
+// filesystem. This is done before locking the store, as copying large blobs takes a while.
+func (is *ImageStoreLocal) stageUpload(repo string, src string) (string, error) {
+	if is.uploadDir == "" {
+		return src, nil
+	}
+
+	dst := filepath.Join(is.rootDir, repo, BlobUploadDir, filepath.Base(src))
+
+	if err := rename(src, dst); err == nil {
+		return dst, nil
+	}
+
+	if err := copyFile(src, dst); err != nil {
+		is.log.Error().Err(err).Str("src", src).Str("dst", dst).Msg("unable to copy upload into repository")
+		os.Remove(dst)
+
+		return "", err
+	}
+
+	if err := os.Remove(src); err != nil {
+		is.log.Warn().Err(err).Str("src", src).Msg("unable to remove upload copied into repository")
+	}
+
+	return dst, nil
+}
+
 // NewBlobUpload returns the unique ID for an upload in progress.
-func (is *ImageStore) NewBlobUpload(repo string) (string, error) {
+func (is *ImageStoreLocal) NewBlobUpload(repo string) (string, error) {
 	if err := is.InitRepo(repo); err != nil {
 		return "", err
 	}
@@ -637,6 +1027,8 @@ func (is *ImageStore) NewBlobUpload(repo string) (string, error) {
 
 	u := uuid.String()
 	blobUploadPath := is.BlobUploadPath(repo, u)
+	ensureDir(filepath.Dir(blobUploadPath), is.log)
+
 	file, err := os.OpenFile(blobUploadPath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
 
 	if err != nil {
@@ -644,11 +1036,13 @@ func (is *ImageStore) NewBlobUpload(repo string) (string, error) {
 	}
 	defer file.Close()
 
+	is.uploads.start(blobUploadPath)
+
 	return u, nil
 }
 
 // GetBlobUpload returns the current size of a blob upload.
-func (is *ImageStore) GetBlobUpload(repo string, uuid string) (int64, error) {
+func (is *ImageStoreLocal) GetBlobUpload(repo string, uuid string) (int64, error) {
 	blobUploadPath := is.BlobUploadPath(repo, uuid)
 	fi, err := os.Stat(blobUploadPath)
 
@@ -665,7 +1059,7 @@ func (is *ImageStore) GetBlobUpload(repo string, uuid string) (int64, error) {
 
 // PutBlobChunkStreamed appends another chunk of data to the specified blob. It returns
 // the number of actual bytes to the blob.
-func (is *ImageStore) PutBlobChunkStreamed(repo string, uuid string, body io.Reader) (int64, error) {
+func (is *ImageStoreLocal) PutBlobChunkStreamed(repo string, uuid string, body io.Reader) (int64, error) {
 	if err := is.InitRepo(repo); err != nil {
 		return -1, err
 	}
@@ -687,18 +1081,24 @@ func (is *ImageStore) PutBlobChunkStreamed(repo string, uuid string, body io.Rea
 	}
 	defer file.Close()
 
-	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
 		is.log.Fatal().Err(err).Msg("failed to seek file")
 	}
 
-	n, err := io.Copy(file, body)
+	w, flush := bufferWrites(file, is.writeBuffer)
+	n, err := is.copyBuffers.Copy(is.uploads.writer(blobUploadPath, offset, w), body)
+
+	if ferr := flush(); err == nil {
+		err = ferr
+	}
 
 	return n, err
 }
 
 // PutBlobChunk writes another chunk of data to the specified blob. It returns
 // the number of actual bytes to the blob.
-func (is *ImageStore) PutBlobChunk(repo string, uuid string, from int64, to int64,
+func (is *ImageStoreLocal) PutBlobChunk(repo string, uuid string, from int64, to int64,
 	body io.Reader) (int64, error) {
 	if err := is.InitRepo(repo); err != nil {
 		return -1, err
@@ -731,13 +1131,36 @@ func (is *ImageStore) PutBlobChunk(repo string, uuid string, from int64, to int6
 		is.log.Fatal().Err(err).Msg("failed to seek file")
 	}
 
-	n, err := io.Copy(file, body)
+	w, flush := bufferWrites(file, is.writeBuffer)
+	n, err := is.copyBuffers.Copy(is.uploads.writer(blobUploadPath, from, w), body)
+
+	if ferr := flush(); err == nil {
+		err = ferr
+	}
 
 	return n, err
 }
 
+// dropUploadCache drops a finished upload from the page cache, if set to, which is only
+// logged if it fails, as the upload doesn't.
+func (is *ImageStoreLocal) dropUploadCache(path string) {
+	if !is.dropCache {
+		return
+	}
+
+	file, err := os.Open(path)
+	if err == nil {
+		err = dropFileCache(file)
+		file.Close()
+	}
+
+	if err != nil {
+		is.log.Warn().Err(err).Str("blob", path).Msg("unable to drop blob from page cache")
+	}
+}
+
 // BlobUploadInfo returns the current blob size in bytes.
-func (is *ImageStore) BlobUploadInfo(repo string, uuid string) (int64, error) {
+func (is *ImageStoreLocal) BlobUploadInfo(repo string, uuid string) (int64, error) {
 	blobUploadPath := is.BlobUploadPath(repo, uuid)
 	fi, err := os.Stat(blobUploadPath)
 
@@ -752,7 +1175,7 @@ func (is *ImageStore) BlobUploadInfo(repo string, uuid string) (int64, error) {
 }
 
 // FinishBlobUpload finalizes the blob upload and moves blob the repository.
-func (is *ImageStore) FinishBlobUpload(repo string, uuid string, body io.Reader, digest string) error {
+func (is *ImageStoreLocal) FinishBlobUpload(repo string, uuid string, body io.Reader, digest string) error {
 	dstDigest, err := godigest.Parse(digest)
 	if err != nil {
 		is.log.Error().Err(err).Str("digest", digest).Msg("failed to parse digest")
@@ -761,24 +1184,28 @@ func (is *ImageStore) FinishBlobUpload(repo string, uuid string, body io.Reader,
 
 	src := is.BlobUploadPath(repo, uuid)
 
-	_, err = os.Stat(src)
+	fi, err := os.Stat(src)
 	if err != nil {
 		is.log.Error().Err(err).Str("blob", src).Msg("failed to stat blob")
 		return errors.ErrUploadNotFound
 	}
 
-	f, err := os.Open(src)
-	if err != nil {
-		is.log.Error().Err(err).Str("blob", src).Msg("failed to open blob")
-		return errors.ErrUploadNotFound
-	}
+	// digested as it was written, with the canonical algorithm, unless it can't have been
+	srcDigest, ok := is.uploads.digest(src, fi.Size())
+	if !ok || srcDigest.Algorithm() != dstDigest.Algorithm() {
+		f, err := os.Open(src)
+		if err != nil {
+			is.log.Error().Err(err).Str("blob", src).Msg("failed to open blob")
+			return errors.ErrUploadNotFound
+		}
 
-	srcDigest, err := godigest.FromReader(f)
-	f.Close()
+		srcDigest, err = dstDigest.Algorithm().FromReader(f)
+		f.Close()
 
-	if err != nil {
-		is.log.Error().Err(err).Str("blob", src).Msg("failed to open blob")
-		return errors.ErrBadBlobDigest
+		if err != nil {
+			is.log.Error().Err(err).Str("blob", src).Msg("failed to open blob")
+			return errors.ErrBadBlobDigest
+		}
 	}
 
 	if srcDigest != dstDigest {
@@ -787,33 +1214,48 @@ func (is *ImageStore) FinishBlobUpload(repo string, uuid string, body io.Reader,
 		return errors.ErrBadBlobDigest
 	}
 
-	dir := path.Join(is.rootDir, repo, "blobs", dstDigest.Algorithm().String())
+	upload := src
+
+	if src, err = is.stageUpload(repo, src); err != nil {
+		return err
+	}
 
-	is.Lock()
-	defer is.Unlock()
+	is.dropUploadCache(src)
+
+	dir := filepath.Join(is.rootDir, repo, "blobs", dstDigest.Algorithm().String())
+
+	is.LockRepo(repo)
+	defer is.UnlockRepo(repo)
 
 	ensureDir(dir, is.log)
 	dst := is.BlobPath(repo, dstDigest)
+	defer is.blobSizes.forget(dst)
 
 	if is.dedupe && is.cache != nil {
-		if err := is.DedupeBlob(src, dstDigest, dst); err != nil {
+		traced := trace(is.tracer, "dedupe", repo, dstDigest.String())
+		err = is.DedupeBlob(src, dstDigest, dst)
+		traced(err)
+
+		if err != nil {
 			is.log.Error().Err(err).Str("src", src).Str("dstDigest", dstDigest.String()).
 				Str("dst", dst).Msg("unable to dedupe blob")
 			return err
 		}
 	} else {
-		if err := os.Rename(src, dst); err != nil {
+		if err := rename(src, dst); err != nil {
 			is.log.Error().Err(err).Str("src", src).Str("dstDigest", dstDigest.String()).
 				Str("dst", dst).Msg("unable to finish blob")
 			return err
 		}
 	}
 
+	is.uploads.forget(upload)
+
 	return nil
 }
 
 // FullBlobUpload handles a full blob upload, and no partial session is created.
-func (is *ImageStore) FullBlobUpload(repo string, body io.Reader, digest string) (string, int64, error) {
+func (is *ImageStoreLocal) FullBlobUpload(repo string, body io.Reader, digest string) (string, int64, error) {
 	if err := is.InitRepo(repo); err != nil {
 		return "", -1, err
 	}
@@ -832,6 +1274,7 @@ func (is *ImageStore) FullBlobUpload(repo string, body io.Reader, digest string)
 	uuid := u.String()
 
 	src := is.BlobUploadPath(repo, uuid)
+	ensureDir(filepath.Dir(src), is.log)
 
 	f, err := os.Create(src)
 	if err != nil {
@@ -839,39 +1282,57 @@ func (is *ImageStore) FullBlobUpload(repo string, body io.Reader, digest string)
 		return "", -1, errors.ErrUploadNotFound
 	}
 
-	defer f.Close()
+	// with the algorithm of the digest the client computed
+	digester := dstDigest.Algorithm().Digester()
+	w, flush := bufferWrites(f, is.writeBuffer)
+	mw := io.MultiWriter(w, digester.Hash())
+	n, err := is.copyBuffers.Copy(mw, body)
 
-	digester := sha256.New()
-	mw := io.MultiWriter(f, digester)
-	n, err := io.Copy(mw, body)
+	if ferr := flush(); err == nil {
+		err = ferr
+	}
+
+	// close before renaming, which fails on open files on some platforms
+	f.Close()
 
 	if err != nil {
 		return "", -1, err
 	}
 
-	srcDigest := godigest.NewDigestFromEncoded(godigest.SHA256, fmt.Sprintf("%x", digester.Sum(nil)))
+	srcDigest := digester.Digest()
 	if srcDigest != dstDigest {
 		is.log.Error().Str("srcDigest", srcDigest.String()).
 			Str("dstDigest", dstDigest.String()).Msg("actual digest not equal to expected digest")
 		return "", -1, errors.ErrBadBlobDigest
 	}
 
-	dir := path.Join(is.rootDir, repo, "blobs", dstDigest.Algorithm().String())
+	if src, err = is.stageUpload(repo, src); err != nil {
+		return "", -1, err
+	}
+
+	is.dropUploadCache(src)
+
+	dir := filepath.Join(is.rootDir, repo, "blobs", dstDigest.Algorithm().String())
 
-	is.Lock()
-	defer is.Unlock()
+	is.LockRepo(repo)
+	defer is.UnlockRepo(repo)
 
 	ensureDir(dir, is.log)
 	dst := is.BlobPath(repo, dstDigest)
+	defer is.blobSizes.forget(dst)
 
 	if is.dedupe && is.cache != nil {
-		if err := is.DedupeBlob(src, dstDigest, dst); err != nil {
+		traced := trace(is.tracer, "dedupe", repo, dstDigest.String())
+		err = is.DedupeBlob(src, dstDigest, dst)
+		traced(err)
+
+		if err != nil {
 			is.log.Error().Err(err).Str("src", src).Str("dstDigest", dstDigest.String()).
 				Str("dst", dst).Msg("unable to dedupe blob")
 			return "", -1, err
 		}
 	} else {
-		if err := os.Rename(src, dst); err != nil {
+		if err := rename(src, dst); err != nil {
 			is.log.Error().Err(err).Str("src", src).Str("dstDigest", dstDigest.String()).
 				Str("dst", dst).Msg("unable to finish blob")
 			return "", -1, err
@@ -881,8 +1342,69 @@ func (is *ImageStore) FullBlobUpload(repo string, body io.Reader, digest string)
 	return uuid, n, nil
 }
 
+// MountBlob adds a blob already stored in another repository to a repository, by linking it
+// from where the dedupe cache has it, rather than it being uploaded again. It returns false,
+// for the blob to be uploaded, if it isn't found, or can't be linked.
+func (is *ImageStoreLocal) MountBlob(repo string, digest string) (bool, int64, error) {
+	d, err := godigest.Parse(digest)
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("failed to parse digest")
+		return false, -1, errors.ErrBadBlobDigest
+	}
+
+	if is.cache == nil {
+		return false, -1, nil
+	}
+
+	record, err := is.cache.GetBlob(d.String())
+	if err == errors.ErrCacheMiss || (err == nil && record == "") {
+		return false, -1, nil
+	}
+
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Msg("mount: unable to lookup blob record")
+		return false, -1, err
+	}
+
+	if err := is.InitRepo(repo); err != nil {
+		return false, -1, err
+	}
+
+	src := filepath.Join(is.rootDir, record)
+	dst := is.BlobPath(repo, d)
+
+	is.LockRepo(repo)
+	defer is.UnlockRepo(repo)
+
+	if size, err := is.blobSizes.stat(dst); err == nil {
+		return true, size, nil
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		// the blob may have been removed by GC, so sync the cache
+		is.log.Warn().Err(err).Str("blobPath", src).Msg("mount: unable to stat")
+
+		if err := is.cache.DeleteBlob(d.String(), src); err != nil {
+			is.log.Error().Err(err).Str("digest", digest).Msg("mount: unable to delete blob record")
+		}
+
+		return false, -1, nil
+	}
+
+	ensureDir(filepath.Dir(dst), is.log)
+	defer is.blobSizes.forget(dst)
+
+	if err := os.Link(src, dst); err != nil {
+		is.log.Warn().Err(err).Str("blobPath", dst).Str("link", src).Msg("mount: unable to hard link")
+		return false, -1, nil
+	}
+
+	return true, fi.Size(), nil
+}
+
 // nolint:interfacer
-func (is *ImageStore) DedupeBlob(src string, dstDigest godigest.Digest, dst string) error {
+func (is *ImageStoreLocal) DedupeBlob(src string, dstDigest godigest.Digest, dst string) error {
 retry:
 	is.log.Debug().Str("src", src).Str("dstDigest", dstDigest.String()).Str("dst", dst).Msg("dedupe: ENTER")
 
@@ -902,7 +1424,7 @@ retry:
 		}
 
 		// move the blob from uploads to final dest
-		if err := os.Rename(src, dst); err != nil {
+		if err := rename(src, dst); err != nil {
 			is.log.Error().Err(err).Str("src", src).Str("dst", dst).Msg("dedupe: unable to rename blob")
 
 			return err
@@ -910,7 +1432,7 @@ retry:
 
 		is.log.Debug().Str("src", src).Str("dst", dst).Msg("dedupe: rename")
 	} else {
-		dstRecord = path.Join(is.rootDir, dstRecord)
+		dstRecord = filepath.Join(is.rootDir, dstRecord)
 
 		dstRecordFi, err := os.Stat(dstRecord)
 		if err != nil {
@@ -932,9 +1454,17 @@ retry:
 		}
 		if !os.SameFile(dstFi, dstRecordFi) {
 			if err := os.Link(dstRecord, dst); err != nil {
-				is.log.Error().Err(err).Str("blobPath", dst).Str("link", dstRecord).Msg("dedupe: unable to hard link")
+				// degrade to keeping a copy of the blob rather than failing the upload
+				is.log.Warn().Err(err).Str("blobPath", dst).Str("link", dstRecord).
+					Msg("dedupe: unable to hard link, keeping a copy")
 
-				return err
+				if err := rename(src, dst); err != nil {
+					is.log.Error().Err(err).Str("src", src).Str("dst", dst).Msg("dedupe: unable to rename blob")
+
+					return err
+				}
+
+				return nil
 			}
 		}
 		if err := os.Remove(src); err != nil {
@@ -948,8 +1478,10 @@ retry:
 }
 
 // DeleteBlobUpload deletes an existing blob upload that is currently in progress.
-func (is *ImageStore) DeleteBlobUpload(repo string, uuid string) error {
+func (is *ImageStoreLocal) DeleteBlobUpload(repo string, uuid string) error {
 	blobUploadPath := is.BlobUploadPath(repo, uuid)
+	is.uploads.forget(blobUploadPath)
+
 	if err := os.Remove(blobUploadPath); err != nil {
 		is.log.Error().Err(err).Str("blobUploadPath", blobUploadPath).Msg("error deleting blob upload")
 		return err
@@ -959,12 +1491,12 @@ func (is *ImageStore) DeleteBlobUpload(repo string, uuid string) error {
 }
 
 // BlobPath returns the repository path of a blob.
-func (is *ImageStore) BlobPath(repo string, digest godigest.Digest) string {
-	return path.Join(is.rootDir, repo, "blobs", digest.Algorithm().String(), digest.Encoded())
+func (is *ImageStoreLocal) BlobPath(repo string, digest godigest.Digest) string {
+	return filepath.Join(is.rootDir, repo, "blobs", digest.Algorithm().String(), digest.Encoded())
 }
 
 // CheckBlob verifies a blob and returns true if the blob is correct.
-func (is *ImageStore) CheckBlob(repo string, digest string,
+func (is *ImageStoreLocal) CheckBlob(repo string, digest string,
 	mediaType string) (bool, int64, error) {
 	d, err := godigest.Parse(digest)
 	if err != nil {
@@ -974,22 +1506,22 @@ func (is *ImageStore) CheckBlob(repo string, digest string,
 
 	blobPath := is.BlobPath(repo, d)
 
-	is.RLock()
-	defer is.RUnlock()
+	is.RLockRepo(repo)
+	defer is.RUnlockRepo(repo)
 
-	blobInfo, err := os.Stat(blobPath)
+	size, err := is.blobSizes.stat(blobPath)
 	if err != nil {
 		is.log.Error().Err(err).Str("blob", blobPath).Msg("failed to stat blob")
 		return false, -1, errors.ErrBlobNotFound
 	}
 
-	return true, blobInfo.Size(), nil
+	return true, size, nil
 }
 
 // GetBlob returns a stream to read the blob.
 // FIXME: we should probably parse the manifest and use (digest, mediaType) as a
 // blob selector instead of directly downloading the blob.
-func (is *ImageStore) GetBlob(repo string, digest string, mediaType string) (io.Reader, int64, error) {
+func (is *ImageStoreLocal) GetBlob(repo string, digest string, mediaType string) (io.Reader, int64, error) {
 	d, err := godigest.Parse(digest)
 	if err != nil {
 		is.log.Error().Err(err).Str("digest", digest).Msg("failed to parse digest")
@@ -998,10 +1530,10 @@ func (is *ImageStore) GetBlob(repo string, digest string, mediaType string) (io.
 
 	blobPath := is.BlobPath(repo, d)
 
-	is.RLock()
-	defer is.RUnlock()
+	is.RLockRepo(repo)
+	defer is.RUnlockRepo(repo)
 
-	blobInfo, err := os.Stat(blobPath)
+	size, err := is.blobSizes.stat(blobPath)
 	if err != nil {
 		is.log.Error().Err(err).Str("blob", blobPath).Msg("failed to stat blob")
 		return nil, -1, errors.ErrBlobNotFound
@@ -1010,14 +1542,46 @@ func (is *ImageStore) GetBlob(repo string, digest string, mediaType string) (io.
 	blobReader, err := os.Open(blobPath)
 	if err != nil {
 		is.log.Error().Err(err).Str("blob", blobPath).Msg("failed to open blob")
+		// removed behind the store's back
+		is.blobSizes.forget(blobPath)
+
+		if os.IsNotExist(err) {
+			return nil, -1, errors.ErrBlobNotFound
+		}
+
 		return nil, -1, err
 	}
 
-	return blobReader, blobInfo.Size(), nil
+	return blobReader, size, nil
+}
+
+// GetBlobPartial returns a stream to read a range of a blob, from and to included, to being
+// -1 for its end, along with the length of the range and the size of the blob.
+func (is *ImageStoreLocal) GetBlobPartial(repo string, digest string, mediaType string, from int64,
+	to int64) (io.Reader, int64, int64, error) {
+	r, size, err := is.GetBlob(repo, digest, mediaType)
+	if err != nil {
+		return nil, -1, -1, err
+	}
+
+	length, err := blobRange(from, to, size)
+	if err == nil {
+		r, err = partialReader(r, from, length)
+	} else if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+
+	if err != nil {
+		is.log.Error().Err(err).Str("digest", digest).Int64("from", from).Int64("to", to).
+			Msg("failed to read blob range")
+		return nil, -1, size, err
+	}
+
+	return r, length, size, nil
 }
 
 // DeleteBlob removes the blob from the repository.
-func (is *ImageStore) DeleteBlob(repo string, digest string) error {
+func (is *ImageStoreLocal) DeleteBlob(repo string, digest string) error {
 	d, err := godigest.Parse(digest)
 	if err != nil {
 		is.log.Error().Err(err).Str("digest", digest).Msg("failed to parse digest")
@@ -1026,8 +1590,8 @@ func (is *ImageStore) DeleteBlob(repo string, digest string) error {
 
 	blobPath := is.BlobPath(repo, d)
 
-	is.Lock()
-	defer is.Unlock()
+	is.LockRepo(repo)
+	defer is.UnlockRepo(repo)
 
 	_, err = os.Stat(blobPath)
 	if err != nil {
@@ -1042,7 +1606,10 @@ func (is *ImageStore) DeleteBlob(repo string, digest string) error {
 		}
 	}
 
-	if err := os.Remove(blobPath); err != nil {
+	err = os.Remove(blobPath)
+	is.blobSizes.forget(blobPath)
+
+	if err != nil {
 		is.log.Error().Err(err).Str("blobPath", blobPath).Msg("unable to remove blob path")
 		return err
 	}
@@ -1050,14 +1617,6 @@ func (is *ImageStore) DeleteBlob(repo string, digest string) error {
 	return nil
 }
 
-// garbage collection
-
-// Scrub will clean up all unreferenced blobs.
-// TODO.
-func Scrub(dir string, fix bool) error {
-	return nil
-}
-
 // utility routines
 
 func dirExists(d string) bool {
@@ -1079,21 +1638,24 @@ func ensureDir(dir string, log zerolog.Logger) {
 	}
 }
 
-func ifOlderThan(is *ImageStore, repo string, delay time.Duration) casext.GCPolicy {
-	return func(ctx context.Context, digest godigest.Digest) (bool, error) {
-		blobPath := is.BlobPath(repo, digest)
-		fi, err := os.Stat(blobPath)
-
-		if err != nil {
-			return false, err
-		}
+// hardlinksSupported reports whether hard links can be created under dir.
+func hardlinksSupported(dir string) bool {
+	f, err := ioutil.TempFile(dir, ".hardlink-check")
+	if err != nil {
+		return false
+	}
 
-		if fi.ModTime().Add(delay).After(time.Now()) {
-			return false, nil
-		}
+	src := f.Name()
+	f.Close()
 
-		is.log.Info().Str("digest", digest.String()).Str("blobPath", blobPath).Msg("perform GC on blob")
+	defer os.Remove(src)
 
-		return true, nil
+	dst := src + ".link"
+	if err := os.Link(src, dst); err != nil {
+		return false
 	}
+
+	_ = os.Remove(dst)
+
+	return true
 }
@@ -4,15 +4,20 @@ import (
 	"bytes"
 	_ "crypto/sha256"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/anuvu/zot/errors"
 	"github.com/anuvu/zot/pkg/log"
 	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
 	godigest "github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/rs/zerolog"
@@ -27,7 +32,7 @@ func TestAPIs(t *testing.T) {
 
 	defer os.RemoveAll(dir)
 
-	il := storage.NewImageStore(dir, true, true, log.Logger{Logger: zerolog.New(os.Stdout)})
+	il := storage.NewImageStore(dir, true, true, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
 
 	Convey("Repo layout", t, func(c C) {
 		repoName := "test"
@@ -450,6 +455,29 @@ func TestAPIs(t *testing.T) {
 			So(os.SameFile(fi1, fi2), ShouldBeTrue)
 		})
 
+		Convey("Delete image tag", func() {
+			img, err := test.GetRandomImage(64, 1)
+			So(err, ShouldBeNil)
+
+			So(test.WriteImageToStore(img, il, "untag", "1.0"), ShouldBeNil)
+			So(test.WriteImageToStore(img, il, "untag", "latest"), ShouldBeNil)
+
+			So(il.DeleteImageTag("untag", "1.0"), ShouldBeNil)
+			So(il.DeleteImageTag("untag", "1.0"), ShouldEqual, errors.ErrManifestNotFound)
+			So(il.DeleteImageTag("missing", "1.0"), ShouldEqual, errors.ErrRepoNotFound)
+
+			tags, err := il.GetImageTags("untag")
+			So(err, ShouldBeNil)
+			So(tags, ShouldResemble, []string{"latest"})
+
+			// still referenced by the other tag
+			d, err := img.Digest()
+			So(err, ShouldBeNil)
+
+			_, _, _, err = il.GetImageManifest("untag", d.String())
+			So(err, ShouldBeNil)
+		})
+
 		Convey("Locks", func() {
 			// in parallel, a mix of read and write locks - mainly for coverage
 			var wg sync.WaitGroup
@@ -476,7 +504,7 @@ func TestAPIs(t *testing.T) {
 func TestDedupe(t *testing.T) {
 	Convey("Dedupe", t, func(c C) {
 		Convey("Nil ImageStore", func() {
-			is := &storage.ImageStore{}
+			is := &storage.ImageStoreLocal{}
 			So(func() { _ = is.DedupeBlob("", "", "") }, ShouldPanic)
 		})
 
@@ -487,13 +515,1456 @@ func TestDedupe(t *testing.T) {
 			}
 			defer os.RemoveAll(dir)
 
-			is := storage.NewImageStore(dir, true, true, log.Logger{Logger: zerolog.New(os.Stdout)})
+			is := storage.NewImageStore(dir, true, true, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
 
 			So(is.DedupeBlob("", "", ""), ShouldNotBeNil)
 		})
 	})
 }
 
+func TestSharedStorage(t *testing.T) {
+	Convey("Share storage between image stores", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.Logger{Logger: zerolog.New(os.Stdout)}
+
+		is1 := storage.NewSharedImageStore(dir, false, true, storage.Options{}, log)
+		So(is1, ShouldNotBeNil)
+		defer is1.Close()
+
+		is2 := storage.NewSharedImageStore(dir, false, true, storage.Options{}, log)
+		So(is2, ShouldNotBeNil)
+		defer is2.Close()
+
+		content := []byte("test-data")
+		digest := godigest.FromBytes(content)
+
+		_, _, err = is1.FullBlobUpload("repo1", bytes.NewReader(content), digest.String())
+		So(err, ShouldBeNil)
+
+		// deduped by the other store, with the cache shared
+		_, _, err = is2.FullBlobUpload("repo2", bytes.NewReader(content), digest.String())
+		So(err, ShouldBeNil)
+
+		fi1, err := os.Stat(is1.BlobPath("repo1", digest))
+		So(err, ShouldBeNil)
+		fi2, err := os.Stat(is2.BlobPath("repo2", digest))
+		So(err, ShouldBeNil)
+		So(os.SameFile(fi1, fi2), ShouldBeTrue)
+
+		ok, _, err := is2.CheckBlob("repo1", digest.String(), "")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		// a write-lock excludes the other store
+		is1.Lock()
+
+		locked := make(chan struct{})
+
+		go func() {
+			is2.RLock()
+			close(locked)
+			is2.RUnlock()
+		}()
+
+		acquired := false
+
+		select {
+		case <-locked:
+			acquired = true
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		So(acquired, ShouldBeFalse)
+
+		is1.Unlock()
+		<-locked
+
+		// read-locks don't
+		is1.RLock()
+		is2.RLock()
+		is2.RUnlock()
+		is1.RUnlock()
+	})
+}
+
+func TestRepoLocks(t *testing.T) {
+	Convey("Lock repositories one by one", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
+		So(is, ShouldNotBeNil)
+
+		content := []byte("test-data")
+		digest := godigest.FromBytes(content)
+
+		for _, repo := range []string{"repo1", "repo2"} {
+			_, _, err = is.FullBlobUpload(repo, bytes.NewReader(content), digest.String())
+			So(err, ShouldBeNil)
+		}
+
+		// whether f ran without waiting for a lock, which it is then left to take
+		acquired := func(f func()) bool {
+			done := make(chan struct{})
+
+			go func() {
+				f()
+				close(done)
+			}()
+
+			select {
+			case <-done:
+				return true
+			case <-time.After(100 * time.Millisecond):
+				<-done
+				return false
+			}
+		}
+
+		// while a push holds the lock of a repository
+		is.LockRepo("repo1")
+
+		unlocked := make(chan struct{})
+
+		go func() {
+			time.Sleep(time.Second)
+			is.UnlockRepo("repo1")
+			close(unlocked)
+		}()
+
+		// others are read and written
+		var ok bool
+
+		So(acquired(func() {
+			ok, _, err = is.CheckBlob("repo2", digest.String(), "")
+			if err == nil {
+				err = is.DeleteBlob("repo2", digest.String())
+			}
+		}), ShouldBeTrue)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		// but not it
+		So(acquired(func() { ok, _, err = is.CheckBlob("repo1", digest.String(), "") }), ShouldBeFalse)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		<-unlocked
+
+		// and locking the store excludes every repository
+		is.Lock()
+
+		go func() {
+			time.Sleep(time.Second)
+			is.Unlock()
+		}()
+
+		So(acquired(func() {
+			is.RLockRepo("repo2")
+			is.RUnlockRepo("repo2")
+		}), ShouldBeFalse)
+	})
+}
+
+func TestGetRepositories(t *testing.T) {
+	Convey("List nested repositories", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
+		So(is, ShouldNotBeNil)
+
+		expected := []string{"a", "a/b", "c/d/e"}
+		for i := 0; i < 100; i++ {
+			expected = append(expected, fmt.Sprintf("many/repo%03d", i))
+		}
+
+		for _, repo := range expected {
+			So(is.InitRepo(repo), ShouldBeNil)
+		}
+
+		So(os.MkdirAll(path.Join(dir, "c", "empty"), 0755), ShouldBeNil)
+
+		// not looked for in blobs
+		So(os.MkdirAll(path.Join(dir, "a", "blobs", "x"), 0755), ShouldBeNil)
+		So(os.Rename(path.Join(dir, "many", "repo000"), path.Join(dir, "a", "blobs", "x", "repo")), ShouldBeNil)
+
+		// even those of invalid repositories
+		So(is.InitRepo("broken/blobs/repo"), ShouldBeNil)
+		So(ioutil.WriteFile(path.Join(dir, "broken", "index.json"), []byte("{}"), 0600), ShouldBeNil)
+
+		// nor in hidden directories, nor too deep
+		So(is.InitRepo(".hidden/repo"), ShouldBeNil)
+		So(is.InitRepo(strings.Repeat("deep/", 16)+"repo"), ShouldBeNil)
+		So(is.InitRepo(strings.Repeat("deep/", 15)+"repo"), ShouldBeNil)
+
+		repos, err := is.GetRepositories()
+		So(err, ShouldBeNil)
+		So(repos, ShouldResemble, append(append([]string{}, expected[:3]...),
+			append([]string{strings.Repeat("deep/", 15) + "repo"}, expected[4:]...)...))
+	})
+
+	Convey("Remember valid repositories until changed", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
+		So(is, ShouldNotBeNil)
+		So(is.InitRepo("repo"), ShouldBeNil)
+
+		ok, err := is.ValidateRepo("repo")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		// the layout isn't read again
+		layout := path.Join(dir, "repo", ispec.ImageLayoutFile)
+		So(ioutil.WriteFile(layout, []byte(`{"imageLayoutVersion": "0.0.0"}`), 0600), ShouldBeNil)
+
+		ok, err = is.ValidateRepo("repo")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		repos, err := is.GetRepositories()
+		So(err, ShouldBeNil)
+		So(repos, ShouldResemble, []string{"repo"})
+
+		// unless entries of the repository change
+		So(os.Remove(layout), ShouldBeNil)
+		So(os.Chtimes(path.Join(dir, "repo"), time.Now(), time.Now().Add(time.Minute)), ShouldBeNil)
+
+		ok, _ = is.ValidateRepo("repo")
+		So(ok, ShouldBeFalse)
+
+		// listed as changed once the store is opened again
+		is = storage.NewImageStore(dir, false, false, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
+		So(is, ShouldNotBeNil)
+
+		repos, err = is.GetRepositories()
+		So(err, ShouldBeNil)
+		So(repos, ShouldBeEmpty)
+	})
+}
+
+func TestRepoCatalog(t *testing.T) {
+	Convey("Keep the list of repositories up to date", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.Logger{Logger: zerolog.New(os.Stdout)}
+
+		is := storage.NewImageStore(dir, true, true, storage.Options{}, log)
+		So(is, ShouldNotBeNil)
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "a", "1.0"), ShouldBeNil)
+
+		repos, err := is.GetRepositories()
+		So(err, ShouldBeNil)
+		So(repos, ShouldResemble, []string{"a"})
+
+		So(test.WriteImageToStore(img, is, "c", "1.0"), ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "b", "1.0"), ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "b/d", "1.0"), ShouldBeNil)
+
+		repos, err = is.GetRepositories()
+		So(err, ShouldBeNil)
+		So(repos, ShouldResemble, []string{"a", "b", "b/d", "c"})
+
+		// not walked for again, until opened again
+		other := storage.NewImageStore(dir, false, false, storage.Options{}, log)
+		So(test.WriteImageToStore(img, other, "e", "1.0"), ShouldBeNil)
+
+		repos, err = is.GetRepositories()
+		So(err, ShouldBeNil)
+		So(repos, ShouldResemble, []string{"a", "b", "b/d", "c"})
+
+		repos, err = storage.NewImageStore(dir, false, false, storage.Options{}, log).GetRepositories()
+		So(err, ShouldBeNil)
+		So(repos, ShouldResemble, []string{"a", "b", "b/d", "c", "e"})
+
+		Convey("Delete repositories", func() {
+			layer := godigest.FromBytes(img.Layers[0])
+
+			So(is.DeleteRepo("b"), ShouldBeNil)
+			So(is.DeleteRepo("b"), ShouldEqual, errors.ErrRepoNotFound)
+			So(is.DeleteRepo("f"), ShouldEqual, errors.ErrRepoNotFound)
+
+			repos, err := is.GetRepositories()
+			So(err, ShouldBeNil)
+			So(repos, ShouldResemble, []string{"a", "b/d", "c"})
+
+			_, err = is.GetImageTags("b")
+			So(err, ShouldNotBeNil)
+
+			ok, _, err := is.CheckBlob("b", layer.String(), "")
+			So(err, ShouldNotBeNil)
+			So(ok, ShouldBeFalse)
+
+			// the nested repository is left
+			tags, err := is.GetImageTags("b/d")
+			So(err, ShouldBeNil)
+			So(tags, ShouldResemble, []string{"1.0"})
+
+			for _, repo := range []string{"a", "b/d", "c"} {
+				So(is.DeleteRepo(repo), ShouldBeNil)
+			}
+
+			// and its directory removed with the last of them
+			_, err = os.Stat(path.Join(dir, "b"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			// nor deduped against
+			ok, _, err = is.MountBlob("f", layer.String())
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+
+			So(is.InitRepo("b"), ShouldBeNil)
+
+			repos, err = is.GetRepositories()
+			So(err, ShouldBeNil)
+			So(repos, ShouldResemble, []string{"b"})
+		})
+	})
+}
+
+func TestIndexSnapshots(t *testing.T) {
+	Convey("Read manifests and tags without locking", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
+		So(is, ShouldNotBeNil)
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+		// while a push holds the lock
+		is.Lock()
+
+		read := make(chan error, 1)
+
+		go func() {
+			_, _, _, err := is.GetImageManifest("repo", "1.0")
+			if err == nil {
+				_, err = is.GetImageTags("repo")
+			}
+			read <- err
+		}()
+
+		waited := false
+
+		select {
+		case err = <-read:
+		case <-time.After(5 * time.Second):
+			waited = true
+		}
+
+		is.Unlock()
+		So(waited, ShouldBeFalse)
+		So(err, ShouldBeNil)
+
+		// and while pushes replace the index
+		mblob, err := img.ManifestBlob()
+		So(err, ShouldBeNil)
+
+		var wg sync.WaitGroup
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 50; i++ {
+				_, _ = is.PutImageManifest("repo", fmt.Sprintf("tag%d", i), ispec.MediaTypeImageManifest, mblob)
+			}
+		}()
+
+		for i := 0; i < 200; i++ {
+			_, _, _, err = is.GetImageManifest("repo", "1.0")
+			So(err, ShouldBeNil)
+		}
+
+		wg.Wait()
+
+		tags, err := is.GetImageTags("repo")
+		So(err, ShouldBeNil)
+		So(tags, ShouldHaveLength, 51)
+
+		Convey("Notice indexes changed by others", func() {
+			other := storage.NewImageStore(dir, false, false, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
+			So(other.DeleteImageTag("repo", "1.0"), ShouldBeNil)
+
+			_, _, _, err = is.GetImageManifest("repo", "1.0")
+			So(err, ShouldEqual, errors.ErrManifestNotFound)
+
+			So(ioutil.WriteFile(path.Join(dir, "repo", "index.json"), []byte("{"), 0600), ShouldBeNil)
+
+			_, err = is.GetImageTags("repo")
+			So(err, ShouldEqual, errors.ErrRepoNotFound)
+		})
+	})
+}
+
+func TestBlobUploadDigest(t *testing.T) {
+	Convey("Digest blob uploads as they're written", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.Logger{Logger: zerolog.New(os.Stdout)}
+
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log)
+		So(is, ShouldNotBeNil)
+
+		chunks := [][]byte{[]byte("test-"), []byte("data")}
+		digest := godigest.FromBytes(bytes.Join(chunks, nil))
+
+		upload := func(is *storage.ImageStoreLocal) string {
+			uuid, err := is.NewBlobUpload("repo")
+			So(err, ShouldBeNil)
+
+			_, err = is.PutBlobChunk("repo", uuid, 0, int64(len(chunks[0])), bytes.NewReader(chunks[0]))
+			So(err, ShouldBeNil)
+
+			_, err = is.PutBlobChunkStreamed("repo", uuid, bytes.NewReader(chunks[1]))
+			So(err, ShouldBeNil)
+
+			return uuid
+		}
+
+		Convey("without reading them again", func() {
+			uuid := upload(is)
+
+			// changed in place behind the store's back, which it doesn't notice
+			f, err := os.OpenFile(is.BlobUploadPath("repo", uuid), os.O_WRONLY, 0600)
+			So(err, ShouldBeNil)
+			_, err = f.WriteAt([]byte("T"), 0)
+			So(err, ShouldBeNil)
+			f.Close()
+
+			So(is.FinishBlobUpload("repo", uuid, nil, digest.String()), ShouldBeNil)
+
+			ok, size, err := is.CheckBlob("repo", digest.String(), "")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(size, ShouldEqual, len(chunks[0])+len(chunks[1]))
+		})
+
+		Convey("rejecting those not matching their digest", func() {
+			uuid := upload(is)
+
+			So(is.FinishBlobUpload("repo", uuid, nil, godigest.FromBytes(chunks[0]).String()),
+				ShouldEqual, errors.ErrBadBlobDigest)
+			So(is.FinishBlobUpload("repo", uuid, nil, digest.String()), ShouldBeNil)
+		})
+
+		Convey("or reading them again if written elsewhere too", func() {
+			uuid := upload(is)
+
+			// appended to by another store, e.g. after a restart
+			other := storage.NewImageStore(dir, false, false, storage.Options{}, log)
+			_, err := other.PutBlobChunkStreamed("repo", uuid, bytes.NewReader([]byte("!")))
+			So(err, ShouldBeNil)
+
+			_, err = is.PutBlobChunkStreamed("repo", uuid, bytes.NewReader([]byte("?")))
+			So(err, ShouldBeNil)
+
+			So(is.FinishBlobUpload("repo", uuid, nil, digest.String()), ShouldEqual, errors.ErrBadBlobDigest)
+
+			full := godigest.FromBytes(append(bytes.Join(chunks, nil), []byte("!?")...))
+			So(is.FinishBlobUpload("repo", uuid, nil, full.String()), ShouldBeNil)
+
+			// and finished elsewhere
+			uuid = upload(is)
+			So(other.FinishBlobUpload("repo", uuid, nil, digest.String()), ShouldBeNil)
+		})
+	})
+}
+
+func TestResumeBlobUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-repo-test")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	logger := log.Logger{Logger: zerolog.New(os.Stdout)}
+
+	driverParams := map[string]interface{}{"rootDirectory": dir + "/driver"}
+
+	// the stores as started again, over the same storage
+	stores := map[string]func() storage.ImageStore{
+		"local": func() storage.ImageStore {
+			return storage.NewImageStore(dir+"/local", false, false, storage.Options{}, logger)
+		},
+		"local with an upload dir": func() storage.ImageStore {
+			is := storage.NewImageStore(dir+"/staged", false, false, storage.Options{}, logger)
+			if err := is.SetUploadDir(dir + "/uploads"); err != nil {
+				panic(err)
+			}
+
+			return is
+		},
+		"driver": func() storage.ImageStore {
+			driver, err := storage.NewDriver(storage.FilesystemDriverName, driverParams)
+			if err != nil {
+				panic(err)
+			}
+
+			return storage.NewImageStoreDriver(driver, false, storage.Options{}, logger)
+		},
+	}
+
+	for name, start := range stores {
+		Convey("Resume blob uploads after restarting the "+name+" store", t, func() {
+			chunks := [][]byte{[]byte("test-"), []byte("data")}
+			digest := godigest.FromBytes(bytes.Join(chunks, nil))
+
+			is := start()
+
+			uuid, err := is.NewBlobUpload("repo")
+			So(err, ShouldBeNil)
+
+			_, err = is.PutBlobChunk("repo", uuid, 0, int64(len(chunks[0])), bytes.NewReader(chunks[0]))
+			So(err, ShouldBeNil)
+
+			// nothing kept in memory but what's on the storage
+			So(is.Close(), ShouldBeNil)
+
+			is = start()
+			defer is.Close()
+
+			offset, err := is.GetBlobUpload("repo", uuid)
+			So(err, ShouldBeNil)
+			So(offset, ShouldEqual, len(chunks[0]))
+
+			_, err = is.PutBlobChunk("repo", uuid, offset, offset+int64(len(chunks[1])), bytes.NewReader(chunks[1]))
+			So(err, ShouldBeNil)
+
+			So(is.FinishBlobUpload("repo", uuid, nil, digest.String()), ShouldBeNil)
+
+			ok, size, err := is.CheckBlob("repo", digest.String(), "")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(size, ShouldEqual, len(chunks[0])+len(chunks[1]))
+
+			_, err = is.GetBlobUpload("repo", uuid)
+			So(err, ShouldNotBeNil)
+		})
+	}
+}
+
+func TestBlobSizes(t *testing.T) {
+	Convey("Remember the size of blobs until written or removed", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.Logger{Logger: zerolog.New(os.Stdout)}
+
+		is := storage.NewImageStore(dir, false, false, storage.Options{}, log)
+		So(is, ShouldNotBeNil)
+
+		content := []byte("test-data")
+		digest := godigest.FromBytes(content)
+
+		ok, _, err := is.CheckBlob("repo", digest.String(), "")
+		So(err, ShouldEqual, errors.ErrBlobNotFound)
+		So(ok, ShouldBeFalse)
+
+		_, _, err = is.FullBlobUpload("repo", bytes.NewReader(content), digest.String())
+		So(err, ShouldBeNil)
+
+		ok, size, err := is.CheckBlob("repo", digest.String(), "")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+		So(size, ShouldEqual, len(content))
+
+		// removed behind the store's back, which it doesn't notice until it reads it
+		So(os.Remove(is.BlobPath("repo", digest)), ShouldBeNil)
+
+		ok, _, err = is.CheckBlob("repo", digest.String(), "")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		_, _, err = is.GetBlob("repo", digest.String(), "")
+		So(err, ShouldEqual, errors.ErrBlobNotFound)
+
+		ok, _, err = is.CheckBlob("repo", digest.String(), "")
+		So(err, ShouldEqual, errors.ErrBlobNotFound)
+		So(ok, ShouldBeFalse)
+
+		uuid, err := is.NewBlobUpload("repo")
+		So(err, ShouldBeNil)
+		_, err = is.PutBlobChunkStreamed("repo", uuid, bytes.NewReader(content))
+		So(err, ShouldBeNil)
+		So(is.FinishBlobUpload("repo", uuid, nil, digest.String()), ShouldBeNil)
+
+		r, size, err := is.GetBlob("repo", digest.String(), "")
+		So(err, ShouldBeNil)
+		So(size, ShouldEqual, len(content))
+		r.(io.Closer).Close()
+
+		r, length, size, err := is.GetBlobPartial("repo", digest.String(), "", 1, 2)
+		So(err, ShouldBeNil)
+		So(length, ShouldEqual, 2)
+		So(size, ShouldEqual, len(content))
+		buf, err := ioutil.ReadAll(r)
+		So(err, ShouldBeNil)
+		So(buf, ShouldResemble, content[1:3])
+		r.(io.Closer).Close()
+
+		So(is.DeleteBlob("repo", digest.String()), ShouldBeNil)
+
+		ok, _, err = is.CheckBlob("repo", digest.String(), "")
+		So(err, ShouldEqual, errors.ErrBlobNotFound)
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestMountBlob(t *testing.T) {
+	Convey("Mount blobs stored in other repositories", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := log.Logger{Logger: zerolog.New(os.Stdout)}
+
+		content := []byte("test-data")
+		digest := godigest.FromBytes(content)
+
+		Convey("from where the dedupe cache has them", func() {
+			is := storage.NewImageStore(dir, false, true, storage.Options{}, log)
+			So(is, ShouldNotBeNil)
+
+			ok, _, err := is.MountBlob("b", digest.String())
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+
+			_, _, err = is.MountBlob("b", "invalid")
+			So(err, ShouldEqual, errors.ErrBadBlobDigest)
+
+			_, _, err = is.FullBlobUpload("a", bytes.NewReader(content), digest.String())
+			So(err, ShouldBeNil)
+
+			ok, size, err := is.MountBlob("b", digest.String())
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(size, ShouldEqual, len(content))
+
+			src, err := os.Stat(is.BlobPath("a", digest))
+			So(err, ShouldBeNil)
+			dst, err := os.Stat(is.BlobPath("b", digest))
+			So(err, ShouldBeNil)
+			So(os.SameFile(src, dst), ShouldBeTrue)
+
+			// already there
+			ok, _, err = is.MountBlob("b", digest.String())
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+
+			// removed behind the cache's back
+			So(os.Remove(is.BlobPath("a", digest)), ShouldBeNil)
+
+			ok, _, err = is.MountBlob("c", digest.String())
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("unless deduping", func() {
+			is := storage.NewImageStore(dir, false, false, storage.Options{}, log)
+			So(is, ShouldNotBeNil)
+
+			_, _, err = is.FullBlobUpload("a", bytes.NewReader(content), digest.String())
+			So(err, ShouldBeNil)
+
+			ok, _, err := is.MountBlob("b", digest.String())
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestGarbageCollect(t *testing.T) {
+	Convey("Collect old unreferenced blobs while serving others", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		is := storage.NewImageStore(dir, true, true, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
+		So(is, ShouldNotBeNil)
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+		layer := godigest.FromBytes(img.Layers[0])
+		old := time.Now().Add(-2 * time.Hour)
+
+		upload := func(content []byte) godigest.Digest {
+			digest := godigest.FromBytes(content)
+			_, _, err := is.FullBlobUpload("repo", bytes.NewReader(content), digest.String())
+			So(err, ShouldBeNil)
+
+			return digest
+		}
+
+		orphan := upload([]byte("orphan"))
+		recent := upload([]byte("recent"))
+
+		for _, digest := range []godigest.Digest{layer, orphan} {
+			So(os.Chtimes(is.BlobPath("repo", digest), old, old), ShouldBeNil)
+		}
+
+		// read meanwhile
+		done := make(chan struct{})
+
+		var wg sync.WaitGroup
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				if r, _, err := is.GetBlob("repo", layer.String(), ""); err == nil {
+					r.(io.Closer).Close()
+				}
+
+				_, _ = is.GetImageTags("repo")
+			}
+		}()
+
+		// collected in the background once another manifest is pushed
+		img2, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img2, is, "repo", "2.0"), ShouldBeNil)
+
+		ok, _, err := is.CheckBlob("repo", orphan.String(), "")
+		for i := 0; i < 100 && ok; i++ {
+			time.Sleep(50 * time.Millisecond)
+
+			ok, _, err = is.CheckBlob("repo", orphan.String(), "")
+		}
+
+		close(done)
+		wg.Wait()
+
+		So(err, ShouldEqual, errors.ErrBlobNotFound)
+		So(ok, ShouldBeFalse)
+
+		// nor mounted from its dedupe record
+		ok, _, err = is.MountBlob("other", orphan.String())
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+
+		for _, digest := range []godigest.Digest{layer, recent} {
+			ok, _, err := is.CheckBlob("repo", digest.String(), "")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+		}
+	})
+}
+
+func TestDockerManifests(t *testing.T) {
+	Convey("Store Docker manifests and lists as they are, keeping what they reference", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		is := storage.NewImageStore(dir, true, true, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
+		So(is, ShouldNotBeNil)
+		So(is.InitRepo("repo"), ShouldBeNil)
+
+		upload := func(content []byte) godigest.Digest {
+			digest := godigest.FromBytes(content)
+			_, _, err := is.FullBlobUpload("repo", bytes.NewReader(content), digest.String())
+			So(err, ShouldBeNil)
+
+			return digest
+		}
+
+		config := []byte(`{"architecture":"amd64","os":"linux"}`)
+		layer := []byte("layer")
+		blobs := []godigest.Digest{upload(config), upload(layer)}
+
+		manifest, err := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     storage.MediaTypeDockerManifest,
+			"config": ispec.Descriptor{MediaType: "application/vnd.docker.container.image.v1+json",
+				Digest: blobs[0], Size: int64(len(config))},
+			"layers": []ispec.Descriptor{{MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip",
+				Digest: blobs[1], Size: int64(len(layer))}},
+		})
+		So(err, ShouldBeNil)
+
+		mDigest, err := is.PutImageManifest("repo", godigest.FromBytes(manifest).String(),
+			storage.MediaTypeDockerManifest, manifest)
+		So(err, ShouldBeNil)
+
+		list, err := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     storage.MediaTypeDockerManifestList,
+			"manifests": []ispec.Descriptor{{MediaType: storage.MediaTypeDockerManifest,
+				Digest: godigest.Digest(mDigest), Size: int64(len(manifest))}},
+		})
+		So(err, ShouldBeNil)
+
+		_, err = is.PutImageManifest("repo", "1.0", storage.MediaTypeDockerManifestList, list)
+		So(err, ShouldBeNil)
+
+		buf, _, mediaType, err := is.GetImageManifest("repo", "1.0")
+		So(err, ShouldBeNil)
+		So(mediaType, ShouldEqual, storage.MediaTypeDockerManifestList)
+		So(buf, ShouldResemble, list)
+
+		buf, _, mediaType, err = is.GetImageManifest("repo", mDigest)
+		So(err, ShouldBeNil)
+		So(mediaType, ShouldEqual, storage.MediaTypeDockerManifest)
+		So(buf, ShouldResemble, manifest)
+
+		// unlike other media types
+		_, err = is.PutImageManifest("repo", "2.0", "application/vnd.docker.distribution.manifest.v1+json", manifest)
+		So(err, ShouldEqual, errors.ErrBadManifest)
+
+		// not collected, though old, once the garbage around them is
+		orphan := upload([]byte("orphan"))
+		old := time.Now().Add(-2 * time.Hour)
+
+		for _, digest := range append(blobs, orphan, godigest.Digest(mDigest)) {
+			So(os.Chtimes(is.BlobPath("repo", digest), old, old), ShouldBeNil)
+		}
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo", "3.0"), ShouldBeNil)
+
+		ok, _, err := is.CheckBlob("repo", orphan.String(), "")
+		for i := 0; i < 100 && ok; i++ {
+			time.Sleep(50 * time.Millisecond)
+
+			ok, _, err = is.CheckBlob("repo", orphan.String(), "")
+		}
+
+		So(err, ShouldEqual, errors.ErrBlobNotFound)
+		So(ok, ShouldBeFalse)
+
+		for _, digest := range append(blobs, godigest.Digest(mDigest)) {
+			ok, _, err := is.CheckBlob("repo", digest.String(), "")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+		}
+	})
+}
+
+func TestGCInterval(t *testing.T) {
+	Convey("Collect garbage in the background, interval after repositories are written to", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		is := storage.NewImageStore(dir, true, false, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
+		So(is, ShouldNotBeNil)
+		defer is.Close()
+
+		is.SetGCInterval(time.Second)
+
+		content := []byte("orphan")
+		orphan := godigest.FromBytes(content)
+		_, _, err = is.FullBlobUpload("repo", bytes.NewReader(content), orphan.String())
+		So(err, ShouldBeNil)
+
+		old := time.Now().Add(-2 * time.Hour)
+		So(os.Chtimes(is.BlobPath("repo", orphan), old, old), ShouldBeNil)
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+
+		start := time.Now()
+		So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo", "2.0"), ShouldBeNil)
+
+		ok, _, _ := is.CheckBlob("repo", orphan.String(), "")
+		So(ok, ShouldBeTrue)
+
+		for ok && time.Since(start) < 5*time.Second {
+			time.Sleep(50 * time.Millisecond)
+
+			ok, _, _ = is.CheckBlob("repo", orphan.String(), "")
+		}
+
+		So(ok, ShouldBeFalse)
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, time.Second)
+	})
+}
+
+// gcTracer tracks how many repositories are collected garbage in at once, at most.
+type gcTracer struct {
+	lock    sync.Mutex
+	running int
+	max     int
+}
+
+func (t *gcTracer) Trace(op string, repo string, digest string) func(error) {
+	if op != "gc" {
+		return func(error) {}
+	}
+
+	t.lock.Lock()
+	t.running++
+	if t.running > t.max {
+		t.max = t.running
+	}
+	t.lock.Unlock()
+
+	// for collections to overlap
+	time.Sleep(200 * time.Millisecond)
+
+	return func(error) {
+		t.lock.Lock()
+		t.running--
+		t.lock.Unlock()
+	}
+}
+
+func TestGCPacing(t *testing.T) {
+	Convey("Pace garbage collection", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		is := storage.NewImageStore(dir, true, false, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
+		So(is, ShouldNotBeNil)
+		defer is.Close()
+
+		img, err := test.GetRandomImage(64, 1)
+		So(err, ShouldBeNil)
+
+		collect := func(tracer *gcTracer, repos ...string) {
+			before, _ := storage.GCRuns()
+
+			for _, repo := range repos {
+				So(test.WriteImageToStore(img, is, repo, "1.0"), ShouldBeNil)
+			}
+
+			for {
+				time.Sleep(50 * time.Millisecond)
+
+				runs, _ := storage.GCRuns()
+				tracer.lock.Lock()
+				running := tracer.running
+				tracer.lock.Unlock()
+
+				if runs >= before+int64(len(repos)) && running == 0 {
+					break
+				}
+			}
+		}
+
+		Convey("Collect repositories one at a time by default", func() {
+			tracer := &gcTracer{}
+			is.SetTracer(tracer)
+
+			collect(tracer, "a", "b", "c")
+			So(tracer.max, ShouldEqual, 1)
+		})
+
+		Convey("Collect repositories in parallel", func() {
+			tracer := &gcTracer{}
+			is.SetTracer(tracer)
+			is.SetGCParallelism(3)
+
+			collect(tracer, "a", "b", "c")
+			So(tracer.max, ShouldBeGreaterThan, 1)
+			So(tracer.max, ShouldBeLessThanOrEqualTo, 3)
+		})
+
+		Convey("Remove blobs within the delete rate", func() {
+			is.SetGCDeleteRate(2)
+
+			orphans := []godigest.Digest{}
+			old := time.Now().Add(-2 * time.Hour)
+
+			for i := 0; i < 4; i++ {
+				content := []byte(fmt.Sprintf("orphan %d", i))
+				orphan := godigest.FromBytes(content)
+				_, _, err = is.FullBlobUpload("repo", bytes.NewReader(content), orphan.String())
+				So(err, ShouldBeNil)
+				So(os.Chtimes(is.BlobPath("repo", orphan), old, old), ShouldBeNil)
+
+				orphans = append(orphans, orphan)
+			}
+
+			remaining := func() int {
+				n := 0
+
+				for _, orphan := range orphans {
+					if ok, _, _ := is.CheckBlob("repo", orphan.String(), ""); ok {
+						n++
+					}
+				}
+
+				return n
+			}
+
+			start := time.Now()
+			So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+			for remaining() > 0 && time.Since(start) < 5*time.Second {
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			// two batches of two, a second apart
+			So(remaining(), ShouldEqual, 0)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, time.Second)
+		})
+	})
+}
+
+func TestImageIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-repo-test")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	logger := log.Logger{Logger: zerolog.New(os.Stdout)}
+
+	driver, err := storage.NewDriver(storage.FilesystemDriverName,
+		map[string]interface{}{"rootDirectory": dir + "/driver"})
+	if err != nil {
+		panic(err)
+	}
+
+	stores := map[string]storage.ImageStore{
+		"local":  storage.NewImageStore(dir+"/local", true, true, storage.Options{}, logger),
+		"memory": storage.NewImageStoreMem(logger),
+		"driver": storage.NewImageStoreDriver(driver, true, storage.Options{}, logger),
+	}
+
+	for name, is := range stores {
+		Convey("Push and pull multiarch images in the "+name+" store", t, func() {
+			platforms := []ispec.Platform{{Architecture: "amd64", OS: "linux"}, {Architecture: "arm64", OS: "linux"}}
+			mi, err := test.GetRandomMultiarchImage(64, platforms)
+			So(err, ShouldBeNil)
+
+			iblob, err := mi.IndexBlob()
+			So(err, ShouldBeNil)
+
+			d, err := mi.Images[0].Digest()
+			So(err, ShouldBeNil)
+
+			missing, err := is.PutImageManifest("repo", "1.0", ispec.MediaTypeImageIndex, iblob)
+			So(err, ShouldEqual, errors.ErrBlobNotFound)
+			So(missing, ShouldEqual, d.String())
+
+			for _, img := range mi.Images {
+				d, err := img.Digest()
+				So(err, ShouldBeNil)
+				So(test.WriteImageToStore(img, is, "repo", d.String()), ShouldBeNil)
+			}
+
+			digest, err := is.PutImageManifest("repo", "1.0", ispec.MediaTypeImageIndex, iblob)
+			So(err, ShouldBeNil)
+			So(digest, ShouldEqual, godigest.FromBytes(iblob).String())
+
+			buf, digest, mediaType, err := is.GetImageManifest("repo", "1.0")
+			So(err, ShouldBeNil)
+			So(buf, ShouldResemble, iblob)
+			So(digest, ShouldEqual, godigest.FromBytes(iblob).String())
+			So(mediaType, ShouldEqual, ispec.MediaTypeImageIndex)
+
+			_, _, mediaType, err = is.GetImageManifest("repo", d.String())
+			So(err, ShouldBeNil)
+			So(mediaType, ShouldEqual, ispec.MediaTypeImageManifest)
+
+			// manifests aren't all for the same platform
+			buf, err = is.GetIndexContent("repo")
+			So(err, ShouldBeNil)
+
+			var index ispec.Index
+			So(json.Unmarshal(buf, &index), ShouldBeNil)
+
+			for _, desc := range index.Manifests {
+				So(desc.Platform, ShouldBeNil)
+			}
+
+			_, err = is.PutImageManifest("repo", "1.1", "application/vnd.oci.image.unknown.v1+json", iblob)
+			So(err, ShouldEqual, errors.ErrBadManifest)
+		})
+	}
+}
+
+func TestSHA512(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-repo-test")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	logger := log.Logger{Logger: zerolog.New(os.Stdout)}
+
+	driver, err := storage.NewDriver(storage.FilesystemDriverName,
+		map[string]interface{}{"rootDirectory": dir + "/driver"})
+	if err != nil {
+		panic(err)
+	}
+
+	stores := map[string]storage.ImageStore{
+		"local":  storage.NewImageStore(dir+"/local", true, true, storage.Options{}, logger),
+		"memory": storage.NewImageStoreMem(logger),
+		"driver": storage.NewImageStoreDriver(driver, true, storage.Options{}, logger),
+	}
+
+	for name, is := range stores {
+		Convey("Push and pull content addressed with sha512 in the "+name+" store", t, func() {
+			content := []byte("sha512 content")
+			digest := godigest.SHA512.FromBytes(content)
+
+			_, _, err := is.FullBlobUpload("repo", bytes.NewReader(content), digest.String())
+			So(err, ShouldBeNil)
+
+			_, _, err = is.FullBlobUpload("repo", bytes.NewReader(content), godigest.SHA512.FromString("x").String())
+			So(err, ShouldEqual, errors.ErrBadBlobDigest)
+
+			// in chunks
+			chunked := []byte("sha512 chunked content")
+			cdigest := godigest.SHA512.FromBytes(chunked)
+
+			uuid, err := is.NewBlobUpload("repo")
+			So(err, ShouldBeNil)
+			_, err = is.PutBlobChunk("repo", uuid, 0, 5, bytes.NewReader(chunked[:6]))
+			So(err, ShouldBeNil)
+			_, err = is.PutBlobChunk("repo", uuid, 6, int64(len(chunked)-1), bytes.NewReader(chunked[6:]))
+			So(err, ShouldBeNil)
+			So(is.FinishBlobUpload("repo", uuid, nil, cdigest.String()), ShouldBeNil)
+
+			for d, c := range map[godigest.Digest][]byte{digest: content, cdigest: chunked} {
+				r, size, err := is.GetBlob("repo", d.String(), "")
+				So(err, ShouldBeNil)
+				So(size, ShouldEqual, len(c))
+
+				buf, err := ioutil.ReadAll(r)
+				So(err, ShouldBeNil)
+				So(buf, ShouldResemble, c)
+
+				if closer, ok := r.(io.Closer); ok {
+					closer.Close()
+				}
+			}
+
+			// and so are manifests pushed by sha512 digest
+			img, err := test.GetRandomImage(64, 1)
+			So(err, ShouldBeNil)
+			So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+			mblob, err := img.ManifestBlob()
+			So(err, ShouldBeNil)
+
+			mdigest := godigest.SHA512.FromBytes(mblob)
+
+			d, err := is.PutImageManifest("repo", mdigest.String(), ispec.MediaTypeImageManifest, mblob)
+			So(err, ShouldBeNil)
+			So(d, ShouldEqual, mdigest.String())
+
+			buf, d, _, err := is.GetImageManifest("repo", mdigest.String())
+			So(err, ShouldBeNil)
+			So(d, ShouldEqual, mdigest.String())
+			So(buf, ShouldResemble, mblob)
+		})
+	}
+}
+
+// artifact returns a manifest of an artifact referring to subject, pushing its empty config.
+func artifact(is storage.ImageStore, repo string, artifactType string, subject godigest.Digest) []byte {
+	config := []byte("{}")
+	_, _, err := is.FullBlobUpload(repo, bytes.NewReader(config), godigest.FromBytes(config).String())
+	So(err, ShouldBeNil)
+
+	buf, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ispec.MediaTypeImageManifest,
+		"artifactType":  artifactType,
+		"config": map[string]interface{}{
+			"mediaType": "application/vnd.oci.empty.v1+json",
+			"digest":    godigest.FromBytes(config),
+			"size":      len(config),
+		},
+		"layers":      []interface{}{},
+		"subject":     map[string]interface{}{"mediaType": ispec.MediaTypeImageManifest, "digest": subject, "size": 1},
+		"annotations": map[string]string{"org.example.kind": artifactType},
+	})
+	So(err, ShouldBeNil)
+
+	return buf
+}
+
+func TestReferrers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-repo-test")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	logger := log.Logger{Logger: zerolog.New(os.Stdout)}
+
+	driver, err := storage.NewDriver(storage.FilesystemDriverName,
+		map[string]interface{}{"rootDirectory": dir + "/driver"})
+	if err != nil {
+		panic(err)
+	}
+
+	stores := map[string]storage.ImageStore{
+		"local":  storage.NewImageStore(dir+"/local", true, true, storage.Options{}, logger),
+		"memory": storage.NewImageStoreMem(logger),
+		"driver": storage.NewImageStoreDriver(driver, true, storage.Options{}, logger),
+	}
+
+	for name, is := range stores {
+		Convey("List the referrers of manifests in the "+name+" store", t, func() {
+			img, err := test.GetRandomImage(64, 1)
+			So(err, ShouldBeNil)
+			So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+			subject, err := img.Digest()
+			So(err, ShouldBeNil)
+
+			_, err = is.GetReferrers("other", subject.String(), "")
+			So(err, ShouldEqual, errors.ErrRepoNotFound)
+
+			_, err = is.GetReferrers("repo", "sha256:x", "")
+			So(err, ShouldEqual, errors.ErrBadBlobDigest)
+
+			refs, err := is.GetReferrers("repo", subject.String(), "")
+			So(err, ShouldBeNil)
+			So(refs, ShouldBeEmpty)
+
+			sig := artifact(is, "repo", "application/vnd.example.signature", subject)
+			sbom := artifact(is, "repo", "application/vnd.example.sbom", subject)
+
+			for _, m := range [][]byte{sig, sbom} {
+				_, err = is.PutImageManifest("repo", godigest.FromBytes(m).String(), ispec.MediaTypeImageManifest, m)
+				So(err, ShouldBeNil)
+			}
+
+			refs, err = is.GetReferrers("repo", subject.String(), "")
+			So(err, ShouldBeNil)
+			So(refs, ShouldHaveLength, 2)
+
+			for _, r := range refs {
+				So(r.MediaType, ShouldEqual, ispec.MediaTypeImageManifest)
+				So(r.Annotations["org.example.kind"], ShouldEqual, r.ArtifactType)
+
+				if r.Digest == godigest.FromBytes(sig) {
+					So(r.ArtifactType, ShouldEqual, "application/vnd.example.signature")
+					So(r.Size, ShouldEqual, len(sig))
+				} else {
+					So(r.Digest, ShouldEqual, godigest.FromBytes(sbom))
+				}
+			}
+
+			refs, err = is.GetReferrers("repo", subject.String(), "application/vnd.example.sbom")
+			So(err, ShouldBeNil)
+			So(refs, ShouldHaveLength, 1)
+			So(refs[0].Digest, ShouldEqual, godigest.FromBytes(sbom))
+
+			// nothing refers to the referrers
+			refs, err = is.GetReferrers("repo", godigest.FromBytes(sig).String(), "")
+			So(err, ShouldBeNil)
+			So(refs, ShouldBeEmpty)
+
+			So(is.DeleteImageManifest("repo", godigest.FromBytes(sbom).String()), ShouldBeNil)
+
+			refs, err = is.GetReferrers("repo", subject.String(), "")
+			So(err, ShouldBeNil)
+			So(refs, ShouldHaveLength, 1)
+			So(refs[0].Digest, ShouldEqual, godigest.FromBytes(sig))
+		})
+	}
+}
+
+func TestConcurrentPushes(t *testing.T) {
+	Convey("Add manifests pushed at once to the index together", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		is := storage.NewImageStore(dir, true, true, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
+		So(is, ShouldNotBeNil)
+
+		const pushes = 20
+
+		imgs := make([]test.Image, pushes)
+
+		for i := range imgs {
+			imgs[i], err = test.GetRandomImage(64, 1)
+			So(err, ShouldBeNil)
+		}
+
+		errs := make(chan error, 2*pushes)
+
+		var wg sync.WaitGroup
+
+		for i, img := range imgs {
+			wg.Add(2)
+
+			go func(i int, img test.Image) {
+				defer wg.Done()
+				errs <- test.WriteImageToStore(img, is, "repo", fmt.Sprintf("%d", i))
+			}(i, img)
+
+			// and moved meanwhile
+			go func(img test.Image) {
+				defer wg.Done()
+				errs <- test.WriteImageToStore(img, is, "repo", "latest")
+			}(img)
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			So(err, ShouldBeNil)
+		}
+
+		tags, err := is.GetImageTags("repo")
+		So(err, ShouldBeNil)
+		So(len(tags), ShouldEqual, pushes+1)
+
+		for i, img := range imgs {
+			digest, err := img.Digest()
+			So(err, ShouldBeNil)
+
+			_, mDigest, _, err := is.GetImageManifest("repo", fmt.Sprintf("%d", i))
+			So(err, ShouldBeNil)
+			So(mDigest, ShouldEqual, digest.String())
+		}
+
+		_, _, _, err = is.GetImageManifest("repo", "latest")
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestManyLayers(t *testing.T) {
+	Convey("Check the layers of images with many of them", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		is := storage.NewImageStore(dir, true, true, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
+		So(is, ShouldNotBeNil)
+
+		img, err := test.GetRandomImage(64, 100)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+		_, mDigest, _, err := is.GetImageManifest("repo", "1.0")
+		So(err, ShouldBeNil)
+
+		digest, err := img.Digest()
+		So(err, ShouldBeNil)
+		So(mDigest, ShouldEqual, digest.String())
+
+		// the first missing layer is reported
+		missing := img.Manifest.Layers[42].Digest
+		So(is.DeleteBlob("repo", missing.String()), ShouldBeNil)
+		So(is.DeleteBlob("repo", img.Manifest.Layers[84].Digest.String()), ShouldBeNil)
+
+		img.Manifest.Annotations = map[string]string{"retagged": "true"}
+		mblob, err := img.ManifestBlob()
+		So(err, ShouldBeNil)
+
+		d, err := is.PutImageManifest("repo", "2.0", ispec.MediaTypeImageManifest, mblob)
+		So(err, ShouldEqual, errors.ErrBlobNotFound)
+		So(d, ShouldEqual, missing.String())
+	})
+}
+
+func TestUploadDir(t *testing.T) {
+	Convey("Stage uploads outside of the root directory", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		// uploads are copied from another filesystem, if tmpfs is mounted there
+		uploadDirs := []string{os.TempDir()}
+		if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+			uploadDirs = append(uploadDirs, "/dev/shm")
+		}
+
+		for _, parent := range uploadDirs {
+			uploadDir, err := ioutil.TempDir(parent, "oci-upload-test")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(uploadDir)
+
+			is := storage.NewImageStore(dir, true, true, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
+			So(is, ShouldNotBeNil)
+			So(is.SetUploadDir(uploadDir), ShouldBeNil)
+
+			content := []byte("staged " + parent)
+			digest := godigest.FromBytes(content)
+
+			uuid, err := is.NewBlobUpload("a/b")
+			So(err, ShouldBeNil)
+			So(is.BlobUploadPath("a/b", uuid), ShouldEqual, path.Join(uploadDir, "a", "b", uuid))
+
+			_, err = is.PutBlobChunk("a/b", uuid, 0, int64(len(content)), bytes.NewReader(content))
+			So(err, ShouldBeNil)
+
+			_, err = os.Stat(path.Join(uploadDir, "a", "b", uuid))
+			So(err, ShouldBeNil)
+
+			So(is.FinishBlobUpload("a/b", uuid, bytes.NewReader(content), digest.String()), ShouldBeNil)
+
+			_, err = os.Stat(path.Join(uploadDir, "a", "b", uuid))
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			ok, size, err := is.CheckBlob("a/b", digest.String(), "")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(size, ShouldEqual, len(content))
+
+			// and deduped
+			_, _, err = is.FullBlobUpload("c", bytes.NewReader(content), digest.String())
+			So(err, ShouldBeNil)
+
+			src, err := os.Stat(is.BlobPath("a/b", digest))
+			So(err, ShouldBeNil)
+			dst, err := os.Stat(is.BlobPath("c", digest))
+			So(err, ShouldBeNil)
+			So(os.SameFile(src, dst), ShouldBeTrue)
+
+			for _, staging := range []string{path.Join(uploadDir, "c"), path.Join(dir, "c", storage.BlobUploadDir)} {
+				files, err := ioutil.ReadDir(staging)
+				So(err, ShouldBeNil)
+				So(files, ShouldBeEmpty)
+			}
+
+			So(is.Close(), ShouldBeNil)
+		}
+	})
+}
+
 func TestNegativeCases(t *testing.T) {
 	Convey("Invalid root dir", t, func(c C) {
 		dir, err := ioutil.TempDir("", "oci-repo-test")
@@ -502,9 +1973,11 @@ func TestNegativeCases(t *testing.T) {
 		}
 		os.RemoveAll(dir)
 
-		So(storage.NewImageStore(dir, true, true, log.Logger{Logger: zerolog.New(os.Stdout)}), ShouldNotBeNil)
+		So(storage.NewImageStore(dir, true, true, storage.Options{},
+			log.Logger{Logger: zerolog.New(os.Stdout)}), ShouldNotBeNil)
 		if os.Geteuid() != 0 {
-			So(storage.NewImageStore("/deadBEEF", true, true, log.Logger{Logger: zerolog.New(os.Stdout)}), ShouldBeNil)
+			So(storage.NewImageStore("/deadBEEF", true, true, storage.Options{},
+				log.Logger{Logger: zerolog.New(os.Stdout)}), ShouldBeNil)
 		}
 	})
 
@@ -514,7 +1987,7 @@ func TestNegativeCases(t *testing.T) {
 			panic(err)
 		}
 		defer os.RemoveAll(dir)
-		il := storage.NewImageStore(dir, true, true, log.Logger{Logger: zerolog.New(os.Stdout)})
+		il := storage.NewImageStore(dir, true, true, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
 		err = os.Chmod(dir, 0000) // remove all perms
 		So(err, ShouldBeNil)
 		if os.Geteuid() != 0 {
@@ -528,7 +2001,7 @@ func TestNegativeCases(t *testing.T) {
 			panic(err)
 		}
 		defer os.RemoveAll(dir)
-		il := storage.NewImageStore(dir, true, true, log.Logger{Logger: zerolog.New(os.Stdout)})
+		il := storage.NewImageStore(dir, true, true, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
 		So(il, ShouldNotBeNil)
 		So(il.InitRepo("test"), ShouldBeNil)
 		files, err := ioutil.ReadDir(path.Join(dir, "test"))
@@ -552,7 +2025,7 @@ func TestNegativeCases(t *testing.T) {
 	})
 
 	Convey("Invalid get image tags", t, func(c C) {
-		il := &storage.ImageStore{}
+		il := &storage.ImageStoreLocal{}
 		_, err := il.GetImageTags("test")
 		So(err, ShouldNotBeNil)
 
@@ -561,7 +2034,7 @@ func TestNegativeCases(t *testing.T) {
 			panic(err)
 		}
 		defer os.RemoveAll(dir)
-		il = storage.NewImageStore(dir, true, true, log.Logger{Logger: zerolog.New(os.Stdout)})
+		il = storage.NewImageStore(dir, true, true, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
 		So(il, ShouldNotBeNil)
 		So(il.InitRepo("test"), ShouldBeNil)
 		So(os.Remove(path.Join(dir, "test", "index.json")), ShouldBeNil)
@@ -575,7 +2048,7 @@ func TestNegativeCases(t *testing.T) {
 	})
 
 	Convey("Invalid get image manifest", t, func(c C) {
-		il := &storage.ImageStore{}
+		il := &storage.ImageStoreLocal{}
 		_, _, _, err := il.GetImageManifest("test", "")
 		So(err, ShouldNotBeNil)
 
@@ -584,7 +2057,7 @@ func TestNegativeCases(t *testing.T) {
 			panic(err)
 		}
 		defer os.RemoveAll(dir)
-		il = storage.NewImageStore(dir, true, true, log.Logger{Logger: zerolog.New(os.Stdout)})
+		il = storage.NewImageStore(dir, true, true, storage.Options{}, log.Logger{Logger: zerolog.New(os.Stdout)})
 		So(il, ShouldNotBeNil)
 		So(il.InitRepo("test"), ShouldBeNil)
 		So(os.Remove(path.Join(dir, "test", "index.json")), ShouldBeNil)
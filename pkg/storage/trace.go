@@ -0,0 +1,18 @@
+package storage
+
+// Tracer traces what stores do within, or besides, serving their methods, e.g. deduping blobs
+// and collecting garbage, for the time spent at it to be told apart.
+type Tracer interface {
+	// Trace starts tracing op on a blob of repo, or on repo if digest is empty, returning the
+	// function ending it with its outcome.
+	Trace(op string, repo string, digest string) func(error)
+}
+
+// trace starts tracing op with t, if set.
+func trace(t Tracer, op string, repo string, digest string) func(error) {
+	if t == nil {
+		return func(error) {}
+	}
+
+	return t.Trace(op, repo, digest)
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"io"
+	"sync"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// uploadDigest is the digest of a blob upload so far, computed as its chunks are written,
+// so that finishing it doesn't read it all again.
+type uploadDigest struct {
+	digester godigest.Digester
+	size     int64 // bytes digested
+}
+
+// uploadDigests tracks the digests of the blob uploads in progress, by upload path.
+type uploadDigests struct {
+	lock    sync.Mutex
+	digests map[string]*uploadDigest
+}
+
+func newUploadDigests() *uploadDigests {
+	return &uploadDigests{digests: make(map[string]*uploadDigest)}
+}
+
+// start tracks the digest of a new, empty upload.
+func (u *uploadDigests) start(path string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.digests[path] = &uploadDigest{digester: godigest.Canonical.Digester()}
+}
+
+// writer returns a writer appending to the digest of an upload the chunk written to w at
+// offset, along with w, or just w if the digest isn't tracked up to that offset, e.g. for
+// uploads started before a restart or appended to by another process sharing the storage,
+// which then no longer are.
+func (u *uploadDigests) writer(path string, offset int64, w io.Writer) io.Writer {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	d, ok := u.digests[path]
+	if !ok {
+		return w
+	}
+
+	if d.size != offset {
+		delete(u.digests, path)
+		return w
+	}
+
+	return io.MultiWriter(w, &digestWriter{d})
+}
+
+// digest returns the digest of an upload of the given size, if tracked up to its end.
+func (u *uploadDigests) digest(path string, size int64) (godigest.Digest, bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	d, ok := u.digests[path]
+	if !ok || d.size != size {
+		return "", false
+	}
+
+	return d.digester.Digest(), true
+}
+
+// forget stops tracking the digest of an upload, once finished or deleted.
+func (u *uploadDigests) forget(path string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	delete(u.digests, path)
+}
+
+type digestWriter struct {
+	d *uploadDigest
+}
+
+func (w *digestWriter) Write(p []byte) (int, error) {
+	n, err := w.d.digester.Hash().Write(p)
+	w.d.size += int64(n)
+
+	return n, err
+}
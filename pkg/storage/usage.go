@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// DiskUsage returns the bytes of the files under rootDir, counting those hard linked to each
+// other, e.g. blobs deduped, once.
+func DiskUsage(rootDir string) (int64, error) {
+	var usage int64
+
+	// by name, since deduped blobs are named after their digest wherever they're linked
+	seen := map[string][]os.FileInfo{}
+
+	err := filepath.Walk(rootDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// removed meanwhile, e.g. by garbage collection
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		if sameFileAsAny(fi, seen[fi.Name()]) {
+			return nil
+		}
+
+		seen[fi.Name()] = append(seen[fi.Name()], fi)
+		usage += fi.Size()
+
+		return nil
+	})
+
+	return usage, err
+}
@@ -0,0 +1,48 @@
+package storage_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/anuvu/zot/pkg/storage"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDiskUsage(t *testing.T) {
+	Convey("Measure the usage of a storage", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		usage, err := storage.DiskUsage(dir)
+		So(err, ShouldBeNil)
+		So(usage, ShouldEqual, 0)
+
+		for _, d := range []string{"repo1", "repo2", "repo3"} {
+			So(os.MkdirAll(path.Join(dir, d, "blobs", "sha256"), 0755), ShouldBeNil)
+		}
+
+		So(ioutil.WriteFile(path.Join(dir, "repo1", "blobs", "sha256", "abc"), make([]byte, 100), 0644), ShouldBeNil)
+		// a copy
+		So(ioutil.WriteFile(path.Join(dir, "repo2", "blobs", "sha256", "abc"), make([]byte, 100), 0644), ShouldBeNil)
+		So(ioutil.WriteFile(path.Join(dir, "repo2", "blobs", "sha256", "def"), make([]byte, 10), 0644), ShouldBeNil)
+
+		usage, err = storage.DiskUsage(dir)
+		So(err, ShouldBeNil)
+		So(usage, ShouldEqual, 210)
+
+		// blobs deduped, i.e. hard linked, are counted once
+		So(os.Link(path.Join(dir, "repo1", "blobs", "sha256", "abc"), path.Join(dir, "repo3", "blobs", "sha256", "abc")),
+			ShouldBeNil)
+
+		usage, err = storage.DiskUsage(dir)
+		So(err, ShouldBeNil)
+		So(usage, ShouldEqual, 210)
+
+		usage, err = storage.DiskUsage(path.Join(dir, "missing"))
+		So(err, ShouldBeNil)
+		So(usage, ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,276 @@
+// Package test provides helpers to generate valid OCI images and push them into
+// an image store or a running registry, for use by tests.
+package test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/storage"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"gopkg.in/resty.v1"
+)
+
+// Image is an OCI image made of a config, its layers and the manifest referencing them.
+type Image struct {
+	Manifest ispec.Manifest
+	Config   ispec.Image
+	Layers   [][]byte
+}
+
+// MultiarchImage is a set of images for different platforms and the index referencing them.
+type MultiarchImage struct {
+	Images []Image
+	Index  ispec.Index
+}
+
+// GetImage returns an image built from the given layers for the given platform.
+func GetImage(layers [][]byte, platform ispec.Platform) (Image, error) {
+	img := Image{
+		Config: ispec.Image{
+			Architecture: platform.Architecture,
+			OS:           platform.OS,
+			RootFS:       ispec.RootFS{Type: "layers", DiffIDs: []godigest.Digest{}},
+		},
+		Layers: layers,
+	}
+
+	descs := make([]ispec.Descriptor, 0, len(layers))
+
+	for _, l := range layers {
+		d := godigest.FromBytes(l)
+		img.Config.RootFS.DiffIDs = append(img.Config.RootFS.DiffIDs, d)
+		descs = append(descs, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayer,
+			Digest:    d,
+			Size:      int64(len(l)),
+		})
+	}
+
+	cblob, err := json.Marshal(img.Config)
+	if err != nil {
+		return Image{}, err
+	}
+
+	img.Manifest = ispec.Manifest{
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    godigest.FromBytes(cblob),
+			Size:      int64(len(cblob)),
+		},
+		Layers: descs,
+	}
+	img.Manifest.SchemaVersion = 2
+
+	return img, nil
+}
+
+// GetRandomImage returns a linux/amd64 image with layerCount layers of random content
+// of layerSize bytes each.
+func GetRandomImage(layerSize int, layerCount int) (Image, error) {
+	return getRandomImage(layerSize, layerCount, ispec.Platform{Architecture: "amd64", OS: "linux"})
+}
+
+// GetRandomMultiarchImage returns one random single-layer image per platform and
+// the index referencing them.
+func GetRandomMultiarchImage(layerSize int, platforms []ispec.Platform) (MultiarchImage, error) {
+	mi := MultiarchImage{}
+	mi.Index.SchemaVersion = 2
+
+	for i := range platforms {
+		img, err := getRandomImage(layerSize, 1, platforms[i])
+		if err != nil {
+			return MultiarchImage{}, err
+		}
+
+		mblob, err := img.ManifestBlob()
+		if err != nil {
+			return MultiarchImage{}, err
+		}
+
+		mi.Images = append(mi.Images, img)
+		mi.Index.Manifests = append(mi.Index.Manifests, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    godigest.FromBytes(mblob),
+			Size:      int64(len(mblob)),
+			Platform:  &platforms[i],
+		})
+	}
+
+	return mi, nil
+}
+
+func getRandomImage(layerSize int, layerCount int, platform ispec.Platform) (Image, error) {
+	layers := make([][]byte, 0, layerCount)
+
+	for i := 0; i < layerCount; i++ {
+		l := make([]byte, layerSize)
+		if _, err := rand.Read(l); err != nil {
+			return Image{}, err
+		}
+
+		layers = append(layers, l)
+	}
+
+	return GetImage(layers, platform)
+}
+
+// ConfigBlob returns the serialized image config.
+func (img Image) ConfigBlob() ([]byte, error) {
+	return json.Marshal(img.Config)
+}
+
+// ManifestBlob returns the serialized image manifest.
+func (img Image) ManifestBlob() ([]byte, error) {
+	return json.Marshal(img.Manifest)
+}
+
+// Digest returns the digest of the image manifest.
+func (img Image) Digest() (godigest.Digest, error) {
+	mblob, err := img.ManifestBlob()
+	if err != nil {
+		return "", err
+	}
+
+	return godigest.FromBytes(mblob), nil
+}
+
+// IndexBlob returns the serialized image index.
+func (mi MultiarchImage) IndexBlob() ([]byte, error) {
+	return json.Marshal(mi.Index)
+}
+
+// WriteImageToStore writes the image blobs and manifest into an image store under
+// the given reference (tag or digest).
+func WriteImageToStore(img Image, is storage.ImageStore, repo string, ref string) error {
+	if err := is.InitRepo(repo); err != nil {
+		return err
+	}
+
+	cblob, err := img.ConfigBlob()
+	if err != nil {
+		return err
+	}
+
+	for _, blob := range append([][]byte{cblob}, img.Layers...) {
+		if _, _, err := is.FullBlobUpload(repo, bytes.NewReader(blob), godigest.FromBytes(blob).String()); err != nil {
+			return err
+		}
+	}
+
+	mblob, err := img.ManifestBlob()
+	if err != nil {
+		return err
+	}
+
+	_, err = is.PutImageManifest(repo, ref, ispec.MediaTypeImageManifest, mblob)
+
+	return err
+}
+
+// UploadImage pushes the image blobs and manifest to the registry at baseURL under
+// the given reference (tag or digest).
+func UploadImage(img Image, baseURL string, repo string, ref string) error {
+	return uploadImage(resty.DefaultClient, img, baseURL, repo, ref)
+}
+
+// UploadImageWithBasicAuth pushes the image as UploadImage does, authenticating as user.
+func UploadImageWithBasicAuth(img Image, baseURL string, repo string, ref string, user string,
+	password string) error {
+	return uploadImage(resty.New().SetBasicAuth(user, password), img, baseURL, repo, ref)
+}
+
+func uploadImage(client *resty.Client, img Image, baseURL string, repo string, ref string) error {
+	cblob, err := img.ConfigBlob()
+	if err != nil {
+		return err
+	}
+
+	for _, blob := range append([][]byte{cblob}, img.Layers...) {
+		if err := uploadBlob(client, baseURL, repo, blob); err != nil {
+			return err
+		}
+	}
+
+	mblob, err := img.ManifestBlob()
+	if err != nil {
+		return err
+	}
+
+	return uploadManifest(client, baseURL, repo, ref, ispec.MediaTypeImageManifest, mblob)
+}
+
+// UploadMultiarchImage pushes each of the images by digest, and then the index under the
+// given reference. The registry must support image indexes.
+func UploadMultiarchImage(mi MultiarchImage, baseURL string, repo string, ref string) error {
+	for _, img := range mi.Images {
+		d, err := img.Digest()
+		if err != nil {
+			return err
+		}
+
+		if err := UploadImage(img, baseURL, repo, d.String()); err != nil {
+			return err
+		}
+	}
+
+	iblob, err := mi.IndexBlob()
+	if err != nil {
+		return err
+	}
+
+	return uploadManifest(resty.DefaultClient, baseURL, repo, ref, ispec.MediaTypeImageIndex, iblob)
+}
+
+func uploadBlob(client *resty.Client, baseURL string, repo string, blob []byte) error {
+	resp, err := client.R().Post(fmt.Sprintf("%s/v2/%s/blobs/uploads/", baseURL, repo))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode() != http.StatusAccepted {
+		return fmt.Errorf("%w: starting upload: %s", errors.ErrUnexpectedStatus, resp.Status())
+	}
+
+	loc := resp.Header().Get("Location")
+	if len(loc) > 0 && loc[0] == '/' {
+		loc = baseURL + loc
+	}
+
+	resp, err = client.R().
+		SetHeader("Content-Type", "application/octet-stream").
+		SetQueryParam("digest", godigest.FromBytes(blob).String()).
+		SetBody(blob).
+		Put(loc)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode() != http.StatusCreated {
+		return fmt.Errorf("%w: uploading blob: %s", errors.ErrUnexpectedStatus, resp.Status())
+	}
+
+	return nil
+}
+
+func uploadManifest(client *resty.Client, baseURL string, repo string, ref string, mediaType string,
+	body []byte) error {
+	resp, err := client.R().
+		SetHeader("Content-Type", mediaType).
+		SetBody(body).
+		Put(fmt.Sprintf("%s/v2/%s/manifests/%s", baseURL, repo, ref))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode() != http.StatusCreated {
+		return fmt.Errorf("%w: uploading manifest: %s", errors.ErrUnexpectedStatus, resp.Status())
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package test_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/anuvu/zot/pkg/api"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGetImage(t *testing.T) {
+	Convey("Generate random images", t, func() {
+		img, err := test.GetRandomImage(100, 3)
+		So(err, ShouldBeNil)
+		So(len(img.Layers), ShouldEqual, 3)
+		So(len(img.Manifest.Layers), ShouldEqual, 3)
+		So(len(img.Config.RootFS.DiffIDs), ShouldEqual, 3)
+		So(img.Manifest.Layers[0].Digest, ShouldEqual, godigest.FromBytes(img.Layers[0]))
+
+		cblob, err := img.ConfigBlob()
+		So(err, ShouldBeNil)
+		So(img.Manifest.Config.Digest, ShouldEqual, godigest.FromBytes(cblob))
+
+		other, err := test.GetRandomImage(100, 3)
+		So(err, ShouldBeNil)
+		d1, err := img.Digest()
+		So(err, ShouldBeNil)
+		d2, err := other.Digest()
+		So(err, ShouldBeNil)
+		So(d1, ShouldNotEqual, d2)
+	})
+
+	Convey("Generate a multiarch image", t, func() {
+		platforms := []ispec.Platform{{Architecture: "amd64", OS: "linux"}, {Architecture: "arm64", OS: "linux"}}
+		mi, err := test.GetRandomMultiarchImage(10, platforms)
+		So(err, ShouldBeNil)
+		So(len(mi.Images), ShouldEqual, 2)
+		So(len(mi.Index.Manifests), ShouldEqual, 2)
+		So(mi.Images[1].Config.Architecture, ShouldEqual, "arm64")
+		So(mi.Index.Manifests[1].Platform.Architecture, ShouldEqual, "arm64")
+
+		d, err := mi.Images[1].Digest()
+		So(err, ShouldBeNil)
+		So(mi.Index.Manifests[1].Digest, ShouldEqual, d)
+	})
+}
+
+func TestWriteImageToStore(t *testing.T) {
+	Convey("Write an image into an image store", t, func() {
+		is := storage.NewImageStoreMem(log.NewLogger("debug", ""))
+
+		img, err := test.GetRandomImage(100, 2)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+		tags, err := is.GetImageTags("repo")
+		So(err, ShouldBeNil)
+		So(tags, ShouldResemble, []string{"1.0"})
+
+		ok, _, err := is.CheckBlob("repo", img.Manifest.Layers[1].Digest.String(), "")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+	})
+}
+
+func TestUploadImage(t *testing.T) {
+	Convey("Upload an image to a registry", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := api.NewConfig()
+		config.HTTP.Port = "0"
+		config.Storage.RootDirectory = dir
+		c := api.NewController(config)
+		So(c.Start(context.Background()), ShouldBeNil)
+		defer func() { _ = c.Stop(context.Background()) }()
+
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d", c.Port())
+
+		img, err := test.GetRandomImage(100, 2)
+		So(err, ShouldBeNil)
+		So(test.UploadImage(img, baseURL, "repo", "1.0"), ShouldBeNil)
+
+		d, err := img.Digest()
+		So(err, ShouldBeNil)
+		_, digest, _, err := c.ImageStore.GetImageManifest("repo", "1.0")
+		So(err, ShouldBeNil)
+		So(digest, ShouldEqual, d.String())
+
+		So(test.UploadImage(img, "http://127.0.0.1:0", "repo", "1.0"), ShouldNotBeNil)
+	})
+}
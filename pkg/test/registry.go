@@ -0,0 +1,141 @@
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Registry is a bare in-memory registry to push images to, and pull them from, without
+// authentication, standing in for another registry zot talks to.
+type Registry struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	blobs     map[string][]byte // by repository and digest
+	manifests map[string][]byte // by repository and tag or digest
+	uploads   int
+}
+
+// NewRegistry starts an empty registry, which the caller must close.
+func NewRegistry() *Registry {
+	r := &Registry{blobs: map[string][]byte{}, manifests: map[string][]byte{}}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+
+	return r
+}
+
+// Blob returns the contents of a blob, and whether the registry has it.
+func (r *Registry) Blob(repo string, digest string) ([]byte, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	blob, ok := r.blobs[repo+"@"+digest]
+
+	return blob, ok
+}
+
+// DeleteBlob removes a blob, e.g. to simulate a partial push.
+func (r *Registry) DeleteBlob(repo string, digest string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.blobs, repo+"@"+digest)
+}
+
+// Manifest returns the contents of a manifest, and whether the registry has it.
+func (r *Registry) Manifest(repo string, reference string) ([]byte, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	manifest, ok := r.manifests[repo+":"+reference]
+
+	return manifest, ok
+}
+
+// Uploads returns how many blobs were uploaded.
+func (r *Registry) Uploads() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.uploads
+}
+
+func (r *Registry) serve(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/v2/"), "/"), "/")
+	if len(parts) < 3 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	kind, reference := parts[len(parts)-2], parts[len(parts)-1]
+	repo := strings.Join(parts[:len(parts)-2], "/")
+
+	switch {
+	case kind == "blobs" && reference == "uploads" && req.Method == http.MethodPost:
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d", repo, r.uploads))
+		w.WriteHeader(http.StatusAccepted)
+	case kind == "uploads" && req.Method == http.MethodPut:
+		repo = strings.TrimSuffix(repo, "/blobs")
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil || godigest.FromBytes(body).String() != req.URL.Query().Get("digest") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		r.blobs[repo+"@"+req.URL.Query().Get("digest")] = body
+		r.uploads++
+
+		w.WriteHeader(http.StatusCreated)
+	case kind == "blobs" && (req.Method == http.MethodGet || req.Method == http.MethodHead):
+		blob, ok := r.blobs[repo+"@"+reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Length", fmt.Sprint(len(blob)))
+
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(blob)
+		}
+	case kind == "manifests" && req.Method == http.MethodPut:
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		digest := godigest.FromBytes(body).String()
+		r.manifests[repo+":"+reference] = body
+		r.manifests[repo+":"+digest] = body
+
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+	case kind == "manifests" && (req.Method == http.MethodGet || req.Method == http.MethodHead):
+		manifest, ok := r.manifests[repo+":"+reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Docker-Content-Digest", godigest.FromBytes(manifest).String())
+		w.Header().Set("Content-Type", ispec.MediaTypeImageManifest)
+
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(manifest)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
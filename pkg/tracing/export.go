@@ -0,0 +1,252 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	queueSize     = 4096 // spans ended but not exported yet, beyond which they're dropped
+	batchSize     = 512
+	flushInterval = 5 * time.Second
+	exportTimeout = 10 * time.Second
+
+	// scopeName is the instrumentation scope spans are reported under.
+	scopeName = "github.com/anuvu/zot"
+)
+
+// export queues a span ended to be exported, dropping it if too many already are, rather than
+// slowing down requests for the endpoint being down or slow.
+func (t *Tracer) export(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
+
+// Run exports the spans ended, in batches, until ctx is done, exporting those queued then.
+func (t *Tracer) Run(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+
+		batch := make([]*Span, 0, batchSize)
+
+		for {
+			select {
+			case s := <-t.queue:
+				if batch = append(batch, s); len(batch) < batchSize {
+					continue
+				}
+			case <-ticker.C:
+			case <-ctx.Done():
+			drain:
+				for {
+					select {
+					case s := <-t.queue:
+						batch = append(batch, s)
+					default:
+						break drain
+					}
+				}
+
+				t.post(batch)
+				t.log.Info().Msg("stopping tracing")
+
+				return
+			}
+
+			t.post(batch)
+			batch = batch[:0]
+		}
+	}()
+}
+
+// post posts a batch of spans to the endpoint, logging rather than retrying on failure, spans
+// being best effort.
+func (t *Tracer) post(batch []*Span) {
+	if dropped := atomic.SwapInt64(&t.dropped, 0); dropped > 0 {
+		t.log.Warn().Int64("spans", dropped).Msg("dropped spans, too many queued for export")
+	}
+
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(t.request(batch))
+	if err != nil {
+		t.log.Error().Err(err).Msg("unable to encode spans")
+		return
+	}
+
+	endpoint := t.config.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		t.log.Error().Err(err).Str("endpoint", endpoint).Msg("unable to export spans")
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	for k, v := range t.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		t.log.Error().Err(err).Str("endpoint", endpoint).Msg("unable to export spans")
+		return
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		t.log.Error().Str("endpoint", endpoint).Int("status", resp.StatusCode).Msg("unable to export spans")
+	}
+}
+
+// otlpRequest is an OTLP/HTTP export request, as of its JSON mapping, ids being hex encoded
+// and 64 bits integers strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Links             []otlpLink      `json:"links,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 2 if failed, unset otherwise
+	Message string `json:"message,omitempty"`
+}
+
+func (t *Tracer) request(batch []*Span) otlpRequest {
+	service := t.config.ServiceName
+	if service == "" {
+		service = defaultServiceName
+	}
+
+	spans := make([]otlpSpan, 0, len(batch))
+
+	for _, s := range batch {
+		spans = append(spans, s.otlp())
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes([]Attribute{String("service.name", service)})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: scopeName}, Spans: spans}},
+	}}}
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.context.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.context.SpanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.attrs),
+	}
+
+	if s.parent != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+
+	for _, l := range s.links {
+		span.Links = append(span.Links, otlpLink{TraceID: hex.EncodeToString(l.TraceID[:]),
+			SpanID: hex.EncodeToString(l.SpanID[:])})
+	}
+
+	if s.err != "" {
+		span.Status = otlpStatus{Code: 2, Message: s.err}
+	}
+
+	return span
+}
+
+func otlpAttributes(attrs []Attribute) []otlpAttribute {
+	otlp := make([]otlpAttribute, 0, len(attrs))
+
+	for _, a := range attrs {
+		var v otlpValue
+
+		switch value := a.Value.(type) {
+		case string:
+			v.StringValue = &value
+		case int64:
+			i := strconv.FormatInt(value, 10)
+			v.IntValue = &i
+		case bool:
+			v.BoolValue = &value
+		default:
+			continue
+		}
+
+		otlp = append(otlp, otlpAttribute{Key: a.Key, Value: v})
+	}
+
+	return otlp
+}
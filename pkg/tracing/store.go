@@ -0,0 +1,330 @@
+package tracing
+
+import (
+	"context"
+	"io"
+
+	"github.com/anuvu/zot/pkg/storage"
+)
+
+// ImageStore traces the operations of the store it wraps done on behalf of traced requests, as
+// their children.
+type ImageStore struct {
+	storage.ImageStore
+	tracer *Tracer
+}
+
+// NewImageStore returns is, tracing its operations with tracer once given the context of requests.
+func NewImageStore(is storage.ImageStore, tracer *Tracer) *ImageStore {
+	return &ImageStore{ImageStore: is, tracer: tracer}
+}
+
+// WithContext returns the store tracing its operations as children of the span carried by ctx,
+// or the store wrapped, untraced, if ctx carries none.
+func (is *ImageStore) WithContext(ctx context.Context) storage.ImageStore {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return is.ImageStore
+	}
+
+	return &tracedStore{ImageStore: is.ImageStore, tracer: is.tracer, parent: span.Context()}
+}
+
+// Trace traces dedupe within the uploads of blobs traced, as their children, and garbage
+// collection as the roots of traces of their own, linked to the last write traced to their
+// repositories, having implemented storage.Tracer.
+func (t *Tracer) Trace(op string, repo string, digest string) func(error) {
+	t.lock.Lock()
+
+	var span *Span
+
+	if digest != "" {
+		upload, ok := t.finishes[repo+"@"+digest]
+		if !ok {
+			t.lock.Unlock()
+			return func(error) {}
+		}
+
+		span = t.start(upload.Context(), "storage."+op, kindInternal)
+		span.SetAttributes(String("zot.digest", digest))
+	} else {
+		span = t.start(SpanContext{}, "storage."+op, kindInternal)
+
+		if write, ok := t.writes[repo]; ok {
+			delete(t.writes, repo)
+
+			span.links = append(span.links, write)
+		}
+	}
+
+	t.lock.Unlock()
+
+	span.SetAttributes(String("zot.repository", repo))
+
+	return func(err error) {
+		span.SetError(err)
+		span.End()
+	}
+}
+
+// finishing records the span of the upload of a blob being finished, for its dedupe to be traced
+// as its child, returning the function forgetting it once finished.
+func (t *Tracer) finishing(repo string, digest string, span *Span) func() {
+	key := repo + "@" + digest
+
+	t.lock.Lock()
+	t.finishes[key] = span
+	t.lock.Unlock()
+
+	return func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+
+		if t.finishes[key] == span {
+			delete(t.finishes, key)
+		}
+	}
+}
+
+// wrote records the span of the last write to a repository, for its garbage collection to be
+// linked to.
+func (t *Tracer) wrote(repo string, span *Span) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.writes[repo] = span.Context()
+}
+
+// tracedStore traces the operations of a store as children of a span.
+type tracedStore struct {
+	storage.ImageStore
+	tracer *Tracer
+	parent SpanContext
+}
+
+func (s *tracedStore) start(op string, repo string, attrs ...Attribute) *Span {
+	span := s.tracer.start(s.parent, "storage."+op, kindInternal)
+
+	if repo != "" {
+		span.SetAttributes(String("zot.repository", repo))
+	}
+
+	span.SetAttributes(attrs...)
+
+	return span
+}
+
+func end(span *Span, err error) {
+	span.SetError(err)
+	span.End()
+}
+
+func (s *tracedStore) InitRepo(name string) error {
+	span := s.start("InitRepo", name)
+	err := s.ImageStore.InitRepo(name)
+	end(span, err)
+
+	return err
+}
+
+func (s *tracedStore) ValidateRepo(name string) (bool, error) {
+	span := s.start("ValidateRepo", name)
+	ok, err := s.ImageStore.ValidateRepo(name)
+	end(span, err)
+
+	return ok, err
+}
+
+func (s *tracedStore) DeleteRepo(name string) error {
+	span := s.start("DeleteRepo", name)
+	err := s.ImageStore.DeleteRepo(name)
+	end(span, err)
+
+	return err
+}
+
+func (s *tracedStore) GetRepositories() ([]string, error) {
+	span := s.start("GetRepositories", "")
+	repos, err := s.ImageStore.GetRepositories()
+	span.SetAttributes(Int64("zot.repositories", int64(len(repos))))
+	end(span, err)
+
+	return repos, err
+}
+
+func (s *tracedStore) GetImageTags(repo string) ([]string, error) {
+	span := s.start("GetImageTags", repo)
+	tags, err := s.ImageStore.GetImageTags(repo)
+	end(span, err)
+
+	return tags, err
+}
+
+func (s *tracedStore) GetIndexContent(repo string) ([]byte, error) {
+	span := s.start("GetIndexContent", repo)
+	buf, err := s.ImageStore.GetIndexContent(repo)
+	end(span, err)
+
+	return buf, err
+}
+
+func (s *tracedStore) GetImageManifest(repo string, reference string) ([]byte, string, string, error) {
+	span := s.start("GetImageManifest", repo, String("zot.reference", reference))
+	buf, digest, mediaType, err := s.ImageStore.GetImageManifest(repo, reference)
+	end(span, err)
+
+	return buf, digest, mediaType, err
+}
+
+func (s *tracedStore) PutImageManifest(repo string, reference string, mediaType string,
+	body []byte) (string, error) {
+	span := s.start("PutImageManifest", repo, String("zot.reference", reference))
+	digest, err := s.ImageStore.PutImageManifest(repo, reference, mediaType, body)
+	span.SetAttributes(String("zot.digest", digest))
+	s.tracer.wrote(repo, span)
+	end(span, err)
+
+	return digest, err
+}
+
+func (s *tracedStore) DeleteImageManifest(repo string, reference string) error {
+	span := s.start("DeleteImageManifest", repo, String("zot.reference", reference))
+	err := s.ImageStore.DeleteImageManifest(repo, reference)
+	s.tracer.wrote(repo, span)
+	end(span, err)
+
+	return err
+}
+
+func (s *tracedStore) DeleteImageTag(repo string, tag string) error {
+	span := s.start("DeleteImageTag", repo, String("zot.reference", tag))
+	err := s.ImageStore.DeleteImageTag(repo, tag)
+	s.tracer.wrote(repo, span)
+	end(span, err)
+
+	return err
+}
+
+func (s *tracedStore) GetReferrers(repo string, digest string, artifactType string) ([]storage.Referrer, error) {
+	span := s.start("GetReferrers", repo, String("zot.digest", digest))
+	referrers, err := s.ImageStore.GetReferrers(repo, digest, artifactType)
+	end(span, err)
+
+	return referrers, err
+}
+
+func (s *tracedStore) NewBlobUpload(repo string) (string, error) {
+	span := s.start("NewBlobUpload", repo)
+	uuid, err := s.ImageStore.NewBlobUpload(repo)
+	span.SetAttributes(String("zot.upload", uuid))
+	end(span, err)
+
+	return uuid, err
+}
+
+func (s *tracedStore) GetBlobUpload(repo string, uuid string) (int64, error) {
+	span := s.start("GetBlobUpload", repo, String("zot.upload", uuid))
+	size, err := s.ImageStore.GetBlobUpload(repo, uuid)
+	end(span, err)
+
+	return size, err
+}
+
+func (s *tracedStore) PutBlobChunkStreamed(repo string, uuid string, body io.Reader) (int64, error) {
+	span := s.start("PutBlobChunkStreamed", repo, String("zot.upload", uuid))
+	size, err := s.ImageStore.PutBlobChunkStreamed(repo, uuid, body)
+	span.SetAttributes(Int64("zot.size", size))
+	end(span, err)
+
+	return size, err
+}
+
+func (s *tracedStore) PutBlobChunk(repo string, uuid string, from int64, to int64, body io.Reader) (int64, error) {
+	span := s.start("PutBlobChunk", repo, String("zot.upload", uuid), Int64("zot.from", from),
+		Int64("zot.to", to))
+	size, err := s.ImageStore.PutBlobChunk(repo, uuid, from, to, body)
+	end(span, err)
+
+	return size, err
+}
+
+func (s *tracedStore) BlobUploadInfo(repo string, uuid string) (int64, error) {
+	span := s.start("BlobUploadInfo", repo, String("zot.upload", uuid))
+	size, err := s.ImageStore.BlobUploadInfo(repo, uuid)
+	end(span, err)
+
+	return size, err
+}
+
+func (s *tracedStore) FinishBlobUpload(repo string, uuid string, body io.Reader, digest string) error {
+	span := s.start("FinishBlobUpload", repo, String("zot.upload", uuid), String("zot.digest", digest))
+	finished := s.tracer.finishing(repo, digest, span)
+	err := s.ImageStore.FinishBlobUpload(repo, uuid, body, digest)
+	finished()
+	end(span, err)
+
+	return err
+}
+
+func (s *tracedStore) FullBlobUpload(repo string, body io.Reader, digest string) (string, int64, error) {
+	span := s.start("FullBlobUpload", repo, String("zot.digest", digest))
+	finished := s.tracer.finishing(repo, digest, span)
+	uuid, size, err := s.ImageStore.FullBlobUpload(repo, body, digest)
+	finished()
+	span.SetAttributes(Int64("zot.size", size))
+	end(span, err)
+
+	return uuid, size, err
+}
+
+func (s *tracedStore) MountBlob(repo string, digest string) (bool, int64, error) {
+	span := s.start("MountBlob", repo, String("zot.digest", digest))
+	ok, size, err := s.ImageStore.MountBlob(repo, digest)
+	end(span, err)
+
+	return ok, size, err
+}
+
+func (s *tracedStore) DeleteBlobUpload(repo string, uuid string) error {
+	span := s.start("DeleteBlobUpload", repo, String("zot.upload", uuid))
+	err := s.ImageStore.DeleteBlobUpload(repo, uuid)
+	end(span, err)
+
+	return err
+}
+
+func (s *tracedStore) CheckBlob(repo string, digest string, mediaType string) (bool, int64, error) {
+	span := s.start("CheckBlob", repo, String("zot.digest", digest))
+	ok, size, err := s.ImageStore.CheckBlob(repo, digest, mediaType)
+	end(span, err)
+
+	return ok, size, err
+}
+
+func (s *tracedStore) GetBlob(repo string, digest string, mediaType string) (io.Reader, int64, error) {
+	span := s.start("GetBlob", repo, String("zot.digest", digest))
+	r, size, err := s.ImageStore.GetBlob(repo, digest, mediaType)
+	span.SetAttributes(Int64("zot.size", size))
+	end(span, err)
+
+	return r, size, err
+}
+
+func (s *tracedStore) GetBlobPartial(repo string, digest string, mediaType string, from int64,
+	to int64) (io.Reader, int64, int64, error) {
+	span := s.start("GetBlobPartial", repo, String("zot.digest", digest), Int64("zot.from", from),
+		Int64("zot.to", to))
+	r, length, size, err := s.ImageStore.GetBlobPartial(repo, digest, mediaType, from, to)
+	end(span, err)
+
+	return r, length, size, err
+}
+
+func (s *tracedStore) DeleteBlob(repo string, digest string) error {
+	span := s.start("DeleteBlob", repo, String("zot.digest", digest))
+	err := s.ImageStore.DeleteBlob(repo, digest)
+	s.tracer.wrote(repo, span)
+	end(span, err)
+
+	return err
+}
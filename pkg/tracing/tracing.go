@@ -0,0 +1,377 @@
+// Package tracing traces requests, and the storage operations serving them, with OpenTelemetry
+// spans exported over OTLP/HTTP, e.g. to find where slow pushes spend their time.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/metrics"
+)
+
+const (
+	// ExporterOTLP posts spans to an OpenTelemetry collector over OTLP/HTTP, in JSON.
+	ExporterOTLP = "otlp"
+
+	// ExporterJaeger posts spans to a Jaeger collector, which receives OTLP as of Jaeger 1.35.
+	ExporterJaeger = "jaeger"
+
+	// DefaultEndpoint is the OTLP/HTTP traces endpoint of a collector, or Jaeger, on localhost.
+	DefaultEndpoint = "http://localhost:4318/v1/traces"
+
+	defaultServiceName = "zot"
+
+	// TraceparentHeader carries the trace context of requests, as of W3C Trace Context.
+	TraceparentHeader = "traceparent"
+)
+
+// span kinds, as of OTLP.
+const (
+	kindInternal = 1
+	kindServer   = 2
+)
+
+type Config struct {
+	Exporter string            // ExporterOTLP, if not set, or ExporterJaeger
+	Endpoint string            // spans are posted to, DefaultEndpoint if not set
+	Headers  map[string]string // e.g. Authorization
+	// ServiceName spans are reported under, "zot" if not set
+	ServiceName string
+	// SampleRatio is the ratio of the traces started by zot, rather than by its clients, which
+	// are recorded, all if not set
+	SampleRatio *float64
+}
+
+// Validate checks the exporter is known, the endpoint is an HTTP URL and the ratio a ratio.
+func (c *Config) Validate(log log.Logger) error {
+	if c.Exporter != "" && c.Exporter != ExporterOTLP && c.Exporter != ExporterJaeger {
+		log.Error().Str("exporter", c.Exporter).Msg("unknown tracing exporter")
+		return errors.ErrBadConfig
+	}
+
+	if c.Endpoint != "" {
+		u, err := url.Parse(c.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Error().Str("endpoint", c.Endpoint).Msg("invalid tracing endpoint")
+			return errors.ErrBadConfig
+		}
+	}
+
+	if c.SampleRatio != nil && (*c.SampleRatio < 0 || *c.SampleRatio > 1) {
+		log.Error().Float64("sampleRatio", *c.SampleRatio).Msg("invalid tracing sample ratio")
+		return errors.ErrBadConfig
+	}
+
+	return nil
+}
+
+// SpanContext identifies a span across processes.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid tells whether the context identifies a span.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent returns the context as the value of a traceparent header.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// ParseTraceparent returns the span context of the value of a traceparent header, false if it's
+// not one.
+func ParseTraceparent(h string) (SpanContext, bool) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(h), "-")
+
+	// later versions may add fields, but not change these
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(sc.TraceID) {
+		return sc, false
+	}
+
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(sc.SpanID) {
+		return sc, false
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&1 == 1
+
+	return sc, sc.IsValid()
+}
+
+// Attribute describes a span, its value being a string, an int64 or a bool.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string attribute.
+func String(key string, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int64 returns an integer attribute.
+func Int64(key string, value int64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Span is an operation traced, recorded once ended if its trace is sampled. Its methods may
+// be called on a nil span, doing nothing.
+type Span struct {
+	tracer  *Tracer
+	context SpanContext
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+
+	lock  sync.Mutex
+	end   time.Time
+	attrs []Attribute
+	links []SpanContext
+	err   string // status message, if failed
+	ended bool
+}
+
+// Context returns the context identifying the span, e.g. to propagate it.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+
+	return s.context
+}
+
+// SetAttributes adds attributes to the span, replacing those of the same keys.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil || !s.context.Sampled {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+next:
+	for _, a := range attrs {
+		for i := range s.attrs {
+			if s.attrs[i].Key == a.Key {
+				s.attrs[i] = a
+				continue next
+			}
+		}
+
+		s.attrs = append(s.attrs, a)
+	}
+}
+
+// SetError marks the span failed with err, if not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.setStatus(err.Error())
+}
+
+func (s *Span) setStatus(message string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.err = message
+}
+
+// End ends the span, exporting it if sampled. Spans are ended once, later calls doing nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+
+	s.ended = true
+	s.end = time.Now()
+	s.lock.Unlock()
+
+	if s.context.Sampled {
+		s.tracer.export(s)
+	}
+}
+
+type contextKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying span, for operations done on its behalf to be
+// traced as its children.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, contextKey{}, span)
+}
+
+// SpanFromContext returns the span carried by ctx, nil if none.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(contextKey{}).(*Span)
+
+	return span
+}
+
+// Tracer starts spans and exports those sampled to the endpoint of its config, in batches.
+type Tracer struct {
+	dropped  int64 // spans not exported for the queue being full, since logged; first, to be aligned
+	config   *Config
+	ratio    float64
+	client   *http.Client
+	queue    chan *Span
+	log      log.Logger
+	lock     sync.Mutex
+	finishes map[string]*Span       // of blob uploads being finished, by repository and digest
+	writes   map[string]SpanContext // last written to repositories by, until collected garbage in
+}
+
+// NewTracer returns a tracer with a valid config, whose spans are exported once it runs.
+func NewTracer(config *Config, log log.Logger) *Tracer {
+	ratio := 1.0
+	if config.SampleRatio != nil {
+		ratio = *config.SampleRatio
+	}
+
+	return &Tracer{
+		config:   config,
+		ratio:    ratio,
+		client:   &http.Client{Timeout: exportTimeout},
+		queue:    make(chan *Span, queueSize),
+		log:      log,
+		finishes: make(map[string]*Span),
+		writes:   make(map[string]SpanContext),
+	}
+}
+
+// Start starts a span, a child of the one carried by ctx, if any, returning a copy of ctx
+// carrying it.
+func (t *Tracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	span := t.start(SpanFromContext(ctx).Context(), name, kindInternal)
+	span.SetAttributes(attrs...)
+
+	return ContextWithSpan(ctx, span), span
+}
+
+// start starts a span, a child of parent if valid, or the root of a trace otherwise, sampled if
+// its parent is, or as of the sample ratio if a root.
+func (t *Tracer) start(parent SpanContext, name string, kind int) *Span {
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+
+	if parent.IsValid() {
+		span.context.TraceID = parent.TraceID
+		span.context.Sampled = parent.Sampled
+		span.parent = parent.SpanID
+	} else {
+		_, _ = rand.Read(span.context.TraceID[:])
+		span.context.Sampled = t.sampled(span.context.TraceID)
+	}
+
+	_, _ = rand.Read(span.context.SpanID[:])
+
+	return span
+}
+
+// sampled tells whether to record a trace started here, from the random bits of its id, for
+// every process seeing it to decide the same.
+func (t *Tracer) sampled(traceID [16]byte) bool {
+	if t.ratio >= 1 {
+		return true
+	}
+
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < uint64(t.ratio*(1<<63))
+}
+
+// Instrument is a middleware tracing requests, as children of the spans of their clients, if
+// given in their traceparent header.
+func (t *Tracer) Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent, _ := ParseTraceparent(r.Header.Get(TraceparentHeader))
+
+		route := metrics.RouteOf(r)
+
+		name := r.Method
+		if route != "" {
+			name += " " + route
+		}
+
+		span := t.start(parent, name, kindServer)
+		span.SetAttributes(String("http.method", r.Method), String("http.route", route),
+			String("http.target", r.URL.Path), String("http.user_agent", r.UserAgent()),
+			String("net.peer.addr", r.RemoteAddr))
+
+		sw := &statusWriter{ResponseWriter: w}
+
+		next.ServeHTTP(sw, r.WithContext(ContextWithSpan(r.Context(), span)))
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		span.SetAttributes(Int64("http.status_code", int64(sw.status)))
+
+		if sw.status >= http.StatusInternalServerError {
+			span.setStatus(http.StatusText(sw.status))
+		}
+
+		span.End()
+	})
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,307 @@
+package tracing_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/tracing"
+	"github.com/gorilla/mux"
+	godigest "github.com/opencontainers/go-digest"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type span struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Attributes   []struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+			IntValue    string `json:"intValue"`
+		} `json:"value"`
+	} `json:"attributes"`
+	Links []struct {
+		SpanID string `json:"spanId"`
+	} `json:"links"`
+	Status struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+func (s span) attribute(key string) string {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value.StringValue + a.Value.IntValue
+		}
+	}
+
+	return ""
+}
+
+// collector receives the spans exported over OTLP/HTTP, by name.
+type collector struct {
+	lock    sync.Mutex
+	spans   map[string][]span
+	service string
+	auth    string
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []struct {
+					Value struct {
+						StringValue string `json:"stringValue"`
+					} `json:"value"`
+				} `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []span `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+
+	if r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&req) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.auth = r.Header.Get("Authorization")
+
+	for _, rs := range req.ResourceSpans {
+		c.service = rs.Resource.Attributes[0].Value.StringValue
+
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				c.spans[s.Name] = append(c.spans[s.Name], s)
+			}
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	Convey("Validate tracing configurations", t, func() {
+		log := log.NewLogger("debug", "")
+
+		half, over := 0.5, 1.5
+
+		So((&tracing.Config{}).Validate(log), ShouldBeNil)
+		So((&tracing.Config{Exporter: tracing.ExporterJaeger, Endpoint: "https://jaeger:4318/v1/traces",
+			SampleRatio: &half}).Validate(log), ShouldBeNil)
+
+		for _, c := range []tracing.Config{{Exporter: "zipkin"}, {Endpoint: "jaeger:4318"},
+			{Endpoint: "grpc://collector:4317"}, {SampleRatio: &over}} {
+			So(c.Validate(log), ShouldEqual, errors.ErrBadConfig)
+		}
+	})
+}
+
+func TestTraceparent(t *testing.T) {
+	Convey("Parse and format traceparent headers", t, func() {
+		h := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+		sc, ok := tracing.ParseTraceparent(h)
+		So(ok, ShouldBeTrue)
+		So(sc.Sampled, ShouldBeTrue)
+		So(sc.Traceparent(), ShouldEqual, h)
+
+		sc, ok = tracing.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+		So(ok, ShouldBeTrue)
+		So(sc.Sampled, ShouldBeFalse)
+
+		// later versions may have more fields
+		_, ok = tracing.ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-more")
+		So(ok, ShouldBeTrue)
+
+		for _, h := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+			"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+			"00-4bf92f3577b34da6-00f067aa0ba902b7-01", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-more"} {
+			_, ok := tracing.ParseTraceparent(h)
+			So(ok, ShouldBeFalse)
+		}
+	})
+}
+
+func TestSampling(t *testing.T) {
+	Convey("Sample the traces started here as of the ratio", t, func() {
+		log := log.NewLogger("debug", "")
+
+		none := 0.0
+		tracer := tracing.NewTracer(&tracing.Config{SampleRatio: &none}, log)
+
+		ctx, root := tracer.Start(context.Background(), "maintenance")
+		So(root.Context().IsValid(), ShouldBeTrue)
+		So(root.Context().Sampled, ShouldBeFalse)
+
+		_, child := tracer.Start(ctx, "child")
+		So(child.Context().TraceID, ShouldResemble, root.Context().TraceID)
+		So(child.Context().SpanID, ShouldNotResemble, root.Context().SpanID)
+		So(child.Context().Sampled, ShouldBeFalse)
+
+		tracer = tracing.NewTracer(&tracing.Config{}, log)
+
+		_, root = tracer.Start(context.Background(), "maintenance")
+		So(root.Context().Sampled, ShouldBeTrue)
+
+		// spans may be nil, e.g. those of contexts carrying none
+		var span *tracing.Span
+
+		So(func() {
+			span.SetAttributes(tracing.String("key", "value"))
+			span.SetError(errors.ErrBadConfig)
+			span.End()
+		}, ShouldNotPanic)
+		So(tracing.SpanFromContext(context.Background()), ShouldBeNil)
+	})
+}
+
+func TestTracer(t *testing.T) {
+	Convey("Trace requests and the storage operations serving them", t, func() {
+		dir, err := ioutil.TempDir("", "oci-repo-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		c := &collector{spans: map[string][]span{}}
+		server := httptest.NewServer(c)
+		defer server.Close()
+
+		log := log.NewLogger("debug", "")
+
+		tracer := tracing.NewTracer(&tracing.Config{Endpoint: server.URL + "/v1/traces", ServiceName: "registry",
+			Headers: map[string]string{"Authorization": "Bearer secret"}}, log)
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var wg sync.WaitGroup
+
+		tracer.Run(ctx, &wg)
+
+		local := storage.NewImageStore(dir, true, true, storage.Options{}, log)
+		So(local, ShouldNotBeNil)
+		local.SetTracer(tracer)
+
+		is := tracing.NewImageStore(local, tracer)
+
+		// untraced outside of requests
+		So(is.WithContext(context.Background()), ShouldEqual, local)
+
+		content := []byte("layer")
+		digest := godigest.FromBytes(content)
+
+		router := mux.NewRouter()
+		router.Use(tracer.Instrument)
+		router.HandleFunc("/v2/{name}/blobs/{digest}", func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+
+			if r.Method == http.MethodDelete {
+				if err := is.WithContext(r.Context()).DeleteBlob(vars["name"], vars["digest"]); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+
+				w.WriteHeader(http.StatusAccepted)
+
+				return
+			}
+
+			if _, _, err := is.WithContext(r.Context()).FullBlobUpload(vars["name"], r.Body,
+				vars["digest"]); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			w.WriteHeader(http.StatusCreated)
+		})
+
+		serve := func(method string, digest godigest.Digest, traceparent string) int {
+			req := httptest.NewRequest(method, "/v2/repo/blobs/"+digest.String(), bytes.NewReader(content))
+			req.Header.Set(tracing.TraceparentHeader, traceparent)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			return w.Code
+		}
+
+		// not sampled by the client
+		So(serve(http.MethodPut, digest, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"),
+			ShouldEqual, http.StatusCreated)
+
+		// sampled by the client
+		So(serve(http.MethodPut, digest, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"),
+			ShouldEqual, http.StatusCreated)
+
+		So(serve(http.MethodDelete, godigest.FromString("missing"),
+			"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"), ShouldEqual, http.StatusInternalServerError)
+
+		// dedupe is only traced within uploads
+		tracer.Trace("dedupe", "repo", digest.String())(nil)
+
+		// garbage collection is traced on its own, linked to the last write
+		tracer.Trace("gc", "repo", "")(nil)
+
+		cancel()
+		wg.Wait()
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		So(c.auth, ShouldEqual, "Bearer secret")
+		So(c.service, ShouldEqual, "registry")
+
+		puts := c.spans["PUT /v2/{name}/blobs/{digest}"]
+		So(len(puts), ShouldEqual, 1)
+		So(puts[0].TraceID, ShouldEqual, "4bf92f3577b34da6a3ce929d0e0e4736")
+		So(puts[0].ParentSpanID, ShouldEqual, "00f067aa0ba902b7")
+		So(puts[0].Kind, ShouldEqual, 2)
+		So(puts[0].attribute("http.status_code"), ShouldEqual, "201")
+
+		uploads := c.spans["storage.FullBlobUpload"]
+		So(len(uploads), ShouldEqual, 1)
+		So(uploads[0].TraceID, ShouldEqual, puts[0].TraceID)
+		So(uploads[0].ParentSpanID, ShouldEqual, puts[0].SpanID)
+		So(uploads[0].attribute("zot.repository"), ShouldEqual, "repo")
+		So(uploads[0].attribute("zot.size"), ShouldEqual, "5")
+
+		dedupes := c.spans["storage.dedupe"]
+		So(len(dedupes), ShouldEqual, 1)
+		So(dedupes[0].TraceID, ShouldEqual, puts[0].TraceID)
+		So(dedupes[0].ParentSpanID, ShouldEqual, uploads[0].SpanID)
+		So(dedupes[0].attribute("zot.digest"), ShouldEqual, digest.String())
+
+		deletes := c.spans["DELETE /v2/{name}/blobs/{digest}"]
+		So(len(deletes), ShouldEqual, 1)
+		So(deletes[0].Status.Code, ShouldEqual, 2)
+
+		blobDeletes := c.spans["storage.DeleteBlob"]
+		So(len(blobDeletes), ShouldEqual, 1)
+		So(blobDeletes[0].ParentSpanID, ShouldEqual, deletes[0].SpanID)
+		So(blobDeletes[0].Status.Code, ShouldEqual, 2)
+
+		gcs := c.spans["storage.gc"]
+		So(len(gcs), ShouldEqual, 1)
+		So(gcs[0].TraceID, ShouldNotEqual, deletes[0].TraceID)
+		So(gcs[0].ParentSpanID, ShouldBeEmpty)
+		So(len(gcs[0].Links), ShouldEqual, 1)
+		So(gcs[0].Links[0].SpanID, ShouldEqual, blobDeletes[0].SpanID)
+	})
+}
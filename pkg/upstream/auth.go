@@ -0,0 +1,45 @@
+package upstream
+
+import (
+	"os"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/docker/cli/cli/config/configfile"
+)
+
+// dockerHubAuthKey is the key docker stores the credentials of Docker Hub under.
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// authFileCredentials looks up the credentials for a registry host in a docker config.json
+// or containers auth.json file, from the file itself or from the credential helper it
+// configures for the host, e.g. docker-credential-ecr-login.
+func authFileCredentials(path string, host string) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	cf := configfile.New(path)
+	if err := cf.LoadFromReader(f); err != nil {
+		return "", "", err
+	}
+
+	switch host {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		host = dockerHubAuthKey
+	}
+
+	auth, err := cf.GetAuthConfig(host)
+	if err != nil {
+		return "", "", err
+	}
+
+	// identity tokens are OAuth2 refresh tokens, which the token service flow used here
+	// can't exchange
+	if auth.IdentityToken != "" {
+		return "", "", errors.ErrUpstreamUnauthorized
+	}
+
+	return auth.Username, auth.Password, nil
+}
@@ -0,0 +1,618 @@
+// Package upstream is a client for pulling content from other OCI registries, used
+// to mirror and proxy them, and for pushing content to them.
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+const (
+	// distContentDigestKey is the response header carrying a manifest's digest.
+	distContentDigestKey = "Docker-Content-Digest"
+
+	// how long to wait for an upstream registry to start responding.
+	responseHeaderTimeout = 30 * time.Second
+)
+
+// Config locates an upstream registry and the credentials to use with it.
+type Config struct {
+	URL      string
+	Username string
+	Password string
+	// AuthFile is a docker config.json or containers auth.json file to take the credentials
+	// for the registry from, if not given, e.g. from a credential helper
+	AuthFile  string
+	TLSVerify *bool  // verify the registry's certificate, true if not set
+	CACert    string // CA certificate to verify the registry's certificate with, if not a well-known one
+}
+
+// Status is the health of syncing with a registry, mirrored from or replicated to, for
+// dashboards and alerting on stale mirrors.
+type Status struct {
+	Kind      string     `json:"kind"` // e.g. "mirror" or "destination"
+	Name      string     `json:"name,omitempty"`
+	URL       string     `json:"url"`
+	LastSync  *time.Time `json:"lastSync"` // last time it was synced with, if ever
+	Lag       int        `json:"lag"`      // tags behind, as of the last sync
+	LastError string     `json:"lastError,omitempty"`
+	// BytesTransferred is how much was sent to, and received from, the registry so far
+	BytesTransferred int64 `json:"bytesTransferred"`
+}
+
+// Client pulls content from, or pushes it to, an upstream registry, authenticating with basic credentials
+// or with bearer tokens obtained from the registry's token service.
+type Client struct {
+	config      Config
+	http        *http.Client
+	log         log.Logger
+	transferred int64 // bytes sent and received, accessed atomically
+
+	lock    sync.Mutex
+	tokens  map[string]string // by repository
+	uploads map[string]string // IDs of interrupted blob uploads, by repository and digest
+}
+
+// NewClient returns a client for the registry described by config.
+func NewClient(config Config, log log.Logger) (*Client, error) {
+	if _, err := url.Parse(config.URL); err != nil || config.URL == "" {
+		log.Error().Err(err).Str("url", config.URL).Msg("invalid upstream registry URL")
+		return nil, errors.ErrBadConfig
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.TLSVerify != nil && !*config.TLSVerify {
+		tlsConfig.InsecureSkipVerify = true //nolint: gosec
+	}
+
+	if config.CACert != "" {
+		caCert, err := ioutil.ReadFile(config.CACert)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, errors.ErrBadCACert
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.ResponseHeaderTimeout = responseHeaderTimeout
+
+	c := &Client{
+		config:  config,
+		log:     log,
+		tokens:  make(map[string]string),
+		uploads: make(map[string]string),
+	}
+	c.http = &http.Client{Transport: &countingTransport{RoundTripper: transport, count: &c.transferred}}
+
+	return c, nil
+}
+
+// URL returns the URL of the upstream registry.
+func (c *Client) URL() string {
+	return c.config.URL
+}
+
+// Transferred returns how many bytes of request and response bodies were sent to, and
+// received from, the registry so far.
+func (c *Client) Transferred() int64 {
+	return atomic.LoadInt64(&c.transferred)
+}
+
+// GetManifest returns the contents, media type and digest of a manifest, accepting the
+// given media types. The contents are verified against the reference if it's a digest,
+// and against the digest reported by the registry, if any.
+func (c *Client) GetManifest(repo string, reference string, mediaTypes ...string) ([]byte, string,
+	godigest.Digest, error) {
+	req, err := http.NewRequest(http.MethodGet, c.endpoint(repo, "manifests", reference), nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	req.Header.Set("Accept", strings.Join(mediaTypes, ", "))
+
+	resp, err := c.do(req, repo)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+
+	if err := c.checkStatus(resp, errors.ErrManifestNotFound); err != nil {
+		return nil, "", "", err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	digest := godigest.FromBytes(body)
+
+	for _, expected := range []string{reference, resp.Header.Get(distContentDigestKey)} {
+		if d, err := godigest.Parse(expected); err == nil && d != digest {
+			c.log.Error().Str("repo", repo).Str("reference", reference).Str("expected", d.String()).
+				Str("actual", digest.String()).Msg("upstream manifest doesn't match its digest")
+
+			return nil, "", "", errors.ErrUpstreamDigestMismatch
+		}
+	}
+
+	return body, resp.Header.Get("Content-Type"), digest, nil
+}
+
+// GetBlob returns the contents and size of a blob, which the caller must close. Reading
+// the contents fails with ErrUpstreamDigestMismatch if they don't match the digest.
+func (c *Client) GetBlob(repo string, digest godigest.Digest) (io.ReadCloser, int64, error) {
+	if err := digest.Validate(); err != nil {
+		return nil, -1, errors.ErrBadBlobDigest
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.endpoint(repo, "blobs", digest.String()), nil)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	resp, err := c.do(req, repo)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	if err := c.checkStatus(resp, errors.ErrBlobNotFound); err != nil {
+		resp.Body.Close()
+		return nil, -1, err
+	}
+
+	return &verifier{ReadCloser: resp.Body, verifier: digest.Verifier(), digest: digest, log: c.log},
+		resp.ContentLength, nil
+}
+
+// CheckBlob returns whether the registry has a blob.
+func (c *Client) CheckBlob(repo string, digest godigest.Digest) (bool, error) {
+	req, err := http.NewRequest(http.MethodHead, c.endpoint(repo, "blobs", digest.String()), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.do(req, repo)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch err := c.checkStatus(resp, errors.ErrBlobNotFound); err {
+	case nil:
+		return true, nil
+	case errors.ErrBlobNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// getBlobFrom returns the contents of a blob from an offset on, which the caller must close,
+// asking for a range if the offset isn't 0. The contents aren't verified.
+func (c *Client) getBlobFrom(repo string, digest godigest.Digest, offset int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, c.endpoint(repo, "blobs", digest.String()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := c.do(req, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > 0 && resp.StatusCode == http.StatusPartialContent {
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			resp.Body.Close()
+			c.log.Error().Str("url", req.URL.String()).Str("range", resp.Header.Get("Content-Range")).
+				Int64("offset", offset).Msg("unexpected range from upstream registry")
+
+			return nil, errors.ErrUpstreamBadResponse
+		}
+
+		return resp.Body, nil
+	}
+
+	if err := c.checkStatus(resp, errors.ErrBlobNotFound); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	// ranges aren't supported, so skip what we already have
+	if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// verifier fails the last read of a blob if its contents don't match its digest.
+type verifier struct {
+	io.ReadCloser
+	verifier godigest.Verifier
+	digest   godigest.Digest
+	log      log.Logger
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	_, _ = v.verifier.Write(p[:n])
+
+	if err == io.EOF && !v.verifier.Verified() {
+		v.log.Error().Str("digest", v.digest.String()).Msg("upstream blob doesn't match its digest")
+		return n, errors.ErrUpstreamDigestMismatch
+	}
+
+	return n, err
+}
+
+// countingTransport counts the bytes of the request bodies sent, as long as the registry
+// responds, and of the response bodies read.
+type countingTransport struct {
+	http.RoundTripper
+	count *int64
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.ContentLength > 0 {
+		atomic.AddInt64(t.count, req.ContentLength)
+	}
+
+	resp.Body = &countingReader{ReadCloser: resp.Body, count: t.count}
+
+	return resp, nil
+}
+
+type countingReader struct {
+	io.ReadCloser
+	count *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+
+	return n, err
+}
+
+// GetTags returns the tags of a repository.
+func (c *Client) GetTags(repo string) ([]string, error) {
+	var tags []string
+
+	err := c.getList(c.endpoint(repo, "tags", "list"), repo, func(body []byte) error {
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+
+		if err := json.Unmarshal(body, &page); err != nil {
+			return err
+		}
+
+		tags = append(tags, page.Tags...)
+
+		return nil
+	})
+
+	return tags, err
+}
+
+// GetRepositories returns the repositories of the registry.
+func (c *Client) GetRepositories() ([]string, error) {
+	var repos []string
+
+	err := c.getList(strings.TrimSuffix(c.config.URL, "/")+"/v2/_catalog", "", func(body []byte) error {
+		var page struct {
+			Repositories []string `json:"repositories"`
+		}
+
+		if err := json.Unmarshal(body, &page); err != nil {
+			return err
+		}
+
+		repos = append(repos, page.Repositories...)
+
+		return nil
+	})
+
+	return repos, err
+}
+
+// getList gets each page of a paginated list, following the "next" links of the responses.
+func (c *Client) getList(url string, repo string, page func(body []byte) error) error {
+	for url != "" {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := c.do(req, repo)
+		if err != nil {
+			return err
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if err != nil {
+			return err
+		}
+
+		if err := c.checkStatus(resp, errors.ErrRepoNotFound); err != nil {
+			return err
+		}
+
+		if err := page(body); err != nil {
+			c.log.Error().Err(err).Str("url", url).Msg("invalid list from upstream registry")
+			return errors.ErrUpstreamBadResponse
+		}
+
+		url = nextLink(resp)
+	}
+
+	return nil
+}
+
+// nextLink returns the URL of the next page from a `Link: </v2/_catalog?n=2&last=b>; rel="next"` header.
+func nextLink(resp *http.Response) string {
+	link := resp.Header.Get("Link")
+	if link == "" || !strings.Contains(link, `rel="next"`) {
+		return ""
+	}
+
+	start, end := strings.Index(link, "<"), strings.Index(link, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+
+	next, err := resp.Request.URL.Parse(link[start+1 : end])
+	if err != nil {
+		return ""
+	}
+
+	return next.String()
+}
+
+func (c *Client) endpoint(repo string, kind string, reference string) string {
+	return fmt.Sprintf("%s/v2/%s/%s/%s", strings.TrimSuffix(c.config.URL, "/"), repo, kind, reference)
+}
+
+func (c *Client) checkStatus(resp *http.Response, notFound error) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return notFound
+	default:
+		c.log.Error().Str("url", resp.Request.URL.String()).Int("status", resp.StatusCode).
+			Msg("unexpected response from upstream registry")
+
+		return errors.ErrUpstreamBadResponse
+	}
+}
+
+// do sends a request, authenticating as the registry challenges it to, if needed.
+func (c *Client) do(req *http.Request, repo string) (*http.Response, error) {
+	c.lock.Lock()
+	token := c.tokens[repo]
+	c.lock.Unlock()
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if c.config.Username != "" {
+		req.SetBasicAuth(c.config.Username, c.config.Password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.log.Error().Err(err).Str("url", req.URL.String()).Msg("unable to reach upstream registry")
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	resp.Body.Close()
+
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+
+	switch scheme {
+	case "bearer":
+		username, password, err := c.credentials()
+		if err != nil {
+			return nil, err
+		}
+
+		token, err := c.getToken(params, username, password)
+		if err != nil {
+			return nil, err
+		}
+
+		c.lock.Lock()
+		c.tokens[repo] = token
+		c.lock.Unlock()
+
+		req.Header.Set("Authorization", "Bearer "+token)
+	case "basic":
+		username, password, err := c.credentials()
+		if err != nil {
+			return nil, err
+		}
+
+		if username == "" {
+			return nil, errors.ErrUpstreamUnauthorized
+		}
+
+		req.SetBasicAuth(username, password)
+	default:
+		return nil, errors.ErrUpstreamUnauthorized
+	}
+
+	// send the body again, if it can be
+	if req.GetBody != nil {
+		if req.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp, err = c.http.Do(req); err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		c.log.Error().Str("url", req.URL.String()).Msg("unauthorized by upstream registry")
+
+		return nil, errors.ErrUpstreamUnauthorized
+	}
+
+	return resp, nil
+}
+
+// credentials returns the username and password to authenticate with, looking them up in
+// the auth file, if any, when not configured.
+func (c *Client) credentials() (string, string, error) {
+	if c.config.Username != "" || c.config.AuthFile == "" {
+		return c.config.Username, c.config.Password, nil
+	}
+
+	u, err := url.Parse(c.config.URL)
+	if err != nil {
+		return "", "", err
+	}
+
+	username, password, err := authFileCredentials(c.config.AuthFile, u.Host)
+	if err != nil {
+		c.log.Error().Err(err).Str("authFile", c.config.AuthFile).Str("host", u.Host).
+			Msg("unable to get upstream credentials")
+	}
+
+	return username, password, err
+}
+
+// getToken obtains a token from the token service named in a bearer challenge.
+func (c *Client) getToken(params map[string]string, username string, password string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", errors.ErrUpstreamBadResponse
+	}
+
+	q := realm.Query()
+
+	for _, key := range []string{"service", "scope"} {
+		if v, ok := params[key]; ok {
+			q.Set(key, v)
+		}
+	}
+
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		c.log.Error().Str("realm", params["realm"]).Int("status", resp.StatusCode).Msg("unable to get upstream token")
+		return "", errors.ErrUpstreamUnauthorized
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	if body.Token != "" {
+		return body.Token, nil
+	}
+
+	return body.AccessToken, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header such as
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`.
+func parseChallenge(header string) (string, map[string]string) {
+	params := make(map[string]string)
+
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2) //nolint: gomnd
+	scheme := strings.ToLower(parts[0])
+
+	if len(parts) < 2 { //nolint: gomnd
+		return scheme, params
+	}
+
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimSpace(rest[eq+1:])
+
+		var value string
+
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+
+		params[key] = value
+		rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+	}
+
+	return scheme, params
+}
@@ -0,0 +1,332 @@
+package upstream_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	"github.com/anuvu/zot/pkg/test"
+	"github.com/anuvu/zot/pkg/upstream"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClient(t *testing.T) {
+	Convey("Pull from an upstream registry", t, func() {
+		manifest := []byte(`{"schemaVersion":2}`)
+		blob := []byte("blob")
+		tokenRequests := 0
+
+		var server *httptest.Server
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/token" {
+				user, pass, ok := r.BasicAuth()
+				if !ok || user != "user" || pass != "pass" || r.URL.Query().Get("scope") != "repository:repo:pull" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+
+				tokenRequests++
+
+				fmt.Fprint(w, `{"access_token":"token"}`)
+
+				return
+			}
+
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+					`Bearer realm="%s/token",service="registry",scope="repository:repo:pull"`, server.URL))
+				w.WriteHeader(http.StatusUnauthorized)
+
+				return
+			}
+
+			switch r.URL.Path {
+			case "/v2/repo/manifests/1.0":
+				w.Header().Set("Content-Type", ispec.MediaTypeImageManifest)
+				_, _ = w.Write(manifest)
+			case "/v2/repo/blobs/" + godigest.FromBytes(blob).String():
+				_, _ = w.Write(blob)
+			case "/v2/repo/tags/list":
+				if r.URL.Query().Get("last") == "" {
+					w.Header().Set("Link", `</v2/repo/tags/list?n=1&last=1.0>; rel="next"`)
+					fmt.Fprint(w, `{"name":"repo","tags":["1.0"]}`)
+
+					return
+				}
+
+				fmt.Fprint(w, `{"name":"repo","tags":["2.0"]}`)
+			case "/v2/repo/manifests/drifted":
+				w.Header().Set("Docker-Content-Digest", godigest.FromBytes([]byte("other")).String())
+				_, _ = w.Write(manifest)
+			case "/v2/repo/manifests/" + godigest.FromBytes([]byte("other")).String():
+				_, _ = w.Write(manifest)
+			case "/v2/repo/blobs/" + godigest.FromBytes([]byte("expected")).String():
+				_, _ = w.Write([]byte("tampered"))
+			case "/v2/repo/manifests/fail":
+				w.WriteHeader(http.StatusInternalServerError)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer server.Close()
+
+		log := log.NewLogger("debug", "")
+
+		_, err := upstream.NewClient(upstream.Config{}, log)
+		So(err, ShouldEqual, errors.ErrBadConfig)
+
+		Convey("with credentials", func() {
+			c, err := upstream.NewClient(upstream.Config{URL: server.URL, Username: "user", Password: "pass"}, log)
+			So(err, ShouldBeNil)
+
+			body, mediaType, digest, err := c.GetManifest("repo", "1.0", ispec.MediaTypeImageManifest)
+			So(err, ShouldBeNil)
+			So(body, ShouldResemble, manifest)
+			So(mediaType, ShouldEqual, ispec.MediaTypeImageManifest)
+			So(digest, ShouldEqual, godigest.FromBytes(manifest))
+
+			r, _, err := c.GetBlob("repo", godigest.FromBytes(blob))
+			So(err, ShouldBeNil)
+			content, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(r.Close(), ShouldBeNil)
+			So(content, ShouldResemble, blob)
+
+			tags, err := c.GetTags("repo")
+			So(err, ShouldBeNil)
+			So(tags, ShouldResemble, []string{"1.0", "2.0"})
+
+			// the token is reused
+			So(tokenRequests, ShouldEqual, 1)
+
+			_, _, _, err = c.GetManifest("repo", "2.0")
+			So(err, ShouldEqual, errors.ErrManifestNotFound)
+
+			_, _, err = c.GetBlob("repo", godigest.FromBytes([]byte("missing")))
+			So(err, ShouldEqual, errors.ErrBlobNotFound)
+
+			// content not matching its digest
+			_, _, _, err = c.GetManifest("repo", "drifted")
+			So(err, ShouldEqual, errors.ErrUpstreamDigestMismatch)
+
+			_, _, _, err = c.GetManifest("repo", godigest.FromBytes([]byte("other")).String())
+			So(err, ShouldEqual, errors.ErrUpstreamDigestMismatch)
+
+			r, _, err = c.GetBlob("repo", godigest.FromBytes([]byte("expected")))
+			So(err, ShouldBeNil)
+			_, err = ioutil.ReadAll(r)
+			So(err, ShouldEqual, errors.ErrUpstreamDigestMismatch)
+			So(r.Close(), ShouldBeNil)
+
+			_, _, _, err = c.GetManifest("repo", "fail")
+			So(err, ShouldEqual, errors.ErrUpstreamBadResponse)
+		})
+
+		Convey("with credentials from an auth file", func() {
+			dir, err := ioutil.TempDir("", "upstream-test")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+
+			host := strings.TrimPrefix(server.URL, "http://")
+			auth := base64.StdEncoding.EncodeToString([]byte("user:pass"))
+			authFile := path.Join(dir, "config.json")
+
+			So(ioutil.WriteFile(authFile, []byte(fmt.Sprintf(`{"auths":{"%s":{"auth":"%s"}}}`, host, auth)), 0600),
+				ShouldBeNil)
+
+			c, err := upstream.NewClient(upstream.Config{URL: server.URL, AuthFile: authFile}, log)
+			So(err, ShouldBeNil)
+
+			_, _, _, err = c.GetManifest("repo", "1.0")
+			So(err, ShouldBeNil)
+
+			// or from the credential helper it names
+			helper := path.Join(dir, "docker-credential-test")
+			So(ioutil.WriteFile(helper, []byte("#!/bin/sh\nread host\n"+
+				`echo '{"ServerURL":"'$host'","Username":"user","Secret":"pass"}'`+"\n"), 0700), ShouldBeNil)
+			So(ioutil.WriteFile(authFile, []byte(fmt.Sprintf(`{"credHelpers":{"%s":"test"}}`, host)), 0600),
+				ShouldBeNil)
+
+			oldPath := os.Getenv("PATH")
+			defer os.Setenv("PATH", oldPath)
+			So(os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath), ShouldBeNil)
+
+			c, err = upstream.NewClient(upstream.Config{URL: server.URL, AuthFile: authFile}, log)
+			So(err, ShouldBeNil)
+
+			_, _, _, err = c.GetManifest("repo", "1.0")
+			So(err, ShouldBeNil)
+
+			c, err = upstream.NewClient(upstream.Config{URL: server.URL, AuthFile: path.Join(dir, "missing")}, log)
+			So(err, ShouldBeNil)
+
+			_, _, _, err = c.GetManifest("repo", "1.0")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("without credentials", func() {
+			c, err := upstream.NewClient(upstream.Config{URL: server.URL}, log)
+			So(err, ShouldBeNil)
+
+			_, _, _, err = c.GetManifest("repo", "1.0")
+			So(err, ShouldEqual, errors.ErrUpstreamUnauthorized)
+		})
+	})
+	Convey("Resume interrupted blob transfers", t, func() {
+		blob := []byte(strings.Repeat("layer", 1000))
+		digest := godigest.FromBytes(blob)
+
+		var ranges []string
+
+		interrupt, supportRanges, failRanges := true, true, false
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v2/repo/blobs/"+digest.String() {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			ranges = append(ranges, r.Header.Get("Range"))
+
+			var offset int
+
+			if supportRanges && r.Header.Get("Range") != "" {
+				if failRanges {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+
+				_, _ = fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset)
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(blob)-1, len(blob)))
+				w.Header().Set("Content-Length", fmt.Sprint(len(blob)-offset))
+				w.WriteHeader(http.StatusPartialContent)
+			} else {
+				w.Header().Set("Content-Length", fmt.Sprint(len(blob)))
+			}
+
+			if interrupt {
+				// the connection drops halfway through
+				interrupt = false
+				_, _ = w.Write(blob[offset : len(blob)/2])
+
+				return
+			}
+
+			_, _ = w.Write(blob[offset:])
+		}))
+		defer server.Close()
+
+		log := log.NewLogger("debug", "")
+
+		c, err := upstream.NewClient(upstream.Config{URL: server.URL}, log)
+		So(err, ShouldBeNil)
+
+		is := storage.NewImageStoreMem(log)
+
+		Convey("with ranges", func() {
+			So(c.CopyBlob(is, "repo", digest), ShouldBeNil)
+			So(ranges, ShouldResemble, []string{"", fmt.Sprintf("bytes=%d-", len(blob)/2)})
+
+			ok, _, err := is.CheckBlob("repo", digest.String(), "")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("without ranges", func() {
+			supportRanges = false
+
+			So(c.CopyBlob(is, "repo", digest), ShouldBeNil)
+			So(ranges, ShouldHaveLength, 2)
+
+			ok, _, err := is.CheckBlob("repo", digest.String(), "")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("on the next copy", func() {
+			failRanges = true
+
+			So(c.CopyBlob(is, "repo", digest), ShouldEqual, errors.ErrUpstreamBadResponse)
+
+			failRanges = false
+
+			So(c.CopyBlob(is, "repo", digest), ShouldBeNil)
+			So(ranges[len(ranges)-1], ShouldEqual, fmt.Sprintf("bytes=%d-", len(blob)/2))
+
+			r, _, err := is.GetBlob("repo", digest.String(), "")
+			So(err, ShouldBeNil)
+
+			buf, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(buf, ShouldResemble, blob)
+		})
+	})
+
+	Convey("Push to a registry", t, func() {
+		registry := test.NewRegistry()
+		defer registry.Close()
+
+		log := log.NewLogger("debug", "")
+
+		c, err := upstream.NewClient(upstream.Config{URL: registry.URL}, log)
+		So(err, ShouldBeNil)
+
+		is := storage.NewImageStoreMem(log)
+
+		img, err := test.GetRandomImage(64, 2)
+		So(err, ShouldBeNil)
+		So(test.WriteImageToStore(img, is, "repo", "1.0"), ShouldBeNil)
+
+		digest, err := c.PushImage(is, "repo", "1.0")
+		So(err, ShouldBeNil)
+
+		expected, err := img.Digest()
+		So(err, ShouldBeNil)
+		So(digest, ShouldEqual, expected)
+
+		mblob, err := img.ManifestBlob()
+		So(err, ShouldBeNil)
+
+		manifest, ok := registry.Manifest("repo", "1.0")
+		So(ok, ShouldBeTrue)
+		So(manifest, ShouldResemble, mblob)
+
+		for _, layer := range img.Layers {
+			blob, ok := registry.Blob("repo", godigest.FromBytes(layer).String())
+			So(ok, ShouldBeTrue)
+			So(blob, ShouldResemble, layer)
+		}
+
+		So(registry.Uploads(), ShouldEqual, 3)
+
+		// what's pushed is counted
+		transferred := int64(len(mblob)) + img.Manifest.Config.Size
+		for _, layer := range img.Layers {
+			transferred += int64(len(layer))
+		}
+
+		So(c.Transferred(), ShouldEqual, transferred)
+
+		// only what's missing is uploaded again
+		registry.DeleteBlob("repo", godigest.FromBytes(img.Layers[0]).String())
+
+		_, err = c.PushImage(is, "repo", "1.0")
+		So(err, ShouldBeNil)
+		So(registry.Uploads(), ShouldEqual, 4)
+
+		_, err = c.PushImage(is, "repo", "missing")
+		So(err, ShouldEqual, errors.ErrManifestNotFound)
+	})
+}
@@ -0,0 +1,211 @@
+package upstream
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"time"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/storage"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// how many times an interrupted blob transfer is resumed before giving up.
+	maxResumes = 5
+
+	// how long to wait before resuming a blob transfer, more each time.
+	resumeBackoff = 500 * time.Millisecond
+)
+
+// CopyImage stores an image, i.e. its manifest along with its config and layers, in is,
+// returning the digest of its manifest. Blobs already present are not copied again, and
+// the copy is skipped altogether if the image is up to date. Only OCI images are
+// supported for now.
+func (c *Client) CopyImage(is storage.ImageStore, repo string, reference string) (godigest.Digest, error) {
+	return c.copyImage(is, repo, reference, "")
+}
+
+// CopyPinnedImage copies an image like CopyImage, provided its manifest has the pinned digest.
+func (c *Client) CopyPinnedImage(is storage.ImageStore, repo string, reference string,
+	pinned godigest.Digest) (godigest.Digest, error) {
+	return c.copyImage(is, repo, reference, pinned)
+}
+
+func (c *Client) copyImage(is storage.ImageStore, repo string, reference string,
+	pinned godigest.Digest) (godigest.Digest, error) {
+	body, mediaType, digest, err := c.GetManifest(repo, reference, ispec.MediaTypeImageManifest)
+	if err != nil {
+		return "", err
+	}
+
+	if pinned != "" && digest != pinned {
+		c.log.Error().Str("repo", repo).Str("reference", reference).Str("pinned", pinned.String()).
+			Str("actual", digest.String()).Msg("upstream image has drifted from its pinned digest")
+
+		return "", errors.ErrUpstreamDigestMismatch
+	}
+
+	var manifest ispec.Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil || mediaType != ispec.MediaTypeImageManifest {
+		c.log.Error().Err(err).Str("repo", repo).Str("reference", reference).Str("mediaType", mediaType).
+			Msg("unsupported upstream manifest")
+
+		return "", errors.ErrBadManifest
+	}
+
+	if _, local, _, err := is.GetImageManifest(repo, reference); err == nil && local == digest.String() {
+		return digest, nil
+	}
+
+	if err := is.InitRepo(repo); err != nil {
+		return "", err
+	}
+
+	for _, desc := range append([]ispec.Descriptor{manifest.Config}, manifest.Layers...) {
+		if ok, _, err := is.CheckBlob(repo, desc.Digest.String(), desc.MediaType); err == nil && ok {
+			continue
+		}
+
+		if err := c.CopyBlob(is, repo, desc.Digest); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := is.PutImageManifest(repo, reference, ispec.MediaTypeImageManifest, body); err != nil {
+		return "", err
+	}
+
+	return digest, nil
+}
+
+// CopyBlob stores a blob in is, verifying its digest. Should the transfer be interrupted,
+// it resumes from where it stopped, a few times over, and failing that, the partial upload
+// is kept for the next copy of the blob to resume.
+func (c *Client) CopyBlob(is storage.ImageStore, repo string, digest godigest.Digest) error {
+	if err := digest.Validate(); err != nil {
+		return errors.ErrBadBlobDigest
+	}
+
+	uuid, offset, err := c.resumeUpload(is, repo, digest)
+	if err != nil {
+		return err
+	}
+
+	for resumes := 0; ; resumes++ {
+		n, err := c.transferBlob(is, repo, digest, uuid, offset)
+		offset += n
+
+		if err == nil {
+			break
+		}
+
+		if _, ok := err.(interruption); !ok || resumes == maxResumes {
+			c.log.Error().Err(err).Str("repo", repo).Str("digest", digest.String()).Int64("offset", offset).
+				Msg("unable to copy upstream blob")
+
+			c.lock.Lock()
+			c.uploads[repo+"@"+digest.String()] = uuid
+			c.lock.Unlock()
+
+			return err
+		}
+
+		c.log.Warn().Err(err).Str("repo", repo).Str("digest", digest.String()).Int64("offset", offset).
+			Msg("upstream blob transfer interrupted, resuming")
+		time.Sleep(time.Duration(resumes+1) * resumeBackoff)
+	}
+
+	if err := is.FinishBlobUpload(repo, uuid, nil, digest.String()); err != nil {
+		c.log.Error().Err(err).Str("repo", repo).Str("digest", digest.String()).Msg("unable to store upstream blob")
+		_ = is.DeleteBlobUpload(repo, uuid)
+
+		if err == errors.ErrBadBlobDigest {
+			return errors.ErrUpstreamDigestMismatch
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// resumeUpload returns the upload of a blob interrupted before, and how much of it was
+// transferred, or else a new upload. Uploads are taken out while in use, so that no two
+// copies of a blob share one.
+func (c *Client) resumeUpload(is storage.ImageStore, repo string, digest godigest.Digest) (string, int64, error) {
+	c.lock.Lock()
+	uuid, ok := c.uploads[repo+"@"+digest.String()]
+	delete(c.uploads, repo+"@"+digest.String())
+	c.lock.Unlock()
+
+	if ok {
+		if offset, err := is.GetBlobUpload(repo, uuid); err == nil {
+			c.log.Info().Str("repo", repo).Str("digest", digest.String()).Int64("offset", offset).
+				Msg("resuming upstream blob transfer")
+
+			return uuid, offset, nil
+		}
+	}
+
+	if err := is.InitRepo(repo); err != nil {
+		return "", -1, err
+	}
+
+	uuid, err := is.NewBlobUpload(repo)
+	if err != nil {
+		return "", -1, err
+	}
+
+	return uuid, 0, nil
+}
+
+// transferBlob appends the contents of a blob from an offset on to an upload, returning
+// how much was appended.
+func (c *Client) transferBlob(is storage.ImageStore, repo string, digest godigest.Digest, uuid string,
+	offset int64) (int64, error) {
+	r, err := c.getBlobFrom(repo, digest, offset)
+	if err != nil {
+		if _, ok := err.(net.Error); ok {
+			return 0, interruption{err}
+		}
+
+		return 0, err
+	}
+	defer r.Close()
+
+	tr := &trackingReader{Reader: r}
+
+	n, err := is.PutBlobChunkStreamed(repo, uuid, tr)
+	if n < 0 {
+		n = 0
+	}
+
+	if tr.err != nil {
+		return n, interruption{tr.err}
+	}
+
+	return n, err
+}
+
+// interruption is a failure to transfer from an upstream registry, which may be resumed.
+type interruption struct {
+	error
+}
+
+// trackingReader records the failure of a read, to tell it from one of the store.
+type trackingReader struct {
+	io.Reader
+	err error
+}
+
+func (r *trackingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+
+	return n, err
+}
@@ -0,0 +1,135 @@
+package upstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/anuvu/zot/errors"
+	"github.com/anuvu/zot/pkg/storage"
+	godigest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PushImage uploads an image of is, i.e. its config and layers and then its manifest, to
+// the registry, returning the digest of its manifest. Blobs the registry has already are
+// not uploaded again. Only OCI images are supported for now.
+func (c *Client) PushImage(is storage.ImageStore, repo string, reference string) (godigest.Digest, error) {
+	body, digest, mediaType, err := is.GetImageManifest(repo, reference)
+	if err != nil {
+		return "", err
+	}
+
+	var manifest ispec.Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil || mediaType != ispec.MediaTypeImageManifest {
+		c.log.Error().Err(err).Str("repo", repo).Str("reference", reference).Str("mediaType", mediaType).
+			Msg("unsupported manifest to push")
+
+		return "", errors.ErrBadManifest
+	}
+
+	for _, desc := range append([]ispec.Descriptor{manifest.Config}, manifest.Layers...) {
+		if ok, err := c.CheckBlob(repo, desc.Digest); err != nil {
+			return "", err
+		} else if ok {
+			continue
+		}
+
+		if err := c.pushBlob(is, repo, desc); err != nil {
+			return "", err
+		}
+	}
+
+	if err := c.PutManifest(repo, reference, mediaType, body); err != nil {
+		return "", err
+	}
+
+	return godigest.Digest(digest), nil
+}
+
+func (c *Client) pushBlob(is storage.ImageStore, repo string, desc ispec.Descriptor) error {
+	r, size, err := is.GetBlob(repo, desc.Digest.String(), desc.MediaType)
+	if err != nil {
+		return err
+	}
+
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	return c.PutBlob(repo, desc.Digest, r, size)
+}
+
+// PutBlob uploads a blob of the given size to the registry, in one go.
+func (c *Client) PutBlob(repo string, digest godigest.Digest, body io.Reader, size int64) error {
+	req, err := http.NewRequest(http.MethodPost, c.endpoint(repo, "blobs", "uploads/"), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req, repo)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if err := c.checkPushStatus(resp, http.StatusAccepted); err != nil {
+		return err
+	}
+
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		c.log.Error().Err(err).Str("repo", repo).Msg("upstream registry didn't locate blob upload")
+		return errors.ErrUpstreamBadResponse
+	}
+
+	q := location.Query()
+	q.Set("digest", digest.String())
+	location.RawQuery = q.Encode()
+
+	req, err = http.NewRequest(http.MethodPut, location.String(), body)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err = c.do(req, repo)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return c.checkPushStatus(resp, http.StatusCreated)
+}
+
+// PutManifest uploads a manifest to the registry under a tag or its digest.
+func (c *Client) PutManifest(repo string, reference string, mediaType string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPut, c.endpoint(repo, "manifests", reference), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", mediaType)
+
+	resp, err := c.do(req, repo)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return c.checkPushStatus(resp, http.StatusCreated)
+}
+
+func (c *Client) checkPushStatus(resp *http.Response, expected int) error {
+	if resp.StatusCode == expected {
+		return nil
+	}
+
+	c.log.Error().Str("url", resp.Request.URL.String()).Int("status", resp.StatusCode).
+		Msg("unexpected response from upstream registry")
+
+	return errors.ErrUpstreamBadResponse
+}
@@ -1 +1,128 @@
+// Package zot allows embedding a zot registry in another Go program.
+//
+//	r := zot.New(api.NewConfig(), zot.WithRootDirectory(dir), zot.WithPort("0"))
+//	if err := r.Start(ctx); err != nil {
+//		...
+//	}
+//	defer r.Stop(ctx)
+//	fmt.Println(r.Addr())
 package zot
+
+import (
+	"context"
+	"net"
+
+	"github.com/anuvu/zot/pkg/api"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+)
+
+// Option configures an embedded Registry.
+type Option func(r *Registry)
+
+// WithRootDirectory sets the storage root directory.
+func WithRootDirectory(dir string) Option {
+	return func(r *Registry) {
+		r.config.Storage.RootDirectory = dir
+	}
+}
+
+// WithAddress sets the address to listen on.
+func WithAddress(address string) Option {
+	return func(r *Registry) {
+		r.config.HTTP.Address = address
+	}
+}
+
+// WithPort sets the port to listen on, "0" picks a free port (see Registry.Addr).
+func WithPort(port string) Option {
+	return func(r *Registry) {
+		r.config.HTTP.Port = port
+	}
+}
+
+// WithLogger sets the logger used by the registry instead of one built from config.
+func WithLogger(logger log.Logger) Option {
+	return func(r *Registry) {
+		r.logger = &logger
+	}
+}
+
+// WithGC enables or disables garbage collection.
+func WithGC(gc bool) Option {
+	return func(r *Registry) {
+		r.config.Storage.GC = gc
+	}
+}
+
+// WithDedupe enables or disables blob deduplication.
+func WithDedupe(dedupe bool) Option {
+	return func(r *Registry) {
+		r.config.Storage.Dedupe = dedupe
+	}
+}
+
+// WithImageStore sets the image store used instead of one backed by the root directory,
+// e.g. storage.NewImageStoreMem for hermetic tests.
+func WithImageStore(is storage.ImageStore) Option {
+	return func(r *Registry) {
+		r.imgStore = is
+	}
+}
+
+// Registry is a zot registry running in-process.
+type Registry struct {
+	config   *api.Config
+	logger   *log.Logger
+	imgStore storage.ImageStore
+	ctrl     *api.Controller
+}
+
+// New returns a registry for the given config (api.NewConfig() if nil) and options.
+// The config is owned by the registry from here on.
+func New(config *api.Config, opts ...Option) *Registry {
+	if config == nil {
+		config = api.NewConfig()
+	}
+
+	r := &Registry{config: config}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	r.ctrl = api.NewController(r.config)
+	if r.logger != nil {
+		r.ctrl.Log = *r.logger
+	}
+
+	r.ctrl.ImageStore = r.imgStore
+
+	return r
+}
+
+// Start starts serving and returns once the registry is listening.
+// Cancelling ctx stops the registry's background work, e.g. garbage collection, but only Stop
+// stops serving.
+func (r *Registry) Start(ctx context.Context) error {
+	return r.ctrl.Start(ctx)
+}
+
+// Stop gracefully stops the registry, once started.
+func (r *Registry) Stop(ctx context.Context) error {
+	return r.ctrl.Stop(ctx)
+}
+
+// Addr returns the address the registry is listening on.
+func (r *Registry) Addr() net.Addr {
+	if r.ctrl.Listener == nil {
+		return nil
+	}
+
+	return r.ctrl.Listener.Addr()
+}
+
+// Controller returns the underlying controller.
+func (r *Registry) Controller() *api.Controller {
+	return r.ctrl
+}
@@ -0,0 +1,75 @@
+package zot_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/anuvu/zot"
+	"github.com/anuvu/zot/pkg/log"
+	"github.com/anuvu/zot/pkg/storage"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/resty.v1"
+)
+
+func TestEmbeddedRegistry(t *testing.T) {
+	Convey("Run an embedded registry", t, func() {
+		dir, err := ioutil.TempDir("", "zot-embed-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r := zot.New(nil, zot.WithRootDirectory(dir), zot.WithPort("0"), zot.WithGC(false))
+		So(r.Addr(), ShouldBeNil)
+		So(r.Start(ctx), ShouldBeNil)
+		So(r.Addr(), ShouldNotBeNil)
+		So(r.Controller(), ShouldNotBeNil)
+
+		resp, err := resty.R().Get(fmt.Sprintf("http://%s/v2/", r.Addr()))
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, 200)
+
+		So(r.Stop(context.Background()), ShouldBeNil)
+		_, err = resty.R().Get(fmt.Sprintf("http://%s/v2/", r.Addr()))
+		So(err, ShouldNotBeNil)
+		cancel()
+	})
+
+	Convey("Keep serving once its context is cancelled, until stopped", t, func() {
+		dir, err := ioutil.TempDir("", "zot-embed-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r := zot.New(nil, zot.WithRootDirectory(dir), zot.WithPort("0"))
+		So(r.Start(ctx), ShouldBeNil)
+
+		cancel()
+
+		resp, err := resty.R().Get(fmt.Sprintf("http://%s/v2/", r.Addr()))
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, 200)
+
+		So(r.Stop(context.Background()), ShouldBeNil)
+		_, err = resty.R().Get(fmt.Sprintf("http://%s/v2/", r.Addr()))
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Run an embedded registry on an in-memory image store", t, func() {
+		is := storage.NewImageStoreMem(log.NewLogger("debug", ""))
+		So(is.InitRepo("repo"), ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		r := zot.New(nil, zot.WithPort("0"), zot.WithImageStore(is))
+		So(r.Start(ctx), ShouldBeNil)
+		defer func() { _ = r.Stop(context.Background()) }()
+
+		resp, err := resty.R().Get(fmt.Sprintf("http://%s/v2/repo/tags/list", r.Addr()))
+		So(err, ShouldBeNil)
+		So(resp.StatusCode(), ShouldEqual, 200)
+	})
+}